@@ -0,0 +1,371 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "math/rand"
+    "os"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/config"
+    "github.com/aws/aws-sdk-go-v2/credentials"
+    "github.com/aws/aws-sdk-go-v2/service/bedrock"
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// throttleHalfLife controls how quickly an account recovers its full share
+// of traffic after being throttled
+const throttleHalfLife = 30 * time.Second
+
+// AccountConfig is one entry of the BEDROCK_ACCOUNTS_FILE list. Each account
+// must use exactly one credential source: a static key pair or a shared profile.
+type AccountConfig struct {
+    Name            string  `json:"name"`
+    Region          string  `json:"region,omitempty"`
+    Weight          float64 `json:"weight"`
+    AccessKeyID     string  `json:"access_key_id,omitempty"`
+    SecretAccessKey string  `json:"secret_access_key,omitempty"`
+    SessionToken    string  `json:"session_token,omitempty"`
+    Profile         string  `json:"profile,omitempty"`
+    EndpointURL     string  `json:"endpoint_url,omitempty"` // Overrides BEDROCK_ENDPOINT_URL for this account
+}
+
+// Account is a Bedrock runtime client for one set of credentials, along with
+// its throttling history
+type Account struct {
+    Name    string
+    Region  string
+    Weight  float64
+    client  *bedrockruntime.Client
+    control *bedrock.Client // Control plane, for the model catalog
+
+    // Calls the SDK has no operation for are signed by hand, see moderation.go
+    signing  aws.Config
+    endpoint string // The runtime endpoint, empty for the region's
+
+    mu            sync.Mutex
+    throttleScore float64 // Decaying count of recent throttles
+    scoreUpdated  time.Time
+}
+
+// AccountPool schedules invocations across accounts proportionally to their
+// weights, shifting traffic away from accounts that are being throttled
+type AccountPool struct {
+    accounts []*Account
+    retry    RetryConfig
+}
+
+// validateAccountConfigs rejects setups where it would be unclear which
+// credentials or share of traffic an account should get
+func validateAccountConfigs(configs []AccountConfig) error {
+    if len(configs) == 0 {
+        return fmt.Errorf("no accounts defined")
+    }
+
+    names := make(map[string]bool)
+    identities := make(map[string]string)
+    for i, cfg := range configs {
+        if cfg.Name == "" {
+            return fmt.Errorf("accounts[%d]: name is required", i)
+        }
+        if names[cfg.Name] {
+            return fmt.Errorf("accounts[%d]: duplicate account name %q", i, cfg.Name)
+        }
+        names[cfg.Name] = true
+
+        if cfg.Weight <= 0 || math.IsInf(cfg.Weight, 0) || math.IsNaN(cfg.Weight) {
+            return fmt.Errorf("accounts[%d] (%s): weight must be a positive number", i, cfg.Name)
+        }
+
+        hasKeys := cfg.AccessKeyID != "" || cfg.SecretAccessKey != ""
+        if hasKeys && (cfg.AccessKeyID == "" || cfg.SecretAccessKey == "") {
+            return fmt.Errorf("accounts[%d] (%s): access_key_id and secret_access_key must both be set", i, cfg.Name)
+        }
+        if hasKeys && cfg.Profile != "" {
+            return fmt.Errorf("accounts[%d] (%s): set either a key pair or a profile, not both", i, cfg.Name)
+        }
+        if !hasKeys && cfg.Profile == "" {
+            return fmt.Errorf("accounts[%d] (%s): credentials are required (key pair or profile)", i, cfg.Name)
+        }
+
+        // The same credentials in the same region listed twice would just double their weight
+        identity := cfg.AccessKeyID + "|" + cfg.Profile + "|" + cfg.Region
+        if other, dup := identities[identity]; dup {
+            return fmt.Errorf("accounts[%d] (%s): same credentials and region as account %q", i, cfg.Name, other)
+        }
+        identities[identity] = cfg.Name
+    }
+    return nil
+}
+
+// LoadAccountPool builds the account pool. With BEDROCK_ACCOUNTS_FILE set the
+// accounts are read from that JSON list, otherwise a single "default" account
+// is created from the standard AWS environment variables.
+func LoadAccountPool(defaultRegion string) (*AccountPool, error) {
+    var configs []AccountConfig
+
+    if path := os.Getenv("BEDROCK_ACCOUNTS_FILE"); path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil, fmt.Errorf("unable to read BEDROCK_ACCOUNTS_FILE: %v", err)
+        }
+        if err := json.Unmarshal(data, &configs); err != nil {
+            return nil, fmt.Errorf("invalid BEDROCK_ACCOUNTS_FILE: %v", err)
+        }
+        if err := validateAccountConfigs(configs); err != nil {
+            return nil, fmt.Errorf("invalid BEDROCK_ACCOUNTS_FILE: %v", err)
+        }
+    } else {
+        configs = []AccountConfig{{
+            Name:            "default",
+            Weight:          1,
+            AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+            SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+        }}
+    }
+
+    retryConfig, err := LoadRetryConfig()
+    if err != nil {
+        return nil, err
+    }
+
+    pool := &AccountPool{retry: retryConfig}
+    for _, cfg := range configs {
+        region := cfg.Region
+        if region == "" {
+            region = defaultRegion
+        }
+
+        opts := []func(*config.LoadOptions) error{config.WithRegion(region), config.WithRetryer(sdkRetryer)}
+        if cfg.Profile != "" {
+            opts = append(opts, config.WithSharedConfigProfile(cfg.Profile))
+        } else {
+            opts = append(opts, config.WithCredentialsProvider(
+                credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.SecretAccessKey, cfg.SessionToken),
+            ))
+        }
+
+        awsCfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
+        if err != nil {
+            return nil, fmt.Errorf("unable to load SDK config for account %s: %v", cfg.Name, err)
+        }
+
+        // A custom endpoint points the runtime client at a VPC endpoint, a
+        // proxy or a local fake instead of the regional service
+        endpoint := cfg.EndpointURL
+        if endpoint == "" {
+            endpoint = os.Getenv("BEDROCK_ENDPOINT_URL")
+        }
+        var clientOpts []func(*bedrockruntime.Options)
+        if endpoint != "" {
+            log.Printf("Bedrock account %s uses endpoint %s", cfg.Name, endpoint)
+            clientOpts = append(clientOpts, func(o *bedrockruntime.Options) { o.BaseEndpoint = aws.String(endpoint) })
+        }
+
+        pool.accounts = append(pool.accounts, &Account{
+            Name:     cfg.Name,
+            Region:   region,
+            Weight:   cfg.Weight,
+            client:   bedrockruntime.NewFromConfig(awsCfg, clientOpts...),
+            control:  bedrock.NewFromConfig(awsCfg),
+            signing:  awsCfg,
+            endpoint: endpoint,
+        })
+    }
+
+    if len(pool.accounts) > 1 {
+        for _, account := range pool.accounts {
+            log.Printf("Bedrock account %s (%s) weight %g", account.Name, account.Region, account.Weight)
+        }
+    }
+    return pool, nil
+}
+
+// effectiveWeight is the configured weight scaled down by recent throttling
+func (a *Account) effectiveWeight(now time.Time) float64 {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    return a.Weight / (1 + a.decayedScore(now))
+}
+
+// decayedScore must be called with a.mu held
+func (a *Account) decayedScore(now time.Time) float64 {
+    if a.throttleScore == 0 {
+        return 0
+    }
+    elapsed := now.Sub(a.scoreUpdated)
+    a.throttleScore *= math.Pow(0.5, elapsed.Seconds()/throttleHalfLife.Seconds())
+    a.scoreUpdated = now
+    if a.throttleScore < 0.01 {
+        a.throttleScore = 0
+    }
+    return a.throttleScore
+}
+
+func (a *Account) recordThrottle(now time.Time) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    a.throttleScore = a.decayedScore(now) + 1
+    a.scoreUpdated = now
+    throttlePressure.record(now)
+}
+
+// throttleGauge is a pool-wide decaying throttle count. Writers serialize on
+// mu, but readers only load the atomics, so it's cheap enough to consult on
+// every response.
+type throttleGauge struct {
+    mu      sync.Mutex
+    score   atomic.Uint64 // math.Float64bits of the score at updated
+    updated atomic.Int64  // Unix nanoseconds
+}
+
+// throttlePressure feeds the X-Backoff-Hint-Ms response header
+var throttlePressure throttleGauge
+
+func (g *throttleGauge) record(now time.Time) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    g.score.Store(math.Float64bits(g.Value(now) + 1))
+    g.updated.Store(now.UnixNano())
+}
+
+// Value returns the score decayed to now
+func (g *throttleGauge) Value(now time.Time) float64 {
+    score := math.Float64frombits(g.score.Load())
+    if score == 0 {
+        return 0
+    }
+    elapsed := now.Sub(time.Unix(0, g.updated.Load()))
+    return score * math.Pow(0.5, elapsed.Seconds()/throttleHalfLife.Seconds())
+}
+
+// pick chooses an account by weighted random selection, skipping excluded ones
+func (p *AccountPool) pick(exclude map[*Account]bool) *Account {
+    now := time.Now()
+
+    var candidates []*Account
+    var weights []float64
+    total := 0.0
+    for _, account := range p.accounts {
+        if exclude[account] {
+            continue
+        }
+        w := account.effectiveWeight(now)
+        candidates = append(candidates, account)
+        weights = append(weights, w)
+        total += w
+    }
+    if len(candidates) == 0 {
+        return nil
+    }
+
+    r := rand.Float64() * total
+    for i, w := range weights {
+        if r < w {
+            return candidates[i]
+        }
+        r -= w
+    }
+    return candidates[len(candidates)-1]
+}
+
+// isThrottle reports whether err means the account ran out of quota
+func isThrottle(err error) bool {
+    var throttling *types.ThrottlingException
+    var quota *types.ServiceQuotaExceededException
+    return errors.As(err, &throttling) || errors.As(err, &quota)
+}
+
+// observeInvocation records one account's call in the latency histogram
+func observeInvocation(ctx context.Context, modelID string, started time.Time, err error) {
+    outcome := "success"
+    switch {
+    case isThrottle(err):
+        outcome = "throttled"
+    case err != nil:
+        outcome = "error"
+    }
+    metrics.Observe(ctx, "bedrock_invoke_duration_seconds", time.Since(started).Seconds(), "model", modelID, "outcome", outcome)
+}
+
+// retryAfter handles a call that failed on account. A throttle moves on to
+// an account not yet tried, so a busy account doesn't push the request onto
+// a worse model. Once every account is throttled, or when the model failed
+// on the provider's side, the call is retried from scratch after a backoff.
+// It reports whether the caller should go round again; otherwise the error
+// is final and non-retriable errors fail fast.
+func (p *AccountPool) retryAfter(ctx context.Context, origin Origin, modelID string, account *Account, err error, tried map[*Account]bool, retries *int) bool {
+    throttled := isThrottle(err)
+    if !throttled {
+        metrics.Inc("bedrock_account_invocations_total", "account", account.Name, "origin", string(origin), "outcome", failureOutcome(err))
+    } else {
+        account.recordThrottle(time.Now())
+        metrics.Inc("bedrock_account_invocations_total", "account", account.Name, "origin", string(origin), "outcome", "throttled")
+        metrics.Inc("bedrock_account_throttles_total", "account", account.Name)
+        if len(tried) < len(p.accounts) {
+            logWarnf(ctx, "Account %s throttled, shifting request to another account", account.Name)
+            return true
+        }
+    }
+
+    reason := "throttled"
+    if !throttled {
+        if !isModelFailure(err) {
+            return false
+        }
+        reason = "model_error"
+    }
+    if !p.retry.allows(origin, *retries) || !p.retry.wait(ctx, *retries) {
+        return false
+    }
+    *retries++
+    addRetry(ctx)
+    metrics.Inc("bedrock_retries_total", "model", modelID, "origin", string(origin), "reason", reason)
+    logInfof(ctx, "Retrying %s after %s (retry %d of %d)", modelID, reason, *retries, p.retry.MaxRetries)
+    clear(tried)
+    return true
+}
+
+// InvokeModel sends the request through a scheduled account, shifting and
+// retrying it as retryAfter describes
+func (p *AccountPool) InvokeModel(ctx context.Context, origin Origin, input *bedrockruntime.InvokeModelInput) (*bedrockruntime.InvokeModelOutput, *Account, error) {
+    if err := origin.check(); err != nil {
+        return nil, nil, err
+    }
+    defer load.Begin()()
+    tried := make(map[*Account]bool)
+    retries := 0
+
+    for {
+        account := p.pick(tried)
+        if account == nil {
+            return nil, nil, fmt.Errorf("no Bedrock accounts configured")
+        }
+        tried[account] = true
+
+        started := time.Now()
+        resp, err := account.client.InvokeModel(ctx, input)
+        observeInvocation(ctx, aws.ToString(input.ModelId), started, err)
+        if err == nil {
+            metrics.Inc("bedrock_account_invocations_total", "account", account.Name, "origin", string(origin), "outcome", "success")
+            metrics.Inc("bedrock_model_invocations_total", "model", aws.ToString(input.ModelId), "origin", string(origin), "outcome", "success")
+            inputTokens, outputTokens := headerTokens(resp.ResultMetadata)
+            recordInvocationTokens(origin, aws.ToString(input.ModelId), inputTokens, outputTokens)
+            return resp, account, nil
+        }
+
+        if p.retryAfter(ctx, origin, aws.ToString(input.ModelId), account, err, tried, &retries) {
+            continue
+        }
+        metrics.Inc("bedrock_model_invocations_total", "model", aws.ToString(input.ModelId), "origin", string(origin), "outcome", failureOutcome(err))
+        return nil, account, err
+    }
+}
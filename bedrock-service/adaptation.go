@@ -0,0 +1,233 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+// Prompts are usually written for the model at the head of the fallback
+// chain. When a request falls back to a model from another provider, the
+// rules configured for that provider rewrite the caller's instructions and
+// turns, so Claude-style tags and formatting don't reach a model that reads
+// them as literal text. The built-in default system prompt is provider
+// neutral and only passes through rules like any other.
+
+// Parts of a request an adaptation rule rewrites
+const (
+    adaptSystem = "system" // The system prompt
+    adaptUser   = "user"   // The caller's turns: history and the prompt
+    adaptAll    = "all"
+)
+
+// AdaptationRule is one rewrite. Exactly one of Replace, Pattern, Prefix,
+// Suffix and Template is set.
+type AdaptationRule struct {
+    Name     string `json:"name"`
+    Target   string `json:"target,omitempty"`   // system, user or all (the default); templates are system only
+    Replace  string `json:"replace,omitempty"`  // Literal text replaced wherever it occurs
+    Pattern  string `json:"pattern,omitempty"`  // Regular expression replaced wherever it matches; With may use $1
+    Prefix   string `json:"prefix,omitempty"`   // Leading text swapped for With
+    Suffix   string `json:"suffix,omitempty"`   // Trailing text swapped for With
+    Template string `json:"template,omitempty"` // Replaces the system prompt; {system} stands for the original
+    With     string `json:"with,omitempty"`
+
+    re *regexp.Regexp
+}
+
+// apply rewrites text, reporting whether anything changed
+func (rule *AdaptationRule) apply(text string) (string, bool) {
+    var out string
+    switch {
+    case rule.Replace != "":
+        out = strings.ReplaceAll(text, rule.Replace, rule.With)
+    case rule.re != nil:
+        out = rule.re.ReplaceAllString(text, rule.With)
+    case rule.Prefix != "":
+        if !strings.HasPrefix(text, rule.Prefix) {
+            return text, false
+        }
+        out = rule.With + strings.TrimPrefix(text, rule.Prefix)
+    case rule.Suffix != "":
+        if !strings.HasSuffix(text, rule.Suffix) {
+            return text, false
+        }
+        out = strings.TrimSuffix(text, rule.Suffix) + rule.With
+    default:
+        out = strings.ReplaceAll(rule.Template, "{system}", text)
+    }
+    return out, out != text
+}
+
+// targets reports whether the rule rewrites part
+func (rule *AdaptationRule) targets(part string) bool {
+    if rule.Template != "" {
+        return part == adaptSystem
+    }
+    return rule.Target == adaptAll || rule.Target == part
+}
+
+// PromptAdaptations holds the rules for each provider, applied in order
+type PromptAdaptations struct {
+    rules map[string][]*AdaptationRule
+}
+
+// LoadPromptAdaptations reads PROMPT_ADAPTATIONS_FILE, a JSON object of the
+// form {"<provider>": [<rule>, ...]} where the provider is the model ID's
+// vendor, such as "anthropic" or "ai21". Unset, nothing is adapted.
+func LoadPromptAdaptations() (*PromptAdaptations, error) {
+    pa := &PromptAdaptations{rules: make(map[string][]*AdaptationRule)}
+    path := os.Getenv("PROMPT_ADAPTATIONS_FILE")
+    if path == "" {
+        return pa, nil
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("error reading PROMPT_ADAPTATIONS_FILE: %v", err)
+    }
+    if err := json.Unmarshal(data, &pa.rules); err != nil {
+        return nil, fmt.Errorf("invalid PROMPT_ADAPTATIONS_FILE: %v", err)
+    }
+
+    count := 0
+    for provider, rules := range pa.rules {
+        names := make(map[string]bool)
+        for i, rule := range rules {
+            field := fmt.Sprintf("%s[%d]", provider, i)
+            if rule.Name == "" || names[rule.Name] {
+                return nil, fmt.Errorf("PROMPT_ADAPTATIONS_FILE: %s needs a name unique within the provider", field)
+            }
+            names[rule.Name] = true
+
+            kinds := 0
+            for _, set := range []string{rule.Replace, rule.Pattern, rule.Prefix, rule.Suffix, rule.Template} {
+                if set != "" {
+                    kinds++
+                }
+            }
+            if kinds != 1 {
+                return nil, fmt.Errorf("PROMPT_ADAPTATIONS_FILE: %s must set exactly one of replace, pattern, prefix, suffix and template", field)
+            }
+            if rule.Target == "" {
+                rule.Target = adaptAll
+            }
+            if rule.Target != adaptSystem && rule.Target != adaptUser && rule.Target != adaptAll {
+                return nil, fmt.Errorf("PROMPT_ADAPTATIONS_FILE: %s target must be \"system\", \"user\" or \"all\"", field)
+            }
+            if rule.Pattern != "" {
+                if rule.re, err = regexp.Compile(rule.Pattern); err != nil {
+                    return nil, fmt.Errorf("PROMPT_ADAPTATIONS_FILE: %s pattern: %v", field, err)
+                }
+            }
+            count++
+        }
+    }
+    providers := make([]string, 0, len(pa.rules))
+    for provider := range pa.rules {
+        providers = append(providers, provider)
+    }
+    sort.Strings(providers)
+    log.Printf("Prompt adaptations: %d rules for %s", count, strings.Join(providers, ", "))
+    return pa, nil
+}
+
+// foundationModelID is the normalized ID of the model behind id. Cross-region
+// inference profiles put a region group ahead of it, as in
+// "us.anthropic.claude-3-5-haiku-20241022-v1:0".
+func foundationModelID(id string) string {
+    id = normalizeModelID(id)
+    if group, rest, ok := strings.Cut(id, "."); ok && strings.Contains(rest, ".") {
+        for _, known := range inferenceProfileGroups {
+            if group == known {
+                return rest
+            }
+        }
+    }
+    return id
+}
+
+// modelVendor is the provider a model comes from, the first part of its ID
+func modelVendor(model ModelInfo) string {
+    vendor, _, _ := strings.Cut(foundationModelID(model.ID), ".")
+    return vendor
+}
+
+// promptVendor is the provider a request's prompt was written for: its
+// preferred model's, or the head of the fallback chain's when it names none
+// the registry knows
+func (bc *BedrockClient) promptVendor(preferredModel string) string {
+    models := bc.textModels()
+    if len(models) == 0 {
+        return ""
+    }
+    if preferredModel != "" {
+        for _, model := range models {
+            if model.matches(preferredModel) {
+                return modelVendor(model)
+            }
+        }
+    }
+    return modelVendor(models[0])
+}
+
+// adapt rewrites the request for model: its sampling defaults fill in what
+// the caller left unset, and when its provider isn't the one the prompt was
+// written for the provider's rules apply. It returns the names of the rules
+// that changed something, as "<provider>:<rule>".
+func (bc *BedrockClient) adapt(model ModelInfo, p GenerationParams) (GenerationParams, []string) {
+    p = p.withModelDefaults(model)
+    if bc.adaptations == nil || p.NoAdaptation {
+        return p, nil
+    }
+    vendor := modelVendor(model)
+    rules := bc.adaptations.rules[vendor]
+    if len(rules) == 0 || vendor == bc.promptVendor(p.PreferredModel) {
+        return p, nil
+    }
+
+    system := defaultSystemPrompt
+    if model.API == apiLegacy {
+        system = legacyPreamble
+    }
+    if p.SystemPrompt != nil {
+        system = *p.SystemPrompt
+    }
+    history := append([]ChatMessage(nil), p.History...)
+    prompt := p.Prompt
+
+    var applied []string
+    for _, rule := range rules {
+        changed := false
+        if rule.targets(adaptSystem) {
+            var ok bool
+            system, ok = rule.apply(system)
+            changed = changed || ok
+        }
+        if rule.targets(adaptUser) {
+            for i := range history {
+                if history[i].Role != roleUser {
+                    continue
+                }
+                var ok bool
+                history[i].Content, ok = rule.apply(history[i].Content)
+                changed = changed || ok
+            }
+            var ok bool
+            prompt, ok = rule.apply(prompt)
+            changed = changed || ok
+        }
+        if changed {
+            applied = append(applied, vendor+":"+rule.Name)
+        }
+    }
+    if len(applied) == 0 {
+        return p, nil
+    }
+    p.SystemPrompt, p.History, p.Prompt = &system, history, prompt
+    metrics.Inc("prompt_adaptations_total", "provider", vendor)
+    return p, applied
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+    "crypto/subtle"
+    "net/http"
+    "os"
+    "strings"
+)
+
+// requireAdmin guards an admin endpoint with the ADMIN_TOKEN env var, sent as
+// "Authorization: Bearer <token>" or "X-Admin-Token". Admin endpoints are
+// disabled entirely when no token is configured.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        token := os.Getenv("ADMIN_TOKEN")
+        if token == "" {
+            writeError(w, r, http.StatusForbidden, ErrCodeForbidden, "Admin endpoints are disabled (ADMIN_TOKEN not set)")
+            return
+        }
+
+        provided := r.Header.Get("X-Admin-Token")
+        if auth := r.Header.Get("Authorization"); provided == "" && strings.HasPrefix(auth, "Bearer ") {
+            provided = strings.TrimPrefix(auth, "Bearer ")
+        }
+
+        if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+            logWarnf(r.Context(), "Rejected admin request to %s from %s", r.URL.Path, r.RemoteAddr)
+            writeError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+            return
+        }
+        next(w, r)
+    }
+}
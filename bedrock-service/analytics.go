@@ -0,0 +1,399 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "unicode"
+    "unicode/utf8"
+
+    "github.com/gorilla/mux"
+)
+
+// maxPromptSample is how much of a prompt is kept as a sample
+const maxPromptSample = 500
+
+// Patterns scrubbed from stored prompt samples and shared transcripts
+var (
+    redactEmail  = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+    redactDigits = regexp.MustCompile(`\d[\d -]{7,}\d`) // Card, account and phone numbers
+)
+
+// PromptAnalyticsConfig controls retention of prompt fingerprints
+type PromptAnalyticsConfig struct {
+    MaxFingerprints int    // Least recently seen fingerprints are dropped past this
+    StoreSamples    bool   // Keep a redacted sample of each prompt
+    StateFile       string // Where counters are persisted, empty to keep them in memory only
+}
+
+// LoadPromptAnalyticsConfig reads PROMPT_ANALYTICS_MAX, PROMPT_ANALYTICS_SAMPLES
+// and PROMPT_ANALYTICS_FILE
+func LoadPromptAnalyticsConfig() (PromptAnalyticsConfig, error) {
+    cfg := PromptAnalyticsConfig{MaxFingerprints: 1000, StateFile: os.Getenv("PROMPT_ANALYTICS_FILE")}
+
+    if v := os.Getenv("PROMPT_ANALYTICS_MAX"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return cfg, fmt.Errorf("invalid PROMPT_ANALYTICS_MAX %q", v)
+        }
+        cfg.MaxFingerprints = n
+    }
+    cfg.StoreSamples, _ = strconv.ParseBool(os.Getenv("PROMPT_ANALYTICS_SAMPLES"))
+    return cfg, nil
+}
+
+// PromptStats are the counters kept per prompt fingerprint
+type PromptStats struct {
+    Fingerprint  string         `json:"fingerprint"`
+    Requests     int            `json:"requests"`
+    Errors       int            `json:"errors"`
+    Refusals     int            `json:"refusals"`
+    InputTokens  int            `json:"input_tokens"`
+    OutputTokens int            `json:"output_tokens"`
+    LatencyMs    int64          `json:"latency_ms"` // Total, divide by requests for the mean
+    Models       map[string]int `json:"models"`
+    FirstSeen    time.Time      `json:"first_seen"`
+    LastSeen     time.Time      `json:"last_seen"`
+    Sample       string         `json:"sample,omitempty"`
+}
+
+// PromptSummary is the reported view of PromptStats
+type PromptSummary struct {
+    Fingerprint     string         `json:"fingerprint"`
+    Requests        int            `json:"requests"`
+    ErrorRate       float64        `json:"error_rate"`
+    RefusalRate     float64        `json:"refusal_rate"` // Of successful requests
+    AvgInputTokens  float64        `json:"avg_input_tokens"`
+    AvgOutputTokens float64        `json:"avg_output_tokens"`
+    AvgLatencyMs    float64        `json:"avg_latency_ms"`
+    Models          map[string]int `json:"models"`
+    FirstSeen       time.Time      `json:"first_seen"`
+    LastSeen        time.Time      `json:"last_seen"`
+    Sample          string         `json:"sample,omitempty"`
+}
+
+func (s *PromptStats) summary(withSample bool) PromptSummary {
+    n := float64(s.Requests)
+    summary := PromptSummary{
+        Fingerprint:     s.Fingerprint,
+        Requests:        s.Requests,
+        ErrorRate:       float64(s.Errors) / n,
+        AvgInputTokens:  float64(s.InputTokens) / n,
+        AvgOutputTokens: float64(s.OutputTokens) / n,
+        AvgLatencyMs:    float64(s.LatencyMs) / n,
+        Models:          s.Models,
+        FirstSeen:       s.FirstSeen,
+        LastSeen:        s.LastSeen,
+    }
+    if succeeded := s.Requests - s.Errors; succeeded > 0 {
+        summary.RefusalRate = float64(s.Refusals) / float64(succeeded)
+    }
+    if withSample {
+        summary.Sample = s.Sample
+    }
+    return summary
+}
+
+// PromptAnalytics fingerprints prompts and aggregates how they perform
+type PromptAnalytics struct {
+    cfg PromptAnalyticsConfig
+
+    mu    sync.Mutex
+    stats map[string]*PromptStats
+    dirty bool
+}
+
+func NewPromptAnalytics(cfg PromptAnalyticsConfig) (*PromptAnalytics, error) {
+    pa := &PromptAnalytics{cfg: cfg, stats: make(map[string]*PromptStats)}
+    if cfg.StateFile != "" {
+        if err := loadState(cfg.StateFile, &pa.stats); err != nil {
+            return nil, err
+        }
+        log.Printf("Loaded %d prompt fingerprints from %s", len(pa.stats), cfg.StateFile)
+    }
+    return pa, nil
+}
+
+// promptFingerprint hashes a prompt after normalizing case and whitespace, so
+// trivially different copies of the same prompt share a fingerprint
+func promptFingerprint(prompt string) string {
+    // strings.Join(strings.Fields(lowered), " "), built in one buffer as
+    // this runs on every request
+    lowered := strings.ToLower(prompt)
+    normalized := make([]byte, 0, len(lowered))
+    space := false
+    for i := 0; i < len(lowered); {
+        r, size := utf8.DecodeRuneInString(lowered[i:])
+        if unicode.IsSpace(r) {
+            space = len(normalized) > 0
+        } else {
+            if space {
+                normalized = append(normalized, ' ')
+                space = false
+            }
+            normalized = append(normalized, lowered[i:i+size]...)
+        }
+        i += size
+    }
+    sum := sha256.Sum256(normalized)
+    var fingerprint [32]byte
+    hex.Encode(fingerprint[:], sum[:16])
+    return string(fingerprint[:])
+}
+
+// redactSample trims and scrubs a prompt before it is stored
+func redactSample(prompt string) string {
+    if len(prompt) > maxPromptSample {
+        // Drops a multi-byte character cut in half by the slice
+        prompt = strings.ToValidUTF8(prompt[:maxPromptSample], "")
+    }
+    return redactText(prompt)
+}
+
+// redactText scrubs email addresses and long numbers
+func redactText(s string) string {
+    s = redactEmail.ReplaceAllString(s, "[email]")
+    return redactDigits.ReplaceAllString(s, "[number]")
+}
+
+// PromptOutcome is one generation as seen by the analytics
+type PromptOutcome struct {
+    Prompt       string
+    Model        string
+    InputTokens  int
+    OutputTokens int
+    Latency      time.Duration
+    Failed       bool
+    Refused      bool
+}
+
+// Record adds a generation to its fingerprint's counters
+func (pa *PromptAnalytics) Record(o PromptOutcome, now time.Time) {
+    fp := promptFingerprint(o.Prompt)
+
+    pa.mu.Lock()
+    defer pa.mu.Unlock()
+
+    s, ok := pa.stats[fp]
+    if !ok {
+        if len(pa.stats) >= pa.cfg.MaxFingerprints {
+            pa.evictOldestLocked()
+        }
+        s = &PromptStats{Fingerprint: fp, Models: make(map[string]int), FirstSeen: now}
+        if pa.cfg.StoreSamples {
+            s.Sample = redactSample(o.Prompt)
+        }
+        pa.stats[fp] = s
+    }
+    s.Requests++
+    if o.Failed {
+        s.Errors++
+    } else {
+        s.Models[o.Model]++
+    }
+    if o.Refused {
+        s.Refusals++
+    }
+    s.InputTokens += o.InputTokens
+    s.OutputTokens += o.OutputTokens
+    s.LatencyMs += o.Latency.Milliseconds()
+    s.LastSeen = now
+    pa.dirty = true
+}
+
+func (pa *PromptAnalytics) evictOldestLocked() {
+    var oldest *PromptStats
+    for _, s := range pa.stats {
+        if oldest == nil || s.LastSeen.Before(oldest.LastSeen) {
+            oldest = s
+        }
+    }
+    if oldest != nil {
+        delete(pa.stats, oldest.Fingerprint)
+    }
+}
+
+func (s *PromptStats) memoryBytes() int64 {
+    n := int64(len(s.Fingerprint)+len(s.Sample)) + recordOverhead
+    for model := range s.Models {
+        n += int64(len(model)) + 16
+    }
+    return n
+}
+
+// MemoryBytes estimates the bytes held by the counters
+func (pa *PromptAnalytics) MemoryBytes() int64 {
+    pa.mu.Lock()
+    defer pa.mu.Unlock()
+    var n int64
+    for _, s := range pa.stats {
+        n += s.memoryBytes()
+    }
+    return n
+}
+
+// EvictTo drops the least recently seen fingerprints
+func (pa *PromptAnalytics) EvictTo(target int64) int {
+    pa.mu.Lock()
+    defer pa.mu.Unlock()
+    sizes := make(map[string]int64, len(pa.stats))
+    lastSeen := make(map[string]time.Time, len(pa.stats))
+    for fingerprint, s := range pa.stats {
+        sizes[fingerprint], lastSeen[fingerprint] = s.memoryBytes(), s.LastSeen
+    }
+    drop := lruEvict(sizes, lastSeen, target)
+    for _, fingerprint := range drop {
+        delete(pa.stats, fingerprint)
+    }
+    if len(drop) > 0 {
+        pa.dirty = true
+    }
+    return len(drop)
+}
+
+// List returns every fingerprint, in no particular order
+func (pa *PromptAnalytics) List() []PromptSummary {
+    pa.mu.Lock()
+    defer pa.mu.Unlock()
+
+    summaries := make([]PromptSummary, 0, len(pa.stats))
+    for _, s := range pa.stats {
+        summaries = append(summaries, s.summary(false))
+    }
+    return summaries
+}
+
+// Get returns one fingerprint with its sample, if samples are kept
+func (pa *PromptAnalytics) Get(fingerprint string) (PromptSummary, bool) {
+    pa.mu.Lock()
+    defer pa.mu.Unlock()
+
+    s, ok := pa.stats[fingerprint]
+    if !ok {
+        return PromptSummary{}, false
+    }
+    return s.summary(pa.cfg.StoreSamples), true
+}
+
+// SweepExpired deletes fingerprints last seen before cutoff
+func (pa *PromptAnalytics) SweepExpired(ctx context.Context, cutoff time.Time, cursor string, limit int, dryRun bool, rep *RetentionReport) (string, error) {
+    pa.mu.Lock()
+    defer pa.mu.Unlock()
+    lastSeen := make(map[string]time.Time, len(pa.stats))
+    for fingerprint, s := range pa.stats {
+        lastSeen[fingerprint] = s.LastSeen
+    }
+    fingerprints, next := expiredPage(lastSeen, cutoff, cursor, limit)
+    for _, fingerprint := range fingerprints {
+        rep.add(lastSeen[fingerprint])
+        if !dryRun {
+            delete(pa.stats, fingerprint)
+            pa.dirty = true
+        }
+    }
+    return next, nil
+}
+
+// Run persists the counters every minute when a state file is configured
+func (pa *PromptAnalytics) Run() {
+    if pa.cfg.StateFile == "" {
+        return
+    }
+    for range time.Tick(time.Minute) {
+        pa.save()
+    }
+}
+
+func (pa *PromptAnalytics) save() {
+    pa.mu.Lock()
+    if !pa.dirty {
+        pa.mu.Unlock()
+        return
+    }
+    data, err := json.Marshal(pa.stats)
+    pa.dirty = false
+    pa.mu.Unlock()
+
+    if err == nil {
+        err = saveState(pa.cfg.StateFile, json.RawMessage(data))
+    }
+    if err != nil {
+        log.Printf("Error saving prompt analytics: %v", err)
+    }
+}
+
+func promptAnalyticsListHandler(pa *PromptAnalytics, pages PageConfig) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        q, apiErr := pages.parseListQuery(r, "sort")
+        if apiErr != nil {
+            writeAPIError(w, r, http.StatusBadRequest, *apiErr)
+            return
+        }
+        prompts := pa.List()
+
+        switch r.URL.Query().Get("sort") {
+        case "":
+        case "requests":
+            // A ranking moves as requests arrive, so it has no stable
+            // position to resume from: it is one page, the top limit
+            writeJSON(w, r, topPrompts(prompts, q))
+            return
+        default:
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "sort must be \"requests\" or omitted")
+            return
+        }
+
+        // A fingerprint is created when it's first seen
+        indexes, page := pages.paginate(q, len(prompts), func(i int) pageKey {
+            return pageKey{Created: prompts[i].FirstSeen, ID: prompts[i].Fingerprint}
+        })
+        items := make([]PromptSummary, len(indexes))
+        for i, idx := range indexes {
+            items[i] = prompts[idx]
+        }
+        page.Items = items
+        writeJSON(w, r, page)
+    }
+}
+
+// topPrompts is the page of the most requested prompts within q's window
+func topPrompts(prompts []PromptSummary, q ListQuery) Page {
+    items := make([]PromptSummary, 0, len(prompts))
+    for _, p := range prompts {
+        if q.inWindow(p.FirstSeen) {
+            items = append(items, p)
+        }
+    }
+    sort.Slice(items, func(i, j int) bool {
+        if items[i].Requests != items[j].Requests {
+            return items[i].Requests > items[j].Requests
+        }
+        return items[i].Fingerprint < items[j].Fingerprint
+    })
+    page := Page{TotalEstimate: len(items)}
+    page.Items = items[:min(q.Limit, len(items))]
+    return page
+}
+
+func promptAnalyticsGetHandler(pa *PromptAnalytics) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        summary, ok := pa.Get(mux.Vars(r)["hash"])
+        if !ok {
+            writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Unknown prompt fingerprint")
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(summary)
+    }
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "strings"
+    "testing"
+)
+
+// The fingerprint is built in one buffer but must stay the hash of the
+// joined fields, or stored fingerprints stop matching
+func TestPromptFingerprint(t *testing.T) {
+    reference := func(prompt string) string {
+        sum := sha256.Sum256([]byte(strings.Join(strings.Fields(strings.ToLower(prompt)), " ")))
+        return hex.EncodeToString(sum[:16])
+    }
+    for _, prompt := range []string{
+        "",
+        "   ",
+        "Summarise this",
+        "  Summarise\tTHIS \n\n please ",
+        "wide　space and nbsp",
+        "日本語の プロンプト",
+        "bad \xff byte",
+    } {
+        if got, want := promptFingerprint(prompt), reference(prompt); got != want {
+            t.Errorf("promptFingerprint(%q) = %s, want %s", prompt, got, want)
+        }
+    }
+    if promptFingerprint("Say  HELLO") != promptFingerprint("say hello") {
+        t.Error("case and spacing change the fingerprint")
+    }
+}
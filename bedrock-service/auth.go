@@ -0,0 +1,225 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+)
+
+// KeyPolicy holds per-key (or per-tenant) behaviour switches. Fields left
+// empty on a key inherit the tenant's value.
+type KeyPolicy struct {
+    AttributionFooter string `json:"attribution_footer,omitempty"` // Appended to every text response
+    AllowMock         bool   `json:"allow_mock,omitempty"`         // Honour X-Mock-Response for contract tests
+    RefusalMessage    string `json:"refusal_message,omitempty"`    // Served in place of a model's refusal text
+    Model             string `json:"model,omitempty"`              // Used when the request names no model
+    Timezone          string `json:"timezone,omitempty"`           // Used when the request names no timezone
+
+    // CallerServices allowlists X-Caller-Service values and, for each, the
+    // X-Caller-Operation values that may accompany it
+    CallerServices map[string][]string `json:"caller_services,omitempty"`
+
+    // RateLimit caps the key's requests and tokens per minute, see keylimits.go
+    RateLimit *KeyRateLimit `json:"rate_limit,omitempty"`
+}
+
+// merge returns p with unset fields filled in from fallback
+func (p KeyPolicy) merge(fallback KeyPolicy) KeyPolicy {
+    if p.AttributionFooter == "" {
+        p.AttributionFooter = fallback.AttributionFooter
+    }
+    if p.RefusalMessage == "" {
+        p.RefusalMessage = fallback.RefusalMessage
+    }
+    if !p.AllowMock {
+        p.AllowMock = fallback.AllowMock
+    }
+    if p.Model == "" {
+        p.Model = fallback.Model
+    }
+    if p.Timezone == "" {
+        p.Timezone = fallback.Timezone
+    }
+    if p.CallerServices == nil {
+        p.CallerServices = fallback.CallerServices
+    }
+    if p.RateLimit == nil {
+        p.RateLimit = fallback.RateLimit
+    }
+    return p
+}
+
+// APIKeyConfig is one key entry in the API_KEYS_FILE
+type APIKeyConfig struct {
+    ID     string    `json:"id"`
+    Key    string    `json:"key"`
+    Tenant string    `json:"tenant,omitempty"`
+    Policy KeyPolicy `json:"policy"`
+
+    // SigningSecret makes the key's requests require an HMAC signature
+    SigningSecret string `json:"signing_secret,omitempty"`
+}
+
+// APIKeysFile is the layout of the API_KEYS_FILE
+type APIKeysFile struct {
+    Tenants map[string]KeyPolicy `json:"tenants,omitempty"`
+    Keys    []APIKeyConfig       `json:"keys"`
+}
+
+// Principal identifies the caller of a request
+type Principal struct {
+    KeyID  string
+    Tenant string
+    Policy KeyPolicy
+
+    signingSecret string // Requests must be HMAC-signed with it when set, see signing.go
+}
+
+// anonymousPrincipal is used for every request when authentication is disabled
+var anonymousPrincipal = &Principal{KeyID: "anonymous"}
+
+// KeyStore resolves API keys to principals. Keys are held only as SHA-256 digests.
+type KeyStore struct {
+    keys map[string]*Principal
+}
+
+type principalKey struct{}
+
+// LoadKeyStore reads API_KEYS_FILE. Without it authentication is disabled and
+// a nil store is returned.
+func LoadKeyStore() (*KeyStore, error) {
+    path := os.Getenv("API_KEYS_FILE")
+    if path == "" {
+        return nil, nil
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("unable to read API_KEYS_FILE: %v", err)
+    }
+    var file APIKeysFile
+    if err := json.Unmarshal(data, &file); err != nil {
+        return nil, fmt.Errorf("invalid API_KEYS_FILE: %v", err)
+    }
+
+    store := &KeyStore{keys: make(map[string]*Principal)}
+    ids := make(map[string]bool)
+    for i, entry := range file.Keys {
+        if entry.ID == "" || entry.Key == "" {
+            return nil, fmt.Errorf("invalid API_KEYS_FILE: keys[%d]: id and key are required", i)
+        }
+        if ids[entry.ID] {
+            return nil, fmt.Errorf("invalid API_KEYS_FILE: keys[%d]: duplicate id %s", i, entry.ID)
+        }
+        ids[entry.ID] = true
+
+        digest := hashKey(entry.Key)
+        if _, dup := store.keys[digest]; dup {
+            return nil, fmt.Errorf("invalid API_KEYS_FILE: keys[%d] (%s): key is already assigned", i, entry.ID)
+        }
+
+        policy := entry.Policy
+        if entry.Tenant != "" {
+            tenantPolicy, ok := file.Tenants[entry.Tenant]
+            if !ok && len(file.Tenants) > 0 {
+                return nil, fmt.Errorf("invalid API_KEYS_FILE: keys[%d] (%s): unknown tenant %s", i, entry.ID, entry.Tenant)
+            }
+            policy = policy.merge(tenantPolicy)
+        }
+        if err := validateCallerServices(policy.CallerServices); err != nil {
+            return nil, fmt.Errorf("invalid API_KEYS_FILE: keys[%d] (%s): %v", i, entry.ID, err)
+        }
+        if policy.RateLimit != nil {
+            if err := policy.RateLimit.validate(); err != nil {
+                return nil, fmt.Errorf("invalid API_KEYS_FILE: keys[%d] (%s): %v", i, entry.ID, err)
+            }
+        }
+        if policy.Timezone != "" {
+            if _, err := time.LoadLocation(policy.Timezone); err != nil {
+                return nil, fmt.Errorf("invalid API_KEYS_FILE: keys[%d] (%s): invalid timezone %q", i, entry.ID, policy.Timezone)
+            }
+        }
+        store.keys[digest] = &Principal{KeyID: entry.ID, Tenant: entry.Tenant, Policy: policy, signingSecret: entry.SigningSecret}
+    }
+
+    log.Printf("Loaded %d API keys", len(store.keys))
+    return store, nil
+}
+
+func hashKey(key string) string {
+    sum := sha256.Sum256([]byte(key))
+    return hex.EncodeToString(sum[:])
+}
+
+// lookup returns the principal for a raw key
+func (ks *KeyStore) lookup(key string) (*Principal, bool) {
+    p, ok := ks.keys[hashKey(key)]
+    return p, ok
+}
+
+// apiKeyFromRequest reads the key from X-API-Key or, failing that, an
+// Authorization bearer token. conflict reports that both were sent and differ.
+func apiKeyFromRequest(r *http.Request) (key string, conflict bool) {
+    var bearer string
+    if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+        bearer = strings.TrimPrefix(auth, "Bearer ")
+    }
+    if header := r.Header.Get("X-API-Key"); header != "" {
+        return header, bearer != "" && bearer != header
+    }
+    return bearer, false
+}
+
+// publicPaths don't require an API key; /admin, /analytics and /status use
+// the admin token, /internal routes the peer secret and /shared a signed
+// token in the path instead
+func isPublicPath(path string) bool {
+    return path == "/" || path == "/health" || path == "/readyz" || path == "/metrics" || path == "/scaling" || path == "/status" ||
+        strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/analytics/") ||
+        strings.HasPrefix(path, "/internal/") || strings.HasPrefix(path, "/shared/")
+}
+
+// Middleware authenticates requests and attaches the caller's Principal to the context
+func (ks *KeyStore) Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if ks == nil || isPublicPath(r.URL.Path) {
+            next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, anonymousPrincipal)))
+            return
+        }
+
+        key, conflict := apiKeyFromRequest(r)
+        if key == "" {
+            writeError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "API key required")
+            return
+        }
+        principal, ok := ks.lookup(key)
+        if !ok {
+            logWarnf(r.Context(), "Rejected request to %s with unknown API key", r.URL.Path)
+            writeError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "Invalid API key")
+            return
+        }
+        requestRecordFrom(r.Context()).identify(principal)
+        ctx := context.WithValue(r.Context(), principalKey{}, principal)
+        if conflict {
+            // Key values are never echoed, not even in a warning
+            metrics.Inc("parameter_conflicts_total", "parameter", "api_key")
+            ctx = withParamWarning(ctx, "conflicting values for api_key: using X-API-Key header, ignoring Authorization header")
+        }
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+// principalFrom returns the caller of the request, never nil
+func principalFrom(ctx context.Context) *Principal {
+    if p, ok := ctx.Value(principalKey{}).(*Principal); ok {
+        return p
+    }
+    return anonymousPrincipal
+}
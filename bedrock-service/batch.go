@@ -0,0 +1,583 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Batch item statuses
+const (
+    batchItemPending   = "pending"
+    batchItemSucceeded = "succeeded"
+    batchItemFailed    = "failed"
+)
+
+// Batch statuses, from its items' latest attempts
+const (
+    batchCompleted = "completed" // Every item succeeded
+    batchPartial   = "partial"
+    batchFailed    = "failed" // Every item failed
+)
+
+// errBatchBusy is returned while a batch has a run or retry in progress
+var errBatchBusy = errors.New("batch has a run in progress")
+
+// BatchConfig bounds /generate/batch and the store its records live in
+type BatchConfig struct {
+    MaxItems    int
+    Concurrency int // Items of one batch generated at once
+    MaxRecords  int
+    TTL         time.Duration // Records expire this long after their last run
+}
+
+// LoadBatchConfig reads BATCH_MAX_ITEMS (default 50), BATCH_CONCURRENCY
+// (default 4), BATCH_STORE_MAX (default 1000) and BATCH_TTL_SECONDS (default
+// 86400)
+func LoadBatchConfig() (BatchConfig, error) {
+    cfg := BatchConfig{MaxItems: 50, Concurrency: 4, MaxRecords: 1000}
+    ttlSeconds := 86400
+    ints := []struct {
+        env    string
+        target *int
+    }{
+        {"BATCH_MAX_ITEMS", &cfg.MaxItems},
+        {"BATCH_CONCURRENCY", &cfg.Concurrency},
+        {"BATCH_STORE_MAX", &cfg.MaxRecords},
+        {"BATCH_TTL_SECONDS", &ttlSeconds},
+    }
+    for _, i := range ints {
+        if v := os.Getenv(i.env); v != "" {
+            n, err := strconv.Atoi(v)
+            if err != nil || n < 1 {
+                return cfg, fmt.Errorf("invalid %s %q", i.env, v)
+            }
+            *i.target = n
+        }
+    }
+    cfg.TTL = time.Duration(ttlSeconds) * time.Second
+    return cfg, nil
+}
+
+// BatchItemRequest is one prompt of a batch
+type BatchItemRequest struct {
+    ItemID      string   `json:"item_id,omitempty"` // Defaults to the item's position; same rules as X-Request-ID
+    Prompt      string   `json:"prompt"`
+    Model       string   `json:"model,omitempty"`
+    MaxTokens   int      `json:"max_tokens,omitempty"`
+    Temperature *float64 `json:"temperature,omitempty"`
+}
+
+// GenerateBatchRequest is the body of POST /generate/batch. The top-level
+// model and params apply to items that don't set their own.
+type GenerateBatchRequest struct {
+    Items       []BatchItemRequest `json:"items"`
+    Model       string             `json:"model,omitempty"`
+    MaxTokens   int                `json:"max_tokens,omitempty"`
+    Temperature *float64           `json:"temperature,omitempty"`
+}
+
+// BatchRetryRequest is the optional body of POST /generate/batch/{id}/retry.
+// Params set here replace the retried items' own, and stick for later retries.
+type BatchRetryRequest struct {
+    ItemIDs     []string `json:"item_ids,omitempty"` // Defaults to every failed item
+    Model       string   `json:"model,omitempty"`
+    MaxTokens   int      `json:"max_tokens,omitempty"`
+    Temperature *float64 `json:"temperature,omitempty"`
+}
+
+// BatchItem is the latest attempt at one item
+type BatchItem struct {
+    ItemID       string    `json:"item_id"`
+    Status       string    `json:"status"`
+    Response     string    `json:"response,omitempty"`
+    ModelUsed    string    `json:"model_used,omitempty"`
+    FinishReason string    `json:"finish_reason,omitempty"`
+    InputTokens  int       `json:"input_tokens,omitempty"`
+    OutputTokens int       `json:"output_tokens,omitempty"`
+    Error        *APIError `json:"error,omitempty"`
+    Attempts     int       `json:"attempts"`
+
+    request BatchItemRequest // As last run, with batch defaults filled in
+}
+
+// BatchUsage totals every attempt at every item. Tokens spent on attempts a
+// retry replaced are still counted; cached answers count nothing.
+type BatchUsage struct {
+    Attempts     int `json:"attempts"`
+    InputTokens  int `json:"input_tokens"`
+    OutputTokens int `json:"output_tokens"`
+}
+
+// BatchRecord is the stored state of a batch
+type BatchRecord struct {
+    BatchID   string      `json:"batch_id"`
+    Status    string      `json:"status"`
+    Succeeded int         `json:"succeeded"`
+    Failed    int         `json:"failed"`
+    Items     []BatchItem `json:"items"`
+    Usage     BatchUsage  `json:"usage"`
+    CreatedAt time.Time   `json:"created_at"`
+    UpdatedAt time.Time   `json:"updated_at"`
+    Retried   []string    `json:"retried,omitempty"` // Items re-run by the retry that returned this record
+}
+
+// batchAttempt is one run of an item and what it spent
+type batchAttempt struct {
+    item                      BatchItem
+    inputTokens, outputTokens int
+}
+
+// batchEntry is a stored record and who may see it
+type batchEntry struct {
+    owner   string
+    record  BatchRecord
+    running bool // A run or retry is in progress
+}
+
+// BatchStore is the bounded job store batch records live in, isolated per
+// tenant
+type BatchStore struct {
+    cfg BatchConfig
+
+    mu      sync.Mutex
+    batches map[string]*batchEntry
+}
+
+func NewBatchStore(cfg BatchConfig) *BatchStore {
+    return &BatchStore{cfg: cfg, batches: make(map[string]*batchEntry)}
+}
+
+// expireLocked drops records idle for longer than the TTL
+func (bs *BatchStore) expireLocked(now time.Time) {
+    for id, e := range bs.batches {
+        if !e.running && now.Sub(e.record.UpdatedAt) > bs.cfg.TTL {
+            delete(bs.batches, id)
+        }
+    }
+}
+
+// memoryBytes estimates the bytes held by a record
+func (e *batchEntry) memoryBytes() int64 {
+    n := int64(len(e.owner)+len(e.record.BatchID)) + recordOverhead
+    for _, item := range e.record.Items {
+        n += int64(len(item.ItemID)+len(item.Response)+len(item.ModelUsed)+len(item.request.Prompt)+len(item.request.Model)) + recordOverhead
+    }
+    return n
+}
+
+// MemoryBytes estimates the bytes held by batch records
+func (bs *BatchStore) MemoryBytes() int64 {
+    bs.mu.Lock()
+    defer bs.mu.Unlock()
+    var n int64
+    for _, e := range bs.batches {
+        n += e.memoryBytes()
+    }
+    return n
+}
+
+// EvictTo drops the least recently run records. Records with a run in
+// progress are kept, so its results aren't merged into a dropped copy.
+func (bs *BatchStore) EvictTo(target int64) int {
+    bs.mu.Lock()
+    defer bs.mu.Unlock()
+    sizes := make(map[string]int64, len(bs.batches))
+    lastUsed := make(map[string]time.Time, len(bs.batches))
+    var busy int64
+    for id, e := range bs.batches {
+        if e.running {
+            busy += e.memoryBytes()
+            continue
+        }
+        sizes[id], lastUsed[id] = e.memoryBytes(), e.record.UpdatedAt
+    }
+    drop := lruEvict(sizes, lastUsed, target-busy)
+    for _, id := range drop {
+        delete(bs.batches, id)
+    }
+    return len(drop)
+}
+
+// Create stores a new batch for owner with its items pending, and marks it
+// running. When the store is full the least recently run idle record makes
+// room.
+func (bs *BatchStore) Create(owner string, items []BatchItem, now time.Time) (BatchRecord, error) {
+    bs.mu.Lock()
+    defer bs.mu.Unlock()
+
+    bs.expireLocked(now)
+    if len(bs.batches) >= bs.cfg.MaxRecords {
+        oldest := ""
+        for id, e := range bs.batches {
+            if !e.running && (oldest == "" || e.record.UpdatedAt.Before(bs.batches[oldest].record.UpdatedAt)) {
+                oldest = id
+            }
+        }
+        if oldest == "" {
+            return BatchRecord{}, fmt.Errorf("too many batches in progress (limit %d)", bs.cfg.MaxRecords)
+        }
+        delete(bs.batches, oldest)
+    }
+
+    e := &batchEntry{owner: owner, running: true, record: BatchRecord{
+        BatchID:   "batch_" + newRequestID(),
+        Items:     items,
+        CreatedAt: now,
+        UpdatedAt: now,
+    }}
+    bs.batches[e.record.BatchID] = e
+    metrics.Inc("batches_created_total")
+    return e.record.copy(), nil
+}
+
+// Get returns a live record visible to owner. Other tenants' batches are
+// reported as missing so IDs can't be probed.
+func (bs *BatchStore) Get(owner, id string, now time.Time) (BatchRecord, bool) {
+    bs.mu.Lock()
+    defer bs.mu.Unlock()
+    e, ok := bs.liveLocked(owner, id, now)
+    if !ok {
+        return BatchRecord{}, false
+    }
+    return e.record.copy(), true
+}
+
+func (bs *BatchStore) liveLocked(owner, id string, now time.Time) (*batchEntry, bool) {
+    e, ok := bs.batches[id]
+    if !ok || e.owner != owner {
+        return nil, false
+    }
+    if !e.running && now.Sub(e.record.UpdatedAt) > bs.cfg.TTL {
+        delete(bs.batches, id)
+        return nil, false
+    }
+    return e, true
+}
+
+// ClaimRetry marks a batch running and returns the items a retry should
+// re-run: the failed ones among itemIDs, or every failed item when itemIDs
+// is empty. Succeeded items are skipped, so retrying one is a no-op. The
+// caller must Finish the batch, even when nothing was claimed.
+func (bs *BatchStore) ClaimRetry(owner, id string, itemIDs []string, now time.Time) ([]BatchItem, bool, error) {
+    bs.mu.Lock()
+    defer bs.mu.Unlock()
+    e, ok := bs.liveLocked(owner, id, now)
+    if !ok {
+        return nil, false, nil
+    }
+    if e.running {
+        return nil, true, errBatchBusy
+    }
+
+    index := make(map[string]int, len(e.record.Items))
+    for i, item := range e.record.Items {
+        index[item.ItemID] = i
+    }
+    for _, itemID := range itemIDs {
+        if _, ok := index[itemID]; !ok {
+            return nil, true, fmt.Errorf("unknown item_id %q", itemID)
+        }
+    }
+
+    var claimed []BatchItem
+    for _, item := range e.record.Items {
+        if item.Status != batchItemFailed || (len(itemIDs) > 0 && !containsString(itemIDs, item.ItemID)) {
+            continue
+        }
+        claimed = append(claimed, item)
+    }
+    e.running = true
+    return claimed, true, nil
+}
+
+// Finish merges a run's attempts into the batch, replacing each item's
+// latest result and adding what every attempt spent to the usage totals
+func (bs *BatchStore) Finish(id string, attempts []batchAttempt, now time.Time) BatchRecord {
+    bs.mu.Lock()
+    defer bs.mu.Unlock()
+    e, ok := bs.batches[id]
+    if !ok {
+        return BatchRecord{}
+    }
+    r := &e.record
+    for _, a := range attempts {
+        for i := range r.Items {
+            if r.Items[i].ItemID == a.item.ItemID {
+                r.Items[i] = a.item
+            }
+        }
+        r.Usage.Attempts++
+        r.Usage.InputTokens += a.inputTokens
+        r.Usage.OutputTokens += a.outputTokens
+    }
+
+    r.Succeeded, r.Failed = 0, 0
+    for _, item := range r.Items {
+        switch item.Status {
+        case batchItemSucceeded:
+            r.Succeeded++
+        case batchItemFailed:
+            r.Failed++
+        }
+    }
+    switch {
+    case r.Failed == 0:
+        r.Status = batchCompleted
+    case r.Succeeded == 0:
+        r.Status = batchFailed
+    default:
+        r.Status = batchPartial
+    }
+    r.UpdatedAt = now
+    e.running = false
+    return r.copy()
+}
+
+// copy returns a record sharing nothing with the stored one
+func (r BatchRecord) copy() BatchRecord {
+    r.Items = append([]BatchItem(nil), r.Items...)
+    return r
+}
+
+// runItems generates the given items, BatchConfig.Concurrency at a time
+func (bs *BatchStore) runItems(r *http.Request, bc *BatchClient, items []BatchItem) []batchAttempt {
+    attempts := make([]batchAttempt, len(items))
+    slots := make(chan struct{}, bs.cfg.Concurrency)
+    var wg sync.WaitGroup
+    for i := range items {
+        wg.Add(1)
+        slots <- struct{}{}
+        go func(i int) {
+            defer func() { <-slots; wg.Done() }()
+            attempts[i] = bc.run(r, items[i])
+        }(i)
+    }
+    wg.Wait()
+    return attempts
+}
+
+// BatchClient is what a batch item run needs from the rest of the service
+type BatchClient struct {
+    bc            *BedrockClient
+    systemContext *SystemContext
+    analytics     *PromptAnalytics
+    loc           *time.Location
+}
+
+// run makes one attempt at an item. Filtered output counts as a failure, so
+// a retry with another model can pick it up.
+func (c *BatchClient) run(r *http.Request, item BatchItem) batchAttempt {
+    req := item.request
+    item.Attempts++
+    item.Response, item.ModelUsed, item.FinishReason, item.Error = "", "", "", nil
+    item.InputTokens, item.OutputTokens = 0, 0
+
+    started := time.Now()
+    result, err := c.bc.Generate(r.Context(), GenerationParams{
+        Prompt:         req.Prompt,
+        PreferredModel: req.Model,
+        MaxTokens:      req.MaxTokens,
+        Temperature:    req.Temperature,
+        SystemContext:  c.systemContext.Lines(time.Now(), c.loc, true),
+        Origin:         originUser,
+        CacheScope:     contextOwner(principalFrom(r.Context())),
+    })
+    outcome := PromptOutcome{Prompt: req.Prompt, Latency: time.Since(started), Failed: err != nil}
+    if err == nil {
+        classifyRefusal(result)
+        outcome.Model = result.ModelID
+        outcome.InputTokens, outcome.OutputTokens = result.InputTokens, result.OutputTokens
+        outcome.Refused = result.Refused
+        if result.Cached {
+            outcome.InputTokens, outcome.OutputTokens = 0, 0
+        }
+    }
+    c.analytics.Record(outcome, time.Now())
+    callerUsage.Record(r.Context(), outcome.Model, outcome.InputTokens, outcome.OutputTokens, outcome.Failed)
+    attempt := batchAttempt{inputTokens: outcome.InputTokens, outputTokens: outcome.OutputTokens}
+
+    switch {
+    case err != nil:
+        logWarnf(r.Context(), "Batch item %s failed: %v", item.ItemID, err)
+        _, apiErr := generationErrorResponse(err)
+        item.Status, item.Error = batchItemFailed, &apiErr
+        metrics.Inc("batch_items_total", "outcome", "error")
+    case result.Filtered:
+        item.Status = batchItemFailed
+        item.Error = &APIError{Code: ErrCodeContentBlocked, Message: "Output was blocked by content filtering"}
+        metrics.Inc("batch_items_total", "outcome", "filtered")
+    default:
+        item.Status = batchItemSucceeded
+        item.Response = result.Text
+        metrics.Inc("batch_items_total", "outcome", "success")
+    }
+    if result != nil {
+        item.ModelUsed, item.FinishReason = result.ModelName, result.FinishReason
+        item.InputTokens, item.OutputTokens = result.InputTokens, result.OutputTokens
+    }
+    attempt.item = item
+    return attempt
+}
+
+// batchClient resolves the timezone for a batch request
+func batchClient(r *http.Request, bc *BedrockClient, systemContext *SystemContext, analytics *PromptAnalytics) (*BatchClient, error) {
+    loc, err := systemContext.ResolveLocation(resolveRequestParams(r, paramValues{}).Timezone)
+    if err != nil {
+        return nil, err
+    }
+    return &BatchClient{bc: bc, systemContext: systemContext, analytics: analytics, loc: loc}, nil
+}
+
+// liftWriteDeadline lets a batch run past the server's WriteTimeout; the
+// item count and per-item generation timeouts bound it instead
+func liftWriteDeadline(w http.ResponseWriter, r *http.Request) {
+    if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+        logWarnf(r.Context(), "Batch for %s keeps the server write timeout: %v", rateLimitKey(r), err)
+    }
+}
+
+func generateBatchHandler(bc *BedrockClient, batches *BatchStore, systemContext *SystemContext, analytics *PromptAnalytics) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req GenerateBatchRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+        if len(req.Items) == 0 || len(req.Items) > batches.cfg.MaxItems {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: fmt.Sprintf("A batch takes between 1 and %d items", batches.cfg.MaxItems),
+                Fields:  []FieldError{{Field: "items", Message: "out of range"}},
+            })
+            return
+        }
+
+        items := make([]BatchItem, len(req.Items))
+        seen := make(map[string]bool, len(req.Items))
+        var fields []FieldError
+        for i, in := range req.Items {
+            if in.ItemID == "" {
+                in.ItemID = strconv.Itoa(i)
+            }
+            switch {
+            case !validRequestID(in.ItemID):
+                fields = append(fields, FieldError{Field: fmt.Sprintf("items[%d].item_id", i), Message: "must be letters, digits, '-', '_' or '.'"})
+            case seen[in.ItemID]:
+                fields = append(fields, FieldError{Field: fmt.Sprintf("items[%d].item_id", i), Message: "duplicate"})
+            }
+            seen[in.ItemID] = true
+            if in.Prompt == "" {
+                fields = append(fields, FieldError{Field: fmt.Sprintf("items[%d].prompt", i), Message: "required"})
+            }
+            if in.Model == "" {
+                in.Model = req.Model
+            }
+            if in.MaxTokens == 0 {
+                in.MaxTokens = req.MaxTokens
+            }
+            if in.Temperature == nil {
+                in.Temperature = req.Temperature
+            }
+            items[i] = BatchItem{ItemID: in.ItemID, Status: batchItemPending, request: in}
+        }
+        if len(fields) > 0 {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{Code: ErrCodeValidation, Message: "Invalid batch items", Fields: fields})
+            return
+        }
+
+        client, err := batchClient(r, bc, systemContext, analytics)
+        if err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, err.Error())
+            return
+        }
+        record, err := batches.Create(contextOwner(principalFrom(r.Context())), items, time.Now())
+        if err != nil {
+            writeError(w, r, http.StatusServiceUnavailable, ErrCodeRateLimited, err.Error())
+            return
+        }
+
+        liftWriteDeadline(w, r)
+        logInfof(r.Context(), "Running batch %s with %d items", record.BatchID, len(items))
+        record = batches.Finish(record.BatchID, batches.runItems(r, client, items), time.Now())
+        metrics.Inc("batch_runs_total", "kind", "initial", "status", record.Status)
+        writeJSON(w, r, record)
+    }
+}
+
+func getBatchHandler(batches *BatchStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        record, ok := batches.Get(contextOwner(principalFrom(r.Context())), mux.Vars(r)["batch_id"], time.Now())
+        if !ok {
+            writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Batch not found")
+            return
+        }
+        writeJSON(w, r, record)
+    }
+}
+
+// retryBatchHandler re-runs a batch's failed items and returns the merged
+// record. With nothing left to retry it returns the record unchanged.
+func retryBatchHandler(bc *BedrockClient, batches *BatchStore, systemContext *SystemContext, analytics *PromptAnalytics) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req BatchRetryRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+        client, err := batchClient(r, bc, systemContext, analytics)
+        if err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, err.Error())
+            return
+        }
+
+        id := mux.Vars(r)["batch_id"]
+        items, found, err := batches.ClaimRetry(contextOwner(principalFrom(r.Context())), id, req.ItemIDs, time.Now())
+        switch {
+        case !found:
+            writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Batch not found")
+            return
+        case errors.Is(err, errBatchBusy):
+            writeError(w, r, http.StatusConflict, ErrCodeValidation, "Batch has a run or retry in progress")
+            return
+        case err != nil:
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: err.Error(),
+                Fields:  []FieldError{{Field: "item_ids", Message: err.Error()}},
+            })
+            return
+        }
+
+        retried := make([]string, len(items))
+        for i := range items {
+            if req.Model != "" {
+                items[i].request.Model = req.Model
+            }
+            if req.MaxTokens != 0 {
+                items[i].request.MaxTokens = req.MaxTokens
+            }
+            if req.Temperature != nil {
+                items[i].request.Temperature = req.Temperature
+            }
+            retried[i] = items[i].ItemID
+        }
+
+        liftWriteDeadline(w, r)
+        if len(items) > 0 {
+            logInfof(r.Context(), "Retrying %d failed items of batch %s", len(items), id)
+        }
+        record := batches.Finish(id, batches.runItems(r, client, items), time.Now())
+        record.Retried = retried
+        metrics.Inc("batch_runs_total", "kind", "retry", "status", record.Status)
+        writeJSON(w, r, record)
+    }
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// batchRouter serves the batch endpoints over a store running one item at
+// a time, so items consume the fake's scripted replies in order
+func batchRouter(t *testing.T) (*mux.Router, *BatchStore) {
+    t.Helper()
+    bc, err := NewBedrockClient()
+    if err != nil {
+        t.Fatal(err)
+    }
+    analytics, err := NewPromptAnalytics(PromptAnalyticsConfig{MaxFingerprints: 100})
+    if err != nil {
+        t.Fatal(err)
+    }
+    systemContext := &SystemContext{Location: time.UTC}
+    batches := NewBatchStore(BatchConfig{MaxItems: 10, Concurrency: 1, MaxRecords: 10, TTL: time.Hour})
+
+    router := mux.NewRouter()
+    router.HandleFunc("/generate/batch", generateBatchHandler(bc, batches, systemContext, analytics)).Methods("POST")
+    router.HandleFunc("/generate/batch/{batch_id}", getBatchHandler(batches)).Methods("GET")
+    router.HandleFunc("/generate/batch/{batch_id}/retry", retryBatchHandler(bc, batches, systemContext, analytics)).Methods("POST")
+    return router, batches
+}
+
+// serveBatch sends one request to the router and decodes the record
+func serveBatch(t *testing.T, router http.Handler, method, path, body string) BatchRecord {
+    t.Helper()
+    rec := httptest.NewRecorder()
+    router.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+    if rec.Code != http.StatusOK {
+        t.Fatalf("%s %s: status %d: %s", method, path, rec.Code, rec.Body)
+    }
+    var record BatchRecord
+    if err := json.NewDecoder(rec.Body).Decode(&record); err != nil {
+        t.Fatal(err)
+    }
+    return record
+}
+
+// itemStatuses maps each item to its status
+func itemStatuses(r BatchRecord) map[string]string {
+    statuses := make(map[string]string, len(r.Items))
+    for _, item := range r.Items {
+        statuses[item.ItemID] = item.Status
+    }
+    return statuses
+}
+
+// A retry re-runs the failed items only, and retrying again once they
+// succeed is a no-op: no model calls, and the usage totals don't move
+func TestBatchRetryIdempotent(t *testing.T) {
+    const model = "mistral.mixtral-8x7b-instruct-v0:1"
+    answer := func(text string, in, out int) fakeReply {
+        return fakeReply{Body: `{"outputs":[{"text":"` + text + `","stop_reason":"stop"}]}`, InputTokens: in, OutputTokens: out}
+    }
+    router, _ := batchRouter(t)
+
+    // b is blocked by a guardrail, which fails the item without a fallback
+    fake.Script(model,
+        answer("A", 10, 1),
+        fakeReply{Body: `{"outputs":[{"text":"","stop_reason":"stop"}],"amazon-bedrock-guardrailAction":"INTERVENED"}`},
+        answer("C", 30, 3),
+    )
+    before := len(fake.Calls(model))
+    record := serveBatch(t, router, http.MethodPost, "/generate/batch", `{"model":"`+model+`","items":[
+        {"item_id":"a","prompt":"first"},{"item_id":"b","prompt":"second"},{"item_id":"c","prompt":"third"}]}`)
+    if record.Status != batchPartial || record.Succeeded != 2 || record.Failed != 1 || itemStatuses(record)["b"] != batchItemFailed {
+        t.Fatalf("first run: %s with %d succeeded, %d failed: %v", record.Status, record.Succeeded, record.Failed, itemStatuses(record))
+    }
+    if want := (BatchUsage{Attempts: 3, InputTokens: 40, OutputTokens: 4}); record.Usage != want {
+        t.Errorf("first run usage %+v, want %+v", record.Usage, want)
+    }
+    id := record.BatchID
+
+    fake.Script(model, answer("B", 20, 2))
+    afterRun := len(fake.Calls(model))
+    retried := serveBatch(t, router, http.MethodPost, "/generate/batch/"+id+"/retry", "")
+    if calls := len(fake.Calls(model)) - afterRun; calls != 1 {
+        t.Errorf("retry made %d calls, want 1 for the failed item", calls)
+    }
+    if retried.Status != batchCompleted || retried.Failed != 0 || len(retried.Retried) != 1 || retried.Retried[0] != "b" {
+        t.Errorf("retry: %s with %d failed, retried %v", retried.Status, retried.Failed, retried.Retried)
+    }
+    for _, item := range retried.Items {
+        attempts := 1
+        if item.ItemID == "b" {
+            attempts = 2
+        }
+        if item.Attempts != attempts || item.Response != strings.ToUpper(item.ItemID) {
+            t.Errorf("item %s: %d attempts answering %q", item.ItemID, item.Attempts, item.Response)
+        }
+    }
+    // The blocked attempt counts as an attempt, and the retry adds only its own
+    want := BatchUsage{Attempts: 4, InputTokens: 60, OutputTokens: 6}
+    if retried.Usage != want {
+        t.Errorf("retry usage %+v, want %+v", retried.Usage, want)
+    }
+
+    afterRetry := len(fake.Calls(model))
+    again := serveBatch(t, router, http.MethodPost, "/generate/batch/"+id+"/retry", "")
+    if calls := len(fake.Calls(model)) - afterRetry; calls != 0 {
+        t.Errorf("second retry made %d calls, want none", calls)
+    }
+    if again.Usage != want || len(again.Retried) != 0 || again.Status != batchCompleted {
+        t.Errorf("second retry: usage %+v, retried %v, status %s; want it unchanged", again.Usage, again.Retried, again.Status)
+    }
+    // Naming a succeeded item is a no-op too
+    named := serveBatch(t, router, http.MethodPost, "/generate/batch/"+id+"/retry", `{"item_ids":["a"]}`)
+    if calls := len(fake.Calls(model)) - afterRetry; calls != 0 || named.Usage != want {
+        t.Errorf("retrying a succeeded item made %d calls, usage %+v", calls, named.Usage)
+    }
+
+    if stored := serveBatch(t, router, http.MethodGet, "/generate/batch/"+id, ""); stored.Usage != want || stored.Succeeded != 3 {
+        t.Errorf("stored record: usage %+v, %d succeeded", stored.Usage, stored.Succeeded)
+    }
+    if total := len(fake.Calls(model)) - before; total != 4 {
+        t.Errorf("%d calls to the model in all, want 4", total)
+    }
+}
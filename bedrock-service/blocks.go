@@ -0,0 +1,496 @@
+package main
+
+import (
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// formatBlocks is the "format" that adds the response parsed into blocks
+const formatBlocks = "blocks"
+
+// Block types
+const (
+    blockParagraph = "paragraph"
+    blockHeading   = "heading"
+    blockList      = "list"
+    blockCode      = "code"
+    blockTable     = "table"
+    blockQuote     = "blockquote"
+    blockRule      = "thematic_break"
+)
+
+// maxBlockDepth bounds nested lists and quotes; anything deeper is kept as
+// paragraph text
+const maxBlockDepth = 16
+
+// Block is one structural element of a markdown response. Inline markdown
+// (emphasis, links, code spans) is left in Text for the UI to render.
+type Block struct {
+    Type     string     `json:"type"`
+    Text     string     `json:"text,omitempty"`     // paragraph, heading and code
+    Level    int        `json:"level,omitempty"`    // heading, 1 to 6
+    Language string     `json:"language,omitempty"` // code, from the fence's info string
+    Ordered  bool       `json:"ordered,omitempty"`  // list
+    Start    int        `json:"start,omitempty"`    // Ordered list, the first item's number
+    Items    []ListItem `json:"items,omitempty"`    // list
+    Header   []string   `json:"header,omitempty"`   // table
+    Align    []string   `json:"align,omitempty"`    // table, per column: left, right, center or ""
+    Rows     [][]string `json:"rows,omitempty"`     // table, padded to the header's width
+    Blocks   []Block    `json:"blocks,omitempty"`   // blockquote
+}
+
+// ListItem is one list entry; nested lists and code are blocks of their own
+type ListItem struct {
+    Blocks []Block `json:"blocks"`
+}
+
+var (
+    atxHeadingPattern    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+    thematicBreakPattern = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+    fencePattern         = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})(.*)$")
+    quotePattern         = regexp.MustCompile(`^ {0,3}> ?(.*)$`)
+    bulletPattern        = regexp.MustCompile(`^( {0,3})([-*+])(?:([ \t]+)(.*))?$`)
+    orderedPattern       = regexp.MustCompile(`^( {0,3})(\d{1,9})([.)])(?:([ \t]+)(.*))?$`)
+    tableDelimPattern    = regexp.MustCompile(`^ {0,3}\|?[ \t]*:?-+:?[ \t]*(?:\|[ \t]*:?-+:?[ \t]*)*\|?[ \t]*$`)
+    setextPattern        = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+)
+
+// parseBlocks splits markdown into blocks. It never fails: constructs it
+// doesn't know, like HTML, come out as paragraphs.
+func parseBlocks(text string) []Block {
+    blocks, _ := parseBlockLines(splitBlockLines(text), 0)
+    return blocks
+}
+
+// splitBlockLines splits text into lines without their line endings, with
+// leading tabs expanded so indentation can be counted in spaces. A final
+// line ending doesn't start another line.
+func splitBlockLines(text string) []string {
+    lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+    for i, line := range lines {
+        line = strings.TrimSuffix(line, "\r")
+        n := 0
+        for n < len(line) && (line[n] == ' ' || line[n] == '\t') {
+            n++
+        }
+        lines[i] = strings.ReplaceAll(line[:n], "\t", "    ") + line[n:]
+    }
+    return lines
+}
+
+// parseBlockLines parses lines into blocks, also returning the line each
+// block starts on
+func parseBlockLines(lines []string, depth int) ([]Block, []int) {
+    var blocks []Block
+    var starts []int
+    for i := 0; i < len(lines); {
+        if isBlank(lines[i]) {
+            i++
+            continue
+        }
+        block, next := parseBlock(lines, i, depth)
+        blocks, starts = append(blocks, block), append(starts, i)
+        i = next
+    }
+    return blocks, starts
+}
+
+// parseBlock parses the block starting on lines[i] and returns it with the
+// index of the line after it
+func parseBlock(lines []string, i, depth int) (Block, int) {
+    line := lines[i]
+    if depth >= maxBlockDepth {
+        return parseParagraph(lines, i)
+    }
+
+    if m := fencePattern.FindStringSubmatch(line); m != nil && !(m[2][0] == '`' && strings.Contains(m[3], "`")) {
+        return parseFence(lines, i, len(m[1]), m[2], m[3])
+    }
+    if m := atxHeadingPattern.FindStringSubmatch(line); m != nil {
+        return Block{Type: blockHeading, Level: len(m[1]), Text: strings.TrimSpace(m[2])}, i + 1
+    }
+    if thematicBreakPattern.MatchString(line) {
+        return Block{Type: blockRule}, i + 1
+    }
+    if quotePattern.MatchString(line) {
+        return parseQuote(lines, i, depth)
+    }
+    if _, ok := parseListMarker(line); ok {
+        return parseList(lines, i, depth)
+    }
+    if isTableStart(lines, i) {
+        return parseTable(lines, i)
+    }
+    if indentOf(line) >= 4 {
+        return parseIndentedCode(lines, i)
+    }
+    return parseParagraph(lines, i)
+}
+
+// parseParagraph collects lines until a blank line or the start of another
+// block. An underline of = or - makes it a heading instead.
+func parseParagraph(lines []string, i int) (Block, int) {
+    text := []string{strings.TrimSpace(lines[i])}
+    j := i + 1
+    for ; j < len(lines) && !isBlank(lines[j]); j++ {
+        if m := setextPattern.FindStringSubmatch(lines[j]); m != nil {
+            level := 1
+            if m[1][0] == '-' {
+                level = 2
+            }
+            return Block{Type: blockHeading, Level: level, Text: strings.Join(text, "\n")}, j + 1
+        }
+        if interruptsParagraph(lines, j) {
+            break
+        }
+        text = append(text, strings.TrimSpace(lines[j]))
+    }
+    return Block{Type: blockParagraph, Text: strings.Join(text, "\n")}, j
+}
+
+// interruptsParagraph reports whether lines[j] starts a block that ends the
+// paragraph before it. Numbered lists only do so from 1, so a sentence
+// wrapped onto a line starting "2019." stays in its paragraph.
+func interruptsParagraph(lines []string, j int) bool {
+    line := lines[j]
+    if fencePattern.MatchString(line) || atxHeadingPattern.MatchString(line) || thematicBreakPattern.MatchString(line) || quotePattern.MatchString(line) {
+        return true
+    }
+    if marker, ok := parseListMarker(line); ok {
+        return !marker.ordered || marker.start == 1
+    }
+    return isTableStart(lines, j)
+}
+
+// parseFence reads a fenced code block. An unclosed fence runs to the end,
+// as it would in any renderer.
+func parseFence(lines []string, i, indent int, fence, info string) (Block, int) {
+    block := Block{Type: blockCode}
+    if fields := strings.Fields(info); len(fields) > 0 {
+        block.Language = fields[0]
+    }
+    var code []string
+    j := i + 1
+    for ; j < len(lines); j++ {
+        trimmed := strings.TrimSpace(lines[j])
+        if indentOf(lines[j]) < 4 && strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+            j++
+            break
+        }
+        code = append(code, stripIndent(lines[j], indent))
+    }
+    block.Text = strings.Join(code, "\n")
+    return block, j
+}
+
+// parseIndentedCode reads a code block indented by four spaces
+func parseIndentedCode(lines []string, i int) (Block, int) {
+    var code []string
+    j := i
+    for ; j < len(lines) && (isBlank(lines[j]) || indentOf(lines[j]) >= 4); j++ {
+        code = append(code, stripIndent(lines[j], 4))
+    }
+    for len(code) > 0 && isBlank(code[len(code)-1]) {
+        code = code[:len(code)-1]
+    }
+    return Block{Type: blockCode, Text: strings.Join(code, "\n")}, i + len(code)
+}
+
+// parseQuote reads a blockquote and parses its contents as blocks. Lines
+// that continue a quoted paragraph without the marker are part of it.
+func parseQuote(lines []string, i, depth int) (Block, int) {
+    var inner []string
+    j := i
+    for ; j < len(lines); j++ {
+        if m := quotePattern.FindStringSubmatch(lines[j]); m != nil {
+            inner = append(inner, m[1])
+            continue
+        }
+        if isBlank(lines[j]) || isBlank(inner[len(inner)-1]) || startsBlock(lines, j) {
+            break
+        }
+        inner = append(inner, lines[j])
+    }
+    blocks, _ := parseBlockLines(splitBlockLines(strings.Join(inner, "\n")), depth+1)
+    return Block{Type: blockQuote, Blocks: blocks}, j
+}
+
+// listMarker is the marker opening a list item
+type listMarker struct {
+    ordered bool
+    char    byte   // -, * or + for bullets; . or ) for numbers
+    start   int
+    indent  int    // Column the item's content starts at
+    rest    string // Text after the marker
+}
+
+func parseListMarker(line string) (listMarker, bool) {
+    var marker listMarker
+    var indent, mark, space string
+    if m := bulletPattern.FindStringSubmatch(line); m != nil {
+        indent, mark, space, marker.rest = m[1], m[2], m[3], m[4]
+        marker.char = mark[0]
+    } else if m := orderedPattern.FindStringSubmatch(line); m != nil {
+        indent, space, marker.rest = m[1], m[4], m[5]
+        mark = m[2] + m[3]
+        marker.ordered, marker.char = true, m[3][0]
+        marker.start, _ = strconv.Atoi(m[2])
+    } else {
+        return marker, false
+    }
+
+    // More than four spaces after the marker is indented code in the item
+    switch {
+    case space == "":
+        marker.indent = len(indent) + len(mark) + 1
+    case len(space) > 4:
+        marker.indent = len(indent) + len(mark) + 1
+        marker.rest = space[1:] + marker.rest
+    default:
+        marker.indent = len(indent) + len(mark) + len(space)
+    }
+    return marker, true
+}
+
+// parseList reads consecutive items with the same kind of marker. Lines
+// indented to an item's content belong to it and are parsed as blocks, which
+// is where nested lists come from.
+func parseList(lines []string, i, depth int) (Block, int) {
+    first, _ := parseListMarker(lines[i])
+    block := Block{Type: blockList, Ordered: first.ordered}
+    if first.ordered {
+        block.Start = first.start
+    }
+
+    item := []string{first.rest}
+    indent := first.indent
+    finish := func() {
+        for len(item) > 0 && isBlank(item[len(item)-1]) {
+            item = item[:len(item)-1]
+        }
+        blocks, _ := parseBlockLines(item, depth+1)
+        block.Items = append(block.Items, ListItem{Blocks: blocks})
+    }
+
+    j := i + 1
+    for ; j < len(lines); j++ {
+        line := lines[j]
+        if isBlank(line) {
+            item = append(item, "")
+            continue
+        }
+        if indentOf(line) >= indent {
+            item = append(item, stripIndent(line, indent))
+            continue
+        }
+        if thematicBreakPattern.MatchString(line) {
+            break
+        }
+        if marker, ok := parseListMarker(line); ok {
+            if marker.ordered != first.ordered || marker.char != first.char {
+                break
+            }
+            finish()
+            item, indent = []string{marker.rest}, marker.indent
+            continue
+        }
+        // Lazy continuation of the item's last paragraph
+        if isBlank(item[len(item)-1]) || startsBlock(lines, j) {
+            break
+        }
+        item = append(item, strings.TrimSpace(line))
+    }
+    finish()
+
+    // Blank lines after the last item aren't part of the list
+    for j > i+1 && isBlank(lines[j-1]) {
+        j--
+    }
+    return block, j
+}
+
+// isTableStart reports whether lines[i] is a table header: a row with pipes
+// followed by a delimiter row with as many columns
+func isTableStart(lines []string, i int) bool {
+    if i+1 >= len(lines) || !strings.Contains(lines[i], "|") || !tableDelimPattern.MatchString(lines[i+1]) {
+        return false
+    }
+    return len(tableCells(lines[i])) == len(tableCells(lines[i+1]))
+}
+
+// parseTable reads a table's header, alignment and rows. Rows run until a
+// blank line or another block.
+func parseTable(lines []string, i int) (Block, int) {
+    block := Block{Type: blockTable, Header: tableCells(lines[i])}
+    aligned := false
+    for _, cell := range tableCells(lines[i+1]) {
+        align := ""
+        switch left, right := strings.HasPrefix(cell, ":"), strings.HasSuffix(cell, ":"); {
+        case left && right:
+            align = "center"
+        case left:
+            align = "left"
+        case right:
+            align = "right"
+        }
+        block.Align = append(block.Align, align)
+        aligned = aligned || align != ""
+    }
+    if !aligned {
+        block.Align = nil
+    }
+
+    j := i + 2
+    for ; j < len(lines) && !isBlank(lines[j]) && !startsBlock(lines, j); j++ {
+        cells := tableCells(lines[j])
+        row := make([]string, len(block.Header))
+        copy(row, cells)
+        block.Rows = append(block.Rows, row)
+    }
+    return block, j
+}
+
+// tableCells splits a table row on unescaped pipes
+func tableCells(line string) []string {
+    line = strings.TrimSpace(line)
+    line = strings.TrimPrefix(line, "|")
+    if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+        line = line[:len(line)-1]
+    }
+    var cells []string
+    var cell strings.Builder
+    for k := 0; k < len(line); k++ {
+        switch {
+        case line[k] == '\\' && k+1 < len(line) && line[k+1] == '|':
+            cell.WriteByte('|')
+            k++
+        case line[k] == '|':
+            cells = append(cells, strings.TrimSpace(cell.String()))
+            cell.Reset()
+        default:
+            cell.WriteByte(line[k])
+        }
+    }
+    return append(cells, strings.TrimSpace(cell.String()))
+}
+
+// startsBlock reports whether lines[j] opens a block other than a paragraph
+// at the current level
+func startsBlock(lines []string, j int) bool {
+    line := lines[j]
+    if _, ok := parseListMarker(line); ok {
+        return true
+    }
+    return fencePattern.MatchString(line) || atxHeadingPattern.MatchString(line) || thematicBreakPattern.MatchString(line) ||
+        quotePattern.MatchString(line) || isTableStart(lines, j)
+}
+
+func isBlank(line string) bool {
+    return strings.TrimSpace(line) == ""
+}
+
+func indentOf(line string) int {
+    return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// stripIndent removes up to n leading spaces
+func stripIndent(line string, n int) string {
+    if indent := indentOf(line); indent < n {
+        n = indent
+    }
+    return line[n:]
+}
+
+// checkFormat rejects an unknown format. Blocks are parsed from markdown,
+// so they can't be combined with JSON output.
+func (req *GenerateRequest) checkFormat() *APIError {
+    if req.Format != "" && req.Format != formatBlocks {
+        return &APIError{
+            Code:    ErrCodeValidation,
+            Message: "Unknown format",
+            Fields:  []FieldError{{Field: "format", Message: "must be \"blocks\" or left out"}},
+        }
+    }
+    if req.Format == formatBlocks && req.ResponseFormat != nil {
+        return &APIError{
+            Code:    ErrCodeValidation,
+            Message: "format \"blocks\" can't be combined with response_format",
+            Fields:  []FieldError{{Field: "format", Message: "must be left out with response_format"}},
+        }
+    }
+    return nil
+}
+
+// blockEvent is a complete block sent in place of text deltas
+type blockEvent struct {
+    Index int   `json:"index"`
+    Block Block `json:"block"`
+}
+
+// blocksWriter turns the text deltas of a stream into block events. A block
+// is sent once the next one has started, since until then more text could
+// still extend it; the last is sent ahead of the done event.
+type blocksWriter struct {
+    sink    eventWriter
+    pending string // Text from the first line of the first unsent block
+    sent    int
+}
+
+func newBlocksWriter(sink eventWriter) *blocksWriter {
+    return &blocksWriter{sink: sink}
+}
+
+func (b *blocksWriter) Send(event string, data interface{}) error {
+    switch event {
+    case "delta":
+        if delta, ok := data.(textDeltaEvent); ok {
+            b.pending += delta.Text
+            return b.flush(false)
+        }
+    case "done":
+        if err := b.flush(true); err != nil {
+            return err
+        }
+    }
+    return b.sink.Send(event, data)
+}
+
+// flush sends the blocks that are complete. Only whole lines are parsed
+// until the stream ends.
+func (b *blocksWriter) flush(final bool) error {
+    text := b.pending
+    if !final {
+        end := strings.LastIndexByte(text, '\n')
+        if end < 0 {
+            return nil
+        }
+        text = text[:end]
+    }
+    lines := strings.Split(text, "\n")
+    blocks, starts := parseBlockLines(splitBlockLines(text), 0)
+    ready := len(blocks)
+    if !final {
+        ready--
+    }
+    if ready <= 0 {
+        return nil
+    }
+    for _, block := range blocks[:ready] {
+        if err := b.sink.Send("block", blockEvent{Index: b.sent, Block: block}); err != nil {
+            return err
+        }
+        b.sent++
+    }
+
+    if final {
+        b.pending = ""
+        return nil
+    }
+    offset := 0
+    for _, line := range lines[:starts[ready]] {
+        offset += len(line) + 1
+    }
+    b.pending = b.pending[offset:]
+    return nil
+}
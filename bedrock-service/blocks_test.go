@@ -0,0 +1,81 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// The markdown corpus lives in testdata/blocks: each name.md is parsed and
+// compared with name.json, which -update rewrites for review
+func TestParseBlocksCorpus(t *testing.T) {
+    paths, _ := filepath.Glob(filepath.Join("testdata", "blocks", "*.md"))
+    if len(paths) == 0 {
+        t.Fatal("no markdown under testdata/blocks")
+    }
+    for _, path := range paths {
+        path := path
+        name := strings.TrimSuffix(filepath.Base(path), ".md")
+        t.Run(name, func(t *testing.T) {
+            text, err := os.ReadFile(path)
+            if err != nil {
+                t.Fatal(err)
+            }
+            blocks := parseBlocks(string(text))
+            golden(t, strings.TrimSuffix(path, ".md")+".json", name, blocks)
+
+            // Streamed a few bytes at a time, it comes out as the same blocks
+            if streamed := streamBlocks(t, string(text), 7); !reflect.DeepEqual(streamed, blocks) {
+                t.Errorf("streamed as\n%+v\nparsed as\n%+v", streamed, blocks)
+            }
+        })
+    }
+}
+
+// blockRecorder collects the block events a blocksWriter sends
+type blockRecorder struct {
+    blocks []Block
+}
+
+func (r *blockRecorder) Send(event string, data interface{}) error {
+    if e, ok := data.(blockEvent); ok && event == "block" {
+        r.blocks = append(r.blocks, e.Block)
+    }
+    return nil
+}
+
+// streamBlocks sends text through a blocksWriter in deltas of size bytes
+func streamBlocks(t *testing.T, text string, size int) []Block {
+    t.Helper()
+    recorder := &blockRecorder{}
+    w := newBlocksWriter(recorder)
+    for len(text) > 0 {
+        n := size
+        if n > len(text) {
+            n = len(text)
+        }
+        if err := w.Send("delta", textDeltaEvent{Text: text[:n]}); err != nil {
+            t.Fatal(err)
+        }
+        text = text[n:]
+    }
+    if err := w.Send("done", nil); err != nil {
+        t.Fatal(err)
+    }
+    return recorder.blocks
+}
+
+// Nesting past maxBlockDepth is kept as paragraph text rather than recursed into
+func TestParseBlocksDepth(t *testing.T) {
+    blocks := parseBlocks(strings.Repeat(">", maxBlockDepth+4) + " deep")
+    depth := 0
+    for len(blocks) == 1 && blocks[0].Type == blockQuote {
+        blocks = blocks[0].Blocks
+        depth++
+    }
+    if depth != maxBlockDepth || len(blocks) != 1 || blocks[0].Type != blockParagraph {
+        t.Errorf("%d quotes deep, then %+v", depth, blocks)
+    }
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+)
+
+// maxRequestBodyEnv overrides the largest request body read, in bytes
+const maxRequestBodyEnv = "REQUEST_MAX_BODY_BYTES"
+
+type bodyKey struct{}
+
+// LoadMaxRequestBody reads REQUEST_MAX_BODY_BYTES (default 10 MiB). Routes
+// with tighter limits of their own still apply them to the buffered body.
+func LoadMaxRequestBody() (int64, error) {
+    limit := int64(10 << 20)
+    if v := os.Getenv(maxRequestBodyEnv); v != "" {
+        n, err := strconv.ParseInt(v, 10, 64)
+        if err != nil || n < 1 {
+            return 0, fmt.Errorf("invalid %s %q", maxRequestBodyEnv, v)
+        }
+        limit = n
+    }
+    return limit, nil
+}
+
+// requestBody returns the buffered request body. Every consumer, whether it
+// decodes, hashes or logs, reads this copy instead of the connection.
+func requestBody(r *http.Request) []byte {
+    body, _ := r.Context().Value(bodyKey{}).([]byte)
+    return body
+}
+
+// bodyBufferMiddleware reads the request body exactly once, completely, into
+// a bounded buffer, and hands downstream handlers a replayable copy. It runs
+// after authentication and rate limiting: net/http only answers
+// "Expect: 100-continue" on the first body read, so requests rejected
+// earlier, or declaring an oversized Content-Length, are refused before the
+// client uploads anything.
+//
+// A body cut short by a reset or timeout is rejected here as incomplete,
+// rather than reaching a decoder and failing as malformed JSON.
+func bodyBufferMiddleware(limit int64) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if r.Body == nil || r.Body == http.NoBody {
+                next.ServeHTTP(w, r)
+                return
+            }
+            if r.ContentLength > limit {
+                metrics.Inc("request_body_rejected_total", "reason", "too_large")
+                requestRecordFrom(r.Context()).Policy("request body limit: Content-Length %d exceeds %d bytes", r.ContentLength, limit)
+                writeError(w, r, http.StatusRequestEntityTooLarge, ErrCodeValidation, fmt.Sprintf("Request body exceeds the %d byte limit", limit))
+                return
+            }
+
+            var buf bytes.Buffer
+            if r.ContentLength > 0 {
+                buf.Grow(int(r.ContentLength))
+            }
+            _, err := buf.ReadFrom(http.MaxBytesReader(w, r.Body, limit))
+            if err != nil {
+                status, reason, message := bodyReadFailure(err, limit)
+                metrics.Inc("request_body_rejected_total", "reason", reason)
+                requestRecordFrom(r.Context()).Policy("request body %s after %d bytes", reason, buf.Len())
+                logWarnf(r.Context(), "Rejected %s %s: request body %s after %d bytes: %v", r.Method, r.URL.Path, reason, buf.Len(), err)
+                writeError(w, r, status, ErrCodeValidation, message)
+                return
+            }
+
+            body := buf.Bytes()
+            requestRecordFrom(r.Context()).setBody(body)
+            r.Body = io.NopCloser(bytes.NewReader(body))
+            r.ContentLength = int64(len(body))
+            r.GetBody = func() (io.ReadCloser, error) {
+                return io.NopCloser(bytes.NewReader(body)), nil
+            }
+            next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), bodyKey{}, body)))
+        })
+    }
+}
+
+// bodyReadFailure maps a failed body read to a response. Incomplete uploads
+// are safe to retry: nothing downstream ever saw a partial body.
+func bodyReadFailure(err error, limit int64) (int, string, string) {
+    var tooLarge *http.MaxBytesError
+    var netErr net.Error
+    switch {
+    case errors.As(err, &tooLarge):
+        return http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("Request body exceeds the %d byte limit", limit)
+    case errors.As(err, &netErr) && netErr.Timeout():
+        return http.StatusRequestTimeout, "timeout", "Timed out reading the request body; retry the request"
+    default:
+        return http.StatusBadRequest, "incomplete", "Request body was incomplete; retry the request"
+    }
+}
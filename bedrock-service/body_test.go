@@ -0,0 +1,140 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+const testBodyLimit = 64
+
+// bodyServer serves bodyBufferMiddleware in front of a handler that counts
+// its calls and echoes the body it was given
+func bodyServer(t *testing.T, readTimeout time.Duration) (*httptest.Server, *int32) {
+    t.Helper()
+    var ran int32
+    handler := bodyBufferMiddleware(testBodyLimit)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt32(&ran, 1)
+        read, _ := io.ReadAll(r.Body)
+        replay, _ := r.GetBody()
+        replayed, _ := io.ReadAll(replay)
+        if !bytes.Equal(read, requestBody(r)) || !bytes.Equal(read, replayed) {
+            http.Error(w, "body copies differ", http.StatusInternalServerError)
+            return
+        }
+        w.Write(read)
+    }))
+    server := httptest.NewUnstartedServer(handler)
+    server.Config.ReadTimeout = readTimeout
+    server.Start()
+    t.Cleanup(server.Close)
+    return server, &ran
+}
+
+// rawRequest writes head, then body, on a new connection and returns the
+// response. With halfClose the connection's write side is shut after the
+// body, as a client that gave up on the upload would.
+func rawRequest(t *testing.T, server *httptest.Server, head, body string, halfClose bool) *http.Response {
+    t.Helper()
+    conn, err := net.Dial("tcp", server.Listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    if _, err := io.WriteString(conn, head+"\r\n"+body); err != nil {
+        t.Fatal(err)
+    }
+    if halfClose {
+        conn.(*net.TCPConn).CloseWrite()
+    }
+    resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { resp.Body.Close() })
+    return resp
+}
+
+// rejections counts request_body_rejected_total for reason
+func rejections(reason string) float64 {
+    return metrics.Value("request_body_rejected_total", "reason", reason)
+}
+
+func TestBodyBufferAccepts(t *testing.T) {
+    server, ran := bodyServer(t, time.Second)
+    for name, head := range map[string]string{
+        "content length": "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 13\r\n",
+        "chunked":        "POST / HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n",
+    } {
+        body := `{"prompt":1}` + "\n"
+        if strings.Contains(head, "chunked") {
+            body = "6\r\n" + body[:6] + "\r\n7\r\n" + body[6:] + "\r\n0\r\n\r\n"
+        }
+        resp := rawRequest(t, server, head, body, false)
+        echoed, _ := io.ReadAll(resp.Body)
+        if resp.StatusCode != http.StatusOK || string(echoed) != `{"prompt":1}`+"\n" {
+            t.Errorf("%s: status %d, echoed %q", name, resp.StatusCode, echoed)
+        }
+    }
+    if *ran != 2 {
+        t.Errorf("handler ran %d times, want 2", *ran)
+    }
+}
+
+// None of these bodies reaches the handler, whole or in part
+func TestBodyBufferRejects(t *testing.T) {
+    big := strings.Repeat("x", testBodyLimit+1)
+    for _, c := range []struct {
+        name      string
+        head      string
+        body      string
+        halfClose bool
+        status    int
+        reason    string
+    }{
+        {"declared too large", fmt.Sprintf("POST / HTTP/1.1\r\nHost: test\r\nContent-Length: %d\r\nExpect: 100-continue\r\n", len(big)), "", false,
+            http.StatusRequestEntityTooLarge, "too_large"},
+        {"chunked over the limit", "POST / HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n",
+            fmt.Sprintf("20\r\n%s\r\n%x\r\n%s\r\n0\r\n\r\n", big[:32], len(big)-32, big[32:]), false,
+            http.StatusRequestEntityTooLarge, "too_large"},
+        {"client abort", "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 40\r\n", `{"prompt":"cut`, true,
+            http.StatusBadRequest, "incomplete"},
+        {"chunked abort", "POST / HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n", "10\r\n{\"prompt\":", true,
+            http.StatusBadRequest, "incomplete"},
+        {"read timeout", "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 40\r\n", `{"prompt":"slow`, false,
+            http.StatusRequestTimeout, "timeout"},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            server, ran := bodyServer(t, 200*time.Millisecond)
+            before := rejections(c.reason)
+
+            resp := rawRequest(t, server, c.head, c.body, c.halfClose)
+            if resp.StatusCode != c.status {
+                t.Errorf("status %d, want %d", resp.StatusCode, c.status)
+            }
+            if resp.StatusCode == http.StatusContinue {
+                t.Error("the server asked for an oversized body")
+            }
+            var envelope errorEnvelope
+            if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil || envelope.Error.Code != ErrCodeValidation {
+                t.Errorf("error %+v (%v)", envelope.Error, err)
+            }
+            if *ran != 0 {
+                t.Errorf("handler ran %d times", *ran)
+            }
+            if got := rejections(c.reason); got != before+1 {
+                t.Errorf("%s rejections went from %v to %v", c.reason, before, got)
+            }
+        })
+    }
+}
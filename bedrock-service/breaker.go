@@ -0,0 +1,202 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "strconv"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// A model that keeps failing between availability probes is taken out of
+// the fallback chain rather than making every request pay for the failure.
+// After BreakerConfig.Threshold consecutive failures its breaker opens and
+// the model is marked unavailable. Once the cooldown passes the breaker is
+// half-open: the next request that reaches the model is let through as a
+// trial, and its outcome closes the breaker or opens it for another
+// cooldown. Requests queued behind a trial skip the model.
+
+// errBreakerOpen is the failure when every model left was skipped
+var errBreakerOpen = errors.New("model skipped: its breaker is open")
+
+// Breaker states reported on /models
+const (
+    breakerClosed   = "closed"
+    breakerOpen     = "open"
+    breakerHalfOpen = "half_open"
+)
+
+// BreakerConfig controls when a failing model is taken out of rotation
+type BreakerConfig struct {
+    Threshold int           // Consecutive failures that open the breaker, 0 disables it
+    Cooldown  time.Duration // How long an open breaker keeps the model out before a trial
+}
+
+// LoadBreakerConfig reads MODEL_BREAKER_THRESHOLD (default 5) and
+// MODEL_BREAKER_COOLDOWN_SECONDS (default 60)
+func LoadBreakerConfig() (BreakerConfig, error) {
+    cfg := BreakerConfig{Threshold: 5, Cooldown: time.Minute}
+    if v := os.Getenv("MODEL_BREAKER_THRESHOLD"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            return cfg, fmt.Errorf("invalid MODEL_BREAKER_THRESHOLD %q", v)
+        }
+        cfg.Threshold = n
+    }
+    if v := os.Getenv("MODEL_BREAKER_COOLDOWN_SECONDS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return cfg, fmt.Errorf("invalid MODEL_BREAKER_COOLDOWN_SECONDS %q", v)
+        }
+        cfg.Cooldown = time.Duration(n) * time.Second
+    }
+    return cfg, nil
+}
+
+// modelBreaker is one model's failure tracking, guarded by
+// BedrockClient.modelsMu
+type modelBreaker struct {
+    failures  int
+    lastError string
+    openUntil time.Time // Zero while closed
+    trial     bool      // A half-open trial request is in flight
+}
+
+func (b *modelBreaker) state(now time.Time) string {
+    switch {
+    case b.openUntil.IsZero():
+        return breakerClosed
+    case b.trial || !now.Before(b.openUntil):
+        return breakerHalfOpen
+    }
+    return breakerOpen
+}
+
+// BreakerStatus is a model's breaker as reported on /models
+type BreakerStatus struct {
+    State               string     `json:"state"`
+    ConsecutiveFailures int        `json:"consecutive_failures"`
+    LastError           string     `json:"last_error,omitempty"`
+    RetryAt             *time.Time `json:"retry_at,omitempty"` // When an open breaker lets a trial through
+}
+
+// breakerStatusLocked reports a model's breaker; callers hold modelsMu
+func (bc *BedrockClient) breakerStatusLocked(id string, now time.Time) BreakerStatus {
+    b, ok := bc.breakers[id]
+    if !ok {
+        return BreakerStatus{State: breakerClosed}
+    }
+    status := BreakerStatus{State: b.state(now), ConsecutiveFailures: b.failures, LastError: b.lastError}
+    if !b.openUntil.IsZero() {
+        retryAt := b.openUntil
+        status.RetryAt = &retryAt
+    }
+    return status
+}
+
+// breakerReadyLocked reports whether an unavailable model is due a trial
+// request; callers hold modelsMu
+func (bc *BedrockClient) breakerReadyLocked(id string, now time.Time) bool {
+    b, ok := bc.breakers[id]
+    return ok && !b.trial && b.state(now) == breakerHalfOpen
+}
+
+// breakerOpenLocked reports whether a model's breaker is keeping it out;
+// callers hold modelsMu
+func (bc *BedrockClient) breakerOpenLocked(id string) bool {
+    b, ok := bc.breakers[id]
+    return ok && !b.openUntil.IsZero()
+}
+
+// breakerAdmit reports whether a request may try the model now. A half-open
+// breaker admits one trial at a time.
+func (bc *BedrockClient) breakerAdmit(id string, now time.Time) bool {
+    bc.modelsMu.Lock()
+    defer bc.modelsMu.Unlock()
+
+    b, ok := bc.breakers[id]
+    if !ok {
+        return true
+    }
+    switch b.state(now) {
+    case breakerOpen:
+        return false
+    case breakerHalfOpen:
+        if b.trial {
+            return false
+        }
+        b.trial = true
+        log.Printf("Model %s breaker half-open, letting a trial request through", id)
+    }
+    return true
+}
+
+// countsAgainstModel reports whether err says something about the model
+// rather than about the request: cancellations, the caller's own deadline
+// and requests the model rejects as invalid don't count
+func countsAgainstModel(err error) bool {
+    var validation *types.ValidationException
+    return !isCancelled(err) && !isDeadline(err) && !errors.As(err, &validation)
+}
+
+// breakerRecord records the outcome of a request the breaker admitted
+func (bc *BedrockClient) breakerRecord(id string, err error, now time.Time) {
+    if bc.breakerCfg.Threshold == 0 {
+        return
+    }
+    bc.modelsMu.Lock()
+    defer bc.modelsMu.Unlock()
+
+    b, ok := bc.breakers[id]
+    if err == nil {
+        if !ok {
+            return
+        }
+        if !b.openUntil.IsZero() {
+            log.Printf("Model %s breaker closed: trial request succeeded", id)
+            bc.setAvailableLocked(id, true, breakerHalfOpen, breakerClosed, "trial request succeeded", now)
+        }
+        delete(bc.breakers, id)
+        bc.invalidateModelsListing()
+        return
+    }
+    if !countsAgainstModel(err) {
+        if ok {
+            b.trial = false
+        }
+        return
+    }
+    if !ok {
+        b = &modelBreaker{}
+        bc.breakers[id] = b
+    }
+    b.failures++
+    b.lastError = err.Error()
+
+    // A failed trial reopens the breaker straight away
+    if b.trial || (b.openUntil.IsZero() && b.failures >= bc.breakerCfg.Threshold) {
+        from := breakerClosed
+        if b.trial {
+            from = breakerHalfOpen
+        }
+        b.openUntil, b.trial = now.Add(bc.breakerCfg.Cooldown), false
+        log.Printf("Model %s breaker open for %v after %d consecutive failures: %v", id, bc.breakerCfg.Cooldown, b.failures, err)
+        metrics.Inc("model_breaker_opened_total", "model", id)
+        bc.setAvailableLocked(id, false, from, breakerOpen, b.lastError, now)
+    }
+    bc.invalidateModelsListing()
+}
+
+// setAvailableLocked changes a model's availability for its breaker and
+// records the transition; callers hold modelsMu
+func (bc *BedrockClient) setAvailableLocked(id string, available bool, from, to, cause string, now time.Time) {
+    for i := range bc.availableModels {
+        if bc.availableModels[i].ID == id {
+            bc.availableModels[i].Available = available
+        }
+    }
+    bc.events.Record(RegistryEvent{Time: now, ModelID: id, Type: registryEventBreaker, From: from, To: to, Cause: cause})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "testing"
+    "time"
+)
+
+// The cached /models body notices an open breaker turning half-open, which
+// happens by time alone with nothing to invalidate the cache
+func TestModelsListingBreakerCooldown(t *testing.T) {
+    bc, err := NewBedrockClient()
+    if err != nil {
+        t.Fatal(err)
+    }
+    bc.breakerCfg = BreakerConfig{Threshold: 1, Cooldown: 50 * time.Millisecond}
+    id := bc.models()[0].ID
+    state := func() string {
+        var body struct {
+            Models []modelListing `json:"models"`
+        }
+        if err := json.Unmarshal(bc.modelsListing(), &body); err != nil {
+            t.Fatal(err)
+        }
+        for _, model := range body.Models {
+            if model.ID == id {
+                return model.Breaker.State
+            }
+        }
+        t.Fatalf("%s not listed", id)
+        return ""
+    }
+
+    if got := state(); got != breakerClosed {
+        t.Fatalf("breaker %s before any failure", got)
+    }
+    bc.breakerRecord(id, errors.New("boom"), time.Now())
+    if got := state(); got != breakerOpen {
+        t.Fatalf("breaker %s after the failure, want %s", got, breakerOpen)
+    }
+    if got := state(); got != breakerOpen {
+        t.Fatalf("breaker %s from the cache, want %s", got, breakerOpen)
+    }
+    time.Sleep(60 * time.Millisecond)
+    if got := state(); got != breakerHalfOpen {
+        t.Errorf("breaker %s after the cooldown, want %s", got, breakerHalfOpen)
+    }
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "os"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Label values used when a request is untagged or past the series budget
+const (
+    callerNone  = "none"
+    callerOther = "other"
+)
+
+// callerTagPattern bounds the characters and length of tag values
+var callerTagPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// CallerTags attribute a request to a downstream service and operation
+type CallerTags struct {
+    Service   string
+    Operation string
+}
+
+type callerTagsKey struct{}
+
+// callerTagsFrom returns the request's tags, "none" for untagged requests
+func callerTagsFrom(ctx context.Context) CallerTags {
+    if tags, ok := ctx.Value(callerTagsKey{}).(CallerTags); ok {
+        return tags
+    }
+    return CallerTags{Service: callerNone, Operation: callerNone}
+}
+
+// validateCallerServices checks an allowlist from API_KEYS_FILE
+func validateCallerServices(services map[string][]string) error {
+    reserved := func(v string) bool { return v == callerNone || v == callerOther }
+    for service, operations := range services {
+        if !callerTagPattern.MatchString(service) || reserved(service) {
+            return fmt.Errorf("caller_services: invalid service %q", service)
+        }
+        for _, op := range operations {
+            if !callerTagPattern.MatchString(op) || reserved(op) {
+                return fmt.Errorf("caller_services[%s]: invalid operation %q", service, op)
+            }
+        }
+    }
+    return nil
+}
+
+// callerTags validates requested tags against the key's allowlist. Only
+// values listed in API_KEYS_FILE are ever accepted, so the set of tags is
+// fixed by configuration rather than by callers.
+func (p KeyPolicy) callerTags(service, operation string) (CallerTags, *FieldError) {
+    if service == "" {
+        return CallerTags{}, &FieldError{Field: "X-Caller-Service", Message: "is required with X-Caller-Operation"}
+    }
+    operations, ok := p.CallerServices[service]
+    if !ok {
+        return CallerTags{}, &FieldError{Field: "X-Caller-Service", Message: fmt.Sprintf("%q is not allowed for this API key", service)}
+    }
+    if operation == "" {
+        return CallerTags{Service: service, Operation: callerNone}, nil
+    }
+    for _, op := range operations {
+        if op == operation {
+            return CallerTags{Service: service, Operation: operation}, nil
+        }
+    }
+    return CallerTags{}, &FieldError{Field: "X-Caller-Operation", Message: fmt.Sprintf("%q is not allowed for service %q", operation, service)}
+}
+
+// callerTagsMiddleware attaches validated X-Caller-Service and
+// X-Caller-Operation tags to the request context
+func callerTagsMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        service := strings.TrimSpace(r.Header.Get("X-Caller-Service"))
+        operation := strings.TrimSpace(r.Header.Get("X-Caller-Operation"))
+        if service == "" && operation == "" {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        tags, fieldErr := principalFrom(r.Context()).Policy.callerTags(service, operation)
+        if fieldErr != nil {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: "Invalid caller tags",
+                Fields:  []FieldError{*fieldErr},
+            })
+            return
+        }
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerTagsKey{}, tags)))
+    })
+}
+
+// UsageTotals are the counters kept per attribution row
+type UsageTotals struct {
+    Requests     int `json:"requests"`
+    Errors       int `json:"errors"`
+    InputTokens  int `json:"input_tokens"`
+    OutputTokens int `json:"output_tokens"`
+}
+
+// UsageGroup is one row of GET /usage
+type UsageGroup struct {
+    Key string `json:"key"`
+    UsageTotals
+}
+
+type usageKey struct {
+    owner, service, operation, model string
+}
+
+// Supported group_by values for GET /usage
+var usageGroupings = map[string]func(k usageKey) string{
+    "caller_service":   func(k usageKey) string { return k.service },
+    "caller_operation": func(k usageKey) string { return k.service + "/" + k.operation },
+    "model":            func(k usageKey) string { return k.model },
+}
+
+// UsageLedger attributes requests and tokens to caller tags. Distinct
+// service/operation pairs are admitted up to MaxSeries; later pairs are
+// folded into "other" in both the ledger and the metrics.
+type UsageLedger struct {
+    maxSeries int
+
+    mu       sync.Mutex
+    admitted map[CallerTags]bool
+    totals   map[usageKey]*UsageTotals
+}
+
+// callerUsage is the process-wide ledger
+var callerUsage = NewUsageLedger(100)
+
+func NewUsageLedger(maxSeries int) *UsageLedger {
+    return &UsageLedger{
+        maxSeries: maxSeries,
+        admitted:  make(map[CallerTags]bool),
+        totals:    make(map[usageKey]*UsageTotals),
+    }
+}
+
+// LoadUsageLedger reads CALLER_TAGS_MAX_SERIES
+func LoadUsageLedger() (*UsageLedger, error) {
+    maxSeries := 100
+    if v := os.Getenv("CALLER_TAGS_MAX_SERIES"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return nil, fmt.Errorf("invalid CALLER_TAGS_MAX_SERIES %q", v)
+        }
+        maxSeries = n
+    }
+    return NewUsageLedger(maxSeries), nil
+}
+
+// labelsLocked returns the tags to record under, folding pairs past the budget into "other"
+func (u *UsageLedger) labelsLocked(tags CallerTags) CallerTags {
+    if u.admitted[tags] {
+        return tags
+    }
+    if len(u.admitted) >= u.maxSeries {
+        return CallerTags{Service: callerOther, Operation: callerOther}
+    }
+    u.admitted[tags] = true
+    return tags
+}
+
+// Record attributes one model invocation to the request's caller tags
+func (u *UsageLedger) Record(ctx context.Context, model string, inputTokens, outputTokens int, failed bool) {
+    u.mu.Lock()
+    tags := u.labelsLocked(callerTagsFrom(ctx))
+    key := usageKey{
+        owner:     contextOwner(principalFrom(ctx)),
+        service:   tags.Service,
+        operation: tags.Operation,
+        model:     model,
+    }
+    t, ok := u.totals[key]
+    if !ok {
+        t = &UsageTotals{}
+        u.totals[key] = t
+    }
+    t.Requests++
+    if failed {
+        t.Errors++
+    }
+    t.InputTokens += inputTokens
+    t.OutputTokens += outputTokens
+    u.mu.Unlock()
+
+    // Every generation path records its usage here, so this is also where
+    // reserved requests and key token limits are charged
+    chargeReservation(ctx, inputTokens+outputTokens)
+    keyLimits.Charge(principalFrom(ctx), inputTokens+outputTokens, time.Now())
+
+    outcome := "success"
+    if failed {
+        outcome = "error"
+    }
+    metrics.Inc("caller_requests_total", "caller_service", tags.Service, "caller_operation", tags.Operation, "outcome", outcome)
+    metrics.Add("caller_tokens_total", float64(inputTokens), "caller_service", tags.Service, "caller_operation", tags.Operation, "direction", "input")
+    metrics.Add("caller_tokens_total", float64(outputTokens), "caller_service", tags.Service, "caller_operation", tags.Operation, "direction", "output")
+}
+
+// Breakdown sums the owner's usage by groupBy, busiest first
+func (u *UsageLedger) Breakdown(owner, groupBy string) []UsageGroup {
+    keyOf := usageGroupings[groupBy]
+
+    u.mu.Lock()
+    groups := make(map[string]*UsageGroup)
+    for k, t := range u.totals {
+        if k.owner != owner {
+            continue
+        }
+        name := keyOf(k)
+        g, ok := groups[name]
+        if !ok {
+            g = &UsageGroup{Key: name}
+            groups[name] = g
+        }
+        g.Requests += t.Requests
+        g.Errors += t.Errors
+        g.InputTokens += t.InputTokens
+        g.OutputTokens += t.OutputTokens
+    }
+    u.mu.Unlock()
+
+    rows := make([]UsageGroup, 0, len(groups))
+    for _, g := range groups {
+        rows = append(rows, *g)
+    }
+    sort.Slice(rows, func(i, j int) bool {
+        if rows[i].Requests != rows[j].Requests {
+            return rows[i].Requests > rows[j].Requests
+        }
+        return rows[i].Key < rows[j].Key
+    })
+    return rows
+}
+
+// usageHandler serves GET /usage. It is per tenant: a caller only sees the
+// usage of its tenant, or of its own key without one, so it takes an API
+// key rather than the admin token.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+    groupBy := r.URL.Query().Get("group_by")
+    if groupBy == "" {
+        groupBy = "caller_service"
+    }
+    if _, ok := usageGroupings[groupBy]; !ok {
+        writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "group_by must be caller_service, caller_operation or model")
+        return
+    }
+    writeJSON(w, r, map[string]interface{}{
+        "group_by": groupBy,
+        "groups":   callerUsage.Breakdown(contextOwner(principalFrom(r.Context())), groupBy),
+    })
+}
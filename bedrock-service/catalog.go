@@ -0,0 +1,383 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "reflect"
+    "sort"
+    "strings"
+)
+
+// maxCatalogBytes bounds a candidate catalog document
+const maxCatalogBytes = 1 << 20
+
+// CatalogModel is one entry of a catalog document, and the canonical form a
+// registry entry is compared in
+type CatalogModel struct {
+    ID            string         `json:"id" yaml:"id"`
+    Name          string         `json:"name" yaml:"name"`
+    APIType       string         `json:"api_type" yaml:"api_type"` // See apiFormats and imageFormats; defaults to messages for Anthropic inference profiles
+    Modality      string         `json:"modality,omitempty" yaml:"modality"` // text or image; defaults to the api_type's
+    ContextWindow int            `json:"context_window" yaml:"context_window"` // Unused for image models
+    MaxOutput     int            `json:"max_output_tokens,omitempty" yaml:"max_output_tokens"` // Caps max_tokens for the model; 0 for none
+    Priority      int            `json:"priority,omitempty" yaml:"priority"` // Lower is tried first; ties keep document order
+    Vision        bool           `json:"vision,omitempty" yaml:"vision"` // Takes images in messages, see vision.go; messages models only
+    Documents     bool           `json:"documents,omitempty" yaml:"documents"` // Reads documents natively, see documents.go; messages models only
+    Defaults      *ModelDefaults `json:"defaults,omitempty" yaml:"defaults"`
+}
+
+// CatalogDocument lists the models in fallback order, most preferred first,
+// unless priorities reorder them. An alias names a group of its models, most
+// preferred first, that requests can ask for by the alias.
+type CatalogDocument struct {
+    Models  []CatalogModel      `json:"models" yaml:"models"`
+    Aliases map[string][]string `json:"aliases,omitempty" yaml:"aliases"`
+}
+
+// normalizeModelID is the form model IDs are compared in. Bedrock IDs are
+// lowercase, so "Anthropic.Claude-V2 " is the same model as "anthropic.claude-v2".
+func normalizeModelID(id string) string {
+    return strings.ToLower(strings.TrimSpace(id))
+}
+
+// catalogEntry is the canonical form of a registry entry
+func catalogEntry(model ModelInfo) CatalogModel {
+    return CatalogModel{
+        ID:            normalizeModelID(model.ID),
+        Name:          model.Name,
+        APIType:       apiType(model),
+        Modality:      string(model.modality()),
+        ContextWindow: model.ContextWindow,
+        MaxOutput:     model.MaxOutputTokens,
+        Vision:        model.Vision,
+        Documents:     model.Documents,
+        Defaults:      catalogDefaults(&model.Defaults),
+    }
+}
+
+// catalogDefaults is the canonical form of a model's defaults, nil for none
+func catalogDefaults(d *ModelDefaults) *ModelDefaults {
+    if d == nil || reflect.DeepEqual(*d, ModelDefaults{}) {
+        return nil
+    }
+    return d
+}
+
+// canonicalCatalog normalizes a validated document in place, putting it in
+// fallback order, and reports every problem with it, so one round trip fixes
+// them all. Problems name fields by their index in the document as given.
+func canonicalCatalog(doc *CatalogDocument) []FieldError {
+    var problems []FieldError
+    if len(doc.Models) == 0 {
+        return []FieldError{{Field: "models", Message: "must list at least one model"}}
+    }
+
+    ids := make(map[string]int)
+    names := make(map[string]int)
+    for i := range doc.Models {
+        m := &doc.Models[i]
+        field := fmt.Sprintf("models[%d]", i)
+        m.ID = normalizeModelID(m.ID)
+        m.Name = strings.TrimSpace(m.Name)
+
+        if m.ID == "" {
+            problems = append(problems, FieldError{Field: field + ".id", Message: "is required"})
+        } else if first, dup := ids[m.ID]; dup {
+            problems = append(problems, FieldError{Field: field + ".id", Message: fmt.Sprintf("duplicates models[%d] after normalization", first)})
+        } else {
+            ids[m.ID] = i
+        }
+
+        // Callers pick models by name as often as by ID, so names must be unique too
+        if m.Name == "" {
+            problems = append(problems, FieldError{Field: field + ".name", Message: "is required"})
+        } else if first, dup := names[strings.ToLower(m.Name)]; dup {
+            problems = append(problems, FieldError{Field: field + ".name", Message: fmt.Sprintf("duplicates models[%d]", first)})
+        } else {
+            names[strings.ToLower(m.Name)] = i
+        }
+        if m.Priority < 0 {
+            problems = append(problems, FieldError{Field: field + ".priority", Message: "must not be negative"})
+        }
+
+        // Image models have little in common with text ones, see images.go
+        m.Modality = strings.ToLower(strings.TrimSpace(m.Modality))
+        if _, image := imageFormats[APIType(m.APIType)]; m.Modality == "" && image {
+            m.Modality = string(modalityImage)
+        } else if m.Modality == "" {
+            m.Modality = string(modalityText)
+        }
+        if m.Modality == string(modalityImage) {
+            problems = append(problems, imageCatalogProblems(m, field)...)
+            continue
+        }
+        if m.Modality != string(modalityText) {
+            problems = append(problems, FieldError{Field: field + ".modality", Message: "must be text or image"})
+        }
+
+        // Anthropic inference profiles only serve the messages API
+        anthropicProfile := isInferenceProfile(m.ID) && strings.HasPrefix(foundationModelID(m.ID), "anthropic.")
+        if m.APIType == "" && anthropicProfile {
+            m.APIType = string(apiMessages)
+        }
+        if _, ok := apiFormats[APIType(m.APIType)]; !ok {
+            problems = append(problems, FieldError{Field: field + ".api_type", Message: "must be one of " + strings.Join(apiTypeNames(), ", ")})
+        } else if anthropicProfile && m.APIType != string(apiMessages) {
+            problems = append(problems, FieldError{Field: field + ".api_type", Message: "must be messages for an Anthropic inference profile"})
+        }
+        if m.Vision && m.APIType != string(apiMessages) {
+            problems = append(problems, FieldError{Field: field + ".vision", Message: "requires api_type messages"})
+        }
+        if m.Documents && m.APIType != string(apiMessages) {
+            problems = append(problems, FieldError{Field: field + ".documents", Message: "requires api_type messages"})
+        }
+        if m.ContextWindow < 1 {
+            problems = append(problems, FieldError{Field: field + ".context_window", Message: "must be a positive number of tokens"})
+        }
+        if m.MaxOutput < 0 {
+            problems = append(problems, FieldError{Field: field + ".max_output_tokens", Message: "must not be negative"})
+        } else if m.MaxOutput > 0 && m.Defaults != nil && m.Defaults.MaxTokens > m.MaxOutput {
+            problems = append(problems, FieldError{Field: field + ".defaults.max_tokens", Message: fmt.Sprintf("exceeds max_output_tokens (%d)", m.MaxOutput)})
+        }
+        if m.Defaults != nil {
+            problems = append(problems, m.Defaults.problems(field+".defaults")...)
+        }
+    }
+    problems = append(problems, canonicalAliases(doc, ids)...)
+    if len(problems) == 0 {
+        sort.SliceStable(doc.Models, func(a, b int) bool { return doc.Models[a].Priority < doc.Models[b].Priority })
+    }
+    return problems
+}
+
+// canonicalAliases normalizes a document's aliases, which may only name its
+// own models, given the index of each model ID
+func canonicalAliases(doc *CatalogDocument, ids map[string]int) []FieldError {
+    var problems []FieldError
+    given := make([]string, 0, len(doc.Aliases))
+    for name := range doc.Aliases {
+        given = append(given, name)
+    }
+    sort.Strings(given)
+
+    aliases := make(map[string][]string, len(doc.Aliases))
+    for _, name := range given {
+        field := "aliases." + name
+        alias := normalizeAlias(name)
+        if _, clash := ids[alias]; clash {
+            problems = append(problems, FieldError{Field: field, Message: "is also a model ID"})
+        } else if _, dup := aliases[alias]; dup || alias == "" {
+            problems = append(problems, FieldError{Field: field, Message: "must be a distinct, non-empty name"})
+        }
+
+        group := doc.Aliases[name]
+        if len(group) == 0 {
+            problems = append(problems, FieldError{Field: field, Message: "must list at least one model"})
+        }
+        seen := make(map[string]bool)
+        for j := range group {
+            group[j] = normalizeModelID(group[j])
+            if _, ok := ids[group[j]]; !ok {
+                problems = append(problems, FieldError{Field: fmt.Sprintf("%s[%d]", field, j), Message: "is not a model in the document"})
+            } else if seen[group[j]] {
+                problems = append(problems, FieldError{Field: fmt.Sprintf("%s[%d]", field, j), Message: "is already in the group"})
+            }
+            seen[group[j]] = true
+        }
+        aliases[alias] = group
+    }
+    doc.Aliases = aliases
+    return problems
+}
+
+// normalizeAlias is the form aliases are compared in
+func normalizeAlias(name string) string {
+    return strings.ToLower(strings.TrimSpace(name))
+}
+
+// CatalogRename is a model whose display name changes
+type CatalogRename struct {
+    ID   string `json:"id"`
+    From string `json:"from"`
+    To   string `json:"to"`
+}
+
+// CatalogReplacement is a name that moves to a different model ID, e.g. a new
+// model version. Requests for the name follow it; requests for the old ID don't.
+type CatalogReplacement struct {
+    Name   string `json:"name"`
+    FromID string `json:"from_id"`
+    ToID   string `json:"to_id"`
+}
+
+// CatalogChange is a before/after value of one kept model
+type CatalogChange struct {
+    ID    string      `json:"id"`
+    Field string      `json:"field,omitempty"` // Which one, for metadata changes
+    From  interface{} `json:"from"`
+    To    interface{} `json:"to"`
+}
+
+// CatalogDiff is the effect of replacing the live registry with a candidate.
+// Replaced models are also listed in Added and Removed. Priorities are
+// 1-based ranks among the models present in both, so adding or removing a
+// model doesn't show up as a priority change of every other one.
+type CatalogDiff struct {
+    Added           []CatalogModel       `json:"added"`
+    Removed         []CatalogModel       `json:"removed"`
+    Replaced        []CatalogReplacement `json:"replaced"`
+    Renamed         []CatalogRename      `json:"renamed"`
+    PriorityChanges []CatalogChange      `json:"priority_changes"`
+    APITypeChanges  []CatalogChange      `json:"api_type_changes"`
+    LimitChanges    []CatalogChange      `json:"context_window_changes"`
+    MetadataChanges []CatalogChange      `json:"metadata_changes"` // The output cap, modality, capabilities and sampling defaults
+    LosesAvailable  []string             `json:"available_removed"` // IDs currently serving traffic that would disappear
+    Unchanged       bool                 `json:"unchanged"`
+}
+
+// diffCatalog compares the live registry with a canonical candidate
+func diffCatalog(live []ModelInfo, candidate []CatalogModel) CatalogDiff {
+    diff := CatalogDiff{
+        Added:           []CatalogModel{},
+        Removed:         []CatalogModel{},
+        Replaced:        []CatalogReplacement{},
+        Renamed:         []CatalogRename{},
+        PriorityChanges: []CatalogChange{},
+        APITypeChanges:  []CatalogChange{},
+        LimitChanges:    []CatalogChange{},
+        MetadataChanges: []CatalogChange{},
+        LosesAvailable:  []string{},
+    }
+
+    current := make(map[string]CatalogModel, len(live))
+    available := make(map[string]bool, len(live))
+    for _, model := range live {
+        entry := catalogEntry(model)
+        current[entry.ID] = entry
+        available[entry.ID] = model.Available
+    }
+    next := make(map[string]CatalogModel, len(candidate))
+    for _, model := range candidate {
+        next[model.ID] = model
+    }
+
+    // Ranks among the kept models, in each list's order
+    liveRank := make(map[string]int)
+    for _, model := range live {
+        id := normalizeModelID(model.ID)
+        if _, kept := next[id]; kept {
+            liveRank[id] = len(liveRank) + 1
+        }
+    }
+    nextRank := make(map[string]int)
+    for _, model := range candidate {
+        if _, kept := current[model.ID]; kept {
+            nextRank[model.ID] = len(nextRank) + 1
+        }
+    }
+
+    removedByName := make(map[string]CatalogModel)
+    for _, model := range live {
+        entry := catalogEntry(model)
+        if _, kept := next[entry.ID]; kept {
+            continue
+        }
+        diff.Removed = append(diff.Removed, entry)
+        removedByName[strings.ToLower(entry.Name)] = entry
+        if available[entry.ID] {
+            diff.LosesAvailable = append(diff.LosesAvailable, entry.ID)
+        }
+    }
+
+    for _, model := range candidate {
+        was, kept := current[model.ID]
+        if !kept {
+            diff.Added = append(diff.Added, model)
+            if old, ok := removedByName[strings.ToLower(model.Name)]; ok {
+                diff.Replaced = append(diff.Replaced, CatalogReplacement{Name: model.Name, FromID: old.ID, ToID: model.ID})
+            }
+            continue
+        }
+        if was.Name != model.Name {
+            diff.Renamed = append(diff.Renamed, CatalogRename{ID: model.ID, From: was.Name, To: model.Name})
+        }
+        if liveRank[model.ID] != nextRank[model.ID] {
+            diff.PriorityChanges = append(diff.PriorityChanges, CatalogChange{ID: model.ID, From: liveRank[model.ID], To: nextRank[model.ID]})
+        }
+        if was.APIType != model.APIType {
+            diff.APITypeChanges = append(diff.APITypeChanges, CatalogChange{ID: model.ID, From: was.APIType, To: model.APIType})
+        }
+        if was.ContextWindow != model.ContextWindow {
+            diff.LimitChanges = append(diff.LimitChanges, CatalogChange{ID: model.ID, From: was.ContextWindow, To: model.ContextWindow})
+        }
+        diff.MetadataChanges = append(diff.MetadataChanges, metadataChanges(was, model)...)
+    }
+
+    diff.Unchanged = len(diff.Added)+len(diff.Removed)+len(diff.Renamed)+len(diff.PriorityChanges)+
+        len(diff.APITypeChanges)+len(diff.LimitChanges)+len(diff.MetadataChanges) == 0
+    return diff
+}
+
+// metadataChanges lists what changes of a kept model besides its routing
+func metadataChanges(was, model CatalogModel) []CatalogChange {
+    var changes []CatalogChange
+    for _, f := range []struct {
+        field    string
+        from, to interface{}
+    }{
+        {"max_output_tokens", was.MaxOutput, model.MaxOutput},
+        {"modality", was.Modality, model.Modality},
+        {"vision", was.Vision, model.Vision},
+        {"documents", was.Documents, model.Documents},
+        {"defaults", catalogDefaults(was.Defaults), catalogDefaults(model.Defaults)},
+    } {
+        if !reflect.DeepEqual(f.from, f.to) {
+            changes = append(changes, CatalogChange{ID: model.ID, Field: f.field, From: f.from, To: f.to})
+        }
+    }
+    return changes
+}
+
+// logCatalogDiff records a catalog change, or a dry run of one, in one line
+func logCatalogDiff(action string, diff CatalogDiff) {
+    if diff.Unchanged {
+        log.Printf("Catalog %s: no changes", action)
+        return
+    }
+    log.Printf("Catalog %s: %d added, %d removed (%d available), %d replaced, %d renamed, %d priority, %d api type, %d context window, %d metadata changes",
+        action, len(diff.Added), len(diff.Removed), len(diff.LosesAvailable), len(diff.Replaced), len(diff.Renamed),
+        len(diff.PriorityChanges), len(diff.APITypeChanges), len(diff.LimitChanges), len(diff.MetadataChanges))
+}
+
+// catalogValidateHandler validates a candidate catalog and diffs it against
+// the live registry. Nothing is applied.
+func catalogValidateHandler(bc *BedrockClient) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var doc CatalogDocument
+        decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCatalogBytes))
+        decoder.DisallowUnknownFields() // A misspelled field would otherwise validate as missing
+        if err := decoder.Decode(&doc); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, fmt.Sprintf("Invalid catalog document: %v", err))
+            return
+        }
+        if problems := canonicalCatalog(&doc); len(problems) > 0 {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: "Invalid catalog document",
+                Fields:  problems,
+            })
+            return
+        }
+
+        diff := diffCatalog(bc.models(), doc.Models)
+        logCatalogDiff("dry run", diff)
+        writeJSON(w, r, map[string]interface{}{
+            "valid":   true,
+            "applied": false,
+            "models":  len(doc.Models),
+            "diff":    diff,
+        })
+    }
+}
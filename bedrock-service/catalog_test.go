@@ -0,0 +1,137 @@
+package main
+
+import (
+    "fmt"
+    "reflect"
+    "testing"
+)
+
+// diffSummary flattens a diff into one line per change, in a fixed order
+func diffSummary(d CatalogDiff) []string {
+    var lines []string
+    for _, m := range d.Added {
+        lines = append(lines, "added "+m.ID)
+    }
+    for _, m := range d.Removed {
+        lines = append(lines, "removed "+m.ID)
+    }
+    for _, r := range d.Replaced {
+        lines = append(lines, fmt.Sprintf("replaced %s: %s -> %s", r.Name, r.FromID, r.ToID))
+    }
+    for _, r := range d.Renamed {
+        lines = append(lines, fmt.Sprintf("renamed %s: %s -> %s", r.ID, r.From, r.To))
+    }
+    for kind, changes := range map[string][]CatalogChange{"priority": d.PriorityChanges, "api_type": d.APITypeChanges, "context_window": d.LimitChanges} {
+        for _, c := range changes {
+            lines = append(lines, fmt.Sprintf("%s %s: %v -> %v", kind, c.ID, c.From, c.To))
+        }
+    }
+    for _, c := range d.MetadataChanges {
+        lines = append(lines, fmt.Sprintf("%s %s: %v -> %v", c.Field, c.ID, c.From, c.To))
+    }
+    for _, id := range d.LosesAvailable {
+        lines = append(lines, "loses available "+id)
+    }
+    return lines
+}
+
+func TestDiffCatalog(t *testing.T) {
+    haiku := ModelInfo{ID: "anthropic.claude-3-haiku-20240307-v1:0", Name: "Claude 3 Haiku", API: apiMessages, ContextWindow: 200000, Available: true}
+    sonnet := ModelInfo{ID: "anthropic.claude-3-sonnet-20240229-v1:0", Name: "Claude 3 Sonnet", API: apiMessages, ContextWindow: 200000, Available: true}
+    titan := ModelInfo{ID: "amazon.titan-text-express-v1", Name: "Titan Text Express", API: apiTitan, ContextWindow: 8000}
+    entry := func(m ModelInfo, edit func(*CatalogModel)) CatalogModel {
+        c := catalogEntry(m)
+        if edit != nil {
+            edit(&c)
+        }
+        return c
+    }
+    temperature := 0.2
+
+    for _, c := range []struct {
+        name      string
+        live      []ModelInfo
+        candidate []CatalogModel
+        want      []string
+    }{
+        {"unchanged", []ModelInfo{haiku, sonnet}, []CatalogModel{entry(haiku, nil), entry(sonnet, nil)}, nil},
+        {"empty previous snapshot", nil, []CatalogModel{entry(haiku, nil), entry(titan, nil)},
+            []string{"added " + haiku.ID, "added " + titan.ID}},
+        {"added", []ModelInfo{haiku}, []CatalogModel{entry(haiku, nil), entry(titan, nil)}, []string{"added " + titan.ID}},
+        // Only a model serving traffic is reported as lost
+        {"removed", []ModelInfo{haiku, titan, sonnet}, []CatalogModel{entry(haiku, nil)},
+            []string{"removed " + titan.ID, "removed " + sonnet.ID, "loses available " + sonnet.ID}},
+        {"added ahead keeps the others' ranks", []ModelInfo{haiku, sonnet}, []CatalogModel{entry(titan, nil), entry(haiku, nil), entry(sonnet, nil)},
+            []string{"added " + titan.ID}},
+        {"reordered", []ModelInfo{haiku, sonnet}, []CatalogModel{entry(sonnet, nil), entry(haiku, nil)},
+            []string{"priority " + sonnet.ID + ": 2 -> 1", "priority " + haiku.ID + ": 1 -> 2"}},
+        {"renamed", []ModelInfo{haiku}, []CatalogModel{entry(haiku, func(m *CatalogModel) { m.Name = "Haiku" })},
+            []string{"renamed " + haiku.ID + ": Claude 3 Haiku -> Haiku"}},
+        {"name moves to a new version", []ModelInfo{haiku}, []CatalogModel{entry(haiku, func(m *CatalogModel) { m.ID = "anthropic.claude-3-5-haiku-20241022-v1:0" })},
+            []string{"added anthropic.claude-3-5-haiku-20241022-v1:0", "removed " + haiku.ID,
+                "replaced Claude 3 Haiku: " + haiku.ID + " -> anthropic.claude-3-5-haiku-20241022-v1:0", "loses available " + haiku.ID}},
+        {"api type and context window", []ModelInfo{titan}, []CatalogModel{entry(titan, func(m *CatalogModel) { m.APIType, m.ContextWindow = "legacy", 32000 })},
+            []string{"api_type " + titan.ID + ": titan -> legacy", "context_window " + titan.ID + ": 8000 -> 32000"}},
+        {"metadata only", []ModelInfo{haiku}, []CatalogModel{entry(haiku, func(m *CatalogModel) { m.MaxOutput, m.Vision = 4096, true })},
+            []string{"max_output_tokens " + haiku.ID + ": 0 -> 4096", "vision " + haiku.ID + ": false -> true"}},
+        {"defaults only", []ModelInfo{haiku}, []CatalogModel{entry(haiku, func(m *CatalogModel) { m.Defaults = &ModelDefaults{Temperature: &temperature} })},
+            []string{fmt.Sprintf("defaults %s: <nil> -> %v", haiku.ID, &ModelDefaults{Temperature: &temperature})}},
+        // Empty defaults are the same as none
+        {"empty defaults", []ModelInfo{haiku}, []CatalogModel{entry(haiku, func(m *CatalogModel) { m.Defaults = &ModelDefaults{} })}, nil},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            diff := diffCatalog(c.live, c.candidate)
+            got := diffSummary(diff)
+            if !sameLines(got, c.want) {
+                t.Errorf("diff:\n%q\nwant:\n%q", got, c.want)
+            }
+            if diff.Unchanged != (len(c.want) == 0) {
+                t.Errorf("unchanged %v for %d changes", diff.Unchanged, len(c.want))
+            }
+        })
+    }
+}
+
+// sameLines compares two lists as sets of lines
+func sameLines(a, b []string) bool {
+    count := make(map[string]int)
+    for _, line := range a {
+        count[line]++
+    }
+    for _, line := range b {
+        count[line]--
+    }
+    for _, n := range count {
+        if n != 0 {
+            return false
+        }
+    }
+    return len(a) == len(b)
+}
+
+// A candidate document is diffed after normalization, so the same models in
+// another spelling and a priority that keeps their order change nothing
+func TestDiffCatalogNormalized(t *testing.T) {
+    live := []ModelInfo{
+        {ID: "anthropic.claude-3-haiku-20240307-v1:0", Name: "Claude 3 Haiku", API: apiMessages, ContextWindow: 200000, Available: true},
+        {ID: "amazon.titan-text-express-v1", Name: "Titan Text Express", API: apiTitan, ContextWindow: 8000},
+    }
+    doc := CatalogDocument{Models: []CatalogModel{
+        {ID: "amazon.titan-text-express-v1", Name: "Titan Text Express", APIType: "titan", ContextWindow: 8000, Priority: 2},
+        {ID: " Anthropic.Claude-3-Haiku-20240307-v1:0 ", Name: " Claude 3 Haiku", APIType: "messages", ContextWindow: 200000, Priority: 1},
+    }}
+    if problems := canonicalCatalog(&doc); len(problems) != 0 {
+        t.Fatalf("problems %+v", problems)
+    }
+    if diff := diffCatalog(live, doc.Models); !diff.Unchanged {
+        t.Errorf("diff %q, want none", diffSummary(diff))
+    }
+
+    // The JSON keeps empty lists, so clients needn't check for null
+    empty := diffCatalog(nil, nil)
+    for name, list := range map[string]interface{}{"added": empty.Added, "removed": empty.Removed, "metadata_changes": empty.MetadataChanges, "available_removed": empty.LosesAvailable} {
+        if v := reflect.ValueOf(list); v.IsNil() {
+            t.Errorf("%s is nil", name)
+        }
+    }
+}
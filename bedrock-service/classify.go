@@ -0,0 +1,280 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+    "sync"
+)
+
+// Classification settings
+const (
+    classifyMaxAttempts = 3 // Initial call plus retries on invalid output
+    classifyConcurrency = 4
+    classifyToolName    = "record_classification"
+)
+
+// ClassifyLabel is a candidate label; in requests it may be given either as a
+// plain string or as {"name": ..., "description": ...}
+type ClassifyLabel struct {
+    Name        string `json:"name"`
+    Description string `json:"description,omitempty"`
+}
+
+func (l *ClassifyLabel) UnmarshalJSON(data []byte) error {
+    var name string
+    if err := json.Unmarshal(data, &name); err == nil {
+        l.Name = name
+        return nil
+    }
+
+    type plain ClassifyLabel
+    var p plain
+    if err := json.Unmarshal(data, &p); err != nil {
+        return fmt.Errorf("label must be a string or an object with a name")
+    }
+    *l = ClassifyLabel(p)
+    return nil
+}
+
+// ClassifyRequest is the body accepted by POST /classify.
+// Text may be a single string or an array of strings.
+type ClassifyRequest struct {
+    Text             json.RawMessage `json:"text"`
+    Labels           []ClassifyLabel `json:"labels"`
+    MultiLabel       bool            `json:"multi_label,omitempty"`
+    IncludeRationale bool            `json:"include_rationale,omitempty"`
+    Model            string          `json:"model,omitempty"`
+    Temperature      *float64        `json:"temperature,omitempty"` // Defaults to 0 for deterministic output
+}
+
+type ClassificationItem struct {
+    Index     int      `json:"index"`
+    Labels    []string `json:"labels"`
+    Rationale string   `json:"rationale,omitempty"`
+    ModelUsed string   `json:"model_used,omitempty"`
+    Attempts  int      `json:"attempts"`
+    Error     string   `json:"error,omitempty"`
+}
+
+type ClassifyResponse struct {
+    MultiLabel      bool                 `json:"multi_label"`
+    Classifications []ClassificationItem `json:"classifications"`
+}
+
+// validate checks the label set and returns a lookup from lowercased label to canonical name
+func (req *ClassifyRequest) validate() (map[string]string, error) {
+    if len(req.Labels) < 2 {
+        return nil, fmt.Errorf("at least two labels are required")
+    }
+
+    canonical := make(map[string]string, len(req.Labels))
+    for _, label := range req.Labels {
+        name := strings.TrimSpace(label.Name)
+        if name == "" {
+            return nil, fmt.Errorf("labels must not be empty")
+        }
+        key := strings.ToLower(name)
+        if _, dup := canonical[key]; dup {
+            return nil, fmt.Errorf("duplicate label: %s", name)
+        }
+        canonical[key] = name
+    }
+    return canonical, nil
+}
+
+// classificationTool builds the tool whose schema restricts the model to the label set
+func classificationTool(req *ClassifyRequest) ToolSpec {
+    names := make([]string, len(req.Labels))
+    for i, label := range req.Labels {
+        names[i] = strings.TrimSpace(label.Name)
+    }
+
+    labelsSchema := map[string]interface{}{
+        "type":     "array",
+        "items":    map[string]interface{}{"type": "string", "enum": names},
+        "minItems": 1,
+    }
+    if !req.MultiLabel {
+        labelsSchema["maxItems"] = 1
+    }
+
+    properties := map[string]interface{}{"labels": labelsSchema}
+    if req.IncludeRationale {
+        properties["rationale"] = map[string]interface{}{
+            "type":        "string",
+            "description": "One or two sentences explaining the choice",
+        }
+    }
+
+    return ToolSpec{
+        Name:        classifyToolName,
+        Description: "Record the label(s) that apply to the text",
+        InputSchema: map[string]interface{}{
+            "type":       "object",
+            "properties": properties,
+            "required":   []string{"labels"},
+        },
+    }
+}
+
+// buildClassificationPrompt renders the constrained instruction prompt for a single text
+func buildClassificationPrompt(req *ClassifyRequest, text string) string {
+    var sb strings.Builder
+    if req.MultiLabel {
+        sb.WriteString("Classify the text below. Choose every label that applies, using only labels from this list:\n")
+    } else {
+        sb.WriteString("Classify the text below. Choose exactly one label from this list:\n")
+    }
+    for _, label := range req.Labels {
+        if label.Description != "" {
+            sb.WriteString(fmt.Sprintf("- %s: %s\n", label.Name, label.Description))
+        } else {
+            sb.WriteString(fmt.Sprintf("- %s\n", label.Name))
+        }
+    }
+    sb.WriteString(fmt.Sprintf("\nRespond by calling the %s tool. Do not invent new labels.\n\nText:\n", classifyToolName))
+    sb.WriteString(text)
+    return sb.String()
+}
+
+// parseClassification validates the tool output against the label set
+func parseClassification(input json.RawMessage, canonical map[string]string, multiLabel bool) ([]string, string, error) {
+    var output struct {
+        Labels    []string `json:"labels"`
+        Rationale string   `json:"rationale"`
+    }
+    if err := json.Unmarshal(input, &output); err != nil {
+        return nil, "", fmt.Errorf("invalid tool input: %v", err)
+    }
+    if len(output.Labels) == 0 {
+        return nil, "", fmt.Errorf("no label returned")
+    }
+    if !multiLabel && len(output.Labels) > 1 {
+        return nil, "", fmt.Errorf("expected one label, got %d", len(output.Labels))
+    }
+
+    seen := make(map[string]bool)
+    var labels []string
+    for _, raw := range output.Labels {
+        name, ok := canonical[strings.ToLower(strings.TrimSpace(raw))]
+        if !ok {
+            return nil, "", fmt.Errorf("label %q is not in the label set", raw)
+        }
+        if !seen[name] {
+            seen[name] = true
+            labels = append(labels, name)
+        }
+    }
+    return labels, output.Rationale, nil
+}
+
+// classifyOne classifies a single text, retrying when the model returns labels outside the set
+func (bc *BedrockClient) classifyOne(ctx context.Context, req *ClassifyRequest, canonical map[string]string, temperature float64, index int, text string) ClassificationItem {
+    item := ClassificationItem{Index: index}
+
+    call := ToolCall{
+        System:         "You are a precise text classifier. You only ever answer with labels from the provided set.",
+        Prompt:         buildClassificationPrompt(req, text),
+        PreferredModel: req.Model,
+        Temperature:    temperature,
+        Tool:           classificationTool(req),
+        Origin:         originUser,
+    }
+
+    var lastErr error
+    for attempt := 1; attempt <= classifyMaxAttempts; attempt++ {
+        item.Attempts = attempt
+
+        input, modelUsed, err := bc.InvokeTool(ctx, call)
+        if err != nil {
+            // Invocation failures already went through the model fallback chain
+            logWarnf(ctx, "Classification of item %d failed: %v", index, err)
+            metrics.Inc("classify_errors_total", "reason", "invocation")
+            item.Error = "classification failed"
+            return item
+        }
+
+        labels, rationale, err := parseClassification(input, canonical, req.MultiLabel)
+        if err != nil {
+            lastErr = err
+            logWarnf(ctx, "Invalid classification for item %d (attempt %d): %v", index, attempt, err)
+            metrics.Inc("classify_invalid_output_total", "model", modelUsed)
+            continue
+        }
+
+        for _, label := range labels {
+            metrics.Inc("classify_labels_total", "label", label)
+        }
+        item.Labels = labels
+        item.ModelUsed = modelUsed
+        if req.IncludeRationale {
+            item.Rationale = rationale
+        }
+        return item
+    }
+
+    metrics.Inc("classify_errors_total", "reason", "invalid_output")
+    item.Error = fmt.Sprintf("model did not return a valid label after %d attempts: %v", classifyMaxAttempts, lastErr)
+    return item
+}
+
+// Classify classifies every text concurrently, preserving input order in the result
+func (bc *BedrockClient) Classify(ctx context.Context, req *ClassifyRequest, canonical map[string]string, texts []string) []ClassificationItem {
+    temperature := 0.0
+    if req.Temperature != nil {
+        temperature = *req.Temperature
+    }
+
+    results := make([]ClassificationItem, len(texts))
+    sem := make(chan struct{}, classifyConcurrency)
+    var wg sync.WaitGroup
+
+    for i, text := range texts {
+        wg.Add(1)
+        go func(i int, text string) {
+            defer wg.Done()
+            sem <- struct{}{}
+            defer func() { <-sem }()
+            results[i] = bc.classifyOne(ctx, req, canonical, temperature, i, text)
+        }(i, text)
+    }
+
+    wg.Wait()
+    return results
+}
+
+func classifyHandler(bc *BedrockClient) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req ClassifyRequest
+
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+
+        canonical, err := req.validate()
+        if err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, err.Error())
+            return
+        }
+
+        texts, err := decodeTextList(req.Text)
+        if err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, err.Error())
+            return
+        }
+
+        logInfof(r.Context(), "Received classification request: %d item(s), %d labels (multi_label: %v)",
+            len(texts), len(req.Labels), req.MultiLabel)
+        metrics.Add("classify_items_total", float64(len(texts)))
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(ClassifyResponse{
+            MultiLabel:      req.MultiLabel,
+            Classifications: bc.Classify(r.Context(), &req, canonical, texts),
+        })
+    }
+}
@@ -0,0 +1,187 @@
+// Package client is a Go client for the bedrock-service HTTP API.
+//
+// Errors returned by the service are decoded into typed errors (see
+// errors.go) so callers can tell throttling from validation from budget
+// problems with errors.Is and errors.As.
+package client
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Client talks to a single bedrock-service deployment
+type Client struct {
+    BaseURL    string
+    APIKey     string
+    HTTPClient *http.Client
+
+    // SigningSecret signs every request with HMAC-SHA256 and a fresh nonce,
+    // for keys the service requires signatures from. The signed path is the
+    // one in the request URL, so base URLs behind path-rewriting proxies
+    // won't verify.
+    SigningSecret string
+}
+
+// New returns a client for the service at baseURL
+func New(baseURL, apiKey string) *Client {
+    return &Client{
+        BaseURL:    strings.TrimRight(baseURL, "/"),
+        APIKey:     apiKey,
+        HTTPClient: &http.Client{Timeout: 120 * time.Second},
+    }
+}
+
+// Message is one turn of a multi-turn request
+type Message struct {
+    Role    string `json:"role"` // "user" or "assistant"
+    Content string `json:"content"`
+}
+
+// GenerateRequest is the body of POST /generate. Set either Prompt or
+// Messages, which must start and end with a user turn.
+type GenerateRequest struct {
+    Prompt           string    `json:"prompt,omitempty"`
+    Messages         []Message `json:"messages,omitempty"`
+    MaxTokens        int       `json:"max_tokens,omitempty"`
+    Temperature      *float64  `json:"temperature,omitempty"`       // Nil for the default; 0 is greedy decoding
+    TopP             *float64  `json:"top_p,omitempty"`             // In (0, 1]; sent alongside temperature
+    TopK             *int      `json:"top_k,omitempty"`
+    Model            string    `json:"model,omitempty"`
+    StrictModel      bool      `json:"strict_model,omitempty"`      // Only try what Model matches; fail with ModelUnavailableError rather than fall back
+    Models           []string  `json:"models,omitempty"`            // The exact models to try, in order, instead of Model and the fallback chain
+    LinkFilter       string    `json:"link_filter,omitempty"`
+    NoTimeContext    bool      `json:"no_time_context,omitempty"`
+    System           *string   `json:"system,omitempty"`            // Replaces the default system prompt; "" sends none
+    StopSequences    []string  `json:"stop_sequences,omitempty"`    // At most 4; generation halts where one would be produced
+    TimeoutSeconds   float64   `json:"timeout_seconds,omitempty"`   // Give up after this long; the server caps it
+    NoAdaptation     bool      `json:"no_adaptation,omitempty"`     // Don't rewrite the prompt for fallbacks from other providers
+    GuardrailID      string    `json:"guardrail_id,omitempty"`      // Bedrock guardrail to apply instead of the server default
+    GuardrailVersion string    `json:"guardrail_version,omitempty"` // Its version number or "DRAFT"; required with GuardrailID unless it is the default
+    GuardrailTrace   bool      `json:"guardrail_trace,omitempty"`   // Return the guardrail's assessment in Debug
+    SchemaVersion    string    `json:"schema_version,omitempty"`    // Pin the request semantics; unset means the oldest
+}
+
+// GenerateResponse is the body returned by POST /generate
+type GenerateResponse struct {
+    Response        string `json:"response"`
+    ModelUsed       string `json:"model_used"`
+    ModelAlias      string `json:"model_alias,omitempty"` // Set when the request's Model was an alias such as "fast"
+    TokenCount      int    `json:"token_count,omitempty"`
+    InputTokens     int    `json:"input_tokens"`
+    OutputTokens    int    `json:"output_tokens"`
+    TokensEstimated bool   `json:"tokens_estimated,omitempty"` // The model reported no usage; the counts are estimates
+    LatencyMs       int64  `json:"latency_ms"`
+    FinishReason    string `json:"finish_reason,omitempty"`
+    FinishReasonRaw string `json:"finish_reason_raw,omitempty"`
+    StopReason      string `json:"stop_reason,omitempty"`
+    StopSequence    string `json:"stop_sequence,omitempty"` // Which of the request's stop_sequences ended generation
+    Refused         bool   `json:"refused,omitempty"`
+    RefusalCategory string `json:"refusal_category,omitempty"`
+    RequestID       string `json:"-"`
+
+    GuardrailIntervened bool   `json:"guardrail_intervened,omitempty"` // The guardrail blocked or masked the output; Response is what it returned
+    Debug               *Debug `json:"debug,omitempty"`                // Set when the request asked for diagnostics
+}
+
+// Debug carries diagnostics a request asked for
+type Debug struct {
+    GuardrailTrace json.RawMessage `json:"guardrail_trace,omitempty"` // With GuardrailTrace, the guardrail's assessment as Bedrock reported it
+}
+
+// Generate sends a prompt to the service
+func (c *Client) Generate(ctx context.Context, req GenerateRequest) (*GenerateResponse, error) {
+    var resp GenerateResponse
+    requestID, err := c.do(ctx, http.MethodPost, "/generate", req, &resp)
+    if err != nil {
+        return nil, err
+    }
+    resp.RequestID = requestID
+    return &resp, nil
+}
+
+// do sends a JSON request and decodes a JSON response, returning the request ID
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) (string, error) {
+    var body io.Reader
+    var payload []byte
+    if in != nil {
+        data, err := json.Marshal(in)
+        if err != nil {
+            return "", fmt.Errorf("error encoding request: %v", err)
+        }
+        body, payload = bytes.NewReader(data), data
+    }
+
+    req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+    if err != nil {
+        return "", err
+    }
+    if in != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    req.Header.Set("Accept", "application/json")
+    if c.APIKey != "" {
+        req.Header.Set("X-API-Key", c.APIKey)
+    }
+    if c.SigningSecret != "" {
+        if err := c.sign(req, payload); err != nil {
+            return "", err
+        }
+    }
+
+    httpClient := c.HTTPClient
+    if httpClient == nil {
+        httpClient = http.DefaultClient
+    }
+    resp, err := httpClient.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+
+    data, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return "", fmt.Errorf("error reading response: %v", err)
+    }
+    requestID := resp.Header.Get("X-Request-ID")
+
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return requestID, parseError(resp, data)
+    }
+    if out != nil {
+        if err := json.Unmarshal(data, out); err != nil {
+            return requestID, fmt.Errorf("error decoding response: %v", err)
+        }
+    }
+    return requestID, nil
+}
+
+// sign sets the headers the service checks for keys with a signing secret
+func (c *Client) sign(req *http.Request, body []byte) error {
+    raw := make([]byte, 16)
+    if _, err := rand.Read(raw); err != nil {
+        return fmt.Errorf("error generating nonce: %v", err)
+    }
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    nonce := hex.EncodeToString(raw)
+    sum := sha256.Sum256(body)
+    payload := req.Method + "\n" + req.URL.RequestURI() + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(sum[:])
+
+    mac := hmac.New(sha256.New, []byte(c.SigningSecret))
+    mac.Write([]byte(payload))
+    req.Header.Set("X-Timestamp", timestamp)
+    req.Header.Set("X-Nonce", nonce)
+    req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+    return nil
+}
@@ -0,0 +1,248 @@
+package client
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// Error codes sent by the service. They match the server's ErrCode constants
+// and are a stable contract.
+const (
+    CodeValidation       = "validation_error"
+    CodeUnauthorized     = "unauthorized"
+    CodeForbidden        = "forbidden"
+    CodeNotFound         = "not_found"
+    CodeMethodNotAllowed = "method_not_allowed"
+    CodeRateLimited      = "rate_limited"
+    CodeBudgetExceeded   = "budget_exceeded"
+    CodeModelUnavailable = "model_unavailable"
+    CodeThrottled        = "throttled"
+    CodeContextTooLong   = "context_too_long"
+    CodeContentBlocked   = "content_blocked"
+    CodeUnprocessable    = "unprocessable"
+    CodeInternal         = "internal"
+    CodeRequestBuild     = "internal_request_construction"
+    CodeDeliveryFailed   = "delivery_failed"
+    CodeInvalidJSON      = "invalid_json"
+    CodeInvalidSignature = "invalid_signature"
+    CodeReplayedRequest  = "replayed_request"
+    CodeCancelled        = "cancelled"
+    CodeDeadlineExceeded = "deadline_exceeded"
+
+    CodeReservationConflict = "reservation_conflict"
+)
+
+// Sentinels for errors.Is. Every typed error below matches its sentinel, so
+// callers can branch without caring about the concrete type.
+var (
+    ErrValidation       = errors.New("validation error")
+    ErrUnauthorized     = errors.New("unauthorized")
+    ErrForbidden        = errors.New("forbidden")
+    ErrNotFound         = errors.New("not found")
+    ErrRateLimited      = errors.New("rate limited")
+    ErrBudgetExceeded   = errors.New("budget exceeded")
+    ErrModelUnavailable = errors.New("model unavailable")
+    ErrThrottled        = errors.New("throttled")
+    ErrContextTooLong   = errors.New("context too long")
+    ErrContentBlocked   = errors.New("content blocked")
+    ErrUnprocessable    = errors.New("unprocessable")
+    ErrInternal         = errors.New("internal server error")
+    ErrDeadlineExceeded = errors.New("deadline exceeded")
+)
+
+var sentinels = map[string]error{
+    CodeValidation:       ErrValidation,
+    CodeUnauthorized:     ErrUnauthorized,
+    CodeForbidden:        ErrForbidden,
+    CodeNotFound:         ErrNotFound,
+    CodeRateLimited:      ErrRateLimited,
+    CodeBudgetExceeded:   ErrBudgetExceeded,
+    CodeModelUnavailable: ErrModelUnavailable,
+    CodeThrottled:        ErrThrottled,
+    CodeContextTooLong:   ErrContextTooLong,
+    CodeContentBlocked:   ErrContentBlocked,
+    CodeUnprocessable:    ErrUnprocessable,
+    CodeInternal:         ErrInternal,
+    CodeRequestBuild:     ErrInternal,
+    CodeDeliveryFailed:   ErrInternal,
+    CodeInvalidJSON:      ErrUnprocessable,
+    CodeInvalidSignature: ErrUnauthorized,
+    CodeReplayedRequest:  ErrUnauthorized,
+    CodeDeadlineExceeded: ErrDeadlineExceeded,
+}
+
+// FieldError describes a validation problem with one request field
+type FieldError struct {
+    Field   string `json:"field"`
+    Message string `json:"message"`
+}
+
+// APIError is any error response from the service. The more specific types
+// below embed it, so errors.As(err, &apiErr) works for all of them.
+type APIError struct {
+    StatusCode int
+    Code       string
+    Message    string
+    RequestID  string
+    TraceID    string // The request's trace, when the service traced it
+}
+
+func (e *APIError) Error() string {
+    msg := fmt.Sprintf("bedrock-service: %s (%d): %s", e.Code, e.StatusCode, e.Message)
+    if e.RequestID != "" {
+        msg += " [request " + e.RequestID + "]"
+    }
+    if e.TraceID != "" {
+        msg += " [trace " + e.TraceID + "]"
+    }
+    return msg
+}
+
+// Is matches the sentinel for the error's code
+func (e *APIError) Is(target error) bool {
+    sentinel, ok := sentinels[e.Code]
+    return ok && sentinel == target
+}
+
+// As lets errors.As extract the embedded *APIError from the typed errors
+func (e *APIError) As(target interface{}) bool {
+    if t, ok := target.(**APIError); ok {
+        *t = e
+        return true
+    }
+    return false
+}
+
+// RateLimitedError is returned when the caller is being throttled, or with
+// code throttled when Bedrock throttled the models the service tried
+type RateLimitedError struct {
+    APIError
+    RetryAfter time.Duration
+}
+
+// ModelUnavailableError is returned when no model could serve the request
+type ModelUnavailableError struct {
+    APIError
+    Attempted  []string       // Model IDs tried by the service, in order
+    ErrorClass string         // With StrictModel, the upstream failure, such as "ThrottlingException"
+    Failures   []ModelFailure // Why each model skipped or tried gave no answer
+}
+
+// ModelFailure is why one model in the request's chain gave no answer
+type ModelFailure struct {
+    Model      string `json:"model"`
+    ErrorClass string `json:"error_class"` // Such as "ThrottlingException" or "not_available"
+    Reason     string `json:"reason"`
+}
+
+// DeadlineExceededError is returned when the request's timeout_seconds ran
+// out before a model answered
+type DeadlineExceededError struct {
+    APIError
+    Attempted []string // Model IDs tried before time ran out, in order
+}
+
+// ValidationError is returned when the request was rejected as invalid
+type ValidationError struct {
+    APIError
+    Fields []FieldError
+}
+
+// BudgetExceededError is returned when the caller's spend budget is used up
+type BudgetExceededError struct {
+    APIError
+    ResetAt time.Time // Zero when the service did not say
+}
+
+// errorEnvelope mirrors the service's {"error": {...}} response body
+type errorEnvelope struct {
+    Error struct {
+        Code              string         `json:"code"`
+        Message           string         `json:"message"`
+        RequestID         string         `json:"request_id"`
+        TraceID           string         `json:"trace_id"`
+        Fields            []FieldError   `json:"fields"`
+        Attempted         []string       `json:"attempted"`
+        RetryAfterSeconds int            `json:"retry_after_seconds"`
+        ResetAt           *time.Time     `json:"reset_at"`
+        ErrorClass        string         `json:"error_class"`
+        Failures          []ModelFailure `json:"failures"`
+    } `json:"error"`
+}
+
+// parseError turns a non-2xx response into a typed error. Bodies that are not
+// an error envelope (proxies, load balancers) still produce an *APIError.
+func parseError(resp *http.Response, body []byte) error {
+    base := APIError{
+        StatusCode: resp.StatusCode,
+        RequestID:  resp.Header.Get("X-Request-ID"),
+    }
+
+    var env errorEnvelope
+    if err := json.Unmarshal(body, &env); err != nil || env.Error.Code == "" {
+        base.Code = codeForStatus(resp.StatusCode)
+        base.Message = http.StatusText(resp.StatusCode)
+        return &base
+    }
+
+    e := env.Error
+    base.Code = e.Code
+    base.Message = e.Message
+    if e.RequestID != "" {
+        base.RequestID = e.RequestID
+    }
+    base.TraceID = e.TraceID
+
+    switch e.Code {
+    case CodeRateLimited, CodeThrottled:
+        retryAfter := time.Duration(e.RetryAfterSeconds) * time.Second
+        if retryAfter == 0 {
+            if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+                retryAfter = time.Duration(seconds) * time.Second
+            }
+        }
+        return &RateLimitedError{APIError: base, RetryAfter: retryAfter}
+    case CodeModelUnavailable:
+        return &ModelUnavailableError{APIError: base, Attempted: e.Attempted, ErrorClass: e.ErrorClass, Failures: e.Failures}
+    case CodeDeadlineExceeded:
+        return &DeadlineExceededError{APIError: base, Attempted: e.Attempted}
+    case CodeValidation:
+        return &ValidationError{APIError: base, Fields: e.Fields}
+    case CodeBudgetExceeded:
+        err := &BudgetExceededError{APIError: base}
+        if e.ResetAt != nil {
+            err.ResetAt = *e.ResetAt
+        }
+        return err
+    }
+    return &base
+}
+
+// codeForStatus guesses a code for responses that carry no envelope
+func codeForStatus(status int) string {
+    switch status {
+    case http.StatusBadRequest:
+        return CodeValidation
+    case http.StatusUnauthorized:
+        return CodeUnauthorized
+    case http.StatusForbidden:
+        return CodeForbidden
+    case http.StatusNotFound:
+        return CodeNotFound
+    case http.StatusMethodNotAllowed:
+        return CodeMethodNotAllowed
+    case http.StatusTooManyRequests:
+        return CodeRateLimited
+    case http.StatusUnprocessableEntity:
+        return CodeUnprocessable
+    case http.StatusServiceUnavailable:
+        return CodeModelUnavailable
+    case http.StatusGatewayTimeout:
+        return CodeDeadlineExceeded
+    }
+    return CodeInternal
+}
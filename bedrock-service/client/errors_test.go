@@ -0,0 +1,186 @@
+package client
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+// errorCase is one error the service sends: its status, the envelope body
+// it writes and what Generate should return for it
+type errorCase struct {
+    code     string
+    status   int
+    extra    string // More fields of the envelope's error object
+    header   http.Header
+    sentinel error // nil for codes without one
+    check    func(t *testing.T, err error)
+}
+
+// errorCases covers every code the service sends, with the statuses it
+// sends them with
+var errorCases = []errorCase{
+    {code: CodeValidation, status: http.StatusBadRequest, extra: `"fields":[{"field":"max_tokens","message":"must be positive"}]`, sentinel: ErrValidation,
+        check: func(t *testing.T, err error) {
+            var v *ValidationError
+            if !errors.As(err, &v) || len(v.Fields) != 1 || v.Fields[0] != (FieldError{Field: "max_tokens", Message: "must be positive"}) {
+                t.Errorf("got %#v, want a *ValidationError with the field", err)
+            }
+        }},
+    {code: CodeUnauthorized, status: http.StatusUnauthorized, sentinel: ErrUnauthorized},
+    {code: CodeForbidden, status: http.StatusForbidden, sentinel: ErrForbidden},
+    {code: CodeNotFound, status: http.StatusNotFound, sentinel: ErrNotFound},
+    {code: CodeMethodNotAllowed, status: http.StatusMethodNotAllowed},
+    {code: CodeRateLimited, status: http.StatusTooManyRequests, extra: `"retry_after_seconds":7`, sentinel: ErrRateLimited,
+        check: func(t *testing.T, err error) {
+            var rl *RateLimitedError
+            if !errors.As(err, &rl) || rl.RetryAfter != 7*time.Second {
+                t.Errorf("got %#v, want a *RateLimitedError retrying after 7s", err)
+            }
+        }},
+    {code: CodeBudgetExceeded, status: http.StatusTooManyRequests, extra: `"reset_at":"2024-07-01T00:00:00Z"`, sentinel: ErrBudgetExceeded,
+        check: func(t *testing.T, err error) {
+            var be *BudgetExceededError
+            if !errors.As(err, &be) || !be.ResetAt.Equal(time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)) {
+                t.Errorf("got %#v, want a *BudgetExceededError resetting on July 1st", err)
+            }
+        }},
+    {code: CodeModelUnavailable, status: http.StatusServiceUnavailable, sentinel: ErrModelUnavailable,
+        extra: `"attempted":["m1","m2"],"error_class":"ThrottlingException","failures":[{"model":"m1","error_class":"ThrottlingException","reason":"throttled"}]`,
+        check: func(t *testing.T, err error) {
+            var mu *ModelUnavailableError
+            if !errors.As(err, &mu) || !reflect.DeepEqual(mu.Attempted, []string{"m1", "m2"}) || mu.ErrorClass != "ThrottlingException" ||
+                len(mu.Failures) != 1 || mu.Failures[0].Model != "m1" {
+                t.Errorf("got %#v, want a *ModelUnavailableError with the attempts and failures", err)
+            }
+        }},
+    // Throttling carries its wait in Retry-After alone
+    {code: CodeThrottled, status: http.StatusTooManyRequests, header: http.Header{"Retry-After": {"3"}}, sentinel: ErrThrottled,
+        check: func(t *testing.T, err error) {
+            var rl *RateLimitedError
+            if !errors.As(err, &rl) || rl.RetryAfter != 3*time.Second {
+                t.Errorf("got %#v, want a *RateLimitedError retrying after the header's 3s", err)
+            }
+        }},
+    {code: CodeContextTooLong, status: http.StatusBadRequest, sentinel: ErrContextTooLong},
+    {code: CodeContentBlocked, status: http.StatusUnprocessableEntity, sentinel: ErrContentBlocked},
+    {code: CodeUnprocessable, status: http.StatusUnprocessableEntity, sentinel: ErrUnprocessable},
+    {code: CodeInternal, status: http.StatusInternalServerError, sentinel: ErrInternal},
+    {code: CodeRequestBuild, status: http.StatusInternalServerError, sentinel: ErrInternal},
+    {code: CodeDeliveryFailed, status: http.StatusBadGateway, sentinel: ErrInternal},
+    {code: CodeInvalidJSON, status: http.StatusUnprocessableEntity, sentinel: ErrUnprocessable},
+    {code: CodeInvalidSignature, status: http.StatusUnauthorized, sentinel: ErrUnauthorized},
+    {code: CodeReplayedRequest, status: http.StatusUnauthorized, sentinel: ErrUnauthorized},
+    {code: CodeCancelled, status: 499},
+    {code: CodeDeadlineExceeded, status: http.StatusGatewayTimeout, extra: `"attempted":["m1"]`, sentinel: ErrDeadlineExceeded,
+        check: func(t *testing.T, err error) {
+            var de *DeadlineExceededError
+            if !errors.As(err, &de) || !reflect.DeepEqual(de.Attempted, []string{"m1"}) {
+                t.Errorf("got %#v, want a *DeadlineExceededError with the attempt", err)
+            }
+        }},
+    {code: CodeReservationConflict, status: http.StatusConflict},
+}
+
+// errorServer answers every request the way the service reports c
+func errorServer(c errorCase) *httptest.Server {
+    return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        for key, values := range c.header {
+            w.Header()[key] = values
+        }
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("X-Request-ID", "req-header")
+        w.WriteHeader(c.status)
+        body := `{"error":{"code":"` + c.code + `","message":"` + c.code + ` happened","request_id":"req-1","trace_id":"trace-1"`
+        if c.extra != "" {
+            body += "," + c.extra
+        }
+        w.Write([]byte(body + "}}\n"))
+    }))
+}
+
+func TestErrorCodesRoundTrip(t *testing.T) {
+    for _, c := range errorCases {
+        c := c
+        t.Run(c.code, func(t *testing.T) {
+            server := errorServer(c)
+            defer server.Close()
+
+            _, err := New(server.URL, "key").Generate(context.Background(), GenerateRequest{Prompt: "hi"})
+            var apiErr *APIError
+            if !errors.As(err, &apiErr) {
+                t.Fatalf("got %#v, want an error holding an *APIError", err)
+            }
+            want := APIError{StatusCode: c.status, Code: c.code, Message: c.code + " happened", RequestID: "req-1", TraceID: "trace-1"}
+            if *apiErr != want {
+                t.Errorf("APIError %+v, want %+v", *apiErr, want)
+            }
+            if !strings.Contains(err.Error(), "req-1") || !strings.Contains(err.Error(), "trace-1") {
+                t.Errorf("message %q doesn't quote the request and trace", err)
+            }
+
+            if c.sentinel != nil && !errors.Is(err, c.sentinel) {
+                t.Errorf("errors.Is(%v, %v) = false", err, c.sentinel)
+            }
+            if c.sentinel == nil {
+                if sentinel, ok := sentinels[c.code]; ok {
+                    t.Errorf("%s has sentinel %v the table doesn't expect", c.code, sentinel)
+                }
+            }
+            for code, other := range sentinels {
+                if other != c.sentinel && errors.Is(err, other) {
+                    t.Errorf("errors.Is matches the sentinel of %s too", code)
+                }
+            }
+            if c.check != nil {
+                c.check(t, err)
+            }
+        })
+    }
+}
+
+// Every code with a sentinel must have a case, so new codes get one
+func TestErrorCasesCoverSentinels(t *testing.T) {
+    covered := make(map[string]bool)
+    for _, c := range errorCases {
+        covered[c.code] = true
+    }
+    for code := range sentinels {
+        if !covered[code] {
+            t.Errorf("no round-trip case for %s", code)
+        }
+    }
+}
+
+func TestErrorWithoutEnvelope(t *testing.T) {
+    for status, code := range map[int]string{
+        http.StatusBadRequest:          CodeValidation,
+        http.StatusTooManyRequests:     CodeRateLimited,
+        http.StatusBadGateway:          CodeInternal,
+        http.StatusServiceUnavailable:  CodeModelUnavailable,
+        http.StatusGatewayTimeout:      CodeDeadlineExceeded,
+        http.StatusInternalServerError: CodeInternal,
+    } {
+        server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            w.Header().Set("X-Request-ID", "req-proxy")
+            w.WriteHeader(status)
+            w.Write([]byte("<html>upstream error</html>"))
+        }))
+        _, err := New(server.URL, "").Generate(context.Background(), GenerateRequest{Prompt: "hi"})
+        server.Close()
+
+        apiErr, ok := err.(*APIError)
+        if !ok {
+            t.Errorf("status %d: got %#v, want a plain *APIError", status, err)
+            continue
+        }
+        if apiErr.Code != code || apiErr.StatusCode != status || apiErr.RequestID != "req-proxy" {
+            t.Errorf("status %d: got %+v, want code %s and the header's request ID", status, *apiErr, code)
+        }
+    }
+}
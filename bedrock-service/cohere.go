@@ -0,0 +1,87 @@
+package main
+
+// Cohere Command R models take the final user turn as message, the turns
+// before it as chat_history with the roles USER and CHATBOT, and the system
+// prompt as preamble. They answer with text and a finish_reason, and report
+// usage under meta.billed_units.
+
+// buildCohereBody is buildRequestBody for the Cohere chat format
+func buildCohereBody(p GenerationParams) map[string]interface{} {
+    history := make([]map[string]string, 0, len(p.History))
+    for _, m := range p.History {
+        role := "USER"
+        if m.Role == roleAssistant {
+            role = "CHATBOT"
+        }
+        history = append(history, map[string]string{"role": role, "message": m.Content})
+    }
+
+    body := map[string]interface{}{
+        "message":     p.Prompt,
+        "max_tokens":  p.MaxTokens,
+        "temperature": *p.Temperature,
+    }
+    if len(history) > 0 {
+        body["chat_history"] = history
+    }
+    // An empty preamble is left out, like the messages API's system prompt
+    if preamble := p.withContextPrefix(p.systemPrompt(defaultSystemPrompt)); preamble != "" {
+        body["preamble"] = preamble
+    }
+    if p.TopP != nil {
+        body["p"] = *p.TopP
+    }
+    if p.TopK != nil {
+        body["k"] = *p.TopK
+    }
+    if len(p.StopSequences) > 0 {
+        body["stop_sequences"] = p.StopSequences
+    }
+    return body
+}
+
+// cohereUsage reads the token usage a Cohere response reports, zero when it
+// reports none
+func cohereUsage(response map[string]interface{}) (input, output int) {
+    meta, _ := response["meta"].(map[string]interface{})
+    billed, ok := meta["billed_units"].(map[string]interface{})
+    if !ok {
+        return 0, 0
+    }
+    if n, ok := billed["input_tokens"].(float64); ok {
+        input = int(n)
+    }
+    if n, ok := billed["output_tokens"].(float64); ok {
+        output = int(n)
+    }
+    return input, output
+}
+
+// cohereFormat is the Cohere chat format
+type cohereFormat struct{}
+
+func (cohereFormat) buildBody(p GenerationParams) map[string]interface{} {
+    return buildCohereBody(p)
+}
+
+func (cohereFormat) probeBody(prompt string) map[string]interface{} {
+    return map[string]interface{}{
+        "message":    prompt,
+        "max_tokens": 10,
+    }
+}
+
+func (cohereFormat) provider() string { return providerCohere }
+
+func (cohereFormat) stopReason(response map[string]interface{}) string {
+    raw, _ := response["finish_reason"].(string)
+    return raw
+}
+
+func (cohereFormat) parseResponse(response map[string]interface{}, p GenerationParams, result *GenerationResult) bool {
+    // Cohere doesn't say which stop sequence matched
+    result.InputTokens, result.OutputTokens = cohereUsage(response)
+    text, ok := response["text"].(string)
+    result.Text = text
+    return ok
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+
+    "go.opentelemetry.io/otel/codes"
+)
+
+// Bedrock throttles hard past about 20 concurrent invocations, so the
+// generations this replica runs at once can be bounded. A generation holds
+// one slot, through every model of its chain, and a stream holds its slot
+// until it has been forwarded in full. A request that finds every slot taken
+// waits up to GENERATION_QUEUE_WAIT_MS for one, or with no wait is turned
+// away at once, with 503 and Retry-After either way.
+
+// ConcurrencyConfig bounds the generations in flight
+type ConcurrencyConfig struct {
+    MaxInFlight int           // Zero leaves generations unbounded
+    QueueWait   time.Duration // How long a request waits for a slot; zero rejects at once
+}
+
+// LoadConcurrencyConfig reads GENERATION_MAX_IN_FLIGHT and
+// GENERATION_QUEUE_WAIT_MS
+func LoadConcurrencyConfig() (ConcurrencyConfig, error) {
+    var cfg ConcurrencyConfig
+    if v := os.Getenv("GENERATION_MAX_IN_FLIGHT"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            return cfg, fmt.Errorf("invalid GENERATION_MAX_IN_FLIGHT %q", v)
+        }
+        cfg.MaxInFlight = n
+    }
+    if v := os.Getenv("GENERATION_QUEUE_WAIT_MS"); v != "" {
+        ms, err := strconv.Atoi(v)
+        if err != nil || ms < 0 {
+            return cfg, fmt.Errorf("invalid GENERATION_QUEUE_WAIT_MS %q", v)
+        }
+        cfg.QueueWait = time.Duration(ms) * time.Millisecond
+    }
+    return cfg, nil
+}
+
+// errSaturated is returned when a generation got no slot
+var errSaturated = errors.New("too many generations in flight")
+
+// saturatedRetryAfter is the Retry-After sent with a 503 for saturation
+const saturatedRetryAfter = 1
+
+// GenerationGate is a semaphore over the generations in flight. Waits and
+// rejections are counted by the load tracker, so they show in /scaling.
+type GenerationGate struct {
+    slots chan struct{}
+    wait  time.Duration
+}
+
+// NewGenerationGate returns the gate, or nil when generations are unbounded
+func NewGenerationGate(cfg ConcurrencyConfig) *GenerationGate {
+    if cfg.MaxInFlight == 0 {
+        return nil
+    }
+    metrics.Set("generation_max_in_flight", float64(cfg.MaxInFlight))
+    return &GenerationGate{slots: make(chan struct{}, cfg.MaxInFlight), wait: cfg.QueueWait}
+}
+
+// gateSlotKey marks a context whose request already holds a slot
+type gateSlotKey struct{}
+
+// Enter takes a slot for the request; call the returned func when its
+// generation ends. A request holding a slot already, a stream invoking a
+// legacy model say, doesn't take another. It fails with errSaturated, or
+// with ctx's error when ctx ends while it waits.
+func (g *GenerationGate) Enter(ctx context.Context) (context.Context, func(), error) {
+    if g == nil || ctx.Value(gateSlotKey{}) != nil {
+        return ctx, func() {}, nil
+    }
+
+    select {
+    case g.slots <- struct{}{}:
+        load.Admit()
+        return g.held(ctx)
+    default:
+    }
+    if g.wait == 0 {
+        load.Shed()
+        return ctx, nil, errSaturated
+    }
+
+    load.Enqueue()
+    started := time.Now()
+    span := startQueueWait(ctx)
+    defer span.End()
+    timer := time.NewTimer(g.wait)
+    defer timer.Stop()
+    select {
+    case g.slots <- struct{}{}:
+        load.Dequeue(time.Since(started), true)
+        return g.held(ctx)
+    case <-timer.C:
+        load.Dequeue(time.Since(started), false)
+        span.SetStatus(codes.Error, errSaturated.Error())
+        return ctx, nil, errSaturated
+    case <-ctx.Done():
+        load.Dequeue(time.Since(started), false)
+        return ctx, nil, ctx.Err()
+    }
+}
+
+// held marks ctx as holding a slot and returns its release
+func (g *GenerationGate) held(ctx context.Context) (context.Context, func(), error) {
+    metrics.Set("generations_in_flight", float64(len(g.slots)))
+    var once sync.Once
+    return context.WithValue(ctx, gateSlotKey{}, true), func() {
+        once.Do(func() {
+            <-g.slots
+            metrics.Set("generations_in_flight", float64(len(g.slots)))
+        })
+    }, nil
+}
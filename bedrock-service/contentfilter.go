@@ -0,0 +1,79 @@
+package main
+
+import (
+    "errors"
+    "os"
+    "strconv"
+)
+
+// ErrContentFiltered is returned by helpers that need text when the model's
+// output was withheld by content filtering
+var ErrContentFiltered = errors.New("response was blocked by content filtering")
+
+// Filter categories reported to callers
+const (
+    filterGuardrail = "guardrail"        // A Bedrock guardrail intervened
+    filterContent   = "content_filtered" // The provider's built-in filter blocked the output
+    filterRefusal   = "refusal"          // The model declined to answer
+)
+
+// contentFilterFallbackEnabled reports whether CONTENT_FILTER_FALLBACK asks
+// for a filtered generation to be retried on the next model. It is off by
+// default since the next model will usually filter the prompt too.
+func contentFilterFallbackEnabled() bool {
+    enabled, _ := strconv.ParseBool(os.Getenv("CONTENT_FILTER_FALLBACK"))
+    return enabled
+}
+
+// detectContentFilter checks a decoded InvokeModel response body for the
+// filtering indicators used by the providers we talk to, returning the
+// category when the output was filtered
+func detectContentFilter(response map[string]interface{}) (string, bool) {
+    // Guardrails add this field regardless of provider
+    if action, ok := response["amazon-bedrock-guardrailAction"].(string); ok && action == "INTERVENED" {
+        return filterGuardrail, true
+    }
+
+    // Anthropic messages and legacy completions
+    for _, field := range []string{"stop_reason", "stopReason"} {
+        switch response[field] {
+        case "refusal":
+            return filterRefusal, true
+        case "content_filtered", "guardrail_intervened":
+            return filterContent, true
+        }
+    }
+
+    // Jamba reports it per choice
+    if choice, ok := jambaChoice(response); ok && choice["finish_reason"] == "content_filter" {
+        return filterContent, true
+    }
+
+    // Cohere reports toxic output as a finish reason
+    if response["finish_reason"] == "ERROR_TOXIC" {
+        return filterContent, true
+    }
+
+    // Titan text reports it per result
+    if results, ok := response["results"].([]interface{}); ok {
+        for _, result := range results {
+            if r, ok := result.(map[string]interface{}); ok {
+                if reason, _ := r["completionReason"].(string); reason == "CONTENT_FILTERED" || reason == "FILTERED" {
+                    return filterContent, true
+                }
+            }
+        }
+    }
+    return "", false
+}
+
+// streamStopFiltered maps a streamed stop reason to a filter category
+func streamStopFiltered(stopReason string) (string, bool) {
+    switch stopReason {
+    case "refusal":
+        return filterRefusal, true
+    case "content_filtered", "guardrail_intervened":
+        return filterContent, true
+    }
+    return "", false
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+    "github.com/gorilla/mux"
+)
+
+// StoredContext is a reusable prompt prefix registered with POST /contexts
+type StoredContext struct {
+    ID        string
+    Owner     string // Tenant, or key ID for keys without a tenant
+    Text      string
+    Tokens    int
+    CreatedAt time.Time
+    ExpiresAt time.Time
+    Warmed    bool
+
+    uses     int
+    lastUsed time.Time
+}
+
+// ContextStoreConfig limits what callers can store
+type ContextStoreConfig struct {
+    MaxBytes    int           // Largest prefix accepted
+    MaxPerOwner int           // Live contexts per tenant
+    DefaultTTL  time.Duration // Used when the request doesn't set ttl_seconds
+    MaxTTL      time.Duration
+    PromptCache bool // Mark prefixes for Anthropic prompt caching
+}
+
+// LoadContextStoreConfig reads CONTEXT_MAX_BYTES, CONTEXT_MAX_PER_TENANT,
+// CONTEXT_TTL_MINUTES, CONTEXT_MAX_TTL_MINUTES and CONTEXT_PROMPT_CACHE
+func LoadContextStoreConfig() (ContextStoreConfig, error) {
+    cfg := ContextStoreConfig{
+        MaxBytes:    200 * 1024,
+        MaxPerOwner: 20,
+        DefaultTTL:  time.Hour,
+        MaxTTL:      24 * time.Hour,
+    }
+
+    ints := []struct {
+        env    string
+        target *int
+    }{
+        {"CONTEXT_MAX_BYTES", &cfg.MaxBytes},
+        {"CONTEXT_MAX_PER_TENANT", &cfg.MaxPerOwner},
+    }
+    for _, setting := range ints {
+        if v := os.Getenv(setting.env); v != "" {
+            n, err := strconv.Atoi(v)
+            if err != nil || n <= 0 {
+                return cfg, fmt.Errorf("invalid %s %q", setting.env, v)
+            }
+            *setting.target = n
+        }
+    }
+
+    durations := []struct {
+        env    string
+        target *time.Duration
+    }{
+        {"CONTEXT_TTL_MINUTES", &cfg.DefaultTTL},
+        {"CONTEXT_MAX_TTL_MINUTES", &cfg.MaxTTL},
+    }
+    for _, setting := range durations {
+        if v := os.Getenv(setting.env); v != "" {
+            minutes, err := strconv.Atoi(v)
+            if err != nil || minutes <= 0 {
+                return cfg, fmt.Errorf("invalid %s %q", setting.env, v)
+            }
+            *setting.target = time.Duration(minutes) * time.Minute
+        }
+    }
+    if cfg.DefaultTTL > cfg.MaxTTL {
+        return cfg, fmt.Errorf("CONTEXT_TTL_MINUTES must not exceed CONTEXT_MAX_TTL_MINUTES")
+    }
+
+    cfg.PromptCache, _ = strconv.ParseBool(os.Getenv("CONTEXT_PROMPT_CACHE"))
+    return cfg, nil
+}
+
+// ContextStore holds prompt prefixes in memory, isolated per tenant
+type ContextStore struct {
+    cfg ContextStoreConfig
+
+    mu       sync.Mutex
+    contexts map[string]*StoredContext
+}
+
+func NewContextStore(cfg ContextStoreConfig) *ContextStore {
+    return &ContextStore{cfg: cfg, contexts: make(map[string]*StoredContext)}
+}
+
+// contextOwner is the isolation boundary for stored contexts
+func contextOwner(p *Principal) string {
+    if p.Tenant != "" {
+        return "tenant:" + p.Tenant
+    }
+    return "key:" + p.KeyID
+}
+
+// expireLocked drops contexts past their expiry
+func (cs *ContextStore) expireLocked(now time.Time) {
+    for id, c := range cs.contexts {
+        if now.After(c.ExpiresAt) {
+            delete(cs.contexts, id)
+        }
+    }
+}
+
+func (c *StoredContext) memoryBytes() int64 {
+    return int64(len(c.ID)+len(c.Owner)+len(c.Text)) + recordOverhead
+}
+
+// MemoryBytes estimates the bytes held by stored contexts
+func (cs *ContextStore) MemoryBytes() int64 {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    var n int64
+    for _, c := range cs.contexts {
+        n += c.memoryBytes()
+    }
+    return n
+}
+
+// EvictTo drops the least recently used contexts; callers see them as expired
+func (cs *ContextStore) EvictTo(target int64) int {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    sizes := make(map[string]int64, len(cs.contexts))
+    lastUsed := make(map[string]time.Time, len(cs.contexts))
+    for id, c := range cs.contexts {
+        sizes[id], lastUsed[id] = c.memoryBytes(), c.CreatedAt
+        if c.lastUsed.After(c.CreatedAt) {
+            lastUsed[id] = c.lastUsed
+        }
+    }
+    drop := lruEvict(sizes, lastUsed, target)
+    for _, id := range drop {
+        delete(cs.contexts, id)
+    }
+    return len(drop)
+}
+
+// Add stores a new prefix for owner
+func (cs *ContextStore) Add(owner, text string, ttl time.Duration, now time.Time) (*StoredContext, error) {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+
+    cs.expireLocked(now)
+    count := 0
+    for _, c := range cs.contexts {
+        if c.Owner == owner {
+            count++
+        }
+    }
+    if count >= cs.cfg.MaxPerOwner {
+        return nil, fmt.Errorf("too many stored contexts (limit %d); wait for some to expire", cs.cfg.MaxPerOwner)
+    }
+
+    c := &StoredContext{
+        ID:        "ctx_" + newRequestID(),
+        Owner:     owner,
+        Text:      text,
+        Tokens:    estimateTokens(text),
+        CreatedAt: now,
+        ExpiresAt: now.Add(ttl),
+    }
+    cs.contexts[c.ID] = c
+    metrics.Inc("contexts_created_total")
+    return c, nil
+}
+
+// lookupLocked returns a live context visible to owner. Contexts of other
+// tenants are reported as missing so IDs can't be probed.
+func (cs *ContextStore) lookupLocked(owner, id string, now time.Time) (*StoredContext, bool) {
+    c, ok := cs.contexts[id]
+    if !ok || c.Owner != owner {
+        return nil, false
+    }
+    if now.After(c.ExpiresAt) {
+        delete(cs.contexts, id)
+        return nil, false
+    }
+    return c, true
+}
+
+// Use returns the prefix text for a generation and records the use
+func (cs *ContextStore) Use(owner, id string, now time.Time) (string, bool) {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+
+    c, ok := cs.lookupLocked(owner, id, now)
+    if !ok {
+        return "", false
+    }
+    c.uses++
+    c.lastUsed = now
+    metrics.Inc("context_uses_total")
+    metrics.Add("context_prefix_tokens_total", float64(c.Tokens))
+    return c.Text, true
+}
+
+// ContextInfo describes a stored context; the prefix text is never echoed back
+type ContextInfo struct {
+    ContextID             string     `json:"context_id"`
+    Tokens                int        `json:"tokens"`
+    Bytes                 int        `json:"bytes"`
+    CreatedAt             time.Time  `json:"created_at"`
+    ExpiresAt             time.Time  `json:"expires_at"`
+    PromptCache           bool       `json:"prompt_cache"`
+    Warmed                bool       `json:"warmed"`
+    Uses                  int        `json:"uses"`
+    LastUsed              *time.Time `json:"last_used,omitempty"`
+    EstimatedTokenSavings int        `json:"estimated_token_savings"` // Prefix tokens callers didn't have to resend
+}
+
+// Info returns usage stats for a context visible to owner
+func (cs *ContextStore) Info(owner, id string, now time.Time) (ContextInfo, bool) {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+
+    c, ok := cs.lookupLocked(owner, id, now)
+    if !ok {
+        return ContextInfo{}, false
+    }
+    return cs.infoLocked(c), true
+}
+
+func (cs *ContextStore) infoLocked(c *StoredContext) ContextInfo {
+    info := ContextInfo{
+        ContextID:             c.ID,
+        Tokens:                c.Tokens,
+        Bytes:                 len(c.Text),
+        CreatedAt:             c.CreatedAt,
+        ExpiresAt:             c.ExpiresAt,
+        PromptCache:           cs.cfg.PromptCache,
+        Warmed:                c.Warmed,
+        Uses:                  c.uses,
+        EstimatedTokenSavings: c.uses * c.Tokens,
+    }
+    if !c.lastUsed.IsZero() {
+        lastUsed := c.lastUsed
+        info.LastUsed = &lastUsed
+    }
+    return info
+}
+
+// markWarmed records that the prompt cache warming call succeeded
+func (cs *ContextStore) markWarmed(id string) {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    if c, ok := cs.contexts[id]; ok {
+        c.Warmed = true
+    }
+}
+
+// warmPromptCache sends a minimal request with the prefix so the first real
+// request reads it from Anthropic's prompt cache
+func (bc *BedrockClient) warmPromptCache(ctx context.Context, prefix, preferredModel string) error {
+    for _, model := range bc.modelsToTry(preferredModel) {
+        if model.API != apiMessages {
+            continue
+        }
+        body, err := marshalRequestBody(ctx, model.ID, buildRequestBody(model, GenerationParams{
+            Prompt:        "Reply with OK.",
+            MaxTokens:     1,
+            ContextPrefix: prefix,
+            PromptCache:   true,
+        }.withDefaults()))
+        if err != nil {
+            return err
+        }
+        _, _, err = bc.accounts.InvokeModel(ctx, originWarmup, &bedrockruntime.InvokeModelInput{
+            Body:        body,
+            ModelId:     aws.String(model.invokeID()),
+            ContentType: aws.String("application/json"),
+        })
+        return err
+    }
+    return fmt.Errorf("no available messages API model to warm")
+}
+
+// CreateContextRequest is the body of POST /contexts
+type CreateContextRequest struct {
+    Text       string `json:"text"`
+    TTLSeconds int    `json:"ttl_seconds,omitempty"`
+    Warm       bool   `json:"warm,omitempty"` // Prime the prompt cache (requires CONTEXT_PROMPT_CACHE)
+    Model      string `json:"model,omitempty"`
+}
+
+func createContextHandler(bc *BedrockClient, cs *ContextStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req CreateContextRequest
+
+        if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(cs.cfg.MaxBytes)+4096)).Decode(&req); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+        if req.Text == "" {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: "text is required",
+                Fields:  []FieldError{{Field: "text", Message: "is required"}},
+            })
+            return
+        }
+        if len(req.Text) > cs.cfg.MaxBytes {
+            writeAPIError(w, r, http.StatusRequestEntityTooLarge, APIError{
+                Code:    ErrCodeValidation,
+                Message: fmt.Sprintf("text exceeds the %d byte limit", cs.cfg.MaxBytes),
+                Fields:  []FieldError{{Field: "text", Message: fmt.Sprintf("must be at most %d bytes", cs.cfg.MaxBytes)}},
+            })
+            return
+        }
+
+        ttl := cs.cfg.DefaultTTL
+        if req.TTLSeconds < 0 || time.Duration(req.TTLSeconds)*time.Second > cs.cfg.MaxTTL {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: fmt.Sprintf("ttl_seconds must be between 1 and %d", int(cs.cfg.MaxTTL.Seconds())),
+                Fields:  []FieldError{{Field: "ttl_seconds", Message: "out of range"}},
+            })
+            return
+        }
+        if req.TTLSeconds > 0 {
+            ttl = time.Duration(req.TTLSeconds) * time.Second
+        }
+
+        owner := contextOwner(principalFrom(r.Context()))
+        stored, err := cs.Add(owner, req.Text, ttl, time.Now())
+        if err != nil {
+            writeError(w, r, http.StatusConflict, ErrCodeUnprocessable, err.Error())
+            return
+        }
+
+        if req.Warm && cs.cfg.PromptCache {
+            if err := bc.warmPromptCache(r.Context(), req.Text, req.Model); err != nil {
+                logWarnf(r.Context(), "Prompt cache warming for %s failed: %v", stored.ID, err)
+            } else {
+                cs.markWarmed(stored.ID)
+            }
+        }
+
+        info, _ := cs.Info(owner, stored.ID, time.Now())
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(info)
+    }
+}
+
+func getContextHandler(cs *ContextStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        owner := contextOwner(principalFrom(r.Context()))
+        info, ok := cs.Info(owner, mux.Vars(r)["id"], time.Now())
+        if !ok {
+            writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Context not found")
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(info)
+    }
+}
@@ -0,0 +1,752 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Message roles in a conversation
+const (
+    roleUser      = "user"
+    roleAssistant = "assistant"
+)
+
+// History policies decide which earlier turns are sent when a conversation
+// outgrows its per-turn input budget
+const (
+    historySlidingWindow = "sliding_window"    // Drop the oldest turns until the rest fits
+    historyKeepLast      = "keep_first_last_n" // System prompt plus the last keep_last turns, trimmed to fit
+    historySummarize     = "summarize"         // Fold dropped turns into a running summary
+)
+
+// summaryMaxTokens bounds the running summary kept by the summarize policy
+const summaryMaxTokens = 400
+
+// ChatMessage is one side of a conversation turn
+type ChatMessage struct {
+    Role    string         `json:"role"`
+    Content string         `json:"content"`
+    Blocks  []ContentBlock `json:"-"` // The content array it was given as, with Content its text; see vision.go
+}
+
+// TurnBudget shapes the input of every turn of a conversation
+type TurnBudget struct {
+    MaxInputTokens       int    `json:"max_input_tokens"`
+    ReservedOutputTokens int    `json:"reserved_output_tokens"`
+    HistoryPolicy        string `json:"history_policy"`
+    KeepLast             int    `json:"keep_last,omitempty"` // Turns kept by keep_first_last_n
+}
+
+// ConversationConfig holds the defaults and limits for server-side conversations
+type ConversationConfig struct {
+    Defaults    TurnBudget
+    MaxPerOwner int
+    IdleTTL     time.Duration // Conversations expire after this long without a turn
+}
+
+// LoadConversationConfig reads CONVERSATION_MAX_INPUT_TOKENS,
+// CONVERSATION_RESERVED_OUTPUT_TOKENS, CONVERSATION_HISTORY_POLICY,
+// CONVERSATION_KEEP_LAST, CONVERSATION_MAX_PER_TENANT and CONVERSATION_TTL_MINUTES
+func LoadConversationConfig() (ConversationConfig, error) {
+    cfg := ConversationConfig{
+        Defaults: TurnBudget{
+            MaxInputTokens:       16000,
+            ReservedOutputTokens: 2000,
+            HistoryPolicy:        historySlidingWindow,
+        },
+        MaxPerOwner: 100,
+        IdleTTL:     24 * time.Hour,
+    }
+
+    keepLast := 10
+    ttlMinutes := 0
+    ints := []struct {
+        env    string
+        target *int
+    }{
+        {"CONVERSATION_MAX_INPUT_TOKENS", &cfg.Defaults.MaxInputTokens},
+        {"CONVERSATION_RESERVED_OUTPUT_TOKENS", &cfg.Defaults.ReservedOutputTokens},
+        {"CONVERSATION_KEEP_LAST", &keepLast},
+        {"CONVERSATION_MAX_PER_TENANT", &cfg.MaxPerOwner},
+        {"CONVERSATION_TTL_MINUTES", &ttlMinutes},
+    }
+    for _, setting := range ints {
+        if v := os.Getenv(setting.env); v != "" {
+            n, err := strconv.Atoi(v)
+            if err != nil || n <= 0 {
+                return cfg, fmt.Errorf("invalid %s %q", setting.env, v)
+            }
+            *setting.target = n
+        }
+    }
+    if ttlMinutes > 0 {
+        cfg.IdleTTL = time.Duration(ttlMinutes) * time.Minute
+    }
+
+    if v := os.Getenv("CONVERSATION_HISTORY_POLICY"); v != "" {
+        cfg.Defaults.HistoryPolicy = v
+    }
+    if cfg.Defaults.HistoryPolicy == historyKeepLast {
+        cfg.Defaults.KeepLast = keepLast
+    }
+    if err := cfg.Defaults.validate(); err != nil {
+        return cfg, fmt.Errorf("invalid conversation defaults: %v", err)
+    }
+    return cfg, nil
+}
+
+// validate rejects budgets that can't work independently of the model
+func (b TurnBudget) validate() error {
+    switch b.HistoryPolicy {
+    case historySlidingWindow, historySummarize:
+        if b.KeepLast != 0 {
+            return fmt.Errorf("keep_last only applies to the %s history policy", historyKeepLast)
+        }
+    case historyKeepLast:
+        if b.KeepLast < 1 {
+            return fmt.Errorf("keep_last must be at least 1 for the %s history policy", historyKeepLast)
+        }
+    default:
+        return fmt.Errorf("history_policy must be one of %s, %s, %s", historySlidingWindow, historyKeepLast, historySummarize)
+    }
+    if b.MaxInputTokens <= 0 {
+        return fmt.Errorf("max_input_tokens must be positive")
+    }
+    if b.ReservedOutputTokens <= 0 {
+        return fmt.Errorf("reserved_output_tokens must be positive")
+    }
+    return nil
+}
+
+// HistoryEvent records turns taken out of a conversation's window
+type HistoryEvent struct {
+    Turn            int       `json:"turn"`
+    Policy          string    `json:"policy"`
+    DroppedMessages int       `json:"dropped_messages"`
+    DroppedTokens   int       `json:"dropped_tokens"`
+    Summarized      bool      `json:"summarized"`
+    At              time.Time `json:"at"`
+}
+
+// Conversation is a server-side conversation. Messages keeps the full
+// transcript; only messages from windowStart on are still sent to the model.
+type Conversation struct {
+    ID        string
+    Owner     string
+    Model     string // Pinned model, empty to use the fallback chain
+    System    string // Conversation-specific instructions
+    Budget    TurnBudget
+    CreatedAt time.Time
+
+    turnMu sync.Mutex // Serializes turns so history is assembled in order
+
+    // Guarded by the store's mutex
+    messages    []ChatMessage
+    windowStart int
+    summary     string
+    events      []HistoryEvent
+    turns       int
+    lastActive  time.Time
+    shareGen    int // Share links signed for an earlier generation are revoked
+}
+
+// ConversationStore holds conversations in memory, isolated per tenant
+type ConversationStore struct {
+    cfg ConversationConfig
+
+    mu            sync.Mutex
+    conversations map[string]*Conversation
+}
+
+func NewConversationStore(cfg ConversationConfig) *ConversationStore {
+    return &ConversationStore{cfg: cfg, conversations: make(map[string]*Conversation)}
+}
+
+// expireLocked drops conversations idle for longer than the TTL
+func (cs *ConversationStore) expireLocked(now time.Time) {
+    for id, c := range cs.conversations {
+        if now.Sub(c.lastActive) > cs.cfg.IdleTTL {
+            delete(cs.conversations, id)
+        }
+    }
+}
+
+// memoryBytesLocked estimates the bytes held by a conversation
+func (c *Conversation) memoryBytesLocked() int64 {
+    n := int64(len(c.ID)+len(c.Owner)+len(c.Model)+len(c.System)+len(c.summary)) + recordOverhead
+    for _, m := range c.messages {
+        n += int64(len(m.Role)+len(m.Content)) + 32
+    }
+    return n + int64(len(c.events))*64
+}
+
+// MemoryBytes estimates the bytes held by conversations
+func (cs *ConversationStore) MemoryBytes() int64 {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    var n int64
+    for _, c := range cs.conversations {
+        n += c.memoryBytesLocked()
+    }
+    return n
+}
+
+// EvictTo drops the least recently active conversations. Conversations with
+// a turn in progress are kept, so the turn isn't appended to a dropped copy.
+func (cs *ConversationStore) EvictTo(target int64) int {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    sizes := make(map[string]int64, len(cs.conversations))
+    lastActive := make(map[string]time.Time, len(cs.conversations))
+    var busy int64
+    for id, c := range cs.conversations {
+        if !c.turnMu.TryLock() {
+            busy += c.memoryBytesLocked()
+            continue
+        }
+        c.turnMu.Unlock()
+        sizes[id], lastActive[id] = c.memoryBytesLocked(), c.lastActive
+    }
+    drop := lruEvict(sizes, lastActive, target-busy)
+    for _, id := range drop {
+        delete(cs.conversations, id)
+    }
+    return len(drop)
+}
+
+// SweepExpired deletes conversations created before cutoff. Conversations
+// with a turn in progress are left for the next sweep.
+func (cs *ConversationStore) SweepExpired(ctx context.Context, cutoff time.Time, cursor string, limit int, dryRun bool, rep *RetentionReport) (string, error) {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    created := make(map[string]time.Time, len(cs.conversations))
+    for id, c := range cs.conversations {
+        created[id] = c.CreatedAt
+    }
+    ids, next := expiredPage(created, cutoff, cursor, limit)
+    for _, id := range ids {
+        c := cs.conversations[id]
+        if !dryRun {
+            if !c.turnMu.TryLock() {
+                continue
+            }
+            delete(cs.conversations, id)
+            c.turnMu.Unlock()
+        }
+        rep.add(c.CreatedAt)
+    }
+    return next, nil
+}
+
+// Create stores a new, empty conversation for owner
+func (cs *ConversationStore) Create(c *Conversation, now time.Time) error {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+
+    cs.expireLocked(now)
+    count := 0
+    for _, existing := range cs.conversations {
+        if existing.Owner == c.Owner {
+            count++
+        }
+    }
+    if count >= cs.cfg.MaxPerOwner {
+        return fmt.Errorf("too many conversations (limit %d); wait for idle ones to expire", cs.cfg.MaxPerOwner)
+    }
+
+    c.ID = "conv_" + newRequestID()
+    c.CreatedAt, c.lastActive = now, now
+    cs.conversations[c.ID] = c
+    metrics.Inc("conversations_created_total", "policy", c.Budget.HistoryPolicy)
+    return nil
+}
+
+// Get returns a live conversation visible to owner. Other tenants'
+// conversations are reported as missing so IDs can't be probed.
+func (cs *ConversationStore) Get(owner, id string, now time.Time) (*Conversation, bool) {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+
+    c, ok := cs.conversations[id]
+    if !ok || c.Owner != owner {
+        return nil, false
+    }
+    if now.Sub(c.lastActive) > cs.cfg.IdleTTL {
+        delete(cs.conversations, id)
+        return nil, false
+    }
+    return c, true
+}
+
+// ShareGeneration returns the generation new share links are signed for
+func (cs *ConversationStore) ShareGeneration(c *Conversation) int {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    return c.shareGen
+}
+
+// RevokeShares invalidates every share link signed so far and returns the
+// new generation
+func (cs *ConversationStore) RevokeShares(c *Conversation) int {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    c.shareGen++
+    return c.shareGen
+}
+
+// Shared returns the redacted transcript of a live conversation for a share
+// link of the given generation, whoever owns it. The link already proves
+// the owner chose to share it.
+func (cs *ConversationStore) Shared(id string, generation int, now time.Time) (SharedTranscript, bool) {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+
+    c, ok := cs.conversations[id]
+    if !ok || c.shareGen != generation || now.Sub(c.lastActive) > cs.cfg.IdleTTL {
+        return SharedTranscript{}, false
+    }
+    transcript := SharedTranscript{ConversationID: c.ID, CreatedAt: c.CreatedAt, Messages: make([]ChatMessage, len(c.messages))}
+    for i, m := range c.messages {
+        transcript.Messages[i] = ChatMessage{Role: m.Role, Content: redactText(m.Content)}
+    }
+    return transcript, true
+}
+
+// modelWindow returns the context window a budget must fit: the pinned
+// model's, or the smallest configured one when any model may serve the turn
+func (bc *BedrockClient) modelWindow(pinned string) (int, string, bool) {
+    smallest, name := 0, ""
+    for _, model := range bc.textModels() {
+        if pinned != "" {
+            if strings.EqualFold(model.ID, pinned) || strings.EqualFold(model.Name, pinned) {
+                return model.ContextWindow, model.Name, true
+            }
+            continue
+        }
+        if smallest == 0 || model.ContextWindow < smallest {
+            smallest, name = model.ContextWindow, model.Name
+        }
+    }
+    return smallest, name, pinned == "" && smallest > 0
+}
+
+// TurnBudgetUsage reports how a turn used its budget. Token counts are
+// estimates made before the model was invoked.
+type TurnBudgetUsage struct {
+    MaxInputTokens       int     `json:"max_input_tokens"`
+    InputTokens          int     `json:"input_tokens"`
+    ReservedOutputTokens int     `json:"reserved_output_tokens"`
+    Utilization          float64 `json:"utilization"` // input_tokens / max_input_tokens
+    HistoryMessages      int     `json:"history_messages"`
+    DroppedMessages      int     `json:"dropped_messages,omitempty"` // Taken out of the window this turn
+    Summarized           bool    `json:"summarized,omitempty"`
+}
+
+// errTurnOverBudget is returned when a turn can't fit even with no history
+var errTurnOverBudget = errors.New("prompt does not fit the conversation's max_input_tokens")
+
+// turnPlan is the assembled input of one turn
+type turnPlan struct {
+    params GenerationParams
+    usage  TurnBudgetUsage
+}
+
+// paramsLocked builds generation params for the window starting at start
+func (c *Conversation) paramsLocked(base GenerationParams, start int) GenerationParams {
+    p := base
+    p.PreferredModel = c.Model
+    p.MaxTokens = c.Budget.ReservedOutputTokens
+    if c.System != "" {
+        p.SystemContext = append(append([]string{}, p.SystemContext...), c.System)
+    }
+    if c.summary != "" {
+        p.SystemContext = append(append([]string{}, p.SystemContext...), "Summary of the earlier conversation: "+c.summary)
+    }
+    p.History = c.messages[start:]
+    return p
+}
+
+// assembleTurn picks the history for the next turn so its estimated input
+// fits the budget, applying the conversation's history policy. Turns taken
+// out of the window stay out and are recorded on the conversation.
+func (cs *ConversationStore) assembleTurn(ctx context.Context, bc *BedrockClient, c *Conversation, base GenerationParams, now time.Time) (*turnPlan, error) {
+    cs.mu.Lock()
+    start := c.windowStart
+    if c.Budget.HistoryPolicy == historyKeepLast && len(c.messages)-2*c.Budget.KeepLast > start {
+        start = len(c.messages) - 2*c.Budget.KeepLast
+    }
+    messages := c.messages
+    cs.mu.Unlock()
+
+    // Every model costs roughly the same here, so estimate with the messages API layout
+    cost := func(start int) int {
+        cs.mu.Lock()
+        defer cs.mu.Unlock()
+        return estimateInputTokens(ModelInfo{API: apiMessages}, c.paramsLocked(base, start))
+    }
+    // Drop whole user/assistant pairs so the history always opens with a user turn
+    fit := func(start int) int {
+        for start < len(messages) && cost(start) > c.Budget.MaxInputTokens {
+            start += 2
+        }
+        return start
+    }
+
+    start = fit(start)
+    event := HistoryEvent{Turn: c.turns + 1, Policy: c.Budget.HistoryPolicy, At: now}
+    if dropped := messages[c.windowStart:start]; len(dropped) > 0 && c.Budget.HistoryPolicy == historySummarize {
+        summary, err := bc.summarizeHistory(ctx, c.summary, dropped)
+        if err != nil {
+            logWarnf(ctx, "Summarizing %d messages of conversation %s failed, dropping them: %v", len(dropped), c.ID, err)
+            metrics.Inc("conversation_summaries_total", "outcome", "error")
+        } else {
+            cs.mu.Lock()
+            c.summary = summary
+            cs.mu.Unlock()
+            event.Summarized = true
+            metrics.Inc("conversation_summaries_total", "outcome", "success")
+            // A longer summary can push the turn back over budget
+            start = fit(start)
+        }
+    }
+
+    input := cost(start)
+    if input > c.Budget.MaxInputTokens {
+        return nil, errTurnOverBudget
+    }
+
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+
+    event.DroppedMessages = start - c.windowStart
+    event.DroppedTokens = estimateHistoryTokens(c.messages[c.windowStart:start])
+    if event.DroppedMessages > 0 {
+        c.events = append(c.events, event)
+        metrics.Add("conversation_dropped_messages_total", float64(event.DroppedMessages), "policy", event.Policy)
+    }
+    c.windowStart = start
+
+    params := c.paramsLocked(base, start)
+    return &turnPlan{
+        params: params,
+        usage: TurnBudgetUsage{
+            MaxInputTokens:       c.Budget.MaxInputTokens,
+            InputTokens:          input,
+            ReservedOutputTokens: c.Budget.ReservedOutputTokens,
+            Utilization:          float64(input) / float64(c.Budget.MaxInputTokens),
+            HistoryMessages:      len(params.History),
+            DroppedMessages:      event.DroppedMessages,
+            Summarized:           event.Summarized,
+        },
+    }, nil
+}
+
+// summarizeHistory folds messages into the running summary
+func (bc *BedrockClient) summarizeHistory(ctx context.Context, summary string, messages []ChatMessage) (string, error) {
+    var sb strings.Builder
+    sb.WriteString("Write a concise summary of the conversation below for your own later reference. ")
+    sb.WriteString("Keep facts, decisions, names and open questions; drop pleasantries. Reply with the summary only.\n\n")
+    if summary != "" {
+        sb.WriteString("Summary so far:\n" + summary + "\n\n")
+    }
+    sb.WriteString("Conversation:\n")
+    for _, m := range messages {
+        sb.WriteString(m.Role + ": " + m.Content + "\n")
+    }
+
+    text, _, err := bc.GenerateText(ctx, sb.String(), "", summaryMaxTokens, 0.2)
+    if err != nil {
+        return "", err
+    }
+    return strings.TrimSpace(text), nil
+}
+
+// appendTurn records a completed exchange
+func (cs *ConversationStore) appendTurn(c *Conversation, prompt, response string, now time.Time) int {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    c.messages = append(c.messages,
+        ChatMessage{Role: roleUser, Content: prompt},
+        ChatMessage{Role: roleAssistant, Content: response})
+    c.turns++
+    c.lastActive = now
+    return c.turns
+}
+
+// ConversationInfo describes a conversation; the transcript itself is not included
+type ConversationInfo struct {
+    ConversationID string         `json:"conversation_id"`
+    Model          string         `json:"model,omitempty"`
+    Budget         TurnBudget     `json:"budget"`
+    Turns          int            `json:"turns"`
+    Messages       int            `json:"messages"`
+    WindowMessages int            `json:"window_messages"` // Messages still sent to the model
+    Summarized     bool           `json:"summarized"`
+    HistoryEvents  []HistoryEvent `json:"history_events,omitempty"`
+    CreatedAt      time.Time      `json:"created_at"`
+    LastActive     time.Time      `json:"last_active"`
+    Warnings       []string       `json:"warnings,omitempty"` // On creation only, see params.go
+}
+
+func (cs *ConversationStore) Info(c *Conversation) ConversationInfo {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    return ConversationInfo{
+        ConversationID: c.ID,
+        Model:          c.Model,
+        Budget:         c.Budget,
+        Turns:          c.turns,
+        Messages:       len(c.messages),
+        WindowMessages: len(c.messages) - c.windowStart,
+        Summarized:     c.summary != "",
+        HistoryEvents:  append([]HistoryEvent(nil), c.events...),
+        CreatedAt:      c.CreatedAt,
+        LastActive:     c.lastActive,
+    }
+}
+
+// CreateConversationRequest is the body of POST /conversations. Budget
+// fields left unset take the configured defaults.
+type CreateConversationRequest struct {
+    Model                string `json:"model,omitempty"`
+    System               string `json:"system,omitempty"`
+    MaxInputTokens       int    `json:"max_input_tokens,omitempty"`
+    ReservedOutputTokens int    `json:"reserved_output_tokens,omitempty"`
+    HistoryPolicy        string `json:"history_policy,omitempty"`
+    KeepLast             int    `json:"keep_last,omitempty"`
+}
+
+// budget merges the request over the defaults
+func (req *CreateConversationRequest) budget(defaults TurnBudget) TurnBudget {
+    b := defaults
+    if req.MaxInputTokens != 0 {
+        b.MaxInputTokens = req.MaxInputTokens
+    }
+    if req.ReservedOutputTokens != 0 {
+        b.ReservedOutputTokens = req.ReservedOutputTokens
+    }
+    if req.HistoryPolicy != "" && req.HistoryPolicy != b.HistoryPolicy {
+        b.HistoryPolicy = req.HistoryPolicy
+        b.KeepLast = 0
+    }
+    if req.KeepLast != 0 {
+        b.KeepLast = req.KeepLast
+    }
+    return b
+}
+
+func createConversationHandler(bc *BedrockClient, cs *ConversationStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req CreateConversationRequest
+
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+
+        budget := req.budget(cs.cfg.Defaults)
+        if budget.HistoryPolicy == historyKeepLast && budget.KeepLast == 0 {
+            budget.KeepLast = 10
+        }
+        if err := budget.validate(); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, err.Error())
+            return
+        }
+
+        reqParams := resolveRequestParams(r, paramValues{Model: req.Model})
+        window, modelName, ok := bc.modelWindow(reqParams.Model.Value)
+        if !ok {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: fmt.Sprintf("Unknown model %q", reqParams.Model.Value),
+                Fields:  []FieldError{{Field: "model", Message: "must be a configured model ID or name"}},
+            })
+            return
+        }
+        if total := budget.MaxInputTokens + budget.ReservedOutputTokens; total > window {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation,
+                fmt.Sprintf("max_input_tokens plus reserved_output_tokens (%d) exceeds the %d token window of %s", total, window, modelName))
+            return
+        }
+
+        c := &Conversation{
+            Owner:  contextOwner(principalFrom(r.Context())),
+            Model:  reqParams.Model.Value,
+            System: req.System,
+            Budget: budget,
+        }
+        if err := cs.Create(c, time.Now()); err != nil {
+            writeError(w, r, http.StatusConflict, ErrCodeUnprocessable, err.Error())
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusCreated)
+        info := cs.Info(c)
+        info.Warnings = reqParams.Warnings
+        json.NewEncoder(w).Encode(info)
+    }
+}
+
+func getConversationHandler(cs *ConversationStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        c, ok := cs.Get(contextOwner(principalFrom(r.Context())), mux.Vars(r)["id"], time.Now())
+        if !ok {
+            writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Conversation not found")
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(cs.Info(c))
+    }
+}
+
+// ConversationTurnRequest is the body of POST /conversations/{id}/turns
+type ConversationTurnRequest struct {
+    Prompt      string  `json:"prompt"`
+    Temperature *float64 `json:"temperature,omitempty"` // Omitted for the default; 0 is greedy decoding
+    UserID      string   `json:"user_id,omitempty"`     // End user, for experiment assignment
+}
+
+// ConversationTurnResponse is a generate response for one turn
+type ConversationTurnResponse struct {
+    ConversationID string `json:"conversation_id"`
+    Turn           int    `json:"turn"`
+    GenerateResponse
+}
+
+func conversationTurnHandler(bc *BedrockClient, cs *ConversationStore, systemContext *SystemContext, experiments *Experiments) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req ConversationTurnRequest
+
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+        if req.Prompt == "" {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: "Prompt is required",
+                Fields:  []FieldError{{Field: "prompt", Message: "is required"}},
+            })
+            return
+        }
+        if apiErr := (&GenerateRequest{Temperature: req.Temperature}).checkSampling(); apiErr != nil {
+            writeAPIError(w, r, http.StatusBadRequest, *apiErr)
+            return
+        }
+
+        reqParams := resolveRequestParams(r, paramValues{})
+        loc, err := systemContext.ResolveLocation(reqParams.Timezone)
+        if err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, err.Error())
+            return
+        }
+
+        c, ok := cs.Get(contextOwner(principalFrom(r.Context())), mux.Vars(r)["id"], time.Now())
+        if !ok {
+            writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Conversation not found")
+            return
+        }
+
+        c.turnMu.Lock()
+        defer c.turnMu.Unlock()
+
+        plan, err := cs.assembleTurn(r.Context(), bc, c, GenerationParams{
+            Prompt:        req.Prompt,
+            Temperature:   req.Temperature,
+            SystemContext: systemContext.Lines(time.Now(), loc, true),
+            Origin:        originUser,
+            Record:        requestRecordFrom(r.Context()),
+        }, time.Now())
+        if err != nil {
+            writeAPIError(w, r, http.StatusRequestEntityTooLarge, APIError{
+                Code:    ErrCodeValidation,
+                Message: err.Error(),
+                Fields:  []FieldError{{Field: "prompt", Message: fmt.Sprintf("must fit within %d input tokens", c.Budget.MaxInputTokens)}},
+            })
+            return
+        }
+
+        // Variants may change the model and prompt but not exceed the reserved output
+        assignments := experiments.Apply(ExperimentUnit{UserID: req.UserID, ConversationID: c.ID}, &plan.params)
+        plan.params.MaxTokens = min(plan.params.MaxTokens, c.Budget.ReservedOutputTokens)
+
+        started := time.Now()
+        result, err := bc.Generate(r.Context(), plan.params)
+        if isCancelled(err) {
+            metrics.Inc("conversation_turns_total", "outcome", "cancelled")
+            logInfof(r.Context(), "Turn for conversation %s cancelled by the client", c.ID)
+            status, apiErr := generationErrorResponse(err)
+            writeAPIError(w, r, status, apiErr)
+            return
+        }
+        experimentResult := ExperimentResult{Latency: time.Since(started), Failed: err != nil}
+        if err == nil {
+            experimentResult.InputTokens, experimentResult.OutputTokens = result.InputTokens, result.OutputTokens
+        }
+        experiments.Record(assignments, experimentResult)
+        if err != nil {
+            callerUsage.Record(r.Context(), "", 0, 0, true)
+            metrics.Inc("conversation_turns_total", "outcome", "error")
+            logErrorf(r.Context(), "Error generating turn for conversation %s: %v", c.ID, err)
+            status, apiErr := generationErrorResponse(err)
+            writeAPIError(w, r, status, apiErr)
+            return
+        }
+        metrics.Inc("conversation_turns_total", "outcome", "success")
+        callerUsage.Record(r.Context(), result.ModelID, result.InputTokens, result.OutputTokens, false)
+        classifyRefusal(result)
+
+        // A reply cut off at the reserved output ran into the conversation's
+        // budget rather than the caller's own max_tokens
+        if result.FinishReason == finishLengthCapped && plan.params.MaxTokens == c.Budget.ReservedOutputTokens {
+            result.FinishReason = finishBudget
+        }
+        metrics.Inc("generate_finish_reasons_total", "model", result.ModelID, "finish_reason", result.FinishReason)
+
+        // Filtered output is not part of the transcript, so the next turn
+        // won't see an empty assistant reply
+        turn := c.turns + 1
+        if result.FinishReason != finishFiltered {
+            turn = cs.appendTurn(c, req.Prompt, result.Text, time.Now())
+        }
+
+        // The transcript keeps what the model said; only the reply is standardized
+        response, refusalReplaced := refusalText(result.Text, result.Refused, principalFrom(r.Context()).Policy)
+
+        turnResponse := ConversationTurnResponse{
+            ConversationID: c.ID,
+            Turn:           turn,
+            GenerateResponse: GenerateResponse{
+                Response:  response,
+                ModelUsed: result.ModelName,
+                Meta: &ResponseMeta{
+                    ModelID:         result.ModelID,
+                    Account:         result.Account,
+                    RefusalReplaced: refusalReplaced,
+                    Budget:          &plan.usage,
+                    Experiments:     assignments,
+                    Warnings:        reqParams.Warnings,
+                },
+                FinishReason:    result.FinishReason,
+                FinishReasonRaw: result.FinishReasonRaw,
+                Filtered:        result.Filtered,
+                FilterCategory:  result.FilterCategory,
+                Refused:         result.Refused,
+                RefusalCategory: result.RefusalCategory,
+            },
+        }
+        turnResponse.setUsage(result)
+        writeJSON(w, r, turnResponse)
+    }
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime/document"
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// usesConverse reports whether a generation goes through the Converse API.
+// Features Converse doesn't cover in this SDK version keep the request on
+// InvokeModel: cache_control on the stored prefix and tools.
+func usesConverse(model ModelInfo, p GenerationParams) bool {
+    return model.Converse && !(p.PromptCache && p.ContextPrefix != "") && len(p.Tools) == 0
+}
+
+// buildConverseInput is buildRequestBody for the Converse API
+func buildConverseInput(model ModelInfo, p GenerationParams) *bedrockruntime.ConverseInput {
+    messages := make([]types.Message, 0, len(p.History)+1)
+    for _, m := range append(p.History[:len(p.History):len(p.History)], p.turn()) {
+        role := types.ConversationRoleUser
+        if m.Role == roleAssistant {
+            role = types.ConversationRoleAssistant
+        }
+        messages = append(messages, types.Message{Role: role, Content: converseContent(m)})
+    }
+    if len(p.Documents) > 0 {
+        last := &messages[len(messages)-1]
+        last.Content = append(converseDocuments(p.Documents), last.Content...)
+    }
+
+    var system []types.SystemContentBlock
+    if p.ContextPrefix != "" {
+        system = append(system, &types.SystemContentBlockMemberText{Value: p.ContextPrefix})
+    }
+    if text := p.systemPrompt(defaultSystemPrompt); text != "" {
+        system = append(system, &types.SystemContentBlockMemberText{Value: text})
+    }
+
+    input := &bedrockruntime.ConverseInput{
+        ModelId:  aws.String(model.invokeID()),
+        Messages: messages,
+        System:   system,
+        InferenceConfig: &types.InferenceConfiguration{
+            MaxTokens:   aws.Int32(int32(p.MaxTokens)),
+            Temperature: aws.Float32(float32(*p.Temperature)),
+        },
+        GuardrailConfig: p.Guardrail.converseConfig(),
+    }
+    if p.TopP != nil {
+        input.InferenceConfig.TopP = aws.Float32(float32(*p.TopP))
+    }
+    if p.TopK != nil {
+        // Converse has no top_k of its own; it is passed to the model as is
+        input.AdditionalModelRequestFields = document.NewLazyDocument(map[string]interface{}{"top_k": *p.TopK})
+    }
+    if len(p.StopSequences) > 0 {
+        input.InferenceConfig.StopSequences = p.StopSequences
+        // Converse only says a stop sequence matched, not which; the model's
+        // own field says which
+        input.AdditionalModelResponseFieldPaths = []string{"/stop_sequence"}
+    }
+    return input
+}
+
+// Converse is InvokeModel for the Converse API, with the same throttle
+// handling across accounts and retries
+func (p *AccountPool) Converse(ctx context.Context, origin Origin, input *bedrockruntime.ConverseInput) (*bedrockruntime.ConverseOutput, *Account, error) {
+    if err := origin.check(); err != nil {
+        return nil, nil, err
+    }
+    defer load.Begin()()
+    tried := make(map[*Account]bool)
+    retries := 0
+
+    for {
+        account := p.pick(tried)
+        if account == nil {
+            return nil, nil, fmt.Errorf("no Bedrock accounts configured")
+        }
+        tried[account] = true
+
+        started := time.Now()
+        resp, err := account.client.Converse(ctx, input)
+        observeInvocation(ctx, aws.ToString(input.ModelId), started, err)
+        if err == nil {
+            metrics.Inc("bedrock_account_invocations_total", "account", account.Name, "origin", string(origin), "outcome", "success")
+            metrics.Inc("bedrock_model_invocations_total", "model", aws.ToString(input.ModelId), "origin", string(origin), "outcome", "success")
+            var inputTokens, outputTokens int
+            if resp.Usage != nil {
+                inputTokens, outputTokens = int(aws.ToInt32(resp.Usage.InputTokens)), int(aws.ToInt32(resp.Usage.OutputTokens))
+            }
+            recordInvocationTokens(origin, aws.ToString(input.ModelId), inputTokens, outputTokens)
+            return resp, account, nil
+        }
+
+        if p.retryAfter(ctx, origin, aws.ToString(input.ModelId), account, err, tried, &retries) {
+            continue
+        }
+        metrics.Inc("bedrock_model_invocations_total", "model", aws.ToString(input.ModelId), "origin", string(origin), "outcome", failureOutcome(err))
+        return nil, account, err
+    }
+}
+
+// converse runs one attempt through the Converse API. The result is read
+// from the typed output, so there is no response schema to drift.
+func (bc *BedrockClient) converse(ctx context.Context, model ModelInfo, p GenerationParams) (*GenerationResult, *Account, error) {
+    started := time.Now()
+    resp, account, err := bc.accounts.Converse(ctx, p.Origin, buildConverseInput(model, p))
+    latency := time.Since(started)
+    if err != nil {
+        return nil, account, err
+    }
+
+    result := &GenerationResult{ModelName: model.Name, ModelID: model.ID, Account: account.Name, Sampling: p.sampling(), Latency: latency}
+    result.FinishReasonRaw = string(resp.StopReason)
+    result.FinishReason = normalizeFinishReason(providerConverse, result.FinishReasonRaw)
+    if resp.Usage != nil {
+        result.InputTokens, result.OutputTokens = int(aws.ToInt32(resp.Usage.InputTokens)), int(aws.ToInt32(resp.Usage.OutputTokens))
+    }
+    if resp.StopReason == types.StopReasonStopSequence && resp.AdditionalModelResponseFields != nil {
+        var fields struct {
+            StopSequence string `json:"stop_sequence"`
+        }
+        if err := resp.AdditionalModelResponseFields.UnmarshalSmithyDocument(&fields); err == nil {
+            result.StopSequence = matchedStopSequence(p.StopSequences, fields.StopSequence)
+        }
+    }
+
+    if p.Guardrail != nil && p.Guardrail.Trace && resp.Trace != nil && resp.Trace.Guardrail != nil {
+        result.GuardrailTrace = resp.Trace.Guardrail
+    }
+
+    var text []string
+    if message, ok := resp.Output.(*types.ConverseOutputMemberMessage); ok {
+        for _, block := range message.Value.Content {
+            if t, ok := block.(*types.ContentBlockMemberText); ok {
+                text = append(text, t.Value)
+            }
+        }
+    }
+    result.Text = strings.Join(text, "")
+
+    // As with InvokeModel, a guardrail that intervened leaves its blocked
+    // message or masked output where the model's text would be
+    switch resp.StopReason {
+    case types.StopReasonContentFiltered:
+        result.Filtered, result.FilterCategory, result.Text = true, filterContent, ""
+        return result, account, nil
+    case types.StopReasonGuardrailIntervened:
+        result.Filtered, result.FilterCategory = true, filterGuardrail
+        return result, account, nil
+    }
+    if len(text) == 0 {
+        return nil, account, fmt.Errorf("unexpected response format from model %s", model.Name)
+    }
+    return result, account, nil
+}
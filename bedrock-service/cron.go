@@ -0,0 +1,166 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// cronMacros are the shorthand schedules accepted in place of five fields
+var cronMacros = map[string]string{
+    "@yearly":  "0 0 1 1 *",
+    "@monthly": "0 0 1 * *",
+    "@weekly":  "0 0 * * 0",
+    "@daily":   "0 0 * * *",
+    "@hourly":  "0 * * * *",
+}
+
+var cronMonthNames = map[string]int{
+    "jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+    "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronDayNames = map[string]int{
+    "sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// cronSpec is a parsed five-field cron expression (minute, hour, day of
+// month, month, day of week) evaluated in a fixed time zone
+type cronSpec struct {
+    minute, hour, dom, month, dow uint64 // Bit n set when value n matches
+    domStar, dowStar              bool
+    loc                           *time.Location
+}
+
+// parseCron parses a standard five-field expression or macro, optionally
+// prefixed with "CRON_TZ=<IANA zone> " to evaluate it outside UTC
+func parseCron(expr string) (*cronSpec, error) {
+    spec := &cronSpec{loc: time.UTC}
+    expr = strings.TrimSpace(expr)
+    if strings.HasPrefix(expr, "CRON_TZ=") || strings.HasPrefix(expr, "TZ=") {
+        zone, rest, _ := strings.Cut(expr, " ")
+        _, name, _ := strings.Cut(zone, "=")
+        loc, err := time.LoadLocation(name)
+        if err != nil {
+            return nil, fmt.Errorf("unknown time zone %q", name)
+        }
+        spec.loc, expr = loc, strings.TrimSpace(rest)
+    }
+    if macro, ok := cronMacros[expr]; ok {
+        expr = macro
+    }
+
+    fields := strings.Fields(expr)
+    if len(fields) != 5 {
+        return nil, fmt.Errorf("expected 5 fields (minute hour day-of-month month day-of-week), got %d", len(fields))
+    }
+
+    var err error
+    if spec.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+        return nil, fmt.Errorf("minute: %v", err)
+    }
+    if spec.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+        return nil, fmt.Errorf("hour: %v", err)
+    }
+    if spec.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+        return nil, fmt.Errorf("day of month: %v", err)
+    }
+    if spec.month, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+        return nil, fmt.Errorf("month: %v", err)
+    }
+    if spec.dow, err = parseCronField(fields[4], 0, 7, cronDayNames); err != nil {
+        return nil, fmt.Errorf("day of week: %v", err)
+    }
+    if spec.dow&(1<<7) != 0 {
+        spec.dow |= 1 // 7 is Sunday too
+    }
+    spec.domStar = strings.HasPrefix(fields[2], "*")
+    spec.dowStar = strings.HasPrefix(fields[4], "*")
+    return spec, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+    var bits uint64
+    for _, part := range strings.Split(field, ",") {
+        rangePart, stepPart, hasStep := strings.Cut(part, "/")
+        step := 1
+        if hasStep {
+            n, err := strconv.Atoi(stepPart)
+            if err != nil || n < 1 {
+                return 0, fmt.Errorf("invalid step %q", stepPart)
+            }
+            step = n
+        }
+
+        lo, hi := min, max
+        if rangePart != "*" {
+            first, last, isRange := strings.Cut(rangePart, "-")
+            var err error
+            if lo, err = parseCronValue(first, min, max, names); err != nil {
+                return 0, err
+            }
+            hi = lo
+            if isRange {
+                if hi, err = parseCronValue(last, min, max, names); err != nil {
+                    return 0, err
+                }
+            } else if hasStep {
+                hi = max
+            }
+            if hi < lo {
+                return 0, fmt.Errorf("range %q is backwards", rangePart)
+            }
+        }
+        for v := lo; v <= hi; v += step {
+            bits |= 1 << uint(v)
+        }
+    }
+    return bits, nil
+}
+
+func parseCronValue(s string, min, max int, names map[string]int) (int, error) {
+    if v, ok := names[strings.ToLower(s)]; ok {
+        return v, nil
+    }
+    v, err := strconv.Atoi(s)
+    if err != nil || v < min || v > max {
+        return 0, fmt.Errorf("value %q must be between %d and %d", s, min, max)
+    }
+    return v, nil
+}
+
+// dayMatches applies the cron rule that when both day fields are
+// restricted, either one matching is enough
+func (c *cronSpec) dayMatches(t time.Time) bool {
+    dom := c.dom&(1<<uint(t.Day())) != 0
+    dow := c.dow&(1<<uint(t.Weekday())) != 0
+    if c.domStar || c.dowStar {
+        return dom && dow
+    }
+    return dom || dow
+}
+
+// Next returns the first matching minute strictly after t, or the zero time
+// if the expression never matches (e.g. "0 0 30 2 *"). Local times skipped
+// by a daylight saving change don't fire that day.
+func (c *cronSpec) Next(t time.Time) time.Time {
+    t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+    limit := t.AddDate(5, 0, 0)
+    for t.Before(limit) {
+        switch {
+        case c.month&(1<<uint(t.Month())) == 0:
+            t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+        case !c.dayMatches(t):
+            t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+        case c.hour&(1<<uint(t.Hour())) == 0:
+            t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.loc)
+        case c.minute&(1<<uint(t.Minute())) == 0:
+            t = t.Add(time.Minute)
+        default:
+            return t
+        }
+    }
+    return time.Time{}
+}
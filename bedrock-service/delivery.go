@@ -0,0 +1,260 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/config"
+    "github.com/aws/aws-sdk-go-v2/service/s3"
+    "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Delivery modes accepted in the "deliver" request field
+const (
+    deliverInline = "inline"
+    deliverS3     = "s3"
+)
+
+// maxPresignExpiry is the longest a SigV4 presigned URL can be valid for
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// ResultStoreConfig controls out-of-band delivery of large results
+type ResultStoreConfig struct {
+    Bucket         string        // Empty disables "deliver": "s3"
+    Prefix         string        // Key prefix; objects go under <prefix>YYYY/MM/DD/
+    URLExpiry      time.Duration // Lifetime of the presigned GET URL
+    InlineMaxBytes int           // Largest payload returned inline when an upload fails
+}
+
+// LoadResultStoreConfig reads RESULTS_BUCKET, RESULTS_PREFIX,
+// RESULTS_URL_EXPIRY_MINUTES and RESULTS_INLINE_MAX_BYTES
+func LoadResultStoreConfig() (ResultStoreConfig, error) {
+    cfg := ResultStoreConfig{
+        Bucket:         os.Getenv("RESULTS_BUCKET"),
+        Prefix:         "results/",
+        URLExpiry:      time.Hour,
+        InlineMaxBytes: 1 << 20,
+    }
+
+    if v, ok := os.LookupEnv("RESULTS_PREFIX"); ok {
+        cfg.Prefix = strings.TrimLeft(v, "/")
+        if cfg.Prefix != "" && !strings.HasSuffix(cfg.Prefix, "/") {
+            cfg.Prefix += "/"
+        }
+    }
+    if v := os.Getenv("RESULTS_URL_EXPIRY_MINUTES"); v != "" {
+        minutes, err := strconv.Atoi(v)
+        if err != nil || minutes < 1 || time.Duration(minutes)*time.Minute > maxPresignExpiry {
+            return cfg, fmt.Errorf("invalid RESULTS_URL_EXPIRY_MINUTES %q", v)
+        }
+        cfg.URLExpiry = time.Duration(minutes) * time.Minute
+    }
+    if v := os.Getenv("RESULTS_INLINE_MAX_BYTES"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            return cfg, fmt.Errorf("invalid RESULTS_INLINE_MAX_BYTES %q", v)
+        }
+        cfg.InlineMaxBytes = n
+    }
+    return cfg, nil
+}
+
+// ResultStore uploads response bodies to S3 and hands out presigned URLs
+type ResultStore struct {
+    cfg     ResultStoreConfig
+    client  *s3.Client
+    presign *s3.PresignClient
+}
+
+// NewResultStore returns nil when no bucket is configured. The bucket uses
+// the default AWS credential chain, not the Bedrock account pool.
+func NewResultStore(cfg ResultStoreConfig, region string) (*ResultStore, error) {
+    if cfg.Bucket == "" {
+        return nil, nil
+    }
+    awsCfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(region))
+    if err != nil {
+        return nil, fmt.Errorf("unable to load SDK config for results bucket: %v", err)
+    }
+    client := s3.NewFromConfig(awsCfg)
+    log.Printf("Large results can be delivered via s3://%s/%s (URLs valid %v)", cfg.Bucket, cfg.Prefix, cfg.URLExpiry)
+    return &ResultStore{cfg: cfg, client: client, presign: s3.NewPresignClient(client)}, nil
+}
+
+// Check is the bucket's readiness check
+func (rs *ResultStore) Check(ctx context.Context) error {
+    _, err := rs.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(rs.cfg.Bucket)})
+    return err
+}
+
+// ResultDelivery is returned in place of the response body with "deliver": "s3"
+type ResultDelivery struct {
+    Delivery  string    `json:"delivery"`
+    URL       string    `json:"url"`
+    Key       string    `json:"key"`
+    SizeBytes int       `json:"size_bytes"`
+    SHA256    string    `json:"sha256"` // Hex digest of the object
+    ExpiresAt time.Time `json:"expires_at"`
+}
+
+// checkDeliver validates the "deliver" field of a request
+func checkDeliver(mode string, store *ResultStore) error {
+    switch mode {
+    case "", deliverInline:
+        return nil
+    case deliverS3:
+        if store == nil {
+            return fmt.Errorf("deliver %q is not available: no results bucket is configured", mode)
+        }
+        return nil
+    }
+    return fmt.Errorf("deliver must be %q or %q", deliverInline, deliverS3)
+}
+
+// resultKey partitions objects by UTC date so bucket lifecycle rules can
+// expire old results by prefix
+func (rs *ResultStore) resultKey(id string, now time.Time) string {
+    return now.UTC().Format("2006/01/02") + "/" + id + ".json"
+}
+
+// Put uploads a JSON payload and returns its presigned download envelope
+func (rs *ResultStore) Put(ctx context.Context, id string, payload []byte, now time.Time) (*ResultDelivery, error) {
+    return rs.PutKey(ctx, rs.resultKey(id, now), payload, now)
+}
+
+// PutKey is Put with the object key, relative to the configured prefix,
+// chosen by the caller
+func (rs *ResultStore) PutKey(ctx context.Context, name string, payload []byte, now time.Time) (*ResultDelivery, error) {
+    return rs.PutObject(ctx, name, "application/json", payload, now)
+}
+
+// PutObject is PutKey for a payload of any content type
+func (rs *ResultStore) PutObject(ctx context.Context, name, contentType string, payload []byte, now time.Time) (*ResultDelivery, error) {
+    sum := sha256.Sum256(payload)
+    key := rs.cfg.Prefix + name
+
+    _, err := rs.client.PutObject(ctx, &s3.PutObjectInput{
+        Bucket:         aws.String(rs.cfg.Bucket),
+        Key:            aws.String(key),
+        Body:           bytes.NewReader(payload),
+        ContentType:    aws.String(contentType),
+        ChecksumSHA256: aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+    })
+    if err != nil {
+        return nil, fmt.Errorf("error uploading result: %v", err)
+    }
+
+    presigned, err := rs.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+        Bucket: aws.String(rs.cfg.Bucket),
+        Key:    aws.String(key),
+    }, s3.WithPresignExpires(rs.cfg.URLExpiry))
+    if err != nil {
+        return nil, fmt.Errorf("error presigning result URL: %v", err)
+    }
+
+    return &ResultDelivery{
+        Delivery:  deliverS3,
+        URL:       presigned.URL,
+        Key:       key,
+        SizeBytes: len(payload),
+        SHA256:    hex.EncodeToString(sum[:]),
+        ExpiresAt: now.Add(rs.cfg.URLExpiry).UTC(),
+    }, nil
+}
+
+// SweepExpired deletes result objects last modified before cutoff, one
+// listing page at a time
+func (rs *ResultStore) SweepExpired(ctx context.Context, cutoff time.Time, cursor string, limit int, dryRun bool, rep *RetentionReport) (string, error) {
+    input := &s3.ListObjectsV2Input{
+        Bucket:  aws.String(rs.cfg.Bucket),
+        Prefix:  aws.String(rs.cfg.Prefix),
+        MaxKeys: aws.Int32(int32(limit)),
+    }
+    if cursor != "" {
+        input.StartAfter = aws.String(cursor)
+    }
+    out, err := rs.client.ListObjectsV2(ctx, input)
+    if err != nil {
+        return cursor, fmt.Errorf("error listing results: %v", err)
+    }
+
+    var expired []types.ObjectIdentifier
+    var written []time.Time
+    for _, obj := range out.Contents {
+        key := aws.ToString(obj.Key)
+        if strings.HasPrefix(key, rs.cfg.Prefix+retentionLeaseDir) || obj.LastModified == nil || !obj.LastModified.Before(cutoff) {
+            continue
+        }
+        expired = append(expired, types.ObjectIdentifier{Key: obj.Key})
+        written = append(written, *obj.LastModified)
+    }
+    if !dryRun && len(expired) > 0 {
+        resp, err := rs.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+            Bucket: aws.String(rs.cfg.Bucket),
+            Delete: &types.Delete{Objects: expired, Quiet: aws.Bool(true)},
+        })
+        if err != nil {
+            return cursor, fmt.Errorf("error deleting results: %v", err)
+        }
+        if len(resp.Errors) > 0 {
+            // Retried from the same cursor next sweep
+            return cursor, fmt.Errorf("error deleting %d results, first %s: %s", len(resp.Errors), aws.ToString(resp.Errors[0].Key), aws.ToString(resp.Errors[0].Message))
+        }
+    }
+    for _, t := range written {
+        rep.add(t)
+    }
+
+    if !aws.ToBool(out.IsTruncated) || len(out.Contents) == 0 {
+        return "", nil
+    }
+    return aws.ToString(out.Contents[len(out.Contents)-1].Key), nil
+}
+
+// writeDelivered uploads v and writes the delivery envelope. When the upload
+// fails, payloads small enough to send inline are sent inline instead (marked
+// with X-Delivery: inline) and anything larger is an error.
+func writeDelivered(w http.ResponseWriter, r *http.Request, rs *ResultStore, v interface{}) {
+    payload, err := json.Marshal(v)
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "Error encoding result")
+        return
+    }
+
+    id := requestIDFrom(r.Context())
+    if id == "" {
+        id = newRequestID()
+    }
+    delivery, err := rs.Put(r.Context(), id, payload, time.Now())
+    if err != nil {
+        logWarnf(r.Context(), "Result delivery to s3://%s failed (%d bytes): %v", rs.cfg.Bucket, len(payload), err)
+        if len(payload) > rs.cfg.InlineMaxBytes {
+            metrics.Inc("result_deliveries_total", "outcome", "error")
+            writeError(w, r, http.StatusBadGateway, ErrCodeDeliveryFailed,
+                fmt.Sprintf("Result of %d bytes could not be uploaded and is too large to return inline", len(payload)))
+            return
+        }
+        metrics.Inc("result_deliveries_total", "outcome", "inline_fallback")
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("X-Delivery", deliverInline)
+        w.Write(payload)
+        return
+    }
+
+    metrics.Inc("result_deliveries_total", "outcome", "s3")
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("X-Delivery", deliverS3)
+    json.NewEncoder(w).Encode(delivery)
+}
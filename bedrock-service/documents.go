@@ -0,0 +1,577 @@
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "compress/zlib"
+    "encoding/base64"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "html"
+    "io"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// A generation can carry files for the model to read:
+//
+//    "documents": [{"name": "Q3 report", "format": "pdf", "data": "<base64>"}]
+//
+// The registry's document models get them as Converse document blocks in
+// the final turn. Every other model, and a document model the request
+// reaches through InvokeModel, gets the text extracted from them here ahead
+// of the prompt instead. meta.documents says which it was. A document with
+// no text to extract, like a scanned PDF, skips the models that can't read
+// it natively. REQUEST_MAX_BODY_BYTES bounds the whole request first, so it
+// needs raising to attach all Bedrock allows.
+
+// How a generation's documents reached the model, meta.documents
+const (
+    documentsNative    = "native"
+    documentsExtracted = "text_extraction"
+)
+
+// Bedrock's limits on the documents of one request
+const (
+    maxDocuments     = 5
+    maxDocumentBytes = 4500000 // Per document, decoded
+)
+
+// maxExtractedBytes caps what a compressed part of a document may expand
+// to while its text is extracted
+const maxExtractedBytes = 64 << 20
+
+// documentFormats are the formats documents may have, the ones text can be
+// extracted from here, with the Converse format of each
+var documentFormats = map[string]types.DocumentFormat{
+    "csv":  types.DocumentFormatCsv,
+    "docx": types.DocumentFormatDocx,
+    "html": types.DocumentFormatHtml,
+    "md":   types.DocumentFormatMd,
+    "pdf":  types.DocumentFormatPdf,
+    "txt":  types.DocumentFormatTxt,
+}
+
+// documentNamePattern is the names Bedrock accepts: letters, digits,
+// hyphens, parentheses and square brackets, in words one space apart
+var documentNamePattern = regexp.MustCompile(`^[A-Za-z0-9()\[\]-]+( [A-Za-z0-9()\[\]-]+)*$`)
+
+// errDocumentsUnreadable is why a request skipped a model that would have
+// been given the text of a document with none
+var errDocumentsUnreadable = errors.New("can't read documents with no extractable text")
+
+// DocumentInput is one entry of a request's documents array
+type DocumentInput struct {
+    Name   string `json:"name"`   // Shown to the model, see documentNamePattern
+    Format string `json:"format"` // pdf, docx, html, csv, txt or md
+    Data   string `json:"data"`   // The file, base64
+}
+
+// Document is a checked document, with the text extracted from it
+type Document struct {
+    Name   string `json:"name"`
+    Format string `json:"format"`
+    Data   []byte `json:"data"`
+    Text   string `json:"-"` // Empty when none could be extracted
+}
+
+// documentFormatNames lists the accepted formats, sorted
+func documentFormatNames() []string {
+    names := make([]string, 0, len(documentFormats))
+    for name := range documentFormats {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// documents checks the request's documents and extracts their text. text
+// is the final turn's, which Converse requires alongside documents.
+func (req *GenerateRequest) documents(text string) ([]Document, *APIError) {
+    if len(req.Documents) == 0 {
+        return nil, nil
+    }
+    var problems []FieldError
+    if len(req.Documents) > maxDocuments {
+        problems = append(problems, FieldError{Field: "documents", Message: fmt.Sprintf("lists %d documents, more than %d", len(req.Documents), maxDocuments)})
+    }
+    if strings.TrimSpace(text) == "" {
+        problems = append(problems, FieldError{Field: "documents", Message: "need a prompt with text to go with them"})
+    }
+
+    docs := make([]Document, 0, len(req.Documents))
+    names := make(map[string]int)
+    for i, d := range req.Documents {
+        field := fmt.Sprintf("documents[%d]", i)
+        before := len(problems)
+        name := strings.TrimSpace(d.Name)
+        if name == "" {
+            problems = append(problems, FieldError{Field: field + ".name", Message: "is required"})
+        } else if !documentNamePattern.MatchString(name) {
+            problems = append(problems, FieldError{Field: field + ".name", Message: "may only hold letters, digits, hyphens, parentheses, square brackets and single spaces"})
+        } else if first, dup := names[strings.ToLower(name)]; dup {
+            problems = append(problems, FieldError{Field: field + ".name", Message: fmt.Sprintf("duplicates documents[%d]", first)})
+        } else {
+            names[strings.ToLower(name)] = i
+        }
+
+        format := strings.ToLower(strings.TrimSpace(d.Format))
+        if _, ok := documentFormats[format]; !ok {
+            problems = append(problems, FieldError{Field: field + ".format", Message: "must be one of " + strings.Join(documentFormatNames(), ", ")})
+            continue
+        }
+        data, err := base64.StdEncoding.DecodeString(d.Data)
+        switch {
+        case d.Data == "":
+            problems = append(problems, FieldError{Field: field + ".data", Message: "is required"})
+        case err != nil:
+            problems = append(problems, FieldError{Field: field + ".data", Message: "is not valid base64"})
+        case len(data) > maxDocumentBytes:
+            problems = append(problems, FieldError{Field: field + ".data", Message: fmt.Sprintf("is %d bytes, more than the %d a document may be", len(data), maxDocumentBytes)})
+        }
+        if len(problems) > before {
+            continue
+        }
+        text, err := extractDocumentText(format, data)
+        if err != nil {
+            problems = append(problems, FieldError{Field: field + ".data", Message: "is not a readable " + format + " file: " + err.Error()})
+            continue
+        }
+        docs = append(docs, Document{Name: name, Format: format, Data: data, Text: text})
+    }
+    if len(problems) > 0 {
+        return nil, &APIError{Code: ErrCodeValidation, Message: "Invalid documents", Fields: problems}
+    }
+    return docs, nil
+}
+
+// readsDocuments reports whether model is given the generation's documents
+// natively
+func readsDocuments(model ModelInfo, p GenerationParams) bool {
+    return model.Documents && usesConverse(model, p)
+}
+
+// withDocuments hands the generation's documents to a model: as they are
+// when native, or else as their text ahead of the prompt. It returns how
+// they were given, empty when there are none.
+func (p GenerationParams) withDocuments(native bool) (GenerationParams, string, error) {
+    switch {
+    case len(p.Documents) == 0:
+        return p, "", nil
+    case native:
+        return p, documentsNative, nil
+    }
+    var sb strings.Builder
+    for _, d := range p.Documents {
+        if strings.TrimSpace(d.Text) == "" {
+            return p, "", errDocumentsUnreadable
+        }
+        fmt.Fprintf(&sb, "<document name=%q format=%q>\n%s\n</document>\n", d.Name, d.Format, d.Text)
+    }
+    if p.PromptBlocks != nil {
+        p.PromptBlocks = append([]ContentBlock{{Type: blockText, Text: sb.String()}}, p.PromptBlocks...)
+        p.Prompt = blocksText(p.PromptBlocks)
+    } else {
+        p.Prompt = sb.String() + "\n" + p.Prompt
+    }
+    p.Documents = nil
+    return p, documentsExtracted, nil
+}
+
+// estimateDocumentTokens estimates the tokens of documents given natively
+// by the length of their text
+func estimateDocumentTokens(docs []Document) int {
+    total := 0
+    for _, d := range docs {
+        total += estimateTokens(d.Text)
+    }
+    return total
+}
+
+// converseDocuments is the documents as Converse content blocks
+func converseDocuments(docs []Document) []types.ContentBlock {
+    blocks := make([]types.ContentBlock, 0, len(docs))
+    for _, d := range docs {
+        blocks = append(blocks, &types.ContentBlockMemberDocument{Value: types.DocumentBlock{
+            Format: documentFormats[d.Format],
+            Name:   aws.String(d.Name),
+            Source: &types.DocumentSourceMemberBytes{Value: d.Data},
+        }})
+    }
+    return blocks
+}
+
+// withDocumentContent puts the documents ahead of a messages API content.
+// Only Converse is sent documents, so this is the form the response cache
+// keys on and a dry run shows, laid out as Converse takes them.
+func withDocumentContent(docs []Document, content interface{}) interface{} {
+    if len(docs) == 0 {
+        return content
+    }
+    blocks := make([]map[string]interface{}, 0, len(docs)+1)
+    for _, d := range docs {
+        blocks = append(blocks, map[string]interface{}{
+            "type":   "document",
+            "name":   d.Name,
+            "format": d.Format,
+            "source": map[string]interface{}{"bytes": base64.StdEncoding.EncodeToString(d.Data)},
+        })
+    }
+    if text, ok := content.(string); ok {
+        return append(blocks, map[string]interface{}{"type": "text", "text": text})
+    }
+    return append(blocks, content.([]map[string]interface{})...)
+}
+
+// extractDocumentText is the text of a document in format
+func extractDocumentText(format string, data []byte) (string, error) {
+    switch format {
+    case "pdf":
+        return pdfText(data)
+    case "docx":
+        return docxText(data)
+    }
+    if !utf8.Valid(data) {
+        return "", errors.New("not UTF-8 text")
+    }
+    if format == "html" {
+        return htmlText(string(data)), nil
+    }
+    return strings.TrimSpace(string(data)), nil
+}
+
+var (
+    htmlHidden = regexp.MustCompile(`(?is)<script\b.*?</script>|<style\b.*?</style>|<!--.*?-->`)
+    htmlBreak  = regexp.MustCompile(`(?i)<(br|/p|/div|/li|/tr|/h[1-6]|/title)\b[^>]*>`)
+    htmlTag    = regexp.MustCompile(`<[^>]*>`)
+)
+
+// htmlText is the text an HTML page shows, a line for each block
+func htmlText(page string) string {
+    page = htmlHidden.ReplaceAllString(page, "")
+    page = htmlBreak.ReplaceAllString(page, "\n")
+    page = htmlTag.ReplaceAllString(page, "")
+    return tidyText(html.UnescapeString(page))
+}
+
+// docxText is the text of a Word document's body, a line for each paragraph
+func docxText(data []byte) (string, error) {
+    archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+    if err != nil {
+        return "", errors.New("not a zip archive")
+    }
+    for _, f := range archive.File {
+        if f.Name != "word/document.xml" {
+            continue
+        }
+        if f.UncompressedSize64 > maxExtractedBytes {
+            return "", fmt.Errorf("word/document.xml expands to more than %d bytes", maxExtractedBytes)
+        }
+        rc, err := f.Open()
+        if err != nil {
+            return "", err
+        }
+        defer rc.Close()
+        return wordText(io.LimitReader(rc, maxExtractedBytes))
+    }
+    return "", errors.New("no word/document.xml")
+}
+
+// wordText reads the text runs of a WordprocessingML body
+func wordText(r io.Reader) (string, error) {
+    var sb strings.Builder
+    inText := false
+    decoder := xml.NewDecoder(r)
+    for {
+        token, err := decoder.Token()
+        if err == io.EOF {
+            return tidyText(sb.String()), nil
+        }
+        if err != nil {
+            return "", errors.New("word/document.xml is not valid XML")
+        }
+        switch t := token.(type) {
+        case xml.StartElement:
+            switch t.Name.Local {
+            case "t":
+                inText = true
+            case "tab":
+                sb.WriteByte('\t')
+            case "br", "cr":
+                sb.WriteByte('\n')
+            }
+        case xml.EndElement:
+            switch t.Name.Local {
+            case "t":
+                inText = false
+            case "p":
+                sb.WriteByte('\n')
+            }
+        case xml.CharData:
+            if inText {
+                sb.Write(t)
+            }
+        }
+    }
+}
+
+// pdfSkippedStream matches the dictionaries of streams that hold no page
+// text: images, fonts, cross-reference and object streams, metadata
+var pdfSkippedStream = regexp.MustCompile(`/(Subtype\s*/Image|Length[123]\b|Type\s*/(XRef|ObjStm|Metadata|EmbeddedFile)\b)`)
+
+// pdfText extracts the text a PDF's pages draw with simple fonts. Text in
+// CID fonts or scanned pages doesn't come out, leaving such a PDF with less
+// text or none for the models that read documents natively.
+func pdfText(data []byte) (string, error) {
+    if !bytes.Contains(data[:min(len(data), 1024)], []byte("%PDF-")) {
+        return "", errors.New("no %PDF- header")
+    }
+    var sb strings.Builder
+    rest := data
+    for {
+        start := bytes.Index(rest, []byte("stream"))
+        if start < 0 {
+            break
+        }
+        dict := rest[:start]
+        if obj := bytes.LastIndex(dict, []byte(" obj")); obj >= 0 {
+            dict = dict[obj:]
+        }
+        body := bytes.TrimLeft(rest[start+len("stream"):], "\r\n")
+        end := bytes.Index(body, []byte("endstream"))
+        if end < 0 {
+            break
+        }
+        content := body[:end]
+        rest = body[end+len("endstream"):]
+
+        if pdfSkippedStream.Match(dict) {
+            continue
+        }
+        if bytes.Contains(dict, []byte("/FlateDecode")) {
+            inflated, err := pdfInflate(content)
+            if err != nil {
+                continue
+            }
+            content = inflated
+        } else if bytes.Contains(dict, []byte("/Filter")) {
+            continue
+        }
+        pdfContentText(&sb, content)
+    }
+    return tidyText(sb.String()), nil
+}
+
+// pdfInflate decompresses a FlateDecode stream, keeping what it could read
+// of one cut short
+func pdfInflate(content []byte) ([]byte, error) {
+    r, err := zlib.NewReader(bytes.NewReader(content))
+    if err != nil {
+        return nil, err
+    }
+    defer r.Close()
+    inflated, err := io.ReadAll(io.LimitReader(r, maxExtractedBytes))
+    if err != nil && len(inflated) == 0 {
+        return nil, err
+    }
+    return inflated, nil
+}
+
+// pdfOperand is a string or number awaiting the operator it belongs to
+type pdfOperand struct {
+    text   string
+    number float64
+    isText bool
+}
+
+// pdfContentText writes the text a content stream shows between BT and ET,
+// a line for each line it moves to
+func pdfContentText(sb *strings.Builder, content []byte) {
+    var operands []pdfOperand
+    inText := false
+    for i := 0; i < len(content); {
+        c := content[i]
+        switch {
+        case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0 || c == '[' || c == ']':
+            i++
+        case c == '%':
+            for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+                i++
+            }
+        case c == '(':
+            var text string
+            text, i = pdfLiteral(content, i+1)
+            operands = append(operands, pdfOperand{text: text, isText: true})
+        case c == '<' && i+1 < len(content) && content[i+1] == '<':
+            i += 2
+        case c == '<':
+            var text string
+            text, i = pdfHex(content, i+1)
+            operands = append(operands, pdfOperand{text: text, isText: true})
+        case c == '>':
+            i++
+        default:
+            start := i
+            for i < len(content) && !strings.ContainsRune(" \t\r\n\f\x00()<>[]{}/%", rune(content[i])) {
+                i++
+            }
+            if i == start {
+                i++ // A name's slash, or a brace
+                continue
+            }
+            token := string(content[start:i])
+            if n, err := strconv.ParseFloat(token, 64); err == nil {
+                operands = append(operands, pdfOperand{number: n})
+                continue
+            }
+            switch token {
+            case "BT":
+                inText = true
+            case "ET":
+                inText = false
+                sb.WriteByte('\n')
+            case "Td", "TD":
+                // A move along the same line separates words, not lines
+                if !inText {
+                    break
+                }
+                if len(operands) >= 2 && operands[len(operands)-1].number == 0 {
+                    sb.WriteByte(' ')
+                } else {
+                    sb.WriteByte('\n')
+                }
+            case "T*", "'", "\"":
+                if inText {
+                    sb.WriteByte('\n')
+                }
+            }
+            if inText && (token == "Tj" || token == "TJ" || token == "'" || token == "\"") {
+                for _, op := range operands {
+                    switch {
+                    case op.isText:
+                        sb.WriteString(op.text)
+                    case token == "TJ" && op.number < -200:
+                        sb.WriteByte(' ') // A gap wide enough to be a space
+                    }
+                }
+            }
+            operands = operands[:0]
+        }
+    }
+}
+
+// pdfLiteral reads a literal string from just past its opening parenthesis,
+// returning its text and where it ended
+func pdfLiteral(content []byte, i int) (string, int) {
+    var raw []byte
+    depth := 1
+    for ; i < len(content); i++ {
+        c := content[i]
+        switch {
+        case c == '\\' && i+1 < len(content):
+            i++
+            switch e := content[i]; e {
+            case 'n':
+                raw = append(raw, '\n')
+            case 'r':
+                raw = append(raw, '\r')
+            case 't':
+                raw = append(raw, '\t')
+            case 'b', 'f':
+            case '\r', '\n':
+                // A line continuation
+            default:
+                if e >= '0' && e <= '7' {
+                    n, digits := 0, 0
+                    for ; digits < 3 && i < len(content) && content[i] >= '0' && content[i] <= '7'; digits++ {
+                        n = n*8 + int(content[i]-'0')
+                        i++
+                    }
+                    i--
+                    raw = append(raw, byte(n))
+                } else {
+                    raw = append(raw, e)
+                }
+            }
+        case c == '(':
+            depth++
+            raw = append(raw, c)
+        case c == ')':
+            depth--
+            if depth == 0 {
+                return pdfString(raw), i + 1
+            }
+            raw = append(raw, c)
+        default:
+            raw = append(raw, c)
+        }
+    }
+    return pdfString(raw), i
+}
+
+// pdfHex reads a hex string from just past its opening angle bracket,
+// returning its text and where it ended
+func pdfHex(content []byte, i int) (string, int) {
+    var raw []byte
+    var digits []byte
+    for ; i < len(content) && content[i] != '>'; i++ {
+        if d, err := strconv.ParseUint(string(content[i]), 16, 8); err == nil {
+            digits = append(digits, byte(d))
+        }
+        if len(digits) == 2 {
+            raw = append(raw, digits[0]<<4|digits[1])
+            digits = digits[:0]
+        }
+    }
+    if len(digits) == 1 {
+        raw = append(raw, digits[0]<<4)
+    }
+    return pdfString(raw), i + 1
+}
+
+// pdfString reads the bytes of a string drawn in a simple font as Latin-1.
+// Two-byte CID codes are mostly control bytes that way, and are dropped.
+func pdfString(raw []byte) string {
+    control := 0
+    for _, b := range raw {
+        if b < 0x20 && b != '\t' && b != '\n' && b != '\r' {
+            control++
+        }
+    }
+    if control*3 > len(raw) {
+        return ""
+    }
+    runes := make([]rune, 0, len(raw))
+    for _, b := range raw {
+        if b >= 0x20 || b == '\t' || b == '\n' {
+            runes = append(runes, rune(b))
+        }
+    }
+    return string(runes)
+}
+
+// tidyText trims extracted text's lines and runs of blank lines
+func tidyText(text string) string {
+    var lines []string
+    blank := false
+    for _, line := range strings.Split(text, "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" {
+            blank = len(lines) > 0
+            continue
+        }
+        if blank {
+            lines = append(lines, "")
+            blank = false
+        }
+        lines = append(lines, line)
+    }
+    return strings.Join(lines, "\n")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+    "log"
+    "sort"
+    "sync"
+)
+
+// knownResponseFields are the top-level fields each provider is documented to
+// return. Anything else is counted as schema drift: usually an additive
+// change, but sometimes the first sign of a breaking one.
+var knownResponseFields = map[string]map[string]bool{
+    providerAnthropicMessages: fieldSet("id", "type", "role", "model", "content", "stop_reason", "stop_sequence", "usage",
+        "amazon-bedrock-guardrailAction", "amazon-bedrock-trace", "amazon-bedrock-invocationMetrics"),
+    providerAnthropicLegacy: fieldSet("type", "id", "model", "completion", "stop_reason", "stop",
+        "amazon-bedrock-guardrailAction", "amazon-bedrock-trace", "amazon-bedrock-invocationMetrics"),
+    providerAI21Jamba: fieldSet("id", "model", "choices", "usage", "meta",
+        "amazon-bedrock-guardrailAction", "amazon-bedrock-trace", "amazon-bedrock-invocationMetrics"),
+    providerAmazonTitan: fieldSet("inputTextTokenCount", "results",
+        "amazon-bedrock-guardrailAction", "amazon-bedrock-trace", "amazon-bedrock-invocationMetrics"),
+    providerMistral: fieldSet("outputs", "id", "object", "created", "model", "choices", "usage",
+        "amazon-bedrock-guardrailAction", "amazon-bedrock-trace", "amazon-bedrock-invocationMetrics"),
+    providerCohere: fieldSet("response_id", "text", "generation_id", "chat_history", "finish_reason", "meta",
+        "is_search_required", "search_queries", "documents", "citations", "tool_calls",
+        "amazon-bedrock-guardrailAction", "amazon-bedrock-trace", "amazon-bedrock-invocationMetrics"),
+    providerAmazonNova: fieldSet("output", "stopReason", "usage", "metrics",
+        "amazon-bedrock-guardrailAction", "amazon-bedrock-trace", "amazon-bedrock-invocationMetrics"),
+    providerMetaLlama: fieldSet("generation", "prompt_token_count", "generation_token_count", "stop_reason",
+        "amazon-bedrock-guardrailAction", "amazon-bedrock-trace", "amazon-bedrock-invocationMetrics"),
+}
+
+// knownStreamChunks are the chunk types of the Anthropic messages stream
+var knownStreamChunks = fieldSet("message_start", "content_block_start", "content_block_delta", "content_block_stop",
+    "message_delta", "message_stop", "ping", "error")
+
+func fieldSet(fields ...string) map[string]bool {
+    set := make(map[string]bool, len(fields))
+    for _, f := range fields {
+        set[f] = true
+    }
+    return set
+}
+
+// driftSeen remembers which unknown fields have been logged, so each one is
+// logged once per process while the counter keeps counting
+var driftSeen sync.Map
+
+// detectSchemaDrift counts top-level fields of a decoded response that the
+// provider isn't known to send
+func detectSchemaDrift(provider string, response map[string]interface{}) {
+    for _, field := range unknownFields(provider, response) {
+        recordDrift(provider, "field", field)
+    }
+}
+
+// unknownFields lists the top-level fields of a decoded response that the
+// provider isn't known to send, sorted
+func unknownFields(provider string, response map[string]interface{}) []string {
+    known := knownResponseFields[provider]
+    var unknown []string
+    for field := range response {
+        if !known[field] {
+            unknown = append(unknown, field)
+        }
+    }
+    sort.Strings(unknown)
+    return unknown
+}
+
+// detectStreamDrift counts stream chunk types we don't recognize
+func detectStreamDrift(provider, chunkType string) {
+    if !knownStreamChunks[chunkType] {
+        recordDrift(provider, "chunk_type", chunkType)
+    }
+}
+
+func recordDrift(provider, kind, name string) {
+    metrics.Inc("provider_schema_drift_total", "provider", provider, "kind", kind, "name", name)
+    if _, seen := driftSeen.LoadOrStore(provider+"/"+kind+"/"+name, true); !seen {
+        log.Printf("Warning: schema drift from %s: unknown %s %q", provider, kind, name)
+    }
+}
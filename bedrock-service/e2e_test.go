@@ -0,0 +1,469 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// The e2e tests boot the whole service once, through run, in front of a
+// fake Bedrock runtime, and drive it over HTTP as a client would. Each test
+// scripts the fake for models no other test uses, since breakers and
+// metrics outlive a test.
+
+var (
+    fake       *fakeBedrock
+    serviceURL string      // Base URL of the service under test
+    serviceLog *syncBuffer // Everything the service logged
+)
+
+// e2eEnv configures the service for the tests: static credentials, no
+// control plane calls and short backoffs
+var e2eEnv = map[string]string{
+    "AWS_ACCESS_KEY_ID":           "AKIDFAKE",
+    "AWS_SECRET_ACCESS_KEY":       "fake-secret",
+    "AWS_REGION":                  "us-east-1",
+    "AWS_CONFIG_FILE":             os.DevNull,
+    "AWS_SHARED_CREDENTIALS_FILE": os.DevNull,
+    "AWS_EC2_METADATA_DISABLED":   "true",
+    "SKIP_MODEL_TEST":             "true",
+    "BEDROCK_MAX_RETRIES":         "1",
+    "BEDROCK_BACKOFF_BASE_MS":     "1",
+    "LOG_LEVEL":                   "debug",
+}
+
+// syncBuffer is a bytes.Buffer safe to log to from many goroutines
+type syncBuffer struct {
+    mu  sync.Mutex
+    buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.String()
+}
+
+func TestMain(m *testing.M) {
+    fake = newFakeBedrock()
+    for key, value := range e2eEnv {
+        os.Setenv(key, value)
+    }
+    os.Setenv("BEDROCK_ENDPOINT_URL", fake.URL)
+    os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+    os.Unsetenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+    serviceURL = "http://" + listener.Addr().String()
+    serviceLog = &syncBuffer{}
+    go func() {
+        err := run(ServerConfig{Listener: listener, LogOutput: serviceLog})
+        fmt.Fprintf(os.Stderr, "service stopped: %v\n", err)
+        os.Exit(1)
+    }()
+    if err := waitReady(10 * time.Second); err != nil {
+        fmt.Fprintf(os.Stderr, "service never became ready: %v\n%s", err, serviceLog)
+        os.Exit(1)
+    }
+
+    code := m.Run()
+    fake.Close()
+    os.Exit(code)
+}
+
+// waitReady polls /readyz until the model registry is ready
+func waitReady(timeout time.Duration) error {
+    deadline := time.Now().Add(timeout)
+    for {
+        resp, err := http.Get(serviceURL + "/readyz")
+        if err == nil {
+            resp.Body.Close()
+            if resp.StatusCode == http.StatusOK {
+                return nil
+            }
+            err = fmt.Errorf("status %d", resp.StatusCode)
+        }
+        if time.Now().After(deadline) {
+            return err
+        }
+        time.Sleep(20 * time.Millisecond)
+    }
+}
+
+// post sends a JSON body to the service
+func post(t *testing.T, path string, body interface{}) *http.Response {
+    t.Helper()
+    data, err := json.Marshal(body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp, err := http.Post(serviceURL+path, "application/json", bytes.NewReader(data))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return resp
+}
+
+// decode reads a JSON response body into v
+func decode(t *testing.T, resp *http.Response, v interface{}) {
+    t.Helper()
+    defer resp.Body.Close()
+    data, err := io.ReadAll(resp.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := json.Unmarshal(data, v); err != nil {
+        t.Fatalf("response is not JSON: %v\n%s", err, data)
+    }
+}
+
+// logLines are the service's JSON log lines for one request
+func logLines(t *testing.T, requestID string) []map[string]interface{} {
+    t.Helper()
+    var lines []map[string]interface{}
+    for _, line := range strings.Split(serviceLog.String(), "\n") {
+        var entry map[string]interface{}
+        if json.Unmarshal([]byte(line), &entry) == nil && entry["request_id"] == requestID {
+            lines = append(lines, entry)
+        }
+    }
+    return lines
+}
+
+// attemptLogged reports whether a request logged a model attempt with an outcome
+func attemptLogged(t *testing.T, requestID, modelID, outcome string) bool {
+    t.Helper()
+    for _, entry := range logLines(t, requestID) {
+        if entry["msg"] == "model attempt" && entry["model_id"] == modelID && entry["outcome"] == outcome {
+            return true
+        }
+    }
+    return false
+}
+
+// metricValue scrapes one series from /metrics, 0 when it's missing
+func metricValue(t *testing.T, series string) float64 {
+    t.Helper()
+    resp, err := http.Get(serviceURL + "/metrics")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    data, _ := io.ReadAll(resp.Body)
+    match := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(series) + ` (\S+)$`).FindSubmatch(data)
+    if match == nil {
+        return 0
+    }
+    value, err := strconv.ParseFloat(string(match[1]), 64)
+    if err != nil {
+        t.Fatalf("series %s has value %q", series, match[1])
+    }
+    return value
+}
+
+// sseEvent is one Server-Sent Event
+type sseEvent struct {
+    Name string
+    Data string
+    At   time.Time // When it was read
+}
+
+// readEvents reads a stream's events until it ends
+func readEvents(t *testing.T, body io.Reader) []sseEvent {
+    t.Helper()
+    var events []sseEvent
+    var current sseEvent
+    scanner := bufio.NewScanner(body)
+    for scanner.Scan() {
+        line := scanner.Text()
+        switch {
+        case strings.HasPrefix(line, "event: "):
+            current.Name = strings.TrimPrefix(line, "event: ")
+        case strings.HasPrefix(line, "data: "):
+            current.Data = strings.TrimPrefix(line, "data: ")
+        case line == "" && current.Name != "":
+            current.At = time.Now()
+            events = append(events, current)
+            current = sseEvent{}
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        t.Fatal(err)
+    }
+    return events
+}
+
+func TestE2EGenerate(t *testing.T) {
+    const model = "anthropic.claude-3-haiku-20240307-v1:0"
+    fake.Script(model, converseMessage("Hello from the fake"))
+    before := metricValue(t, `bedrock_invoke_duration_seconds_count{model="`+model+`",outcome="success"}`)
+
+    resp := post(t, "/generate", map[string]interface{}{"prompt": "Say hello", "models": []string{model}})
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("status %d", resp.StatusCode)
+    }
+    requestID := resp.Header.Get("X-Request-ID")
+    var out GenerateResponse
+    decode(t, resp, &out)
+
+    if out.Response != "Hello from the fake" {
+        t.Errorf("response %q", out.Response)
+    }
+    if out.Meta == nil || out.Meta.ModelID != model {
+        t.Errorf("meta %+v, want model %s", out.Meta, model)
+    }
+    if out.InputTokens != 12 || out.OutputTokens != 7 || out.FinishReason != finishCompleted {
+        t.Errorf("usage %d/%d, finish reason %q", out.InputTokens, out.OutputTokens, out.FinishReason)
+    }
+
+    calls := fake.Calls(model)
+    if len(calls) != 1 || calls[0].Operation != "converse" {
+        t.Fatalf("calls %+v, want one converse", calls)
+    }
+    var sent struct {
+        Messages []struct {
+            Content []struct {
+                Text string `json:"text"`
+            } `json:"content"`
+        } `json:"messages"`
+    }
+    if err := json.Unmarshal(calls[0].Body, &sent); err != nil || len(sent.Messages) != 1 || !strings.Contains(sent.Messages[0].Content[0].Text, "Say hello") {
+        t.Errorf("Converse body %s", calls[0].Body)
+    }
+
+    if !attemptLogged(t, requestID, model, "success") {
+        t.Errorf("no successful attempt logged for request %s:\n%v", requestID, logLines(t, requestID))
+    }
+    if after := metricValue(t, `bedrock_invoke_duration_seconds_count{model="`+model+`",outcome="success"}`); after != before+1 {
+        t.Errorf("invocation histogram count went from %g to %g", before, after)
+    }
+}
+
+func TestE2EGenerateFallsBackPastMalformedBody(t *testing.T) {
+    const broken, backup = "anthropic.claude-v2", "anthropic.claude-3-sonnet-20240229-v1:0"
+    fake.Script(broken, fakeReply{Body: `{"completion": "cut off`})
+    fake.Script(backup, converseMessage("From the backup"))
+
+    resp := post(t, "/generate", map[string]interface{}{"prompt": "Hi", "models": []string{broken, backup}})
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("status %d", resp.StatusCode)
+    }
+    requestID := resp.Header.Get("X-Request-ID")
+    var out GenerateResponse
+    decode(t, resp, &out)
+
+    if out.Response != "From the backup" || out.Meta == nil || out.Meta.ModelID != backup {
+        t.Errorf("response %q from %+v, want the backup's", out.Response, out.Meta)
+    }
+    if calls := fake.Calls(broken); len(calls) != 1 || calls[0].Operation != "invoke" {
+        t.Errorf("calls to %s: %+v, want one InvokeModel", broken, calls)
+    }
+    if !attemptLogged(t, requestID, broken, "error") || !attemptLogged(t, requestID, backup, "success") {
+        t.Errorf("attempts not logged for request %s:\n%v", requestID, logLines(t, requestID))
+    }
+}
+
+func TestE2EGenerateThrottled(t *testing.T) {
+    const model = "anthropic.claude-3-opus-20240229-v1:0"
+    fake.Script(model, throttled(), throttled(), throttled())
+    before := metricValue(t, `bedrock_retries_total{model="`+model+`",origin="user",reason="throttled"}`)
+
+    resp := post(t, "/generate", map[string]interface{}{"prompt": "Hi", "models": []string{model}})
+    var envelope errorEnvelope
+    decode(t, resp, &envelope)
+    out := envelope.Error
+
+    if resp.StatusCode != http.StatusTooManyRequests || out.Code != ErrCodeThrottled {
+        t.Fatalf("status %d, error %+v; want 429 throttled", resp.StatusCode, out)
+    }
+    if resp.Header.Get("Retry-After") == "" {
+        t.Error("no Retry-After on a throttled response")
+    }
+    // One call and BEDROCK_MAX_RETRIES=1 retry
+    if calls := len(fake.Calls(model)); calls != 2 {
+        t.Errorf("%d calls, want 2", calls)
+    }
+    if after := metricValue(t, `bedrock_retries_total{model="`+model+`",origin="user",reason="throttled"}`); after != before+1 {
+        t.Errorf("retries went from %g to %g", before, after)
+    }
+}
+
+func TestE2EGenerateWaitsForSlowModel(t *testing.T) {
+    const model = "anthropic.claude-3-5-haiku-20241022-v1:0"
+    slow := converseMessage("Worth the wait")
+    slow.Delay = 150 * time.Millisecond
+    fake.Script(model, slow)
+
+    started := time.Now()
+    resp := post(t, "/generate", map[string]interface{}{"prompt": "Hi", "models": []string{model}})
+    var out GenerateResponse
+    decode(t, resp, &out)
+
+    if resp.StatusCode != http.StatusOK || out.Response != "Worth the wait" {
+        t.Fatalf("status %d, response %q", resp.StatusCode, out.Response)
+    }
+    if elapsed := time.Since(started); elapsed < slow.Delay {
+        t.Errorf("answered in %v, before the model did", elapsed)
+    }
+    if out.LatencyMs < slow.Delay.Milliseconds() {
+        t.Errorf("latency_ms %d, want at least %d", out.LatencyMs, slow.Delay.Milliseconds())
+    }
+}
+
+func TestE2EStream(t *testing.T) {
+    const model = "anthropic.claude-3-5-sonnet-20240620-v1:0"
+    reply := claudeStream("Hello", ", ", "world")
+    reply.Delay = 40 * time.Millisecond
+    fake.Script(model, reply)
+
+    resp := post(t, "/generate/stream", map[string]interface{}{"prompt": "Greet me", "models": []string{model}})
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+        t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+    }
+    requestID := resp.Header.Get("X-Request-ID")
+    events := readEvents(t, resp.Body)
+
+    var text strings.Builder
+    var deltas []sseEvent
+    for _, event := range events {
+        if event.Name == "delta" {
+            var delta textDeltaEvent
+            if err := json.Unmarshal([]byte(event.Data), &delta); err != nil {
+                t.Fatal(err)
+            }
+            text.WriteString(delta.Text)
+            deltas = append(deltas, event)
+        }
+    }
+    if text.String() != "Hello, world" {
+        t.Errorf("streamed %q", text.String())
+    }
+    // Each delta is flushed as it arrives, not buffered until the end
+    if len(deltas) < 2 || deltas[len(deltas)-1].At.Sub(deltas[0].At) < reply.Delay {
+        t.Errorf("deltas arrived together: %+v", deltas)
+    }
+
+    last := events[len(events)-1]
+    if last.Name != "done" {
+        t.Fatalf("last event %s %s, want done", last.Name, last.Data)
+    }
+    var done streamDoneEvent
+    if err := json.Unmarshal([]byte(last.Data), &done); err != nil {
+        t.Fatal(err)
+    }
+    if done.ModelID != model || done.FinishReason != finishCompleted || done.InputTokens != 12 || done.OutputTokens != 7 {
+        t.Errorf("done %+v", done)
+    }
+    if calls := fake.Calls(model); len(calls) != 1 || calls[0].Operation != "invoke-with-response-stream" {
+        t.Errorf("calls %+v, want one stream", calls)
+    }
+    if !attemptLogged(t, requestID, model, "success") {
+        t.Errorf("no successful attempt logged for request %s:\n%v", requestID, logLines(t, requestID))
+    }
+}
+
+func TestE2EStreamMalformedChunk(t *testing.T) {
+    const model = "anthropic.claude-3-5-sonnet-20241022-v2:0"
+    reply := claudeStream("Partial")
+    reply.Chunks = append(reply.Chunks[:3:3], "{not json")
+    fake.Script(model, reply)
+
+    resp := post(t, "/generate/stream", map[string]interface{}{"prompt": "Hi", "models": []string{model}})
+    defer resp.Body.Close()
+    events := readEvents(t, resp.Body)
+
+    if len(events) == 0 {
+        t.Fatal("no events")
+    }
+    if first := events[0]; first.Name != "delta" || !strings.Contains(first.Data, "Partial") {
+        t.Errorf("first event %s %s, want the text sent before the bad chunk", first.Name, first.Data)
+    }
+    last := events[len(events)-1]
+    var failed streamErrorEvent
+    if err := json.Unmarshal([]byte(last.Data), &failed); err != nil || last.Name != "error" {
+        t.Fatalf("last event %s %s, want error", last.Name, last.Data)
+    }
+    if failed.Code != ErrCodeInternal || failed.FinishReason != finishError || strings.Contains(failed.Error, "json") {
+        t.Errorf("error event %+v", failed)
+    }
+}
+
+func TestE2EStreamThrottledBeforeStart(t *testing.T) {
+    const model = "anthropic.claude-instant-v1"
+    fake.Script(model, throttled(), throttled())
+
+    resp := post(t, "/generate/stream", map[string]interface{}{"prompt": "Hi", "models": []string{model}})
+    var envelope errorEnvelope
+    decode(t, resp, &envelope)
+    out := envelope.Error
+    if resp.StatusCode != http.StatusTooManyRequests || out.Code != ErrCodeThrottled || out.RequestID == "" {
+        t.Errorf("status %d, error %+v; want 429 throttled with a request ID", resp.StatusCode, out)
+    }
+}
+
+// BenchmarkE2EGenerate measures a /generate request through the whole
+// service, its Bedrock call answered by the fake. Prompts differ so none is
+// answered from the response cache.
+func BenchmarkE2EGenerate(b *testing.B) {
+    const model = "anthropic.claude-v2:1"
+    reply, _ := json.Marshal(map[string]string{"completion": " Hello from the fake", "stop_reason": "stop_sequence"})
+    replies := make([]fakeReply, b.N)
+    for i := range replies {
+        replies[i] = fakeReply{Body: string(reply)}
+    }
+    fake.Script(model, replies...)
+    defer fake.Reset()
+
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        data, _ := json.Marshal(map[string]interface{}{"prompt": fmt.Sprintf("Say hello %d", i), "models": []string{model}})
+        resp, err := http.Post(serviceURL+"/generate", "application/json", bytes.NewReader(data))
+        if err != nil {
+            b.Fatal(err)
+        }
+        io.Copy(io.Discard, resp.Body)
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+            b.Fatalf("status %d", resp.StatusCode)
+        }
+    }
+}
+
+// BenchmarkE2EModels measures GET /models, answered from the cached listing
+func BenchmarkE2EModels(b *testing.B) {
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+        resp, err := http.Get(serviceURL + "/models")
+        if err != nil {
+            b.Fatal(err)
+        }
+        io.Copy(io.Discard, resp.Body)
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+            b.Fatalf("status %d", resp.StatusCode)
+        }
+    }
+}
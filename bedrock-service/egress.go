@@ -0,0 +1,386 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Egress defaults
+const (
+    defaultEgressTimeout   = 10 * time.Second
+    defaultEgressRedirects = 3
+)
+
+// blockedNetworks are never reachable by caller-supplied URLs unless a range
+// is explicitly allowlisted: loopback, private, link-local (including the
+// instance metadata endpoints), CGNAT, multicast and other special ranges.
+// IPv4-compatible IPv6 (::a.b.c.d) is deprecated and blocked outright.
+var blockedNetworks = mustParseCIDRs(
+    "0.0.0.0/8",
+    "10.0.0.0/8",
+    "100.64.0.0/10",
+    "127.0.0.0/8",
+    "169.254.0.0/16",
+    "172.16.0.0/12",
+    "192.0.0.0/24",
+    "192.0.2.0/24",
+    "192.168.0.0/16",
+    "198.18.0.0/15",
+    "198.51.100.0/24",
+    "203.0.113.0/24",
+    "224.0.0.0/4",
+    "240.0.0.0/4",
+    "::/128",
+    "::1/128",
+    "::/96",
+    "64:ff9b::/96",
+    "100::/64",
+    "2001:db8::/32",
+    "fc00::/7",
+    "fe80::/10",
+    "ff00::/8",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+    nets := make([]*net.IPNet, 0, len(cidrs))
+    for _, cidr := range cidrs {
+        _, n, err := net.ParseCIDR(cidr)
+        if err != nil {
+            panic(err)
+        }
+        nets = append(nets, n)
+    }
+    return nets
+}
+
+// ErrEgressDenied is returned (wrapped) when a destination violates the egress policy
+var ErrEgressDenied = errors.New("egress denied")
+
+// EgressPolicy restricts which destinations features fetching caller-supplied
+// URLs (content URLs, webhooks) may reach
+type EgressPolicy struct {
+    Schemes      map[string]bool
+    Ports        map[int]bool
+    AllowedHosts []string     // If non-empty, only these hosts (and subdomains) may be reached
+    AllowedNets  []*net.IPNet // Ranges exempt from the blocked network list
+    MaxRedirects int
+    Timeout      time.Duration
+    HostTimeouts map[string]time.Duration
+}
+
+// LoadEgressPolicy reads the policy from EGRESS_ALLOWED_SCHEMES (default
+// "https"), EGRESS_ALLOWED_PORTS (default "443"), EGRESS_ALLOWED_HOSTS,
+// EGRESS_ALLOWED_CIDRS, EGRESS_MAX_REDIRECTS, EGRESS_TIMEOUT_SECONDS and
+// EGRESS_HOST_TIMEOUTS ("host=seconds,...")
+func LoadEgressPolicy() (*EgressPolicy, error) {
+    p := &EgressPolicy{
+        Schemes:      map[string]bool{"https": true},
+        Ports:        map[int]bool{443: true},
+        MaxRedirects: defaultEgressRedirects,
+        Timeout:      defaultEgressTimeout,
+        HostTimeouts: make(map[string]time.Duration),
+    }
+
+    if v := os.Getenv("EGRESS_ALLOWED_SCHEMES"); v != "" {
+        p.Schemes = make(map[string]bool)
+        for _, scheme := range strings.Split(v, ",") {
+            scheme = strings.ToLower(strings.TrimSpace(scheme))
+            if scheme != "http" && scheme != "https" {
+                return nil, fmt.Errorf("invalid EGRESS_ALLOWED_SCHEMES entry %q", scheme)
+            }
+            p.Schemes[scheme] = true
+        }
+    }
+    if v := os.Getenv("EGRESS_ALLOWED_PORTS"); v != "" {
+        p.Ports = make(map[int]bool)
+        for _, field := range strings.Split(v, ",") {
+            port, err := strconv.Atoi(strings.TrimSpace(field))
+            if err != nil || port < 1 || port > 65535 {
+                return nil, fmt.Errorf("invalid EGRESS_ALLOWED_PORTS entry %q", field)
+            }
+            p.Ports[port] = true
+        }
+    }
+    p.AllowedHosts = splitDomains(os.Getenv("EGRESS_ALLOWED_HOSTS"))
+    if v := os.Getenv("EGRESS_ALLOWED_CIDRS"); v != "" {
+        for _, field := range strings.Split(v, ",") {
+            _, n, err := net.ParseCIDR(strings.TrimSpace(field))
+            if err != nil {
+                return nil, fmt.Errorf("invalid EGRESS_ALLOWED_CIDRS entry %q", field)
+            }
+            p.AllowedNets = append(p.AllowedNets, n)
+        }
+    }
+    if v := os.Getenv("EGRESS_MAX_REDIRECTS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            return nil, fmt.Errorf("invalid EGRESS_MAX_REDIRECTS %q", v)
+        }
+        p.MaxRedirects = n
+    }
+    if v := os.Getenv("EGRESS_TIMEOUT_SECONDS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n <= 0 {
+            return nil, fmt.Errorf("invalid EGRESS_TIMEOUT_SECONDS %q", v)
+        }
+        p.Timeout = time.Duration(n) * time.Second
+    }
+    if v := os.Getenv("EGRESS_HOST_TIMEOUTS"); v != "" {
+        for _, field := range strings.Split(v, ",") {
+            host, seconds, ok := strings.Cut(strings.TrimSpace(field), "=")
+            n, err := strconv.Atoi(seconds)
+            if !ok || host == "" || err != nil || n <= 0 {
+                return nil, fmt.Errorf("invalid EGRESS_HOST_TIMEOUTS entry %q", field)
+            }
+            p.HostTimeouts[strings.ToLower(host)] = time.Duration(n) * time.Second
+        }
+    }
+    return p, nil
+}
+
+// CheckURL validates the scheme, port and host of a destination before any
+// connection is made. The resolved addresses are checked separately at dial time.
+func (p *EgressPolicy) CheckURL(u *url.URL) error {
+    if !p.Schemes[strings.ToLower(u.Scheme)] {
+        return fmt.Errorf("%w: scheme %q not allowed", ErrEgressDenied, u.Scheme)
+    }
+    if u.User != nil {
+        return fmt.Errorf("%w: credentials in URLs are not allowed", ErrEgressDenied)
+    }
+
+    host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+    if host == "" {
+        return fmt.Errorf("%w: missing host", ErrEgressDenied)
+    }
+
+    port := 443
+    if u.Scheme == "http" {
+        port = 80
+    }
+    if u.Port() != "" {
+        n, err := strconv.Atoi(u.Port())
+        if err != nil {
+            return fmt.Errorf("%w: invalid port %q", ErrEgressDenied, u.Port())
+        }
+        port = n
+    }
+    if !p.Ports[port] {
+        return fmt.Errorf("%w: port %d not allowed", ErrEgressDenied, port)
+    }
+
+    if len(p.AllowedHosts) > 0 {
+        allowed := false
+        for _, d := range p.AllowedHosts {
+            if domainMatches(host, d) {
+                allowed = true
+                break
+            }
+        }
+        if !allowed {
+            return fmt.Errorf("%w: host %s is not allowlisted", ErrEgressDenied, host)
+        }
+    }
+
+    // Literal IPs (including IPv6 and IPv4-mapped forms) are checked right away
+    if ip := net.ParseIP(host); ip != nil {
+        return p.CheckIP(ip)
+    }
+    return nil
+}
+
+// CheckIP rejects addresses in blocked ranges unless explicitly allowlisted
+func (p *EgressPolicy) CheckIP(ip net.IP) error {
+    // Normalize IPv4-mapped IPv6 (::ffff:a.b.c.d) to plain IPv4
+    if v4 := ip.To4(); v4 != nil {
+        ip = v4
+    }
+
+    for _, n := range p.AllowedNets {
+        if n.Contains(ip) {
+            return nil
+        }
+    }
+    for _, n := range blockedNetworks {
+        if n.Contains(ip) {
+            return fmt.Errorf("%w: address %s is in blocked range %s", ErrEgressDenied, ip, n)
+        }
+    }
+
+    // 6to4 addresses embed an IPv4 address that must pass the same checks
+    if len(ip) == net.IPv6len && ip[0] == 0x20 && ip[1] == 0x02 {
+        return p.CheckIP(net.IPv4(ip[2], ip[3], ip[4], ip[5]))
+    }
+    return nil
+}
+
+// timeoutFor returns the timeout for a destination host
+func (p *EgressPolicy) timeoutFor(host string) time.Duration {
+    host = strings.ToLower(host)
+    for h, timeout := range p.HostTimeouts {
+        if domainMatches(host, h) {
+            return timeout
+        }
+    }
+    return p.Timeout
+}
+
+// egress is the process-wide client used for every fetch of a caller-supplied URL
+var egress *EgressClient
+
+// EgressClient is the single hardened HTTP client for all outbound requests
+// to caller-supplied URLs
+type EgressClient struct {
+    policy   *EgressPolicy
+    client   *http.Client
+    resolver hostResolver
+}
+
+// hostResolver looks up a destination's addresses; *net.Resolver in production
+type hostResolver interface {
+    LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// NewEgressClient creates a client that resolves each destination once,
+// validates every resolved address and then dials that exact address, so a
+// DNS answer can't change between the check and the connection
+func NewEgressClient(policy *EgressPolicy) *EgressClient {
+    ec := &EgressClient{policy: policy, resolver: net.DefaultResolver}
+
+    transport := &http.Transport{
+        Proxy:                 nil, // Never route through environment proxies
+        DialContext:           ec.dialContext,
+        ForceAttemptHTTP2:     true,
+        MaxIdleConns:          20,
+        IdleConnTimeout:       30 * time.Second,
+        TLSHandshakeTimeout:   5 * time.Second,
+        ResponseHeaderTimeout: policy.Timeout,
+    }
+
+    ec.client = &http.Client{
+        Transport: transport,
+        CheckRedirect: func(req *http.Request, via []*http.Request) error {
+            if len(via) > policy.MaxRedirects {
+                return fmt.Errorf("%w: more than %d redirects", ErrEgressDenied, policy.MaxRedirects)
+            }
+            // Every hop is re-validated; the dialer re-checks its addresses
+            return policy.CheckURL(req.URL)
+        },
+    }
+    return ec
+}
+
+// dialContext resolves the host, rejects it if any address is blocked and
+// connects to the validated address
+func (ec *EgressClient) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+    host, port, err := net.SplitHostPort(addr)
+    if err != nil {
+        return nil, err
+    }
+
+    var ips []net.IP
+    if ip := net.ParseIP(host); ip != nil {
+        ips = []net.IP{ip}
+    } else {
+        addrs, err := ec.resolver.LookupIPAddr(ctx, host)
+        if err != nil {
+            return nil, err
+        }
+        for _, a := range addrs {
+            ips = append(ips, a.IP)
+        }
+    }
+    if len(ips) == 0 {
+        return nil, fmt.Errorf("no addresses found for %s", host)
+    }
+
+    // Reject the host if any answer is blocked, so round-robin tricks can't mix in internal targets
+    for _, ip := range ips {
+        if err := ec.policy.CheckIP(ip); err != nil {
+            return nil, err
+        }
+    }
+
+    dialer := &net.Dialer{Timeout: 5 * time.Second}
+    var lastErr error
+    for _, ip := range ips {
+        conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+        if err == nil {
+            return conn, nil
+        }
+        lastErr = err
+    }
+    return nil, lastErr
+}
+
+// Do sends req after validating its destination, applying the per-destination timeout
+func (ec *EgressClient) Do(req *http.Request) (*http.Response, error) {
+    start := time.Now()
+    destination := req.URL.Redacted()
+
+    if err := ec.policy.CheckURL(req.URL); err != nil {
+        ec.record(req.Method, destination, "denied", start, err)
+        return nil, err
+    }
+
+    ctx, cancel := context.WithTimeout(req.Context(), ec.policy.timeoutFor(req.URL.Hostname()))
+    resp, err := ec.client.Do(req.WithContext(ctx))
+    if err != nil {
+        cancel()
+        outcome := "error"
+        if errors.Is(err, ErrEgressDenied) {
+            outcome = "denied"
+        }
+        ec.record(req.Method, destination, outcome, start, err)
+        return nil, err
+    }
+
+    ec.record(req.Method, destination, fmt.Sprintf("status_%d", resp.StatusCode), start, nil)
+    resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+    return resp, nil
+}
+
+// Get fetches rawURL through the hardened client
+func (ec *EgressClient) Get(ctx context.Context, rawURL string) (*http.Response, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+    if err != nil {
+        return nil, fmt.Errorf("%w: invalid URL", ErrEgressDenied)
+    }
+    return ec.Do(req)
+}
+
+// record logs and counts every outbound fetch with its destination and outcome
+func (ec *EgressClient) record(method, destination, outcome string, start time.Time, err error) {
+    label := outcome
+    if strings.HasPrefix(outcome, "status_") {
+        label = "completed"
+    }
+    metrics.Inc("egress_requests_total", "outcome", label)
+
+    if err != nil {
+        log.Printf("Egress %s %s: %s after %v: %v", method, destination, outcome, time.Since(start).Round(time.Millisecond), err)
+        return
+    }
+    log.Printf("Egress %s %s: %s after %v", method, destination, outcome, time.Since(start).Round(time.Millisecond))
+}
+
+// cancelOnClose releases the request context once the caller is done with the body
+type cancelOnClose struct {
+    io.ReadCloser
+    cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+    err := c.ReadCloser.Close()
+    c.cancel()
+    return err
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+    "context"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "strings"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/config"
+    "github.com/aws/aws-sdk-go-v2/service/kms"
+    "github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// Envelope format written to disk
+const (
+    envelopeVersion   = 1
+    envelopeAlgorithm = "AES-256-GCM"
+)
+
+// ErrStateKey is returned when an encrypted object can't be opened with any
+// configured key: it was written under a key that has since been removed, or
+// it was tampered with
+var ErrStateKey = errors.New("state file cannot be decrypted: wrong key or corrupted data")
+
+// stateEncryption encrypts everything written through saveState. Nil stores
+// plaintext.
+var stateEncryption *Envelope
+
+// encryptedObject is an AES-GCM sealed payload together with the data key
+// that sealed it, itself wrapped by the master key
+type encryptedObject struct {
+    Version    int    `json:"encrypted"` // Doubles as the marker that a file is an envelope
+    Algorithm  string `json:"alg"`
+    KeyID      string `json:"key_id"` // Master key that wrapped the data key
+    WrappedKey []byte `json:"wrapped_key"`
+    Nonce      []byte `json:"nonce"`
+    Ciphertext []byte `json:"ciphertext"`
+}
+
+// keyWrapper issues and unwraps per-object data keys under a master key
+type keyWrapper interface {
+    // NewDataKey returns a fresh 256-bit key, its wrapped form and the ID of
+    // the master key that wrapped it
+    NewDataKey(ctx context.Context) (plain, wrapped []byte, keyID string, err error)
+    // Unwrap recovers a data key wrapped under keyID
+    Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+    // Current reports whether keyID is the master key new objects use
+    Current(keyID string) bool
+}
+
+// Envelope seals objects with per-object data keys, binding each one to its
+// name so a file copied over another fails to open
+type Envelope struct {
+    keys keyWrapper
+}
+
+// LoadStateEncryption reads KMS_KEY_ID, or STATE_ENCRYPTION_KEY and
+// STATE_ENCRYPTION_OLD_KEYS for a local master key. With neither set, state
+// is stored in plaintext.
+func LoadStateEncryption() (*Envelope, error) {
+    if keyID := os.Getenv("KMS_KEY_ID"); keyID != "" {
+        if os.Getenv("STATE_ENCRYPTION_KEY") != "" {
+            return nil, fmt.Errorf("set only one of KMS_KEY_ID and STATE_ENCRYPTION_KEY")
+        }
+        awsCfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(defaultRegion()))
+        if err != nil {
+            return nil, fmt.Errorf("unable to load SDK config for KMS: %v", err)
+        }
+        log.Printf("State files are encrypted with data keys from KMS key %s", keyID)
+        return &Envelope{keys: &kmsKeys{client: kms.NewFromConfig(awsCfg), keyID: keyID}}, nil
+    }
+
+    v := os.Getenv("STATE_ENCRYPTION_KEY")
+    if v == "" {
+        return nil, nil
+    }
+    current, err := decodeMasterKey(v)
+    if err != nil {
+        return nil, fmt.Errorf("invalid STATE_ENCRYPTION_KEY: %v", err)
+    }
+    keys := &localKeys{masters: map[string][]byte{}}
+    keys.current = keys.add(current)
+    if old := os.Getenv("STATE_ENCRYPTION_OLD_KEYS"); old != "" {
+        for _, part := range strings.Split(old, ",") {
+            key, err := decodeMasterKey(strings.TrimSpace(part))
+            if err != nil {
+                return nil, fmt.Errorf("invalid STATE_ENCRYPTION_OLD_KEYS: %v", err)
+            }
+            keys.add(key)
+        }
+    }
+    log.Printf("State files are encrypted under local master key %s (%d older keys accepted)", keys.current, len(keys.masters)-1)
+    return &Envelope{keys: keys}, nil
+}
+
+// decodeMasterKey parses a base64 encoded 256-bit key
+func decodeMasterKey(v string) ([]byte, error) {
+    key, err := base64.StdEncoding.DecodeString(v)
+    if err != nil {
+        return nil, fmt.Errorf("must be base64")
+    }
+    if len(key) != 32 {
+        return nil, fmt.Errorf("must decode to 32 bytes, got %d", len(key))
+    }
+    return key, nil
+}
+
+// isEnvelope reports whether data looks like an encryptedObject rather than
+// a plaintext snapshot
+func isEnvelope(data []byte) bool {
+    var probe struct {
+        Version int `json:"encrypted"`
+    }
+    return json.Unmarshal(data, &probe) == nil && probe.Version > 0
+}
+
+// kmsKeys returns the KMS key behind the envelope, if it uses one. Nil
+// envelopes, for plaintext state, don't.
+func (e *Envelope) kmsKeys() (*kmsKeys, bool) {
+    if e == nil {
+        return nil, false
+    }
+    keys, ok := e.keys.(*kmsKeys)
+    return keys, ok
+}
+
+// Seal encrypts plaintext under a new data key. name is authenticated but
+// not stored, and must be passed to Open unchanged.
+func (e *Envelope) Seal(ctx context.Context, name string, plaintext []byte) ([]byte, error) {
+    dataKey, wrapped, keyID, err := e.keys.NewDataKey(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("error generating data key: %v", err)
+    }
+    aead, err := newGCM(dataKey)
+    if err != nil {
+        return nil, err
+    }
+    nonce := make([]byte, aead.NonceSize())
+    if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+        return nil, err
+    }
+    return json.Marshal(encryptedObject{
+        Version:    envelopeVersion,
+        Algorithm:  envelopeAlgorithm,
+        KeyID:      keyID,
+        WrappedKey: wrapped,
+        Nonce:      nonce,
+        Ciphertext: aead.Seal(nil, nonce, plaintext, []byte(name)),
+    })
+}
+
+// Open decrypts an object written by Seal. stale is set when the object's
+// data key was wrapped by an older master key and should be rewritten.
+func (e *Envelope) Open(ctx context.Context, name string, data []byte) (plaintext []byte, stale bool, err error) {
+    var obj encryptedObject
+    if err := json.Unmarshal(data, &obj); err != nil || obj.Version == 0 {
+        return nil, false, ErrStateKey
+    }
+    if obj.Version != envelopeVersion || obj.Algorithm != envelopeAlgorithm {
+        return nil, false, fmt.Errorf("unsupported encryption format %d/%s", obj.Version, obj.Algorithm)
+    }
+    dataKey, err := e.keys.Unwrap(ctx, obj.KeyID, obj.WrappedKey)
+    if err != nil {
+        return nil, false, fmt.Errorf("%w (master key %s: %v)", ErrStateKey, obj.KeyID, err)
+    }
+    aead, err := newGCM(dataKey)
+    if err != nil || len(obj.Nonce) != aead.NonceSize() {
+        return nil, false, ErrStateKey
+    }
+    plaintext, err = aead.Open(nil, obj.Nonce, obj.Ciphertext, []byte(name))
+    if err != nil {
+        return nil, false, ErrStateKey
+    }
+    return plaintext, !e.keys.Current(obj.KeyID), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+// localKeys wraps data keys with AES-GCM under master keys from the
+// environment. Old keys are kept only to unwrap objects not yet rewritten.
+type localKeys struct {
+    current string
+    masters map[string][]byte // By key ID
+}
+
+// add registers a master key under an ID derived from it, so IDs never
+// need to be configured and can't be mismatched
+func (k *localKeys) add(key []byte) string {
+    sum := sha256.Sum256(key)
+    id := "local:" + hex.EncodeToString(sum[:4])
+    k.masters[id] = key
+    return id
+}
+
+func (k *localKeys) NewDataKey(ctx context.Context) ([]byte, []byte, string, error) {
+    dataKey := make([]byte, 32)
+    if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+        return nil, nil, "", err
+    }
+    aead, err := newGCM(k.masters[k.current])
+    if err != nil {
+        return nil, nil, "", err
+    }
+    nonce := make([]byte, aead.NonceSize())
+    if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+        return nil, nil, "", err
+    }
+    return dataKey, aead.Seal(nonce, nonce, dataKey, []byte(k.current)), k.current, nil
+}
+
+func (k *localKeys) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+    master, ok := k.masters[keyID]
+    if !ok {
+        return nil, fmt.Errorf("key is not configured")
+    }
+    aead, err := newGCM(master)
+    if err != nil {
+        return nil, err
+    }
+    if len(wrapped) < aead.NonceSize() {
+        return nil, fmt.Errorf("wrapped key is truncated")
+    }
+    nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+    return aead.Open(nil, nonce, sealed, []byte(keyID))
+}
+
+func (k *localKeys) Current(keyID string) bool {
+    return keyID == k.current
+}
+
+// kmsKeys generates and decrypts data keys with AWS KMS. KMS rotates the
+// key material behind a key ID itself; changing KMS_KEY_ID to a different
+// key is what makes existing objects stale.
+type kmsKeys struct {
+    client *kms.Client
+    keyID  string
+}
+
+func (k *kmsKeys) NewDataKey(ctx context.Context) ([]byte, []byte, string, error) {
+    out, err := k.client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+        KeyId:   aws.String(k.keyID),
+        KeySpec: types.DataKeySpecAes256,
+    })
+    if err != nil {
+        return nil, nil, "", err
+    }
+    return out.Plaintext, out.CiphertextBlob, k.keyID, nil
+}
+
+func (k *kmsKeys) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+    out, err := k.client.Decrypt(ctx, &kms.DecryptInput{
+        KeyId:          aws.String(keyID),
+        CiphertextBlob: wrapped,
+    })
+    if err != nil {
+        return nil, err
+    }
+    return out.Plaintext, nil
+}
+
+func (k *kmsKeys) Current(keyID string) bool {
+    return keyID == k.keyID
+}
+
+// Check is the key's readiness check; state can't be read or written
+// without it
+func (k *kmsKeys) Check(ctx context.Context) error {
+    out, err := k.client.DescribeKey(ctx, &kms.DescribeKeyInput{KeyId: aws.String(k.keyID)})
+    if err != nil {
+        return err
+    }
+    if out.KeyMetadata != nil && !out.KeyMetadata.Enabled {
+        return fmt.Errorf("KMS key %s is %s", k.keyID, out.KeyMetadata.KeyState)
+    }
+    return nil
+}
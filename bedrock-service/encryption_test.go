@@ -0,0 +1,292 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// fakeKMS answers GenerateDataKey, Decrypt and DescribeKey for the keys it
+// holds. A wrapped data key is an opaque handle that only decrypts under
+// the key that issued it, as in KMS.
+type fakeKMS struct {
+    mu       sync.Mutex
+    keys     map[string]bool   // Key ID to enabled
+    wrapped  map[string][]byte // Handle to data key
+    issuedBy map[string]string // Handle to key ID
+    calls    map[string]int    // By operation
+}
+
+func newFakeKMS(keyIDs ...string) *fakeKMS {
+    f := &fakeKMS{keys: map[string]bool{}, wrapped: map[string][]byte{}, issuedBy: map[string]string{}, calls: map[string]int{}}
+    for _, id := range keyIDs {
+        f.keys[id] = true
+    }
+    return f
+}
+
+func (f *fakeKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    var req struct {
+        KeyId          string
+        CiphertextBlob []byte
+    }
+    json.NewDecoder(r.Body).Decode(&req)
+    fail := func(kind, message string) {
+        w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprintf(w, `{"__type":%q,"message":%q}`, kind, message)
+    }
+    enabled, known := f.keys[req.KeyId]
+    if !known {
+        fail("NotFoundException", "key "+req.KeyId+" does not exist")
+        return
+    }
+
+    operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "TrentService.")
+    f.calls[operation]++
+    var out interface{}
+    switch operation {
+    case "GenerateDataKey":
+        if !enabled {
+            fail("DisabledException", "key is disabled")
+            return
+        }
+        dataKey, handle := make([]byte, 32), make([]byte, 16)
+        rand.Read(dataKey)
+        rand.Read(handle)
+        f.wrapped[string(handle)], f.issuedBy[string(handle)] = dataKey, req.KeyId
+        out = map[string]interface{}{"KeyId": req.KeyId, "Plaintext": dataKey, "CiphertextBlob": handle}
+    case "Decrypt":
+        dataKey, ok := f.wrapped[string(req.CiphertextBlob)]
+        if !ok {
+            fail("InvalidCiphertextException", "")
+            return
+        }
+        if f.issuedBy[string(req.CiphertextBlob)] != req.KeyId {
+            fail("IncorrectKeyException", "the key ID in the request does not identify the key that encrypted the ciphertext")
+            return
+        }
+        out = map[string]interface{}{"KeyId": req.KeyId, "Plaintext": dataKey}
+    case "DescribeKey":
+        state := "Enabled"
+        if !enabled {
+            state = "Disabled"
+        }
+        out = map[string]interface{}{"KeyMetadata": map[string]interface{}{"KeyId": req.KeyId, "Enabled": enabled, "KeyState": state}}
+    default:
+        fail("UnknownOperationException", operation)
+        return
+    }
+    w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+    json.NewEncoder(w).Encode(out)
+}
+
+// kmsEnvelope is an envelope using keyID on the fake at url
+func kmsEnvelope(url, keyID string) *Envelope {
+    client := kms.New(kms.Options{
+        Region:           "us-east-1",
+        BaseEndpoint:     aws.String(url),
+        Credentials:      aws.AnonymousCredentials{},
+        RetryMaxAttempts: 1,
+    })
+    return &Envelope{keys: &kmsKeys{client: client, keyID: keyID}}
+}
+
+// localEnvelope is an envelope under local master keys, the first current
+func localEnvelope(t *testing.T, current []byte, old ...[]byte) *Envelope {
+    t.Helper()
+    t.Setenv("KMS_KEY_ID", "")
+    t.Setenv("STATE_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(current))
+    var encoded []string
+    for _, key := range old {
+        encoded = append(encoded, base64.StdEncoding.EncodeToString(key))
+    }
+    t.Setenv("STATE_ENCRYPTION_OLD_KEYS", strings.Join(encoded, ","))
+    e, err := LoadStateEncryption()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return e
+}
+
+func masterKey(fill byte) []byte {
+    return bytes.Repeat([]byte{fill}, 32)
+}
+
+const (
+    stateName  = "conversations.json"
+    stateValue = `{"conversations":{"c-1":{"turns":3}}}`
+)
+
+func TestEnvelopeKMSRotation(t *testing.T) {
+    fake := newFakeKMS("key-a", "key-b")
+    server := httptest.NewServer(fake)
+    defer server.Close()
+    ctx := context.Background()
+
+    sealed, err := kmsEnvelope(server.URL, "key-a").Seal(ctx, stateName, []byte(stateValue))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if bytes.Contains(sealed, []byte("turns")) {
+        t.Fatalf("sealed object holds the plaintext: %s", sealed)
+    }
+    if !isEnvelope(sealed) || isEnvelope([]byte(stateValue)) {
+        t.Error("envelope marker misread")
+    }
+
+    // KMS_KEY_ID moves to key-b: old objects still open, and say they're stale
+    rotated := kmsEnvelope(server.URL, "key-b")
+    plaintext, stale, err := rotated.Open(ctx, stateName, sealed)
+    if err != nil || string(plaintext) != stateValue || !stale {
+        t.Fatalf("opened %q, stale %v, error %v after rotation", plaintext, stale, err)
+    }
+    resealed, err := rotated.Seal(ctx, stateName, plaintext)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var obj encryptedObject
+    json.Unmarshal(resealed, &obj)
+    if obj.KeyID != "key-b" {
+        t.Errorf("rewritten under %s, want key-b", obj.KeyID)
+    }
+    if _, stale, err := rotated.Open(ctx, stateName, resealed); err != nil || stale {
+        t.Errorf("rewritten object: stale %v, error %v", stale, err)
+    }
+    if fake.calls["GenerateDataKey"] != 2 || fake.calls["Decrypt"] != 2 {
+        t.Errorf("KMS calls %v, want a data key per seal and a decrypt per open", fake.calls)
+    }
+
+    // Once key-a is gone the old object can't be opened at all
+    delete(fake.keys, "key-a")
+    if _, _, err := rotated.Open(ctx, stateName, sealed); !errors.Is(err, ErrStateKey) || !strings.Contains(err.Error(), "key-a") {
+        t.Errorf("error %v for an object under a deleted key, want ErrStateKey naming it", err)
+    }
+}
+
+func TestEnvelopeLocalRotation(t *testing.T) {
+    ctx := context.Background()
+    sealed, err := localEnvelope(t, masterKey(1)).Seal(ctx, stateName, []byte(stateValue))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    plaintext, stale, err := localEnvelope(t, masterKey(2), masterKey(1)).Open(ctx, stateName, sealed)
+    if err != nil || string(plaintext) != stateValue || !stale {
+        t.Fatalf("opened %q, stale %v, error %v under the old key", plaintext, stale, err)
+    }
+    if _, stale, err := localEnvelope(t, masterKey(1), masterKey(2)).Open(ctx, stateName, sealed); err != nil || stale {
+        t.Errorf("under the current key: stale %v, error %v", stale, err)
+    }
+    if _, _, err := localEnvelope(t, masterKey(2)).Open(ctx, stateName, sealed); !errors.Is(err, ErrStateKey) {
+        t.Errorf("error %v once the old key is dropped, want ErrStateKey", err)
+    }
+}
+
+// Any flipped byte, in the payload, its nonce or the wrapped data key, and
+// any other name fails to open rather than yielding altered state
+func TestEnvelopeTampering(t *testing.T) {
+    server := httptest.NewServer(newFakeKMS("key-a"))
+    defer server.Close()
+    ctx := context.Background()
+
+    for name, e := range map[string]*Envelope{
+        "kms":   kmsEnvelope(server.URL, "key-a"),
+        "local": localEnvelope(t, masterKey(1)),
+    } {
+        t.Run(name, func(t *testing.T) {
+            sealed, err := e.Seal(ctx, stateName, []byte(stateValue))
+            if err != nil {
+                t.Fatal(err)
+            }
+            var obj encryptedObject
+            if err := json.Unmarshal(sealed, &obj); err != nil {
+                t.Fatal(err)
+            }
+            for field, data := range map[string][]byte{"ciphertext": obj.Ciphertext, "nonce": obj.Nonce, "wrapped key": obj.WrappedKey} {
+                for _, i := range []int{0, len(data) / 2, len(data) - 1} {
+                    data[i] ^= 0x01
+                    tampered, _ := json.Marshal(obj)
+                    data[i] ^= 0x01
+                    if plaintext, _, err := e.Open(ctx, stateName, tampered); !errors.Is(err, ErrStateKey) {
+                        t.Errorf("%s byte %d flipped: opened %q, error %v", field, i, plaintext, err)
+                    }
+                }
+            }
+
+            // The name is the additional data: a file copied over another doesn't open
+            for _, other := range []string{"usage.json", "conversations.json.bak", ""} {
+                if _, _, err := e.Open(ctx, other, sealed); !errors.Is(err, ErrStateKey) {
+                    t.Errorf("opened as %q: error %v, want ErrStateKey", other, err)
+                }
+            }
+
+            if _, _, err := e.Open(ctx, stateName, sealed); err != nil {
+                t.Errorf("untouched object: %v", err)
+            }
+        })
+    }
+}
+
+func TestEnvelopeMalformed(t *testing.T) {
+    e := localEnvelope(t, masterKey(1))
+    ctx := context.Background()
+    for _, data := range []string{"", "not json", stateValue, `{"encrypted":0}`} {
+        if _, _, err := e.Open(ctx, stateName, []byte(data)); !errors.Is(err, ErrStateKey) {
+            t.Errorf("Open(%q) = %v, want ErrStateKey", data, err)
+        }
+    }
+    if _, _, err := e.Open(ctx, stateName, []byte(`{"encrypted":2,"alg":"AES-256-GCM"}`)); err == nil || errors.Is(err, ErrStateKey) {
+        t.Errorf("error %v for a newer format, want it named as unsupported", err)
+    }
+}
+
+func TestKMSKeyCheck(t *testing.T) {
+    fake := newFakeKMS("key-a")
+    server := httptest.NewServer(fake)
+    defer server.Close()
+    keys, _ := kmsEnvelope(server.URL, "key-a").kmsKeys()
+
+    if err := keys.Check(context.Background()); err != nil {
+        t.Errorf("enabled key: %v", err)
+    }
+    fake.keys["key-a"] = false
+    if err := keys.Check(context.Background()); err == nil || !strings.Contains(err.Error(), "Disabled") {
+        t.Errorf("disabled key: %v", err)
+    }
+}
+
+func TestLoadStateEncryption(t *testing.T) {
+    t.Setenv("STATE_ENCRYPTION_OLD_KEYS", "")
+    for _, c := range []struct {
+        kmsKey, key string
+        wantErr     bool
+    }{
+        {"", "", false},
+        {"", base64.StdEncoding.EncodeToString(masterKey(1)), false},
+        {"", "not base64!", true},
+        {"", base64.StdEncoding.EncodeToString(make([]byte, 16)), true},
+        {"key-a", base64.StdEncoding.EncodeToString(masterKey(1)), true},
+    } {
+        t.Setenv("KMS_KEY_ID", c.kmsKey)
+        t.Setenv("STATE_ENCRYPTION_KEY", c.key)
+        if _, err := LoadStateEncryption(); (err != nil) != c.wantErr {
+            t.Errorf("KMS_KEY_ID=%q STATE_ENCRYPTION_KEY=%q: error %v", c.kmsKey, c.key, err)
+        }
+    }
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// Error codes returned in the error envelope. These are a stable contract
+// with API clients (see the client package): never rename or repurpose one.
+const (
+    ErrCodeValidation       = "validation_error"
+    ErrCodeUnauthorized     = "unauthorized"
+    ErrCodeForbidden        = "forbidden"
+    ErrCodeNotFound         = "not_found"
+    ErrCodeMethodNotAllowed = "method_not_allowed"
+    ErrCodeRateLimited      = "rate_limited"
+    ErrCodeBudgetExceeded   = "budget_exceeded"
+    ErrCodeModelUnavailable = "model_unavailable"
+    ErrCodeThrottled        = "throttled"        // Bedrock throttled the models tried
+    ErrCodeContextTooLong   = "context_too_long" // The prompt doesn't fit the models' context windows
+    ErrCodeContentBlocked   = "content_blocked"
+    ErrCodeUnprocessable    = "unprocessable"
+    ErrCodeInternal         = "internal"
+    ErrCodeRequestBuild     = "internal_request_construction"
+    ErrCodeDeliveryFailed   = "delivery_failed"
+    ErrCodeInvalidJSON      = "invalid_json" // Stream error event: JSON mode output can't become valid JSON
+    ErrCodeInvalidSignature = "invalid_signature"
+    ErrCodeReplayedRequest  = "replayed_request"
+    ErrCodeCancelled        = "cancelled"         // The client gave up before generation finished
+    ErrCodeDeadlineExceeded = "deadline_exceeded" // The request's timeout ran out before a model answered
+
+    ErrCodeReservationConflict = "reservation_conflict" // Reserved capacity is taken for the window asked for
+)
+
+// statusClientClosedRequest is logged for requests the client abandoned;
+// there is no standard code, this is the one nginx uses
+const statusClientClosedRequest = 499
+
+// FieldError describes a validation problem with one request field
+type FieldError struct {
+    Field   string `json:"field"`
+    Message string `json:"message"`
+}
+
+// APIError is the body of every error response, wrapped as {"error": {...}}
+type APIError struct {
+    Code              string       `json:"code"`
+    Message           string       `json:"message"`
+    RequestID         string       `json:"request_id,omitempty"`
+    TraceID           string       `json:"trace_id,omitempty"`            // The request's trace, to quote in bug reports
+    Fields            []FieldError `json:"fields,omitempty"`              // validation_error
+    Attempted         []string     `json:"attempted,omitempty"`           // model_unavailable, deadline_exceeded: model IDs tried
+    RetryAfterSeconds int          `json:"retry_after_seconds,omitempty"` // rate_limited
+    Limit             int          `json:"limit,omitempty"`               // rate_limited: the limit exceeded
+    LimitUnit         string       `json:"limit_unit,omitempty"`          // rate_limited: what Limit counts, e.g. tokens_per_minute
+    ResetAt           *time.Time   `json:"reset_at,omitempty"`            // budget_exceeded, rate_limited
+    ErrorClass        string       `json:"error_class,omitempty"`         // model_unavailable with strict_model: the upstream failure, see remediation.go
+    ModelMatch        *ModelMatch  `json:"model_match,omitempty"`         // How the request's model was matched, when it was at fault
+
+    // Failures says why each model in the chain gave no answer (model_unavailable)
+    Failures []ModelFailure `json:"failures,omitempty"`
+
+    // SuggestedWindows are windows that would fit (reservation_conflict)
+    SuggestedWindows []ReservationWindow `json:"suggested_windows,omitempty"`
+}
+
+type errorEnvelope struct {
+    Error APIError `json:"error"`
+}
+
+// writeError sends an error envelope with a plain message
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+    writeAPIError(w, r, status, APIError{Code: code, Message: message})
+}
+
+// writeAPIError sends a fully populated error envelope, filling in the
+// request and trace IDs
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, apiErr APIError) {
+    apiErr.RequestID = requestIDFrom(r.Context())
+    apiErr.TraceID = traceIDFrom(r.Context())
+    requestRecordFrom(r.Context()).failed(apiErr)
+    localizeError(w, r, &apiErr)
+    if apiErr.RetryAfterSeconds > 0 {
+        w.Header().Set("Retry-After", strconv.Itoa(apiErr.RetryAfterSeconds))
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(errorEnvelope{Error: apiErr})
+}
+
+// notFoundHandler answers requests for paths no route serves
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+    writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "No route for "+r.URL.Path)
+}
+
+// methodNotAllowedHandler answers requests whose path is served, but not
+// with their method
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+    writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
+}
+
+// isCancelled reports whether err comes from the caller cancelling a
+// request rather than from Bedrock. Deadlines aren't cancellations: a
+// request that ran out of time failed.
+func isCancelled(err error) bool {
+    return errors.Is(err, context.Canceled)
+}
+
+// failureOutcome is the metrics outcome of a failed call, keeping
+// cancellations, callers' own timeouts and shed requests out of the error
+// counts that safe mode and alerts watch
+func failureOutcome(err error) string {
+    switch {
+    case isCancelled(err):
+        return "cancelled"
+    case isDeadline(err):
+        return "timeout"
+    case errors.Is(err, errSaturated):
+        return "shed"
+    }
+    return "error"
+}
+
+// ModelFailure is why one model in a request's chain gave no answer
+type ModelFailure struct {
+    Model      string `json:"model"`
+    ErrorClass string `json:"error_class"` // See remediation.go
+    Reason     string `json:"reason"`
+}
+
+// modelFailure records why model failed. Callers see err's class described,
+// never err itself: Bedrock's messages can name accounts and ARNs, so they
+// stay in the attempt logs.
+func modelFailure(model string, err error) ModelFailure {
+    class := classifyError(err)
+    return ModelFailure{Model: model, ErrorClass: class, Reason: failureReason(class)}
+}
+
+// GenerationError is returned when no model in the fallback chain produced a response
+type GenerationError struct {
+    Attempted []string       // Model IDs tried, in order
+    Failures  []ModelFailure // Each model skipped or tried, in order
+    Err       error          // Last underlying error
+}
+
+func (e *GenerationError) Error() string {
+    if len(e.Attempted) == 0 {
+        return e.Err.Error()
+    }
+    return fmt.Sprintf("all available models failed. Last error: %v", e.Err)
+}
+
+func (e *GenerationError) Unwrap() error {
+    return e.Err
+}
+
+// RequestBuildError means we failed to construct a model request body. The
+// failure is in our own code and would repeat for every model, so the
+// fallback loop stops at the first one.
+type RequestBuildError struct {
+    Model string // Model ID the body was being built for
+    Field string // Top-level body field that failed to encode, if known
+    Err   error
+}
+
+func (e *RequestBuildError) Error() string {
+    if e.Field != "" {
+        return fmt.Sprintf("error building request for %s: field %q: %v", e.Model, e.Field, e.Err)
+    }
+    return fmt.Sprintf("error building request for %s: %v", e.Model, e.Err)
+}
+
+func (e *RequestBuildError) Unwrap() error {
+    return e.Err
+}
+
+// marshalRequestBody encodes a model request body, reporting which top-level
+// field is at fault when encoding fails
+func marshalRequestBody(ctx context.Context, modelID string, body map[string]interface{}) ([]byte, error) {
+    data, err := json.Marshal(body)
+    if err == nil {
+        return data, nil
+    }
+    buildErr := &RequestBuildError{Model: modelID, Err: err}
+    for field, value := range body {
+        if _, fieldErr := json.Marshal(value); fieldErr != nil {
+            buildErr.Field = field
+            break
+        }
+    }
+    slog.ErrorContext(ctx, "Internal error: building model request body", "model_id", modelID, "field", buildErr.Field, "error", err.Error())
+    return nil, buildErr
+}
+
+// generationErrorResponse maps an error from Generate onto the error envelope
+func generationErrorResponse(err error) (int, APIError) {
+    if isCancelled(err) {
+        return statusClientClosedRequest, APIError{Code: ErrCodeCancelled, Message: "The request was cancelled before generation finished"}
+    }
+    if errors.Is(err, errSaturated) {
+        return http.StatusServiceUnavailable, APIError{
+            Code:              ErrCodeRateLimited,
+            Message:           "Too many generations in flight on this server; retry shortly",
+            RetryAfterSeconds: saturatedRetryAfter,
+        }
+    }
+    var genErr *GenerationError
+    if isDeadline(err) && errors.As(err, &genErr) {
+        return http.StatusGatewayTimeout, APIError{
+            Code:      ErrCodeDeadlineExceeded,
+            Message:   "The request timed out before a model answered",
+            Attempted: genErr.Attempted,
+        }
+    }
+    var buildErr *RequestBuildError
+    if errors.As(err, &buildErr) {
+        return http.StatusInternalServerError, APIError{
+            Code:    ErrCodeRequestBuild,
+            Message: "Internal error while constructing the model request",
+        }
+    }
+    if errors.As(err, &genErr) {
+        return modelUnavailableError(genErr)
+    }
+    return http.StatusInternalServerError, APIError{Code: ErrCodeInternal, Message: "Error generating response"}
+}
+
+// throttledRetryAfter is the Retry-After sent when Bedrock throttled the chain
+const throttledRetryAfter = 5
+
+// modelUnavailableError builds the envelope for a failed generation. When
+// the last model tried failed in a way the caller can act on, its class
+// picks the code: throttled, context_too_long or validation_error.
+func modelUnavailableError(err *GenerationError) (int, APIError) {
+    apiErr := APIError{
+        Code:      ErrCodeModelUnavailable,
+        Message:   "No model was able to handle the request",
+        Attempted: err.Attempted,
+        Failures:  err.Failures,
+    }
+    if len(err.Attempted) == 0 {
+        apiErr.Message = "No models are currently available"
+        return http.StatusInternalServerError, apiErr
+    }
+    switch class := classifyError(err.Err); {
+    case isThrottle(err.Err):
+        apiErr.Code, apiErr.Message = ErrCodeThrottled, "Bedrock is throttling the models tried; retry shortly"
+        apiErr.RetryAfterSeconds = throttledRetryAfter
+        return http.StatusTooManyRequests, apiErr
+    case class == errClassContextTooLong:
+        apiErr.Code, apiErr.Message = ErrCodeContextTooLong, "The prompt is too long for the models tried; shorten it or choose a model with a larger context window"
+        return http.StatusBadRequest, apiErr
+    case class == "ValidationException":
+        apiErr.Code, apiErr.Message = ErrCodeValidation, "The model rejected the request's parameters"
+        return http.StatusBadRequest, apiErr
+    }
+    return http.StatusInternalServerError, apiErr
+}
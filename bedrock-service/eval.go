@@ -0,0 +1,396 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "math"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "unicode"
+)
+
+// Scoring rubrics accepted by POST /eval/score
+const (
+    rubricExact      = "exact"      // Byte-for-byte match after trimming whitespace
+    rubricNormalized = "normalized" // Match ignoring case, punctuation and spacing
+    rubricF1         = "f1"         // Token-overlap F1 between generated and reference
+    rubricJudge      = "llm_judge"  // 1-5 score from the configured judge model
+)
+
+// Judge settings. Bump judgePromptVersion whenever buildJudgePrompt or the
+// scoring tool changes, so recorded scores stay comparable.
+const (
+    judgePromptVersion = "v1"
+    judgeMaxAttempts   = 3
+    judgeToolName      = "record_score"
+)
+
+// EvalConfig controls POST /eval/score
+type EvalConfig struct {
+    JudgeModel  string // Model ID or name used for llm_judge; empty disables it
+    Concurrency int
+    MaxItems    int
+}
+
+// LoadEvalConfig reads EVAL_JUDGE_MODEL, EVAL_CONCURRENCY and EVAL_MAX_ITEMS
+func LoadEvalConfig() (EvalConfig, error) {
+    cfg := EvalConfig{JudgeModel: os.Getenv("EVAL_JUDGE_MODEL"), Concurrency: 4, MaxItems: 100}
+
+    if v := os.Getenv("EVAL_CONCURRENCY"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return cfg, fmt.Errorf("invalid EVAL_CONCURRENCY %q", v)
+        }
+        cfg.Concurrency = n
+    }
+    if v := os.Getenv("EVAL_MAX_ITEMS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return cfg, fmt.Errorf("invalid EVAL_MAX_ITEMS %q", v)
+        }
+        cfg.MaxItems = n
+    }
+    return cfg, nil
+}
+
+// EvalItem is one (prompt, generated, reference) triple to score
+type EvalItem struct {
+    ID        string `json:"id,omitempty"`
+    Prompt    string `json:"prompt,omitempty"`
+    Generated string `json:"generated"`
+    Reference string `json:"reference"`
+}
+
+// EvalRequest is the body accepted by POST /eval/score
+type EvalRequest struct {
+    Rubric string     `json:"rubric"`
+    Items  []EvalItem `json:"items"`
+}
+
+// EvalScore is the result for one item. Score is 0-1 for the match and F1
+// rubrics and 1-5 for llm_judge.
+type EvalScore struct {
+    Index      int      `json:"index"`
+    ID         string   `json:"id,omitempty"`
+    Score      *float64 `json:"score,omitempty"` // Unset when the item could not be scored
+    Rationale  string   `json:"rationale,omitempty"`
+    JudgeModel string   `json:"judge_model,omitempty"`
+    Attempts   int      `json:"attempts,omitempty"`
+    Error      string   `json:"error,omitempty"`
+}
+
+// EvalAggregate summarizes the scored items
+type EvalAggregate struct {
+    Items  int     `json:"items"`
+    Scored int     `json:"scored"`
+    Errors int     `json:"errors"`
+    Mean   float64 `json:"mean"`
+    StdDev float64 `json:"stddev"`
+    Min    float64 `json:"min"`
+    Max    float64 `json:"max"`
+}
+
+// EvalSettings records everything needed to reproduce a run
+type EvalSettings struct {
+    Rubric             string   `json:"rubric"`
+    JudgeModel         string   `json:"judge_model,omitempty"`
+    JudgePromptVersion string   `json:"judge_prompt_version,omitempty"`
+    Temperature        *float64 `json:"temperature,omitempty"`
+}
+
+// EvalResponse is returned by POST /eval/score. JudgeUsage covers only the
+// judge's own invocations, never the generations being scored.
+type EvalResponse struct {
+    Settings   EvalSettings  `json:"settings"`
+    Results    []EvalScore   `json:"results"`
+    Aggregate  EvalAggregate `json:"aggregate"`
+    JudgeUsage *ToolUsage    `json:"judge_usage,omitempty"`
+}
+
+// validate checks the rubric and items against the configured limits
+func (req *EvalRequest) validate(cfg EvalConfig) error {
+    switch req.Rubric {
+    case rubricExact, rubricNormalized, rubricF1:
+    case rubricJudge:
+        if cfg.JudgeModel == "" {
+            return fmt.Errorf("rubric %s is not available: no judge model is configured", rubricJudge)
+        }
+    default:
+        return fmt.Errorf("rubric must be one of %s, %s, %s, %s", rubricExact, rubricNormalized, rubricF1, rubricJudge)
+    }
+    if len(req.Items) == 0 {
+        return fmt.Errorf("at least one item is required")
+    }
+    if len(req.Items) > cfg.MaxItems {
+        return fmt.Errorf("at most %d items can be scored per request", cfg.MaxItems)
+    }
+    for i, item := range req.Items {
+        if item.Reference == "" {
+            return fmt.Errorf("items[%d]: reference is required", i)
+        }
+        if req.Rubric == rubricJudge && item.Prompt == "" {
+            return fmt.Errorf("items[%d]: prompt is required for %s", i, rubricJudge)
+        }
+    }
+    return nil
+}
+
+// evalTokens lowercases text and splits it into words, dropping punctuation
+func evalTokens(text string) []string {
+    return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+    })
+}
+
+// tokenF1 is the SQuAD-style token-overlap F1 of generated against reference
+func tokenF1(generated, reference string) float64 {
+    gen, ref := evalTokens(generated), evalTokens(reference)
+    if len(gen) == 0 || len(ref) == 0 {
+        if len(gen) == len(ref) {
+            return 1
+        }
+        return 0
+    }
+
+    counts := make(map[string]int, len(ref))
+    for _, token := range ref {
+        counts[token]++
+    }
+    common := 0
+    for _, token := range gen {
+        if counts[token] > 0 {
+            counts[token]--
+            common++
+        }
+    }
+    if common == 0 {
+        return 0
+    }
+    precision := float64(common) / float64(len(gen))
+    recall := float64(common) / float64(len(ref))
+    return 2 * precision * recall / (precision + recall)
+}
+
+// scoreMatch scores an item with one of the deterministic rubrics
+func scoreMatch(rubric string, item EvalItem) float64 {
+    var match bool
+    switch rubric {
+    case rubricExact:
+        match = strings.TrimSpace(item.Generated) == strings.TrimSpace(item.Reference)
+    case rubricNormalized:
+        match = strings.Join(evalTokens(item.Generated), " ") == strings.Join(evalTokens(item.Reference), " ")
+    case rubricF1:
+        return tokenF1(item.Generated, item.Reference)
+    }
+    if match {
+        return 1
+    }
+    return 0
+}
+
+// judgeTool constrains the judge to an integer score and a rationale
+func judgeTool() ToolSpec {
+    return ToolSpec{
+        Name:        judgeToolName,
+        Description: "Record the score for the candidate answer",
+        InputSchema: map[string]interface{}{
+            "type": "object",
+            "properties": map[string]interface{}{
+                "score": map[string]interface{}{
+                    "type":    "integer",
+                    "minimum": 1,
+                    "maximum": 5,
+                },
+                "rationale": map[string]interface{}{
+                    "type":        "string",
+                    "description": "One to three sentences justifying the score",
+                },
+            },
+            "required": []string{"score", "rationale"},
+        },
+    }
+}
+
+// buildJudgePrompt renders the fixed scoring prompt (judgePromptVersion)
+func buildJudgePrompt(item EvalItem) string {
+    var sb strings.Builder
+    sb.WriteString("Score how well the candidate answer responds to the question, using the reference answer as the ground truth.\n\n")
+    sb.WriteString("Scale:\n")
+    sb.WriteString("5 - Fully correct and complete; equivalent to the reference\n")
+    sb.WriteString("4 - Correct with minor omissions or imprecision\n")
+    sb.WriteString("3 - Partially correct; important details missing or wrong\n")
+    sb.WriteString("2 - Mostly incorrect, with some relevant content\n")
+    sb.WriteString("1 - Incorrect, irrelevant or empty\n\n")
+    sb.WriteString("Judge substance, not wording or style. Do not reward length.\n\n")
+    sb.WriteString("<question>\n" + item.Prompt + "\n</question>\n\n")
+    sb.WriteString("<reference>\n" + item.Reference + "\n</reference>\n\n")
+    sb.WriteString("<candidate>\n" + item.Generated + "\n</candidate>\n\n")
+    sb.WriteString(fmt.Sprintf("Respond by calling the %s tool.", judgeToolName))
+    return sb.String()
+}
+
+// parseJudgement validates the judge's tool output
+func parseJudgement(input json.RawMessage) (float64, string, error) {
+    var output struct {
+        Score     float64 `json:"score"`
+        Rationale string  `json:"rationale"`
+    }
+    if err := json.Unmarshal(input, &output); err != nil {
+        return 0, "", fmt.Errorf("invalid tool input: %v", err)
+    }
+    if output.Score < 1 || output.Score > 5 || output.Score != math.Trunc(output.Score) {
+        return 0, "", fmt.Errorf("score %v is not an integer from 1 to 5", output.Score)
+    }
+    return output.Score, output.Rationale, nil
+}
+
+// judgeOne scores a single item with the judge model, retrying invalid output.
+// Usage from every attempt is returned, including the ones that were retried.
+func (bc *BedrockClient) judgeOne(ctx context.Context, judgeModel string, index int, item EvalItem) (EvalScore, ToolUsage) {
+    result := EvalScore{Index: index, ID: item.ID}
+    var total ToolUsage
+
+    call := ToolCall{
+        System:         "You are a strict, consistent grader of answers against a reference.",
+        Prompt:         buildJudgePrompt(item),
+        PreferredModel: judgeModel,
+        MaxTokens:      500,
+        Temperature:    0,
+        Tool:           judgeTool(),
+        Origin:         originUser,
+    }
+
+    var lastErr error
+    for attempt := 1; attempt <= judgeMaxAttempts; attempt++ {
+        result.Attempts = attempt
+
+        input, modelUsed, usage, err := bc.InvokeToolUsage(ctx, call)
+        total.InputTokens += usage.InputTokens
+        total.OutputTokens += usage.OutputTokens
+        if err != nil {
+            logWarnf(ctx, "Judging of eval item %d failed: %v", index, err)
+            metrics.Inc("eval_judge_errors_total", "reason", "invocation")
+            result.Error = "judge invocation failed"
+            return result, total
+        }
+
+        score, rationale, err := parseJudgement(input)
+        if err != nil {
+            lastErr = err
+            logWarnf(ctx, "Invalid judgement for eval item %d (attempt %d): %v", index, attempt, err)
+            metrics.Inc("eval_judge_invalid_output_total", "model", modelUsed)
+            continue
+        }
+
+        result.Score = &score
+        result.Rationale = rationale
+        result.JudgeModel = modelUsed
+        return result, total
+    }
+
+    metrics.Inc("eval_judge_errors_total", "reason", "invalid_output")
+    result.Error = fmt.Sprintf("judge did not return a valid score after %d attempts: %v", judgeMaxAttempts, lastErr)
+    return result, total
+}
+
+// Score scores every item, running judge calls concurrently with a bounded
+// pool and preserving input order in the results
+func (bc *BedrockClient) Score(ctx context.Context, cfg EvalConfig, req *EvalRequest) EvalResponse {
+    resp := EvalResponse{
+        Settings: EvalSettings{Rubric: req.Rubric},
+        Results:  make([]EvalScore, len(req.Items)),
+    }
+
+    if req.Rubric != rubricJudge {
+        for i, item := range req.Items {
+            score := scoreMatch(req.Rubric, item)
+            resp.Results[i] = EvalScore{Index: i, ID: item.ID, Score: &score}
+        }
+    } else {
+        temperature := 0.0
+        resp.Settings.JudgeModel = cfg.JudgeModel
+        resp.Settings.JudgePromptVersion = judgePromptVersion
+        resp.Settings.Temperature = &temperature
+        resp.JudgeUsage = &ToolUsage{}
+
+        var mu sync.Mutex
+        sem := make(chan struct{}, cfg.Concurrency)
+        var wg sync.WaitGroup
+        for i, item := range req.Items {
+            wg.Add(1)
+            go func(i int, item EvalItem) {
+                defer wg.Done()
+                sem <- struct{}{}
+                defer func() { <-sem }()
+                score, usage := bc.judgeOne(ctx, cfg.JudgeModel, i, item)
+                resp.Results[i] = score
+
+                mu.Lock()
+                resp.JudgeUsage.InputTokens += usage.InputTokens
+                resp.JudgeUsage.OutputTokens += usage.OutputTokens
+                mu.Unlock()
+            }(i, item)
+        }
+        wg.Wait()
+
+        metrics.Add("eval_judge_input_tokens_total", float64(resp.JudgeUsage.InputTokens))
+        metrics.Add("eval_judge_output_tokens_total", float64(resp.JudgeUsage.OutputTokens))
+    }
+
+    resp.Aggregate = aggregateScores(resp.Results)
+    return resp
+}
+
+// aggregateScores computes summary statistics over the scored items
+func aggregateScores(results []EvalScore) EvalAggregate {
+    agg := EvalAggregate{Items: len(results)}
+    var sum, sumSquares float64
+    for _, result := range results {
+        if result.Score == nil {
+            agg.Errors++
+            continue
+        }
+        score := *result.Score
+        if agg.Scored == 0 || score < agg.Min {
+            agg.Min = score
+        }
+        if agg.Scored == 0 || score > agg.Max {
+            agg.Max = score
+        }
+        agg.Scored++
+        sum += score
+        sumSquares += score * score
+    }
+    if agg.Scored > 0 {
+        n := float64(agg.Scored)
+        agg.Mean = sum / n
+        agg.StdDev = math.Sqrt(math.Max(0, sumSquares/n-agg.Mean*agg.Mean))
+    }
+    return agg
+}
+
+func evalScoreHandler(bc *BedrockClient, cfg EvalConfig) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req EvalRequest
+
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+
+        if err := req.validate(cfg); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, err.Error())
+            return
+        }
+
+        logInfof(r.Context(), "Received eval request: %d item(s), rubric %s", len(req.Items), req.Rubric)
+        metrics.Add("eval_items_total", float64(len(req.Items)), "rubric", req.Rubric)
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(bc.Score(r.Context(), cfg, &req))
+    }
+}
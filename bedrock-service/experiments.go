@@ -0,0 +1,518 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+    "os"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Units experiments are assigned by
+const (
+    assignByUser         = "user"
+    assignByConversation = "conversation"
+)
+
+// ExperimentVariant is one arm of an experiment. Unset overrides leave the
+// request as it was, so a variant with none is the control.
+type ExperimentVariant struct {
+    Name        string   `json:"name"`
+    Weight      float64  `json:"weight"`
+    Model       string   `json:"model,omitempty"`
+    System      string   `json:"system,omitempty"` // Replaces the built-in system prompt
+    MaxTokens   int      `json:"max_tokens,omitempty"`
+    Temperature *float64 `json:"temperature,omitempty"`
+}
+
+// ExperimentConfig is one entry of the EXPERIMENTS_FILE list
+type ExperimentConfig struct {
+    Name     string              `json:"name"`
+    Enabled  bool                `json:"enabled"`
+    AssignBy string              `json:"assign_by"`         // user or conversation
+    Traffic  float64             `json:"traffic,omitempty"` // Fraction of units enrolled, defaults to 1
+    Salt     string              `json:"salt,omitempty"`    // Defaults to the name; change it to reshuffle units
+    Variants []ExperimentVariant `json:"variants"`
+}
+
+// validateExperimentConfigs rejects definitions whose assignment would be ambiguous
+func validateExperimentConfigs(configs []ExperimentConfig) error {
+    names := make(map[string]bool)
+    for i, cfg := range configs {
+        if cfg.Name == "" {
+            return fmt.Errorf("experiments[%d]: name is required", i)
+        }
+        if names[cfg.Name] {
+            return fmt.Errorf("experiments[%d]: duplicate experiment name %q", i, cfg.Name)
+        }
+        names[cfg.Name] = true
+
+        if cfg.AssignBy != assignByUser && cfg.AssignBy != assignByConversation {
+            return fmt.Errorf("experiments[%d] (%s): assign_by must be %q or %q", i, cfg.Name, assignByUser, assignByConversation)
+        }
+        if cfg.Traffic < 0 || cfg.Traffic > 1 {
+            return fmt.Errorf("experiments[%d] (%s): traffic must be between 0 and 1", i, cfg.Name)
+        }
+        if len(cfg.Variants) < 2 {
+            return fmt.Errorf("experiments[%d] (%s): at least two variants are required", i, cfg.Name)
+        }
+        variants := make(map[string]bool)
+        for j, v := range cfg.Variants {
+            if v.Name == "" || variants[v.Name] {
+                return fmt.Errorf("experiments[%d] (%s): variants[%d] needs a unique name", i, cfg.Name, j)
+            }
+            variants[v.Name] = true
+            if v.Weight <= 0 || math.IsInf(v.Weight, 0) || math.IsNaN(v.Weight) {
+                return fmt.Errorf("experiments[%d] (%s): variant %s weight must be a positive number", i, cfg.Name, v.Name)
+            }
+            if v.MaxTokens < 0 {
+                return fmt.Errorf("experiments[%d] (%s): variant %s max_tokens must not be negative", i, cfg.Name, v.Name)
+            }
+        }
+    }
+    return nil
+}
+
+// ExperimentAssignment is reported in response meta
+type ExperimentAssignment struct {
+    Experiment string `json:"experiment"`
+    Variant    string `json:"variant"`
+}
+
+// ExperimentUnit identifies who is being assigned
+type ExperimentUnit struct {
+    UserID         string
+    ConversationID string
+}
+
+// variantStats are the counters kept per experiment variant
+type variantStats struct {
+    requests     int
+    errors       int
+    latency      time.Duration
+    inputTokens  int
+    outputTokens int
+    outcomes     map[string]*outcomeStats
+}
+
+type outcomeStats struct {
+    count int
+    sum   float64
+}
+
+// experiment is a configured experiment with its live kill switch and counters
+type experiment struct {
+    cfg     ExperimentConfig
+    enabled bool
+    stats   map[string]*variantStats
+}
+
+// Experiments assigns requests to experiment variants and tracks how each performs
+type Experiments struct {
+    mu   sync.Mutex
+    list []*experiment // Config order, which is also the order overrides apply in
+}
+
+// LoadExperiments reads the EXPERIMENTS_FILE list; without it no experiments run
+func LoadExperiments() (*Experiments, error) {
+    e := &Experiments{}
+    path := os.Getenv("EXPERIMENTS_FILE")
+    if path == "" {
+        return e, nil
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("unable to read EXPERIMENTS_FILE: %v", err)
+    }
+    var configs []ExperimentConfig
+    if err := json.Unmarshal(data, &configs); err != nil {
+        return nil, fmt.Errorf("invalid EXPERIMENTS_FILE: %v", err)
+    }
+    if err := validateExperimentConfigs(configs); err != nil {
+        return nil, fmt.Errorf("invalid EXPERIMENTS_FILE: %v", err)
+    }
+
+    for _, cfg := range configs {
+        if cfg.Traffic == 0 {
+            cfg.Traffic = 1
+        }
+        if cfg.Salt == "" {
+            cfg.Salt = cfg.Name
+        }
+        exp := &experiment{cfg: cfg, enabled: cfg.Enabled, stats: make(map[string]*variantStats)}
+        for _, v := range cfg.Variants {
+            exp.stats[v.Name] = &variantStats{outcomes: make(map[string]*outcomeStats)}
+        }
+        e.list = append(e.list, exp)
+        log.Printf("Experiment %s: %d variants by %s, %.0f%% of traffic (enabled: %v)",
+            cfg.Name, len(cfg.Variants), cfg.AssignBy, cfg.Traffic*100, cfg.Enabled)
+    }
+    return e, nil
+}
+
+func (e *Experiments) find(name string) *experiment {
+    for _, exp := range e.list {
+        if exp.cfg.Name == name {
+            return exp
+        }
+    }
+    return nil
+}
+
+// bucket maps a unit to a stable point in [0, 1) for this experiment's salt
+func (exp *experiment) bucket(unitID string) float64 {
+    sum := sha256.Sum256([]byte(exp.cfg.Salt + ":" + unitID))
+    return float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53)
+}
+
+// assign returns the unit's variant, or nil when it is outside the enrolled traffic
+func (exp *experiment) assign(unit ExperimentUnit) *ExperimentVariant {
+    unitID := unit.UserID
+    if exp.cfg.AssignBy == assignByConversation {
+        unitID = unit.ConversationID
+    }
+    if unitID == "" {
+        return nil
+    }
+
+    point := exp.bucket(unitID)
+    if point >= exp.cfg.Traffic {
+        return nil
+    }
+    // Spread the enrolled range over the variants by weight
+    point /= exp.cfg.Traffic
+
+    total := 0.0
+    for _, v := range exp.cfg.Variants {
+        total += v.Weight
+    }
+    acc := 0.0
+    for i := range exp.cfg.Variants {
+        acc += exp.cfg.Variants[i].Weight / total
+        if point < acc {
+            return &exp.cfg.Variants[i]
+        }
+    }
+    return &exp.cfg.Variants[len(exp.cfg.Variants)-1]
+}
+
+// Apply assigns the unit to every enabled experiment and applies the
+// variants' overrides to params in config order
+func (e *Experiments) Apply(unit ExperimentUnit, p *GenerationParams) []ExperimentAssignment {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    var assignments []ExperimentAssignment
+    for _, exp := range e.list {
+        if !exp.enabled {
+            continue
+        }
+        v := exp.assign(unit)
+        if v == nil {
+            continue
+        }
+
+        if v.Model != "" {
+            p.PreferredModel = v.Model
+        }
+        // A system prompt the caller chose outranks the variant's
+        if v.System != "" && p.SystemPrompt == nil {
+            system := v.System
+            p.SystemPrompt = &system
+        }
+        if v.MaxTokens > 0 {
+            p.MaxTokens = v.MaxTokens
+        }
+        if v.Temperature != nil {
+            p.Temperature = v.Temperature
+        }
+
+        assignments = append(assignments, ExperimentAssignment{Experiment: exp.cfg.Name, Variant: v.Name})
+        metrics.Inc("experiment_exposures_total", "experiment", exp.cfg.Name, "variant", v.Name)
+        log.Printf("Experiment %s: %s %s assigned to variant %s", exp.cfg.Name, exp.cfg.AssignBy, unitLabel(exp, unit), v.Name)
+    }
+    return assignments
+}
+
+// unitLabel is the unit ID shown in logs
+func unitLabel(exp *experiment, unit ExperimentUnit) string {
+    if exp.cfg.AssignBy == assignByConversation {
+        return unit.ConversationID
+    }
+    return unit.UserID
+}
+
+// ExperimentResult is how a request with assignments went
+type ExperimentResult struct {
+    Latency      time.Duration
+    Failed       bool
+    InputTokens  int
+    OutputTokens int
+}
+
+// Record adds a request's result to the counters of each assigned variant
+func (e *Experiments) Record(assignments []ExperimentAssignment, result ExperimentResult) {
+    if len(assignments) == 0 {
+        return
+    }
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    for _, a := range assignments {
+        exp := e.find(a.Experiment)
+        if exp == nil {
+            continue
+        }
+        s := exp.stats[a.Variant]
+        s.requests++
+        if result.Failed {
+            s.errors++
+        }
+        s.latency += result.Latency
+        s.inputTokens += result.InputTokens
+        s.outputTokens += result.OutputTokens
+    }
+}
+
+// errNotEnrolled is returned for outcomes of units the experiment never assigned
+var errNotEnrolled = fmt.Errorf("unit is not enrolled in the experiment")
+
+// RecordOutcome attributes a caller-reported outcome event to the unit's
+// variant. Assignment is deterministic, so the variant is recomputed rather
+// than looked up.
+func (e *Experiments) RecordOutcome(name string, unit ExperimentUnit, event string, value float64) (string, bool, error) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    exp := e.find(name)
+    if exp == nil {
+        return "", false, nil
+    }
+    v := exp.assign(unit)
+    if v == nil {
+        return "", true, errNotEnrolled
+    }
+
+    s := exp.stats[v.Name]
+    o, ok := s.outcomes[event]
+    if !ok {
+        o = &outcomeStats{}
+        s.outcomes[event] = o
+    }
+    o.count++
+    o.sum += value
+    metrics.Inc("experiment_outcomes_total", "experiment", name, "variant", v.Name, "event", event)
+    return v.Name, true, nil
+}
+
+// SetEnabled flips an experiment's kill switch
+func (e *Experiments) SetEnabled(name string, enabled bool) bool {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    exp := e.find(name)
+    if exp == nil {
+        return false
+    }
+    if exp.enabled != enabled {
+        log.Printf("Experiment %s enabled: %v -> %v", name, exp.enabled, enabled)
+    }
+    exp.enabled = enabled
+    return true
+}
+
+// ExperimentState is an experiment's configuration and kill switch
+type ExperimentState struct {
+    Name     string
+    Enabled  bool
+    Traffic  float64
+    Variants []string
+}
+
+// States lists the experiments in config order
+func (e *Experiments) States() []ExperimentState {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    states := make([]ExperimentState, 0, len(e.list))
+    for _, exp := range e.list {
+        state := ExperimentState{Name: exp.cfg.Name, Enabled: exp.enabled, Traffic: exp.cfg.Traffic}
+        for _, v := range exp.cfg.Variants {
+            state.Variants = append(state.Variants, v.Name)
+        }
+        states = append(states, state)
+    }
+    return states
+}
+
+// OutcomeSummary aggregates one outcome event for a variant
+type OutcomeSummary struct {
+    Count      int     `json:"count"`
+    ValueSum   float64 `json:"value_sum"`
+    PerRequest float64 `json:"per_request"` // count / requests
+}
+
+// VariantReport summarizes one variant of an experiment
+type VariantReport struct {
+    Variant         string                    `json:"variant"`
+    Requests        int                       `json:"requests"`
+    Errors          int                       `json:"errors"`
+    ErrorRate       float64                   `json:"error_rate"`
+    AvgLatencyMs    float64                   `json:"avg_latency_ms"`
+    InputTokens     int                       `json:"input_tokens"`
+    OutputTokens    int                       `json:"output_tokens"`
+    AvgOutputTokens float64                   `json:"avg_output_tokens"`
+    Outcomes        map[string]OutcomeSummary `json:"outcomes,omitempty"`
+}
+
+// ExperimentReport is returned by GET /admin/experiments/{name}/report
+type ExperimentReport struct {
+    Experiment string          `json:"experiment"`
+    Enabled    bool            `json:"enabled"`
+    AssignBy   string          `json:"assign_by"`
+    Traffic    float64         `json:"traffic"`
+    Variants   []VariantReport `json:"variants"`
+}
+
+// Report summarizes an experiment's counters per variant
+func (e *Experiments) Report(name string) (ExperimentReport, bool) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    exp := e.find(name)
+    if exp == nil {
+        return ExperimentReport{}, false
+    }
+    report := ExperimentReport{
+        Experiment: name,
+        Enabled:    exp.enabled,
+        AssignBy:   exp.cfg.AssignBy,
+        Traffic:    exp.cfg.Traffic,
+    }
+    for _, v := range exp.cfg.Variants {
+        s := exp.stats[v.Name]
+        vr := VariantReport{
+            Variant:      v.Name,
+            Requests:     s.requests,
+            Errors:       s.errors,
+            InputTokens:  s.inputTokens,
+            OutputTokens: s.outputTokens,
+        }
+        if s.requests > 0 {
+            n := float64(s.requests)
+            vr.ErrorRate = float64(s.errors) / n
+            vr.AvgLatencyMs = float64(s.latency.Milliseconds()) / n
+            vr.AvgOutputTokens = float64(s.outputTokens) / n
+        }
+        if len(s.outcomes) > 0 {
+            vr.Outcomes = make(map[string]OutcomeSummary, len(s.outcomes))
+            events := make([]string, 0, len(s.outcomes))
+            for event := range s.outcomes {
+                events = append(events, event)
+            }
+            sort.Strings(events)
+            for _, event := range events {
+                o := s.outcomes[event]
+                summary := OutcomeSummary{Count: o.count, ValueSum: o.sum}
+                if s.requests > 0 {
+                    summary.PerRequest = float64(o.count) / float64(s.requests)
+                }
+                vr.Outcomes[event] = summary
+            }
+        }
+        report.Variants = append(report.Variants, vr)
+    }
+    return report, true
+}
+
+func experimentReportHandler(e *Experiments) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        report, ok := e.Report(mux.Vars(r)["name"])
+        if !ok {
+            writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Unknown experiment")
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(report)
+    }
+}
+
+// ExperimentOutcomeRequest is the body of POST /experiments/{name}/outcomes.
+// Exactly the unit the experiment assigns by must be set.
+type ExperimentOutcomeRequest struct {
+    UserID         string  `json:"user_id,omitempty"`
+    ConversationID string  `json:"conversation_id,omitempty"`
+    Event          string  `json:"event"`
+    Value          float64 `json:"value,omitempty"`
+}
+
+func experimentOutcomeHandler(e *Experiments) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req ExperimentOutcomeRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+        if req.Event == "" {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: "event is required",
+                Fields:  []FieldError{{Field: "event", Message: "is required"}},
+            })
+            return
+        }
+        if math.IsInf(req.Value, 0) || math.IsNaN(req.Value) {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "value must be a finite number")
+            return
+        }
+
+        name := mux.Vars(r)["name"]
+        variant, found, err := e.RecordOutcome(name, ExperimentUnit{UserID: req.UserID, ConversationID: req.ConversationID}, req.Event, req.Value)
+        if !found {
+            writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Unknown experiment")
+            return
+        }
+        if err != nil {
+            writeError(w, r, http.StatusUnprocessableEntity, ErrCodeUnprocessable, err.Error())
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusAccepted)
+        json.NewEncoder(w).Encode(ExperimentAssignment{Experiment: name, Variant: variant})
+    }
+}
+
+func experimentToggleHandler(e *Experiments) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req struct {
+            Enabled *bool `json:"enabled"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: "enabled is required",
+                Fields:  []FieldError{{Field: "enabled", Message: "must be true or false"}},
+            })
+            return
+        }
+
+        name := mux.Vars(r)["name"]
+        if !e.SetEnabled(name, *req.Enabled) {
+            writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Unknown experiment")
+            return
+        }
+        report, _ := e.Report(name)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(report)
+    }
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Extraction settings
+const (
+    extractMaxAttempts = 2 // Initial call plus one retry for missing required fields
+    extractToolName    = "record_extraction"
+)
+
+// Supported field types
+const (
+    fieldString  = "string"
+    fieldNumber  = "number"
+    fieldInteger = "integer"
+    fieldBoolean = "boolean"
+    fieldDate    = "date"
+)
+
+// ExtractField describes one field the caller wants pulled out of the text
+type ExtractField struct {
+    Name        string `json:"name"`
+    Type        string `json:"type"`
+    Description string `json:"description,omitempty"`
+    Required    bool   `json:"required,omitempty"`
+}
+
+// ExtractRequest is the body accepted by POST /extract. When Strict is set,
+// missing required fields fail the request instead of returning a partial result.
+type ExtractRequest struct {
+    Text        string         `json:"text"`
+    Fields      []ExtractField `json:"fields"`
+    Strict      bool           `json:"strict,omitempty"`
+    Model       string         `json:"model,omitempty"`
+    Temperature *float64       `json:"temperature,omitempty"` // Defaults to 0
+    Deliver     string         `json:"deliver,omitempty"`     // "s3" returns a presigned URL instead of the result
+}
+
+type FieldResult struct {
+    Found      bool    `json:"found"`
+    Confidence float64 `json:"confidence"`
+}
+
+type ExtractResponse struct {
+    Data      map[string]interface{} `json:"data"`
+    Fields    map[string]FieldResult `json:"fields"`
+    Warnings  []string               `json:"warnings,omitempty"`
+    ModelUsed string                 `json:"model_used"`
+    Attempts  int                    `json:"attempts"`
+}
+
+// validate checks the field schema
+func (req *ExtractRequest) validate() error {
+    if strings.TrimSpace(req.Text) == "" {
+        return fmt.Errorf("text is required")
+    }
+    if len(req.Fields) == 0 {
+        return fmt.Errorf("at least one field is required")
+    }
+
+    seen := make(map[string]bool)
+    for i := range req.Fields {
+        field := &req.Fields[i]
+        if field.Name == "" {
+            return fmt.Errorf("fields[%d]: name is required", i)
+        }
+        if field.Name == "confidence" {
+            return fmt.Errorf("fields[%d]: \"confidence\" is a reserved field name", i)
+        }
+        if seen[field.Name] {
+            return fmt.Errorf("fields[%d]: duplicate field name %s", i, field.Name)
+        }
+        seen[field.Name] = true
+
+        if field.Type == "" {
+            field.Type = fieldString
+        }
+        switch field.Type {
+        case fieldString, fieldNumber, fieldInteger, fieldBoolean, fieldDate:
+        default:
+            return fmt.Errorf("fields[%d]: unsupported type %s", i, field.Type)
+        }
+    }
+    return nil
+}
+
+// extractionTool builds the tool schema; every value is nullable so the model
+// can say a field is absent instead of making one up
+func extractionTool(fields []ExtractField) ToolSpec {
+    properties := make(map[string]interface{})
+    confidence := make(map[string]interface{})
+
+    for _, field := range fields {
+        jsonType := field.Type
+        description := field.Description
+        if field.Type == fieldDate {
+            jsonType = fieldString
+            description = strings.TrimSpace(description + " (date, preferably YYYY-MM-DD)")
+        }
+        properties[field.Name] = map[string]interface{}{
+            "type":        []string{jsonType, "null"},
+            "description": description,
+        }
+        confidence[field.Name] = map[string]interface{}{"type": "number", "minimum": 0, "maximum": 1}
+    }
+    properties["confidence"] = map[string]interface{}{
+        "type":        "object",
+        "description": "Confidence between 0 and 1 for each extracted field",
+        "properties":  confidence,
+    }
+
+    return ToolSpec{
+        Name:        extractToolName,
+        Description: "Record the fields extracted from the text. Use null for anything not present.",
+        InputSchema: map[string]interface{}{
+            "type":       "object",
+            "properties": properties,
+            "required":   []string{"confidence"},
+        },
+    }
+}
+
+// buildExtractionPrompt renders the instruction prompt, naming fields that a previous attempt missed
+func buildExtractionPrompt(req *ExtractRequest, missing []string) string {
+    var sb strings.Builder
+    sb.WriteString("Extract the following fields from the text below:\n")
+    for _, field := range req.Fields {
+        required := ""
+        if field.Required {
+            required = ", required"
+        }
+        sb.WriteString(fmt.Sprintf("- %s (%s%s): %s\n", field.Name, field.Type, required, field.Description))
+    }
+    sb.WriteString(fmt.Sprintf("\nRespond by calling the %s tool. Use null when a value is not present in the text; never guess.\n", extractToolName))
+    if len(missing) > 0 {
+        sb.WriteString(fmt.Sprintf("A previous attempt did not find these required fields, look for them carefully: %s\n",
+            strings.Join(missing, ", ")))
+    }
+    sb.WriteString("\nText:\n")
+    sb.WriteString(req.Text)
+    return sb.String()
+}
+
+var dateLayouts = []string{
+    time.RFC3339,
+    "2006-01-02",
+    "2006/01/02",
+    "01/02/2006",
+    "1/2/2006",
+    "02.01.2006",
+    "January 2, 2006",
+    "Jan 2, 2006",
+    "2 January 2006",
+    "2 Jan 2006",
+    "January 2 2006",
+}
+
+var numberCleaner = regexp.MustCompile(`[^0-9.\-eE+]`)
+
+// coerceField converts a raw extracted value to the field's declared type
+func coerceField(field ExtractField, raw interface{}) (interface{}, error) {
+    if raw == nil {
+        return nil, nil
+    }
+
+    switch field.Type {
+    case fieldString:
+        if s, ok := raw.(string); ok {
+            return s, nil
+        }
+        return fmt.Sprint(raw), nil
+
+    case fieldNumber, fieldInteger:
+        var n float64
+        switch v := raw.(type) {
+        case float64:
+            n = v
+        case string:
+            // Strip currency symbols and thousands separators, e.g. "$1,234.50"
+            cleaned := numberCleaner.ReplaceAllString(v, "")
+            parsed, err := strconv.ParseFloat(cleaned, 64)
+            if err != nil {
+                return nil, fmt.Errorf("cannot parse %q as a number", v)
+            }
+            n = parsed
+        default:
+            return nil, fmt.Errorf("unexpected %T for a number", raw)
+        }
+        if field.Type == fieldInteger {
+            return int64(n), nil
+        }
+        return n, nil
+
+    case fieldBoolean:
+        switch v := raw.(type) {
+        case bool:
+            return v, nil
+        case string:
+            parsed, err := strconv.ParseBool(strings.ToLower(strings.TrimSpace(v)))
+            if err != nil {
+                return nil, fmt.Errorf("cannot parse %q as a boolean", v)
+            }
+            return parsed, nil
+        }
+        return nil, fmt.Errorf("unexpected %T for a boolean", raw)
+
+    case fieldDate:
+        s, ok := raw.(string)
+        if !ok {
+            return nil, fmt.Errorf("unexpected %T for a date", raw)
+        }
+        s = strings.TrimSpace(s)
+        for _, layout := range dateLayouts {
+            if t, err := time.Parse(layout, s); err == nil {
+                return t.Format(time.RFC3339), nil
+            }
+        }
+        return nil, fmt.Errorf("cannot parse %q as a date", s)
+    }
+    return raw, nil
+}
+
+// applyExtraction coerces the tool output into the response and returns the missing required fields
+func applyExtraction(req *ExtractRequest, input json.RawMessage, resp *ExtractResponse) ([]string, error) {
+    var output map[string]interface{}
+    if err := json.Unmarshal(input, &output); err != nil {
+        return nil, fmt.Errorf("invalid tool input: %v", err)
+    }
+    confidence, _ := output["confidence"].(map[string]interface{})
+
+    resp.Data = make(map[string]interface{}, len(req.Fields))
+    resp.Fields = make(map[string]FieldResult, len(req.Fields))
+    resp.Warnings = nil
+
+    var missing []string
+    for _, field := range req.Fields {
+        value, err := coerceField(field, output[field.Name])
+        if err != nil {
+            resp.Warnings = append(resp.Warnings, fmt.Sprintf("%s: %v", field.Name, err))
+            value = nil
+        }
+
+        result := FieldResult{Found: value != nil}
+        if result.Found {
+            if c, ok := confidence[field.Name].(float64); ok {
+                result.Confidence = c
+            }
+        } else if field.Required {
+            missing = append(missing, field.Name)
+        }
+
+        resp.Data[field.Name] = value
+        resp.Fields[field.Name] = result
+    }
+    return missing, nil
+}
+
+// Extract runs the extraction, retrying once when required fields are missing
+func (bc *BedrockClient) Extract(ctx context.Context, req *ExtractRequest) (*ExtractResponse, []string, error) {
+    temperature := 0.0
+    if req.Temperature != nil {
+        temperature = *req.Temperature
+    }
+
+    resp := &ExtractResponse{}
+    var missing []string
+    for attempt := 1; attempt <= extractMaxAttempts; attempt++ {
+        resp.Attempts = attempt
+
+        input, modelUsed, err := bc.InvokeTool(ctx, ToolCall{
+            System:         "You extract structured data from documents. You never invent values that are not in the text.",
+            Prompt:         buildExtractionPrompt(req, missing),
+            PreferredModel: req.Model,
+            MaxTokens:      2000,
+            Temperature:    temperature,
+            Tool:           extractionTool(req.Fields),
+            Origin:         originUser,
+        })
+        if err != nil {
+            return nil, nil, err
+        }
+        resp.ModelUsed = modelUsed
+
+        missing, err = applyExtraction(req, input, resp)
+        if err != nil {
+            logWarnf(ctx, "Invalid extraction output (attempt %d): %v", attempt, err)
+            continue
+        }
+        if len(missing) == 0 {
+            return resp, nil, nil
+        }
+        logInfof(ctx, "Extraction attempt %d missing required fields: %s", attempt, strings.Join(missing, ", "))
+    }
+
+    if resp.Data == nil {
+        return nil, nil, fmt.Errorf("model did not return a valid extraction")
+    }
+    return resp, missing, nil
+}
+
+func extractHandler(bc *BedrockClient, results *ResultStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req ExtractRequest
+
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+
+        if err := req.validate(); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, err.Error())
+            return
+        }
+        if err := checkDeliver(req.Deliver, results); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, err.Error())
+            return
+        }
+
+        logInfof(r.Context(), "Received extraction request: %d field(s), %d chars (strict: %v)",
+            len(req.Fields), len(req.Text), req.Strict)
+
+        resp, missing, err := bc.Extract(r.Context(), &req)
+        if err != nil {
+            logErrorf(r.Context(), "Error extracting fields: %v", err)
+            writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Error extracting fields: %v", err))
+            return
+        }
+
+        if len(missing) > 0 {
+            if req.Strict {
+                writeError(w, r, http.StatusUnprocessableEntity, ErrCodeUnprocessable,
+                    fmt.Sprintf("Required fields not found: %s", strings.Join(missing, ", ")))
+                return
+            }
+            resp.Warnings = append(resp.Warnings,
+                fmt.Sprintf("required fields not found: %s", strings.Join(missing, ", ")))
+        }
+
+        if req.Deliver == deliverS3 {
+            writeDelivered(w, r, results, resp)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(resp)
+    }
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws/protocol/eventstream"
+)
+
+// fakeBedrock is an in-process Bedrock runtime for the e2e tests. The
+// service reaches it through BEDROCK_ENDPOINT_URL, so every call still goes
+// through the SDK: signing, serialization, error decoding and event
+// streams. Tests script the replies of each model; a model with nothing
+// scripted answers like one the account has no access to.
+type fakeBedrock struct {
+    *httptest.Server
+
+    mu      sync.Mutex
+    replies map[string][]fakeReply // Model ID -> replies still to give, in order
+    calls   []fakeCall
+}
+
+// fakeReply is one scripted answer
+type fakeReply struct {
+    Status int           // HTTP status, 200 when 0 and no Error is set
+    Error  string        // Error type sent in X-Amzn-ErrorType, like ThrottlingException
+    Body   string        // InvokeModel or Converse body, sent as is, so it may be malformed
+    Chunks []string      // Stream chunks, each sent as is as one event's bytes
+    Delay  time.Duration // Before answering, and between the chunks of a stream
+
+    InputTokens, OutputTokens int // InvokeModel's usage headers
+}
+
+// fakeCall is one request the fake received
+type fakeCall struct {
+    Operation string // invoke, invoke-with-response-stream or converse
+    ModelID   string
+    Body      []byte
+}
+
+func newFakeBedrock() *fakeBedrock {
+    f := &fakeBedrock{replies: make(map[string][]fakeReply)}
+    f.Server = httptest.NewServer(f)
+    return f
+}
+
+// Script queues replies for a model
+func (f *fakeBedrock) Script(modelID string, replies ...fakeReply) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.replies[modelID] = append(f.replies[modelID], replies...)
+}
+
+// Reset drops scripted replies and recorded calls
+func (f *fakeBedrock) Reset() {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.replies = make(map[string][]fakeReply)
+    f.calls = nil
+}
+
+// Calls returns the requests made to a model
+func (f *fakeBedrock) Calls(modelID string) []fakeCall {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    var calls []fakeCall
+    for _, call := range f.calls {
+        if call.ModelID == modelID {
+            calls = append(calls, call)
+        }
+    }
+    return calls
+}
+
+func (f *fakeBedrock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    modelID, operation, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/model/"), "/")
+    if !ok || r.Method != http.MethodPost {
+        fakeError(w, http.StatusNotFound, "UnknownOperationException", "no such operation "+r.URL.Path)
+        return
+    }
+    body, _ := io.ReadAll(r.Body)
+
+    f.mu.Lock()
+    f.calls = append(f.calls, fakeCall{Operation: operation, ModelID: modelID, Body: body})
+    queue := f.replies[modelID]
+    var reply fakeReply
+    scripted := len(queue) > 0
+    if scripted {
+        reply, f.replies[modelID] = queue[0], queue[1:]
+    }
+    f.mu.Unlock()
+
+    if !scripted {
+        fakeError(w, http.StatusForbidden, "AccessDeniedException", "You don't have access to the model with the specified model ID.")
+        return
+    }
+    if reply.Delay > 0 && len(reply.Chunks) == 0 {
+        select {
+        case <-time.After(reply.Delay):
+        case <-r.Context().Done():
+            return
+        }
+    }
+    if reply.Error != "" {
+        status := reply.Status
+        if status == 0 {
+            status = http.StatusBadRequest
+        }
+        fakeError(w, status, reply.Error, reply.Body)
+        return
+    }
+
+    switch operation {
+    case "invoke", "converse":
+        w.Header().Set("Content-Type", "application/json")
+        if reply.InputTokens > 0 || reply.OutputTokens > 0 {
+            w.Header().Set("X-Amzn-Bedrock-Input-Token-Count", fmt.Sprint(reply.InputTokens))
+            w.Header().Set("X-Amzn-Bedrock-Output-Token-Count", fmt.Sprint(reply.OutputTokens))
+        }
+        if reply.Status != 0 {
+            w.WriteHeader(reply.Status)
+        }
+        io.WriteString(w, reply.Body)
+    case "invoke-with-response-stream":
+        f.stream(w, r, reply)
+    default:
+        fakeError(w, http.StatusNotFound, "UnknownOperationException", "no such operation "+operation)
+    }
+}
+
+// stream writes the reply's chunks as an event stream, flushing each one
+func (f *fakeBedrock) stream(w http.ResponseWriter, r *http.Request, reply fakeReply) {
+    w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+    w.WriteHeader(http.StatusOK)
+    encoder := eventstream.NewEncoder()
+    for i, chunk := range reply.Chunks {
+        if i > 0 && reply.Delay > 0 {
+            select {
+            case <-time.After(reply.Delay):
+            case <-r.Context().Done():
+                return
+            }
+        }
+        payload, _ := json.Marshal(map[string]string{"bytes": base64.StdEncoding.EncodeToString([]byte(chunk))})
+        message := eventstream.Message{
+            Headers: eventstream.Headers{
+                {Name: ":message-type", Value: eventstream.StringValue("event")},
+                {Name: ":event-type", Value: eventstream.StringValue("chunk")},
+                {Name: ":content-type", Value: eventstream.StringValue("application/json")},
+            },
+            Payload: payload,
+        }
+        if err := encoder.Encode(w, message); err != nil {
+            return
+        }
+        w.(http.Flusher).Flush()
+    }
+}
+
+// fakeError answers the way Bedrock's REST JSON protocol reports errors
+func fakeError(w http.ResponseWriter, status int, errorType, message string) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("X-Amzn-ErrorType", errorType)
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+// throttled is the reply of a model out of quota
+func throttled() fakeReply {
+    return fakeReply{Status: http.StatusTooManyRequests, Error: "ThrottlingException", Body: "Too many requests, please wait before trying again."}
+}
+
+// claudeMessage is an Anthropic messages InvokeModel body
+func claudeMessage(text string) fakeReply {
+    body, _ := json.Marshal(map[string]interface{}{
+        "id":            "msg_fake",
+        "type":          "message",
+        "role":          "assistant",
+        "model":         "claude-fake",
+        "content":       []map[string]string{{"type": "text", "text": text}},
+        "stop_reason":   "end_turn",
+        "stop_sequence": nil,
+        "usage":         map[string]int{"input_tokens": 12, "output_tokens": 7},
+    })
+    return fakeReply{Body: string(body)}
+}
+
+// converseMessage is a Converse body
+func converseMessage(text string) fakeReply {
+    body, _ := json.Marshal(map[string]interface{}{
+        "output":     map[string]interface{}{"message": map[string]interface{}{"role": "assistant", "content": []map[string]string{{"text": text}}}},
+        "stopReason": "end_turn",
+        "usage":      map[string]int{"inputTokens": 12, "outputTokens": 7, "totalTokens": 19},
+        "metrics":    map[string]int{"latencyMs": 5},
+    })
+    return fakeReply{Body: string(body)}
+}
+
+// claudeStream is an Anthropic messages stream sending text in pieces
+func claudeStream(pieces ...string) fakeReply {
+    chunks := []string{`{"type":"message_start","message":{"id":"msg_fake","type":"message","role":"assistant","usage":{"input_tokens":12,"output_tokens":1}}}`,
+        `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`}
+    for _, piece := range pieces {
+        delta, _ := json.Marshal(map[string]interface{}{"type": "content_block_delta", "index": 0, "delta": map[string]string{"type": "text_delta", "text": piece}})
+        chunks = append(chunks, string(delta))
+    }
+    chunks = append(chunks,
+        `{"type":"content_block_stop","index":0}`,
+        `{"type":"message_delta","delta":{"stop_reason":"end_turn","stop_sequence":null},"usage":{"output_tokens":7}}`,
+        `{"type":"message_stop"}`)
+    return fakeReply{Chunks: chunks}
+}
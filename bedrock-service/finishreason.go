@@ -0,0 +1,139 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log"
+)
+
+// Normalized finish reasons returned as finish_reason. The provider's own
+// value is passed through as finish_reason_raw.
+const (
+    finishCompleted    = "completed"     // The model finished on its own
+    finishLengthCapped = "length_capped" // max_tokens was reached
+    finishStopSequence = "stop_sequence" // A caller-supplied stop sequence matched
+    finishFiltered     = "filtered"      // Output was withheld by content filtering
+    finishToolUse      = "tool_use"      // The model stopped to call a tool
+    finishError        = "error"         // The invocation or stream failed
+    finishDeadline     = "deadline"      // The request ran out of time
+    finishBudget       = "budget"        // A conversation's reserved output capped the reply
+    finishOther        = "other"         // Raw value not in the provider's table
+)
+
+// Providers with their own stop reason vocabulary
+const (
+    providerAnthropicMessages = "anthropic_messages"
+    providerAnthropicLegacy   = "anthropic_legacy"
+    providerAI21Jamba         = "ai21_jamba"
+    providerAmazonTitan       = "amazon_titan"
+    providerMetaLlama         = "meta_llama"
+    providerMistral           = "mistral" // Both Mistral formats
+    providerCohere            = "cohere"
+    providerAmazonNova        = "amazon_nova"
+    providerConverse          = "converse" // The same for every model behind the Converse API
+)
+
+// finishReasonTables maps each provider's raw stop reasons to the normalized set
+var finishReasonTables = map[string]map[string]string{
+    providerAnthropicMessages: {
+        "end_turn":             finishCompleted,
+        "max_tokens":           finishLengthCapped,
+        "stop_sequence":        finishStopSequence,
+        "tool_use":             finishToolUse,
+        "refusal":              finishFiltered,
+        "content_filtered":     finishFiltered,
+        "guardrail_intervened": finishFiltered,
+    },
+    providerAnthropicLegacy: {
+        "stop_sequence":        finishCompleted, // Legacy completions end on "\n\nHuman:"
+        "max_tokens":           finishLengthCapped,
+        "refusal":              finishFiltered,
+        "content_filtered":     finishFiltered,
+        "guardrail_intervened": finishFiltered,
+    },
+    providerAI21Jamba: {
+        "stop":           finishCompleted, // Also reported when a stop sequence matched
+        "length":         finishLengthCapped,
+        "content_filter": finishFiltered,
+        "tool_calls":     finishToolUse,
+    },
+    providerAmazonTitan: {
+        "FINISH":            finishCompleted,
+        "LENGTH":            finishLengthCapped,
+        "STOP_CRITERIA_MET": finishStopSequence,
+        "CONTENT_FILTERED":  finishFiltered,
+        "FILTERED":          finishFiltered,
+    },
+    providerMetaLlama: {
+        "stop":   finishCompleted,
+        "length": finishLengthCapped,
+    },
+    providerMistral: {
+        "stop":         finishCompleted, // Also reported when a stop sequence matched
+        "length":       finishLengthCapped,
+        "model_length": finishLengthCapped, // The context window ran out first
+        "tool_calls":   finishToolUse,
+    },
+    providerCohere: {
+        "COMPLETE":    finishCompleted, // Also reported when a stop sequence matched
+        "MAX_TOKENS":  finishLengthCapped,
+        "ERROR_LIMIT": finishLengthCapped, // The context window ran out first
+        "ERROR_TOXIC": finishFiltered,
+        "ERROR":       finishError,
+    },
+    providerAmazonNova: {
+        "end_turn":         finishCompleted,
+        "max_tokens":       finishLengthCapped,
+        "stop_sequence":    finishStopSequence,
+        "content_filtered": finishFiltered,
+    },
+    providerConverse: {
+        "end_turn":             finishCompleted,
+        "max_tokens":           finishLengthCapped,
+        "stop_sequence":        finishStopSequence,
+        "tool_use":             finishToolUse,
+        "content_filtered":     finishFiltered,
+        "guardrail_intervened": finishFiltered,
+    },
+}
+
+// modelProvider returns the stop reason vocabulary a model uses
+func modelProvider(model ModelInfo) string {
+    return formatOf(model).provider()
+}
+
+// normalizeFinishReason maps a raw provider stop reason to the normalized
+// set. Unknown values, including a missing one, become "other" and are
+// counted rather than failing the request so new provider values show up on
+// a dashboard instead of as errors.
+func normalizeFinishReason(provider, raw string) string {
+    if reason, ok := finishReasonTables[provider][raw]; ok {
+        return reason
+    }
+    label := raw
+    if label == "" {
+        label = "(none)"
+    }
+    log.Printf("Warning: unknown finish reason %q from provider %s", raw, provider)
+    metrics.Inc("finish_reason_unknown_total", "provider", provider, "raw", label)
+    return finishOther
+}
+
+// rawFinishReason reads a stop reason reported at the top level of a decoded
+// InvokeModel response, for the formats that put it there
+func rawFinishReason(response map[string]interface{}) string {
+    for _, field := range []string{"stop_reason", "stopReason"} {
+        if raw, ok := response[field].(string); ok {
+            return raw
+        }
+    }
+    return ""
+}
+
+// streamFailureReason distinguishes a stream that timed out from one that broke
+func streamFailureReason(ctx context.Context, err error) string {
+    if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+        return finishDeadline
+    }
+    return finishError
+}
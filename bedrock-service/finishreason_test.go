@@ -0,0 +1,103 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// Each provider's recorded bodies come out with the normalized reason,
+// checked here by hand rather than against the conformance golden files
+func TestFinishReasonFixtures(t *testing.T) {
+    cases := []struct {
+        fixture  string // Under testdata/fixtures
+        provider string
+        raw      string
+        want     string
+    }{
+        {"messages/2024-03-end-turn", providerAnthropicMessages, "end_turn", finishCompleted},
+        {"messages/2024-03-max-tokens", providerAnthropicMessages, "max_tokens", finishLengthCapped},
+        {"messages/2024-03-stop-sequence", providerAnthropicMessages, "stop_sequence", finishStopSequence},
+        {"legacy/2023-09-stop-sequence", providerAnthropicLegacy, "stop_sequence", finishCompleted},
+        {"legacy/2023-09-max-tokens", providerAnthropicLegacy, "max_tokens", finishLengthCapped},
+        {"jamba/2024-08-stop", providerAI21Jamba, "stop", finishCompleted},
+        {"jamba/2024-08-content-filter", providerAI21Jamba, "content_filter", finishFiltered},
+        {"titan/2023-11-finish", providerAmazonTitan, "FINISH", finishCompleted},
+        {"titan/2023-11-length", providerAmazonTitan, "LENGTH", finishLengthCapped},
+        {"titan/2024-05-content-filtered", providerAmazonTitan, "CONTENT_FILTERED", finishFiltered},
+        {"titan/2024-05-lowercase-finish", providerAmazonTitan, "finish", finishOther}, // Matched case-sensitively
+        {"llama/2024-04-stop", providerMetaLlama, "stop", finishCompleted},
+        {"llama/2024-04-length", providerMetaLlama, "length", finishLengthCapped},
+        {"llama/2024-04-stop-sequence", providerMetaLlama, "stop", finishStopSequence}, // Told apart by the text, see cutAtStopSequence
+        {"mistral/2024-03-stop", providerMistral, "stop", finishCompleted},
+        {"mistral/2024-03-length", providerMistral, "length", finishLengthCapped},
+        {"mistral_chat/2024-07-stop", providerMistral, "stop", finishCompleted},
+        {"mistral_chat/2024-07-stop-sequence", providerMistral, "stop", finishStopSequence},
+        {"cohere/2024-04-complete", providerCohere, "COMPLETE", finishCompleted},
+        {"cohere/2024-04-toxic", providerCohere, "ERROR_TOXIC", finishFiltered},
+        {"nova/2024-12-end-turn", providerAmazonNova, "end_turn", finishCompleted},
+        {"nova/2024-12-max-tokens", providerAmazonNova, "max_tokens", finishLengthCapped},
+    }
+
+    covered := make(map[string]bool)
+    for _, c := range cases {
+        t.Run(c.fixture, func(t *testing.T) {
+            dir := filepath.Join("testdata", "fixtures", filepath.FromSlash(c.fixture))
+            apiType := APIType(filepath.Dir(c.fixture))
+            format, ok := apiFormats[apiType]
+            if !ok {
+                t.Fatalf("no API format %s", apiType)
+            }
+            if got := format.provider(); got != c.provider {
+                t.Fatalf("format %s reads stop reasons as %s, want %s", apiType, got, c.provider)
+            }
+            var req fixtureRequest
+            readFixture(t, filepath.Join(dir, "request.json"), &req)
+            body, err := os.ReadFile(filepath.Join(dir, "response.json"))
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            got := conformanceResult(t, apiType, format, req, body)
+            if got.FinishReasonRaw != c.raw || got.FinishReason != c.want {
+                t.Errorf("%s read as %s/%s, want %s/%s", c.fixture, got.FinishReason, got.FinishReasonRaw, c.want, c.raw)
+            }
+        })
+        covered[c.provider] = true
+    }
+
+    // Converse responses are typed, with no body to record
+    for provider := range finishReasonTables {
+        if !covered[provider] && provider != providerConverse {
+            t.Errorf("no fixture checks %s", provider)
+        }
+    }
+}
+
+// A value missing from a provider's table, or from the response, becomes
+// "other" and is counted by provider and raw value
+func TestNormalizeFinishReasonUnknown(t *testing.T) {
+    for _, c := range []struct {
+        provider string
+        raw      string
+        label    string
+    }{
+        {providerAnthropicMessages, "pause_turn", "pause_turn"},
+        {providerCohere, "USER_CANCEL", "USER_CANCEL"},
+        {providerMetaLlama, "", "(none)"},
+        {"unknown_provider", "stop", "stop"},
+    } {
+        before := metrics.Value("finish_reason_unknown_total", "provider", c.provider, "raw", c.label)
+        if got := normalizeFinishReason(c.provider, c.raw); got != finishOther {
+            t.Errorf("%s %q normalized to %s, want %s", c.provider, c.raw, got, finishOther)
+        }
+        if n := metrics.Value("finish_reason_unknown_total", "provider", c.provider, "raw", c.label) - before; n != 1 {
+            t.Errorf("%s %q counted %v times, want once as %q", c.provider, c.raw, n, c.label)
+        }
+    }
+
+    // The same raw value means different things to different providers
+    if a, b := normalizeFinishReason(providerAnthropicMessages, "stop_sequence"), normalizeFinishReason(providerAnthropicLegacy, "stop_sequence"); a != finishStopSequence || b != finishCompleted {
+        t.Errorf("stop_sequence normalized to %s for messages and %s for legacy", a, b)
+    }
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+    "strings"
+)
+
+// footerSeparator sits between the generated text and the attribution footer
+const footerSeparator = "\n\n"
+
+// applyFooter appends the caller's attribution footer to a text response. It
+// must run after every other post-processing step so nothing can strip or
+// rewrite it. Structured outputs (classify, extract, tool calls) never get a
+// footer since it would corrupt the JSON, and the footer is not counted in
+// token usage because the model never produced it.
+func applyFooter(text string, policy KeyPolicy) (string, bool) {
+    footer := strings.TrimSpace(policy.AttributionFooter)
+    if footer == "" {
+        return text, false
+    }
+    return text + footerSeparator + footer, true
+}
+
+// footerDelta is the final text delta sent on a stream when a footer applies
+func footerDelta(policy KeyPolicy) (string, bool) {
+    footer := strings.TrimSpace(policy.AttributionFooter)
+    if footer == "" {
+        return "", false
+    }
+    return footerSeparator + footer, true
+}
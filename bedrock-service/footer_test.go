@@ -0,0 +1,131 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strings"
+    "testing"
+)
+
+// withFooter gives the e2e service's anonymous caller an attribution footer
+// for the length of a test
+func withFooter(t *testing.T, footer string) {
+    previous := anonymousPrincipal.Policy
+    anonymousPrincipal.Policy.AttributionFooter = footer
+    t.Cleanup(func() { anonymousPrincipal.Policy = previous })
+}
+
+func TestApplyFooter(t *testing.T) {
+    for _, c := range []struct {
+        footer  string
+        text    string
+        applied bool
+    }{
+        {"Generated by Acme AI", "Hello\n\nGenerated by Acme AI", true},
+        {"  Generated by Acme AI\n", "Hello\n\nGenerated by Acme AI", true},
+        {"", "Hello", false},
+        {" \n", "Hello", false},
+    } {
+        text, applied := applyFooter("Hello", KeyPolicy{AttributionFooter: c.footer})
+        delta, deltaApplied := footerDelta(KeyPolicy{AttributionFooter: c.footer})
+        if text != c.text || applied != c.applied || deltaApplied != c.applied || "Hello"+delta != c.text {
+            t.Errorf("footer %q: %q (%v), delta %q (%v); want %q", c.footer, text, applied, delta, deltaApplied, c.text)
+        }
+    }
+}
+
+// The footer is sent once, as the last text of the stream, in whichever
+// shape the stream carries text; JSON mode gets none
+func TestE2EStreamFooter(t *testing.T) {
+    const footer = "Generated by Acme AI"
+    const streamed, legacy = "anthropic.claude-3-5-sonnet-20241022-v2:0", "anthropic.claude-instant-v1"
+    withFooter(t, footer)
+
+    for _, c := range []struct {
+        name     string
+        model    string
+        reply    fakeReply
+        request  map[string]interface{}
+        text     string // What the deltas or blocks add up to
+        buffered bool
+        applied  bool
+    }{
+        {"plain", streamed, claudeStream("Hello", ", world"), nil, "Hello, world\n\n" + footer, false, true},
+        {"json mode", streamed, claudeStream(`{"greeting":`, `"hello"}`),
+            map[string]interface{}{"response_format": map[string]string{"type": "json"}}, `{"greeting":"hello"}`, false, false},
+        {"blocks", streamed, claudeStream("# Title\n\n", "- one\n- two"),
+            map[string]interface{}{"format": formatBlocks}, "Title|one,two|" + footer, false, true},
+        {"legacy buffered", legacy, fakeReply{Body: `{"completion":" Hello from Claude Instant","stop_reason":"stop_sequence"}`}, nil,
+            " Hello from Claude Instant\n\n" + footer, true, true},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            fake.Script(c.model, c.reply)
+            body := map[string]interface{}{"prompt": "Say hello (" + c.name + ")", "models": []string{c.model}}
+            for k, v := range c.request {
+                body[k] = v
+            }
+            resp := post(t, "/generate/stream", body)
+            defer resp.Body.Close()
+            if resp.StatusCode != http.StatusOK {
+                t.Fatalf("status %d", resp.StatusCode)
+            }
+            events := readEvents(t, resp.Body)
+            if len(events) == 0 || events[len(events)-1].Name != "done" {
+                t.Fatalf("events %+v, want done last", events)
+            }
+
+            var text []string
+            for _, event := range events[:len(events)-1] {
+                switch event.Name {
+                case "delta":
+                    var delta textDeltaEvent
+                    if err := json.Unmarshal([]byte(event.Data), &delta); err != nil {
+                        t.Fatal(err)
+                    }
+                    text = append(text, delta.Text)
+                case "block":
+                    var b blockEvent
+                    if err := json.Unmarshal([]byte(event.Data), &b); err != nil {
+                        t.Fatal(err)
+                    }
+                    text = append(text, flattenBlock(b.Block)+"|")
+                }
+            }
+            got := strings.TrimSuffix(strings.Join(text, ""), "|")
+            if got != c.text {
+                t.Errorf("streamed %q, want %q", got, c.text)
+            }
+            if n := strings.Count(got, footer); n != map[bool]int{true: 1, false: 0}[c.applied] {
+                t.Errorf("footer sent %d times", n)
+            }
+            // As a delta, the footer travels on its own, after the model's text
+            if c.applied && c.request == nil && text[len(text)-1] != footerSeparator+footer {
+                t.Errorf("last delta %q, want the footer alone", text[len(text)-1])
+            }
+
+            var done streamDoneEvent
+            if err := json.Unmarshal([]byte(events[len(events)-1].Data), &done); err != nil {
+                t.Fatal(err)
+            }
+            if done.FooterApplied != c.applied || done.Buffered != c.buffered {
+                t.Errorf("done footer_applied %v, buffered %v; want %v, %v", done.FooterApplied, done.Buffered, c.applied, c.buffered)
+            }
+        })
+    }
+}
+
+// flattenBlock flattens a block to its text, list items joined by commas
+func flattenBlock(b Block) string {
+    if b.Type != blockList {
+        return b.Text
+    }
+    items := make([]string, len(b.Items))
+    for i, item := range b.Items {
+        var parts []string
+        for _, inner := range item.Blocks {
+            parts = append(parts, flattenBlock(inner))
+        }
+        items[i] = strings.Join(parts, " ")
+    }
+    return strings.Join(items, ",")
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/subtle"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// gossipSyncPath is the internal endpoint replicas exchange counts on
+const gossipSyncPath = "/internal/ratelimit/sync"
+
+// GossipConfig configures the peer-synchronized limiter
+type GossipConfig struct {
+    NodeID    string
+    Peers     []string // Static peer base URLs, e.g. http://10.0.0.2:9000
+    PeerDNS   string   // host:port resolved on every sync; each address is a peer
+    Secret    string   // Shared secret required on the sync endpoint
+    Interval  time.Duration
+    Overshoot float64 // Fraction over the limit tolerated because counts lag
+}
+
+// LoadGossipConfig reads RATE_LIMIT_PEERS, RATE_LIMIT_PEER_DNS,
+// RATE_LIMIT_PEER_SECRET, RATE_LIMIT_SYNC_SECONDS, RATE_LIMIT_OVERSHOOT and
+// RATE_LIMIT_NODE_ID
+func LoadGossipConfig() (GossipConfig, error) {
+    cfg := GossipConfig{
+        PeerDNS:   os.Getenv("RATE_LIMIT_PEER_DNS"),
+        Secret:    os.Getenv("RATE_LIMIT_PEER_SECRET"),
+        NodeID:    os.Getenv("RATE_LIMIT_NODE_ID"),
+        Interval:  2 * time.Second,
+        Overshoot: 0.1,
+    }
+
+    for _, peer := range strings.Split(os.Getenv("RATE_LIMIT_PEERS"), ",") {
+        if peer = strings.TrimRight(strings.TrimSpace(peer), "/"); peer == "" {
+            continue
+        }
+        if !strings.Contains(peer, "://") {
+            peer = "http://" + peer
+        }
+        cfg.Peers = append(cfg.Peers, peer)
+    }
+    if len(cfg.Peers) == 0 && cfg.PeerDNS == "" {
+        return cfg, fmt.Errorf("RATE_LIMIT_BACKEND=gossip requires RATE_LIMIT_PEERS or RATE_LIMIT_PEER_DNS")
+    }
+    if cfg.PeerDNS != "" {
+        if _, _, err := net.SplitHostPort(cfg.PeerDNS); err != nil {
+            return cfg, fmt.Errorf("invalid RATE_LIMIT_PEER_DNS %q (expected host:port)", cfg.PeerDNS)
+        }
+    }
+    if cfg.Secret == "" {
+        return cfg, fmt.Errorf("RATE_LIMIT_BACKEND=gossip requires RATE_LIMIT_PEER_SECRET")
+    }
+    if cfg.NodeID == "" {
+        hostname, err := os.Hostname()
+        if err != nil {
+            return cfg, fmt.Errorf("unable to determine node ID, set RATE_LIMIT_NODE_ID: %v", err)
+        }
+        cfg.NodeID = hostname
+    }
+
+    if v := os.Getenv("RATE_LIMIT_SYNC_SECONDS"); v != "" {
+        seconds, err := strconv.ParseFloat(v, 64)
+        if err != nil || seconds <= 0 {
+            return cfg, fmt.Errorf("invalid RATE_LIMIT_SYNC_SECONDS %q", v)
+        }
+        cfg.Interval = time.Duration(seconds * float64(time.Second))
+    }
+    if v := os.Getenv("RATE_LIMIT_OVERSHOOT"); v != "" {
+        overshoot, err := strconv.ParseFloat(v, 64)
+        if err != nil || overshoot < 0 || overshoot > 1 {
+            return cfg, fmt.Errorf("invalid RATE_LIMIT_OVERSHOOT %q (expected 0-1)", v)
+        }
+        cfg.Overshoot = overshoot
+    }
+    return cfg, nil
+}
+
+// gossipMessage carries one node's counts for the current window. Counts are
+// the node's own running totals rather than increments, so a lost or
+// repeated exchange never skews the merged view.
+type gossipMessage struct {
+    NodeID      string         `json:"node_id"`
+    WindowStart time.Time      `json:"window_start"`
+    Counts      map[string]int `json:"counts"`
+}
+
+// peerView is the last state received from one peer
+type peerView struct {
+    windowStart time.Time
+    counts      map[string]int
+    seen        time.Time
+}
+
+// GossipLimiter enforces limits against the merged counts of every reachable
+// replica. When no peer has been heard from recently it falls back to
+// enforcing the limit against local counts only.
+type GossipLimiter struct {
+    limit  int
+    window time.Duration
+    cfg    GossipConfig
+    client *http.Client
+
+    mu        sync.Mutex
+    local     windowCounts
+    peers     map[string]*peerView // node ID -> view
+    selfAddrs map[string]bool      // Discovered addresses that turned out to be this node
+}
+
+func NewGossipLimiter(limit int, window time.Duration, cfg GossipConfig) *GossipLimiter {
+    return &GossipLimiter{
+        limit:  limit,
+        window: window,
+        cfg:    cfg,
+        // Peers are internal replicas, so this deliberately doesn't use the
+        // egress client, which refuses private addresses
+        client:    &http.Client{Timeout: cfg.Interval},
+        peers:     make(map[string]*peerView),
+        selfAddrs: make(map[string]bool),
+    }
+}
+
+// staleAfter is how long a peer's counts are trusted without a fresh exchange
+func (gl *GossipLimiter) staleAfter() time.Duration {
+    return 3 * gl.cfg.Interval
+}
+
+func (gl *GossipLimiter) Allow(key string, now time.Time) RateDecision {
+    gl.mu.Lock()
+    defer gl.mu.Unlock()
+
+    gl.local.roll(now, gl.window)
+    used := gl.local.counts[key]
+    budget := gl.limit
+
+    livePeers := 0
+    for _, peer := range gl.peers {
+        if now.Sub(peer.seen) > gl.staleAfter() {
+            continue
+        }
+        livePeers++
+        if peer.windowStart.Equal(gl.local.start) {
+            used += peer.counts[key]
+        }
+    }
+    if livePeers > 0 {
+        budget += int(float64(gl.limit) * gl.cfg.Overshoot)
+    } else {
+        metrics.Inc("ratelimit_local_only_decisions_total")
+    }
+
+    decision := RateDecision{Limit: gl.limit, ResetAt: gl.local.start.Add(gl.window)}
+    if used >= budget {
+        return decision
+    }
+    gl.local.counts[key]++
+    decision.Allowed = true
+    decision.Remaining = gl.limit - used - 1
+    if decision.Remaining < 0 {
+        decision.Remaining = 0
+    }
+    return decision
+}
+
+// snapshot returns this node's counts for the current window
+func (gl *GossipLimiter) snapshot(now time.Time) gossipMessage {
+    gl.mu.Lock()
+    defer gl.mu.Unlock()
+
+    gl.local.roll(now, gl.window)
+    counts := make(map[string]int, len(gl.local.counts))
+    for key, n := range gl.local.counts {
+        counts[key] = n
+    }
+    return gossipMessage{NodeID: gl.cfg.NodeID, WindowStart: gl.local.start, Counts: counts}
+}
+
+// merge records a message received from a peer
+func (gl *GossipLimiter) merge(msg gossipMessage, now time.Time) {
+    if msg.NodeID == "" || msg.NodeID == gl.cfg.NodeID {
+        return
+    }
+    gl.mu.Lock()
+    defer gl.mu.Unlock()
+    gl.peers[msg.NodeID] = &peerView{windowStart: msg.WindowStart, counts: msg.Counts, seen: now}
+}
+
+// peerURLs lists the static peers plus the current DNS answers
+func (gl *GossipLimiter) peerURLs(ctx context.Context) []string {
+    urls := append([]string(nil), gl.cfg.Peers...)
+    if gl.cfg.PeerDNS != "" {
+        host, port, _ := net.SplitHostPort(gl.cfg.PeerDNS)
+        addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+        if err != nil {
+            logWarnf(ctx, "Rate limit peer discovery failed for %s: %v", host, err)
+        }
+        for _, addr := range addrs {
+            urls = append(urls, "http://"+net.JoinHostPort(addr, port))
+        }
+    }
+
+    gl.mu.Lock()
+    defer gl.mu.Unlock()
+    var peers []string
+    for _, u := range urls {
+        if !gl.selfAddrs[u] {
+            peers = append(peers, u)
+        }
+    }
+    return peers
+}
+
+// Run exchanges counts with every peer on each interval
+func (gl *GossipLimiter) Run() {
+    ticker := time.NewTicker(gl.cfg.Interval)
+    defer ticker.Stop()
+    for range ticker.C {
+        gl.syncOnce()
+    }
+}
+
+func (gl *GossipLimiter) syncOnce() {
+    ctx, cancel := context.WithTimeout(context.Background(), gl.cfg.Interval)
+    defer cancel()
+
+    body, err := json.Marshal(gl.snapshot(time.Now()))
+    if err != nil {
+        logErrorf(ctx, "Error encoding rate limit counts: %v", err)
+        return
+    }
+
+    var wg sync.WaitGroup
+    for _, peer := range gl.peerURLs(ctx) {
+        wg.Add(1)
+        go func(peer string) {
+            defer wg.Done()
+            if err := gl.exchange(ctx, peer, body); err != nil {
+                metrics.Inc("ratelimit_gossip_sync_total", "outcome", "error")
+                logWarnf(ctx, "Rate limit sync with %s failed: %v", peer, err)
+                return
+            }
+            metrics.Inc("ratelimit_gossip_sync_total", "outcome", "success")
+        }(peer)
+    }
+    wg.Wait()
+}
+
+// exchange pushes our counts to a peer and merges the counts it returns
+func (gl *GossipLimiter) exchange(ctx context.Context, peer string, body []byte) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+gossipSyncPath, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Peer-Secret", gl.cfg.Secret)
+
+    resp, err := gl.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("unexpected status %d", resp.StatusCode)
+    }
+
+    var msg gossipMessage
+    if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+        return fmt.Errorf("invalid response: %v", err)
+    }
+    if msg.NodeID == gl.cfg.NodeID {
+        // DNS returned our own address; stop calling it
+        gl.mu.Lock()
+        gl.selfAddrs[peer] = true
+        gl.mu.Unlock()
+        return nil
+    }
+    gl.merge(msg, time.Now())
+    return nil
+}
+
+// syncHandler receives a peer's counts and answers with ours
+func (gl *GossipLimiter) syncHandler(w http.ResponseWriter, r *http.Request) {
+    if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Peer-Secret")), []byte(gl.cfg.Secret)) != 1 {
+        writeError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+        return
+    }
+
+    var msg gossipMessage
+    if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+        writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+        return
+    }
+    now := time.Now()
+    gl.merge(msg, now)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(gl.snapshot(now))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// Generations can be passed through a Bedrock guardrail. GUARDRAIL_ID and
+// GUARDRAIL_VERSION name the one applied when a request names none, and a
+// request's guardrail_id and guardrail_version replace it. The guardrail
+// travels with the generation parameters, so every model of the fallback
+// chain is invoked with the same one, whether through InvokeModel or
+// Converse.
+
+// GuardrailConfig is the guardrail applied when a request names none
+type GuardrailConfig struct {
+    ID      string // Guardrail ID or ARN, empty for none
+    Version string // A version number or DRAFT
+}
+
+// LoadGuardrailConfig reads GUARDRAIL_ID and GUARDRAIL_VERSION. Bedrock
+// takes no guardrail without a version, so the version is required.
+func LoadGuardrailConfig() (GuardrailConfig, error) {
+    cfg := GuardrailConfig{
+        ID:      strings.TrimSpace(os.Getenv("GUARDRAIL_ID")),
+        Version: strings.TrimSpace(os.Getenv("GUARDRAIL_VERSION")),
+    }
+    switch {
+    case cfg.ID == "" && cfg.Version != "":
+        return cfg, fmt.Errorf("GUARDRAIL_VERSION is set without GUARDRAIL_ID")
+    case cfg.ID != "" && !validGuardrailVersion(cfg.Version):
+        return cfg, fmt.Errorf("invalid GUARDRAIL_VERSION %q: must be a version number or DRAFT", cfg.Version)
+    }
+    return cfg, nil
+}
+
+// guardrail is the default guardrail, nil when there is none
+func (cfg GuardrailConfig) guardrail() *Guardrail {
+    if cfg.ID == "" {
+        return nil
+    }
+    return &Guardrail{ID: cfg.ID, Version: cfg.Version}
+}
+
+// validGuardrailVersion reports whether v names a guardrail version
+func validGuardrailVersion(v string) bool {
+    if v == "DRAFT" {
+        return true
+    }
+    n, err := strconv.Atoi(v)
+    return err == nil && n > 0
+}
+
+// Guardrail is the guardrail a generation is invoked with
+type Guardrail struct {
+    ID      string `json:"id"`
+    Version string `json:"version"`
+    Trace   bool   `json:"trace,omitempty"` // Return the guardrail's assessment in debug
+}
+
+// forRequest resolves the guardrail a request is invoked with, nil for none
+func (cfg GuardrailConfig) forRequest(req *GenerateRequest) (*Guardrail, *APIError) {
+    return cfg.resolve(req.GuardrailID, req.GuardrailVersion, req.GuardrailTrace)
+}
+
+// resolve picks the guardrail a caller named against the default, nil for
+// none. A caller naming its own guardrail names its version too; one asking
+// for another version of the default guardrail may give just the version.
+func (cfg GuardrailConfig) resolve(id, version string, trace bool) (*Guardrail, *APIError) {
+    id, version = strings.TrimSpace(id), strings.TrimSpace(version)
+    if id == "" {
+        id = cfg.ID
+    }
+    if version == "" && id == cfg.ID {
+        version = cfg.Version
+    }
+
+    var problems []FieldError
+    switch {
+    case id == "":
+        if version != "" {
+            problems = append(problems, FieldError{Field: "guardrail_version", Message: "requires guardrail_id"})
+        }
+        if trace {
+            problems = append(problems, FieldError{Field: "guardrail_trace", Message: "requires guardrail_id"})
+        }
+    case version == "":
+        problems = append(problems, FieldError{Field: "guardrail_version", Message: "is required with guardrail_id"})
+    case !validGuardrailVersion(version):
+        problems = append(problems, FieldError{Field: "guardrail_version", Message: "must be a version number or DRAFT"})
+    }
+    if len(problems) > 0 {
+        return nil, &APIError{Code: ErrCodeValidation, Message: "Invalid guardrail", Fields: problems}
+    }
+    if id == "" {
+        return nil, nil
+    }
+    return &Guardrail{ID: id, Version: version, Trace: trace}, nil
+}
+
+// invocation is the guardrail's InvokeModel parameters: nil for none, and
+// the trace left unset unless it was asked for
+func (g *Guardrail) invocation() (identifier, version *string, trace types.Trace) {
+    if g == nil {
+        return nil, nil, ""
+    }
+    if g.Trace {
+        trace = types.TraceEnabled
+    }
+    return aws.String(g.ID), aws.String(g.Version), trace
+}
+
+// converseConfig is the guardrail's Converse configuration: nil for none,
+// and the trace left unset unless it was asked for
+func (g *Guardrail) converseConfig() *types.GuardrailConfiguration {
+    if g == nil {
+        return nil
+    }
+    cfg := &types.GuardrailConfiguration{GuardrailIdentifier: aws.String(g.ID), GuardrailVersion: aws.String(g.Version)}
+    if g.Trace {
+        cfg.Trace = types.GuardrailTraceEnabled
+    }
+    return cfg
+}
+
+// guardrailTrace is the guardrail's assessment in a response body invoked
+// with its trace enabled, nil when there is none
+func guardrailTrace(response map[string]interface{}) interface{} {
+    trace, ok := response["amazon-bedrock-trace"].(map[string]interface{})
+    if !ok {
+        return nil
+    }
+    return trace["guardrail"]
+}
+
+// responseCacheScope is the response cache scope of the generation. An
+// answer is only served again under the same guardrail, and with its trace
+// only to a request that asked for it.
+func (p GenerationParams) responseCacheScope() string {
+    if p.CacheScope == "" || p.Guardrail == nil {
+        return p.CacheScope
+    }
+    scope := p.CacheScope + "\x00guardrail:" + p.Guardrail.ID + ":" + p.Guardrail.Version
+    if p.Guardrail.Trace {
+        scope += ":trace"
+    }
+    return scope
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log"
+    "net/http"
+)
+
+// Hooks let deployments extend /generate without patching the handler.
+// Register them from an init function in a file behind a build tag, e.g.
+//
+//    //go:build costcenter
+//
+//    func init() {
+//        RegisterRequestHook("cost-center", costCenterRequestHook)
+//    }
+//
+// and build with -tags costcenter (BUILD_TAGS in the Dockerfile). Request
+// hooks run in registration order after validation and before the model is
+// called, and the first to fail rejects the request. Response hooks run in
+// registration order just before the response is written; the generation
+// has already been paid for by then, so one that fails is logged and the
+// response goes out without its changes. Company-specific fields travel in the request and response
+// "extensions" objects so the core schema never has to change.
+
+// RequestHook may inspect or modify a validated generate request
+type RequestHook func(ctx context.Context, req *GenerateRequest) error
+
+// ResponseHook may inspect or modify a generate response before it is sent
+type ResponseHook func(ctx context.Context, resp *GenerateResponse) error
+
+type namedRequestHook struct {
+    name string
+    hook RequestHook
+}
+
+type namedResponseHook struct {
+    name string
+    hook ResponseHook
+}
+
+var (
+    requestHooks  []namedRequestHook
+    responseHooks []namedResponseHook
+)
+
+// RegisterRequestHook adds a request hook. It must only be called during
+// initialization, before the server starts.
+func RegisterRequestHook(name string, hook RequestHook) {
+    requestHooks = append(requestHooks, namedRequestHook{name: name, hook: hook})
+    log.Printf("Registered request hook: %s", name)
+}
+
+// RegisterResponseHook adds a response hook. It must only be called during
+// initialization, before the server starts.
+func RegisterResponseHook(name string, hook ResponseHook) {
+    responseHooks = append(responseHooks, namedResponseHook{name: name, hook: hook})
+    log.Printf("Registered response hook: %s", name)
+}
+
+// HookError lets a request hook choose the status and error code sent to the
+// caller. Any other error returned by a request hook becomes a 500 internal
+// error.
+type HookError struct {
+    Status  int
+    Code    string
+    Message string
+    Fields  []FieldError
+}
+
+func (e *HookError) Error() string {
+    return e.Message
+}
+
+// HookValidationError rejects a request because of one field
+func HookValidationError(field, message string) *HookError {
+    return &HookError{
+        Status:  http.StatusBadRequest,
+        Code:    ErrCodeValidation,
+        Message: field + " " + message,
+        Fields:  []FieldError{{Field: field, Message: message}},
+    }
+}
+
+type requestHeadersKey struct{}
+
+// hookContext makes the incoming headers available to hooks
+func hookContext(r *http.Request) context.Context {
+    return context.WithValue(r.Context(), requestHeadersKey{}, r.Header)
+}
+
+// RequestHeader returns a header of the request being processed, for hooks
+// that derive fields from headers
+func RequestHeader(ctx context.Context, name string) string {
+    if h, ok := ctx.Value(requestHeadersKey{}).(http.Header); ok {
+        return h.Get(name)
+    }
+    return ""
+}
+
+type generateRequestKey struct{}
+
+// GenerateRequestFrom returns the request a response hook is running for,
+// including any extensions set by request hooks
+func GenerateRequestFrom(ctx context.Context) *GenerateRequest {
+    req, _ := ctx.Value(generateRequestKey{}).(*GenerateRequest)
+    return req
+}
+
+// runRequestHooks runs every request hook, stopping at the first error
+func runRequestHooks(ctx context.Context, req *GenerateRequest) error {
+    for _, h := range requestHooks {
+        if err := h.hook(ctx, req); err != nil {
+            logWarnf(ctx, "Request hook %s failed: %v", h.name, err)
+            return err
+        }
+    }
+    return nil
+}
+
+// runResponseHooks runs every response hook. One that fails is logged and
+// its changes are undone, so the caller still gets the answer it paid for.
+func runResponseHooks(ctx context.Context, req *GenerateRequest, resp *GenerateResponse) {
+    ctx = context.WithValue(ctx, generateRequestKey{}, req)
+    for _, h := range responseHooks {
+        before := *resp
+        before.Extensions = copyExtensions(resp.Extensions)
+        if err := h.hook(ctx, resp); err != nil {
+            logWarnf(ctx, "Response hook %s failed: %v", h.name, err)
+            *resp = before
+        }
+    }
+}
+
+// copyExtensions is a shallow copy, enough to undo a hook's top-level writes
+func copyExtensions(ext map[string]interface{}) map[string]interface{} {
+    if ext == nil {
+        return nil
+    }
+    c := make(map[string]interface{}, len(ext))
+    for k, v := range ext {
+        c[k] = v
+    }
+    return c
+}
+
+// hookErrorResponse maps a hook error onto the standard error envelope
+func hookErrorResponse(err error) (int, APIError) {
+    var hookErr *HookError
+    if errors.As(err, &hookErr) {
+        status, code := hookErr.Status, hookErr.Code
+        if status == 0 {
+            status = http.StatusBadRequest
+        }
+        if code == "" {
+            code = ErrCodeValidation
+        }
+        return status, APIError{Code: code, Message: hookErr.Message, Fields: hookErr.Fields}
+    }
+    return http.StatusInternalServerError, APIError{Code: ErrCodeInternal, Message: "Request processing failed"}
+}
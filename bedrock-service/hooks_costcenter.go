@@ -0,0 +1,51 @@
+//go:build costcenter
+
+package main
+
+import (
+    "context"
+    "regexp"
+)
+
+// Example extension: tag every generation with the caller's cost center from
+// the X-Cost-Center header, echo it in the response extensions and count
+// requests per cost center in the usage metrics. Build with -tags costcenter.
+
+var costCenterPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+func init() {
+    metrics.Describe("usage_requests_total", "Generate requests by cost center")
+    RegisterRequestHook("cost-center", costCenterRequestHook)
+    RegisterResponseHook("cost-center", costCenterResponseHook)
+}
+
+func costCenterRequestHook(ctx context.Context, req *GenerateRequest) error {
+    costCenter := RequestHeader(ctx, "X-Cost-Center")
+    if costCenter == "" {
+        costCenter = "unassigned"
+    } else if !costCenterPattern.MatchString(costCenter) {
+        return HookValidationError("X-Cost-Center", "must be 1-32 letters, digits, '-' or '_'")
+    }
+    if req.Extensions == nil {
+        req.Extensions = make(map[string]interface{})
+    }
+    req.Extensions["cost_center"] = costCenter
+    return nil
+}
+
+func costCenterResponseHook(ctx context.Context, resp *GenerateResponse) error {
+    req := GenerateRequestFrom(ctx)
+    if req == nil {
+        return nil
+    }
+    costCenter, _ := req.Extensions["cost_center"].(string)
+    if costCenter == "" {
+        return nil
+    }
+    metrics.Inc("usage_requests_total", "cost_center", costCenter, "model", resp.ModelUsed)
+    if resp.Extensions == nil {
+        resp.Extensions = make(map[string]interface{})
+    }
+    resp.Extensions["cost_center"] = costCenter
+    return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// withHooks replaces the registered hooks until the test ends
+func withHooks(t *testing.T, req []namedRequestHook, resp []namedResponseHook) {
+    t.Helper()
+    previousReq, previousResp := requestHooks, responseHooks
+    requestHooks, responseHooks = req, resp
+    t.Cleanup(func() {
+        requestHooks, responseHooks = previousReq, previousResp
+    })
+}
+
+// Request hooks run in registration order and the first error stops them
+func TestRunRequestHooks(t *testing.T) {
+    var ran []string
+    hook := func(name string, err error) namedRequestHook {
+        return namedRequestHook{name: name, hook: func(ctx context.Context, req *GenerateRequest) error {
+            ran = append(ran, name)
+            req.Prompt += " " + name
+            return err
+        }}
+    }
+    rejected := HookValidationError("X-Cost-Center", "is required")
+
+    for _, c := range []struct {
+        name   string
+        hooks  []namedRequestHook
+        ran    []string
+        prompt string
+        err    error
+    }{
+        {"none", nil, nil, "hi", nil},
+        {"in order", []namedRequestHook{hook("a", nil), hook("b", nil), hook("c", nil)}, []string{"a", "b", "c"}, "hi a b c", nil},
+        {"first fails", []namedRequestHook{hook("a", rejected), hook("b", nil)}, []string{"a"}, "hi a", rejected},
+        {"middle fails", []namedRequestHook{hook("a", nil), hook("b", rejected), hook("c", nil)}, []string{"a", "b"}, "hi a b", rejected},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            withHooks(t, c.hooks, nil)
+            ran = nil
+            req := &GenerateRequest{Prompt: "hi"}
+            err := runRequestHooks(context.Background(), req)
+            if err != c.err {
+                t.Errorf("error %v, want %v", err, c.err)
+            }
+            if !reflect.DeepEqual(ran, c.ran) || req.Prompt != c.prompt {
+                t.Errorf("ran %v leaving %q, want %v leaving %q", ran, req.Prompt, c.ran, c.prompt)
+            }
+        })
+    }
+}
+
+// Response hooks run in registration order; one that fails is logged, its
+// changes are undone and the rest still run
+func TestRunResponseHooks(t *testing.T) {
+    buf := captureLogs(t, 0, false)
+    var ran []string
+    set := func(name string, err error) namedResponseHook {
+        return namedResponseHook{name: name, hook: func(ctx context.Context, resp *GenerateResponse) error {
+            ran = append(ran, name)
+            if GenerateRequestFrom(ctx) == nil {
+                t.Errorf("hook %s can't see the request", name)
+            }
+            if resp.Extensions == nil {
+                resp.Extensions = make(map[string]interface{})
+            }
+            resp.Extensions[name] = true
+            resp.Response += " " + name
+            return err
+        }}
+    }
+    withHooks(t, nil, []namedResponseHook{set("a", nil), set("b", errors.New("billing export down")), set("c", nil)})
+
+    resp := &GenerateResponse{Response: "answer"}
+    runResponseHooks(context.Background(), &GenerateRequest{Prompt: "hi"}, resp)
+
+    if want := []string{"a", "b", "c"}; !reflect.DeepEqual(ran, want) {
+        t.Errorf("ran %v, want %v", ran, want)
+    }
+    if want := map[string]interface{}{"a": true, "c": true}; resp.Response != "answer a c" || !reflect.DeepEqual(resp.Extensions, want) {
+        t.Errorf("response %q with extensions %v, want the failed hook's changes undone", resp.Response, resp.Extensions)
+    }
+    if !strings.Contains(buf.String(), "Response hook b failed: billing export down") {
+        t.Errorf("failure not logged:\n%s", buf)
+    }
+}
+
+func TestHookErrorResponse(t *testing.T) {
+    for _, c := range []struct {
+        name   string
+        err    error
+        status int
+        code   string
+    }{
+        {"validation", HookValidationError("X-Cost-Center", "is required"), http.StatusBadRequest, ErrCodeValidation},
+        {"chosen status", &HookError{Status: http.StatusForbidden, Code: ErrCodeForbidden, Message: "department closed"}, http.StatusForbidden, ErrCodeForbidden},
+        {"defaults", &HookError{Message: "bad"}, http.StatusBadRequest, ErrCodeValidation},
+        {"plain error", errors.New("lookup failed"), http.StatusInternalServerError, ErrCodeInternal},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            status, apiErr := hookErrorResponse(c.err)
+            if status != c.status || apiErr.Code != c.code {
+                t.Errorf("%d %s, want %d %s", status, apiErr.Code, c.status, c.code)
+            }
+            // A plain error's text may hold internals
+            if c.code == ErrCodeInternal && strings.Contains(apiErr.Message, "lookup") {
+                t.Errorf("message %q leaks the hook's error", apiErr.Message)
+            }
+        })
+    }
+}
+
+// Through /generate a failing request hook answers with its envelope before
+// the model is called, and a failing response hook doesn't cost the caller
+// the answer
+func TestE2EHooks(t *testing.T) {
+    const model = "mistral.mixtral-8x7b-instruct-v0:1"
+    fake.Script(model, fakeReply{Body: `{"outputs":[{"text":"Hooked","stop_reason":"stop"}]}`})
+
+    withHooks(t, []namedRequestHook{{name: "department", hook: func(ctx context.Context, req *GenerateRequest) error {
+        if RequestHeader(ctx, "X-Department") == "" {
+            return HookValidationError("X-Department", "is required")
+        }
+        return nil
+    }}}, []namedResponseHook{{name: "export", hook: func(ctx context.Context, resp *GenerateResponse) error {
+        return errors.New("export failed")
+    }}})
+
+    before := len(fake.Calls(model))
+    resp := post(t, "/generate", map[string]interface{}{"prompt": "Hi", "models": []string{model}})
+    var rejected errorEnvelope
+    decode(t, resp, &rejected)
+    if resp.StatusCode != http.StatusBadRequest || rejected.Error.Code != ErrCodeValidation || len(rejected.Error.Fields) != 1 || rejected.Error.Fields[0].Field != "X-Department" {
+        t.Errorf("status %d, error %+v, want the hook's validation error", resp.StatusCode, rejected.Error)
+    }
+    if calls := len(fake.Calls(model)) - before; calls != 0 {
+        t.Errorf("model called %d times for a rejected request", calls)
+    }
+
+    req, _ := http.NewRequest(http.MethodPost, serviceURL+"/generate", strings.NewReader(`{"prompt":"Hi","models":["`+model+`"]}`))
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Department", "sales")
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    requestID := resp.Header.Get("X-Request-ID")
+    var out GenerateResponse
+    decode(t, resp, &out)
+    if resp.StatusCode != http.StatusOK || out.Response != "Hooked" {
+        t.Errorf("status %d, response %q, want the answer despite the response hook", resp.StatusCode, out.Response)
+    }
+    logged := false
+    for _, entry := range logLines(t, requestID) {
+        if entry["level"] == "WARN" && entry["msg"] == "Response hook export failed: export failed" {
+            logged = true
+        }
+    }
+    if !logged {
+        t.Errorf("response hook failure not logged for request %s", requestID)
+    }
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "unicode/utf8"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// POST /images turns a prompt into PNGs with the image models, the registry
+// entries of modality image. They are never part of a text fallback chain,
+// and text models never answer /images. A request tries the image models its
+// model preference matches, or all of them, in catalog order, skipping any
+// that can't make its size. A content policy refusal ends the request with a
+// 422 instead of falling back, since any other model would be asked for the
+// same picture.
+
+const (
+    maxImageCount    = 5           // Most images one request asks for
+    maxImageSeed     = 2147483646  // Largest seed every image format takes
+    defaultImageSize = "1024x1024" // Every image format makes this size
+)
+
+// ImageFormat builds InvokeModel request bodies in one image API format and
+// reads the images out of its responses
+type ImageFormat interface {
+    sizes() []string  // The WIDTHxHEIGHT sizes the models make
+    perRequest() int  // Most images one invocation returns
+    promptLimit() int // Most characters a prompt, or negative prompt, may have
+    imageBody(p ImageParams, count int, seed *int64) map[string]interface{}
+    probeBody() map[string]interface{} // The cheapest useful request
+
+    // parseImages reads the base64 PNGs of a response, reporting false when
+    // they aren't where the format puts them. A refusal is the reason the
+    // model's content policy withheld them.
+    parseImages(response map[string]interface{}) (images []GeneratedImage, refusal string, ok bool)
+}
+
+// imageFormats holds the format of each image APIType; the catalog accepts
+// exactly these for image models
+var imageFormats = map[APIType]ImageFormat{
+    apiTitanImage: titanImageFormat{},
+    apiStability:  stabilityFormat{},
+}
+
+// imageTypeNames lists every image APIType, sorted
+func imageTypeNames() []string {
+    names := make([]string, 0, len(imageFormats))
+    for apiType := range imageFormats {
+        names = append(names, string(apiType))
+    }
+    sort.Strings(names)
+    return names
+}
+
+// imageCatalogProblems checks the fields of a catalog entry with modality
+// image. Token limits and sampling defaults mean nothing to image models.
+func imageCatalogProblems(m *CatalogModel, field string) []FieldError {
+    var problems []FieldError
+    if _, ok := imageFormats[APIType(m.APIType)]; !ok {
+        problems = append(problems, FieldError{Field: field + ".api_type", Message: "must be one of " + strings.Join(imageTypeNames(), ", ") + " for an image model"})
+    }
+    if m.ContextWindow < 0 {
+        problems = append(problems, FieldError{Field: field + ".context_window", Message: "must not be negative"})
+    }
+    if m.MaxOutput != 0 {
+        problems = append(problems, FieldError{Field: field + ".max_output_tokens", Message: "applies only to text models"})
+    }
+    if m.Defaults != nil {
+        problems = append(problems, FieldError{Field: field + ".defaults", Message: "apply only to text models"})
+    }
+    if m.Vision {
+        problems = append(problems, FieldError{Field: field + ".vision", Message: "applies only to text models"})
+    }
+    if m.Documents {
+        problems = append(problems, FieldError{Field: field + ".documents", Message: "applies only to text models"})
+    }
+    return problems
+}
+
+// ImageRequest is the body of POST /images
+type ImageRequest struct {
+    Prompt         string `json:"prompt"`
+    NegativePrompt string `json:"negative_prompt,omitempty"` // What the images should not show
+    Model          string `json:"model,omitempty"`           // An image model's name or ID, or part of one; any image model when empty
+    Size           string `json:"size,omitempty"`            // WIDTHxHEIGHT, default 1024x1024
+    Count          int    `json:"count,omitempty"`           // Images to make, 1 to 5, default 1
+    Seed           *int64 `json:"seed,omitempty"`            // Repeats a result; random when unset
+    Deliver        string `json:"deliver,omitempty"`         // "s3" uploads the PNGs and returns presigned URLs instead
+}
+
+// ImageParams is a validated image request
+type ImageParams struct {
+    Prompt         string
+    NegativePrompt string
+    Size           string // WIDTHxHEIGHT, canonical
+    Width, Height  int
+    Count          int
+    Seed           *int64
+}
+
+// params validates the request, reporting every problem with it
+func (req *ImageRequest) params() (ImageParams, []FieldError) {
+    p := ImageParams{
+        Prompt:         strings.TrimSpace(req.Prompt),
+        NegativePrompt: strings.TrimSpace(req.NegativePrompt),
+        Count:          req.Count,
+        Seed:           req.Seed,
+    }
+    var problems []FieldError
+    if p.Prompt == "" {
+        problems = append(problems, FieldError{Field: "prompt", Message: "is required"})
+    }
+    switch {
+    case p.Count == 0:
+        p.Count = 1
+    case p.Count < 0 || p.Count > maxImageCount:
+        problems = append(problems, FieldError{Field: "count", Message: fmt.Sprintf("must be between 1 and %d", maxImageCount)})
+    }
+    size := strings.TrimSpace(req.Size)
+    if size == "" {
+        size = defaultImageSize
+    }
+    var ok bool
+    if p.Width, p.Height, ok = parseImageSize(size); ok {
+        p.Size = fmt.Sprintf("%dx%d", p.Width, p.Height)
+    } else {
+        problems = append(problems, FieldError{Field: "size", Message: "must be WIDTHxHEIGHT, such as " + defaultImageSize})
+    }
+    if p.Seed != nil && (*p.Seed < 0 || *p.Seed > maxImageSeed) {
+        problems = append(problems, FieldError{Field: "seed", Message: fmt.Sprintf("must be between 0 and %d", maxImageSeed)})
+    }
+    return p, problems
+}
+
+// parseImageSize reads a WIDTHxHEIGHT size
+func parseImageSize(size string) (width, height int, ok bool) {
+    w, h, found := strings.Cut(strings.ToLower(size), "x")
+    width, werr := strconv.Atoi(w)
+    height, herr := strconv.Atoi(h)
+    if !found || werr != nil || herr != nil || width < 1 || height < 1 {
+        return 0, 0, false
+    }
+    return width, height, true
+}
+
+// imageProblems are the reasons model can't carry out p, nil when it can
+func imageProblems(model ModelInfo, p ImageParams) []FieldError {
+    format := imageFormats[model.API]
+    var problems []FieldError
+    supported := false
+    for _, size := range format.sizes() {
+        supported = supported || size == p.Size
+    }
+    if !supported {
+        problems = append(problems, FieldError{Field: "size", Message: fmt.Sprintf("is not a size %s makes; it makes %s", model.Name, strings.Join(format.sizes(), ", "))})
+    }
+    limit := format.promptLimit()
+    if n := utf8.RuneCountInString(p.Prompt); n > limit {
+        problems = append(problems, FieldError{Field: "prompt", Message: fmt.Sprintf("has %d characters, more than the %d %s accepts", n, limit, model.Name)})
+    }
+    if n := utf8.RuneCountInString(p.NegativePrompt); n > limit {
+        problems = append(problems, FieldError{Field: "negative_prompt", Message: fmt.Sprintf("has %d characters, more than the %d %s accepts", n, limit, model.Name)})
+    }
+    return problems
+}
+
+// GeneratedImage is one image in an /images response
+type GeneratedImage struct {
+    Index    int             `json:"index"`
+    Base64   string          `json:"b64_png,omitempty"`  // Absent when delivered to S3
+    Seed     *int64          `json:"seed,omitempty"`     // When the model reports it
+    Delivery *ResultDelivery `json:"delivery,omitempty"` // With "deliver": "s3", where the PNG was uploaded
+}
+
+// ImageResponse is the body of a successful POST /images
+type ImageResponse struct {
+    Images    []GeneratedImage `json:"images"`
+    ModelUsed string           `json:"model_used"`
+    ModelID   string           `json:"model_id"`
+    Size      string           `json:"size"`
+    LatencyMs int64            `json:"latency_ms"` // Of the model's invocations
+}
+
+// ImageRefusal is a model's content policy declining to make the images
+type ImageRefusal struct {
+    Model  string
+    Reason string
+}
+
+func (e *ImageRefusal) Error() string {
+    return fmt.Sprintf("model %s refused the image request: %s", e.Model, e.Reason)
+}
+
+// contentPolicyRefusal is the reason given when Bedrock rejected an image
+// request for its content rather than its form, "" for any other error.
+// Titan reports these as a ValidationException about its content filters.
+func contentPolicyRefusal(err error) string {
+    var validation *types.ValidationException
+    if errors.As(err, &validation) && strings.Contains(strings.ToLower(validation.ErrorMessage()), "content filter") {
+        return validation.ErrorMessage()
+    }
+    return ""
+}
+
+// imageChain is the image models a request tries: those its preference
+// matches, or every one, that can make the images asked for, in catalog
+// order. Those not usable now are returned as skipped. A preference that
+// matches no image model, or only ones that can't make the images, is
+// rejected with why.
+func (bc *BedrockClient) imageChain(preferred string, p ImageParams) ([]ModelInfo, []ModelFailure, *APIError) {
+    now := time.Now()
+    warming := !bc.registryReady.Load()
+    bc.modelsMu.RLock()
+    defer bc.modelsMu.RUnlock()
+
+    var matched []ModelInfo
+    for _, model := range bc.availableModels {
+        if model.modality() == modalityImage && (preferred == "" || model.matches(preferred)) {
+            matched = append(matched, model)
+        }
+    }
+    if len(matched) == 0 && preferred != "" {
+        return nil, nil, &APIError{
+            Code:    ErrCodeValidation,
+            Message: fmt.Sprintf("Model %q matches no configured image model", preferred),
+            Fields:  []FieldError{{Field: "model", Message: "matches no image model name or ID"}},
+        }
+    }
+
+    chain := []ModelInfo{}
+    var skipped []ModelFailure
+    capable := 0
+    for _, model := range matched {
+        if imageProblems(model, p) != nil {
+            continue
+        }
+        capable++
+        switch {
+        case bc.usableLocked(model, now, warming):
+            chain = append(chain, model)
+        case model.Disabled:
+            skipped = append(skipped, ModelFailure{Model: model.ID, ErrorClass: errClassNotAvailable, Reason: "disabled by an admin"})
+        default:
+            reason := "unavailable"
+            if model.ProbeStatus != "" {
+                reason += ": " + model.ProbeStatus
+            }
+            skipped = append(skipped, ModelFailure{Model: model.ID, ErrorClass: errClassNotAvailable, Reason: reason})
+        }
+    }
+    if capable == 0 && len(matched) > 0 {
+        // Say what the model that would have been tried first needs
+        return nil, nil, &APIError{Code: ErrCodeValidation, Message: "Invalid image request", Fields: imageProblems(matched[0], p)}
+    }
+    return chain, skipped, nil
+}
+
+// GenerateImages tries the chain's models in order until one makes the
+// images. A refusal is returned as is; other failures fall back.
+func (bc *BedrockClient) GenerateImages(ctx context.Context, chain []ModelInfo, skipped []ModelFailure, p ImageParams) (*ImageResponse, error) {
+    rec := requestRecordFrom(ctx)
+    var lastError error
+    var attempted []string
+    failures := append([]ModelFailure(nil), skipped...)
+    for _, model := range chain {
+        started := time.Now()
+        if !bc.breakerAdmit(model.ID, started) {
+            logInfof(ctx, "Skipping image model %s: its breaker is open", model.Name)
+            rec.Attempt(model.ID, "", started, "breaker_open", nil)
+            if lastError == nil {
+                lastError = errBreakerOpen
+            }
+            failures = append(failures, modelFailure(model.ID, errBreakerOpen))
+            continue
+        }
+        attempted = append(attempted, model.ID)
+
+        images, account, err := bc.invokeImageModel(ctx, model, p)
+        var refusal *ImageRefusal
+        if errors.As(err, &refusal) {
+            bc.breakerRecord(model.ID, nil, time.Now()) // The model answered
+            logWarnf(ctx, "Image model %s refused the request: %s", model.Name, refusal.Reason)
+            metrics.Inc("image_generations_total", "model", model.ID, "outcome", "refused")
+            rec.Attempt(model.ID, accountName(account), started, "refused", err)
+            return nil, err
+        }
+        bc.breakerRecord(model.ID, err, time.Now())
+        if isCancelled(err) {
+            rec.Attempt(model.ID, accountName(account), started, "cancelled", err)
+            return nil, &GenerationError{Attempted: attempted, Err: err}
+        }
+        if err != nil && isDeadline(ctx.Err()) {
+            rec.Attempt(model.ID, accountName(account), started, "timeout", err)
+            return nil, &GenerationError{Attempted: attempted, Err: ctx.Err()}
+        }
+        if err != nil {
+            lastError = err
+            logWarnf(ctx, "Error with image model %s: %v", model.Name, err)
+            metrics.Inc("image_generations_total", "model", model.ID, "outcome", "error")
+            rec.Attempt(model.ID, accountName(account), started, "error", err)
+            failures = append(failures, modelFailure(model.ID, err))
+            continue
+        }
+
+        logInfof(ctx, "✓ Generated %d image(s) with model: %s (account %s)", len(images), model.Name, account.Name)
+        metrics.Inc("image_generations_total", "model", model.ID, "outcome", "success")
+        rec.Attempt(model.ID, account.Name, started, "success", nil)
+        return &ImageResponse{
+            Images:    images,
+            ModelUsed: model.Name,
+            ModelID:   model.ID,
+            Size:      p.Size,
+            LatencyMs: time.Since(started).Milliseconds(),
+        }, nil
+    }
+
+    if lastError == nil {
+        lastError = fmt.Errorf("no available image models found")
+    }
+    return nil, &GenerationError{Attempted: attempted, Failures: failures, Err: lastError}
+}
+
+// invokeImageModel makes p's images with one model, in as many invocations
+// as its format needs. A seed is advanced for each invocation after the
+// first, so their images differ.
+func (bc *BedrockClient) invokeImageModel(ctx context.Context, model ModelInfo, p ImageParams) ([]GeneratedImage, *Account, error) {
+    format := imageFormats[model.API]
+    var images []GeneratedImage
+    var account *Account
+    for len(images) < p.Count {
+        var seed *int64
+        if p.Seed != nil {
+            next := *p.Seed + int64(len(images))
+            seed = &next
+        }
+        body, err := marshalRequestBody(ctx, model.ID, format.imageBody(p, min(p.Count-len(images), format.perRequest()), seed))
+        if err != nil {
+            return nil, account, err
+        }
+        var resp *bedrockruntime.InvokeModelOutput
+        resp, account, err = bc.accounts.InvokeModel(ctx, originUser, &bedrockruntime.InvokeModelInput{
+            Body:        body,
+            ModelId:     aws.String(model.invokeID()),
+            ContentType: aws.String("application/json"),
+            Accept:      aws.String("application/json"),
+        })
+        if reason := contentPolicyRefusal(err); reason != "" {
+            return nil, account, &ImageRefusal{Model: model.ID, Reason: reason}
+        }
+        if err != nil {
+            return nil, account, err
+        }
+
+        var response map[string]interface{}
+        if err := json.Unmarshal(resp.Body, &response); err != nil {
+            return nil, account, fmt.Errorf("error parsing response: %v", err)
+        }
+        batch, refusal, ok := format.parseImages(response)
+        if refusal != "" {
+            return nil, account, &ImageRefusal{Model: model.ID, Reason: refusal}
+        }
+        if !ok || len(batch) == 0 {
+            return nil, account, fmt.Errorf("unexpected response format from model %s", model.Name)
+        }
+        for _, image := range batch {
+            image.Index = len(images)
+            images = append(images, image)
+        }
+    }
+    return images[:p.Count], account, nil
+}
+
+// imageKey names an uploaded image: under the date like results, by request
+// and index
+func imageKey(id string, index int, now time.Time) string {
+    return fmt.Sprintf("%s/%s-%d.png", now.UTC().Format("2006/01/02"), id, index)
+}
+
+// deliverImages uploads the response's images and swaps their base64 for
+// where they went
+func deliverImages(ctx context.Context, rs *ResultStore, resp *ImageResponse) error {
+    id := requestIDFrom(ctx)
+    if id == "" {
+        id = newRequestID()
+    }
+    now := time.Now()
+    for i := range resp.Images {
+        image := &resp.Images[i]
+        png, err := base64.StdEncoding.DecodeString(image.Base64)
+        if err != nil {
+            return fmt.Errorf("image %d is not valid base64: %v", image.Index, err)
+        }
+        delivery, err := rs.PutObject(ctx, imageKey(id, image.Index, now), "image/png", png, now)
+        if err != nil {
+            return err
+        }
+        image.Delivery, image.Base64 = delivery, ""
+    }
+    return nil
+}
+
+func imagesHandler(bc *BedrockClient, results *ResultStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req ImageRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+        p, problems := req.params()
+        if err := checkDeliver(req.Deliver, results); err != nil {
+            problems = append(problems, FieldError{Field: "deliver", Message: err.Error()})
+        }
+        if len(problems) > 0 {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{Code: ErrCodeValidation, Message: "Invalid image request", Fields: problems})
+            return
+        }
+        chain, skipped, apiErr := bc.imageChain(req.Model, p)
+        if apiErr != nil {
+            writeAPIError(w, r, http.StatusBadRequest, *apiErr)
+            return
+        }
+
+        logInfof(r.Context(), "Received image request: %d image(s) at %s", p.Count, p.Size)
+        resp, err := bc.GenerateImages(r.Context(), chain, skipped, p)
+        if err != nil {
+            logErrorf(r.Context(), "Error generating images: %v", err)
+            status, apiErr := imageErrorResponse(err)
+            writeAPIError(w, r, status, apiErr)
+            return
+        }
+        if req.Deliver == deliverS3 {
+            if err := deliverImages(r.Context(), results, resp); err != nil {
+                logWarnf(r.Context(), "Image delivery to s3://%s failed: %v", results.cfg.Bucket, err)
+                metrics.Inc("result_deliveries_total", "outcome", "error")
+                writeError(w, r, http.StatusBadGateway, ErrCodeDeliveryFailed, "The images could not be uploaded")
+                return
+            }
+            metrics.Inc("result_deliveries_total", "outcome", "s3")
+        }
+        writeJSON(w, r, resp)
+    }
+}
+
+// imageErrorResponse maps a failed image request to a response: a content
+// policy refusal is a 422 with the model's reason, anything else answers as
+// a failed generation does
+func imageErrorResponse(err error) (int, APIError) {
+    var refusal *ImageRefusal
+    if errors.As(err, &refusal) {
+        return http.StatusUnprocessableEntity, APIError{
+            Code:      ErrCodeContentBlocked,
+            Message:   "The image request was refused by content policy: " + refusal.Reason,
+            Attempted: []string{refusal.Model},
+        }
+    }
+    return generationErrorResponse(err)
+}
+
+// titanSizes are the sizes Titan Image Generator makes
+var titanSizes = []string{
+    "1024x1024", "768x768", "512x512", "768x1152", "384x576", "1152x768", "576x384",
+    "768x1280", "384x640", "1280x768", "640x384", "896x1152", "448x576", "1152x896",
+    "576x448", "768x1408", "384x704", "1408x768", "704x384", "640x1408", "320x704",
+    "1408x640", "704x320", "1152x640", "1173x640",
+}
+
+// titanImageFormat is Amazon Titan Image Generator's text-to-image task.
+// Blocked content comes back as a ValidationException, or in the body's
+// error field.
+type titanImageFormat struct{}
+
+func (titanImageFormat) sizes() []string  { return titanSizes }
+func (titanImageFormat) perRequest() int  { return 5 }
+func (titanImageFormat) promptLimit() int { return 512 }
+
+func (titanImageFormat) imageBody(p ImageParams, count int, seed *int64) map[string]interface{} {
+    params := map[string]interface{}{"text": p.Prompt}
+    if p.NegativePrompt != "" {
+        params["negativeText"] = p.NegativePrompt
+    }
+    config := map[string]interface{}{"numberOfImages": count, "width": p.Width, "height": p.Height}
+    if seed != nil {
+        config["seed"] = *seed
+    }
+    return map[string]interface{}{
+        "taskType":              "TEXT_IMAGE",
+        "textToImageParams":     params,
+        "imageGenerationConfig": config,
+    }
+}
+
+func (titanImageFormat) probeBody() map[string]interface{} {
+    return map[string]interface{}{
+        "taskType":              "TEXT_IMAGE",
+        "textToImageParams":     map[string]interface{}{"text": "Hello"},
+        "imageGenerationConfig": map[string]interface{}{"numberOfImages": 1, "width": 512, "height": 512},
+    }
+}
+
+func (titanImageFormat) parseImages(response map[string]interface{}) ([]GeneratedImage, string, bool) {
+    if message, _ := response["error"].(string); message != "" {
+        return nil, message, true
+    }
+    encoded, ok := response["images"].([]interface{})
+    if !ok {
+        return nil, "", false
+    }
+    images := make([]GeneratedImage, 0, len(encoded))
+    for _, e := range encoded {
+        data, ok := e.(string)
+        if !ok {
+            return nil, "", false
+        }
+        images = append(images, GeneratedImage{Base64: data})
+    }
+    return images, "", true
+}
+
+// stabilitySizes are the sizes Stable Diffusion XL makes
+var stabilitySizes = []string{
+    "1024x1024", "1152x896", "1216x832", "1344x768", "1536x640",
+    "640x1536", "768x1344", "832x1216", "896x1152",
+}
+
+// stabilityFormat is Stability AI's Stable Diffusion XL. Bedrock makes one
+// image per invocation, and marks one its filter withheld CONTENT_FILTERED.
+type stabilityFormat struct{}
+
+func (stabilityFormat) sizes() []string  { return stabilitySizes }
+func (stabilityFormat) perRequest() int  { return 1 }
+func (stabilityFormat) promptLimit() int { return 2000 }
+
+func (stabilityFormat) imageBody(p ImageParams, count int, seed *int64) map[string]interface{} {
+    prompts := []map[string]interface{}{{"text": p.Prompt, "weight": 1.0}}
+    if p.NegativePrompt != "" {
+        prompts = append(prompts, map[string]interface{}{"text": p.NegativePrompt, "weight": -1.0})
+    }
+    body := map[string]interface{}{"text_prompts": prompts, "width": p.Width, "height": p.Height, "samples": count}
+    if seed != nil {
+        body["seed"] = *seed
+    }
+    return body
+}
+
+func (stabilityFormat) probeBody() map[string]interface{} {
+    return map[string]interface{}{
+        "text_prompts": []map[string]interface{}{{"text": "Hello"}},
+        "steps":        10,
+    }
+}
+
+func (stabilityFormat) parseImages(response map[string]interface{}) ([]GeneratedImage, string, bool) {
+    artifacts, ok := response["artifacts"].([]interface{})
+    if !ok {
+        return nil, "", false
+    }
+    images := make([]GeneratedImage, 0, len(artifacts))
+    for _, a := range artifacts {
+        artifact, ok := a.(map[string]interface{})
+        if !ok {
+            return nil, "", false
+        }
+        switch artifact["finishReason"] {
+        case "CONTENT_FILTERED":
+            return nil, "the image was withheld by the model's content filter", true
+        case "ERROR":
+            return nil, "", false
+        }
+        data, ok := artifact["base64"].(string)
+        if !ok {
+            return nil, "", false
+        }
+        image := GeneratedImage{Base64: data}
+        if seed, ok := artifact["seed"].(float64); ok {
+            s := int64(seed)
+            image.Seed = &s
+        }
+        images = append(images, image)
+    }
+    return images, "", true
+}
@@ -0,0 +1,105 @@
+package main
+
+// AI21 Jamba models take an OpenAI-style chat request: one messages array
+// with the system prompt as its first message, and the sampling parameters
+// at the top level. They answer with choices[0].message.content.
+
+// buildJambaBody is buildRequestBody for the Jamba chat format
+func buildJambaBody(p GenerationParams) map[string]interface{} {
+    system := p.withContextPrefix(p.systemPrompt(defaultSystemPrompt))
+
+    messages := make([]map[string]interface{}, 0, len(p.History)+2)
+    // An empty system prompt is left out, like on the messages API
+    if system != "" {
+        messages = append(messages, map[string]interface{}{"role": "system", "content": system})
+    }
+    messages = append(messages, p.messages()...)
+
+    body := map[string]interface{}{
+        "messages":    messages,
+        "max_tokens":  p.MaxTokens,
+        "temperature": *p.Temperature,
+    }
+    if p.TopP != nil {
+        body["top_p"] = *p.TopP
+    }
+    // Jamba has no top_k, and rejects the request if one is sent
+    if len(p.StopSequences) > 0 {
+        body["stop"] = p.StopSequences
+    }
+    return body
+}
+
+// jambaChoice returns the first choice of a Jamba response
+func jambaChoice(response map[string]interface{}) (map[string]interface{}, bool) {
+    choices, ok := response["choices"].([]interface{})
+    if !ok || len(choices) == 0 {
+        return nil, false
+    }
+    choice, ok := choices[0].(map[string]interface{})
+    return choice, ok
+}
+
+// jambaText reads the generated text of a Jamba response
+func jambaText(response map[string]interface{}) (string, bool) {
+    choice, ok := jambaChoice(response)
+    if !ok {
+        return "", false
+    }
+    message, ok := choice["message"].(map[string]interface{})
+    if !ok {
+        return "", false
+    }
+    text, ok := message["content"].(string)
+    return text, ok
+}
+
+// jambaUsage reads the token usage a Jamba response reports, zero when it
+// reports none
+func jambaUsage(response map[string]interface{}) (input, output int) {
+    usage, ok := response["usage"].(map[string]interface{})
+    if !ok {
+        return 0, 0
+    }
+    if n, ok := usage["prompt_tokens"].(float64); ok {
+        input = int(n)
+    }
+    if n, ok := usage["completion_tokens"].(float64); ok {
+        output = int(n)
+    }
+    return input, output
+}
+
+// jambaFormat is AI21's OpenAI-style chat
+type jambaFormat struct{}
+
+func (jambaFormat) buildBody(p GenerationParams) map[string]interface{} {
+    return buildJambaBody(p)
+}
+
+func (jambaFormat) probeBody(prompt string) map[string]interface{} {
+    return map[string]interface{}{
+        "max_tokens": 10,
+        "messages": []map[string]string{
+            {"role": "user", "content": prompt},
+        },
+    }
+}
+
+func (jambaFormat) provider() string { return providerAI21Jamba }
+
+func (jambaFormat) stopReason(response map[string]interface{}) string {
+    // Jamba reports it per choice
+    choice, _ := jambaChoice(response)
+    raw, _ := choice["finish_reason"].(string)
+    return raw
+}
+
+func (jambaFormat) parseResponse(response map[string]interface{}, p GenerationParams, result *GenerationResult) bool {
+    result.InputTokens, result.OutputTokens = jambaUsage(response)
+    // Jamba doesn't say which stop sequence matched, and sends no top_k
+    result.Sampling.TopK = nil
+    text, ok := jambaText(response)
+    result.Text = text
+    return ok
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "net/http"
+    "sync"
+)
+
+// maxPooledBuffer keeps the occasional huge response from pinning memory in the pool
+const maxPooledBuffer = 64 << 10
+
+var bufferPool = sync.Pool{
+    New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// writeJSON encodes v into a pooled buffer and writes it in one call. The
+// bytes are the same as json.NewEncoder(w).Encode(v), trailing newline
+// included, but a value that fails to encode becomes a 500 instead of a
+// truncated 200.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+    buf := bufferPool.Get().(*bytes.Buffer)
+    buf.Reset()
+    defer func() {
+        if buf.Cap() <= maxPooledBuffer {
+            bufferPool.Put(buf)
+        }
+    }()
+
+    if err := json.NewEncoder(buf).Encode(v); err != nil {
+        logErrorf(r.Context(), "Internal error: encoding response: %v", err)
+        writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "Error encoding response")
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(buf.Bytes())
+}
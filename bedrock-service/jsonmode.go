@@ -0,0 +1,460 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "sort"
+    "strings"
+)
+
+// maxSchemaProblems bounds the validation_failed event when the output is wildly off
+const maxSchemaProblems = 20
+
+// errJSONAborted is returned by a jsonModeWriter once it has aborted the
+// stream; the error event has already been sent
+var errJSONAborted = errors.New("stream aborted: output is not valid JSON")
+
+// ResponseFormat asks for the response to be a single JSON value. Schema is a
+// subset of JSON Schema: type, properties, required, additionalProperties
+// (false only), items and enum are enforced; other keywords such as
+// description or format are accepted and ignored.
+type ResponseFormat struct {
+    Type   string                 `json:"type"` // Only "json"
+    Schema map[string]interface{} `json:"schema,omitempty"`
+}
+
+var schemaTypes = map[string]bool{
+    "object": true, "array": true, "string": true, "number": true,
+    "integer": true, "boolean": true, "null": true,
+}
+
+// validate checks the format and its schema before any model is invoked
+func (rf *ResponseFormat) validate() error {
+    if rf.Type != "json" {
+        return fmt.Errorf("response_format.type must be \"json\"")
+    }
+    if rf.Schema == nil {
+        return nil
+    }
+    if err := checkSchema(rf.Schema, "response_format.schema"); err != nil {
+        return err
+    }
+    // The stream is checked as an object or array as it arrives, so a
+    // scalar top-level value could never pass
+    for _, t := range schemaTypeList(rf.Schema) {
+        if t != "object" && t != "array" {
+            return fmt.Errorf("response_format.schema must describe an object or an array")
+        }
+    }
+    return nil
+}
+
+// instruction is the system prompt line asking the model for JSON
+func (rf *ResponseFormat) instruction() string {
+    line := "Respond with a single JSON object or array and nothing else: no prose, no Markdown code fences."
+    if rf.Schema != nil {
+        schema, _ := json.Marshal(rf.Schema)
+        line += " It must match this JSON Schema: " + string(schema)
+    }
+    return line
+}
+
+// rootOpener is the opening character the schema requires, or 0 for either
+func (rf *ResponseFormat) rootOpener() byte {
+    types := schemaTypeList(rf.Schema)
+    if len(types) != 1 {
+        return 0
+    }
+    switch types[0] {
+    case "object":
+        return '{'
+    case "array":
+        return '['
+    }
+    return 0
+}
+
+// checkSchema rejects schemas the validator would misread
+func checkSchema(schema map[string]interface{}, field string) error {
+    if raw, ok := schema["type"]; ok {
+        types := schemaTypeList(schema)
+        if len(types) == 0 {
+            return fmt.Errorf("%s.type must be a type name or a list of them", field)
+        }
+        for _, t := range types {
+            if !schemaTypes[t] {
+                return fmt.Errorf("%s.type: unknown type %v", field, raw)
+            }
+        }
+    }
+    if raw, ok := schema["properties"]; ok {
+        properties, ok := raw.(map[string]interface{})
+        if !ok {
+            return fmt.Errorf("%s.properties must be an object", field)
+        }
+        for name, sub := range properties {
+            subSchema, ok := sub.(map[string]interface{})
+            if !ok {
+                return fmt.Errorf("%s.properties.%s must be a schema object", field, name)
+            }
+            if err := checkSchema(subSchema, field+".properties."+name); err != nil {
+                return err
+            }
+        }
+    }
+    if raw, ok := schema["required"]; ok {
+        list, ok := raw.([]interface{})
+        if !ok {
+            return fmt.Errorf("%s.required must be a list of property names", field)
+        }
+        for _, name := range list {
+            if _, ok := name.(string); !ok {
+                return fmt.Errorf("%s.required must be a list of property names", field)
+            }
+        }
+    }
+    if raw, ok := schema["additionalProperties"]; ok {
+        if _, ok := raw.(bool); !ok {
+            return fmt.Errorf("%s.additionalProperties must be true or false", field)
+        }
+    }
+    if raw, ok := schema["items"]; ok {
+        items, ok := raw.(map[string]interface{})
+        if !ok {
+            return fmt.Errorf("%s.items must be a schema object", field)
+        }
+        if err := checkSchema(items, field+".items"); err != nil {
+            return err
+        }
+    }
+    if raw, ok := schema["enum"]; ok {
+        if _, ok := raw.([]interface{}); !ok {
+            return fmt.Errorf("%s.enum must be a list", field)
+        }
+    }
+    return nil
+}
+
+// schemaTypeList returns the schema's type keyword as a list
+func schemaTypeList(schema map[string]interface{}) []string {
+    switch t := schema["type"].(type) {
+    case string:
+        return []string{t}
+    case []interface{}:
+        var types []string
+        for _, v := range t {
+            s, ok := v.(string)
+            if !ok {
+                return nil
+            }
+            types = append(types, s)
+        }
+        return types
+    }
+    return nil
+}
+
+// jsonTypeOf names a decoded value's JSON Schema type
+func jsonTypeOf(v interface{}) string {
+    switch n := v.(type) {
+    case nil:
+        return "null"
+    case bool:
+        return "boolean"
+    case string:
+        return "string"
+    case float64:
+        if n == math.Trunc(n) {
+            return "integer"
+        }
+        return "number"
+    case []interface{}:
+        return "array"
+    case map[string]interface{}:
+        return "object"
+    }
+    return fmt.Sprintf("%T", v)
+}
+
+// validateSchema appends every way v fails schema to problems. Paths are
+// JSONPath-style, starting at $.
+func validateSchema(schema map[string]interface{}, v interface{}, path string, problems *[]FieldError) {
+    if len(*problems) >= maxSchemaProblems {
+        return
+    }
+    fail := func(format string, args ...interface{}) {
+        if len(*problems) < maxSchemaProblems {
+            *problems = append(*problems, FieldError{Field: path, Message: fmt.Sprintf(format, args...)})
+        }
+    }
+
+    if types := schemaTypeList(schema); len(types) > 0 {
+        actual := jsonTypeOf(v)
+        matched := false
+        for _, t := range types {
+            // Every integer is also a number
+            if t == actual || (t == "number" && actual == "integer") {
+                matched = true
+            }
+        }
+        if !matched {
+            fail("must be %s, got %s", strings.Join(types, " or "), actual)
+            return
+        }
+    }
+
+    if enum, ok := schema["enum"].([]interface{}); ok {
+        found := false
+        for _, allowed := range enum {
+            a, _ := json.Marshal(allowed)
+            b, _ := json.Marshal(v)
+            if string(a) == string(b) {
+                found = true
+                break
+            }
+        }
+        if !found {
+            fail("must be one of the enum values")
+        }
+    }
+
+    switch value := v.(type) {
+    case map[string]interface{}:
+        properties, _ := schema["properties"].(map[string]interface{})
+        if required, ok := schema["required"].([]interface{}); ok {
+            for _, name := range required {
+                if _, present := value[name.(string)]; !present {
+                    fail("missing required property %q", name)
+                }
+            }
+        }
+        names := make([]string, 0, len(value))
+        for name := range value {
+            names = append(names, name)
+        }
+        sort.Strings(names) // Deterministic problem order
+        for _, name := range names {
+            sub, known := properties[name].(map[string]interface{})
+            if !known {
+                if extra, ok := schema["additionalProperties"].(bool); ok && !extra && len(*problems) < maxSchemaProblems {
+                    *problems = append(*problems, FieldError{Field: path + "." + name, Message: "is not allowed by the schema"})
+                }
+                continue
+            }
+            validateSchema(sub, value[name], path+"."+name, problems)
+        }
+    case []interface{}:
+        if items, ok := schema["items"].(map[string]interface{}); ok {
+            for i, item := range value {
+                validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i), problems)
+            }
+        }
+    }
+}
+
+// jsonViolation is an irrecoverable problem found while the output streams:
+// no continuation could make the text valid JSON
+type jsonViolation struct {
+    Offset int    // Byte offset into the output
+    Kind   string // Metric label: prefix, trailing, mismatch, unexpected, control or escape
+    Reason string
+}
+
+func (v *jsonViolation) Error() string {
+    return fmt.Sprintf("invalid JSON at byte %d: %s", v.Offset, v.Reason)
+}
+
+// jsonScanner tracks enough of JSON's structure, incrementally, to spot
+// output that can no longer become valid JSON: a prose prefix, mismatched
+// brackets, bare words, text after the closing bracket, bad escapes and raw
+// control characters in strings. Anything it accepts is still fully parsed
+// once the stream ends.
+type jsonScanner struct {
+    root     byte // Required opening character, or 0 for { or [
+    stack    []byte
+    inString bool
+    escape   bool
+    hex      int // \u digits still expected
+    started  bool
+    complete bool
+    offset   int
+}
+
+// bareJSONChars may appear outside strings, in numbers and true/false/null
+const bareJSONChars = "0123456789-+.eEtrufalsn"
+
+// Feed scans the next part of the output
+func (s *jsonScanner) Feed(text string) error {
+    for i := 0; i < len(text); i, s.offset = i+1, s.offset+1 {
+        c := text[i]
+        violation := func(kind, format string, args ...interface{}) error {
+            return &jsonViolation{Offset: s.offset, Kind: kind, Reason: fmt.Sprintf(format, args...)}
+        }
+
+        switch {
+        case s.inString:
+            switch {
+            case s.hex > 0:
+                if !strings.ContainsRune("0123456789abcdefABCDEF", rune(c)) {
+                    return violation("escape", "invalid \\u escape in string")
+                }
+                s.hex--
+            case s.escape:
+                s.escape = false
+                switch c {
+                case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+                case 'u':
+                    s.hex = 4
+                default:
+                    return violation("escape", "invalid escape \\%c in string", c)
+                }
+            case c == '\\':
+                s.escape = true
+            case c == '"':
+                s.inString = false
+            case c < 0x20:
+                return violation("control", "unescaped control character in string")
+            }
+
+        case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+
+        case s.complete:
+            return violation("trailing", "text after the end of the JSON value")
+
+        case !s.started:
+            if (c != '{' && c != '[') || (s.root != 0 && c != s.root) {
+                want := "a JSON object or array"
+                if s.root == '{' {
+                    want = "a JSON object"
+                } else if s.root == '[' {
+                    want = "a JSON array"
+                }
+                return violation("prefix", "output must start with %s, got %q", want, c)
+            }
+            s.started = true
+            s.stack = append(s.stack, c)
+
+        case c == '{' || c == '[':
+            s.stack = append(s.stack, c)
+
+        case c == '}' || c == ']':
+            open := byte('{')
+            if c == ']' {
+                open = '['
+            }
+            if s.stack[len(s.stack)-1] != open {
+                return violation("mismatch", "%q closes %q", c, s.stack[len(s.stack)-1])
+            }
+            s.stack = s.stack[:len(s.stack)-1]
+            s.complete = len(s.stack) == 0
+
+        case c == '"':
+            s.inString = true
+
+        case c == ',' || c == ':' || strings.IndexByte(bareJSONChars, c) >= 0:
+
+        default:
+            return violation("unexpected", "unexpected %q outside a string", c)
+        }
+    }
+    return nil
+}
+
+// jsonObjectEvent carries the validated output in JSON mode
+type jsonObjectEvent struct {
+    Object json.RawMessage `json:"object"`
+}
+
+// jsonValidationFailedEvent reports output that isn't valid, or doesn't
+// match the schema, once the stream has ended
+type jsonValidationFailedEvent struct {
+    Error  string       `json:"error"`
+    Fields []FieldError `json:"fields,omitempty"`
+}
+
+// jsonModeWriter checks text deltas as they pass through. On a violation it
+// sends a typed error event, cancels the invocation and fails every later
+// send with errJSONAborted. Before the done event it validates the complete
+// output and sends an object or validation_failed event.
+type jsonModeWriter struct {
+    sink    eventWriter
+    format  *ResponseFormat
+    cancel  func()
+    scanner jsonScanner
+    output  strings.Builder
+    aborted error
+}
+
+func newJSONModeWriter(sink eventWriter, format *ResponseFormat, cancel func()) *jsonModeWriter {
+    return &jsonModeWriter{sink: sink, format: format, cancel: cancel, scanner: jsonScanner{root: format.rootOpener()}}
+}
+
+// Aborted returns the violation that ended the stream, if any
+func (j *jsonModeWriter) Aborted() error {
+    return j.aborted
+}
+
+func (j *jsonModeWriter) Send(event string, data interface{}) error {
+    if j.aborted != nil {
+        return errJSONAborted
+    }
+    switch event {
+    case "delta":
+        if delta, ok := data.(textDeltaEvent); ok {
+            if err := j.scanner.Feed(delta.Text); err != nil {
+                j.abort(err)
+                return errJSONAborted
+            }
+            j.output.WriteString(delta.Text)
+        }
+    case "done":
+        j.finish()
+    }
+    return j.sink.Send(event, data)
+}
+
+func (j *jsonModeWriter) abort(err error) {
+    j.aborted = err
+    j.cancel()
+    var violation *jsonViolation
+    reason := "unexpected"
+    if errors.As(err, &violation) {
+        reason = violation.Kind
+    }
+    metrics.Inc("json_stream_aborts_total", "reason", reason)
+    metrics.Inc("json_stream_results_total", "outcome", "aborted")
+    log.Printf("Aborted JSON mode stream after %d bytes: %v", j.scanner.offset, err)
+    j.sink.Send("error", streamErrorEvent{Error: err.Error(), Code: ErrCodeInvalidJSON, FinishReason: finishError})
+}
+
+// finish validates the complete output ahead of the done event
+func (j *jsonModeWriter) finish() {
+    text := j.output.String()
+    failed := func(message string, fields []FieldError) {
+        metrics.Inc("json_stream_results_total", "outcome", "invalid")
+        j.sink.Send("validation_failed", jsonValidationFailedEvent{Error: message, Fields: fields})
+    }
+
+    if !j.scanner.complete {
+        failed("output ended before the JSON value was complete", nil)
+        return
+    }
+    var value interface{}
+    if err := json.Unmarshal([]byte(text), &value); err != nil {
+        failed(fmt.Sprintf("output is not valid JSON: %v", err), nil)
+        return
+    }
+    if j.format.Schema != nil {
+        var problems []FieldError
+        validateSchema(j.format.Schema, value, "$", &problems)
+        if len(problems) > 0 {
+            failed("output does not match the schema", problems)
+            return
+        }
+    }
+    metrics.Inc("json_stream_results_total", "outcome", "valid")
+    j.sink.Send("object", jsonObjectEvent{Object: json.RawMessage(strings.TrimSpace(text))})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "math/rand"
+    "strings"
+    "testing"
+)
+
+// scanCase is output for the incremental scanner, with the violation it must
+// report, if any, wherever the stream happens to split it
+type scanCase struct {
+    name     string
+    root     byte
+    text     string
+    kind     string // Empty when the text is acceptable
+    offset   int
+    complete bool
+}
+
+var scanCases = []scanCase{
+    {name: "object", text: `{"a":1}`, complete: true},
+    {name: "array of scalars", text: `  [1, -2.5e-3, true, false, null]`, complete: true},
+    {name: "whitespace after", text: "{}\n \t\r\n", complete: true},
+    {name: "escapes", text: `{"s":"q \" b \\ s \/ \b\f\n\r\t é 😀"}`, complete: true},
+    {name: "escaped backslash before quote", text: `{"a":"\\"}`, complete: true},
+    {name: "brackets in strings", text: `{"k":"}]{[","l":["]"]}`, complete: true},
+    {name: "multi-byte text", text: `{"言葉":"日本語 😀"}`, complete: true},
+    {name: "deep nesting", text: strings.Repeat(`{"a":[`, 150) + "1" + strings.Repeat("]}", 150), complete: true},
+    {name: "object root", root: '{', text: `{"a":[1]}`, complete: true},
+    {name: "array root", root: '[', text: `[{"a":1}]`, complete: true},
+    {name: "open object", text: `{"a":`},
+    {name: "open string", text: `{"a":"tex`},
+    {name: "open escape", text: `{"a":"\u00`},
+    {name: "open deep nesting", text: strings.Repeat("[", 300)},
+    {name: "empty", text: ""},
+    {name: "whitespace only", text: "  \n"},
+
+    {name: "prose prefix", text: `Sure! {"a":1}`, kind: "prefix", offset: 0},
+    {name: "fenced", text: "```json\n{}\n```", kind: "prefix", offset: 0},
+    {name: "scalar root", text: `"just a string"`, kind: "prefix", offset: 0},
+    {name: "wrong root object", root: '{', text: ` [1]`, kind: "prefix", offset: 1},
+    {name: "wrong root array", root: '[', text: `{}`, kind: "prefix", offset: 0},
+    {name: "trailing prose", text: "  \n{\"a\":1} ok", kind: "trailing", offset: 11},
+    {name: "second value", text: `{"a":1}{`, kind: "trailing", offset: 7},
+    {name: "trailing after deep nesting", text: strings.Repeat("[", 64) + strings.Repeat("]", 64) + "]", kind: "trailing", offset: 128},
+    {name: "mismatch", text: `{"a":[1}`, kind: "mismatch", offset: 7},
+    {name: "deep mismatch", text: strings.Repeat("[{", 40) + "]", kind: "mismatch", offset: 80},
+    {name: "bare word", text: `{"a":yes}`, kind: "unexpected", offset: 5},
+    {name: "single quotes", text: `{'a':1}`, kind: "unexpected", offset: 1},
+    {name: "control character", text: "{\"a\":\"b\x01\"}", kind: "control", offset: 7},
+    {name: "raw newline", text: "{\"a\":\"line\nbreak\"}", kind: "control", offset: 10},
+    {name: "bad escape", text: `{"a":"\q"}`, kind: "escape", offset: 7},
+    {name: "bad unicode escape", text: `{"a":"\u12G4"}`, kind: "escape", offset: 10},
+    {name: "short unicode escape", text: `{"a":"\u12"}`, kind: "escape", offset: 10},
+}
+
+// scan feeds text to a fresh scanner in the given chunks
+func scan(root byte, chunks []string) (*jsonScanner, error) {
+    s := &jsonScanner{root: root}
+    for _, chunk := range chunks {
+        if err := s.Feed(chunk); err != nil {
+            return s, err
+        }
+    }
+    return s, nil
+}
+
+// byteChunks splits text a byte at a time, through multi-byte characters
+func byteChunks(text string) []string {
+    chunks := make([]string, len(text))
+    for i := range chunks {
+        chunks[i] = text[i : i+1]
+    }
+    return chunks
+}
+
+// randomChunks splits text into chunks of one to eight bytes
+func randomChunks(text string, rng *rand.Rand) []string {
+    var chunks []string
+    for len(text) > 0 {
+        n := 1 + rng.Intn(8)
+        if n > len(text) {
+            n = len(text)
+        }
+        chunks, text = append(chunks, text[:n]), text[n:]
+    }
+    return chunks
+}
+
+func TestJSONScanner(t *testing.T) {
+    for _, c := range scanCases {
+        t.Run(c.name, func(t *testing.T) {
+            splits := map[string][]string{"whole": {c.text}, "bytes": byteChunks(c.text)}
+            rng := rand.New(rand.NewSource(int64(len(c.text))))
+            for i := 0; i < 20; i++ {
+                splits[fmt.Sprintf("random %d", i)] = randomChunks(c.text, rng)
+            }
+
+            for split, chunks := range splits {
+                s, err := scan(c.root, chunks)
+                if c.kind == "" {
+                    if err != nil {
+                        t.Fatalf("%s: %v", split, err)
+                    }
+                    if s.complete != c.complete {
+                        t.Errorf("%s: complete %v, want %v", split, s.complete, c.complete)
+                    }
+                    continue
+                }
+                var violation *jsonViolation
+                if !errors.As(err, &violation) {
+                    t.Fatalf("%s: error %v, want a %s violation", split, err, c.kind)
+                }
+                if violation.Kind != c.kind || violation.Offset != c.offset {
+                    t.Errorf("%s: %s violation at byte %d (%v), want %s at %d", split, violation.Kind, violation.Offset, err, c.kind, c.offset)
+                }
+            }
+        })
+    }
+}
+
+// recordingWriter keeps every event sent through it
+type recordingWriter struct {
+    events []string
+    data   []interface{}
+}
+
+func (w *recordingWriter) Send(event string, data interface{}) error {
+    w.events, w.data = append(w.events, event), append(w.data, data)
+    return nil
+}
+
+// stream sends deltas and then done through a JSON mode writer, stopping at
+// the first error as the stream loop does
+func stream(format *ResponseFormat, deltas ...string) (*recordingWriter, *jsonModeWriter, int, int) {
+    sink, cancels := &recordingWriter{}, 0
+    j := newJSONModeWriter(sink, format, func() { cancels++ })
+    sent := 0
+    for _, delta := range deltas {
+        if j.Send("delta", textDeltaEvent{Text: delta}) != nil {
+            return sink, j, sent, cancels
+        }
+        sent++
+    }
+    j.Send("done", nil)
+    return sink, j, sent, cancels
+}
+
+func TestJSONModeWriterAbortsEarly(t *testing.T) {
+    sink, j, sent, cancels := stream(&ResponseFormat{Type: "json"}, `{"a":`, ` [1, 2`, `]} and then`, ` some prose`, `}`)
+
+    // The delta carrying the violation never reaches the caller
+    if sent != 2 || cancels != 1 {
+        t.Fatalf("%d deltas sent, %d cancels; want 2 and 1", sent, cancels)
+    }
+    if strings.Join(sink.events, ",") != "delta,delta,error" {
+        t.Fatalf("events %v", sink.events)
+    }
+    event, ok := sink.data[2].(streamErrorEvent)
+    if !ok || event.Code != ErrCodeInvalidJSON || event.FinishReason != finishError || !strings.Contains(event.Error, "byte 14") {
+        t.Errorf("error event %+v", sink.data[2])
+    }
+    var violation *jsonViolation
+    if !errors.As(j.Aborted(), &violation) || violation.Kind != "trailing" {
+        t.Errorf("aborted with %v", j.Aborted())
+    }
+
+    // Nothing gets through afterwards, done included
+    for _, event := range []string{"delta", "done", "error"} {
+        if err := j.Send(event, textDeltaEvent{Text: "x"}); !errors.Is(err, errJSONAborted) {
+            t.Errorf("%s after the abort: %v", event, err)
+        }
+    }
+    if len(sink.events) != 3 || cancels != 1 {
+        t.Errorf("events %v and %d cancels after the abort", sink.events, cancels)
+    }
+}
+
+func TestJSONModeWriterFinish(t *testing.T) {
+    schema := map[string]interface{}{
+        "type":     "object",
+        "required": []interface{}{"name"},
+        "properties": map[string]interface{}{
+            "name": map[string]interface{}{"type": "string"},
+        },
+    }
+    for _, c := range []struct {
+        name   string
+        format *ResponseFormat
+        deltas []string
+        events string
+    }{
+        {"valid", &ResponseFormat{Type: "json"}, []string{`{"na`, `me": "Ada"}`, "\n"}, "delta,delta,delta,object,done"},
+        {"matches schema", &ResponseFormat{Type: "json", Schema: schema}, []string{`{"name":"Ada"}`}, "delta,object,done"},
+        {"schema mismatch", &ResponseFormat{Type: "json", Schema: schema}, []string{`{"name":`, `42}`}, "delta,delta,validation_failed,done"},
+        {"ended early", &ResponseFormat{Type: "json"}, []string{`{"name":"Ada"`}, "delta,validation_failed,done"},
+        // Scans cleanly but doesn't parse: the scanner leaves commas and numbers to the parser
+        {"bad number", &ResponseFormat{Type: "json"}, []string{`{"a":1..2}`}, "delta,validation_failed,done"},
+        {"schema root", &ResponseFormat{Type: "json", Schema: schema}, []string{`[{"name":"Ada"}]`}, "error"},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            sink, _, _, _ := stream(c.format, c.deltas...)
+            if got := strings.Join(sink.events, ","); got != c.events {
+                t.Fatalf("events %s, want %s", got, c.events)
+            }
+            for i, event := range sink.events {
+                if event == "object" {
+                    if object := sink.data[i].(jsonObjectEvent).Object; string(object) != strings.TrimSpace(strings.Join(c.deltas, "")) {
+                        t.Errorf("object %s", object)
+                    }
+                }
+            }
+        })
+    }
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Keys may carry their own limits in the API_KEYS_FILE, on the key's policy
+// or its tenant's, so one team can't starve the others:
+//
+//    "policy": {"rate_limit": {"requests_per_minute": 600, "tokens_per_minute": 200000}}
+//
+// Each key has a token bucket per limit, holding a minute's worth and
+// refilling continuously. A request takes one from the requests bucket when
+// it's admitted; the tokens bucket is charged the usage a generation
+// returns, once it's known, so it may go into debt, and the key's requests
+// are turned away until it refills past zero. A tenant's limit applies to
+// each of its keys separately.
+
+// KeyRateLimit is a key's limits. Zero leaves that limit off.
+type KeyRateLimit struct {
+    RequestsPerMinute int `json:"requests_per_minute,omitempty"`
+    TokensPerMinute   int `json:"tokens_per_minute,omitempty"`
+}
+
+// validate checks the limits as given in the key file
+func (l *KeyRateLimit) validate() error {
+    switch {
+    case l.RequestsPerMinute < 0 || l.TokensPerMinute < 0:
+        return fmt.Errorf("rate_limit values must not be negative")
+    case l.RequestsPerMinute == 0 && l.TokensPerMinute == 0:
+        return fmt.Errorf("rate_limit sets neither requests_per_minute nor tokens_per_minute")
+    }
+    return nil
+}
+
+// Limit names, as they appear in 429 bodies and metrics
+const (
+    limitRequests = "requests"
+    limitTokens   = "tokens"
+)
+
+// tokenBucket holds up to a minute's worth and refills at a minute's worth
+// per minute. level is as of at.
+type tokenBucket struct {
+    perMinute int
+    level     float64
+    at        time.Time
+}
+
+// refill brings the bucket up to now, taking on a changed limit
+func (b *tokenBucket) refill(perMinute int, now time.Time) {
+    if b.perMinute != perMinute {
+        b.level = math.Min(b.level, float64(perMinute))
+        b.perMinute = perMinute
+    }
+    if elapsed := now.Sub(b.at); elapsed > 0 {
+        b.level = math.Min(b.level+elapsed.Minutes()*float64(b.perMinute), float64(b.perMinute))
+        b.at = now
+    }
+}
+
+// until is how long the bucket takes to refill to level
+func (b *tokenBucket) until(level float64) time.Duration {
+    if b.level >= level || b.perMinute == 0 {
+        return 0
+    }
+    return time.Duration((level - b.level) / float64(b.perMinute) * float64(time.Minute))
+}
+
+// keyBuckets are one key's buckets; a nil bucket is a limit left off
+type keyBuckets struct {
+    tenant   string
+    requests *tokenBucket
+    tokens   *tokenBucket
+}
+
+// KeyLimitDecision is the outcome of a key's admission check
+type KeyLimitDecision struct {
+    Allowed bool
+    Limit   string // The limit that turned the request away: requests or tokens
+    PerMin  int
+    ResetAt time.Time // When the request would have been admitted
+}
+
+// KeyLimiter holds the buckets of the keys with limits. It's safe for
+// concurrent use.
+type KeyLimiter struct {
+    mu      sync.Mutex
+    buckets map[string]*keyBuckets // By key ID
+}
+
+// NewKeyLimiter returns a limiter with every bucket full
+func NewKeyLimiter() *KeyLimiter {
+    return &KeyLimiter{buckets: make(map[string]*keyBuckets)}
+}
+
+// keyLimits is the process-wide limiter, charged by the usage ledger
+var keyLimits = NewKeyLimiter()
+
+// bucketsLocked returns the key's buckets, refilled to now, creating full
+// ones on first sight. It returns nil for keys without limits.
+func (kl *KeyLimiter) bucketsLocked(p *Principal, now time.Time) *keyBuckets {
+    limit := p.Policy.RateLimit
+    if limit == nil {
+        delete(kl.buckets, p.KeyID)
+        return nil
+    }
+    kb, ok := kl.buckets[p.KeyID]
+    if !ok {
+        kb = &keyBuckets{}
+        kl.buckets[p.KeyID] = kb
+    }
+    kb.tenant = p.Tenant
+    kb.requests = fitBucket(kb.requests, limit.RequestsPerMinute, now)
+    kb.tokens = fitBucket(kb.tokens, limit.TokensPerMinute, now)
+    return kb
+}
+
+// fitBucket refills b to now under perMinute, making a full bucket when the
+// limit is new and dropping it when the limit is off
+func fitBucket(b *tokenBucket, perMinute int, now time.Time) *tokenBucket {
+    switch {
+    case perMinute == 0:
+        return nil
+    case b == nil:
+        return &tokenBucket{perMinute: perMinute, level: float64(perMinute), at: now}
+    }
+    b.refill(perMinute, now)
+    return b
+}
+
+// Admit takes a request from the caller's requests bucket, unless either
+// bucket is empty. Callers without a key or without limits are admitted.
+func (kl *KeyLimiter) Admit(p *Principal, now time.Time) KeyLimitDecision {
+    if p == nil {
+        return KeyLimitDecision{Allowed: true}
+    }
+    kl.mu.Lock()
+    defer kl.mu.Unlock()
+
+    kb := kl.bucketsLocked(p, now)
+    if kb == nil {
+        return KeyLimitDecision{Allowed: true}
+    }
+    if kb.tokens != nil && kb.tokens.level <= 0 {
+        // A token over zero is enough to go on
+        return KeyLimitDecision{Limit: limitTokens, PerMin: kb.tokens.perMinute, ResetAt: now.Add(kb.tokens.until(1))}
+    }
+    if kb.requests != nil {
+        if kb.requests.level < 1 {
+            return KeyLimitDecision{Limit: limitRequests, PerMin: kb.requests.perMinute, ResetAt: now.Add(kb.requests.until(1))}
+        }
+        kb.requests.level--
+    }
+    return KeyLimitDecision{Allowed: true}
+}
+
+// Charge takes the tokens a generation used from the caller's tokens bucket
+func (kl *KeyLimiter) Charge(p *Principal, tokens int, now time.Time) {
+    if p == nil || tokens <= 0 {
+        return
+    }
+    kl.mu.Lock()
+    defer kl.mu.Unlock()
+
+    if kb := kl.bucketsLocked(p, now); kb != nil && kb.tokens != nil {
+        kb.tokens.level -= float64(tokens)
+    }
+}
+
+// BucketLevel is where one bucket stands
+type BucketLevel struct {
+    PerMinute int       `json:"per_minute"`
+    Level     float64   `json:"level"`   // Negative when tokens are owed
+    Used      float64   `json:"used"`    // Fraction of the limit in use, over 1 in debt
+    FullAt    time.Time `json:"full_at"` // When the bucket will have refilled if left alone
+}
+
+// KeyBucketStatus is where one key stands against its limits
+type KeyBucketStatus struct {
+    KeyID    string       `json:"key_id"`
+    Tenant   string       `json:"tenant,omitempty"`
+    Requests *BucketLevel `json:"requests,omitempty"`
+    Tokens   *BucketLevel `json:"tokens,omitempty"`
+}
+
+// bucketLevel reports b as of now; b was refilled to a time at or before now
+func bucketLevel(b *tokenBucket, now time.Time) *BucketLevel {
+    if b == nil {
+        return nil
+    }
+    level := *b
+    level.refill(b.perMinute, now)
+    return &BucketLevel{
+        PerMinute: level.perMinute,
+        Level:     math.Round(level.level*100) / 100,
+        Used:      math.Round((1-level.level/float64(level.perMinute))*1000) / 1000,
+        FullAt:    now.Add(level.until(float64(level.perMinute))).UTC(),
+    }
+}
+
+// Levels reports every key seen since start, fullest first in use. Keys
+// that haven't been seen are full.
+func (kl *KeyLimiter) Levels(now time.Time) []KeyBucketStatus {
+    kl.mu.Lock()
+    levels := make([]KeyBucketStatus, 0, len(kl.buckets))
+    for id, kb := range kl.buckets {
+        levels = append(levels, KeyBucketStatus{
+            KeyID:    id,
+            Tenant:   kb.tenant,
+            Requests: bucketLevel(kb.requests, now),
+            Tokens:   bucketLevel(kb.tokens, now),
+        })
+    }
+    kl.mu.Unlock()
+
+    sort.Slice(levels, func(i, j int) bool {
+        ui, uj := levels[i].used(), levels[j].used()
+        if ui != uj {
+            return ui > uj
+        }
+        return levels[i].KeyID < levels[j].KeyID
+    })
+    return levels
+}
+
+// used is the larger of the key's bucket fractions in use
+func (s KeyBucketStatus) used() float64 {
+    used := 0.0
+    for _, b := range []*BucketLevel{s.Requests, s.Tokens} {
+        if b != nil && b.Used > used {
+            used = b.Used
+        }
+    }
+    return used
+}
+
+// admitKeyLimits checks the caller's key limits, writing the 429 when over
+func admitKeyLimits(w http.ResponseWriter, r *http.Request, kl *KeyLimiter, now time.Time) bool {
+    decision := kl.Admit(principalFrom(r.Context()), now)
+    if decision.Allowed {
+        return true
+    }
+    metrics.Inc("key_rate_limited_requests_total", "path", r.URL.Path, "limit", decision.Limit)
+    requestRecordFrom(r.Context()).Policy("key rate limit: %d %s per minute exhausted until %s", decision.PerMin, decision.Limit, decision.ResetAt.UTC().Format(time.RFC3339))
+    resetAt := decision.ResetAt.UTC()
+    writeAPIError(w, r, http.StatusTooManyRequests, APIError{
+        Code:              ErrCodeRateLimited,
+        Message:           fmt.Sprintf("API key rate limit of %d %s per minute exceeded", decision.PerMin, decision.Limit),
+        RetryAfterSeconds: retryAfterSeconds(decision.ResetAt.Sub(now)),
+        Limit:             decision.PerMin,
+        LimitUnit:         decision.Limit + "_per_minute",
+        ResetAt:           &resetAt,
+    })
+    return false
+}
+
+// keyRateLimitsHandler handles GET /admin/rate-limits: every key's bucket
+// levels, the keys nearest their caps first
+func keyRateLimitsHandler(kl *KeyLimiter) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{"keys": kl.Levels(time.Now())})
+    }
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+    "fmt"
+    "net/url"
+    "os"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+// Link filter modes, in increasing order of strictness
+const (
+    LinkFilterOff      = "off"
+    LinkFilterAnnotate = "annotate" // Report every link with its verdict in the response
+    LinkFilterStrip    = "strip"    // Remove disallowed links, keeping any link text
+    LinkFilterBlock    = "block"    // Reject the whole response when a disallowed link appears
+)
+
+var linkFilterStrictness = map[string]int{
+    LinkFilterOff:      0,
+    LinkFilterAnnotate: 1,
+    LinkFilterStrip:    2,
+    LinkFilterBlock:    3,
+}
+
+// removedLinkPlaceholder replaces disallowed bare URLs in strip mode, since
+// leaving the URL text in place would still get it auto-linked by the UI
+const removedLinkPlaceholder = "[link removed]"
+
+// LinkInfo is reported for each link found in a response in annotate mode
+type LinkInfo struct {
+    URL     string `json:"url"`
+    Allowed bool   `json:"allowed"`
+}
+
+// LinkPolicy decides which link domains may appear in generated output
+type LinkPolicy struct {
+    Mode    string
+    Allowed []string // If non-empty, only these domains (and subdomains) are allowed
+    Denied  []string // Always rejected, even when also allowlisted
+}
+
+// linkSpan is a link occurrence in the text; Text is the visible link text for markdown links
+type linkSpan struct {
+    Start, End int
+    URL        string
+    Text       string
+    Markdown   bool
+}
+
+// LoadLinkPolicy reads the server-wide link policy from LINK_FILTER_MODE,
+// LINK_ALLOWED_DOMAINS and LINK_DENIED_DOMAINS (comma-separated)
+func LoadLinkPolicy() (*LinkPolicy, error) {
+    mode := strings.ToLower(strings.TrimSpace(os.Getenv("LINK_FILTER_MODE")))
+    if mode == "" {
+        mode = LinkFilterOff
+    }
+    if _, ok := linkFilterStrictness[mode]; !ok {
+        return nil, fmt.Errorf("invalid LINK_FILTER_MODE %q", mode)
+    }
+
+    return &LinkPolicy{
+        Mode:    mode,
+        Allowed: splitDomains(os.Getenv("LINK_ALLOWED_DOMAINS")),
+        Denied:  splitDomains(os.Getenv("LINK_DENIED_DOMAINS")),
+    }, nil
+}
+
+func splitDomains(value string) []string {
+    var domains []string
+    for _, d := range strings.Split(value, ",") {
+        d = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(d)), ".")
+        if d != "" {
+            domains = append(domains, d)
+        }
+    }
+    return domains
+}
+
+// EffectiveMode combines the server mode with a per-request mode; callers may
+// only tighten the policy, never loosen it
+func (p *LinkPolicy) EffectiveMode(requested string) (string, error) {
+    requested = strings.ToLower(strings.TrimSpace(requested))
+    if requested == "" {
+        return p.Mode, nil
+    }
+    strictness, ok := linkFilterStrictness[requested]
+    if !ok {
+        return "", fmt.Errorf("invalid link_filter %q", requested)
+    }
+    if strictness < linkFilterStrictness[p.Mode] {
+        return p.Mode, nil
+    }
+    return requested, nil
+}
+
+// Allows reports whether a URL's host passes the allow/deny lists
+func (p *LinkPolicy) Allows(rawURL string) bool {
+    u, err := url.Parse(rawURL)
+    if err != nil || u.Hostname() == "" {
+        return false
+    }
+    if u.Scheme != "http" && u.Scheme != "https" {
+        return false
+    }
+    host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+
+    for _, d := range p.Denied {
+        if domainMatches(host, d) {
+            return false
+        }
+    }
+    if len(p.Allowed) == 0 {
+        return true
+    }
+    for _, d := range p.Allowed {
+        if domainMatches(host, d) {
+            return true
+        }
+    }
+    return false
+}
+
+// domainMatches matches a host against a domain on label boundaries, so
+// "example.com" matches "docs.example.com" but not "badexample.com"
+func domainMatches(host, domain string) bool {
+    return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// Apply runs the filter over text in the given mode. It returns the possibly
+// rewritten text, the link report (annotate mode only) and an error in block
+// mode when a disallowed link is present.
+func (p *LinkPolicy) Apply(mode, text string) (string, []LinkInfo, error) {
+    if mode == LinkFilterOff {
+        return text, nil, nil
+    }
+
+    spans := extractLinks(text)
+    if len(spans) == 0 {
+        return text, nil, nil
+    }
+
+    var links []LinkInfo
+    var disallowed []string
+    var sb strings.Builder
+    last := 0
+
+    for _, span := range spans {
+        allowed := p.Allows(span.URL)
+        links = append(links, LinkInfo{URL: span.URL, Allowed: allowed})
+        if allowed {
+            continue
+        }
+        disallowed = append(disallowed, span.URL)
+
+        sb.WriteString(text[last:span.Start])
+        if span.Markdown && strings.TrimSpace(span.Text) != "" {
+            sb.WriteString(span.Text)
+        } else {
+            sb.WriteString(removedLinkPlaceholder)
+        }
+        last = span.End
+    }
+    sb.WriteString(text[last:])
+
+    metrics.Add("link_filter_links_total", float64(len(links)), "verdict", "seen")
+    metrics.Add("link_filter_links_total", float64(len(disallowed)), "verdict", "disallowed")
+
+    switch mode {
+    case LinkFilterBlock:
+        if len(disallowed) > 0 {
+            metrics.Inc("link_filter_blocked_total")
+            return "", nil, fmt.Errorf("response contains links to disallowed domains: %s", hostsOf(disallowed))
+        }
+        return text, nil, nil
+    case LinkFilterStrip:
+        return sb.String(), nil, nil
+    default:
+        return text, links, nil
+    }
+}
+
+// hostsOf lists the distinct hosts of the given URLs
+func hostsOf(urls []string) string {
+    seen := make(map[string]bool)
+    var hosts []string
+    for _, raw := range urls {
+        host := raw
+        if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+            host = u.Hostname()
+        }
+        if !seen[host] {
+            seen[host] = true
+            hosts = append(hosts, host)
+        }
+    }
+    sort.Strings(hosts)
+    return strings.Join(hosts, ", ")
+}
+
+var (
+    angleURLPattern = regexp.MustCompile(`<([a-zA-Z][a-zA-Z0-9+.\-]*://[^\s<>]+)>`)
+    bareURLPattern  = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.\-]*://[^\s<>\x60"]+`)
+)
+
+// extractLinks finds markdown links/images, angle-bracket autolinks and bare
+// URLs in text, returned in order of appearance with non-overlapping spans
+func extractLinks(text string) []linkSpan {
+    spans := extractMarkdownLinks(text)
+
+    for _, m := range angleURLPattern.FindAllStringSubmatchIndex(text, -1) {
+        if !overlaps(spans, m[0], m[1]) {
+            spans = append(spans, linkSpan{Start: m[0], End: m[1], URL: text[m[2]:m[3]]})
+        }
+    }
+
+    for _, m := range bareURLPattern.FindAllStringIndex(text, -1) {
+        end := m[0] + len(trimURLTail(text[m[0]:m[1]]))
+        if end > m[0] && !overlaps(spans, m[0], end) {
+            spans = append(spans, linkSpan{Start: m[0], End: end, URL: text[m[0]:end]})
+        }
+    }
+
+    sort.Slice(spans, func(i, j int) bool { return spans[i].Start < spans[j].Start })
+    return spans
+}
+
+// extractMarkdownLinks parses [text](url "title") and ![alt](url) forms,
+// allowing nested brackets in the text and balanced parentheses in the URL
+func extractMarkdownLinks(text string) []linkSpan {
+    var spans []linkSpan
+
+    for i := 0; i < len(text); i++ {
+        if text[i] != '[' || isEscaped(text, i) {
+            continue
+        }
+
+        closeBracket := matchingBracket(text, i)
+        if closeBracket < 0 || closeBracket+1 >= len(text) || text[closeBracket+1] != '(' {
+            continue
+        }
+
+        dest, end, ok := parseLinkDestination(text, closeBracket+2)
+        if !ok {
+            continue
+        }
+
+        start := i
+        if start > 0 && text[start-1] == '!' {
+            start--
+        }
+        spans = append(spans, linkSpan{
+            Start:    start,
+            End:      end,
+            URL:      dest,
+            Text:     text[i+1 : closeBracket],
+            Markdown: true,
+        })
+        i = end - 1
+    }
+    return spans
+}
+
+// matchingBracket returns the index of the ']' closing the '[' at open, or -1
+func matchingBracket(text string, open int) int {
+    depth := 0
+    for j := open; j < len(text); j++ {
+        switch {
+        case isEscaped(text, j):
+        case text[j] == '[':
+            depth++
+        case text[j] == ']':
+            depth--
+            if depth == 0 {
+                return j
+            }
+        case text[j] == '\n' && j+1 < len(text) && text[j+1] == '\n':
+            return -1 // Links don't span paragraphs
+        }
+    }
+    return -1
+}
+
+// parseLinkDestination parses `url "title")` starting just after "](" and
+// returns the URL and the index just past the closing parenthesis
+func parseLinkDestination(text string, pos int) (string, int, bool) {
+    for pos < len(text) && text[pos] == ' ' {
+        pos++
+    }
+    if pos >= len(text) {
+        return "", 0, false
+    }
+
+    var dest string
+    if text[pos] == '<' {
+        end := strings.IndexByte(text[pos:], '>')
+        if end < 0 {
+            return "", 0, false
+        }
+        dest = text[pos+1 : pos+end]
+        pos += end + 1
+    } else {
+        depth := 0
+        start := pos
+        for pos < len(text) {
+            c := text[pos]
+            if c == ' ' || c == '\n' || c == '\t' {
+                break
+            }
+            if c == '(' {
+                depth++
+            } else if c == ')' {
+                if depth == 0 {
+                    break
+                }
+                depth--
+            }
+            pos++
+        }
+        dest = text[start:pos]
+    }
+
+    // Optional title
+    for pos < len(text) && text[pos] == ' ' {
+        pos++
+    }
+    if pos < len(text) && (text[pos] == '"' || text[pos] == '\'') {
+        quote := text[pos]
+        end := strings.IndexByte(text[pos+1:], quote)
+        if end < 0 {
+            return "", 0, false
+        }
+        pos += end + 2
+        for pos < len(text) && text[pos] == ' ' {
+            pos++
+        }
+    }
+
+    if pos >= len(text) || text[pos] != ')' || dest == "" {
+        return "", 0, false
+    }
+    return dest, pos + 1, true
+}
+
+// trimURLTail drops trailing punctuation that belongs to the sentence rather
+// than the URL, keeping closing parentheses that balance an opening one
+func trimURLTail(u string) string {
+    for len(u) > 0 {
+        last := u[len(u)-1]
+        switch last {
+        case '.', ',', ';', ':', '!', '?', '\'', '*', '_', '~':
+            u = u[:len(u)-1]
+            continue
+        case ')':
+            if strings.Count(u, "(") < strings.Count(u, ")") {
+                u = u[:len(u)-1]
+                continue
+            }
+        case ']':
+            if strings.Count(u, "[") < strings.Count(u, "]") {
+                u = u[:len(u)-1]
+                continue
+            }
+        }
+        break
+    }
+    return u
+}
+
+func isEscaped(text string, i int) bool {
+    backslashes := 0
+    for j := i - 1; j >= 0 && text[j] == '\\'; j-- {
+        backslashes++
+    }
+    return backslashes%2 == 1
+}
+
+func overlaps(spans []linkSpan, start, end int) bool {
+    for _, s := range spans {
+        if start < s.End && end > s.Start {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// Every case runs in every mode: annotate reports what strip removes and
+// block rejects
+func TestLinkPolicyApply(t *testing.T) {
+    p := &LinkPolicy{Allowed: []string{"example.com"}, Denied: []string{"bad.example.com"}}
+    deny := func(url string) LinkInfo { return LinkInfo{URL: url, Allowed: false} }
+    allow := func(url string) LinkInfo { return LinkInfo{URL: url, Allowed: true} }
+
+    for _, c := range []struct {
+        name     string
+        text     string
+        links    []LinkInfo // What annotate reports
+        stripped string
+        blocked  string // Hosts named by block's error, empty when it passes
+    }{
+        {"no links", "Nothing to see here.", nil, "Nothing to see here.", ""},
+        {"allowed", "See [docs](https://docs.example.com/a).", []LinkInfo{allow("https://docs.example.com/a")}, "See [docs](https://docs.example.com/a).", ""},
+
+        // Markdown nesting
+        {"nested brackets", "See [the [docs] page](https://evil.com/x) now.",
+            []LinkInfo{deny("https://evil.com/x")}, "See the [docs] page now.", "evil.com"},
+        {"image", "![logo](https://evil.com/a.png)", []LinkInfo{deny("https://evil.com/a.png")}, "logo", "evil.com"},
+        {"empty text", "[](https://evil.com)", []LinkInfo{deny("https://evil.com")}, removedLinkPlaceholder, "evil.com"},
+        {"title", `[t](https://evil.com "A title")`, []LinkInfo{deny("https://evil.com")}, "t", "evil.com"},
+        {"angle destination", "[t](<https://evil.com/a b>)", []LinkInfo{deny("https://evil.com/a b")}, "t", "evil.com"},
+        {"inside emphasis", "**[x](https://evil.com)**.", []LinkInfo{deny("https://evil.com")}, "**x**.", "evil.com"},
+        {"link in link text", "[see https://evil.com/a](https://example.com)",
+            []LinkInfo{allow("https://example.com")}, "[see https://evil.com/a](https://example.com)", ""},
+        {"escaped bracket", `\[not a link](https://evil.com)`,
+            []LinkInfo{deny("https://evil.com")}, `\[not a link](` + removedLinkPlaceholder + ")", "evil.com"},
+        {"across paragraphs", "[a\n\nb](https://evil.com)",
+            []LinkInfo{deny("https://evil.com")}, "[a\n\nb](" + removedLinkPlaceholder + ")", "evil.com"},
+        {"other scheme", "[x](javascript:alert(1))", []LinkInfo{deny("javascript:alert(1)")}, "x", "javascript:alert(1)"},
+
+        // Parentheses
+        {"balanced in markdown", "[Go](https://en.wikipedia.org/wiki/Go_(programming_language))",
+            []LinkInfo{deny("https://en.wikipedia.org/wiki/Go_(programming_language)")}, "Go", "en.wikipedia.org"},
+        {"bare in parentheses", "(see https://evil.com/a)", []LinkInfo{deny("https://evil.com/a")}, "(see " + removedLinkPlaceholder + ")", "evil.com"},
+        {"bare balanced", "(https://evil.com/Go_(lang)).", []LinkInfo{deny("https://evil.com/Go_(lang)")}, "(" + removedLinkPlaceholder + ").", "evil.com"},
+        {"bare brackets", "[https://evil.com/a]", []LinkInfo{deny("https://evil.com/a")}, "[" + removedLinkPlaceholder + "]", "evil.com"},
+
+        // Trailing punctuation belongs to the sentence
+        {"period", "Read https://evil.com/page.", []LinkInfo{deny("https://evil.com/page")}, "Read " + removedLinkPlaceholder + ".", "evil.com"},
+        {"several", "Really? https://evil.com/a?!;", []LinkInfo{deny("https://evil.com/a")}, "Really? " + removedLinkPlaceholder + "?!;", "evil.com"},
+        {"quoted", `"https://evil.com/a"`, []LinkInfo{deny("https://evil.com/a")}, `"` + removedLinkPlaceholder + `"`, "evil.com"},
+        {"emphasis", "_https://evil.com/a_", []LinkInfo{deny("https://evil.com/a")}, "_" + removedLinkPlaceholder + "_", "evil.com"},
+        {"query kept", "https://example.com/search?q=go.", []LinkInfo{allow("https://example.com/search?q=go")}, "https://example.com/search?q=go.", ""},
+        {"angle autolink", "<https://evil.com/x>.", []LinkInfo{deny("https://evil.com/x")}, removedLinkPlaceholder + ".", "evil.com"},
+
+        // Domains
+        {"denied subdomain", "https://docs.example.com/a, and [x](https://bad.example.com)",
+            []LinkInfo{allow("https://docs.example.com/a"), deny("https://bad.example.com")}, "https://docs.example.com/a, and x", "bad.example.com"},
+        {"lookalikes", "https://badexample.com https://example.com.evil.net",
+            []LinkInfo{deny("https://badexample.com"), deny("https://example.com.evil.net")},
+            removedLinkPlaceholder + " " + removedLinkPlaceholder, "badexample.com, example.com.evil.net"},
+        {"case and trailing dot", "https://Docs.Example.COM./a", []LinkInfo{allow("https://Docs.Example.COM./a")}, "https://Docs.Example.COM./a", ""},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            if out, links, err := p.Apply(LinkFilterOff, c.text); out != c.text || links != nil || err != nil {
+                t.Errorf("off: %q, %v, %v", out, links, err)
+            }
+
+            out, links, err := p.Apply(LinkFilterAnnotate, c.text)
+            if out != c.text || err != nil || !reflect.DeepEqual(links, c.links) {
+                t.Errorf("annotate: %q, %v, %v; want links %v", out, links, err, c.links)
+            }
+
+            out, links, err = p.Apply(LinkFilterStrip, c.text)
+            if out != c.stripped || links != nil || err != nil {
+                t.Errorf("strip: %q, %v, %v; want %q", out, links, err, c.stripped)
+            }
+
+            out, _, err = p.Apply(LinkFilterBlock, c.text)
+            if c.blocked == "" {
+                if out != c.text || err != nil {
+                    t.Errorf("block: %q, %v; want it passed", out, err)
+                }
+            } else if out != "" || err == nil || !strings.HasSuffix(err.Error(), ": "+c.blocked) {
+                t.Errorf("block: %q, %v; want it rejected naming %s", out, err, c.blocked)
+            }
+        })
+    }
+}
+
+func TestLinkPolicyEffectiveMode(t *testing.T) {
+    for _, c := range []struct {
+        server, requested, want string
+        wantErr                 bool
+    }{
+        {LinkFilterOff, "", LinkFilterOff, false},
+        {LinkFilterOff, "Strip ", LinkFilterStrip, false},
+        {LinkFilterStrip, LinkFilterBlock, LinkFilterBlock, false},
+        // A caller can't loosen the server's policy
+        {LinkFilterStrip, LinkFilterAnnotate, LinkFilterStrip, false},
+        {LinkFilterBlock, LinkFilterOff, LinkFilterBlock, false},
+        {LinkFilterAnnotate, "remove", "", true},
+    } {
+        got, err := (&LinkPolicy{Mode: c.server}).EffectiveMode(c.requested)
+        if got != c.want || (err != nil) != c.wantErr {
+            t.Errorf("server %s, requested %q: %q, %v", c.server, c.requested, got, err)
+        }
+    }
+}
@@ -0,0 +1,115 @@
+package main
+
+import "strings"
+
+// Meta Llama 3 instruct models take a single prompt already rendered with
+// the Llama 3 chat template, and answer with the generation, its stop_reason
+// and token counts. Bedrock offers them no top_k and no stop sequences; the
+// caller's stop sequences are applied to the generation instead.
+
+// buildLlamaBody is buildRequestBody for the Llama 3 format
+func buildLlamaBody(p GenerationParams) map[string]interface{} {
+    system := p.withContextPrefix(p.systemPrompt(defaultSystemPrompt))
+
+    body := map[string]interface{}{
+        "prompt":      renderLlama3Prompt(system, p.History, p.Prompt),
+        "max_gen_len": p.MaxTokens,
+        "temperature": *p.Temperature,
+    }
+    if p.TopP != nil {
+        body["top_p"] = *p.TopP
+    }
+    return body
+}
+
+// renderLlama3Prompt renders turns with the Llama 3 chat template: each turn
+// is a role header followed by its content and <|eot_id|>, and the prompt
+// ends on an open assistant header for the model to answer under. An empty
+// system prompt is left out. The model still answers when a header token is
+// wrong, just worse, so the layout must match Meta's exactly.
+func renderLlama3Prompt(system string, history []ChatMessage, prompt string) string {
+    var sb strings.Builder
+    turn := func(role, content string) {
+        sb.WriteString("<|start_header_id|>" + role + "<|end_header_id|>\n\n")
+        sb.WriteString(strings.TrimSpace(content) + "<|eot_id|>")
+    }
+
+    sb.WriteString("<|begin_of_text|>")
+    if system != "" {
+        turn("system", system)
+    }
+    for _, m := range append(history[:len(history):len(history)], ChatMessage{Role: roleUser, Content: prompt}) {
+        role := "user"
+        if m.Role == roleAssistant {
+            role = "assistant"
+        }
+        turn(role, m.Content)
+    }
+    sb.WriteString("<|start_header_id|>assistant<|end_header_id|>\n\n")
+    return sb.String()
+}
+
+// llamaText reads the generated text of a Llama response
+func llamaText(response map[string]interface{}) (string, bool) {
+    text, ok := response["generation"].(string)
+    return text, ok
+}
+
+// llamaUsage reads the token usage a Llama response reports, zero when it
+// reports none
+func llamaUsage(response map[string]interface{}) (input, output int) {
+    if n, ok := response["prompt_token_count"].(float64); ok {
+        input = int(n)
+    }
+    if n, ok := response["generation_token_count"].(float64); ok {
+        output = int(n)
+    }
+    return input, output
+}
+
+// cutAtStopSequence ends text where the earliest of the caller's stop
+// sequences begins, standing in for the stop sequences Llama doesn't take.
+// It returns the sequence that matched, if any.
+func cutAtStopSequence(text string, stopSequences []string) (string, string) {
+    cut, matched := len(text), ""
+    for _, stop := range stopSequences {
+        if i := strings.Index(text, stop); stop != "" && i >= 0 && i < cut {
+            cut, matched = i, stop
+        }
+    }
+    return text[:cut], matched
+}
+
+// llamaFormat is Meta Llama 3 instruct
+type llamaFormat struct{}
+
+func (llamaFormat) buildBody(p GenerationParams) map[string]interface{} {
+    return buildLlamaBody(p)
+}
+
+func (llamaFormat) probeBody(prompt string) map[string]interface{} {
+    return map[string]interface{}{
+        "prompt":      renderLlama3Prompt("", nil, prompt),
+        "max_gen_len": 10,
+    }
+}
+
+func (llamaFormat) provider() string { return providerMetaLlama }
+
+func (llamaFormat) stopReason(response map[string]interface{}) string {
+    return rawFinishReason(response)
+}
+
+func (llamaFormat) parseResponse(response map[string]interface{}, p GenerationParams, result *GenerationResult) bool {
+    result.InputTokens, result.OutputTokens = llamaUsage(response)
+    result.Sampling.TopK = nil
+    text, ok := llamaText(response)
+    if !ok {
+        return false
+    }
+    result.Text, result.StopSequence = cutAtStopSequence(text, p.StopSequences)
+    if result.StopSequence != "" {
+        result.FinishReason = finishStopSequence
+    }
+    return true
+}
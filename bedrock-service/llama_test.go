@@ -0,0 +1,150 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strings"
+    "testing"
+)
+
+const llamaModel = "meta.llama3-70b-instruct-v1:0"
+
+// The expected prompts are written out by hand from Meta's template, so a
+// change to a header token or a newline shows up as a failure here
+func TestRenderLlama3Prompt(t *testing.T) {
+    for _, c := range []struct {
+        name    string
+        system  string
+        history []ChatMessage
+        prompt  string
+        want    string
+    }{
+        {"prompt only", "", nil, "Hi",
+            "<|begin_of_text|>" +
+                "<|start_header_id|>user<|end_header_id|>\n\nHi<|eot_id|>" +
+                "<|start_header_id|>assistant<|end_header_id|>\n\n"},
+        {"system prompt", "Be brief.", nil, "Hi",
+            "<|begin_of_text|>" +
+                "<|start_header_id|>system<|end_header_id|>\n\nBe brief.<|eot_id|>" +
+                "<|start_header_id|>user<|end_header_id|>\n\nHi<|eot_id|>" +
+                "<|start_header_id|>assistant<|end_header_id|>\n\n"},
+        {"history", "Be brief.",
+            []ChatMessage{{Role: roleUser, Content: "Capital of France?"}, {Role: roleAssistant, Content: "Paris."}}, "And Spain?",
+            "<|begin_of_text|>" +
+                "<|start_header_id|>system<|end_header_id|>\n\nBe brief.<|eot_id|>" +
+                "<|start_header_id|>user<|end_header_id|>\n\nCapital of France?<|eot_id|>" +
+                "<|start_header_id|>assistant<|end_header_id|>\n\nParis.<|eot_id|>" +
+                "<|start_header_id|>user<|end_header_id|>\n\nAnd Spain?<|eot_id|>" +
+                "<|start_header_id|>assistant<|end_header_id|>\n\n"},
+        // Meta strips each message; inner newlines stay
+        {"whitespace", "  Be brief.\n", []ChatMessage{{Role: roleAssistant, Content: "\nHello!  "}}, " Line one\n\nLine two \n",
+            "<|begin_of_text|>" +
+                "<|start_header_id|>system<|end_header_id|>\n\nBe brief.<|eot_id|>" +
+                "<|start_header_id|>assistant<|end_header_id|>\n\nHello!<|eot_id|>" +
+                "<|start_header_id|>user<|end_header_id|>\n\nLine one\n\nLine two<|eot_id|>" +
+                "<|start_header_id|>assistant<|end_header_id|>\n\n"},
+        // Roles other than assistant are the user's, as in every format
+        {"other roles", "", []ChatMessage{{Role: "tool", Content: "42"}}, "So?",
+            "<|begin_of_text|>" +
+                "<|start_header_id|>user<|end_header_id|>\n\n42<|eot_id|>" +
+                "<|start_header_id|>user<|end_header_id|>\n\nSo?<|eot_id|>" +
+                "<|start_header_id|>assistant<|end_header_id|>\n\n"},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            if got := renderLlama3Prompt(c.system, c.history, c.prompt); got != c.want {
+                t.Errorf("rendered\n%q\nwant\n%q", got, c.want)
+            }
+        })
+    }
+}
+
+// Rendering appends the prompt to the turns without writing into the
+// caller's history, however much room it has
+func TestRenderLlama3PromptLeavesHistory(t *testing.T) {
+    history := make([]ChatMessage, 1, 4)
+    history[0] = ChatMessage{Role: roleUser, Content: "First"}
+    renderLlama3Prompt("", history, "Second")
+    if spare := history[:2][1]; spare.Role != "" || spare.Content != "" {
+        t.Errorf("history's spare capacity holds %+v", spare)
+    }
+}
+
+func TestLlamaRequestBody(t *testing.T) {
+    topP, topK := 0.8, 40
+    p := GenerationParams{Prompt: "Hi", MaxTokens: 256, TopP: &topP, TopK: &topK, StopSequences: []string{"\n\n"}}.withDefaults()
+    body := buildRequestBody(ModelInfo{ID: llamaModel, API: apiLlama}, p)
+
+    if body["max_gen_len"] != 256 || body["temperature"] != *p.Temperature || body["top_p"] != 0.8 {
+        t.Errorf("body %v", body)
+    }
+    // Bedrock rejects these for Llama
+    for _, unsupported := range []string{"top_k", "stop", "stop_sequences", "max_tokens"} {
+        if _, ok := body[unsupported]; ok {
+            t.Errorf("body sends %s", unsupported)
+        }
+    }
+    want := renderLlama3Prompt(p.withContextPrefix(p.systemPrompt(defaultSystemPrompt)), nil, "Hi")
+    if body["prompt"] != want {
+        t.Errorf("prompt %q, want %q", body["prompt"], want)
+    }
+
+    probe := probeRequestBody(ModelInfo{ID: llamaModel, API: apiLlama})
+    if probe["prompt"] != renderLlama3Prompt("", nil, "Hello") || probe["max_gen_len"] != 10 {
+        t.Errorf("probe body %v", probe)
+    }
+}
+
+func TestCutAtStopSequence(t *testing.T) {
+    for _, c := range []struct {
+        text    string
+        stops   []string
+        want    string
+        matched string
+    }{
+        {"1. a\n2. b\n3. c", []string{"3."}, "1. a\n2. b\n", "3."},
+        {"1. a\n2. b\n3. c", []string{"3.", "2."}, "1. a\n", "2."}, // The earliest in the text wins
+        {"abc", []string{"x"}, "abc", ""},
+        {"abc", []string{""}, "abc", ""},
+        {"abc", nil, "abc", ""},
+        {"END", []string{"END"}, "", "END"},
+    } {
+        got, matched := cutAtStopSequence(c.text, c.stops)
+        if got != c.want || matched != c.matched {
+            t.Errorf("cutAtStopSequence(%q, %q) = %q, %q; want %q, %q", c.text, c.stops, got, matched, c.want, c.matched)
+        }
+    }
+}
+
+// Llama is reached through the model preference field, with the template
+// on the wire
+func TestE2ELlamaByModelField(t *testing.T) {
+    fake.Script(llamaModel, fakeReply{Body: `{"generation":"Bonjour !","prompt_token_count":31,"generation_token_count":4,"stop_reason":"stop"}`})
+
+    resp := post(t, "/generate", map[string]interface{}{"prompt": "Say hello in French", "model": llamaModel, "strict_model": true})
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("status %d", resp.StatusCode)
+    }
+    var out GenerateResponse
+    decode(t, resp, &out)
+    if out.Response != "Bonjour !" || out.Meta == nil || out.Meta.ModelID != llamaModel {
+        t.Errorf("response %q from %+v, want Llama's", out.Response, out.Meta)
+    }
+    if out.InputTokens != 31 || out.OutputTokens != 4 || out.FinishReason != finishCompleted {
+        t.Errorf("usage %d/%d, finish reason %q", out.InputTokens, out.OutputTokens, out.FinishReason)
+    }
+
+    calls := fake.Calls(llamaModel)
+    if len(calls) != 1 || calls[0].Operation != "invoke" {
+        t.Fatalf("calls %+v, want one InvokeModel", calls)
+    }
+    var sent struct {
+        Prompt string `json:"prompt"`
+    }
+    if err := json.Unmarshal(calls[0].Body, &sent); err != nil {
+        t.Fatal(err)
+    }
+    const tail = "<|start_header_id|>user<|end_header_id|>\n\nSay hello in French<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\n"
+    if !strings.HasSuffix(sent.Prompt, tail) {
+        t.Errorf("prompt %q doesn't end on the turn and an open assistant header", sent.Prompt)
+    }
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// localizableCodes are the error codes whose messages reach end users.
+// Everything else is for operators and stays in English.
+var localizableCodes = map[string]bool{
+    ErrCodeValidation:     true,
+    ErrCodeRateLimited:    true,
+    ErrCodeBudgetExceeded: true,
+    ErrCodeContentBlocked: true,
+}
+
+// languageTag matches the BCP 47 subset we look up: a primary language with
+// optional subtags, lowercased
+var languageTag = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+// errorMessages translates client-facing error messages. The zero catalog
+// translates nothing.
+var errorMessages = &MessageCatalog{}
+
+// MessageCatalog holds translated messages by error code, then language
+type MessageCatalog struct {
+    messages map[string]map[string]string
+}
+
+// LoadMessageCatalog reads ERROR_MESSAGES_FILE, a JSON object of the form
+// {"<error code>": {"<language>": "<message>"}}. English is the built-in
+// message and needs no entry. A translation replaces the whole message, so it
+// should describe the code in general; per-field details stay in "fields".
+func LoadMessageCatalog() (*MessageCatalog, error) {
+    path := os.Getenv("ERROR_MESSAGES_FILE")
+    if path == "" {
+        return &MessageCatalog{}, nil
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("error reading ERROR_MESSAGES_FILE: %v", err)
+    }
+    var raw map[string]map[string]string
+    if err := json.Unmarshal(data, &raw); err != nil {
+        return nil, fmt.Errorf("invalid ERROR_MESSAGES_FILE: %v", err)
+    }
+
+    catalog := &MessageCatalog{messages: make(map[string]map[string]string)}
+    for code, translations := range raw {
+        if !localizableCodes[code] {
+            return nil, fmt.Errorf("%s: messages for this code are not localized", code)
+        }
+        catalog.messages[code] = make(map[string]string)
+        for lang, message := range translations {
+            tag := strings.ToLower(lang)
+            if !languageTag.MatchString(tag) {
+                return nil, fmt.Errorf("%s: invalid language tag %q", code, lang)
+            }
+            if strings.TrimSpace(message) == "" {
+                return nil, fmt.Errorf("%s (%s): message is empty", code, lang)
+            }
+            catalog.messages[code][tag] = message
+        }
+    }
+    return catalog, nil
+}
+
+// acceptedLanguages returns the tags of an Accept-Language header in
+// preference order, each followed by its fallbacks ("pt-br" then "pt").
+// English, wildcards and q=0 entries end the useful part of the list.
+func acceptedLanguages(header string) []string {
+    type weighted struct {
+        tag string
+        q   float64
+    }
+    var prefs []weighted
+    for _, part := range strings.Split(header, ",") {
+        tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+        tag = strings.ToLower(strings.TrimSpace(tag))
+        q := 1.0
+        if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+            parsed, err := strconv.ParseFloat(v, 64)
+            if err != nil {
+                continue
+            }
+            q = parsed
+        }
+        if tag == "" || q <= 0 {
+            continue
+        }
+        prefs = append(prefs, weighted{tag, q})
+    }
+    sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+
+    var tags []string
+    for _, p := range prefs {
+        if p.tag == "*" {
+            break
+        }
+        for tag := p.tag; tag != ""; {
+            tags = append(tags, tag)
+            cut := strings.LastIndex(tag, "-")
+            if cut < 0 {
+                break
+            }
+            tag = tag[:cut]
+        }
+    }
+    return tags
+}
+
+// Localize returns the message for code in the caller's preferred language
+// and the language used. English, and codes or languages without a
+// translation, return fallback unchanged.
+func (c *MessageCatalog) Localize(acceptLanguage, code, fallback string) (string, string) {
+    translations := c.messages[code]
+    if len(translations) == 0 {
+        return fallback, "en"
+    }
+    for _, tag := range acceptedLanguages(acceptLanguage) {
+        if tag == "en" || strings.HasPrefix(tag, "en-") {
+            break
+        }
+        if message, ok := translations[tag]; ok {
+            return message, tag
+        }
+    }
+    return fallback, "en"
+}
+
+// localizeError translates a client-facing envelope for the request
+func localizeError(w http.ResponseWriter, r *http.Request, apiErr *APIError) {
+    if !localizableCodes[apiErr.Code] {
+        return
+    }
+    w.Header().Add("Vary", "Accept-Language")
+    message, lang := errorMessages.Localize(r.Header.Get("Accept-Language"), apiErr.Code, apiErr.Message)
+    apiErr.Message = message
+    w.Header().Set("Content-Language", lang)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// testCatalog loads a catalog from JSON the way ERROR_MESSAGES_FILE is read
+func testCatalog(t *testing.T, data string) (*MessageCatalog, error) {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), "messages.json")
+    if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("ERROR_MESSAGES_FILE", path)
+    return LoadMessageCatalog()
+}
+
+func TestAcceptedLanguages(t *testing.T) {
+    for _, c := range []struct {
+        header string
+        want   []string
+    }{
+        {"", nil},
+        {"fr", []string{"fr"}},
+        {"pt-BR", []string{"pt-br", "pt"}},
+        {"zh-Hant-TW", []string{"zh-hant-tw", "zh-hant", "zh"}},
+        {"de;q=0.5, fr-CA", []string{"fr-ca", "fr", "de"}},
+        {"es, it;q=0.9, *;q=0.1, de;q=0.05", []string{"es", "it"}},
+        {"fr;q=0, de", []string{"de"}},
+        // Malformed entries are skipped, not fatal
+        {"fr;q=high, de", []string{"de"}},
+        {",,;q=0.5, ;, it", []string{"it"}},
+        {"*", nil},
+    } {
+        if got := acceptedLanguages(c.header); !reflect.DeepEqual(got, c.want) {
+            t.Errorf("acceptedLanguages(%q) = %q, want %q", c.header, got, c.want)
+        }
+    }
+}
+
+// A regional tag falls back to its language, then to the English default
+func TestLocalize(t *testing.T) {
+    catalog, err := testCatalog(t, `{
+        "validation_error": {"fr": "Requête invalide", "pt": "Pedido inválido", "pt-BR": "Solicitação inválida"},
+        "rate_limited":     {"de": "Zu viele Anfragen"}
+    }`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    const english = "Invalid request body"
+
+    for _, c := range []struct {
+        name    string
+        header  string
+        code    string
+        message string
+        lang    string
+    }{
+        {"exact region", "pt-BR", ErrCodeValidation, "Solicitação inválida", "pt-br"},
+        {"region to language", "pt-PT", ErrCodeValidation, "Pedido inválido", "pt"},
+        {"region to language, any case", "FR-ca", ErrCodeValidation, "Requête invalide", "fr"},
+        {"language to default", "ja", ErrCodeValidation, english, "en"},
+        {"unknown tag", "xx-yy", ErrCodeValidation, english, "en"},
+        {"next preference", "ja, fr;q=0.8", ErrCodeValidation, "Requête invalide", "fr"},
+        {"english preferred", "en-GB, fr;q=0.8", ErrCodeValidation, english, "en"},
+        {"translated for another code only", "de", ErrCodeValidation, english, "en"},
+        {"other code", "de-AT", ErrCodeRateLimited, "Zu viele Anfragen", "de"},
+        {"code without translations", "fr", ErrCodeBudgetExceeded, english, "en"},
+        {"no header", "", ErrCodeValidation, english, "en"},
+        {"malformed header", "fr;q=;;, ==", ErrCodeValidation, english, "en"},
+        {"malformed weight", "fr;q=x, pt", ErrCodeValidation, "Pedido inválido", "pt"},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            message, lang := catalog.Localize(c.header, c.code, english)
+            if message != c.message || lang != c.lang {
+                t.Errorf("Localize(%q, %s) = %q (%s), want %q (%s)", c.header, c.code, message, lang, c.message, c.lang)
+            }
+        })
+    }
+
+    if message, lang := (&MessageCatalog{}).Localize("fr", ErrCodeValidation, english); message != english || lang != "en" {
+        t.Errorf("empty catalog localized to %q (%s)", message, lang)
+    }
+}
+
+func TestLoadMessageCatalogErrors(t *testing.T) {
+    for name, data := range map[string]string{
+        "not json":      `{"validation_error": `,
+        "internal code": `{"internal_error": {"fr": "Erreur interne"}}`,
+        "bad tag":       `{"validation_error": {"fr_FR": "Requête invalide"}}`,
+        "empty message": `{"validation_error": {"fr": "  "}}`,
+    } {
+        t.Run(name, func(t *testing.T) {
+            if _, err := testCatalog(t, data); err == nil {
+                t.Errorf("catalog %s loaded", data)
+            }
+        })
+    }
+}
+
+// Only client-facing envelopes are translated, and the response says so
+func TestLocalizeError(t *testing.T) {
+    catalog, err := testCatalog(t, `{"validation_error": {"fr": "Requête invalide"}}`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    previous := errorMessages
+    errorMessages = catalog
+    defer func() { errorMessages = previous }()
+
+    for _, c := range []struct {
+        code     string
+        message  string
+        language string // Content-Language, empty when untouched
+    }{
+        {ErrCodeValidation, "Requête invalide", "fr"},
+        {ErrCodeInternal, "Request processing failed", ""},
+    } {
+        r := httptest.NewRequest(http.MethodPost, "/generate", nil)
+        r.Header.Set("Accept-Language", "fr-FR")
+        w := httptest.NewRecorder()
+        apiErr := APIError{Code: c.code, Message: "Request processing failed"}
+        if c.code == ErrCodeValidation {
+            apiErr.Message = "Invalid request body"
+        }
+        localizeError(w, r, &apiErr)
+        if apiErr.Message != c.message || w.Header().Get("Content-Language") != c.language {
+            t.Errorf("%s: %q in %q, want %q in %q", c.code, apiErr.Message, w.Header().Get("Content-Language"), c.message, c.language)
+        }
+        if vary := strings.Join(w.Header().Values("Vary"), ","); (vary != "") != (c.language != "") {
+            t.Errorf("%s: Vary %q", c.code, vary)
+        }
+    }
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "strconv"
+    "time"
+)
+
+// Logs are JSON lines, one object per line, at the level LOG_LEVEL asks for:
+// debug, info (the default), warn or error. The standard log package is
+// routed through the same handler, at info. Lines logged with a request's
+// context carry its request_id, and its trace_id when it's traced, so every
+// line of a request can be found from the X-Request-ID it was answered with.
+// Prompt content is only logged at debug. With LOG_PROMPT_HASHES set, the
+// prompt's analytics fingerprint is logged at info instead, so a request
+// can be matched to /analytics/prompts/{hash} without its text in the logs.
+
+// promptLogRunes is how much of a prompt is logged at debug
+const promptLogRunes = 100
+
+// logPromptHashes logs prompt fingerprints at info, see LoadLogging
+var logPromptHashes bool
+
+// LoadLogging installs the JSON logger, writing to out or else os.Stderr,
+// as the default, slog and log alike. It reads LOG_LEVEL and LOG_PROMPT_HASHES.
+func LoadLogging(out io.Writer) error {
+    level := slog.LevelInfo
+    if v := os.Getenv("LOG_LEVEL"); v != "" {
+        if err := level.UnmarshalText([]byte(v)); err != nil {
+            return fmt.Errorf("invalid LOG_LEVEL %q", v)
+        }
+    }
+    if v := os.Getenv("LOG_PROMPT_HASHES"); v != "" {
+        hashes, err := strconv.ParseBool(v)
+        if err != nil {
+            return fmt.Errorf("invalid LOG_PROMPT_HASHES %q", v)
+        }
+        logPromptHashes = hashes
+    }
+    if out == nil {
+        out = os.Stderr
+    }
+    handler := slog.NewJSONHandler(out, &slog.HandlerOptions{Level: level})
+    slog.SetDefault(slog.New(contextHandler{handler}))
+    return nil
+}
+
+// contextHandler adds the request and trace IDs of a record's context
+type contextHandler struct {
+    slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+    if id := requestIDFrom(ctx); id != "" {
+        rec.AddAttrs(slog.String("request_id", id))
+    }
+    if id := traceIDFrom(ctx); id != "" {
+        rec.AddAttrs(slog.String("trace_id", id))
+    }
+    return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+    return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// logInfof logs a formatted message at info on behalf of ctx's request
+func logInfof(ctx context.Context, format string, args ...interface{}) {
+    slog.InfoContext(ctx, fmt.Sprintf(format, args...))
+}
+
+// logWarnf logs a formatted message at warn on behalf of ctx's request
+func logWarnf(ctx context.Context, format string, args ...interface{}) {
+    slog.WarnContext(ctx, fmt.Sprintf(format, args...))
+}
+
+// logErrorf logs a formatted message at error on behalf of ctx's request
+func logErrorf(ctx context.Context, format string, args ...interface{}) {
+    slog.ErrorContext(ctx, fmt.Sprintf(format, args...))
+}
+
+// logAttempt logs how one model attempt went. Failures are warnings, with
+// the error class remediation.go gives them; cancellations aren't failures.
+func logAttempt(ctx context.Context, modelID, account, outcome string, started time.Time, err error) {
+    level := slog.LevelInfo
+    attrs := []interface{}{
+        "model_id", modelID,
+        "outcome", outcome,
+        "duration_ms", time.Since(started).Milliseconds(),
+    }
+    if account != "" {
+        attrs = append(attrs, "account", account)
+    }
+    if err != nil && outcome != "cancelled" {
+        level = slog.LevelWarn
+        attrs = append(attrs, "error_class", classifyError(err), "error", err.Error())
+    }
+    slog.Log(ctx, level, "model attempt", attrs...)
+}
+
+// logPrompt logs a prompt's arrival: its start at debug, or with
+// LOG_PROMPT_HASHES its fingerprint at info and its start only at debug
+func logPrompt(ctx context.Context, msg, prompt string, attrs ...interface{}) {
+    logger := slog.Default()
+    level := slog.LevelDebug
+    attrs = append([]interface{}{"prompt_bytes", len(prompt)}, attrs...)
+    if logPromptHashes {
+        level = slog.LevelInfo
+        attrs = append(attrs, "prompt_fingerprint", promptFingerprint(prompt))
+    }
+    if !logger.Enabled(ctx, level) {
+        return
+    }
+    if logger.Enabled(ctx, slog.LevelDebug) {
+        attrs = append(attrs, "prompt", truncateRunes(prompt, promptLogRunes))
+    }
+    logger.Log(ctx, level, msg, attrs...)
+}
+
+// truncateMarker ends text that truncateRunes cut short
+const truncateMarker = "…"
+
+// truncateRunes cuts s to at most n runes without splitting one, marking
+// the cut with an ellipsis
+func truncateRunes(s string, n int) string {
+    for i := range s {
+        if n == 0 {
+            return s[:i] + truncateMarker
+        }
+        n--
+    }
+    return s
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "strings"
+    "testing"
+    "unicode/utf8"
+)
+
+// Prompts whose multi-byte characters sit on the 100 rune log boundary.
+// A byte slice at 100 would split each of them.
+func TestTruncateRunes(t *testing.T) {
+    ascii := strings.Repeat("a", 99)
+    for _, c := range []struct {
+        name string
+        in   string
+        want string
+    }{
+        {"empty", "", ""},
+        {"ascii at the limit", ascii + "b", ascii + "b"},
+        {"ascii past the limit", ascii + "bc", ascii + "b" + truncateMarker},
+        {"emoji last", ascii + "😀", ascii + "😀"},
+        {"emoji past the limit", ascii + "😀😀", ascii + "😀" + truncateMarker},
+        {"emoji over byte 100", strings.Repeat("a", 98) + "🎉x", strings.Repeat("a", 98) + "🎉x"},
+        {"cjk at the limit", strings.Repeat("日", 100), strings.Repeat("日", 100)},
+        {"cjk past the limit", strings.Repeat("日本", 51), strings.Repeat("日本", 50) + truncateMarker},
+        {"cjk across byte 100", "abc" + strings.Repeat("語", 40), "abc" + strings.Repeat("語", 40)},
+        {"mixed", strings.Repeat("x😀日", 34), strings.Repeat("x😀日", 33) + "x" + truncateMarker},
+        // A cut may split a grapheme of several runes, never a rune
+        {"zwj family", ascii + "👩\u200d👩\u200d👧", ascii + "👩" + truncateMarker},
+        {"flag", ascii + "🇫🇷", ascii + "🇫" + truncateMarker},
+        {"combining accent", ascii + "e\u0301", ascii + "e" + truncateMarker},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            got := truncateRunes(c.in, promptLogRunes)
+            if got != c.want {
+                t.Errorf("truncateRunes(%q) = %q, want %q", c.in, got, c.want)
+            }
+            if !utf8.ValidString(got) {
+                t.Errorf("%q is not valid UTF-8", got)
+            }
+            if n := utf8.RuneCountInString(strings.TrimSuffix(got, truncateMarker)); n > promptLogRunes {
+                t.Errorf("kept %d runes, more than %d", n, promptLogRunes)
+            }
+        })
+    }
+
+    for _, n := range []int{0, 1, 2} {
+        if got, want := truncateRunes("日本語", n), string([]rune("日本語")[:n])+truncateMarker; got != want {
+            t.Errorf("truncateRunes to %d = %q, want %q", n, got, want)
+        }
+    }
+}
+
+// captureLogs routes slog to a buffer at level, and logPromptHashes to
+// hashes, until the test ends
+func captureLogs(t *testing.T, level slog.Level, hashes bool) *bytes.Buffer {
+    t.Helper()
+    var buf bytes.Buffer
+    previous, previousHashes := slog.Default(), logPromptHashes
+    slog.SetDefault(slog.New(contextHandler{slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level})}))
+    logPromptHashes = hashes
+    t.Cleanup(func() {
+        slog.SetDefault(previous)
+        logPromptHashes = previousHashes
+    })
+    return &buf
+}
+
+// promptLines are the lines logPrompt wrote
+func promptLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+    t.Helper()
+    var lines []map[string]interface{}
+    for _, line := range strings.Split(buf.String(), "\n") {
+        var entry map[string]interface{}
+        if json.Unmarshal([]byte(line), &entry) == nil && entry["msg"] == "test prompt" {
+            lines = append(lines, entry)
+        }
+    }
+    return lines
+}
+
+// Content only at debug; with LOG_PROMPT_HASHES the fingerprint at info
+func TestLogPrompt(t *testing.T) {
+    prompt := strings.Repeat("a", 98) + "日本語のプロンプト"
+    for _, c := range []struct {
+        name        string
+        level       slog.Level
+        hashes      bool
+        logged      string // Level of the line, empty for none
+        content     bool
+        fingerprint bool
+    }{
+        {"info", slog.LevelInfo, false, "", false, false},
+        {"debug", slog.LevelDebug, false, "DEBUG", true, false},
+        {"hashes at info", slog.LevelInfo, true, "INFO", false, true},
+        {"hashes at debug", slog.LevelDebug, true, "INFO", true, true},
+        {"hashes at warn", slog.LevelWarn, true, "", false, false},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            buf := captureLogs(t, c.level, c.hashes)
+            logPrompt(context.Background(), "test prompt", prompt, "model_preference", "m")
+
+            lines := promptLines(t, buf)
+            if c.logged == "" {
+                if len(lines) != 0 {
+                    t.Errorf("logged %s", buf)
+                }
+                return
+            }
+            if len(lines) != 1 {
+                t.Fatalf("logged %s, want one line", buf)
+            }
+            line := lines[0]
+            if line["level"] != c.logged || line["prompt_bytes"] != float64(len(prompt)) || line["model_preference"] != "m" {
+                t.Errorf("line %v", line)
+            }
+            if content, ok := line["prompt"].(string); ok != c.content || ok && content != strings.Repeat("a", 98)+"日本"+truncateMarker {
+                t.Errorf("prompt %q logged, want it %v", line["prompt"], c.content)
+            }
+            if fp, ok := line["prompt_fingerprint"]; ok != c.fingerprint || ok && fp != promptFingerprint(prompt) {
+                t.Errorf("fingerprint %v logged, want it %v", fp, c.fingerprint)
+            }
+            // Nothing of the prompt beyond the start leaks into the line
+            if strings.Contains(buf.String(), "プロンプト") {
+                t.Errorf("line holds the prompt's end: %s", buf)
+            }
+        })
+    }
+}
+
+func TestLoadLoggingPromptHashes(t *testing.T) {
+    previous, previousHashes := slog.Default(), logPromptHashes
+    defer func() {
+        slog.SetDefault(previous)
+        logPromptHashes = previousHashes
+    }()
+
+    t.Setenv("LOG_LEVEL", "info")
+    t.Setenv("LOG_PROMPT_HASHES", "sometimes")
+    if err := LoadLogging(&bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "LOG_PROMPT_HASHES") {
+        t.Errorf("error %v for an invalid LOG_PROMPT_HASHES", err)
+    }
+    t.Setenv("LOG_PROMPT_HASHES", "true")
+    if err := LoadLogging(&bytes.Buffer{}); err != nil || !logPromptHashes {
+        t.Errorf("error %v, hashes %v for LOG_PROMPT_HASHES=true", err, logPromptHashes)
+    }
+}
+
+// A CJK prompt straddling the boundary comes out of the service's debug
+// log as valid, truncated text
+func TestE2EPromptLogTruncation(t *testing.T) {
+    const model = "mistral.mixtral-8x7b-instruct-v0:1"
+    fake.Script(model, fakeReply{Body: `{"outputs":[{"text":" 好的","stop_reason":"stop"}]}`})
+
+    prompt := strings.Repeat("訳", 99) + "😀してください"
+    resp := post(t, "/generate", map[string]interface{}{"prompt": prompt, "models": []string{model}})
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("status %d", resp.StatusCode)
+    }
+    requestID := resp.Header.Get("X-Request-ID")
+    resp.Body.Close()
+
+    for _, entry := range logLines(t, requestID) {
+        if entry["msg"] != "received prompt" {
+            continue
+        }
+        if want := strings.Repeat("訳", 99) + "😀" + truncateMarker; entry["prompt"] != want {
+            t.Errorf("logged prompt %q, want %q", entry["prompt"], want)
+        }
+        if entry["prompt_bytes"] != float64(len(prompt)) {
+            t.Errorf("prompt_bytes %v, want %d", entry["prompt_bytes"], len(prompt))
+        }
+        return
+    }
+    t.Errorf("no received prompt line for request %s:\n%v", requestID, logLines(t, requestID))
+}
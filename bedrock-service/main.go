@@ -4,411 +4,2071 @@ import (
     "context"
     "encoding/json"
     "fmt"
+    "io"
     "log"
+    "log/slog"
+    "net"
     "net/http"
     "os"
+    "sort"
     "strings"
+    "sync"
+    "sync/atomic"
     "time"
+    "unicode/utf8"
 
     "github.com/aws/aws-sdk-go-v2/aws"
-    "github.com/aws/aws-sdk-go-v2/config"
-    "github.com/aws/aws-sdk-go-v2/credentials"
     "github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
     "github.com/gorilla/mux"
 )
 
 // Request and Response structs
 type GenerateRequest struct {
-    Prompt      string  `json:"prompt"`
-    MaxTokens   int     `json:"max_tokens,omitempty"`
-    Temperature float64 `json:"temperature,omitempty"`
-    Model       string  `json:"model,omitempty"`
+    Prompt           string        `json:"prompt"`
+    Messages         []ChatMessage `json:"messages,omitempty"`           // Multi-turn alternative to prompt, see turns
+    MaxTokens        *int          `json:"max_tokens,omitempty"`         // Omitted for the default
+    Temperature      *float64      `json:"temperature,omitempty"`        // Omitted for the default; 0 is greedy decoding
+    TopP             *float64      `json:"top_p,omitempty"`              // Nucleus sampling, in (0, 1]; sent alongside temperature
+    TopK             *int          `json:"top_k,omitempty"`              // Sample from the k most likely tokens only
+    Model            string        `json:"model,omitempty"`
+    StrictModel      bool          `json:"strict_model,omitempty"`       // Only try what model matches; fail rather than fall back, see selection.go
+    Models           []string      `json:"models,omitempty"`             // The exact models to try, in order, instead of model and the fallback chain
+    LinkFilter       string        `json:"link_filter,omitempty"`        // Optional stricter link filter mode for this request
+    NoTimeContext    bool          `json:"no_time_context,omitempty"`    // Don't inject the current date/time into the system prompt
+    DryRun           bool          `json:"dry_run,omitempty"`            // Return the request that would be sent without invoking a model
+    Tools            []ToolSpec    `json:"tools,omitempty"`              // Tools the model may call (streaming only)
+    StreamToolEvents bool          `json:"stream_tool_events,omitempty"` // Client handles tool_call_* stream events
+    ContextID        string        `json:"context_id,omitempty"`         // Stored prefix from POST /contexts to prepend
+    Deliver          string        `json:"deliver,omitempty"`            // "s3" returns a presigned URL instead of the response
+    UserID           string        `json:"user_id,omitempty"`            // End user, for experiment assignment
+    Timezone         string        `json:"timezone,omitempty"`           // IANA zone for the time context, like X-Timezone
+    System           *string       `json:"system,omitempty"`             // Replaces the built-in system prompt; "" sends none
+    StopSequences    []string      `json:"stop_sequences,omitempty"`     // Generation halts where one of these would be produced
+    VerifyNumeric    bool          `json:"verify_numeric,omitempty"`     // Recompute arithmetic in the response, see numeric.go
+    NumericStrict    bool          `json:"numeric_strict,omitempty"`     // With verify_numeric, regenerate once if a claim fails
+    Format           string        `json:"format,omitempty"`             // "blocks" adds the response parsed into blocks, see blocks.go
+    TimeoutSeconds   *float64      `json:"timeout_seconds,omitempty"`    // Give up after this long, like X-Request-Timeout (/generate only)
+    NoAdaptation     bool          `json:"no_adaptation,omitempty"`      // Send the prompt unchanged to fallbacks from other providers
+    GuardrailID      string        `json:"guardrail_id,omitempty"`       // Bedrock guardrail to invoke with instead of GUARDRAIL_ID, see guardrail.go
+    GuardrailVersion string        `json:"guardrail_version,omitempty"`  // Its version number or DRAFT
+    GuardrailTrace   bool          `json:"guardrail_trace,omitempty"`    // Return the guardrail's assessment in debug (/generate only)
+
+    // ResponseFormat asks for JSON output, validated as it streams (streaming only)
+    ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+
+    // Documents are files for the model to read, see documents.go
+    Documents []DocumentInput `json:"documents,omitempty"`
+
+    // Extensions carries deployment-specific fields handled by hooks (see hooks.go)
+    Extensions map[string]interface{} `json:"extensions,omitempty"`
+
+    // SchemaVersion is consumed by decodeGenerateRequest and never set on the canonical request
+    SchemaVersion string `json:"schema_version,omitempty"`
+}
+
+// turns splits a request into its final user turn and the turns before it.
+// A request gives either prompt or messages; messages start and end with a
+// user turn and alternate roles, as the messages API requires. Content
+// blocks are checked too, see vision.go.
+func (req *GenerateRequest) turns() (string, []ChatMessage, *APIError) {
+    if req.Messages == nil {
+        if req.Prompt == "" {
+            return "", nil, &APIError{
+                Code:    ErrCodeValidation,
+                Message: "Prompt is required",
+                Fields:  []FieldError{{Field: "prompt", Message: "is required"}},
+            }
+        }
+        return req.Prompt, nil, nil
+    }
+
+    var problems []FieldError
+    var images imageTotals
+    switch {
+    case req.Prompt != "":
+        problems = append(problems, FieldError{Field: "messages", Message: "must not be combined with prompt"})
+    case len(req.Messages) == 0:
+        problems = append(problems, FieldError{Field: "messages", Message: "must not be empty"})
+    }
+    for i, m := range req.Messages {
+        field := fmt.Sprintf("messages[%d]", i)
+        switch {
+        case m.Role != roleUser && m.Role != roleAssistant:
+            problems = append(problems, FieldError{Field: field + ".role", Message: "must be \"user\" or \"assistant\""})
+        case i == 0 && m.Role != roleUser:
+            problems = append(problems, FieldError{Field: field + ".role", Message: "must be \"user\": conversations start with a user turn"})
+        case i > 0 && m.Role == req.Messages[i-1].Role:
+            problems = append(problems, FieldError{Field: field + ".role", Message: "must alternate with the previous message"})
+        case i == len(req.Messages)-1 && m.Role != roleUser:
+            problems = append(problems, FieldError{Field: field + ".role", Message: "must be \"user\": the last message is the turn being answered"})
+        }
+        if strings.TrimSpace(m.Content) == "" && m.images() == 0 {
+            problems = append(problems, FieldError{Field: field + ".content", Message: "is required"})
+        }
+        problems = append(problems, checkContentBlocks(field, m, &images)...)
+    }
+    problems = append(problems, images.problems()...)
+    if len(problems) > 0 {
+        return "", nil, &APIError{Code: ErrCodeValidation, Message: "Invalid messages", Fields: problems}
+    }
+    last := len(req.Messages) - 1
+    return req.Messages[last].Content, req.Messages[:last:last], nil
+}
+
+// Limits on stop_sequences. The Converse API takes at most 4; the length cap
+// keeps every sequence well inside what the Anthropic models accept.
+const (
+    maxStopSequences      = 4
+    maxStopSequenceLength = 256
+)
+
+// maxTopK is the largest top_k the Anthropic models accept
+const maxTopK = 500
+
+// maxTokens is the requested output cap, 0 for the default
+func (req *GenerateRequest) maxTokens() int {
+    if req.MaxTokens == nil {
+        return 0
+    }
+    return *req.MaxTokens
+}
+
+// checkSampling rejects sampling parameters outside the ranges the models
+// accept. Explicit zeros are checked too: they are no longer read as unset.
+func (req *GenerateRequest) checkSampling() *APIError {
+    var problems []FieldError
+    if req.MaxTokens != nil && *req.MaxTokens < 1 {
+        problems = append(problems, FieldError{Field: "max_tokens", Message: "must be at least 1"})
+    }
+    if req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > 1) {
+        problems = append(problems, FieldError{Field: "temperature", Message: "must be between 0 and 1"})
+    }
+    if req.TopP != nil && (*req.TopP <= 0 || *req.TopP > 1) {
+        problems = append(problems, FieldError{Field: "top_p", Message: "must be greater than 0 and at most 1"})
+    }
+    if req.TopK != nil && (*req.TopK < 1 || *req.TopK > maxTopK) {
+        problems = append(problems, FieldError{Field: "top_k", Message: fmt.Sprintf("must be between 1 and %d", maxTopK)})
+    }
+    if len(problems) > 0 {
+        return &APIError{Code: ErrCodeValidation, Message: "Invalid sampling parameters", Fields: problems}
+    }
+    return nil
+}
+
+// checkStopSequences rejects stop sequences Bedrock would fail the call on
+func (req *GenerateRequest) checkStopSequences() *APIError {
+    if len(req.StopSequences) > maxStopSequences {
+        return &APIError{
+            Code:    ErrCodeValidation,
+            Message: fmt.Sprintf("At most %d stop sequences are allowed", maxStopSequences),
+            Fields:  []FieldError{{Field: "stop_sequences", Message: fmt.Sprintf("has %d entries", len(req.StopSequences))}},
+        }
+    }
+    var problems []FieldError
+    for i, s := range req.StopSequences {
+        field := fmt.Sprintf("stop_sequences[%d]", i)
+        switch {
+        case s == "":
+            problems = append(problems, FieldError{Field: field, Message: "must not be empty"})
+        case utf8.RuneCountInString(s) > maxStopSequenceLength:
+            problems = append(problems, FieldError{Field: field, Message: fmt.Sprintf("must be at most %d characters", maxStopSequenceLength)})
+        }
+    }
+    if len(problems) > 0 {
+        return &APIError{Code: ErrCodeValidation, Message: "Invalid stop_sequences", Fields: problems}
+    }
+    return nil
 }
 
 type GenerateResponse struct {
-    Response   string `json:"response"`
-    ModelUsed  string `json:"model_used"`
-    TokenCount int    `json:"token_count,omitempty"`
+    Response   string        `json:"response"`
+    ModelUsed  string        `json:"model_used"`
+    ModelAlias string        `json:"model_alias,omitempty"` // The alias the request named; meta.model_id is the model it resolved to
+    TokenCount int           `json:"token_count,omitempty"`
+    Links      []LinkInfo    `json:"links,omitempty"`
+    Meta       *ResponseMeta `json:"meta,omitempty"`
+
+    FinishReason    string `json:"finish_reason,omitempty"`     // Normalized across providers, see finishreason.go
+    FinishReasonRaw string `json:"finish_reason_raw,omitempty"` // As reported by the provider
+    StopSequence    string `json:"stop_sequence,omitempty"`     // Which of stop_sequences ended generation
+    StopReason      string `json:"stop_reason,omitempty"`       // The same as finish_reason_raw, by the name Anthropic uses
+
+    InputTokens     int   `json:"input_tokens"`
+    OutputTokens    int   `json:"output_tokens"`
+    TokensEstimated bool  `json:"tokens_estimated,omitempty"` // The model reported no usage; the counts are estimates
+    LatencyMs       int64 `json:"latency_ms"`                 // Of the model invocation, 0 when none was made
+
+    Filtered       bool   `json:"filtered,omitempty"`        // Output was withheld by content filtering
+    FilterCategory string `json:"filter_category,omitempty"` // guardrail, content_filtered or refusal
+
+    GuardrailIntervened bool `json:"guardrail_intervened,omitempty"` // The guardrail blocked or masked the output; response is what it returned
+
+    Refused         bool   `json:"refused,omitempty"`          // The model declined to answer, by any signal
+    RefusalCategory string `json:"refusal_category,omitempty"` // See refusal.go
+
+    NumericChecks []NumericCheck `json:"numeric_checks,omitempty"` // With verify_numeric; absent when no claims were found
+    Blocks        []Block        `json:"blocks,omitempty"`         // With "format": "blocks", the response parsed from markdown
+
+    Extensions map[string]interface{} `json:"extensions,omitempty"` // Set by response hooks
+
+    Debug *ResponseDebug `json:"debug,omitempty"` // Only with guardrail_trace
+}
+
+// ResponseDebug carries diagnostics the caller asked for
+type ResponseDebug struct {
+    GuardrailTrace interface{} `json:"guardrail_trace,omitempty"` // The guardrail's assessment, as Bedrock reported it
+}
+
+// ResponseMeta carries details about how a response was served
+type ResponseMeta struct {
+    ModelID            string `json:"model_id,omitempty"`
+    Account            string `json:"account,omitempty"`             // AWS account that served the invocation
+    FooterApplied      bool   `json:"footer_applied,omitempty"`      // An attribution footer was appended by policy
+    RefusalReplaced    bool   `json:"refusal_replaced,omitempty"`    // A refusal was replaced with the policy's message
+    Mocked             bool   `json:"mocked,omitempty"`              // Served from X-Mock-Response; token counts are estimates
+    Cached             bool   `json:"cached,omitempty"`              // Served from the response cache; token counts are the original's
+    NumericRegenerated bool   `json:"numeric_regenerated,omitempty"` // numeric_strict replaced an answer whose figures were wrong
+
+    Sampling    *SamplingParams        `json:"sampling,omitempty"` // As sent to Bedrock
+    Adaptations []string               `json:"adaptations,omitempty"` // Prompt rewrites for a fallback from another provider, see adaptation.go
+    Retries     int                    `json:"retries,omitempty"`     // Backoff retries after throttles and model failures
+    Documents   string                 `json:"documents,omitempty"`   // How the model got the request's documents: native or text_extraction
+
+    Budget      *TurnBudgetUsage       `json:"budget,omitempty"` // Conversation turns only
+    Experiments []ExperimentAssignment `json:"experiments,omitempty"`
+    Warnings    []string               `json:"warnings,omitempty"` // Parameters that were overridden, see params.go
+}
+
+// DryRunResponse shows what a generate request would send to Bedrock
+type DryRunResponse struct {
+    DryRun               bool                   `json:"dry_run"`
+    Model                string                 `json:"model"`
+    ModelID              string                 `json:"model_id"`
+    SystemContext        []string               `json:"system_context"`
+    EstimatedInputTokens int                    `json:"estimated_input_tokens"`
+    PromptHash           string                 `json:"prompt_hash"`
+    RequestBody          map[string]interface{} `json:"request_body"`
+    Adaptations          []string               `json:"adaptations,omitempty"`
+
+    // Fallbacks are the requests each later model in the chain would get,
+    // so prompt adaptation rules can be checked without a failover
+    Fallbacks []DryRunFallback `json:"fallbacks"`
+}
+
+// DryRunFallback is the request one fallback model would be sent
+type DryRunFallback struct {
+    Model       string                 `json:"model"`
+    ModelID     string                 `json:"model_id"`
+    Adaptations []string               `json:"adaptations,omitempty"`
+    RequestBody map[string]interface{} `json:"request_body"`
 }
 
 type HealthResponse struct {
     Status         string   `json:"status"`
     Service        string   `json:"service"`
     AvailableModels []string `json:"available_models"`
+    SafeMode       bool     `json:"safe_mode"`
+    LastModelCheck *time.Time `json:"last_model_check,omitempty"` // When model availability was last probed
 }
 
 type ModelInfo struct {
-    ID          string
-    Name        string
-    Available   bool
-    MessageAPI  bool // Uses new message API format
+    ID              string
+    Name            string
+    Available       bool
+    API             APIType       // Request and response format
+    Converse        bool          // Invoked through the Converse API rather than InvokeModel
+    ProbeStatus     string        // Result of the last availability probe
+    ContextWindow   int           // Input plus output tokens the model accepts
+    MaxOutputTokens int           // Most max_tokens the model accepts, 0 for no cap of its own
+    Defaults        ModelDefaults // Sampling defaults from the models config
+    Disabled        bool          // Turned off by an admin; probes and breakers never turn it back on
+    ProfileFallback bool          // Its inference profile is unavailable, so the base model is invoked, see profiles.go
+    Modality        Modality      // What the model generates; text when unset
+    Vision          bool          // Takes image content blocks, see vision.go
+    Documents       bool          // Reads document blocks through Converse, see documents.go
+}
+
+// APIType is the request and response format a model uses, the catalog's
+// api_type. Each has an APIFormat, see providers.go.
+type APIType string
+
+const (
+    apiMessages APIType = "messages" // Anthropic messages; the only format with tools and streaming
+    apiLegacy   APIType = "legacy"   // Anthropic text completions
+    apiJamba    APIType = "jamba"    // AI21's OpenAI-style chat
+    apiTitan    APIType = "titan"    // Amazon Titan Text, see titan.go
+    apiLlama    APIType = "llama"    // Meta Llama 3 instruct, see llama.go
+
+    apiMistral     APIType = "mistral"      // Mistral's [INST] prompt, see mistral.go
+    apiMistralChat APIType = "mistral_chat" // Mistral's chat messages
+    apiCohere      APIType = "cohere"       // Cohere Command R chat, see cohere.go
+    apiNova        APIType = "nova"         // Amazon Nova messages, see nova.go
+
+    apiTitanImage APIType = "titan_image" // Amazon Titan Image Generator, see images.go
+    apiStability  APIType = "stability"   // Stability AI SDXL, see images.go
+)
+
+// Modality is what a model generates, the catalog's modality
+type Modality string
+
+const (
+    modalityText  Modality = "text"  // Answers /generate and every other text endpoint
+    modalityImage Modality = "image" // Only answers /images, never part of a text fallback chain
+)
+
+// modality is what the model generates
+func (model ModelInfo) modality() Modality {
+    if model.Modality == "" {
+        return modalityText
+    }
+    return model.Modality
+}
+
+// selectable reports whether requests may be sent to the model
+func (model ModelInfo) selectable() bool {
+    return model.Available && !model.Disabled
 }
 
 // BedrockClient wraps the AWS Bedrock client
 type BedrockClient struct {
-    client         *bedrockruntime.Client
+    accounts       *AccountPool
+    prober         modelInvoker // Sends deep probes, normally accounts
+    safeMode       *SafeMode
+    filterFallback bool        // Try the next model when output is content filtered
+    builtin        ModelConfig // The registry when there is no models config
+    reloadMu       sync.Mutex  // Reloads run one at a time
+
+    // Probes and breakers update the registry while requests read it
+    modelsMu        sync.RWMutex
     availableModels []ModelInfo
+    breakers        map[string]*modelBreaker // Models with recent failures, see breaker.go
+    breakerCfg      BreakerConfig
+    guardrail       GuardrailConfig // Applied when a request names no guardrail
+    aliases         map[string][]string // Normalized alias to model IDs, see modelsToTry
+    catalogSource   string              // The models config path the registry was loaded from, or "built-in"
+    lastProbe       time.Time           // When the last availability sweep finished
+    registryReady   atomic.Bool         // The first sweep finished or was skipped; until then every model is tried
+
+    listing   atomic.Pointer[modelsBody] // Encoded GET /models body, nil when stale
+    events    *RegistryEvents        // Transitions of availableModels, may be nil
+    responses *ResponseCache         // Cached /generate results, nil when disabled
+
+    adaptations *PromptAdaptations // Rewrites for fallbacks to other providers, see adaptation.go
+    gate        *GenerationGate    // Bounds the generations in flight, nil when unbounded
 }
 
-// NewBedrockClient creates a new Bedrock client
-func NewBedrockClient() (*BedrockClient, error) {
-    // Get AWS credentials from environment variables
-    awsAccessKey := os.Getenv("AWS_ACCESS_KEY_ID")
-    awsSecretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
-    awsRegion := os.Getenv("AWS_REGION")
-    
-    if awsRegion == "" {
-        awsRegion = "us-east-1" // Default region
+// defaultRegion is the AWS region used when an account or store doesn't set one
+func defaultRegion() string {
+    if region := os.Getenv("AWS_REGION"); region != "" {
+        return region
     }
+    return "us-east-1"
+}
 
-    // Create AWS config
-    cfg, err := config.LoadDefaultConfig(context.TODO(),
-        config.WithRegion(awsRegion),
-        config.WithCredentialsProvider(
-            credentials.NewStaticCredentialsProvider(awsAccessKey, awsSecretKey, ""),
-        ),
-    )
+// NewBedrockClient creates a new Bedrock client
+func NewBedrockClient() (*BedrockClient, error) {
+    // Create Bedrock clients for every configured account
+    accounts, err := LoadAccountPool(defaultRegion())
     if err != nil {
-        return nil, fmt.Errorf("unable to load SDK config: %v", err)
+        return nil, err
     }
-
-    // Create Bedrock client
-    client := bedrockruntime.NewFromConfig(cfg)
     
-    // Define available models with enhanced context handling
-    availableModels := []ModelInfo{
+    // Built-in models with enhanced context handling, unless a models config
+    // replaces them
+    builtinModels := []ModelInfo{
         // Claude 3.5 models (best for conversation memory)
-        {ID: "anthropic.claude-3-5-sonnet-20241022-v2:0", Name: "Claude 3.5 Sonnet v2", MessageAPI: true},
-        {ID: "anthropic.claude-3-5-sonnet-20240620-v1:0", Name: "Claude 3.5 Sonnet", MessageAPI: true},
-        {ID: "anthropic.claude-3-5-haiku-20241022-v1:0", Name: "Claude 3.5 Haiku", MessageAPI: true},
+        {ID: "anthropic.claude-3-5-sonnet-20241022-v2:0", Name: "Claude 3.5 Sonnet v2", API: apiMessages, Converse: true, ContextWindow: 200000, Vision: true, Documents: true},
+        {ID: "anthropic.claude-3-5-sonnet-20240620-v1:0", Name: "Claude 3.5 Sonnet", API: apiMessages, Converse: true, ContextWindow: 200000, Vision: true, Documents: true},
+        {ID: "anthropic.claude-3-5-haiku-20241022-v1:0", Name: "Claude 3.5 Haiku", API: apiMessages, Converse: true, ContextWindow: 200000, Documents: true},
         
         // Claude 3 models
-        {ID: "anthropic.claude-3-sonnet-20240229-v1:0", Name: "Claude 3 Sonnet", MessageAPI: true},
-        {ID: "anthropic.claude-3-haiku-20240307-v1:0", Name: "Claude 3 Haiku", MessageAPI: true},
-        {ID: "anthropic.claude-3-opus-20240229-v1:0", Name: "Claude 3 Opus", MessageAPI: true},
+        {ID: "anthropic.claude-3-sonnet-20240229-v1:0", Name: "Claude 3 Sonnet", API: apiMessages, Converse: true, ContextWindow: 200000, Vision: true, Documents: true},
+        {ID: "anthropic.claude-3-haiku-20240307-v1:0", Name: "Claude 3 Haiku", API: apiMessages, Converse: true, ContextWindow: 200000, Vision: true, Documents: true},
+        {ID: "anthropic.claude-3-opus-20240229-v1:0", Name: "Claude 3 Opus", API: apiMessages, Converse: true, ContextWindow: 200000, Vision: true, Documents: true},
         
         // Older Claude models (fallback)
-        {ID: "anthropic.claude-v2:1", Name: "Claude v2.1", MessageAPI: false},
-        {ID: "anthropic.claude-v2", Name: "Claude v2", MessageAPI: false},
-        {ID: "anthropic.claude-instant-v1", Name: "Claude Instant", MessageAPI: false},
+        {ID: "anthropic.claude-v2:1", Name: "Claude v2.1", API: apiLegacy, ContextWindow: 200000},
+        {ID: "anthropic.claude-v2", Name: "Claude v2", API: apiLegacy, ContextWindow: 100000},
+        {ID: "anthropic.claude-instant-v1", Name: "Claude Instant", API: apiLegacy, ContextWindow: 100000},
+
+        // AI21 Jamba (long-context fallback)
+        {ID: "ai21.jamba-1-5-large-v1:0", Name: "Jamba 1.5 Large", API: apiJamba, ContextWindow: 256000},
+
+        // Meta Llama 3
+        {ID: "meta.llama3-70b-instruct-v1:0", Name: "Llama 3 70B Instruct", API: apiLlama, ContextWindow: 8192, MaxOutputTokens: 2048},
+
+        // Mistral
+        {ID: "mistral.mistral-large-2407-v1:0", Name: "Mistral Large 2", API: apiMistralChat, ContextWindow: 128000},
+        {ID: "mistral.mixtral-8x7b-instruct-v0:1", Name: "Mixtral 8x7B Instruct", API: apiMistral, ContextWindow: 32000},
+
+        // Cohere
+        {ID: "cohere.command-r-plus-v1:0", Name: "Command R+", API: apiCohere, ContextWindow: 128000},
+
+        // Amazon Nova (the cheapest in us-east-1)
+        {ID: "amazon.nova-pro-v1:0", Name: "Nova Pro", API: apiNova, ContextWindow: 300000, MaxOutputTokens: 5000},
+        {ID: "amazon.nova-lite-v1:0", Name: "Nova Lite", API: apiNova, ContextWindow: 300000, MaxOutputTokens: 5000},
+        {ID: "amazon.nova-micro-v1:0", Name: "Nova Micro", API: apiNova, ContextWindow: 128000, MaxOutputTokens: 5000},
+
+        // Amazon Titan (cheap, for simple rewriting)
+        {ID: "amazon.titan-text-premier-v1:0", Name: "Titan Text Premier", API: apiTitan, ContextWindow: 32000},
+
+        // Image generation, for /images only
+        {ID: "amazon.titan-image-generator-v2:0", Name: "Titan Image Generator v2", API: apiTitanImage, Modality: modalityImage},
+        {ID: "stability.stable-diffusion-xl-v1", Name: "Stable Diffusion XL", API: apiStability, Modality: modalityImage},
+    }
+
+    // Aliases requests can name instead of a model, each resolving to the
+    // first usable model of its group
+    builtinAliases := map[string][]string{
+        "fast":  {"anthropic.claude-3-5-haiku-20241022-v1:0", "anthropic.claude-3-haiku-20240307-v1:0", "anthropic.claude-instant-v1"},
+        "smart": {"anthropic.claude-3-5-sonnet-20241022-v2:0", "anthropic.claude-3-5-sonnet-20240620-v1:0", "anthropic.claude-3-opus-20240229-v1:0"},
+        "cheap": {"anthropic.claude-3-haiku-20240307-v1:0", "amazon.titan-text-premier-v1:0", "anthropic.claude-instant-v1", "anthropic.claude-3-5-haiku-20241022-v1:0"},
+    }
+    profile, err := LoadInferenceProfile()
+    if err != nil {
+        return nil, err
+    }
+    builtin := withInferenceProfile(ModelConfig{Models: builtinModels, Aliases: builtinAliases, Source: builtinCatalog}, profile)
+    config, err := LoadModelConfig(builtin)
+    if err != nil {
+        return nil, err
     }
     
     return &BedrockClient{
-        client: client,
-        availableModels: availableModels,
+        accounts: accounts,
+        prober: accounts,
+        availableModels: config.Models,
+        aliases: config.Aliases,
+        builtin: builtin,
+        catalogSource: config.Source,
+        breakers: make(map[string]*modelBreaker),
+        filterFallback: contentFilterFallbackEnabled(),
     }, nil
 }
 
-// TestModelAvailability tests which models are actually available
-func (bc *BedrockClient) TestModelAvailability() {
-    log.Println("Testing model availability...")
-    
-    testPrompt := "Hello"
-    
-    for i := range bc.availableModels {
-        model := &bc.availableModels[i]
-        
-        var requestBody map[string]interface{}
-        
-        if model.MessageAPI {
-            // New message API format for Claude 3+ models
-            requestBody = map[string]interface{}{
-                "anthropic_version": "bedrock-2023-05-31",
-                "max_tokens": 10,
-                "messages": []map[string]string{
-                    {
-                        "role": "user",
-                        "content": testPrompt,
-                    },
-                },
-            }
-        } else {
-            // Legacy format for Claude v2 and earlier
-            requestBody = map[string]interface{}{
-                "prompt": fmt.Sprintf("\n\nHuman: %s\n\nAssistant:", testPrompt),
-                "max_tokens_to_sample": 10,
-            }
-        }
+// CatalogSource is where the registry was loaded from
+func (bc *BedrockClient) CatalogSource() string {
+    bc.modelsMu.RLock()
+    defer bc.modelsMu.RUnlock()
+    return bc.catalogSource
+}
 
-        bodyBytes, _ := json.Marshal(requestBody)
-        
-        _, err := bc.client.InvokeModel(context.TODO(), &bedrockruntime.InvokeModelInput{
-            Body:        bodyBytes,
-            ModelId:     aws.String(model.ID),
-            ContentType: aws.String("application/json"),
-        })
-        
-        if err != nil {
-            log.Printf("Model %s (%s): UNAVAILABLE - %v", model.Name, model.ID, err)
-            model.Available = false
-        } else {
-            log.Printf("Model %s (%s): AVAILABLE ✓", model.Name, model.ID)
-            model.Available = true
+// models returns a snapshot of the registry
+func (bc *BedrockClient) models() []ModelInfo {
+    bc.modelsMu.RLock()
+    defer bc.modelsMu.RUnlock()
+    return append([]ModelInfo(nil), bc.availableModels...)
+}
+
+// usableLocked reports whether requests may try model now; callers hold
+// modelsMu
+func (bc *BedrockClient) usableLocked(model ModelInfo, now time.Time, warming bool) bool {
+    return !model.Disabled && (warming || model.Available || bc.breakerReadyLocked(model.ID, now))
+}
+
+// aliasOf is the normalized alias a request's model names, or "" when it
+// names a model
+func (bc *BedrockClient) aliasOf(preferredModel string) string {
+    alias := normalizeAlias(preferredModel)
+    bc.modelsMu.RLock()
+    defer bc.modelsMu.RUnlock()
+    if _, ok := bc.aliases[alias]; ok {
+        return alias
+    }
+    return ""
+}
+
+// textModels returns a snapshot of the registry's text models
+func (bc *BedrockClient) textModels() []ModelInfo {
+    var text []ModelInfo
+    for _, model := range bc.models() {
+        if model.modality() == modalityText {
+            text = append(text, model)
         }
     }
+    return text
 }
 
 // GetAvailableModels returns list of available model names
 func (bc *BedrockClient) GetAvailableModels() []string {
     var available []string
-    for _, model := range bc.availableModels {
-        if model.Available {
+    for _, model := range bc.models() {
+        if model.selectable() {
             available = append(available, model.Name)
         }
     }
     return available
 }
 
-// GenerateText calls Amazon Bedrock with enhanced context handling
-func (bc *BedrockClient) GenerateText(prompt string, preferredModel string, maxTokens int, temperature float64) (string, string, error) {
-    // Set defaults
-    if maxTokens == 0 {
-        maxTokens = 2000 // Increased for better responses with context
+// usableModels returns the text models requests may try now, in fallback
+// order. A model whose breaker is due a trial keeps its usual place. Before
+// the first sweep nothing is known, so every model is tried rather than
+// failing requests for want of a check. Disabled models never are.
+func (bc *BedrockClient) usableModels() []ModelInfo {
+    now := time.Now()
+    warming := !bc.registryReady.Load()
+    var usable []ModelInfo
+    bc.modelsMu.RLock()
+    defer bc.modelsMu.RUnlock()
+    for _, model := range bc.availableModels {
+        if model.modality() == modalityText && bc.usableLocked(model, now, warming) {
+            usable = append(usable, model)
+        }
     }
-    if temperature == 0 {
-        temperature = 0.7
+    return usable
+}
+
+// chain is the models a generation tries, in order: its candidates when set,
+// otherwise the fallback chain
+func (bc *BedrockClient) chain(p GenerationParams) []ModelInfo {
+    if p.Candidates != nil {
+        return p.Candidates
     }
+    return bc.modelsToTry(p.PreferredModel)
+}
 
-    // Find preferred model if specified
-    var modelsToTry []ModelInfo
-    if preferredModel != "" {
-        for _, model := range bc.availableModels {
-            if model.Available && (strings.Contains(strings.ToLower(model.Name), strings.ToLower(preferredModel)) || 
-                                 strings.Contains(strings.ToLower(model.ID), strings.ToLower(preferredModel))) {
-                modelsToTry = append(modelsToTry, model)
-                break
-            }
+// modelsToTry returns the available models in fallback order, with the
+// preferred model (matched by name or ID substring) first if specified
+func (bc *BedrockClient) modelsToTry(preferredModel string) []ModelInfo {
+    // In safe mode all traffic goes to the most reliable model first
+    if bc.safeMode.Active() {
+        if reliable := bc.mostReliableModel(); reliable != "" {
+            preferredModel = reliable
         }
     }
-    
-    // Add all available models as fallback
-    for _, model := range bc.availableModels {
-        if model.Available {
-            // Check if already added
-            found := false
-            for _, existing := range modelsToTry {
-                if existing.ID == model.ID {
-                    found = true
+
+    usable := bc.usableModels()
+    bc.modelsMu.RLock()
+    group := bc.aliases[normalizeAlias(preferredModel)]
+    bc.modelsMu.RUnlock()
+
+    // Find preferred model if specified. An alias puts the usable models of
+    // its group first, so a failure falls through the group before the rest
+    // of the chain.
+    var modelsToTry []ModelInfo
+    if group != nil {
+        for _, id := range group {
+            for _, model := range usable {
+                if normalizeModelID(model.ID) == id {
+                    modelsToTry = append(modelsToTry, model)
                     break
                 }
             }
-            if !found {
+        }
+    } else if preferredModel != "" {
+        for _, model := range usable {
+            if model.matches(preferredModel) {
                 modelsToTry = append(modelsToTry, model)
+                break
             }
         }
     }
     
-    if len(modelsToTry) == 0 {
-        return "", "", fmt.Errorf("no available models found")
-    }
-    
-    var lastError error
-    for _, model := range modelsToTry {
-        log.Printf("Trying model: %s (%s)", model.Name, model.ID)
-        
-        var requestBody map[string]interface{}
-        
-        if model.MessageAPI {
-            // Enhanced system prompt for better context understanding
-            systemPrompt := "You are a helpful AI assistant with access to conversation history and uploaded files. " +
-                           "When responding, consider the full context provided, including previous conversations and any file content. " +
-                           "If file content is mentioned in the context, analyze and reference it appropriately in your response. " +
-                           "Be conversational, helpful, and maintain continuity with previous interactions."
-            
-            requestBody = map[string]interface{}{
-                "anthropic_version": "bedrock-2023-05-31",
-                "max_tokens": maxTokens,
-                "system": systemPrompt,
-                "messages": []map[string]interface{}{
-                    {
-                        "role": "user",
-                        "content": prompt,
-                    },
-                },
-                "temperature": temperature,
-            }
-        } else {
-            // Enhanced legacy format with better context handling
-            enhancedPrompt := fmt.Sprintf("\n\nHuman: You are a helpful AI assistant with conversation memory and file analysis capabilities. Please provide thoughtful, contextual responses based on the information provided.\n\n%s\n\nAssistant:", prompt)
-            
-            requestBody = map[string]interface{}{
-                "prompt": enhancedPrompt,
-                "max_tokens_to_sample": maxTokens,
-                "temperature": temperature,
+    // Add all available models as fallback
+    for _, model := range usable {
+        // Check if already added
+        found := false
+        for _, existing := range modelsToTry {
+            if existing.ID == model.ID {
+                found = true
+                break
             }
         }
-
-        bodyBytes, err := json.Marshal(requestBody)
-        if err != nil {
-            lastError = fmt.Errorf("error marshaling request: %v", err)
-            continue
+        if !found {
+            modelsToTry = append(modelsToTry, model)
         }
+    }
+    return modelsToTry
+}
 
-        // Invoke the model
-        resp, err := bc.client.InvokeModel(context.TODO(), &bedrockruntime.InvokeModelInput{
-            Body:        bodyBytes,
-            ModelId:     aws.String(model.ID),
-            ContentType: aws.String("application/json"),
-        })
-        
-        if err != nil {
-            lastError = err
-            log.Printf("Error with model %s: %v", model.Name, err)
-            continue
-        }
+// Built-in instructions sent with every generation request, replaced by
+// DEFAULT_SYSTEM_PROMPT when set
+var (
+    // Enhanced system prompt for better context understanding
+    defaultSystemPrompt = "You are a helpful AI assistant with access to conversation history and uploaded files. " +
+                          "When responding, consider the full context provided, including previous conversations and any file content. " +
+                          "If file content is mentioned in the context, analyze and reference it appropriately in your response. " +
+                          "Be conversational, helpful, and maintain continuity with previous interactions."
 
-        // Parse the response
-        var response map[string]interface{}
-        if err := json.Unmarshal(resp.Body, &response); err != nil {
-            lastError = fmt.Errorf("error parsing response: %v", err)
-            continue
-        }
+    // Preamble for legacy models, which have no separate system prompt
+    legacyPreamble = "You are a helpful AI assistant with conversation memory and file analysis capabilities. " +
+                     "Please provide thoughtful, contextual responses based on the information provided."
+)
 
-        // Extract text based on API format
-        if model.MessageAPI {
-            // New message API format
-            if content, ok := response["content"].([]interface{}); ok && len(content) > 0 {
-                if firstContent, ok := content[0].(map[string]interface{}); ok {
-                    if text, ok := firstContent["text"].(string); ok {
-                        log.Printf("✓ Successfully used model: %s", model.Name)
-                        return text, model.Name, nil
-                    }
-                }
-            }
-        } else {
-            // Legacy format
-            if completion, ok := response["completion"].(string); ok {
-                log.Printf("✓ Successfully used model: %s", model.Name)
-                return completion, model.Name, nil
-            }
-        }
-        
-        lastError = fmt.Errorf("unexpected response format from model %s", model.Name)
-    }
+// GenerationParams holds everything that shapes a single generation request
+type GenerationParams struct {
+    Prompt         string
+    PreferredModel string
+    MaxTokens      int
+    Temperature    *float64       // defaultTemperature when nil; 0 is greedy decoding
+    TopP           *float64       // Left to the model's default when nil
+    TopK           *int           // Likewise
+    SystemContext  []string       // Extra lines appended to the system prompt (date/time, deployment facts)
+    Tools          []ToolSpec     // Tools offered to messages API models
+    ContextPrefix  string         // Stored context placed ahead of the system prompt
+    PromptCache    bool           // Mark ContextPrefix for Anthropic prompt caching
+    History        []ChatMessage  // Earlier turns sent ahead of Prompt, oldest first
+    PromptBlocks   []ContentBlock // The final turn as content blocks, with Prompt its text; nil for a string
+    Documents      []Document     // Files for the model to read, given to each as withDocuments decides
+    SystemPrompt   *string        // Replaces the built-in instructions when set; empty for none
+    Origin         Origin         // Required, never defaulted: who the invocation is for
+    Record         *RequestRecord // Receives each model attempt; may be nil
+    Candidates     []ModelInfo    // Replaces the fallback chain when set
+    Skipped        []ModelFailure // Models of the request's chain left out of Candidates, reported if the rest fail
+    CacheScope     string         // Results may be served from and stored in the response cache within this scope
+    StopSequences  []string       // Caller-supplied sequences that end generation
+    NoAdaptation   bool           // The caller handles provider differences itself
+    Guardrail      *Guardrail     // Applied to every model invoked, nil for none
 
-    return "", "", fmt.Errorf("all available models failed. Last error: %v", lastError)
+    defaulted struct{ maxTokens, temperature bool } // Filled in by withDefaults, so a model's own defaults may replace them
 }
 
-// Handlers
-func healthHandler(bc *BedrockClient) http.HandlerFunc {
-    return func(w http.ResponseWriter, r *http.Request) {
-        response := HealthResponse{
-            Status:          "healthy",
-            Service:         "bedrock-service",
-            AvailableModels: bc.GetAvailableModels(),
-        }
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(response)
+// defaultTemperature applies when a request doesn't set one
+const defaultTemperature = 0.7
+
+// withDefaults fills in the default generation parameters
+func (p GenerationParams) withDefaults() GenerationParams {
+    if p.MaxTokens == 0 {
+        p.MaxTokens = 2000 // Increased for better responses with context
+        p.defaulted.maxTokens = true
     }
+    if p.Temperature == nil {
+        temperature := defaultTemperature
+        p.Temperature = &temperature
+        p.defaulted.temperature = true
+    }
+    return p
 }
 
-func rootHandler(w http.ResponseWriter, r *http.Request) {
-    response := map[string]string{
-        "message": "Enhanced Bedrock Service is running",
-        "version": "3.0.0",
-        "features": "conversation-context, file-analysis, multi-model-support",
-        "documentation": "POST /generate with {\"prompt\": \"your prompt with context\", \"model\": \"optional model preference\"}",
+// SamplingParams are the sampling parameters sent to Bedrock, defaults
+// filled in, so callers can confirm what a model was actually asked for
+type SamplingParams struct {
+    MaxTokens   int      `json:"max_tokens"`
+    Temperature float64  `json:"temperature"`
+    TopP        *float64 `json:"top_p,omitempty"`
+    TopK        *int     `json:"top_k,omitempty"`
+}
+
+// sampling reports the sampling parameters of params with defaults applied
+func (p GenerationParams) sampling() SamplingParams {
+    return SamplingParams{MaxTokens: p.MaxTokens, Temperature: *p.Temperature, TopP: p.TopP, TopK: p.TopK}
+}
+
+// addSampling puts the optional sampling parameters into a request body;
+// both Anthropic formats and the Mistral prompt format name them the same way
+func (p GenerationParams) addSampling(body map[string]interface{}) {
+    if p.TopP != nil {
+        body["top_p"] = *p.TopP
+    }
+    if p.TopK != nil {
+        body["top_k"] = *p.TopK
     }
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(response)
 }
 
-func generateHandler(bc *BedrockClient) http.HandlerFunc {
-    return func(w http.ResponseWriter, r *http.Request) {
-        var req GenerateRequest
-        
-        // Parse request body
-        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-            http.Error(w, "Invalid request body", http.StatusBadRequest)
-            return
-        }
+// systemPrompt returns the system prompt including any injected context lines
+func (p GenerationParams) systemPrompt(base string) string {
+    if p.SystemPrompt != nil {
+        base = *p.SystemPrompt
+    }
+    if len(p.SystemContext) == 0 {
+        return base
+    }
+    if base == "" {
+        return strings.Join(p.SystemContext, "\n")
+    }
+    return base + "\n\n" + strings.Join(p.SystemContext, "\n")
+}
 
-        // Validate prompt
-        if req.Prompt == "" {
-            http.Error(w, "Prompt is required", http.StatusBadRequest)
-            return
-        }
+// withContextPrefix puts the stored context prefix ahead of a system prompt,
+// for formats that take the two as one text
+func (p GenerationParams) withContextPrefix(system string) string {
+    switch {
+    case p.ContextPrefix == "":
+        return system
+    case system == "":
+        return p.ContextPrefix
+    }
+    return p.ContextPrefix + "\n\n" + system
+}
 
-        log.Printf("Received enhanced prompt: %s (model preference: %s)", 
-            req.Prompt[:min(100, len(req.Prompt))], req.Model)
+// messages returns the history followed by the current prompt as a user turn
+func (p GenerationParams) messages() []map[string]interface{} {
+    messages := make([]map[string]interface{}, 0, len(p.History)+1)
+    for _, m := range p.History {
+        messages = append(messages, map[string]interface{}{"role": m.Role, "content": anthropicContent(m)})
+    }
+    return append(messages, map[string]interface{}{"role": "user", "content": withDocumentContent(p.Documents, anthropicContent(p.turn()))})
+}
 
-        // Generate text using Bedrock with enhanced context
-        response, modelUsed, err := bc.GenerateText(req.Prompt, req.Model, req.MaxTokens, req.Temperature)
-        if err != nil {
-            log.Printf("Error generating text: %v", err)
-            http.Error(w, fmt.Sprintf("Error generating response: %v", err), http.StatusInternalServerError)
-            return
+// renderLegacyPrompt lays out the history in the Human/Assistant format of
+// the text completion models, with the preamble, if any, opening the first
+// human turn
+func renderLegacyPrompt(preamble string, history []ChatMessage, prompt string) string {
+    var sb strings.Builder
+    for i, m := range append(history, ChatMessage{Role: roleUser, Content: prompt}) {
+        content := m.Content
+        if i == 0 && preamble != "" {
+            content = preamble + "\n\n" + content
+        }
+        if m.Role == roleAssistant {
+            sb.WriteString("\n\nAssistant: " + content)
+        } else {
+            sb.WriteString("\n\nHuman: " + content)
         }
-
-        // Send response
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(GenerateResponse{
-            Response:  response,
-            ModelUsed: modelUsed,
-        })
     }
+    sb.WriteString("\n\nAssistant:")
+    return sb.String()
 }
 
-func modelsHandler(bc *BedrockClient) http.HandlerFunc {
-    return func(w http.ResponseWriter, r *http.Request) {
-        models := make([]map[string]interface{}, 0)
-        for _, model := range bc.availableModels {
-            models = append(models, map[string]interface{}{
-                "id":        model.ID,
-                "name":      model.Name,
-                "available": model.Available,
-                "api_type":  map[bool]string{true: "messages", false: "legacy"}[model.MessageAPI],
-                "features":  []string{"conversation-context", "file-analysis"},
-            })
+// buildRequestBody builds the InvokeModel request body for the model's API format
+func buildRequestBody(model ModelInfo, p GenerationParams) map[string]interface{} {
+    return formatOf(model).buildBody(p)
+}
+
+// buildMessagesBody is buildRequestBody for the Anthropic messages API
+func buildMessagesBody(p GenerationParams) map[string]interface{} {
+    system := p.systemPrompt(defaultSystemPrompt)
+    body := map[string]interface{}{
+        "anthropic_version": "bedrock-2023-05-31",
+        "max_tokens": p.MaxTokens,
+        "messages": p.messages(),
+        "temperature": *p.Temperature,
+    }
+    // An empty system prompt is left out, the API rejects empty text
+    if system != "" {
+        body["system"] = system
+    }
+    if p.ContextPrefix != "" {
+        // The stored prefix goes first so it stays a stable, cacheable
+        // prefix while the rest of the system prompt varies per request
+        prefix := map[string]interface{}{"type": "text", "text": p.ContextPrefix}
+        if p.PromptCache {
+            prefix["cache_control"] = map[string]string{"type": "ephemeral"}
         }
-        
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "models": models,
-        })
+        blocks := []map[string]interface{}{prefix}
+        if system != "" {
+            blocks = append(blocks, map[string]interface{}{"type": "text", "text": system})
+        }
+        body["system"] = blocks
+    }
+    if len(p.Tools) > 0 {
+        body["tools"] = p.Tools
     }
+    if len(p.StopSequences) > 0 {
+        body["stop_sequences"] = p.StopSequences
+    }
+    p.addSampling(body)
+    return body
 }
 
-func min(a, b int) int {
-    if a < b {
-        return a
+// buildLegacyBody is buildRequestBody for Anthropic text completions
+func buildLegacyBody(p GenerationParams) map[string]interface{} {
+    // Enhanced legacy format with better context handling
+    preamble := p.withContextPrefix(p.systemPrompt(legacyPreamble))
+    enhancedPrompt := renderLegacyPrompt(preamble, p.History, p.Prompt)
+
+    body := map[string]interface{}{
+        "prompt": enhancedPrompt,
+        "max_tokens_to_sample": p.MaxTokens,
+        "temperature": *p.Temperature,
     }
-    return b
+    if len(p.StopSequences) > 0 {
+        body["stop_sequences"] = p.StopSequences
+    }
+    p.addSampling(body)
+    return body
 }
 
-func main() {
-    log.Println("Starting Enhanced Bedrock Service v3.0...")
-    
-    // Initialize Bedrock client
-    bc, err := NewBedrockClient()
-    if err != nil {
-        log.Fatalf("Failed to initialize Bedrock client: %v", err)
+// matchedStopSequence returns the stop sequence a provider reported, if it
+// is one the caller asked for. Legacy models also report their own
+// "\n\nHuman:" stop, which isn't the caller's to know about.
+func matchedStopSequence(requested []string, reported string) string {
+    if containsString(requested, reported) {
+        return reported
     }
+    return ""
+}
 
-    // Test model availability
-    bc.TestModelAvailability()
+// GenerationResult is the outcome of a successful generation
+type GenerationResult struct {
+    Text      string
+    ModelName string
+    ModelID   string
+    Account   string // Name of the AWS account that served the request
 
-    // Create router
-    router := mux.NewRouter()
-    
-    // Register routes
-    router.HandleFunc("/", rootHandler).Methods("GET")
-    router.HandleFunc("/health", healthHandler(bc)).Methods("GET")
-    router.HandleFunc("/models", modelsHandler(bc)).Methods("GET")
-    router.HandleFunc("/generate", generateHandler(bc)).Methods("POST")
+    // Token usage as reported by the model, or estimated when it doesn't
+    // report any
+    InputTokens     int
+    OutputTokens    int
+    TokensEstimated bool
 
-    // Configure server with enhanced timeouts for context processing
-    srv := &http.Server{
-        Handler:      router,
-        Addr:         ":9000",
-        WriteTimeout: 120 * time.Second,  // Increased for context processing
-        ReadTimeout:  60 * time.Second,   // Increased for large context
-    }
+    Latency time.Duration // Of the model invocation, zero when none was made
 
-    log.Printf("Enhanced Bedrock Service started on port 9000 with %d available models", len(bc.GetAvailableModels()))
-    log.Println("Features: Conversation Context, File Analysis, Multi-Model Support")
-    
-    if err := srv.ListenAndServe(); err != nil {
-        log.Fatal(err)
+    // Normalized and provider-reported stop reasons
+    FinishReason    string
+    FinishReasonRaw string
+    StopSequence    string // The requested stop sequence that ended generation, if any
+
+    Sampling SamplingParams // As sent to the model
+
+    // Set when the provider's content filtering withheld the output
+    Filtered       bool
+    FilterCategory string
+
+    // Set by classifyRefusal when the model declined to answer
+    Refused         bool
+    RefusalCategory string
+
+    Adaptations []string // Prompt adaptation rules applied for the serving model
+    Documents   string   // How the serving model got the documents: native or text_extraction; empty for none
+    Retries     int      // Backoff retries across the attempts, see retry.go
+
+    GuardrailTrace interface{} // The guardrail's assessment, when its trace was asked for
+
+    Mocked bool // Canned X-Mock-Response text, no model was invoked
+    Cached bool // Served from the response cache, no model was invoked
+}
+
+// GenerateText calls Amazon Bedrock with enhanced context handling, on
+// behalf of the client whose request is being served. Cancelling ctx
+// cancels the invocation in flight.
+func (bc *BedrockClient) GenerateText(ctx context.Context, prompt string, preferredModel string, maxTokens int, temperature float64) (string, string, error) {
+    result, err := bc.Generate(ctx, GenerationParams{
+        Prompt:         prompt,
+        PreferredModel: preferredModel,
+        MaxTokens:      maxTokens,
+        Temperature:    &temperature,
+        Origin:         originUser,
+    })
+    if err != nil {
+        return "", "", err
+    }
+    if result.Filtered {
+        return "", result.ModelName, ErrContentFiltered
+    }
+    return result.Text, result.ModelName, nil
+}
+
+// Generate runs a generation through the model fallback chain. Once ctx is
+// cancelled no further models are tried. It fails with errSaturated when
+// no generation slot came free in time.
+func (bc *BedrockClient) Generate(ctx context.Context, p GenerationParams) (*GenerationResult, error) {
+    if err := p.Origin.check(); err != nil {
+        return nil, err
+    }
+    ctx, leave, err := bc.gate.Enter(ctx)
+    if err == errSaturated {
+        p.Record.Policy("concurrency limit: no generation slot came free")
+        return nil, err
+    }
+    if err != nil {
+        return nil, &GenerationError{Err: err}
+    }
+    defer leave()
+    p = p.withDefaults()
+    if p.Guardrail == nil {
+        p.Guardrail = bc.guardrail.guardrail() // Generations that name none get the default
+    }
+    ctx, retries := countRetries(ctx)
+    slog.DebugContext(ctx, "generation parameters", "max_tokens", p.MaxTokens, "temperature", *p.Temperature)
+
+    modelsToTry := bc.chain(p)
+    if len(modelsToTry) == 0 {
+        return nil, &GenerationError{Failures: p.Skipped, Err: fmt.Errorf("no available models found")}
+    }
+    if bc.safeMode.Active() {
+        p.Record.Policy("safe mode: the most reliable model was tried first")
+    }
+    
+    var lastError error
+    var lastFiltered *GenerationResult
+    var attempted []string
+    failures := append([]ModelFailure(nil), p.Skipped...)
+    for _, model := range modelsToTry {
+        if p.hasImages() && !model.Vision {
+            if lastError == nil {
+                lastError = errImagesUnsupported
+            }
+            failures = append(failures, ModelFailure{Model: model.ID, ErrorClass: errClassNotAvailable, Reason: errImagesUnsupported.Error()})
+            continue
+        }
+        slog.DebugContext(ctx, "trying model", "model_id", model.ID, "model", model.Name)
+        started := time.Now()
+        
+        // A body we can't encode for one model can't be encoded for any of
+        // them, so don't fall back. Converse models get one too: it carries
+        // the same inputs and keys the response cache.
+        attempt, adaptations := bc.adapt(model, p)
+        attempt, documents, err := attempt.withDocuments(readsDocuments(model, attempt))
+        if err != nil {
+            if lastError == nil {
+                lastError = err
+            }
+            failures = append(failures, ModelFailure{Model: model.ID, ErrorClass: errClassNotAvailable, Reason: err.Error()})
+            continue
+        }
+        bodyBytes, err := marshalRequestBody(ctx, model.ID, buildRequestBody(model, attempt))
+        if err != nil {
+            return nil, err
+        }
+
+        cacheKey := bc.responses.Key(p.responseCacheScope(), model.ID, bodyBytes)
+        if cached, ok := bc.responses.Get(cacheKey, started); ok {
+            logAttempt(ctx, model.ID, cached.Account, "cached", started, nil)
+            p.Record.Attempt(model.ID, cached.Account, started, "cached", nil)
+            return cached, nil
+        }
+
+        // Another request may have opened the breaker, or be its trial
+        if !bc.breakerAdmit(model.ID, started) {
+            logAttempt(ctx, model.ID, "", "breaker_open", started, nil)
+            p.Record.Attempt(model.ID, "", started, "breaker_open", nil)
+            if lastError == nil {
+                lastError = errBreakerOpen
+            }
+            failures = append(failures, modelFailure(model.ID, errBreakerOpen))
+            continue
+        }
+        attempted = append(attempted, model.ID)
+
+        var result *GenerationResult
+        var account *Account
+        attemptCtx, span := startAttempt(ctx, model, retries)
+        if usesConverse(model, attempt) {
+            result, account, err = bc.converse(attemptCtx, model, attempt)
+        } else {
+            result, account, err = bc.invokeModel(attemptCtx, model, attempt, bodyBytes)
+        }
+        bc.breakerRecord(model.ID, err, time.Now())
+        bc.noteProfileFailure(model, err)
+        attemptDone := func(outcome string, err error) {
+            logAttempt(ctx, model.ID, accountName(account), outcome, started, err)
+            p.Record.Attempt(model.ID, accountName(account), started, outcome, err)
+            if result != nil {
+                span.end(account, outcome, result.InputTokens, result.OutputTokens, err)
+            } else {
+                span.end(account, outcome, 0, 0, err)
+            }
+        }
+        if isCancelled(err) {
+            // The caller gave up; another model would be answering no one
+            attemptDone("cancelled", err)
+            return nil, &GenerationError{Attempted: attempted, Err: err}
+        }
+        if err != nil && isDeadline(ctx.Err()) {
+            // The caller's timeout ran out; the next model would start with
+            // no time left
+            attemptDone("timeout", err)
+            if lastFiltered != nil {
+                return lastFiltered, nil
+            }
+            return nil, &GenerationError{Attempted: attempted, Err: ctx.Err()}
+        }
+        if err != nil {
+            lastError = err
+            attemptDone("error", err)
+            failures = append(failures, modelFailure(model.ID, err))
+            continue
+        }
+
+        result.Adaptations, result.Retries, result.Documents = adaptations, int(retries.Load()), documents
+        if len(adaptations) > 0 {
+            p.Record.Policy("prompt adapted for %s: %s", model.ID, strings.Join(adaptations, ", "))
+        }
+
+        // Filtered output is a normal outcome, not an unexpected response format
+        if result.Filtered {
+            metrics.Inc("content_filtered_total", "model", model.ID, "category", result.FilterCategory)
+            result.FinishReason = finishFiltered
+            attemptDone("filtered", ErrContentFiltered)
+            if !bc.filterFallback {
+                return result, nil
+            }
+            lastFiltered, lastError = result, ErrContentFiltered
+            failures = append(failures, modelFailure(model.ID, ErrContentFiltered))
+            continue
+        }
+
+        attemptDone("success", nil)
+        bc.responses.Put(cacheKey, result, time.Now())
+        return result, nil
+    }
+
+    if lastFiltered != nil {
+        return lastFiltered, nil
+    }
+    return nil, &GenerationError{Attempted: attempted, Failures: failures, Err: lastError}
+}
+
+// invokeModel runs one attempt through InvokeModel with the request body
+// built for the model's format
+func (bc *BedrockClient) invokeModel(ctx context.Context, model ModelInfo, p GenerationParams, body []byte) (*GenerationResult, *Account, error) {
+    started := time.Now()
+    input := &bedrockruntime.InvokeModelInput{
+        Body:        body,
+        ModelId:     aws.String(model.invokeID()),
+        ContentType: aws.String("application/json"),
+    }
+    input.GuardrailIdentifier, input.GuardrailVersion, input.Trace = p.Guardrail.invocation()
+    resp, account, err := bc.accounts.InvokeModel(ctx, p.Origin, input)
+    latency := time.Since(started)
+    if err != nil {
+        return nil, account, err
+    }
+
+    result := &GenerationResult{ModelName: model.Name, ModelID: model.ID, Account: account.Name, Sampling: p.sampling(), Latency: latency}
+    if err := readInvokeResponse(model, p, resp.Body, result); err != nil {
+        return nil, account, err
+    }
+    // Bedrock counts tokens for every model, in the headers, when the body
+    // reports none
+    if !result.Filtered && result.InputTokens == 0 && result.OutputTokens == 0 {
+        result.InputTokens, result.OutputTokens = headerTokens(resp.ResultMetadata)
+    }
+    return result, account, nil
+}
+
+// readInvokeResponse fills in result from an InvokeModel response body in
+// the model's format. The provider conformance tests run it over the
+// fixtures in testdata/fixtures.
+func readInvokeResponse(model ModelInfo, p GenerationParams, body []byte, result *GenerationResult) error {
+    var response map[string]interface{}
+    if err := json.Unmarshal(body, &response); err != nil {
+        return fmt.Errorf("error parsing response: %v", err)
+    }
+    format := formatOf(model)
+    detectSchemaDrift(format.provider(), response)
+
+    result.FinishReasonRaw = format.stopReason(response)
+    result.FinishReason = normalizeFinishReason(format.provider(), result.FinishReasonRaw)
+
+    if p.Guardrail != nil && p.Guardrail.Trace {
+        result.GuardrailTrace = guardrailTrace(response)
+    }
+
+    // Guardrails intervene without changing the stop reason, so filtering
+    // is detected from the body. A guardrail puts its blocked message or
+    // masked output where the model's text would be.
+    if category, filtered := detectContentFilter(response); filtered {
+        result.Filtered, result.FilterCategory = true, category
+        if category == filterGuardrail {
+            format.parseResponse(response, p, result)
+        }
+        return nil
+    }
+
+    if !format.parseResponse(response, p, result) {
+        return fmt.Errorf("unexpected response format from model %s", model.Name)
+    }
+    return nil
+}
+
+// setUsage fills in the token usage, stop reason and latency of result
+func (resp *GenerateResponse) setUsage(result *GenerationResult) {
+    resp.InputTokens, resp.OutputTokens = result.InputTokens, result.OutputTokens
+    resp.TokenCount = result.InputTokens + result.OutputTokens
+    resp.TokensEstimated = result.TokensEstimated
+    resp.StopReason = result.FinishReasonRaw
+    resp.LatencyMs = result.Latency.Milliseconds()
+}
+
+// Handlers
+func healthHandler(bc *BedrockClient) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        response := HealthResponse{
+            Status:          "healthy",
+            Service:         "bedrock-service",
+            AvailableModels: bc.GetAvailableModels(),
+            SafeMode:        bc.safeMode.Active(),
+        }
+        if last := bc.LastProbe(); !last.IsZero() {
+            response.LastModelCheck = &last
+        }
+        switch {
+        case !bc.registryReady.Load():
+            response.Status = "initializing"
+        case response.SafeMode:
+            response.Status = "degraded"
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(response)
+    }
+}
+
+// serviceVersion is reported by / and /status
+const serviceVersion = "3.0.0"
+
+func rootHandler(w http.ResponseWriter, r *http.Request) {
+    response := map[string]string{
+        "message": "Enhanced Bedrock Service is running",
+        "version": serviceVersion,
+        "features": "conversation-context, file-analysis, multi-model-support",
+        "documentation": "POST /generate with {\"prompt\": \"your prompt with context\", \"model\": \"optional model preference\"}",
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+func generateHandler(bc *BedrockClient, linkPolicy *LinkPolicy, systemContext *SystemContext, contexts *ContextStore, analytics *PromptAnalytics, results *ResultStore, experiments *Experiments, timeouts RequestTimeoutConfig) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        received := time.Now()
+        defer func() {
+            metrics.Observe(r.Context(), "generate_request_duration_seconds", time.Since(received).Seconds())
+        }()
+        format, ok := negotiate(r.Header.Get("Accept"), generateFormats)
+        if !ok {
+            notAcceptable(w, r, generateFormats)
+            return
+        }
+        out := newGenerateWriter(w, r, format)
+
+        var req GenerateRequest
+        
+        // Parse request body
+        schemaVersion, err := decodeGenerateRequest(r, &req)
+        if err != nil {
+            out.Error(schemaErrorResponse(err))
+            return
+        }
+        w.Header().Set("X-Schema-Version", schemaVersion)
+
+        // Validate prompt or messages
+        if _, _, apiErr := req.turns(); apiErr != nil {
+            out.Error(http.StatusBadRequest, *apiErr)
+            return
+        }
+        if apiErr := req.checkStopSequences(); apiErr != nil {
+            out.Error(http.StatusBadRequest, *apiErr)
+            return
+        }
+        if apiErr := req.checkSampling(); apiErr != nil {
+            out.Error(http.StatusBadRequest, *apiErr)
+            return
+        }
+        if apiErr := req.checkFormat(); apiErr != nil {
+            out.Error(http.StatusBadRequest, *apiErr)
+            return
+        }
+
+        if len(req.Tools) > 0 {
+            out.Errorf(http.StatusBadRequest, ErrCodeValidation, "Tools are only supported on /generate/stream")
+            return
+        }
+        if req.ResponseFormat != nil {
+            out.Errorf(http.StatusBadRequest, ErrCodeValidation, "response_format is only supported on /generate/stream")
+            return
+        }
+        if req.NumericStrict && !req.VerifyNumeric {
+            out.Errorf(http.StatusBadRequest, ErrCodeValidation, "numeric_strict requires verify_numeric")
+            return
+        }
+
+        if err := checkDeliver(req.Deliver, results); err != nil {
+            out.Error(http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: err.Error(),
+                Fields:  []FieldError{{Field: "deliver", Message: err.Error()}},
+            })
+            return
+        }
+        if req.Deliver == deliverS3 && format != mimeJSON {
+            out.Errorf(http.StatusBadRequest, ErrCodeValidation, "deliver \"s3\" returns a JSON envelope; request it with Accept: application/json")
+            return
+        }
+
+        linkMode, err := linkPolicy.EffectiveMode(req.LinkFilter)
+        if err != nil {
+            out.Errorf(http.StatusBadRequest, ErrCodeValidation, err.Error())
+            return
+        }
+
+        reqParams := resolveRequestParams(r, paramValues{Model: req.Model, Timezone: req.Timezone, Timeout: req.timeoutValue()})
+        loc, err := systemContext.ResolveLocation(reqParams.Timezone)
+        if err != nil {
+            out.Errorf(http.StatusBadRequest, ErrCodeValidation, err.Error())
+            return
+        }
+        timeout, apiErr := timeouts.requestTimeout(reqParams.Timeout, &reqParams.Warnings)
+        if apiErr != nil {
+            out.Error(http.StatusBadRequest, *apiErr)
+            return
+        }
+        match, apiErr := bc.checkModelPreference(reqParams.Model.Value, req.StrictModel)
+        if apiErr != nil {
+            out.Error(http.StatusBadRequest, *apiErr)
+            return
+        }
+        chain, apiErr := bc.resolveChain(req.Models, reqParams.Model.Value)
+        if apiErr != nil {
+            out.Error(http.StatusBadRequest, *apiErr)
+            return
+        }
+        guardrail, apiErr := bc.guardrail.forRequest(&req)
+        if apiErr != nil {
+            out.Error(http.StatusBadRequest, *apiErr)
+            return
+        }
+
+        var prefix string
+        if req.ContextID != "" {
+            var found bool
+            prefix, found = contexts.Use(contextOwner(principalFrom(r.Context())), req.ContextID, time.Now())
+            if !found {
+                out.Errorf(http.StatusNotFound, ErrCodeNotFound, "Unknown or expired context_id")
+                return
+            }
+        }
+
+        // Deployment-specific extensions run after core validation
+        hookCtx := hookContext(r)
+        if err := runRequestHooks(hookCtx, &req); err != nil {
+            out.Error(hookErrorResponse(err))
+            return
+        }
+        // Hooks may have rewritten the turns, so they are read afterwards
+        prompt, history, apiErr := req.turns()
+        if apiErr != nil {
+            out.Error(http.StatusBadRequest, *apiErr)
+            return
+        }
+        documents, apiErr := req.documents(prompt)
+        if apiErr != nil {
+            out.Error(http.StatusBadRequest, *apiErr)
+            return
+        }
+
+        params := GenerationParams{
+            Prompt:         prompt,
+            History:        history,
+            PromptBlocks:   req.promptBlocks(),
+            Documents:      documents,
+            PreferredModel: reqParams.Model.Value,
+            MaxTokens:      req.maxTokens(),
+            Temperature:    req.Temperature,
+            TopP:           req.TopP,
+            TopK:           req.TopK,
+            SystemPrompt:   req.System,
+            StopSequences:  req.StopSequences,
+            SystemContext:  systemContext.Lines(time.Now(), loc, !req.NoTimeContext),
+            ContextPrefix:  prefix,
+            PromptCache:    contexts.cfg.PromptCache,
+            Origin:         originUser,
+            Record:         requestRecordFrom(r.Context()),
+            CacheScope:     contextOwner(principalFrom(r.Context())),
+            NoAdaptation:   req.NoAdaptation,
+            Guardrail:      guardrail,
+        }
+
+        assignments := experiments.Apply(ExperimentUnit{UserID: req.UserID}, &params)
+        if req.StrictModel {
+            params.Candidates = bc.strictCandidates(match)
+        }
+        chain.apply(&params)
+
+        if req.DryRun {
+            dryRunHandler(w, r, bc, params, systemContext, !req.NoTimeContext)
+            return
+        }
+
+        mockText, mocked, err := mockResponse(r)
+        if err != nil {
+            out.Errorf(http.StatusForbidden, ErrCodeForbidden, err.Error())
+            return
+        }
+
+        // The caller's timeout bounds the Bedrock calls, numeric
+        // regeneration included, but not what's done with the answer
+        ctx, cancel := withRequestTimeout(r.Context(), timeout)
+        defer cancel()
+
+        var result *GenerationResult
+        if mocked {
+            // Contract testing: skip Bedrock but run everything else. Mocked
+            // requests stay out of usage analytics and the outcome counters.
+            logInfof(r.Context(), "Serving mocked response for key %s (%d bytes)", principalFrom(r.Context()).KeyID, len(mockText))
+            metrics.Inc("mock_requests_total", "endpoint", "generate")
+            result = mockGeneration(mockText, params.withDefaults())
+            classifyRefusal(result)
+            params.Record.Policy("mocked response: no model was invoked")
+        } else {
+            logPrompt(r.Context(), "received prompt", prompt, "model_preference", params.PreferredModel)
+
+            // Generate text using Bedrock with enhanced context
+            started := time.Now()
+            result, err = bc.Generate(ctx, params)
+            if isCancelled(err) {
+                // The client went away. That isn't a failure of the model or
+                // ours, so it stays out of analytics, experiments and usage.
+                metrics.Inc("generate_requests_total", "outcome", "cancelled")
+                logInfof(r.Context(), "Request cancelled by the client after %v", time.Since(started).Round(time.Millisecond))
+                out.Error(generationErrorResponse(err))
+                return
+            }
+            outcome := PromptOutcome{Prompt: prompt, Latency: time.Since(started), Failed: err != nil}
+            if err == nil {
+                classifyRefusal(result)
+                outcome.Model = result.ModelID
+                outcome.InputTokens, outcome.OutputTokens = result.InputTokens, result.OutputTokens
+                outcome.Refused = result.Refused
+                if result.Cached {
+                    // Nothing was spent on a cached answer
+                    outcome.InputTokens, outcome.OutputTokens = 0, 0
+                }
+            }
+            analytics.Record(outcome, time.Now())
+            callerUsage.Record(r.Context(), outcome.Model, outcome.InputTokens, outcome.OutputTokens, outcome.Failed)
+            experiments.Record(assignments, ExperimentResult{
+                Latency:      outcome.Latency,
+                Failed:       outcome.Failed,
+                InputTokens:  outcome.InputTokens,
+                OutputTokens: outcome.OutputTokens,
+            })
+            if err != nil {
+                metrics.Inc("generate_requests_total", "outcome", failureOutcome(err))
+                logErrorf(r.Context(), "Error generating text: %v", err)
+                if req.StrictModel {
+                    out.Error(strictErrorResponse(err, match))
+                    return
+                }
+                out.Error(generationErrorResponse(err))
+                return
+            }
+
+            metrics.Inc("generate_requests_total", "outcome", "success")
+            metrics.Inc("generate_finish_reasons_total", "model", result.ModelID, "finish_reason", result.FinishReason)
+        }
+
+        // Numeric claims are checked in the model's own text, before any
+        // policy rewrites it
+        var numericChecks []NumericCheck
+        numericRegenerated := false
+        if req.VerifyNumeric && !result.Filtered {
+            numericChecks = verifyNumeric(result.Text)
+            if req.NumericStrict && !result.Mocked && numericFailures(numericChecks) > 0 {
+                result, numericChecks, numericRegenerated = bc.regenerateNumeric(ctx, params, result, numericChecks)
+            }
+        }
+
+        // Check links in the output against the domain policy
+        response, links, err := linkPolicy.Apply(linkMode, result.Text)
+        if err != nil {
+            logWarnf(r.Context(), "Blocked response from %s: %v", result.ModelName, err)
+            params.Record.Policy("link policy: %v", err)
+            out.Errorf(http.StatusUnprocessableEntity, ErrCodeContentBlocked, "Response blocked: it contained links to disallowed domains")
+            return
+        }
+
+        // A standardized refusal message replaces the model's text, and like
+        // filtered output it isn't the model's to attribute
+        policy := principalFrom(r.Context()).Policy
+        response, refusalReplaced := refusalText(response, result.Refused, policy)
+        if refusalReplaced {
+            params.Record.Policy("refusal (%s) replaced with the key's refusal message", result.RefusalCategory)
+        }
+
+        // The attribution footer goes last, after all other post-processing;
+        // filtered responses have no text to attribute
+        footerApplied := false
+        if result.FinishReason != finishFiltered && !refusalReplaced {
+            response, footerApplied = applyFooter(response, policy)
+        }
+
+        resp := GenerateResponse{
+            Response:   response,
+            ModelUsed:  result.ModelName,
+            ModelAlias: bc.aliasOf(reqParams.Model.Value),
+            Links:      links,
+            Meta: &ResponseMeta{
+                ModelID:            result.ModelID,
+                Account:            result.Account,
+                FooterApplied:      footerApplied,
+                RefusalReplaced:    refusalReplaced,
+                Mocked:             result.Mocked,
+                Cached:             result.Cached,
+                NumericRegenerated: numericRegenerated,
+                Sampling:           &result.Sampling,
+                Adaptations:        result.Adaptations,
+                Retries:            result.Retries,
+                Documents:          result.Documents,
+                Experiments:        assignments,
+                Warnings:           reqParams.Warnings,
+            },
+            FinishReason:    result.FinishReason,
+            FinishReasonRaw: result.FinishReasonRaw,
+            StopSequence:    result.StopSequence,
+            NumericChecks:   numericChecks,
+            Filtered:        result.Filtered,
+            FilterCategory:  result.FilterCategory,
+            Refused:         result.Refused,
+            RefusalCategory: result.RefusalCategory,
+
+            GuardrailIntervened: result.FilterCategory == filterGuardrail,
+        }
+        resp.setUsage(result)
+        if result.GuardrailTrace != nil {
+            resp.Debug = &ResponseDebug{GuardrailTrace: result.GuardrailTrace}
+        }
+        if req.Format == formatBlocks && !result.Filtered {
+            resp.Blocks = parseBlocks(response)
+        }
+        runResponseHooks(hookCtx, &req, &resp)
+
+        // Send response
+        if req.Deliver == deliverS3 {
+            writeDelivered(w, r, results, resp)
+            return
+        }
+        out.Result(resp, result)
+    }
+}
+
+// dryRunHandler reports the body that would be sent to the first model in the
+// fallback chain, including injected system context, without invoking it
+func dryRunHandler(w http.ResponseWriter, r *http.Request, bc *BedrockClient, params GenerationParams, systemContext *SystemContext, timeContext bool) {
+    params = params.withDefaults()
+
+    models := bc.chain(params)
+    if len(models) == 0 {
+        // Nothing is available yet, show the request for the first configured model
+        models = bc.models()
+    }
+    if len(models) == 0 {
+        writeError(w, r, http.StatusServiceUnavailable, ErrCodeModelUnavailable, "No models configured")
+        return
+    }
+    model := models[0]
+
+    systemLines := params.SystemContext
+    if systemLines == nil {
+        systemLines = []string{}
+    }
+
+    fallbacks := []DryRunFallback{}
+    for _, fallback := range models[1:] {
+        adapted, adaptations := bc.adapt(fallback, params)
+        adapted, _, _ = adapted.withDocuments(readsDocuments(fallback, adapted)) // A model it would skip shows the documents as given
+        fallbacks = append(fallbacks, DryRunFallback{
+            Model:       fallback.Name,
+            ModelID:     fallback.ID,
+            Adaptations: adaptations,
+            RequestBody: buildRequestBody(fallback, adapted),
+        })
+    }
+
+    adapted, adaptations := bc.adapt(model, params)
+    adapted, _, _ = adapted.withDocuments(readsDocuments(model, adapted))
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(DryRunResponse{
+        DryRun:               true,
+        Model:                model.Name,
+        ModelID:              model.ID,
+        SystemContext:        systemLines,
+        EstimatedInputTokens: estimateInputTokens(model, adapted),
+        PromptHash:           PromptHash(params, timeContext, systemContext.StaticLines),
+        RequestBody:          buildRequestBody(model, adapted),
+        Adaptations:          adaptations,
+        Fallbacks:            fallbacks,
+    })
+}
+
+// modelListing is one entry of GET /models. Fields are in the order
+// encoding/json used to sort the keys of the map this replaced, so the bytes
+// served are unchanged.
+type modelListing struct {
+    APIType       string         `json:"api_type"`
+    Available     bool           `json:"available"`
+    BaseModel     string         `json:"base_model,omitempty"` // The base model behind an inference profile
+    Breaker       BreakerStatus  `json:"breaker"`
+    ContextWindow int            `json:"context_window"`
+    Defaults      *ModelDefaults `json:"defaults,omitempty"`
+    Enabled       bool           `json:"enabled"` // False while an admin has the model turned off; available is then false too
+    Features      []string       `json:"features"`
+    ID            string         `json:"id"`
+    Profile       bool           `json:"inference_profile"` // The ID is a cross-region inference profile rather than a base model
+    MaxOutput     int            `json:"max_output_tokens,omitempty"` // max_tokens above this is lowered for the model
+    Modality      Modality       `json:"modality"` // text or image
+    Name          string         `json:"name"`
+    ProbeStatus   string         `json:"probe_status"`
+    Fallback      bool           `json:"profile_fallback,omitempty"` // The profile is unavailable and base_model is invoked instead
+    Provider      string         `json:"provider"` // The vendor of the model family, such as "anthropic" or "cohere"
+}
+
+// aliasListing is one alias in GET /models
+type aliasListing struct {
+    Alias      string   `json:"alias"`
+    Models     []string `json:"models"`                // Most preferred first
+    ResolvesTo string   `json:"resolves_to,omitempty"` // The model the alias picks now; absent when none of the group is usable
+}
+
+// modelFeatures is what every text model offers, and imageModelFeatures
+// every image model
+var (
+    modelFeatures      = []string{"conversation-context", "file-analysis"}
+    imageModelFeatures = []string{"image-generation"}
+)
+
+// features lists what model offers in GET /models
+func (model ModelInfo) features() []string {
+    if model.modality() == modalityImage {
+        return imageModelFeatures
+    }
+    features := append([]string(nil), modelFeatures...)
+    if model.Vision {
+        features = append(features, "vision")
+    }
+    if model.Documents {
+        features = append(features, "documents")
+    }
+    return features
+}
+
+// apiType names the request format a model uses
+func apiType(model ModelInfo) string {
+    return string(model.API)
+}
+
+// modelsBody is a cached GET /models body
+type modelsBody struct {
+    data    []byte
+    staleAt time.Time // When the first open breaker turns half-open, which nothing invalidates; zero when none is open
+}
+
+// modelsListing returns the encoded GET /models body, building it on first
+// use after the registry last changed or a breaker's cooldown ran out
+func (bc *BedrockClient) modelsListing() []byte {
+    now := time.Now()
+    if cached := bc.listing.Load(); cached != nil && (cached.staleAt.IsZero() || now.Before(cached.staleAt)) {
+        return cached.data
+    }
+    bc.modelsMu.RLock()
+    var staleAt time.Time
+    for _, b := range bc.breakers {
+        if b.state(now) == breakerOpen && (staleAt.IsZero() || b.openUntil.Before(staleAt)) {
+            staleAt = b.openUntil
+        }
+    }
+    models := make([]modelListing, 0, len(bc.availableModels))
+    modalities := map[Modality][]string{modalityText: {}, modalityImage: {}}
+    for _, model := range bc.availableModels {
+        models = append(models, bc.modelListingLocked(model, now))
+        modalities[model.modality()] = append(modalities[model.modality()], model.ID)
+    }
+    aliases := make([]aliasListing, 0, len(bc.aliases))
+    warming := !bc.registryReady.Load()
+    for alias, group := range bc.aliases {
+        listing := aliasListing{Alias: alias, Models: group}
+        for _, id := range group {
+            for _, model := range bc.availableModels {
+                if normalizeModelID(model.ID) == id && listing.ResolvesTo == "" && bc.usableLocked(model, now, warming) {
+                    listing.ResolvesTo = model.ID
+                }
+            }
+        }
+        aliases = append(aliases, listing)
+    }
+    bc.modelsMu.RUnlock()
+    sort.Slice(aliases, func(i, j int) bool { return aliases[i].Alias < aliases[j].Alias })
+    data, err := json.Marshal(map[string]interface{}{"models": models, "aliases": aliases, "modalities": modalities})
+    if err != nil {
+        log.Printf("Internal error: encoding models listing: %v", err)
+        return nil
+    }
+    data = append(data, '\n')
+    bc.listing.Store(&modelsBody{data: data, staleAt: staleAt})
+    return data
+}
+
+// modelListingLocked is a model's /models entry; callers hold modelsMu
+func (bc *BedrockClient) modelListingLocked(model ModelInfo, now time.Time) modelListing {
+    listing := modelListing{
+        APIType:       apiType(model),
+        Available:     model.selectable(),
+        Breaker:       bc.breakerStatusLocked(model.ID, now),
+        ContextWindow: model.ContextWindow,
+        Enabled:       !model.Disabled,
+        Features:      model.features(),
+        ID:            model.ID,
+        MaxOutput:     model.MaxOutputTokens,
+        Modality:      model.modality(),
+        Name:          model.Name,
+        ProbeStatus:   model.ProbeStatus,
+        Provider:      modelVendor(model),
+    }
+    if isInferenceProfile(model.ID) {
+        listing.Profile, listing.BaseModel, listing.Fallback = true, foundationModelID(model.ID), model.ProfileFallback
+    }
+    if model.Defaults != (ModelDefaults{}) {
+        defaults := model.Defaults
+        listing.Defaults = &defaults
+    }
+    return listing
+}
+
+// invalidateModelsListing must be called whenever availableModels changes
+func (bc *BedrockClient) invalidateModelsListing() {
+    bc.listing.Store(nil)
+}
+
+func modelsHandler(bc *BedrockClient) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        listing := bc.modelsListing()
+        if listing == nil {
+            writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "Error encoding models")
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        w.Write(listing)
+    }
+}
+
+func min(a, b int) int {
+    if a < b {
+        return a
+    }
+    return b
+}
+
+// ServerConfig is what run takes besides the environment
+type ServerConfig struct {
+    Addr      string       // Listen address, unless Listener is set
+    Listener  net.Listener // Serve on this instead, as the e2e tests do
+    LogOutput io.Writer    // Where the JSON logs go, os.Stderr when nil
+}
+
+func main() {
+    if err := run(ServerConfig{Addr: ":9000"}); err != nil {
+        log.Fatal(err)
+    }
+}
+
+// run wires the service up from the environment and serves until the
+// server fails. Invalid configuration is fatal, as it always was at startup.
+func run(cfg ServerConfig) error {
+    // JSON logs, before anything else is logged
+    if err := LoadLogging(cfg.LogOutput); err != nil {
+        log.Fatalf("Invalid logging configuration: %v", err)
+    }
+    log.Println("Starting Enhanced Bedrock Service v3.0...")
+    
+    // OpenTelemetry tracing, exported when an OTLP endpoint is configured
+    if err := LoadTracing(context.Background()); err != nil {
+        log.Fatalf("Invalid tracing configuration: %v", err)
+    }
+
+    // Initialize Bedrock client
+    bc, err := NewBedrockClient()
+    if err != nil {
+        log.Fatalf("Failed to initialize Bedrock client: %v", err)
+    }
+
+    // Load output link policy
+    linkPolicy, err := LoadLinkPolicy()
+    if err != nil {
+        log.Fatalf("Invalid link filter configuration: %v", err)
+    }
+
+    // Load system prompt context (time zone, static deployment facts)
+    systemContext, err := LoadSystemContext()
+    if err != nil {
+        log.Fatalf("Invalid system context configuration: %v", err)
+    }
+
+    // Default instructions for requests that don't send their own system prompt
+    if v := os.Getenv("DEFAULT_SYSTEM_PROMPT"); v != "" {
+        defaultSystemPrompt, legacyPreamble = v, v
+        log.Printf("Using DEFAULT_SYSTEM_PROMPT as the default system prompt (%d bytes)", len(v))
+    }
+
+    // Prompt rewrites for fallbacks to models from another provider
+    if bc.adaptations, err = LoadPromptAdaptations(); err != nil {
+        log.Fatalf("Invalid prompt adaptation configuration: %v", err)
+    }
+
+    // All fetches of caller-supplied URLs go through the hardened egress client
+    egressPolicy, err := LoadEgressPolicy()
+    if err != nil {
+        log.Fatalf("Invalid egress configuration: %v", err)
+    }
+    egress = NewEgressClient(egressPolicy)
+
+    // Translations of client-facing error messages
+    errorMessages, err = LoadMessageCatalog()
+    if err != nil {
+        log.Fatalf("Invalid error message catalog: %v", err)
+    }
+
+    // Refusal phrase heuristics, on top of provider refusal signals
+    refusals, err = LoadRefusalClassifier()
+    if err != nil {
+        log.Fatalf("Invalid refusal detection configuration: %v", err)
+    }
+
+    // Everything persisted to local disk is encrypted at rest when a key is configured
+    stateEncryption, err = LoadStateEncryption()
+    if err != nil {
+        log.Fatalf("Invalid state encryption configuration: %v", err)
+    }
+
+    // Track the error budget and enter safe mode automatically when it's exhausted
+    safeModeConfig, err := LoadSafeModeConfig()
+    if err != nil {
+        log.Fatalf("Invalid safe mode configuration: %v", err)
+    }
+    bc.safeMode = NewSafeMode(safeModeConfig)
+    go bc.safeMode.Run()
+
+    // Every change of a model's state is kept in the registry event log
+    registryEventsConfig, err := LoadRegistryEventsConfig()
+    if err != nil {
+        log.Fatalf("Invalid model registry event configuration: %v", err)
+    }
+    bc.events, err = NewRegistryEvents(registryEventsConfig)
+    if err != nil {
+        log.Fatalf("Failed to load model registry events: %v", err)
+    }
+    go bc.events.Run()
+
+    // Failing models are taken out of the fallback chain between probes
+    if bc.breakerCfg, err = LoadBreakerConfig(); err != nil {
+        log.Fatalf("Invalid model breaker configuration: %v", err)
+    }
+
+    // Generations pass through the default guardrail unless they name another
+    if bc.guardrail, err = LoadGuardrailConfig(); err != nil {
+        log.Fatalf("Invalid guardrail configuration: %v", err)
+    }
+    if bc.guardrail.ID != "" {
+        log.Printf("Guardrail %s version %s applies to generations by default", bc.guardrail.ID, bc.guardrail.Version)
+    }
+
+    // Test model availability
+    probeConfig, err := LoadProbeConfig()
+    if err != nil {
+        log.Fatalf("Invalid model probe configuration: %v", err)
+    }
+    go bc.RunProbes(probeConfig)
+    go reloadModelsOnSignal(bc, probeConfig)
+
+    // Load API keys (authentication is disabled without API_KEYS_FILE)
+    keyStore, err := LoadKeyStore()
+    if err != nil {
+        log.Fatalf("Invalid API key configuration: %v", err)
+    }
+
+    // Per-caller rate limiting (disabled unless RATE_LIMIT_REQUESTS is set)
+    rateLimitConfig, err := LoadRateLimitConfig()
+    if err != nil {
+        log.Fatalf("Invalid rate limit configuration: %v", err)
+    }
+    limiter, err := NewRateLimiter(rateLimitConfig)
+    if err != nil {
+        log.Fatalf("Invalid rate limit configuration: %v", err)
+    }
+
+    // Reusable prompt prefixes for POST /contexts
+    contextConfig, err := LoadContextStoreConfig()
+    if err != nil {
+        log.Fatalf("Invalid context store configuration: %v", err)
+    }
+    contexts := NewContextStore(contextConfig)
+
+    // Targets behind the /scaling autoscaling signal
+    scalingTargets, err := LoadScalingTargets()
+    if err != nil {
+        log.Fatalf("Invalid scaling configuration: %v", err)
+    }
+
+    // Per-prompt usage analytics
+    analyticsConfig, err := LoadPromptAnalyticsConfig()
+    if err != nil {
+        log.Fatalf("Invalid prompt analytics configuration: %v", err)
+    }
+    analytics, err := NewPromptAnalytics(analyticsConfig)
+    if err != nil {
+        log.Fatalf("Failed to load prompt analytics: %v", err)
+    }
+    go analytics.Run()
+
+    // Optional S3 bucket for "deliver": "s3"
+    resultStoreConfig, err := LoadResultStoreConfig()
+    if err != nil {
+        log.Fatalf("Invalid results bucket configuration: %v", err)
+    }
+    results, err := NewResultStore(resultStoreConfig, defaultRegion())
+    if err != nil {
+        log.Fatalf("Failed to initialize results bucket: %v", err)
+    }
+
+    // Server-side conversations with per-turn token budgets
+    conversationConfig, err := LoadConversationConfig()
+    if err != nil {
+        log.Fatalf("Invalid conversation configuration: %v", err)
+    }
+    conversations := NewConversationStore(conversationConfig)
+
+    // Signed, expiring links to conversation transcripts
+    shareConfig, err := LoadShareConfig()
+    if err != nil {
+        log.Fatalf("Invalid share link configuration: %v", err)
+    }
+
+    // Scoring of outputs against reference answers
+    evalConfig, err := LoadEvalConfig()
+    if err != nil {
+        log.Fatalf("Invalid eval configuration: %v", err)
+    }
+
+    // Named A/B experiments on prompts and models
+    experiments, err := LoadExperiments()
+    if err != nil {
+        log.Fatalf("Invalid experiment configuration: %v", err)
+    }
+
+    // Recurring generations fired by the in-process scheduler
+    scheduleConfig, err := LoadScheduleConfig()
+    if err != nil {
+        log.Fatalf("Invalid schedule configuration: %v", err)
+    }
+    schedules := NewScheduleStore(scheduleConfig)
+    go schedules.Run(&scheduleRunner{bc: bc, linkPolicy: linkPolicy, systemContext: systemContext, results: results})
+
+    // Usage attribution by X-Caller-Service and X-Caller-Operation
+    callerUsage, err = LoadUsageLedger()
+    if err != nil {
+        log.Fatalf("Invalid caller tag configuration: %v", err)
+    }
+
+    // Concurrent stream limits and the idle stream reaper
+    streamLimits, err := LoadStreamLimitConfig()
+    if err != nil {
+        log.Fatalf("Invalid stream limit configuration: %v", err)
+    }
+    streams := NewStreamLimiter(streamLimits)
+    go streams.Run()
+
+    // Request bodies are buffered once, after auth and rate limiting
+    maxBody, err := LoadMaxRequestBody()
+    if err != nil {
+        log.Fatalf("Invalid request body configuration: %v", err)
+    }
+
+    // Recent requests, kept for /admin/requests/{request_id}
+    requestLog, err := LoadRequestLog()
+    if err != nil {
+        log.Fatalf("Invalid request log configuration: %v", err)
+    }
+
+    // HMAC request signing and replay protection for keys with a signing secret
+    signingConfig, err := LoadSigningConfig()
+    if err != nil {
+        log.Fatalf("Invalid request signing configuration: %v", err)
+    }
+
+    // Caps on the in-memory stores, and shedding near the container limit
+    memoryConfig, err := LoadMemoryConfig()
+    if err != nil {
+        log.Fatalf("Invalid memory configuration: %v", err)
+    }
+    memory := NewMemoryGovernor(memoryConfig)
+    memory.Register("contexts", contexts)
+    memory.Register("conversations", conversations)
+    memory.Register("request_log", requestLog)
+    memory.Register("prompt_analytics", analytics)
+
+    // Repeated /generate requests, keyed on the exact body sent to the model
+    responseCacheConfig, err := LoadResponseCacheConfig()
+    if err != nil {
+        log.Fatalf("Invalid response cache configuration: %v", err)
+    }
+    if bc.responses = NewResponseCache(responseCacheConfig, memory); bc.responses != nil {
+        memory.Register("response_cache", bc.responses)
+    }
+
+    // The generations in flight, bounded below Bedrock's throttling point
+    concurrencyConfig, err := LoadConcurrencyConfig()
+    if err != nil {
+        log.Fatalf("Invalid concurrency configuration: %v", err)
+    }
+    bc.gate = NewGenerationGate(concurrencyConfig)
+
+    // Records of /generate/batch runs, kept for retries
+    batchConfig, err := LoadBatchConfig()
+    if err != nil {
+        log.Fatalf("Invalid batch configuration: %v", err)
+    }
+    batches := NewBatchStore(batchConfig)
+    memory.Register("batches", batches)
+    go memory.Run()
+
+    // Scheduled deletion of data past its retention period
+    retentionConfig, err := LoadRetentionConfig()
+    if err != nil {
+        log.Fatalf("Invalid retention configuration: %v", err)
+    }
+    var retentionLease RetentionLease
+    if results != nil {
+        retentionLease = newResultStoreLease(results)
+    }
+    retention := NewRetentionSweeper(retentionConfig, retentionLease)
+    retention.Register("conversations", conversations, false)
+    retention.Register("usage", analytics, false)
+    if results != nil {
+        retention.Register("results", results, true)
+    }
+    go retention.Run()
+
+    // Cap on the timeout callers may set on /generate
+    timeouts, err := LoadRequestTimeoutConfig()
+    if err != nil {
+        log.Fatalf("Invalid request timeout configuration: %v", err)
+    }
+
+    // Page sizes and cursor signing for list endpoints
+    pages, err := LoadPageConfig()
+    if err != nil {
+        log.Fatalf("Invalid pagination configuration: %v", err)
+    }
+
+    // Dependency checks behind /readyz
+    readinessConfig, err := LoadReadinessConfig()
+    if err != nil {
+        log.Fatalf("Invalid readiness configuration: %v", err)
+    }
+    readiness := NewReadiness(readinessConfig)
+    readiness.Register("bedrock", true, func(ctx context.Context) error {
+        if !bc.registryReady.Load() {
+            return fmt.Errorf("model availability check still running")
+        }
+        if len(bc.GetAvailableModels()) == 0 {
+            return fmt.Errorf("no models available")
+        }
+        return nil
+    })
+    if keys, ok := stateEncryption.kmsKeys(); ok {
+        readiness.Register("kms", true, keys.Check)
+    }
+    if results != nil {
+        readiness.Register("results_bucket", false, results.Check)
+    }
+
+    // Capacity held for planned bulk jobs
+    reservationConfig, err := LoadReservationConfig()
+    if err != nil {
+        log.Fatalf("Invalid reservation configuration: %v", err)
+    }
+    reservations := NewReservationStore(reservationConfig)
+    if reservations != nil {
+        go reservations.Run()
+    }
+
+    // Create router
+    router := mux.NewRouter()
+    router.Use(requestIDMiddleware, tracingMiddleware, requestLog.Middleware(bc, memory), keyStore.Middleware, callerTagsMiddleware, rateLimitMiddleware(limiter, reservations), bodyBufferMiddleware(maxBody), signatureMiddleware(signingConfig, newMemoryNonceStore(signingConfig.MaxNonces)))
+    // The router's middleware doesn't run for unmatched requests
+    router.NotFoundHandler = requestIDMiddleware(tracingMiddleware(http.HandlerFunc(notFoundHandler)))
+    router.MethodNotAllowedHandler = requestIDMiddleware(tracingMiddleware(http.HandlerFunc(methodNotAllowedHandler)))
+    
+    // Register routes
+    router.HandleFunc("/", rootHandler).Methods("GET")
+    router.HandleFunc("/health", healthHandler(bc)).Methods("GET")
+    router.HandleFunc("/readyz", readyzHandler(readiness)).Methods("GET")
+    router.HandleFunc("/models", modelsHandler(bc)).Methods("GET")
+    router.HandleFunc("/models/events", registryEventsHandler(bc, bc.events)).Methods("GET")
+    router.HandleFunc("/models/{id}/events", registryEventsHandler(bc, bc.events)).Methods("GET")
+    router.HandleFunc("/generate", generateHandler(bc, linkPolicy, systemContext, contexts, analytics, results, experiments, timeouts)).Methods("POST")
+    router.HandleFunc("/generate/stream", generateStreamHandler(bc, systemContext, contexts, streams)).Methods("POST")
+    router.HandleFunc("/v1/chat/completions", chatCompletionsHandler(bc, systemContext, contexts, streams)).Methods("POST")
+    router.HandleFunc("/generate/batch", generateBatchHandler(bc, batches, systemContext, analytics)).Methods("POST")
+    router.HandleFunc("/generate/batch/{batch_id}", getBatchHandler(batches)).Methods("GET")
+    router.HandleFunc("/generate/batch/{batch_id}/retry", retryBatchHandler(bc, batches, systemContext, analytics)).Methods("POST")
+    router.HandleFunc("/contexts", createContextHandler(bc, contexts)).Methods("POST")
+    router.HandleFunc("/contexts/{id}", getContextHandler(contexts)).Methods("GET")
+    router.HandleFunc("/conversations", createConversationHandler(bc, conversations)).Methods("POST")
+    router.HandleFunc("/conversations/{id}", getConversationHandler(conversations)).Methods("GET")
+    router.HandleFunc("/conversations/{id}/turns", conversationTurnHandler(bc, conversations, systemContext, experiments)).Methods("POST")
+    if shareConfig.Secret != "" {
+        router.HandleFunc("/conversations/{id}/share", createShareHandler(conversations, shareConfig)).Methods("POST")
+        router.HandleFunc("/conversations/{id}/share", revokeSharesHandler(conversations)).Methods("DELETE")
+        router.HandleFunc("/shared/{token}", sharedTranscriptHandler(conversations, shareConfig)).Methods("GET")
+    }
+    if reservations != nil {
+        router.HandleFunc("/reservations", createReservationHandler(reservations)).Methods("POST")
+        router.HandleFunc("/reservations/{id}", getReservationHandler(reservations)).Methods("GET")
+    }
+    router.HandleFunc("/schedules", createScheduleHandler(schedules, bc, linkPolicy, results)).Methods("POST")
+    router.HandleFunc("/schedules", listSchedulesHandler(schedules, pages)).Methods("GET")
+    router.HandleFunc("/schedules/{id}", getScheduleHandler(schedules)).Methods("GET")
+    router.HandleFunc("/schedules/{id}", deleteScheduleHandler(schedules)).Methods("DELETE")
+    router.HandleFunc("/schedules/{id}/pause", pauseScheduleHandler(schedules, true)).Methods("POST")
+    router.HandleFunc("/schedules/{id}/resume", pauseScheduleHandler(schedules, false)).Methods("POST")
+    router.HandleFunc("/schedules/{id}/runs", scheduleRunsHandler(schedules, pages)).Methods("GET")
+    router.HandleFunc("/translate", translateHandler(bc)).Methods("POST")
+    router.HandleFunc("/truncate", truncateHandler(bc)).Methods("POST")
+    router.HandleFunc("/classify", classifyHandler(bc)).Methods("POST")
+    router.HandleFunc("/moderate", moderateHandler(bc)).Methods("POST")
+    router.HandleFunc("/images", imagesHandler(bc, results)).Methods("POST")
+    router.HandleFunc("/extract", extractHandler(bc, results)).Methods("POST")
+    router.HandleFunc("/admin/experiments/{name}/report", requireAdmin(experimentReportHandler(experiments))).Methods("GET")
+    router.HandleFunc("/experiments/{name}/outcomes", experimentOutcomeHandler(experiments)).Methods("POST")
+    router.HandleFunc("/admin/experiments/{name}", requireAdmin(experimentToggleHandler(experiments))).Methods("POST")
+    router.HandleFunc("/eval/score", evalScoreHandler(bc, evalConfig)).Methods("POST")
+    router.HandleFunc("/usage", usageHandler).Methods("GET")
+    router.HandleFunc("/metrics", metricsHandler).Methods("GET")
+    router.HandleFunc("/scaling", scalingHandler(scalingTargets)).Methods("GET")
+    router.HandleFunc("/analytics/prompts", requireAdmin(promptAnalyticsListHandler(analytics, pages))).Methods("GET")
+    router.HandleFunc("/analytics/prompts/{hash}", requireAdmin(promptAnalyticsGetHandler(analytics))).Methods("GET")
+    router.HandleFunc("/admin/safe-mode", requireAdmin(safeModeStatusHandler(bc.safeMode))).Methods("GET")
+    router.HandleFunc("/admin/safe-mode", requireAdmin(safeModeForceHandler(bc.safeMode))).Methods("POST")
+    router.HandleFunc("/admin/catalog/validate", requireAdmin(catalogValidateHandler(bc))).Methods("POST")
+    router.HandleFunc("/admin/models/reload", requireAdmin(modelsReloadHandler(bc, probeConfig))).Methods("POST")
+    router.HandleFunc("/admin/models/{id}", requireAdmin(modelToggleHandler(bc))).Methods("PATCH")
+    router.HandleFunc("/admin/rate-limits", requireAdmin(keyRateLimitsHandler(keyLimits))).Methods("GET")
+    router.HandleFunc("/admin/retention/dry-run", requireAdmin(retentionDryRunHandler(retention))).Methods("POST")
+    router.HandleFunc("/admin/debug/stats", requireAdmin(debugStatsHandler(streams, memory))).Methods("GET")
+    statusFlags := []StatusFlag{
+        {Name: "API key authentication", Value: fmt.Sprint(keyStore != nil)},
+        {Name: "Content filter fallback", Value: fmt.Sprint(bc.filterFallback)},
+        {Name: "Prompt caching", Value: fmt.Sprint(contexts.cfg.PromptCache)},
+        {Name: "Request log size", Value: fmt.Sprint(requestLog.size)},
+        {Name: "Max request body", Value: fmt.Sprintf("%d bytes", maxBody)},
+        {Name: "Stream idle timeout", Value: streamLimits.IdleTimeout.String()},
+        {Name: "Max request timeout", Value: timeouts.Max.String()},
+        {Name: "Max page size", Value: fmt.Sprint(pages.MaxLimit)},
+        {Name: "Model probe interval", Value: probeConfig.Interval.String()},
+        {Name: "Deep model probes", Value: fmt.Sprint(probeConfig.Deep)},
+        {Name: "Model availability checks", Value: fmt.Sprint(!probeConfig.Skip)},
+        {Name: "Model catalog", Value: bc.CatalogSource()},
+        {Name: "Bedrock retries", Value: bc.accounts.retry.String()},
+        {Name: "Reservations", Value: fmt.Sprint(reservations != nil)},
+        {Name: "Conversation share links", Value: fmt.Sprint(shareConfig.Secret != "")},
+    }
+    if memoryConfig.Limit > 0 {
+        statusFlags = append(statusFlags, StatusFlag{Name: "Memory limit", Value: fmt.Sprintf("%d bytes from %s", memoryConfig.Limit, memoryConfig.LimitSource)})
+    }
+    router.HandleFunc("/status", requireAdmin(statusHandler(bc, requestLog, streams, experiments, statusFlags))).Methods("GET")
+    router.HandleFunc("/admin/requests/{request_id}", requireAdmin(requestReportHandler(requestLog))).Methods("GET")
+    if gossip, ok := limiter.(*GossipLimiter); ok {
+        router.HandleFunc(gossipSyncPath, gossip.syncHandler).Methods("POST")
+        go gossip.Run()
+    }
+
+    // Configure server with enhanced timeouts for context processing
+    srv := &http.Server{
+        Handler:      router,
+        Addr:         cfg.Addr,
+        WriteTimeout: 120 * time.Second,  // Increased for context processing
+        ReadTimeout:  60 * time.Second,   // Increased for large context
+    }
+
+    addr := cfg.Addr
+    if cfg.Listener != nil {
+        addr = cfg.Listener.Addr().String()
+    }
+    log.Printf("Enhanced Bedrock Service started on %s with %d configured models", addr, len(bc.models()))
+    log.Println("Features: Conversation Context, File Analysis, Multi-Model Support")
+    
+    if cfg.Listener != nil {
+        return srv.Serve(cfg.Listener)
     }
+    return srv.ListenAndServe()
 }
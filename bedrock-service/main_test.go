@@ -0,0 +1,216 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log/slog"
+    "math"
+    "net/http"
+    "strings"
+    "testing"
+)
+
+// BenchmarkRequestBody measures what GenerateText does per attempt before
+// calling Bedrock: building the model's request body and marshalling it
+func BenchmarkRequestBody(b *testing.B) {
+    p := GenerationParams{Prompt: "Explain the difference between a mutex and a channel", Origin: originUser,
+        SystemContext: []string{"Current date: 2024-06-01"}}.withDefaults()
+    for i := 0; i < 5; i++ {
+        p.History = append(p.History, ChatMessage{Role: "user", Content: "What is a goroutine?"},
+            ChatMessage{Role: "assistant", Content: "A goroutine is a function running concurrently with the rest of the program."})
+    }
+    for _, model := range []ModelInfo{
+        {ID: "anthropic.claude-3-haiku-20240307-v1:0", API: apiMessages},
+        {ID: "anthropic.claude-v2", API: apiLegacy},
+        {ID: "meta.llama3-70b-instruct-v1:0", API: apiLlama},
+        {ID: "mistral.mistral-large-2407-v1:0", API: apiMistralChat},
+        {ID: "ai21.jamba-1-5-large-v1:0", API: apiJamba},
+    } {
+        b.Run(model.ID, func(b *testing.B) {
+            b.ReportAllocs()
+            for i := 0; i < b.N; i++ {
+                if _, err := marshalRequestBody(context.Background(), model.ID, buildRequestBody(model, p)); err != nil {
+                    b.Fatal(err)
+                }
+            }
+        })
+    }
+}
+
+// findTemperature returns the first "temperature" anywhere in a decoded body
+func findTemperature(v interface{}) (float64, bool) {
+    switch v := v.(type) {
+    case map[string]interface{}:
+        if t, ok := v["temperature"].(float64); ok {
+            return t, true
+        }
+        for _, child := range v {
+            if t, ok := findTemperature(child); ok {
+                return t, true
+            }
+        }
+    case []interface{}:
+        for _, child := range v {
+            if t, ok := findTemperature(child); ok {
+                return t, true
+            }
+        }
+    }
+    return 0, false
+}
+
+// Every format sends an explicit 0 as 0 and only an unset temperature as
+// the default
+func TestTemperatureZeroInEveryFormat(t *testing.T) {
+    zero := 0.0
+    for _, c := range []struct {
+        name        string
+        temperature *float64
+        want        float64
+    }{{"zero", &zero, 0}, {"omitted", nil, defaultTemperature}} {
+        p := GenerationParams{Prompt: "Say hello", Temperature: c.temperature, Origin: originUser}.withDefaults()
+        if p.defaulted.temperature != (c.temperature == nil) {
+            t.Errorf("%s: defaulted.temperature = %v", c.name, p.defaulted.temperature)
+        }
+        for apiType := range apiFormats {
+            model := ModelInfo{ID: "test." + string(apiType), API: apiType}
+            data, err := marshalRequestBody(context.Background(), model.ID, buildRequestBody(model, p))
+            if err != nil {
+                t.Fatal(err)
+            }
+            var body interface{}
+            json.Unmarshal(data, &body)
+            if got, ok := findTemperature(body); !ok || got != c.want {
+                t.Errorf("%s: %s body %s has temperature %v (found %v), want %v", c.name, apiType, data, got, ok, c.want)
+            }
+        }
+        input := buildConverseInput(ModelInfo{ID: "test.converse", Converse: true}, p)
+        if got := input.InferenceConfig.Temperature; got == nil || *got != float32(c.want) {
+            t.Errorf("%s: Converse temperature %v, want %v", c.name, input.InferenceConfig.Temperature, c.want)
+        }
+    }
+}
+
+// /generate with temperature 0, 0.0, omitted and set: what Bedrock is sent,
+// what the response reports and what is logged
+func TestE2ETemperature(t *testing.T) {
+    const model = "anthropic.claude-v2:1"
+    for _, c := range []struct {
+        name  string
+        field string
+        want  float64
+    }{
+        {"zero", `,"temperature":0`, 0},
+        {"zero point zero", `,"temperature":0.0`, 0},
+        {"omitted", ``, defaultTemperature},
+        {"set", `,"temperature":0.3`, 0.3},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            fake.Script(model, fakeReply{Body: `{"completion":" Hello","stop_reason":"stop_sequence"}`})
+            before := len(fake.Calls(model))
+
+            data := `{"prompt":"Say hello","models":["` + model + `"]` + c.field + `}`
+            resp, err := http.Post(serviceURL+"/generate", "application/json", strings.NewReader(data))
+            if err != nil {
+                t.Fatal(err)
+            }
+            if resp.StatusCode != http.StatusOK {
+                t.Fatalf("status %d", resp.StatusCode)
+            }
+            requestID := resp.Header.Get("X-Request-ID")
+            var out GenerateResponse
+            decode(t, resp, &out)
+
+            calls := fake.Calls(model)
+            if len(calls) != before+1 {
+                t.Fatalf("%d calls, want one more than %d", len(calls), before)
+            }
+            var sent map[string]interface{}
+            json.Unmarshal(calls[len(calls)-1].Body, &sent)
+            if got, ok := sent["temperature"].(float64); !ok || got != c.want {
+                t.Errorf("Bedrock was sent temperature %v, want %v", sent["temperature"], c.want)
+            }
+            if out.Meta == nil || out.Meta.Sampling == nil || out.Meta.Sampling.Temperature != c.want {
+                t.Errorf("meta %+v, want sampling temperature %v", out.Meta, c.want)
+            }
+
+            logged := false
+            for _, entry := range logLines(t, requestID) {
+                if entry["msg"] == "generation parameters" && entry["temperature"] == c.want {
+                    logged = true
+                }
+            }
+            if !logged {
+                t.Errorf("effective temperature %v not logged:\n%v", c.want, logLines(t, requestID))
+            }
+        })
+    }
+}
+
+// Explicit values are checked rather than read as unset
+func TestSamplingZeroesValidated(t *testing.T) {
+    zero, tooHot := 0, 1.5
+    req := &GenerateRequest{MaxTokens: &zero, Temperature: &tooHot}
+    apiErr := req.checkSampling()
+    if apiErr == nil || len(apiErr.Fields) != 2 || apiErr.Fields[0].Field != "max_tokens" || apiErr.Fields[1].Field != "temperature" {
+        t.Errorf("checkSampling = %+v, want max_tokens and temperature rejected", apiErr)
+    }
+    greedy := 0.0
+    if apiErr := (&GenerateRequest{Temperature: &greedy}).checkSampling(); apiErr != nil {
+        t.Errorf("temperature 0 rejected: %+v", apiErr)
+    }
+    if apiErr := (&GenerateRequest{}).checkSampling(); apiErr != nil {
+        t.Errorf("omitted parameters rejected: %+v", apiErr)
+    }
+}
+
+// A body that can't be encoded for the first model can't be for any: the
+// chain stops there, nothing reaches Bedrock and the failure is logged once.
+// Nothing a caller sends can fail to encode, since JSON has no NaN, so the
+// test hands Generate one directly.
+func TestGenerateStopsOnRequestBuildError(t *testing.T) {
+    bc, err := NewBedrockClient()
+    if err != nil {
+        t.Fatal(err)
+    }
+    chain := []ModelInfo{
+        {ID: "anthropic.claude-3-5-haiku-20241022-v1:0", API: apiMessages, Available: true},
+        {ID: "amazon.nova-pro-v1:0", API: apiNova, Available: true},
+        {ID: "mistral.mistral-large-2407-v1:0", API: apiMistralChat, Available: true},
+    }
+    logs := captureLogs(t, slog.LevelInfo, false)
+    nan := math.NaN()
+    calls := make(map[string]int)
+    for _, model := range chain {
+        calls[model.ID] = len(fake.Calls(model.ID)) // Other tests use the models too
+    }
+
+    _, err = bc.Generate(context.Background(), GenerationParams{Prompt: "Hi", Temperature: &nan, Origin: originUser, Candidates: chain})
+    var buildErr *RequestBuildError
+    if !errors.As(err, &buildErr) {
+        t.Fatalf("error %v, want a RequestBuildError", err)
+    }
+    if buildErr.Model != chain[0].ID || buildErr.Field != "temperature" {
+        t.Errorf("build error %+v, want the first model's temperature", buildErr)
+    }
+    if status, apiErr := generationErrorResponse(err); status != http.StatusInternalServerError || apiErr.Code != ErrCodeRequestBuild {
+        t.Errorf("mapped to %d %s, want 500 %s", status, apiErr.Code, ErrCodeRequestBuild)
+    }
+    for _, model := range chain {
+        if n := len(fake.Calls(model.ID)) - calls[model.ID]; n != 0 {
+            t.Errorf("%s invoked %d times", model.ID, n)
+        }
+    }
+
+    var lines []map[string]interface{}
+    for _, line := range strings.Split(logs.String(), "\n") {
+        var entry map[string]interface{}
+        if json.Unmarshal([]byte(line), &entry) == nil && entry["level"] != "DEBUG" {
+            lines = append(lines, entry)
+        }
+    }
+    if len(lines) != 1 || lines[0]["level"] != "ERROR" || lines[0]["model_id"] != chain[0].ID || lines[0]["field"] != "temperature" {
+        t.Errorf("logged %v, want one error line naming the model and field", lines)
+    }
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "math"
+    "os"
+    "runtime"
+    "runtime/debug"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Stores the memory governor knows about, as named in MEMORY_STORE_LIMITS
+var memoryStoreNames = []string{"contexts", "conversations", "request_log", "prompt_analytics", "response_cache", "batches"}
+
+// Cgroup files holding the container memory limit, v2 first
+var cgroupMemoryLimitFiles = []string{
+    "/sys/fs/cgroup/memory.max",
+    "/sys/fs/cgroup/memory/memory.limit_in_bytes",
+}
+
+// recordOverhead approximates the bytes of an entry besides its strings
+const recordOverhead = 128
+
+// MemoryStore is an in-memory store the governor can measure and shrink.
+// Sizes are estimates from string lengths plus a fixed per-entry overhead.
+type MemoryStore interface {
+    MemoryBytes() int64
+    // EvictTo drops least recently used entries until at most target bytes
+    // are held, and returns how many entries it dropped
+    EvictTo(target int64) int
+}
+
+// MemoryConfig sets the caps the governor enforces
+type MemoryConfig struct {
+    Limit       int64            // Container memory limit, 0 when unknown
+    LimitSource string           // Where Limit came from
+    Pressure    float64          // Fraction of Limit at which heap usage triggers aggressive eviction
+    MaxStores   int64            // Cap on all stores together, 0 for none
+    StoreLimits map[string]int64 // Per-store caps
+    Interval    time.Duration
+}
+
+// cgroupMemoryLimit reads the container memory limit, if there is one
+func cgroupMemoryLimit() (int64, string) {
+    for _, path := range cgroupMemoryLimitFiles {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            continue
+        }
+        v := strings.TrimSpace(string(data))
+        n, err := strconv.ParseInt(v, 10, 64)
+        // v2 reports "max" and v1 a huge number when there is no limit
+        if err != nil || n <= 0 || n >= math.MaxInt64/2 {
+            return 0, ""
+        }
+        return n, path
+    }
+    return 0, ""
+}
+
+// LoadMemoryConfig reads MEMORY_LIMIT_BYTES (default: the cgroup limit),
+// MEMORY_PRESSURE_FRACTION (default 0.85), MEMORY_STORES_MAX_BYTES (default
+// a quarter of the limit), MEMORY_STORE_LIMITS as comma-separated
+// store=bytes pairs, and MEMORY_CHECK_SECONDS (default 10)
+func LoadMemoryConfig() (MemoryConfig, error) {
+    cfg := MemoryConfig{Pressure: 0.85, StoreLimits: make(map[string]int64), Interval: 10 * time.Second}
+
+    cfg.Limit, cfg.LimitSource = cgroupMemoryLimit()
+    if v := os.Getenv("MEMORY_LIMIT_BYTES"); v != "" {
+        n, err := strconv.ParseInt(v, 10, 64)
+        if err != nil || n < 0 {
+            return cfg, fmt.Errorf("invalid MEMORY_LIMIT_BYTES %q", v)
+        }
+        cfg.Limit, cfg.LimitSource = n, "MEMORY_LIMIT_BYTES"
+    }
+    if v := os.Getenv("MEMORY_PRESSURE_FRACTION"); v != "" {
+        f, err := strconv.ParseFloat(v, 64)
+        if err != nil || f <= 0 || f >= 1 {
+            return cfg, fmt.Errorf("invalid MEMORY_PRESSURE_FRACTION %q", v)
+        }
+        cfg.Pressure = f
+    }
+
+    cfg.MaxStores = cfg.Limit / 4
+    if v := os.Getenv("MEMORY_STORES_MAX_BYTES"); v != "" {
+        n, err := strconv.ParseInt(v, 10, 64)
+        if err != nil || n < 0 {
+            return cfg, fmt.Errorf("invalid MEMORY_STORES_MAX_BYTES %q", v)
+        }
+        cfg.MaxStores = n
+    }
+
+    if v := os.Getenv("MEMORY_STORE_LIMITS"); v != "" {
+        for _, pair := range strings.Split(v, ",") {
+            name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+            n, err := strconv.ParseInt(value, 10, 64)
+            if !ok || err != nil || n < 1 || !containsString(memoryStoreNames, name) {
+                return cfg, fmt.Errorf("invalid MEMORY_STORE_LIMITS entry %q; stores are %s", pair, strings.Join(memoryStoreNames, ", "))
+            }
+            cfg.StoreLimits[name] = n
+        }
+    }
+
+    if v := os.Getenv("MEMORY_CHECK_SECONDS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return cfg, fmt.Errorf("invalid MEMORY_CHECK_SECONDS %q", v)
+        }
+        cfg.Interval = time.Duration(n) * time.Second
+    }
+    return cfg, nil
+}
+
+func containsString(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
+// StoreMemory is one store's row in the memory stats
+type StoreMemory struct {
+    Name       string `json:"name"`
+    Bytes      int64  `json:"bytes"`
+    LimitBytes int64  `json:"limit_bytes,omitempty"`
+    Evicted    int64  `json:"evicted"` // Entries dropped by the governor since startup
+}
+
+// MemoryStats is the governor's view for /admin/debug/stats
+type MemoryStats struct {
+    LimitBytes       int64         `json:"limit_bytes,omitempty"`
+    LimitSource      string        `json:"limit_source,omitempty"`
+    HeapBytes        uint64        `json:"heap_bytes"`
+    PressureFraction float64       `json:"pressure_fraction"`
+    UnderPressure    bool          `json:"under_pressure"`
+    PressureSince    *time.Time    `json:"pressure_since,omitempty"`
+    StoresBytes      int64         `json:"stores_bytes"`
+    StoresLimitBytes int64         `json:"stores_limit_bytes,omitempty"`
+    Stores           []StoreMemory `json:"stores"`
+}
+
+// MemoryGovernor keeps in-memory stores within their caps and sheds memory
+// when the heap nears the container limit
+type MemoryGovernor struct {
+    cfg      MemoryConfig
+    pressure atomic.Bool // Read on every request by optional features
+
+    mu            sync.Mutex
+    names         []string
+    stores        map[string]MemoryStore
+    evicted       map[string]int64
+    heap          uint64
+    pressureSince time.Time
+}
+
+func NewMemoryGovernor(cfg MemoryConfig) *MemoryGovernor {
+    return &MemoryGovernor{cfg: cfg, stores: make(map[string]MemoryStore), evicted: make(map[string]int64)}
+}
+
+// Register puts a store under the governor
+func (g *MemoryGovernor) Register(name string, s MemoryStore) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    g.names = append(g.names, name)
+    g.stores[name] = s
+}
+
+// UnderPressure reports whether memory-hungry optional features should stand
+// down. A nil governor never is.
+func (g *MemoryGovernor) UnderPressure() bool {
+    return g != nil && g.pressure.Load()
+}
+
+// Run checks memory use on every interval
+func (g *MemoryGovernor) Run() {
+    for range time.Tick(g.cfg.Interval) {
+        g.check(time.Now())
+    }
+}
+
+// evictLocked shrinks a store to target bytes and accounts for it
+func (g *MemoryGovernor) evictLocked(name string, target int64, reason string) {
+    if n := g.stores[name].EvictTo(target); n > 0 {
+        g.evicted[name] += int64(n)
+        metrics.Add("memory_evictions_total", float64(n), "store", name, "reason", reason)
+    }
+}
+
+func (g *MemoryGovernor) check(now time.Time) {
+    var ms runtime.MemStats
+    runtime.ReadMemStats(&ms)
+
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    g.heap = ms.HeapAlloc
+
+    // Per-store caps first, then the global cap shared out in proportion
+    for _, name := range g.names {
+        if limit := g.cfg.StoreLimits[name]; limit > 0 && g.stores[name].MemoryBytes() > limit {
+            g.evictLocked(name, limit, "store_limit")
+        }
+    }
+    if g.cfg.MaxStores > 0 {
+        sizes := make(map[string]int64)
+        var total int64
+        for _, name := range g.names {
+            sizes[name] = g.stores[name].MemoryBytes()
+            total += sizes[name]
+        }
+        if total > g.cfg.MaxStores {
+            for _, name := range g.names {
+                g.evictLocked(name, int64(float64(sizes[name])*float64(g.cfg.MaxStores)/float64(total)), "global_limit")
+            }
+        }
+    }
+
+    if g.cfg.Limit == 0 {
+        return
+    }
+    used := float64(ms.HeapAlloc) / float64(g.cfg.Limit)
+    switch {
+    case used >= g.cfg.Pressure:
+        if !g.pressure.Load() {
+            g.pressure.Store(true)
+            g.pressureSince = now
+            metrics.Inc("memory_pressure_events_total")
+            log.Printf("Memory pressure: heap %d bytes is %.0f%% of the %d byte limit; evicting and disabling the request log and response cache", ms.HeapAlloc, used*100, g.cfg.Limit)
+        }
+        // Halve every store on each check until the heap comes back down
+        for _, name := range g.names {
+            g.evictLocked(name, g.stores[name].MemoryBytes()/2, "pressure")
+        }
+        debug.FreeOSMemory()
+    case g.pressure.Load() && used < g.cfg.Pressure*0.9:
+        // Some headroom before re-enabling, so the features don't flap
+        g.pressure.Store(false)
+        log.Printf("Memory pressure cleared after %s: heap %d bytes is %.0f%% of the limit",
+            now.Sub(g.pressureSince).Round(time.Second), ms.HeapAlloc, used*100)
+    }
+    pressure := 0.0
+    if g.pressure.Load() {
+        pressure = 1
+    }
+    metrics.Set("memory_pressure", pressure)
+}
+
+// Stats reports per-store usage
+func (g *MemoryGovernor) Stats() MemoryStats {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    stats := MemoryStats{
+        LimitBytes:       g.cfg.Limit,
+        LimitSource:      g.cfg.LimitSource,
+        HeapBytes:        g.heap,
+        PressureFraction: g.cfg.Pressure,
+        UnderPressure:    g.pressure.Load(),
+        StoresLimitBytes: g.cfg.MaxStores,
+        Stores:           []StoreMemory{},
+    }
+    if stats.UnderPressure {
+        since := g.pressureSince
+        stats.PressureSince = &since
+    }
+    for _, name := range g.names {
+        bytes := g.stores[name].MemoryBytes()
+        stats.StoresBytes += bytes
+        stats.Stores = append(stats.Stores, StoreMemory{Name: name, Bytes: bytes, LimitBytes: g.cfg.StoreLimits[name], Evicted: g.evicted[name]})
+    }
+    return stats
+}
+
+// lruEvict drops entries, least recently used first, until the remaining
+// sizes add up to at most target. It returns the keys to drop.
+func lruEvict(sizes map[string]int64, lastUsed map[string]time.Time, target int64) []string {
+    var total int64
+    keys := make([]string, 0, len(sizes))
+    for key, size := range sizes {
+        total += size
+        keys = append(keys, key)
+    }
+    sort.Slice(keys, func(a, b int) bool { return lastUsed[keys[a]].Before(lastUsed[keys[b]]) })
+
+    var drop []string
+    for _, key := range keys {
+        if total <= target {
+            break
+        }
+        total -= sizes[key]
+        drop = append(drop, key)
+    }
+    return drop
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+    "fmt"
+    "runtime"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// soakStores are the stores the soak test fills, registered with a governor
+type soakStores struct {
+    governor      *MemoryGovernor
+    contexts      *ContextStore
+    conversations *ConversationStore
+    responses     *ResponseCache
+}
+
+func newSoakStores(cfg MemoryConfig) soakStores {
+    s := soakStores{governor: NewMemoryGovernor(cfg)}
+    s.contexts = NewContextStore(ContextStoreConfig{MaxBytes: 1 << 20, MaxPerOwner: 1 << 30, DefaultTTL: time.Hour, MaxTTL: time.Hour})
+    s.conversations = NewConversationStore(ConversationConfig{MaxPerOwner: 1 << 30, IdleTTL: time.Hour})
+    s.responses = NewResponseCache(ResponseCacheConfig{MaxEntries: 1 << 30, TTL: time.Hour}, s.governor)
+    s.governor.Register("contexts", s.contexts)
+    s.governor.Register("conversations", s.conversations)
+    s.governor.Register("response_cache", s.responses)
+    return s
+}
+
+// load is one worker's share of a round: a stored context, a conversation
+// turn and a cached response, each about 2KB
+func (s soakStores) load(t *testing.T, worker, round int, now time.Time) string {
+    owner := fmt.Sprintf("tenant:%d", worker)
+    text := strings.Repeat(fmt.Sprintf("%d/%d ", worker, round), 2048/8)
+    stored, err := s.contexts.Add(owner, text, time.Hour, now)
+    if err != nil {
+        t.Error(err)
+        return ""
+    }
+    conv := &Conversation{Owner: owner, Budget: TurnBudget{HistoryPolicy: historySlidingWindow}}
+    if err := s.conversations.Create(conv, now); err != nil {
+        t.Error(err)
+        return ""
+    }
+    s.conversations.appendTurn(conv, text[:1024], text[:1024], now)
+    s.responses.Put(fmt.Sprintf("%s/%d", owner, round), &GenerationResult{Text: text, ModelID: "m"}, now)
+    return stored.ID
+}
+
+func heapAlloc() uint64 {
+    runtime.GC()
+    var ms runtime.MemStats
+    runtime.ReadMemStats(&ms)
+    return ms.HeapAlloc
+}
+
+// Concurrent writers fill the stores far past their caps, round after
+// round. After every governor check each store is within its own cap and
+// all of them within the shared one, the newest entries survive, and the
+// heap stays flat however much was written.
+func TestMemoryCapsHoldUnderSustainedLoad(t *testing.T) {
+    if testing.Short() {
+        t.Skip("soak test")
+    }
+    const (
+        workers = 8
+        rounds  = 400
+        shared  = 2 << 20
+    )
+    limits := map[string]int64{"contexts": 512 << 10, "response_cache": 1 << 20}
+    s := newSoakStores(MemoryConfig{MaxStores: shared, StoreLimits: limits})
+
+    baseline := heapAlloc()
+    now := time.Now()
+    newest := make([]string, workers)
+    for round := 0; round < rounds; round++ {
+        now = now.Add(time.Second)
+        var wg sync.WaitGroup
+        for worker := 0; worker < workers; worker++ {
+            wg.Add(1)
+            go func(worker int) {
+                defer wg.Done()
+                newest[worker] = s.load(t, worker, round, now)
+            }(worker)
+        }
+        wg.Wait()
+        s.governor.check(now)
+
+        stats := s.governor.Stats()
+        if stats.StoresBytes > shared {
+            t.Fatalf("round %d: stores hold %d bytes, over the shared cap of %d", round, stats.StoresBytes, shared)
+        }
+        for _, store := range stats.Stores {
+            if limit := limits[store.Name]; limit > 0 && store.Bytes > limit {
+                t.Fatalf("round %d: %s holds %d bytes, over its cap of %d", round, store.Name, store.Bytes, limit)
+            }
+        }
+    }
+
+    // Written: about 6KB per worker per round, some 19MB in all
+    for _, store := range s.governor.Stats().Stores {
+        if store.Evicted == 0 {
+            t.Errorf("%s never had entries evicted", store.Name)
+        }
+    }
+    for worker, id := range newest {
+        if _, ok := s.contexts.Use(fmt.Sprintf("tenant:%d", worker), id, now); !ok {
+            t.Errorf("worker %d's newest context was evicted before older ones", worker)
+        }
+    }
+    if grown := int64(heapAlloc()) - int64(baseline); grown > 4*shared {
+        t.Errorf("heap grew by %d bytes, more than four times the %d byte cap", grown, shared)
+    }
+    runtime.KeepAlive(s) // The stores are measured above, not collected
+}
+
+// Under pressure every store is halved on each check and the response
+// cache stops serving, until the heap is back under the threshold with
+// headroom
+func TestMemoryPressureShedsAndRecovers(t *testing.T) {
+    s := newSoakStores(MemoryConfig{Pressure: 0.85})
+    now := time.Now()
+    for round := 0; round < 50; round++ {
+        s.load(t, 0, round, now)
+    }
+    before := s.responses.MemoryBytes()
+    if s.responses.Key("tenant:0", "m", []byte(`{}`)) == "" {
+        t.Fatal("cache bypassed before any pressure")
+    }
+
+    s.governor.cfg.Limit = 1 // Any heap is over it
+    s.governor.check(now)
+    if !s.governor.UnderPressure() {
+        t.Fatal("no pressure with the heap over the limit")
+    }
+    if after := s.responses.MemoryBytes(); after > before/2 {
+        t.Errorf("response cache holds %d bytes under pressure, want at most half of %d", after, before)
+    }
+    if key := s.responses.Key("tenant:0", "m", []byte(`{}`)); key != "" {
+        t.Error("response cache still keyed under pressure")
+    }
+    if stats := s.governor.Stats(); !stats.UnderPressure || stats.PressureSince == nil {
+        t.Errorf("stats %+v don't report the pressure", stats)
+    }
+
+    s.governor.cfg.Limit = 1 << 62
+    s.governor.check(now.Add(time.Minute))
+    if s.governor.UnderPressure() {
+        t.Fatal("pressure didn't clear with the heap far under the limit")
+    }
+    if s.responses.Key("tenant:0", "m", []byte(`{}`)) == "" {
+        t.Error("response cache still bypassed after the pressure cleared")
+    }
+}
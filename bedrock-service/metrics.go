@@ -0,0 +1,331 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Metrics is a minimal in-process registry of labelled counters, gauges and
+// duration histograms, exposed on GET /metrics in the Prometheus text format,
+// or in OpenMetrics to scrapers that ask for it. Only OpenMetrics carries
+// exemplars: a traced observation's trace and request IDs, so a dashboard
+// can jump from a latency bucket to a trace that landed in it.
+type Metrics struct {
+    mu         sync.Mutex
+    counters   map[string]map[string]float64    // metric name -> rendered label set -> value
+    gauges     map[string]bool                  // Names set with Set rather than Add
+    histograms map[string]map[string]*histogram // metric name -> rendered label set -> series
+    help       map[string]string
+}
+
+// latencyBuckets are the upper bounds, in seconds, of duration histograms
+var latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120}
+
+// histogram is one labelled series of a histogram
+type histogram struct {
+    counts    []uint64    // Per bucket, not cumulative; the last is +Inf
+    exemplars []*exemplar // The latest traced observation per bucket
+    sum       float64
+    count     uint64
+}
+
+// exemplar links an observation to the trace it was made in
+type exemplar struct {
+    labels string // Rendered trace_id and request_id
+    value  float64
+    at     time.Time
+}
+
+// metrics is the process-wide registry used by all handlers
+var metrics = NewMetrics()
+
+func init() {
+    metrics.Describe("bedrock_invoke_duration_seconds", "Bedrock call latency by model and outcome; a stream's ends once its response starts")
+    metrics.Describe("generate_request_duration_seconds", "Time taken to answer /generate requests")
+}
+
+// NewMetrics creates an empty registry
+func NewMetrics() *Metrics {
+    return &Metrics{
+        counters:   make(map[string]map[string]float64),
+        gauges:     make(map[string]bool),
+        histograms: make(map[string]map[string]*histogram),
+        help:       make(map[string]string),
+    }
+}
+
+// Describe registers the help text shown for a metric
+func (m *Metrics) Describe(name, help string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.help[name] = help
+}
+
+// Inc increments a counter; labels are given as alternating key/value pairs
+func (m *Metrics) Inc(name string, labels ...string) {
+    m.Add(name, 1, labels...)
+}
+
+// Add adds delta to a counter; labels are given as alternating key/value pairs
+func (m *Metrics) Add(name string, delta float64, labels ...string) {
+    key := renderLabels(labels)
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    series, ok := m.counters[name]
+    if !ok {
+        series = make(map[string]float64)
+        m.counters[name] = series
+    }
+    series[key] += delta
+}
+
+// Set sets a gauge to value; labels are given as alternating key/value pairs
+func (m *Metrics) Set(name string, value float64, labels ...string) {
+    key := renderLabels(labels)
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    series, ok := m.counters[name]
+    if !ok {
+        series = make(map[string]float64)
+        m.counters[name] = series
+    }
+    series[key] = value
+    m.gauges[name] = true
+}
+
+// Observe records a duration in seconds in a histogram; labels are given as
+// alternating key/value pairs. An observation made in a sampled span becomes
+// its bucket's exemplar.
+func (m *Metrics) Observe(ctx context.Context, name string, seconds float64, labels ...string) {
+    key := renderLabels(labels)
+    exemplarOf := exemplarLabels(ctx)
+    now := time.Now()
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    series, ok := m.histograms[name]
+    if !ok {
+        series = make(map[string]*histogram)
+        m.histograms[name] = series
+    }
+    h, ok := series[key]
+    if !ok {
+        h = &histogram{
+            counts:    make([]uint64, len(latencyBuckets)+1),
+            exemplars: make([]*exemplar, len(latencyBuckets)+1),
+        }
+        series[key] = h
+    }
+    bucket := sort.SearchFloat64s(latencyBuckets, seconds)
+    h.counts[bucket]++
+    h.sum += seconds
+    h.count++
+    if exemplarOf != "" {
+        h.exemplars[bucket] = &exemplar{labels: exemplarOf, value: seconds, at: now}
+    }
+}
+
+// Value returns the current value of a counter series (0 if never set)
+func (m *Metrics) Value(name string, labels ...string) float64 {
+    key := renderLabels(labels)
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return m.counters[name][key]
+}
+
+// labelEscaper escapes a label value for the exposition format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// renderLabels formats key/value pairs as a Prometheus label set, sorted by
+// key. It runs on every metric update, so it builds the set in one string.
+func renderLabels(labels []string) string {
+    if len(labels) < 2 {
+        return ""
+    }
+
+    // Label sets are small: an insertion sort of the key indexes, on the
+    // stack for up to eight pairs
+    var stack [8]int
+    order, size := stack[:0], 2
+    for i := 0; i+1 < len(labels); i += 2 {
+        order = append(order, i)
+        size += len(labels[i]) + len(labels[i+1]) + 4
+    }
+    for i := 1; i < len(order); i++ {
+        for j := i; j > 0 && labels[order[j]] < labels[order[j-1]]; j-- {
+            order[j], order[j-1] = order[j-1], order[j]
+        }
+    }
+
+    var sb strings.Builder
+    sb.Grow(size)
+    sb.WriteByte('{')
+    for n, i := range order {
+        if n > 0 {
+            sb.WriteByte(',')
+        }
+        sb.WriteString(labels[i])
+        sb.WriteString(`="`)
+        sb.WriteString(labelEscaper.Replace(labels[i+1])) // The value itself when nothing needs escaping
+        sb.WriteByte('"')
+    }
+    sb.WriteByte('}')
+    return sb.String()
+}
+
+// withLabel adds one rendered pair to a rendered label set
+func withLabel(key, pair string) string {
+    if key == "" {
+        return "{" + pair + "}"
+    }
+    return key[:len(key)-1] + "," + pair + "}"
+}
+
+// render formats every metric in the Prometheus text exposition format, or
+// in OpenMetrics, exemplars included
+func (m *Metrics) render(openMetrics bool) string {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    names := make([]string, 0, len(m.counters)+len(m.histograms))
+    for name := range m.counters {
+        names = append(names, name)
+    }
+    for name := range m.histograms {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var sb strings.Builder
+    for _, name := range names {
+        if series, ok := m.histograms[name]; ok {
+            m.renderHistogram(&sb, name, series, openMetrics)
+            continue
+        }
+        // OpenMetrics names a counter's family without its _total suffix,
+        // and only counters that have one can be typed as counters
+        family, metricType := name, "counter"
+        switch {
+        case m.gauges[name]:
+            metricType = "gauge"
+        case openMetrics && strings.HasSuffix(name, "_total"):
+            family = strings.TrimSuffix(name, "_total")
+        case openMetrics:
+            metricType = "unknown"
+        }
+        writeMeta(&sb, family, m.help[name], metricType)
+
+        series := m.counters[name]
+        keys := make([]string, 0, len(series))
+        for key := range series {
+            keys = append(keys, key)
+        }
+        sort.Strings(keys)
+        for _, key := range keys {
+            sb.WriteString(name)
+            sb.WriteString(key)
+            sb.WriteByte(' ')
+            writeFloat(&sb, series[key])
+            sb.WriteByte('\n')
+        }
+    }
+    if openMetrics {
+        sb.WriteString("# EOF\n")
+    }
+    return sb.String()
+}
+
+// renderHistogram writes a histogram's buckets, sum and count per series
+func (m *Metrics) renderHistogram(sb *strings.Builder, name string, series map[string]*histogram, openMetrics bool) {
+    writeMeta(sb, name, m.help[name], "histogram")
+
+    keys := make([]string, 0, len(series))
+    for key := range series {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+        h := series[key]
+        var cumulative uint64
+        for i, count := range h.counts {
+            cumulative += count
+            le := "+Inf"
+            if i < len(latencyBuckets) {
+                le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+            }
+            sb.WriteString(name)
+            sb.WriteString("_bucket")
+            sb.WriteString(withLabel(key, `le="`+le+`"`))
+            sb.WriteByte(' ')
+            sb.WriteString(strconv.FormatUint(cumulative, 10))
+            if ex := h.exemplars[i]; openMetrics && ex != nil {
+                sb.WriteString(" # ")
+                sb.WriteString(ex.labels)
+                sb.WriteByte(' ')
+                writeFloat(sb, ex.value)
+                sb.WriteByte(' ')
+                sb.WriteString(strconv.FormatFloat(float64(ex.at.UnixMilli())/1000, 'f', 3, 64))
+            }
+            sb.WriteByte('\n')
+        }
+        sb.WriteString(name)
+        sb.WriteString("_sum")
+        sb.WriteString(key)
+        sb.WriteByte(' ')
+        writeFloat(sb, h.sum)
+        sb.WriteByte('\n')
+        sb.WriteString(name)
+        sb.WriteString("_count")
+        sb.WriteString(key)
+        sb.WriteByte(' ')
+        sb.WriteString(strconv.FormatUint(h.count, 10))
+        sb.WriteByte('\n')
+    }
+}
+
+// writeMeta writes a family's HELP line, when it has help, and TYPE line
+func writeMeta(sb *strings.Builder, family, help, metricType string) {
+    if help != "" {
+        sb.WriteString("# HELP ")
+        sb.WriteString(family)
+        sb.WriteByte(' ')
+        sb.WriteString(help)
+        sb.WriteByte('\n')
+    }
+    sb.WriteString("# TYPE ")
+    sb.WriteString(family)
+    sb.WriteByte(' ')
+    sb.WriteString(metricType)
+    sb.WriteByte('\n')
+}
+
+// writeFloat writes a sample value the way %g formats it
+func writeFloat(sb *strings.Builder, v float64) {
+    var buf [32]byte
+    sb.Write(strconv.AppendFloat(buf[:0], v, 'g', -1, 64))
+}
+
+// mimeOpenMetrics is the exposition format exemplars need
+const mimeOpenMetrics = "application/openmetrics-text"
+
+// metricsFormats are offered to scrapers, the classic text format first
+var metricsFormats = []string{mimeText, mimeOpenMetrics}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Vary", "Accept")
+    if format, _ := negotiate(r.Header.Get("Accept"), metricsFormats); format == mimeOpenMetrics {
+        w.Header().Set("Content-Type", mimeOpenMetrics+"; version=1.0.0; charset=utf-8")
+        w.Write([]byte(metrics.render(true)))
+        return
+    }
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    w.Write([]byte(metrics.render(false)))
+}
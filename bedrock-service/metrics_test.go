@@ -0,0 +1,182 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "regexp"
+    "strings"
+    "testing"
+
+    "go.opentelemetry.io/otel/trace"
+)
+
+// sampledContext is a request context whose span is sampled
+func sampledContext(t *testing.T, traceID, requestID string) context.Context {
+    t.Helper()
+    tid, err := trace.TraceIDFromHex(traceID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    sc := trace.NewSpanContext(trace.SpanContextConfig{
+        TraceID:    tid,
+        SpanID:     trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+        TraceFlags: trace.FlagsSampled,
+    })
+    ctx := context.WithValue(context.Background(), requestIDKey{}, requestID)
+    return trace.ContextWithSpanContext(ctx, sc)
+}
+
+// scrape fetches /metrics with the given Accept header
+func scrape(t *testing.T, accept string) (string, string) {
+    t.Helper()
+    req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+    if accept != "" {
+        req.Header.Set("Accept", accept)
+    }
+    rec := httptest.NewRecorder()
+    metricsHandler(rec, req)
+    if rec.Code != http.StatusOK {
+        t.Fatalf("status %d", rec.Code)
+    }
+    return rec.Header().Get("Content-Type"), rec.Body.String()
+}
+
+func TestMetricsExemplars(t *testing.T) {
+    defer func(exported bool) { tracesExported = exported }(tracesExported)
+    tracesExported = true
+
+    const traceID = "0af7651916cd43dd8448eb211c80319c"
+    metrics.Observe(sampledContext(t, traceID, "req-exemplar"), "test_exemplar_duration_seconds", 0.3, "model", "m")
+    metrics.Observe(context.Background(), "test_exemplar_duration_seconds", 7, "model", "m")
+
+    contentType, body := scrape(t, "application/openmetrics-text; version=1.0.0")
+    if !strings.HasPrefix(contentType, mimeOpenMetrics) {
+        t.Fatalf("content type %q", contentType)
+    }
+    if !strings.HasSuffix(body, "# EOF\n") {
+        t.Error("OpenMetrics output doesn't end with # EOF")
+    }
+    if !strings.Contains(body, "# TYPE test_exemplar_duration_seconds histogram\n") {
+        t.Errorf("histogram not typed:\n%s", body)
+    }
+
+    exemplarLine := regexp.MustCompile(`(?m)^test_exemplar_duration_seconds_bucket\{model="m",le="0\.5"\} 1 # \{trace_id="` + traceID + `",request_id="req-exemplar"\} 0\.3 \d+\.\d{3}$`)
+    if !exemplarLine.MatchString(body) {
+        t.Errorf("no exemplar on the 0.5 bucket:\n%s", body)
+    }
+    // The untraced observation counts but leaves its bucket without one
+    if !strings.Contains(body, "test_exemplar_duration_seconds_bucket{model=\"m\",le=\"10\"} 2\n") {
+        t.Errorf("untraced observation has an exemplar or wasn't counted:\n%s", body)
+    }
+    if !strings.Contains(body, "test_exemplar_duration_seconds_count{model=\"m\"} 2\n") {
+        t.Errorf("count missing:\n%s", body)
+    }
+}
+
+func TestMetricsPlainTextHasNoExemplars(t *testing.T) {
+    defer func(exported bool) { tracesExported = exported }(tracesExported)
+    tracesExported = true
+
+    metrics.Observe(sampledContext(t, "4bf92f3577b34da6a3ce929d0e0e4736", "req-plain"), "test_plain_duration_seconds", 0.2)
+
+    for _, accept := range []string{"", "text/plain", "*/*"} {
+        contentType, body := scrape(t, accept)
+        if !strings.HasPrefix(contentType, "text/plain") {
+            t.Errorf("Accept %q: content type %q", accept, contentType)
+        }
+        if !strings.Contains(body, "test_plain_duration_seconds_bucket{le=\"0.25\"} 1\n") {
+            t.Errorf("Accept %q: bucket missing:\n%s", accept, body)
+        }
+        if strings.Contains(body, "# {") || strings.Contains(body, "# EOF") {
+            t.Errorf("Accept %q: OpenMetrics syntax in plain text:\n%s", accept, body)
+        }
+    }
+}
+
+func TestExemplarLabelsNeedExportedSampledSpans(t *testing.T) {
+    defer func(exported bool) { tracesExported = exported }(tracesExported)
+    sampled := sampledContext(t, "4bf92f3577b34da6a3ce929d0e0e4736", "req-1")
+
+    tracesExported = false
+    if labels := exemplarLabels(sampled); labels != "" {
+        t.Errorf("exemplar %s recorded while tracing is disabled", labels)
+    }
+
+    tracesExported = true
+    unsampled := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(sampled).WithTraceFlags(0))
+    if labels := exemplarLabels(unsampled); labels != "" {
+        t.Errorf("exemplar %s recorded for an unsampled span", labels)
+    }
+    if labels := exemplarLabels(context.Background()); labels != "" {
+        t.Errorf("exemplar %s recorded without a span", labels)
+    }
+    if labels, want := exemplarLabels(sampled), `{trace_id="4bf92f3577b34da6a3ce929d0e0e4736",request_id="req-1"}`; labels != want {
+        t.Errorf("exemplarLabels = %s, want %s", labels, want)
+    }
+}
+
+// benchmarkRegistry is a registry the size of a busy instance's: counters
+// and gauges over many label sets, and latency histograms with exemplars
+func benchmarkRegistry(b *testing.B) *Metrics {
+    b.Helper()
+    defer func(exported bool) { tracesExported = exported }(tracesExported)
+    tracesExported = true
+
+    m := NewMetrics()
+    m.Describe("generate_requests_total", "Requests to /generate by model and status")
+    m.Describe("bedrock_invoke_duration_seconds", "Bedrock call latency by model and outcome")
+    tid, _ := trace.TraceIDFromHex("0af7651916cd43dd8448eb211c80319c")
+    ctx := trace.ContextWithSpanContext(context.WithValue(context.Background(), requestIDKey{}, "req-bench"),
+        trace.NewSpanContext(trace.SpanContextConfig{TraceID: tid, SpanID: trace.SpanID{1}, TraceFlags: trace.FlagsSampled}))
+    for i := 0; i < 20; i++ {
+        model := fmt.Sprintf("vendor.model-%02d-v1:0", i)
+        for _, status := range []string{"200", "429", "500", "503"} {
+            m.Add("generate_requests_total", float64(i+1), "model", model, "status", status)
+        }
+        m.Set("model_available", 1, "model", model)
+        for _, outcome := range []string{"success", "throttled", "error"} {
+            for j := 0; j < 50; j++ {
+                m.Observe(ctx, "bedrock_invoke_duration_seconds", float64(j)*0.37, "model", model, "outcome", outcome)
+            }
+        }
+    }
+    return m
+}
+
+func BenchmarkMetricsRender(b *testing.B) {
+    m := benchmarkRegistry(b)
+    for _, format := range []struct {
+        name        string
+        openMetrics bool
+    }{{"text", false}, {"openmetrics", true}} {
+        b.Run(format.name, func(b *testing.B) {
+            b.ReportAllocs()
+            for i := 0; i < b.N; i++ {
+                m.render(format.openMetrics)
+            }
+        })
+    }
+}
+
+func TestRenderLabels(t *testing.T) {
+    for _, c := range []struct {
+        labels []string
+        want   string
+    }{
+        {nil, ""},
+        {[]string{"model"}, ""},
+        {[]string{"model", "m"}, `{model="m"}`},
+        {[]string{"status", "200", "model", "m", "code", ""}, `{code="",model="m",status="200"}`},
+        {[]string{"error", "a \"quoted\"\nC:\\path"}, `{error="a \"quoted\"\nC:\\path"}`},
+        {[]string{"model", "m", "odd"}, `{model="m"}`},
+        // More pairs than fit the sort's stack space
+        {[]string{"j", "9", "i", "8", "h", "7", "g", "6", "f", "5", "e", "4", "d", "3", "c", "2", "b", "1", "a", "0"},
+            `{a="0",b="1",c="2",d="3",e="4",f="5",g="6",h="7",i="8",j="9"}`},
+    } {
+        if got := renderLabels(c.labels); got != c.want {
+            t.Errorf("renderLabels(%q) = %s, want %s", c.labels, got, c.want)
+        }
+    }
+}
@@ -0,0 +1,155 @@
+package main
+
+import "strings"
+
+// Mistral models come in two formats. Mistral 7B, Mixtral and the first
+// Mistral Large take a prompt rendered with the [INST] template and answer
+// with outputs[0].text. Mistral Large 2407 and later take a messages array
+// and answer with choices[0].message.content. Both report a stop_reason next
+// to the text, and neither reports usage in the body.
+
+// buildMistralBody is buildRequestBody for the Mistral prompt format
+func buildMistralBody(p GenerationParams) map[string]interface{} {
+    system := p.withContextPrefix(p.systemPrompt(defaultSystemPrompt))
+    body := map[string]interface{}{
+        "prompt":      renderMistralPrompt(system, p.History, p.Prompt),
+        "max_tokens":  p.MaxTokens,
+        "temperature": *p.Temperature,
+    }
+    p.addSampling(body)
+    if len(p.StopSequences) > 0 {
+        body["stop"] = p.StopSequences
+    }
+    return body
+}
+
+// buildMistralChatBody is buildRequestBody for the Mistral chat format. It
+// takes no top_k or stop sequences.
+func buildMistralChatBody(p GenerationParams) map[string]interface{} {
+    system := p.withContextPrefix(p.systemPrompt(defaultSystemPrompt))
+    messages := make([]map[string]interface{}, 0, len(p.History)+2)
+    // An empty system prompt is left out, like on the messages API
+    if system != "" {
+        messages = append(messages, map[string]interface{}{"role": "system", "content": system})
+    }
+    messages = append(messages, p.messages()...)
+
+    body := map[string]interface{}{
+        "messages":    messages,
+        "max_tokens":  p.MaxTokens,
+        "temperature": *p.Temperature,
+    }
+    if p.TopP != nil {
+        body["top_p"] = *p.TopP
+    }
+    return body
+}
+
+// renderMistralPrompt lays out the turns with the Mistral instruct template:
+// each user turn in [INST] ... [/INST], each answer after it closed by </s>.
+// There is no system role, so the system prompt opens the first user turn.
+func renderMistralPrompt(system string, history []ChatMessage, prompt string) string {
+    var sb strings.Builder
+    sb.WriteString("<s>")
+    for _, m := range append(history[:len(history):len(history)], ChatMessage{Role: roleUser, Content: prompt}) {
+        if m.Role == roleAssistant {
+            sb.WriteString(" " + m.Content + "</s>")
+            continue
+        }
+        content := m.Content
+        if system != "" {
+            content, system = system+"\n\n"+content, ""
+        }
+        sb.WriteString("[INST] " + content + " [/INST]")
+    }
+    return sb.String()
+}
+
+// mistralOutput returns the first output of a Mistral response, in either
+// format: outputs[0] or choices[0]
+func mistralOutput(response map[string]interface{}) (map[string]interface{}, bool) {
+    outputs, ok := response["outputs"].([]interface{})
+    if !ok {
+        outputs, ok = response["choices"].([]interface{})
+    }
+    if !ok || len(outputs) == 0 {
+        return nil, false
+    }
+    output, ok := outputs[0].(map[string]interface{})
+    return output, ok
+}
+
+// mistralText reads the generated text of a Mistral response
+func mistralText(response map[string]interface{}) (string, bool) {
+    output, ok := mistralOutput(response)
+    if !ok {
+        return "", false
+    }
+    if text, ok := output["text"].(string); ok {
+        return strings.TrimLeft(text, " "), true
+    }
+    message, ok := output["message"].(map[string]interface{})
+    if !ok {
+        return "", false
+    }
+    text, ok := message["content"].(string)
+    return text, ok
+}
+
+// mistralFormat is the Mistral prompt format
+type mistralFormat struct{}
+
+func (mistralFormat) buildBody(p GenerationParams) map[string]interface{} {
+    return buildMistralBody(p)
+}
+
+func (mistralFormat) probeBody(prompt string) map[string]interface{} {
+    return map[string]interface{}{
+        "prompt":     renderMistralPrompt("", nil, prompt),
+        "max_tokens": 10,
+    }
+}
+
+func (mistralFormat) provider() string { return providerMistral }
+
+func (mistralFormat) stopReason(response map[string]interface{}) string {
+    output, _ := mistralOutput(response)
+    raw, _ := output["stop_reason"].(string)
+    return raw
+}
+
+func (mistralFormat) parseResponse(response map[string]interface{}, p GenerationParams, result *GenerationResult) bool {
+    // Mistral doesn't say which stop sequence matched; usage comes from the
+    // headers
+    text, ok := mistralText(response)
+    result.Text = text
+    return ok
+}
+
+// mistralChatFormat is the Mistral chat format. Its responses read like the
+// prompt format's, except that caller stop sequences are applied here.
+type mistralChatFormat struct{ mistralFormat }
+
+func (mistralChatFormat) buildBody(p GenerationParams) map[string]interface{} {
+    return buildMistralChatBody(p)
+}
+
+func (mistralChatFormat) probeBody(prompt string) map[string]interface{} {
+    return map[string]interface{}{
+        "messages":   []map[string]string{{"role": "user", "content": prompt}},
+        "max_tokens": 10,
+    }
+}
+
+func (mistralChatFormat) parseResponse(response map[string]interface{}, p GenerationParams, result *GenerationResult) bool {
+    result.Sampling.TopK = nil
+    text, ok := mistralText(response)
+    if !ok {
+        return false
+    }
+    result.Text, result.StopSequence = cutAtStopSequence(text, p.StopSequences)
+    if result.StopSequence != "" {
+        result.FinishReason = finishStopSequence
+    }
+    return true
+}
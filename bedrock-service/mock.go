@@ -0,0 +1,77 @@
+package main
+
+import (
+    "encoding/base64"
+    "fmt"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// mockModelName is reported as the model for mocked responses
+const mockModelName = "mock"
+
+// mockChunkSize is the rough size of the deltas a mocked stream is split into
+const mockChunkSize = 20
+
+// mockModeEnabled reports whether MOCK_MODE lets every caller use X-Mock-Response
+func mockModeEnabled() bool {
+    enabled, _ := strconv.ParseBool(os.Getenv("MOCK_MODE"))
+    return enabled
+}
+
+// mockResponse returns the canned text requested with X-Mock-Response. The
+// header is only honoured in MOCK_MODE or for keys whose policy sets
+// allow_mock; X-Mock-Response-Encoding: base64 allows multi-line text.
+func mockResponse(r *http.Request) (string, bool, error) {
+    text := r.Header.Get("X-Mock-Response")
+    if text == "" {
+        return "", false, nil
+    }
+    if !mockModeEnabled() && !principalFrom(r.Context()).Policy.AllowMock {
+        return "", true, fmt.Errorf("mock responses are not enabled for this API key")
+    }
+    if strings.EqualFold(r.Header.Get("X-Mock-Response-Encoding"), "base64") {
+        decoded, err := base64.StdEncoding.DecodeString(text)
+        if err != nil {
+            return "", true, fmt.Errorf("X-Mock-Response is not valid base64")
+        }
+        text = string(decoded)
+    }
+    return text, true, nil
+}
+
+// mockGeneration builds the result a model would have returned, with token
+// usage estimated since nothing was really invoked
+func mockGeneration(text string, p GenerationParams) *GenerationResult {
+    return &GenerationResult{
+        Text:            text,
+        ModelName:       mockModelName,
+        ModelID:         mockModelName,
+        Account:         mockModelName,
+        InputTokens:     estimateTokens(p.systemPrompt(defaultSystemPrompt)) + estimateTokens(p.ContextPrefix) + estimateTokens(p.Prompt),
+        OutputTokens:    estimateTokens(text),
+        TokensEstimated: true,
+        FinishReason:    finishCompleted,
+        Sampling:        p.sampling(),
+        Mocked:          true,
+    }
+}
+
+// mockDeltas splits canned text into stream deltas at word boundaries
+func mockDeltas(text string) []string {
+    var deltas []string
+    var current strings.Builder
+    for _, word := range strings.SplitAfter(text, " ") {
+        current.WriteString(word)
+        if current.Len() >= mockChunkSize {
+            deltas = append(deltas, current.String())
+            current.Reset()
+        }
+    }
+    if current.Len() > 0 {
+        deltas = append(deltas, current.String())
+    }
+    return deltas
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "os/signal"
+    "reflect"
+    "sort"
+    "strings"
+    "syscall"
+    "time"
+
+    "gopkg.in/yaml.v3"
+)
+
+// The model registry is built from MODELS_CONFIG_PATH when it is set, so
+// models can be added and retired without a release. The file is a catalog
+// document in JSON or YAML, the same form /admin/catalog/validate checks:
+//
+//    models:
+//      - id: anthropic.claude-sonnet-4-20250514-v1:0
+//        name: Claude Sonnet 4
+//        api_type: messages
+//        context_window: 200000
+//        priority: 1
+//        defaults: {max_tokens: 4000, temperature: 0.5}
+//    aliases:
+//      smart: [anthropic.claude-sonnet-4-20250514-v1:0]
+//
+// An image model, which only /images uses, sets modality: image and one of
+// the image api_types, see images.go. A JSON document is read as YAML, which
+// it is a subset of, so both report problems by line.
+
+// builtinCatalog names the registry used when no models config is loaded
+const builtinCatalog = "built-in"
+
+// Fields a models config entry may set. Unknown ones are rejected by line
+// rather than silently ignored.
+var (
+    modelConfigFields   = map[string]bool{"id": true, "name": true, "api_type": true, "modality": true, "context_window": true, "max_output_tokens": true, "priority": true, "vision": true, "documents": true, "defaults": true}
+    modelDefaultsFields = map[string]bool{"max_tokens": true, "temperature": true, "top_p": true, "top_k": true}
+)
+
+// ModelDefaults are sampling parameters a model uses when a request leaves
+// them unset, in place of the service-wide defaults
+type ModelDefaults struct {
+    MaxTokens   int      `json:"max_tokens,omitempty" yaml:"max_tokens"`
+    Temperature *float64 `json:"temperature,omitempty" yaml:"temperature"`
+    TopP        *float64 `json:"top_p,omitempty" yaml:"top_p"`
+    TopK        *int     `json:"top_k,omitempty" yaml:"top_k"`
+}
+
+// problems checks the defaults against the ranges requests are held to
+func (d *ModelDefaults) problems(field string) []FieldError {
+    var problems []FieldError
+    if d.MaxTokens < 0 {
+        problems = append(problems, FieldError{Field: field + ".max_tokens", Message: "must be at least 1"})
+    }
+    if d.Temperature != nil && (*d.Temperature < 0 || *d.Temperature > 1) {
+        problems = append(problems, FieldError{Field: field + ".temperature", Message: "must be between 0 and 1"})
+    }
+    if d.TopP != nil && (*d.TopP <= 0 || *d.TopP > 1) {
+        problems = append(problems, FieldError{Field: field + ".top_p", Message: "must be greater than 0 and at most 1"})
+    }
+    if d.TopK != nil && (*d.TopK < 1 || *d.TopK > maxTopK) {
+        problems = append(problems, FieldError{Field: field + ".top_k", Message: fmt.Sprintf("must be between 1 and %d", maxTopK)})
+    }
+    return problems
+}
+
+// withModelDefaults fills in model's defaults for the sampling parameters
+// the caller left unset
+func (p GenerationParams) withModelDefaults(model ModelInfo) GenerationParams {
+    d := model.Defaults
+    if d.MaxTokens != 0 && p.defaulted.maxTokens {
+        p.MaxTokens = d.MaxTokens
+    }
+    if d.Temperature != nil && p.defaulted.temperature {
+        p.Temperature = d.Temperature
+    }
+    if p.TopP == nil {
+        p.TopP = d.TopP
+    }
+    if p.TopK == nil {
+        p.TopK = d.TopK
+    }
+    // A fallback may accept fewer output tokens than the caller asked of
+    // the chain's head
+    if model.MaxOutputTokens > 0 && p.MaxTokens > model.MaxOutputTokens {
+        p.MaxTokens = model.MaxOutputTokens
+    }
+    return p
+}
+
+// modelInfo is the registry entry for a canonical catalog model. Messages
+// models are invoked through Converse, like the built-in ones.
+func (m CatalogModel) modelInfo() ModelInfo {
+    info := ModelInfo{
+        ID:              m.ID,
+        Name:            m.Name,
+        API:             APIType(m.APIType),
+        Modality:        Modality(m.Modality),
+        Converse:        m.APIType == string(apiMessages),
+        ContextWindow:   m.ContextWindow,
+        MaxOutputTokens: m.MaxOutput,
+        Vision:          m.Vision,
+        Documents:       m.Documents,
+    }
+    if m.Defaults != nil {
+        info.Defaults = *m.Defaults
+    }
+    return info
+}
+
+// ModelConfig is a loaded models config
+type ModelConfig struct {
+    Models  []ModelInfo         // In fallback order
+    Aliases map[string][]string // Normalized alias to model IDs, most preferred first
+    Source  string              // The path loaded, or "built-in"
+}
+
+// LoadModelConfig reads the registry from MODELS_CONFIG_PATH. Unset, or set
+// to a file that doesn't exist, a copy of the built-in config is used.
+func LoadModelConfig(builtin ModelConfig) (ModelConfig, error) {
+    path := os.Getenv("MODELS_CONFIG_PATH")
+    if path == "" {
+        builtin.Models = append([]ModelInfo(nil), builtin.Models...)
+        return builtin, nil
+    }
+    data, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        log.Printf("MODELS_CONFIG_PATH %s not found, using the %d built-in models", path, len(builtin.Models))
+        builtin.Models = append([]ModelInfo(nil), builtin.Models...)
+        return builtin, nil
+    }
+    if err != nil {
+        return ModelConfig{}, fmt.Errorf("error reading MODELS_CONFIG_PATH: %v", err)
+    }
+
+    doc, lines, err := parseModelConfig(data)
+    if err != nil {
+        return ModelConfig{}, fmt.Errorf("invalid MODELS_CONFIG_PATH %s: %v", path, err)
+    }
+    if problems := canonicalCatalog(&doc); len(problems) > 0 {
+        messages := make([]string, len(problems))
+        for i, problem := range problems {
+            messages[i] = fmt.Sprintf("line %d: %s %s", lines.find(problem.Field), problem.Field, problem.Message)
+        }
+        return ModelConfig{}, fmt.Errorf("invalid MODELS_CONFIG_PATH %s: %s", path, strings.Join(messages, "; "))
+    }
+
+    loaded := ModelConfig{Models: make([]ModelInfo, len(doc.Models)), Aliases: doc.Aliases, Source: path}
+    for i, model := range doc.Models {
+        loaded.Models[i] = model.modelInfo()
+    }
+    log.Printf("Loaded %d models and %d aliases from %s", len(loaded.Models), len(loaded.Aliases), path)
+    return loaded, nil
+}
+
+// fieldLines maps the fields of a models config, as canonicalCatalog names
+// them, to the lines they are on
+type fieldLines map[string]int
+
+// find is the line of field, or of the nearest enclosing field that has one
+func (lines fieldLines) find(field string) int {
+    for {
+        if line, ok := lines[field]; ok {
+            return line
+        }
+        dot := strings.LastIndex(field, ".")
+        if dot < 0 {
+            return 1
+        }
+        field = field[:dot]
+    }
+}
+
+// parseModelConfig decodes a models config, rejecting unknown and repeated
+// fields, and records where each field is
+func parseModelConfig(data []byte) (CatalogDocument, fieldLines, error) {
+    var doc CatalogDocument
+    var root yaml.Node
+    if err := yaml.Unmarshal(data, &root); err != nil {
+        return doc, nil, err
+    }
+    if len(root.Content) == 0 {
+        return doc, nil, fmt.Errorf("the file is empty")
+    }
+    top := root.Content[0]
+    if top.Kind != yaml.MappingNode {
+        return doc, nil, fmt.Errorf("line %d: expected an object with a models list", top.Line)
+    }
+
+    lines := fieldLines{"models": top.Line}
+    var models, aliases *yaml.Node
+    for i := 0; i+1 < len(top.Content); i += 2 {
+        key, value := top.Content[i], top.Content[i+1]
+        var node **yaml.Node
+        switch key.Value {
+        case "models":
+            node = &models
+        case "aliases":
+            node = &aliases
+        default:
+            return doc, nil, fmt.Errorf("line %d: unknown field %q", key.Line, key.Value)
+        }
+        if *node != nil {
+            return doc, nil, fmt.Errorf("line %d: %s is set twice", key.Line, key.Value)
+        }
+        *node, lines[key.Value] = value, key.Line
+    }
+    if aliases != nil {
+        if err := parseAliases(aliases, &doc, lines); err != nil {
+            return doc, nil, err
+        }
+    }
+    if models == nil {
+        return doc, lines, nil // canonicalCatalog reports the missing list
+    }
+    if models.Kind != yaml.SequenceNode {
+        return doc, nil, fmt.Errorf("line %d: models must be a list", models.Line)
+    }
+
+    doc.Models = make([]CatalogModel, len(models.Content))
+    for i, entry := range models.Content {
+        field := fmt.Sprintf("models[%d]", i)
+        lines[field] = entry.Line
+        if err := checkConfigFields(entry, field, modelConfigFields, lines); err != nil {
+            return doc, nil, err
+        }
+        for j := 0; j+1 < len(entry.Content); j += 2 {
+            if entry.Content[j].Value == "defaults" {
+                if err := checkConfigFields(entry.Content[j+1], field+".defaults", modelDefaultsFields, lines); err != nil {
+                    return doc, nil, err
+                }
+            }
+        }
+        if err := entry.Decode(&doc.Models[i]); err != nil {
+            var typeErr *yaml.TypeError
+            if errors.As(err, &typeErr) {
+                // Each error reads "line N: cannot unmarshal ..."
+                messages := make([]string, len(typeErr.Errors))
+                for k, message := range typeErr.Errors {
+                    at, rest, _ := strings.Cut(message, ": ")
+                    messages[k] = at + ": " + field + ": " + rest
+                }
+                return doc, nil, errors.New(strings.Join(messages, "; "))
+            }
+            return doc, nil, fmt.Errorf("%s: %v", field, err)
+        }
+    }
+    return doc, lines, nil
+}
+
+// parseAliases decodes the aliases of a models config, recording the line of
+// each alias and group entry
+func parseAliases(node *yaml.Node, doc *CatalogDocument, lines fieldLines) error {
+    if node.Kind != yaml.MappingNode {
+        return fmt.Errorf("line %d: aliases must be an object", node.Line)
+    }
+    doc.Aliases = make(map[string][]string, len(node.Content)/2)
+    for i := 0; i+1 < len(node.Content); i += 2 {
+        key, group := node.Content[i], node.Content[i+1]
+        field := "aliases." + key.Value
+        if first, dup := lines[field]; dup {
+            return fmt.Errorf("line %d: %s is already set on line %d", key.Line, field, first)
+        }
+        lines[field] = key.Line
+        if group.Kind != yaml.SequenceNode {
+            return fmt.Errorf("line %d: %s must be a list of model IDs", group.Line, field)
+        }
+        ids := make([]string, len(group.Content))
+        for j, id := range group.Content {
+            if id.Kind != yaml.ScalarNode {
+                return fmt.Errorf("line %d: %s[%d] must be a model ID", id.Line, field, j)
+            }
+            ids[j] = id.Value
+            lines[fmt.Sprintf("%s[%d]", field, j)] = id.Line
+        }
+        doc.Aliases[key.Value] = ids
+    }
+    return nil
+}
+
+// checkConfigFields checks that node is an object of known, distinct fields
+// and records their lines
+func checkConfigFields(node *yaml.Node, field string, known map[string]bool, lines fieldLines) error {
+    if node.Kind != yaml.MappingNode {
+        return fmt.Errorf("line %d: %s must be an object", node.Line, field)
+    }
+    for i := 0; i+1 < len(node.Content); i += 2 {
+        key := node.Content[i]
+        name := field + "." + key.Value
+        if !known[key.Value] {
+            return fmt.Errorf("line %d: %s is not a known field", key.Line, name)
+        }
+        if first, dup := lines[name]; dup {
+            return fmt.Errorf("line %d: %s is already set on line %d", key.Line, name, first)
+        }
+        lines[name] = key.Line
+    }
+    return nil
+}
+
+// ModelsReload summarizes a reload of the models config
+type ModelsReload struct {
+    Source   string      `json:"source"`
+    Models   int         `json:"models"`
+    Added    []string    `json:"added"`
+    Removed  []string    `json:"removed"`
+    Modified []string    `json:"modified"` // Kept models whose name, API type, context window, priority or defaults changed
+    Aliases  []string    `json:"aliases_changed"` // Aliases added, removed or given a different group
+    Diff     CatalogDiff `json:"diff"`
+}
+
+// ReloadModels re-reads the models config and swaps it in whole. A config
+// that fails validation is rejected and the registry is left as it was.
+// Kept models keep their availability and breakers; new ones are checked
+// before requests can select them. Models an admin disabled stay disabled.
+// Requests already running finish against the models they started with,
+// since they work from a snapshot.
+func (bc *BedrockClient) ReloadModels(cfg ProbeConfig) (ModelsReload, error) {
+    bc.reloadMu.Lock()
+    defer bc.reloadMu.Unlock()
+
+    config, err := LoadModelConfig(bc.builtin)
+    if err != nil {
+        log.Printf("Models config reload rejected, keeping the current models: %v", err)
+        return ModelsReload{}, err
+    }
+    loaded := config.Models
+    candidate := make([]CatalogModel, len(loaded))
+    for i, model := range loaded {
+        candidate[i] = catalogEntry(model)
+    }
+
+    reload := ModelsReload{Source: config.Source, Models: len(loaded), Added: []string{}, Removed: []string{}, Modified: []string{}, Aliases: []string{}}
+    now := time.Now()
+    bc.modelsMu.Lock()
+    reload.Diff = diffCatalog(bc.availableModels, candidate)
+    for alias := range bc.aliases {
+        if _, kept := config.Aliases[alias]; !kept {
+            reload.Aliases = append(reload.Aliases, alias)
+        }
+    }
+    for alias, group := range config.Aliases {
+        if !reflect.DeepEqual(bc.aliases[alias], group) {
+            reload.Aliases = append(reload.Aliases, alias)
+        }
+    }
+    sort.Strings(reload.Aliases)
+
+    modified := make(map[string]bool)
+    for _, rename := range reload.Diff.Renamed {
+        modified[rename.ID] = true
+    }
+    for _, changes := range [][]CatalogChange{reload.Diff.PriorityChanges, reload.Diff.APITypeChanges, reload.Diff.LimitChanges, reload.Diff.MetadataChanges} {
+        for _, change := range changes {
+            modified[change.ID] = true
+        }
+    }
+
+    previous := make(map[string]ModelInfo, len(bc.availableModels))
+    for _, model := range bc.availableModels {
+        previous[normalizeModelID(model.ID)] = model
+    }
+    var added []ModelInfo
+    for i := range loaded {
+        model := &loaded[i]
+        was, kept := previous[model.ID]
+        if !kept {
+            added = append(added, *model)
+            reload.Added = append(reload.Added, model.ID)
+            bc.events.Record(RegistryEvent{Time: now, ModelID: model.ID, Type: registryEventReload, From: "", To: "configured", Cause: "models config reloaded"})
+            continue
+        }
+        delete(previous, model.ID)
+        model.Available, model.ProbeStatus, model.Disabled = was.Available, was.ProbeStatus, was.Disabled
+        model.ProfileFallback = was.ProfileFallback
+        if modified[model.ID] || !reflect.DeepEqual(was.Defaults, model.Defaults) {
+            reload.Modified = append(reload.Modified, model.ID)
+        }
+    }
+    for _, model := range bc.availableModels {
+        if _, removed := previous[normalizeModelID(model.ID)]; removed {
+            reload.Removed = append(reload.Removed, model.ID)
+            delete(bc.breakers, model.ID)
+            bc.events.Record(RegistryEvent{Time: now, ModelID: model.ID, Type: registryEventReload, From: "configured", To: "removed", Cause: "models config reloaded"})
+        }
+    }
+
+    bc.availableModels, bc.aliases, bc.catalogSource = loaded, config.Aliases, config.Source
+    bc.invalidateModelsListing()
+    bc.modelsMu.Unlock()
+
+    logCatalogDiff("reload", reload.Diff)
+    if len(added) > 0 {
+        if cfg.Skip {
+            bc.modelsMu.Lock()
+            for i := range bc.availableModels {
+                if bc.availableModels[i].ProbeStatus == "" {
+                    bc.availableModels[i].Available, bc.availableModels[i].ProbeStatus = true, probeSkipped
+                }
+            }
+            bc.invalidateModelsListing()
+            bc.modelsMu.Unlock()
+        } else {
+            bc.applyProbes(added, bc.checkModels(added, cfg), cfg)
+        }
+    }
+    return reload, nil
+}
+
+// modelsReloadHandler reloads the models config. A config that fails
+// validation is rejected with its problems and the current models stay.
+func modelsReloadHandler(bc *BedrockClient, probes ProbeConfig) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        reload, err := bc.ReloadModels(probes)
+        if err != nil {
+            writeError(w, r, http.StatusUnprocessableEntity, ErrCodeValidation, err.Error())
+            return
+        }
+        writeJSON(w, r, reload)
+    }
+}
+
+// reloadModelsOnSignal reloads the models config on every SIGHUP
+func reloadModelsOnSignal(bc *BedrockClient, probes ProbeConfig) {
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    for range hup {
+        log.Println("SIGHUP received, reloading the models config")
+        bc.ReloadModels(probes) // A rejected config is logged
+    }
+}
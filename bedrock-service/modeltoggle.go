@@ -0,0 +1,75 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// SetModelEnabled turns a model off for selection, keeping it in the
+// registry, or back on. Probes and breakers keep tracking a disabled model;
+// its availability is only used again once it's re-enabled. Disabling lasts
+// until re-enabled or the process restarts. It reports false when no model
+// has the ID.
+func (bc *BedrockClient) SetModelEnabled(id string, enabled bool, reason string) (modelListing, bool) {
+    now := time.Now()
+    bc.modelsMu.Lock()
+    defer bc.invalidateModelsListing()
+    defer bc.modelsMu.Unlock()
+
+    for i := range bc.availableModels {
+        model := &bc.availableModels[i]
+        if normalizeModelID(model.ID) != normalizeModelID(id) {
+            continue
+        }
+        if model.Disabled == !enabled {
+            return bc.modelListingLocked(*model, now), true
+        }
+        from, to := "enabled", "disabled"
+        if enabled {
+            from, to = to, from
+        }
+        if reason == "" {
+            reason = "set by an admin"
+        }
+        model.Disabled = !enabled
+        log.Printf("Model %s (%s) %s by an admin: %s", model.Name, model.ID, to, reason)
+        bc.events.Record(RegistryEvent{Time: now, ModelID: model.ID, Type: registryEventAdmin, From: from, To: to, Cause: reason})
+        return bc.modelListingLocked(*model, now), true
+    }
+    return modelListing{}, false
+}
+
+// modelToggleHandler handles PATCH /admin/models/{id} with
+// {"enabled": false, "reason": "..."}, or "enabled": true to undo it, and
+// returns the model's /models entry
+func modelToggleHandler(bc *BedrockClient) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req struct {
+            Enabled *bool  `json:"enabled"`
+            Reason  string `json:"reason"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+        if req.Enabled == nil {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: "enabled is required",
+                Fields:  []FieldError{{Field: "enabled", Message: "is required"}},
+            })
+            return
+        }
+
+        listing, ok := bc.SetModelEnabled(mux.Vars(r)["id"], *req.Enabled, req.Reason)
+        if !ok {
+            writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Model not found")
+            return
+        }
+        writeJSON(w, r, listing)
+    }
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+    "unicode"
+    "unicode/utf8"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+    "github.com/aws/smithy-go"
+)
+
+// POST /moderate screens text with a guardrail through ApplyGuardrail,
+// without invoking a model, so a client can turn input away before any
+// tokens are spent on it. This SDK version has no ApplyGuardrail operation,
+// so the call is a REST request signed with the account's credentials.
+// Text longer than one call takes is screened in chunks and the
+// assessments are merged.
+
+// Guardrail sources
+const (
+    guardrailSourceInput  = "INPUT"  // Text from a user, screened before a model sees it
+    guardrailSourceOutput = "OUTPUT" // Text a model produced
+)
+
+const (
+    maxModerateChars          = 200000  // Longest text /moderate screens
+    maxGuardrailResponseBytes = 4 << 20 // Bounds a decoded ApplyGuardrail response
+)
+
+// moderationChunkChars reads MODERATION_CHUNK_CHARS, the most characters
+// sent to ApplyGuardrail at once. Guardrails are billed in text units of
+// 1,000 characters and bound how many one call takes, so it defaults to a
+// conservative 10 units.
+func moderationChunkChars() (int, error) {
+    v := os.Getenv("MODERATION_CHUNK_CHARS")
+    if v == "" {
+        return 10000, nil
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil || n < 1000 {
+        return 0, fmt.Errorf("invalid MODERATION_CHUNK_CHARS %q: must be at least 1000", v)
+    }
+    return n, nil
+}
+
+// ModerateRequest is the body of POST /moderate
+type ModerateRequest struct {
+    Text             string `json:"text"`
+    Source           string `json:"source,omitempty"`            // INPUT, the default, or OUTPUT
+    GuardrailID      string `json:"guardrail_id,omitempty"`      // Instead of GUARDRAIL_ID, see guardrail.go
+    GuardrailVersion string `json:"guardrail_version,omitempty"` // Its version number or DRAFT
+}
+
+// GuardrailHit is one policy match in a guardrail assessment
+type GuardrailHit struct {
+    Name       string `json:"name,omitempty"`       // Denied topic or regex name
+    Type       string `json:"type,omitempty"`       // Topic type, filter category, word list or PII entity type
+    Match      string `json:"match,omitempty"`      // The text that matched a word, PII or regex policy
+    Confidence string `json:"confidence,omitempty"` // Content filters only
+    Action     string `json:"action"`               // BLOCKED or ANONYMIZED
+    Chunk      int    `json:"chunk"`                // The chunk of the text it was found in, from 0
+}
+
+// GuardrailAssessment is every policy match across the chunks of a text
+type GuardrailAssessment struct {
+    Topics         []GuardrailHit `json:"topics"`
+    ContentFilters []GuardrailHit `json:"content_filters"`
+    Words          []GuardrailHit `json:"words"`
+    PII            []GuardrailHit `json:"pii"`
+    Regexes        []GuardrailHit `json:"regexes"`
+}
+
+// ModerateResponse is the result of POST /moderate
+type ModerateResponse struct {
+    Action     string              `json:"action"` // GUARDRAIL_INTERVENED when any chunk was, otherwise NONE
+    Intervened bool                `json:"intervened"`
+    Blocked    bool                `json:"blocked"` // A policy blocked the text rather than masking it
+    Output     string              `json:"output"`  // The guardrail's blocked message when blocked, otherwise the text with matches masked
+    Assessment GuardrailAssessment `json:"assessment"`
+    Chunks     int                 `json:"chunks"`
+    Guardrail  Guardrail           `json:"guardrail"`
+    Usage      map[string]int      `json:"usage,omitempty"` // Policy units consumed, summed across chunks
+}
+
+// applyGuardrailOutput is the part of an ApplyGuardrail response read
+type applyGuardrailOutput struct {
+    Action  string `json:"action"`
+    Outputs []struct {
+        Text string `json:"text"`
+    } `json:"outputs"`
+    Assessments []struct {
+        TopicPolicy *struct {
+            Topics []struct{ Name, Type, Action string } `json:"topics"`
+        } `json:"topicPolicy"`
+        ContentPolicy *struct {
+            Filters []struct{ Type, Confidence, Action string } `json:"filters"`
+        } `json:"contentPolicy"`
+        WordPolicy *struct {
+            CustomWords      []struct{ Match, Action string }       `json:"customWords"`
+            ManagedWordLists []struct{ Match, Type, Action string } `json:"managedWordLists"`
+        } `json:"wordPolicy"`
+        SensitiveInformationPolicy *struct {
+            PIIEntities []struct{ Match, Type, Action string } `json:"piiEntities"`
+            Regexes     []struct{ Name, Match, Action string } `json:"regexes"`
+        } `json:"sensitiveInformationPolicy"`
+    } `json:"assessments"`
+    Usage map[string]int `json:"usage"`
+}
+
+// add merges one chunk's assessments, reporting whether any of its matches
+// blocked the text
+func (a *GuardrailAssessment) add(out *applyGuardrailOutput, chunk int) (blocked bool) {
+    hit := func(hits *[]GuardrailHit, h GuardrailHit) {
+        h.Chunk = chunk
+        *hits = append(*hits, h)
+        blocked = blocked || h.Action == "BLOCKED"
+    }
+    for _, assessment := range out.Assessments {
+        if p := assessment.TopicPolicy; p != nil {
+            for _, t := range p.Topics {
+                hit(&a.Topics, GuardrailHit{Name: t.Name, Type: t.Type, Action: t.Action})
+            }
+        }
+        if p := assessment.ContentPolicy; p != nil {
+            for _, f := range p.Filters {
+                hit(&a.ContentFilters, GuardrailHit{Type: f.Type, Confidence: f.Confidence, Action: f.Action})
+            }
+        }
+        if p := assessment.WordPolicy; p != nil {
+            for _, w := range p.CustomWords {
+                hit(&a.Words, GuardrailHit{Match: w.Match, Action: w.Action})
+            }
+            for _, w := range p.ManagedWordLists {
+                hit(&a.Words, GuardrailHit{Match: w.Match, Type: w.Type, Action: w.Action})
+            }
+        }
+        if p := assessment.SensitiveInformationPolicy; p != nil {
+            for _, e := range p.PIIEntities {
+                hit(&a.PII, GuardrailHit{Match: e.Match, Type: e.Type, Action: e.Action})
+            }
+            for _, r := range p.Regexes {
+                hit(&a.Regexes, GuardrailHit{Name: r.Name, Match: r.Match, Action: r.Action})
+            }
+        }
+    }
+    return blocked
+}
+
+// chunkText splits text into chunks of at most limit runes. A chunk ends after
+// whitespace where there is some in its second half, so words, and the
+// addresses and numbers PII policies look for, aren't cut in two.
+func chunkText(text string, limit int) []string {
+    var chunks []string
+    for utf8.RuneCountInString(text) > limit {
+        end, runes, lastSpace := 0, 0, -1
+        for i, r := range text {
+            if runes == limit {
+                end = i
+                break
+            }
+            if unicode.IsSpace(r) && runes >= limit/2 {
+                lastSpace = i + utf8.RuneLen(r)
+            }
+            runes++
+        }
+        if lastSpace > 0 {
+            end = lastSpace
+        }
+        chunks = append(chunks, text[:end])
+        text = text[end:]
+    }
+    return append(chunks, text)
+}
+
+// runtimeURL is the account's runtime endpoint
+func (a *Account) runtimeURL() string {
+    if a.endpoint != "" {
+        return strings.TrimRight(a.endpoint, "/")
+    }
+    return "https://bedrock-runtime." + a.Region + ".amazonaws.com"
+}
+
+// applyGuardrail sends one signed ApplyGuardrail request
+func (a *Account) applyGuardrail(ctx context.Context, g Guardrail, body []byte) ([]byte, error) {
+    target := a.runtimeURL() + "/guardrail/" + url.PathEscape(g.ID) + "/version/" + url.PathEscape(g.Version) + "/apply"
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    creds, err := a.signing.Credentials.Retrieve(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("error retrieving credentials for account %s: %v", a.Name, err)
+    }
+    sum := sha256.Sum256(body)
+    if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(sum[:]), "bedrock", a.Region, time.Now()); err != nil {
+        return nil, fmt.Errorf("error signing ApplyGuardrail request: %v", err)
+    }
+
+    var client aws.HTTPClient = http.DefaultClient
+    if a.signing.HTTPClient != nil {
+        client = a.signing.HTTPClient
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    data, err := io.ReadAll(io.LimitReader(resp.Body, maxGuardrailResponseBytes))
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, guardrailAPIError(resp, data)
+    }
+    return data, nil
+}
+
+// guardrailAPIError turns a failed ApplyGuardrail response into the error
+// the SDK would have returned, so throttles shift accounts and failures are
+// classified like any other Bedrock call's
+func guardrailAPIError(resp *http.Response, body []byte) error {
+    code, _, _ := strings.Cut(resp.Header.Get("X-Amzn-ErrorType"), ":")
+    var payload struct {
+        Message string `json:"message"`
+    }
+    json.Unmarshal(body, &payload)
+    message := aws.String(payload.Message)
+    switch code {
+    case "ThrottlingException":
+        return &types.ThrottlingException{Message: message}
+    case "ServiceQuotaExceededException":
+        return &types.ServiceQuotaExceededException{Message: message}
+    case "ResourceNotFoundException":
+        return &types.ResourceNotFoundException{Message: message}
+    case "ValidationException":
+        return &types.ValidationException{Message: message}
+    case "AccessDeniedException":
+        return &types.AccessDeniedException{Message: message}
+    case "InternalServerException":
+        return &types.InternalServerException{Message: message}
+    }
+    if code == "" {
+        code = "HTTP" + strconv.Itoa(resp.StatusCode)
+    }
+    return &smithy.GenericAPIError{Code: code, Message: payload.Message}
+}
+
+// ApplyGuardrail screens text through a scheduled account, shifting and
+// retrying like InvokeModel
+func (p *AccountPool) ApplyGuardrail(ctx context.Context, origin Origin, g Guardrail, source, text string) (*applyGuardrailOutput, error) {
+    if err := origin.check(); err != nil {
+        return nil, err
+    }
+    body, err := json.Marshal(map[string]interface{}{
+        "source":  source,
+        "content": []map[string]interface{}{{"text": map[string]string{"text": text}}},
+    })
+    if err != nil {
+        return nil, err
+    }
+    tried := make(map[*Account]bool)
+    retries := 0
+    for {
+        account := p.pick(tried)
+        if account == nil {
+            return nil, fmt.Errorf("no Bedrock accounts configured")
+        }
+        tried[account] = true
+
+        data, err := account.applyGuardrail(ctx, g, body)
+        if err == nil {
+            metrics.Inc("bedrock_account_invocations_total", "account", account.Name, "origin", string(origin), "outcome", "success")
+            var out applyGuardrailOutput
+            if err := json.Unmarshal(data, &out); err != nil {
+                return nil, fmt.Errorf("error parsing response: %v", err)
+            }
+            return &out, nil
+        }
+        if p.retryAfter(ctx, origin, "guardrail:"+g.ID, account, err, tried, &retries) {
+            continue
+        }
+        return nil, err
+    }
+}
+
+// Moderate screens text with the guardrail, chunk by chunk
+func (bc *BedrockClient) Moderate(ctx context.Context, g Guardrail, source, text string, chunkChars int) (*ModerateResponse, error) {
+    chunks := chunkText(text, chunkChars)
+    result := &ModerateResponse{
+        Action:    "NONE",
+        Chunks:    len(chunks),
+        Guardrail: g,
+        Assessment: GuardrailAssessment{
+            Topics:         []GuardrailHit{},
+            ContentFilters: []GuardrailHit{},
+            Words:          []GuardrailHit{},
+            PII:            []GuardrailHit{},
+            Regexes:        []GuardrailHit{},
+        },
+    }
+    var output strings.Builder
+    var blockedMessage string
+    for i, chunk := range chunks {
+        out, err := bc.accounts.ApplyGuardrail(ctx, originUser, g, source, chunk)
+        if err != nil {
+            return nil, err
+        }
+        for unit, n := range out.Usage {
+            if result.Usage == nil {
+                result.Usage = make(map[string]int)
+            }
+            result.Usage[unit] += n
+        }
+        blocked := result.Assessment.add(out, i)
+        if out.Action != "GUARDRAIL_INTERVENED" {
+            output.WriteString(chunk)
+            continue
+        }
+        result.Action, result.Intervened = out.Action, true
+        var masked strings.Builder
+        for _, o := range out.Outputs {
+            masked.WriteString(o.Text)
+        }
+        output.WriteString(masked.String())
+        // The first blocked message stands for the whole text
+        if blocked && !result.Blocked {
+            result.Blocked, blockedMessage = true, masked.String()
+        }
+    }
+    result.Output = output.String()
+    if result.Blocked {
+        result.Output = blockedMessage
+    }
+    return result, nil
+}
+
+func moderateHandler(bc *BedrockClient) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req ModerateRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+
+        var problems []FieldError
+        switch n := utf8.RuneCountInString(req.Text); {
+        case strings.TrimSpace(req.Text) == "":
+            problems = append(problems, FieldError{Field: "text", Message: "is required"})
+        case n > maxModerateChars:
+            problems = append(problems, FieldError{Field: "text", Message: fmt.Sprintf("has %d characters, more than %d", n, maxModerateChars)})
+        }
+        source := strings.ToUpper(strings.TrimSpace(req.Source))
+        if source == "" {
+            source = guardrailSourceInput
+        }
+        if source != guardrailSourceInput && source != guardrailSourceOutput {
+            problems = append(problems, FieldError{Field: "source", Message: "must be INPUT or OUTPUT"})
+        }
+        if len(problems) > 0 {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{Code: ErrCodeValidation, Message: "Invalid moderation request", Fields: problems})
+            return
+        }
+
+        guardrail, apiErr := bc.guardrail.resolve(req.GuardrailID, req.GuardrailVersion, false)
+        if apiErr != nil {
+            writeAPIError(w, r, http.StatusBadRequest, *apiErr)
+            return
+        }
+        if guardrail == nil {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: "No guardrail to moderate with",
+                Fields:  []FieldError{{Field: "guardrail_id", Message: "is required when GUARDRAIL_ID is not configured"}},
+            })
+            return
+        }
+        chunkChars, err := moderationChunkChars()
+        if err != nil {
+            logErrorf(r.Context(), "Moderation is misconfigured: %v", err)
+            writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "Moderation is misconfigured on this server")
+            return
+        }
+
+        result, err := bc.Moderate(r.Context(), *guardrail, source, req.Text, chunkChars)
+        if err != nil {
+            logErrorf(r.Context(), "Error applying guardrail %s: %v", guardrail.ID, err)
+            status, apiErr := moderationErrorResponse(err)
+            writeAPIError(w, r, status, apiErr)
+            return
+        }
+        metrics.Inc("moderation_requests_total", "source", source, "action", result.Action)
+        logInfof(r.Context(), "Moderated %d chunk(s) with guardrail %s: %s", result.Chunks, guardrail.ID, result.Action)
+        writeJSON(w, r, result)
+    }
+}
+
+// moderationErrorResponse maps an ApplyGuardrail failure to a response
+func moderationErrorResponse(err error) (int, APIError) {
+    class := classifyError(err)
+    switch {
+    case isCancelled(err):
+        return statusClientClosedRequest, APIError{Code: ErrCodeCancelled, Message: "The request was cancelled before moderation finished"}
+    case class == "ResourceNotFoundException":
+        return http.StatusNotFound, APIError{Code: ErrCodeNotFound, Message: "Unknown guardrail or guardrail version", ErrorClass: class}
+    case class == "ValidationException":
+        return http.StatusBadRequest, APIError{Code: ErrCodeValidation, Message: "The guardrail rejected the request", ErrorClass: class}
+    case isThrottle(err):
+        return http.StatusTooManyRequests, APIError{Code: ErrCodeRateLimited, Message: "Guardrail capacity is exhausted; retry shortly", ErrorClass: class}
+    }
+    return http.StatusInternalServerError, APIError{Code: ErrCodeInternal, Message: "Error applying guardrail", ErrorClass: class}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// Media types the service can produce
+const (
+    mimeJSON     = "application/json"
+    mimeText     = "text/plain"
+    mimeMarkdown = "text/markdown"
+    mimeSSE      = "text/event-stream"
+    mimeNDJSON   = "application/x-ndjson"
+)
+
+// generateFormats and streamFormats are offered in order of preference; the
+// first one is used when the caller sends no Accept header
+var (
+    generateFormats = []string{mimeJSON, mimeText, mimeMarkdown}
+    streamFormats   = []string{mimeSSE, mimeNDJSON}
+)
+
+// mediaRange is one entry of an Accept header
+type mediaRange struct {
+    typ, subtype string
+    q            float64
+}
+
+func parseAccept(header string) []mediaRange {
+    var ranges []mediaRange
+    for _, part := range strings.Split(header, ",") {
+        fields := strings.Split(part, ";")
+        typ, subtype, ok := strings.Cut(strings.ToLower(strings.TrimSpace(fields[0])), "/")
+        if !ok || typ == "" || subtype == "" {
+            continue
+        }
+        q := 1.0
+        for _, param := range fields[1:] {
+            name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+            if strings.EqualFold(name, "q") {
+                if parsed, err := strconv.ParseFloat(value, 64); err == nil && parsed >= 0 && parsed <= 1 {
+                    q = parsed
+                }
+            }
+        }
+        ranges = append(ranges, mediaRange{typ: typ, subtype: subtype, q: q})
+    }
+    return ranges
+}
+
+// quality returns the q-value the most specific matching range gives offer,
+// or -1 when nothing matches
+func quality(ranges []mediaRange, offer string) float64 {
+    typ, subtype, _ := strings.Cut(offer, "/")
+    best, specificity := -1.0, -1
+    for _, mr := range ranges {
+        s := -1
+        switch {
+        case mr.typ == typ && mr.subtype == subtype:
+            s = 2
+        case mr.typ == typ && mr.subtype == "*":
+            s = 1
+        case mr.typ == "*" && mr.subtype == "*":
+            s = 0
+        }
+        if s > specificity {
+            best, specificity = mr.q, s
+        }
+    }
+    return best
+}
+
+// negotiate picks the offered media type the Accept header prefers most. It
+// reports false when the caller accepts none of them.
+func negotiate(accept string, offered []string) (string, bool) {
+    if strings.TrimSpace(accept) == "" {
+        return offered[0], true
+    }
+    ranges := parseAccept(accept)
+    if len(ranges) == 0 {
+        return offered[0], true
+    }
+
+    chosen, chosenQ := "", 0.0
+    for _, offer := range offered {
+        if q := quality(ranges, offer); q > chosenQ {
+            chosen, chosenQ = offer, q
+        }
+    }
+    return chosen, chosen != ""
+}
+
+// notAcceptable rejects a request whose Accept header matches no format we produce
+func notAcceptable(w http.ResponseWriter, r *http.Request, offered []string) {
+    writeError(w, r, http.StatusNotAcceptable, ErrCodeValidation,
+        fmt.Sprintf("Unsupported Accept header; this endpoint produces %s", strings.Join(offered, ", ")))
+}
+
+// generateWriter renders /generate results and errors in the negotiated
+// format so the handler has a single code path for all of them
+type generateWriter struct {
+    w      http.ResponseWriter
+    r      *http.Request
+    format string
+}
+
+func newGenerateWriter(w http.ResponseWriter, r *http.Request, format string) *generateWriter {
+    w.Header().Set("Vary", "Accept")
+    return &generateWriter{w: w, r: r, format: format}
+}
+
+// Error writes an error response. Text formats get the code and message as
+// plain text so callers can still tell failures apart by status.
+func (g *generateWriter) Error(status int, apiErr APIError) {
+    if g.format == mimeJSON {
+        writeAPIError(g.w, g.r, status, apiErr)
+        return
+    }
+    requestRecordFrom(g.r.Context()).failed(apiErr)
+    localizeError(g.w, g.r, &apiErr)
+    if apiErr.RetryAfterSeconds > 0 {
+        g.w.Header().Set("Retry-After", strconv.Itoa(apiErr.RetryAfterSeconds))
+    }
+    g.w.Header().Set("X-Error-Code", apiErr.Code)
+    g.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    g.w.WriteHeader(status)
+    fmt.Fprintf(g.w, "%s: %s\n", apiErr.Code, apiErr.Message)
+}
+
+// Errorf is Error for envelopes that only carry a code and message
+func (g *generateWriter) Errorf(status int, code, message string) {
+    g.Error(status, APIError{Code: code, Message: message})
+}
+
+// Result writes a successful generation. Text formats carry the metadata in
+// headers and the generated text as the whole body.
+func (g *generateWriter) Result(resp GenerateResponse, result *GenerationResult) {
+    if g.format == mimeJSON {
+        writeJSON(g.w, g.r, resp)
+        return
+    }
+
+    h := g.w.Header()
+    h.Set("Content-Type", g.format+"; charset=utf-8")
+    h.Set("X-Model-Used", resp.ModelUsed)
+    if resp.Meta != nil {
+        h.Set("X-Model-ID", resp.Meta.ModelID)
+        h.Set("X-Footer-Applied", strconv.FormatBool(resp.Meta.FooterApplied))
+    }
+    if result.InputTokens > 0 || result.OutputTokens > 0 {
+        h.Set("X-Input-Tokens", strconv.Itoa(result.InputTokens))
+        h.Set("X-Output-Tokens", strconv.Itoa(result.OutputTokens))
+    }
+    if result.Mocked {
+        h.Set("X-Mocked", "true")
+    }
+    if resp.FinishReason != "" {
+        h.Set("X-Finish-Reason", resp.FinishReason)
+    }
+    if resp.Filtered {
+        h.Set("X-Filtered", "true")
+        h.Set("X-Filter-Category", resp.FilterCategory)
+    }
+    if resp.Refused {
+        h.Set("X-Refusal-Category", resp.RefusalCategory)
+    }
+    if len(resp.Links) > 0 {
+        h.Set("X-Link-Count", strconv.Itoa(len(resp.Links)))
+    }
+    g.w.WriteHeader(http.StatusOK)
+    g.w.Write([]byte(resp.Response))
+}
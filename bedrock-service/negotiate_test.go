@@ -0,0 +1,90 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "net/http"
+    "testing"
+)
+
+func TestNegotiate(t *testing.T) {
+    for _, c := range []struct {
+        accept   string
+        generate string // Empty when nothing offered is acceptable
+        stream   string
+    }{
+        {"", mimeJSON, mimeSSE},
+        {"application/json", mimeJSON, ""},
+        {"application/x-ndjson", "", mimeNDJSON},
+        {"text/event-stream", "", mimeSSE},
+        {"Application/JSON", mimeJSON, ""},
+
+        // Wildcards take the first offer they cover
+        {"*/*", mimeJSON, mimeSSE},
+        {"text/*", mimeText, mimeSSE},
+        {"application/*", mimeJSON, mimeNDJSON},
+
+        // q-values
+        {"text/markdown;q=0.9, text/plain;q=0.5", mimeMarkdown, ""},
+        {"text/plain; q=0.8, application/json; q=0.8", mimeJSON, ""}, // Ties go to the preferred offer
+        {"application/x-ndjson, text/event-stream;q=0.1", "", mimeNDJSON},
+        {"application/json;q=0, */*", mimeText, mimeSSE},
+        {"text/*;q=0.5, text/plain;q=0", mimeMarkdown, mimeSSE}, // The most specific range wins
+        {"text/event-stream;q=0.2, */*;q=0.1", mimeJSON, mimeSSE},
+        {"*/*;q=0", "", ""},
+        {"application/json;q=2", mimeJSON, ""}, // An invalid q counts as 1
+        {"application/json;level=1;q=0.5", mimeJSON, ""},
+
+        // Nothing usable to go on: the default
+        {"nonsense", mimeJSON, mimeSSE},
+        {" , ;q=1", mimeJSON, mimeSSE},
+
+        {"image/png", "", ""},
+        {"text/html, application/xml;q=0.9", "", ""},
+    } {
+        for _, offer := range []struct {
+            name    string
+            offered []string
+            want    string
+        }{{"generate", generateFormats, c.generate}, {"stream", streamFormats, c.stream}} {
+            got, ok := negotiate(c.accept, offer.offered)
+            if ok != (offer.want != "") || got != offer.want {
+                t.Errorf("%s, Accept %q: %q, %v; want %q", offer.name, c.accept, got, ok, offer.want)
+            }
+        }
+    }
+}
+
+// A stream asked for in a format it doesn't come in is refused before any
+// model is invoked, and the other way round
+func TestE2ENotAcceptable(t *testing.T) {
+    const model = "amazon.nova-micro-v1:0"
+    for _, c := range []struct {
+        path, accept string
+    }{
+        {"/generate/stream", "application/json"},
+        {"/generate/stream", "text/plain, text/html;q=0.5"},
+        {"/generate", "text/event-stream"},
+        {"/generate", "application/x-ndjson"},
+    } {
+        data, _ := json.Marshal(map[string]interface{}{"prompt": "Hi", "models": []string{model}})
+        req, _ := http.NewRequest(http.MethodPost, serviceURL+c.path, bytes.NewReader(data))
+        req.Header.Set("Content-Type", mimeJSON)
+        req.Header.Set("Accept", c.accept)
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if resp.StatusCode != http.StatusNotAcceptable {
+            t.Errorf("%s with Accept %q: status %d, want 406", c.path, c.accept, resp.StatusCode)
+        }
+        var envelope errorEnvelope
+        decode(t, resp, &envelope)
+        if envelope.Error.Code != ErrCodeValidation || envelope.Error.Message == "" {
+            t.Errorf("%s with Accept %q: error %+v", c.path, c.accept, envelope.Error)
+        }
+    }
+    if calls := fake.Calls(model); len(calls) != 0 {
+        t.Errorf("model invoked %d times", len(calls))
+    }
+}
@@ -0,0 +1,88 @@
+package main
+
+// Amazon Nova models take messages whose content is an array of blocks, an
+// optional system array, and the sampling parameters in inferenceConfig.
+// They answer with output.message.content, a top-level stopReason and usage
+// in camel case.
+
+// novaText wraps text as the content blocks Nova takes
+func novaText(text string) []map[string]string {
+    return []map[string]string{{"text": text}}
+}
+
+// buildNovaBody is buildRequestBody for the Nova messages format
+func buildNovaBody(p GenerationParams) map[string]interface{} {
+    messages := make([]map[string]interface{}, 0, len(p.History)+1)
+    for _, m := range p.History {
+        messages = append(messages, map[string]interface{}{"role": m.Role, "content": novaText(m.Content)})
+    }
+    messages = append(messages, map[string]interface{}{"role": "user", "content": novaText(p.Prompt)})
+
+    config := map[string]interface{}{
+        "maxTokens":   p.MaxTokens,
+        "temperature": *p.Temperature,
+    }
+    if p.TopP != nil {
+        config["topP"] = *p.TopP
+    }
+    if p.TopK != nil {
+        config["topK"] = *p.TopK
+    }
+    if len(p.StopSequences) > 0 {
+        config["stopSequences"] = p.StopSequences
+    }
+
+    body := map[string]interface{}{
+        "schemaVersion":   "messages-v1",
+        "messages":        messages,
+        "inferenceConfig": config,
+    }
+    // An empty system prompt is left out, like on the messages API
+    if system := p.withContextPrefix(p.systemPrompt(defaultSystemPrompt)); system != "" {
+        body["system"] = novaText(system)
+    }
+    return body
+}
+
+// novaFormat is the Amazon Nova messages format
+type novaFormat struct{}
+
+func (novaFormat) buildBody(p GenerationParams) map[string]interface{} {
+    return buildNovaBody(p)
+}
+
+func (novaFormat) probeBody(prompt string) map[string]interface{} {
+    return map[string]interface{}{
+        "schemaVersion":   "messages-v1",
+        "messages":        []map[string]interface{}{{"role": "user", "content": novaText(prompt)}},
+        "inferenceConfig": map[string]interface{}{"maxTokens": 10},
+    }
+}
+
+func (novaFormat) provider() string { return providerAmazonNova }
+
+func (novaFormat) stopReason(response map[string]interface{}) string {
+    return rawFinishReason(response)
+}
+
+func (novaFormat) parseResponse(response map[string]interface{}, p GenerationParams, result *GenerationResult) bool {
+    // Nova doesn't say which stop sequence matched
+    if usage, ok := response["usage"].(map[string]interface{}); ok {
+        if n, ok := usage["inputTokens"].(float64); ok {
+            result.InputTokens = int(n)
+        }
+        if n, ok := usage["outputTokens"].(float64); ok {
+            result.OutputTokens = int(n)
+        }
+    }
+    output, _ := response["output"].(map[string]interface{})
+    message, _ := output["message"].(map[string]interface{})
+    content, ok := message["content"].([]interface{})
+    if !ok || len(content) == 0 {
+        return false
+    }
+    block, _ := content[0].(map[string]interface{})
+    text, ok := block["text"].(string)
+    result.Text = text
+    return ok
+}
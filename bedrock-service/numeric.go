@@ -0,0 +1,439 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "math"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+)
+
+// Kinds of numeric claims the post-check recomputes
+const (
+    numericArithmetic = "arithmetic" // 12 + 30 = 42
+    numericPercentage = "percentage" // 15% of 80 is 12
+    numericConversion = "conversion" // 5 km = 3.1 miles
+)
+
+// Bounds on the post-check, so its cost doesn't grow with the response:
+// only the start of the text is scanned and only so many claims are kept.
+// The regular expressions run in linear time.
+const (
+    numericScanLimit = 32 << 10
+    maxNumericClaims = 50
+)
+
+// NumericCheck is one claim found in a response and its recomputed value
+type NumericCheck struct {
+    Claim    string  `json:"claim"`
+    Kind     string  `json:"kind"`
+    Stated   float64 `json:"stated"`
+    Computed float64 `json:"computed"`
+    Pass     bool    `json:"pass"`
+}
+
+// numericUnit is an entry of the built-in conversion table. A value in the
+// unit is value*scale+offset in its dimension's base unit.
+type numericUnit struct {
+    dimension string
+    scales    []float64 // More than one when the name is ambiguous, like gallon
+    offset    float64   // Temperatures only
+}
+
+// numericUnits maps the names a unit is written with to its conversion.
+// Abbreviations that double as ordinary words or magnitudes (in, K, C, F)
+// are left out.
+var numericUnits = func() map[string]numericUnit {
+    units := make(map[string]numericUnit)
+    add := func(u numericUnit, names ...string) {
+        for _, name := range names {
+            units[name] = u
+        }
+    }
+    add(numericUnit{dimension: "length", scales: []float64{1000}}, "km", "kilometer", "kilometers", "kilometre", "kilometres")
+    add(numericUnit{dimension: "length", scales: []float64{1}}, "m", "meter", "meters", "metre", "metres")
+    add(numericUnit{dimension: "length", scales: []float64{0.01}}, "cm", "centimeter", "centimeters", "centimetre", "centimetres")
+    add(numericUnit{dimension: "length", scales: []float64{0.001}}, "mm", "millimeter", "millimeters", "millimetre", "millimetres")
+    add(numericUnit{dimension: "length", scales: []float64{1609.344}}, "mi", "mile", "miles")
+    add(numericUnit{dimension: "length", scales: []float64{0.9144}}, "yd", "yard", "yards")
+    add(numericUnit{dimension: "length", scales: []float64{0.3048}}, "ft", "foot", "feet")
+    add(numericUnit{dimension: "length", scales: []float64{0.0254}}, "inch", "inches")
+    add(numericUnit{dimension: "mass", scales: []float64{1}}, "kg", "kilogram", "kilograms")
+    add(numericUnit{dimension: "mass", scales: []float64{0.001}}, "g", "gram", "grams")
+    add(numericUnit{dimension: "mass", scales: []float64{0.45359237}}, "lb", "lbs", "pound", "pounds")
+    add(numericUnit{dimension: "mass", scales: []float64{0.028349523125}}, "oz", "ounce", "ounces")
+    add(numericUnit{dimension: "volume", scales: []float64{1}}, "l", "L", "liter", "liters", "litre", "litres")
+    add(numericUnit{dimension: "volume", scales: []float64{0.001}}, "ml", "mL", "milliliter", "milliliters", "millilitre", "millilitres")
+    add(numericUnit{dimension: "volume", scales: []float64{3.785411784, 4.54609}}, "gal", "gallon", "gallons") // US or imperial
+    add(numericUnit{dimension: "temperature", scales: []float64{1}}, "°C", "℃", "degrees Celsius", "Celsius", "celsius")
+    add(numericUnit{dimension: "temperature", scales: []float64{5.0 / 9}, offset: -160.0 / 9}, "°F", "℉", "degrees Fahrenheit", "Fahrenheit", "fahrenheit")
+    add(numericUnit{dimension: "temperature", scales: []float64{1}, offset: -273.15}, "kelvin")
+    return units
+}()
+
+// numericNumber is a number as written: an optional currency symbol, then
+// digits with any grouping and decimal separators, ending in a digit so
+// sentence punctuation isn't taken in
+const numericNumber = `[$€£¥]?\d(?:[\d.,']*\d)?`
+
+var (
+    numericOperand = regexp.MustCompile(`^[-−]?` + numericNumber)
+    numericStep    = regexp.MustCompile(`(\s*[+\-−×*/÷]\s*|\s+x\s+)(` + numericNumber + `)`)
+
+    numericArithmeticPattern = regexp.MustCompile(
+        `([-−]?` + numericNumber + `(?:(?:\s*[+\-−×*/÷]\s*|\s+x\s+)` + numericNumber + `)+)\s*(?:=|≈)\s*([-−]?` + numericNumber + `)`)
+    numericPercentagePattern = regexp.MustCompile(
+        `(` + numericNumber + `)(?:\s?%|\s+percent)\s+of\s+(` + numericNumber + `)\s*(?:=|≈|(?i:is|equals|comes to|would be))\s*(?:(?i:about|approximately|roughly|around)\s+)?(` + numericNumber + `)`)
+    numericConversionPattern = regexp.MustCompile(
+        `([-−]?` + numericNumber + `)\s?(` + numericUnitPattern() + `)\s*(?:=|≈|(?i:is equal to|is|equals))\s*(?:(?i:about|approximately|roughly|around)\s+|~\s?)?([-−]?` + numericNumber + `)\s?(` + numericUnitPattern() + `)`)
+)
+
+// numericUnitPattern matches any unit name, longest first so "miles" isn't
+// read as "mi"
+func numericUnitPattern() string {
+    names := make([]string, 0, len(numericUnits))
+    for name := range numericUnits {
+        names = append(names, regexp.QuoteMeta(name))
+    }
+    sort.Slice(names, func(a, b int) bool {
+        if len(names[a]) != len(names[b]) {
+            return len(names[a]) > len(names[b])
+        }
+        return names[a] < names[b]
+    })
+    return strings.Join(names, "|")
+}
+
+// Digit grouping conventions a number may be written in. Numbers with
+// separators are often readable either way ("1,234"), so a claim is read
+// under each convention its numbers fit and only fails if it fails under all.
+const (
+    numbersDotDecimal   = iota // 1,234.5
+    numbersCommaDecimal        // 1.234,5
+)
+
+var numericGroupedInteger = map[int]*regexp.Regexp{
+    numbersDotDecimal:   regexp.MustCompile(`^\d{1,3}(?:,\d{3})+$`),
+    numbersCommaDecimal: regexp.MustCompile(`^\d{1,3}(?:\.\d{3})+$`),
+}
+
+// parseNumericValue reads a number written in one convention, and reports
+// how many decimals it was given with. Apostrophes group digits in both.
+func parseNumericValue(s string, convention int) (float64, int, bool) {
+    negative := strings.HasPrefix(s, "-") || strings.HasPrefix(s, "−")
+    s = strings.TrimLeft(s, "-−")
+    s = strings.TrimLeft(s, "$€£¥")
+    s = strings.ReplaceAll(s, "'", "")
+
+    group, decimal := ",", "."
+    if convention == numbersCommaDecimal {
+        group, decimal = ".", ","
+    }
+    whole, frac, hasFrac := strings.Cut(s, decimal)
+    if hasFrac && (frac == "" || strings.ContainsAny(frac, ".,")) {
+        return 0, 0, false
+    }
+    if strings.Contains(whole, group) {
+        if !numericGroupedInteger[convention].MatchString(whole) {
+            return 0, 0, false
+        }
+        whole = strings.ReplaceAll(whole, group, "")
+    }
+    if strings.ContainsAny(whole, ".,") {
+        return 0, 0, false
+    }
+
+    v, err := strconv.ParseFloat(whole+"."+frac+"0", 64)
+    if err != nil {
+        return 0, 0, false
+    }
+    if negative {
+        v = -v
+    }
+    return v, len(frac), true
+}
+
+// numericMatches reports whether a stated value agrees with the recomputed
+// one. Stated values are usually rounded, so anything that rounds to what
+// was written passes; relative widens that for conversions, whose factors
+// are commonly approximated.
+func numericMatches(stated float64, decimals int, computed, relative float64) bool {
+    tolerance := 0.5*math.Pow(10, -float64(decimals)) + 1e-9*math.Abs(computed)
+    tolerance = math.Max(tolerance, relative*math.Abs(computed))
+    return math.Abs(stated-computed) <= tolerance
+}
+
+// evaluateArithmetic computes operands joined by operators, multiplication
+// and division first
+func evaluateArithmetic(values []float64, ops []string) (float64, bool) {
+    terms := []float64{values[0]}
+    signs := []float64{1}
+    for i, op := range ops {
+        v := values[i+1]
+        switch op {
+        case "*", "×", "x":
+            terms[len(terms)-1] *= v
+        case "/", "÷":
+            if v == 0 {
+                return 0, false
+            }
+            terms[len(terms)-1] /= v
+        case "+":
+            terms, signs = append(terms, v), append(signs, 1)
+        default:
+            terms, signs = append(terms, v), append(signs, -1)
+        }
+    }
+    total := 0.0
+    for i, t := range terms {
+        total += signs[i] * t
+    }
+    return total, true
+}
+
+// numericClaim is a claim found in the text: the numbers as written and how
+// to recompute the stated value, the last number, from the rest
+type numericClaim struct {
+    kind     string
+    start    int
+    end      int
+    numbers  []string
+    relative float64
+    compute  func(inputs []float64, stated float64) (float64, bool)
+}
+
+// check recomputes a claim under each digit convention its numbers fit. It
+// reports false when the claim can't be read under any.
+func (c numericClaim) check(text string) (NumericCheck, bool) {
+    result := NumericCheck{Claim: text[c.start:c.end], Kind: c.kind}
+    read := false
+    for _, convention := range []int{numbersDotDecimal, numbersCommaDecimal} {
+        values := make([]float64, len(c.numbers))
+        decimals, ok := 0, true
+        for i, n := range c.numbers {
+            values[i], decimals, ok = parseNumericValue(n, convention)
+            if !ok {
+                break
+            }
+        }
+        if !ok {
+            continue
+        }
+        last := len(values) - 1
+        computed, ok := c.compute(values[:last], values[last])
+        if !ok {
+            continue
+        }
+        pass := numericMatches(values[last], decimals, computed, c.relative)
+        if !read || pass {
+            result.Stated, result.Computed, result.Pass = values[last], math.Round(computed*1e6)/1e6, pass
+            read = true
+        }
+        if pass {
+            break
+        }
+    }
+    return result, read
+}
+
+// numericBoundaries reports whether a match stands on its own rather than
+// being the middle of a longer expression, a time, a fraction or a word
+func numericBoundaries(text string, start, end int) bool {
+    if start > 0 {
+        prev, _ := utf8.DecodeLastRuneInString(text[:start])
+        if unicode.IsLetter(prev) || unicode.IsDigit(prev) || strings.ContainsRune(".,':/^_", prev) {
+            return false
+        }
+        // An operator or equals sign before it means the claim is only part
+        // of the expression, like the 3 + 4 in "x * 3 + 4 = 10"
+        before := strings.TrimRight(text[:start], " \t")
+        if prev, _ := utf8.DecodeLastRuneInString(before); strings.ContainsRune("+-−×*/÷^=", prev) {
+            return false
+        }
+    }
+    if end < len(text) {
+        next, _ := utf8.DecodeRuneInString(text[end:])
+        if unicode.IsLetter(next) || unicode.IsDigit(next) || strings.ContainsRune("%/^°_(", next) {
+            return false
+        }
+    }
+    return true
+}
+
+// findNumericClaims extracts arithmetic, percentage and conversion claims.
+// Extraction is conservative: anything that could be read another way,
+// like a unit conversion between different dimensions, is left alone.
+func findNumericClaims(text string) []numericClaim {
+    var claims []numericClaim
+
+    for _, m := range numericArithmeticPattern.FindAllStringSubmatchIndex(text, -1) {
+        if !numericBoundaries(text, m[0], m[1]) {
+            continue
+        }
+        expr := text[m[2]:m[3]]
+        first := numericOperand.FindString(expr)
+        numbers := []string{first}
+        var ops []string
+        for _, step := range numericStep.FindAllStringSubmatch(expr[len(first):], -1) {
+            ops = append(ops, strings.TrimSpace(step[1]))
+            numbers = append(numbers, step[2])
+        }
+        numbers = append(numbers, text[m[4]:m[5]])
+        claims = append(claims, numericClaim{
+            kind:    numericArithmetic,
+            start:   m[0],
+            end:     m[1],
+            numbers: numbers,
+            compute: func(inputs []float64, _ float64) (float64, bool) {
+                return evaluateArithmetic(inputs, ops)
+            },
+        })
+    }
+
+    for _, m := range numericPercentagePattern.FindAllStringSubmatchIndex(text, -1) {
+        if !numericBoundaries(text, m[0], m[1]) {
+            continue
+        }
+        claims = append(claims, numericClaim{
+            kind:    numericPercentage,
+            start:   m[0],
+            end:     m[1],
+            numbers: []string{text[m[2]:m[3]], text[m[4]:m[5]], text[m[6]:m[7]]},
+            compute: func(inputs []float64, _ float64) (float64, bool) {
+                return inputs[0] / 100 * inputs[1], true
+            },
+        })
+    }
+
+    for _, m := range numericConversionPattern.FindAllStringSubmatchIndex(text, -1) {
+        if !numericBoundaries(text, m[0], m[1]) {
+            continue
+        }
+        from, to := numericUnits[text[m[4]:m[5]]], numericUnits[text[m[8]:m[9]]]
+        value, converted := text[m[2]:m[3]], text[m[6]:m[7]]
+        // Currency amounts aren't lengths, whatever the letter after them
+        if from.dimension != to.dimension || text[m[4]:m[5]] == text[m[8]:m[9]] || strings.ContainsAny(value+converted, "$€£¥") {
+            continue
+        }
+        claims = append(claims, numericClaim{
+            kind:     numericConversion,
+            start:    m[0],
+            end:      m[1],
+            numbers:  []string{value, converted},
+            relative: 0.01,
+            compute: func(inputs []float64, stated float64) (float64, bool) {
+                // An ambiguous unit converts with whichever reading comes
+                // closest to what was stated
+                best, found := 0.0, false
+                for _, fromScale := range from.scales {
+                    for _, toScale := range to.scales {
+                        v := (inputs[0]*fromScale + from.offset - to.offset) / toScale
+                        if !found || math.Abs(v-stated) < math.Abs(best-stated) {
+                            best, found = v, true
+                        }
+                    }
+                }
+                return best, found
+            },
+        })
+    }
+
+    sort.Slice(claims, func(a, b int) bool { return claims[a].start < claims[b].start })
+    return claims
+}
+
+// verifyNumeric finds numeric claims in a response and recomputes them.
+// Claims overlapping an earlier one are skipped.
+func verifyNumeric(text string) []NumericCheck {
+    if len(text) > numericScanLimit {
+        text = text[:numericScanLimit]
+    }
+    var checks []NumericCheck
+    covered := 0
+    for _, claim := range findNumericClaims(text) {
+        if claim.start < covered {
+            continue
+        }
+        check, ok := claim.check(text)
+        if !ok {
+            continue
+        }
+        covered = claim.end
+        checks = append(checks, check)
+        outcome := "pass"
+        if !check.Pass {
+            outcome = "fail"
+        }
+        metrics.Inc("numeric_checks_total", "kind", check.Kind, "outcome", outcome)
+        if len(checks) == maxNumericClaims {
+            break
+        }
+    }
+    return checks
+}
+
+// numericFailures counts the checks that failed
+func numericFailures(checks []NumericCheck) int {
+    n := 0
+    for _, c := range checks {
+        if !c.Pass {
+            n++
+        }
+    }
+    return n
+}
+
+// numericFeedback asks the model to correct the claims that failed
+func numericFeedback(checks []NumericCheck) string {
+    var sb strings.Builder
+    sb.WriteString("Some figures in your previous answer don't check out:\n")
+    for _, c := range checks {
+        if !c.Pass {
+            fmt.Fprintf(&sb, "- %q: the correct value is %s\n", c.Claim, strconv.FormatFloat(c.Computed, 'f', -1, 64))
+        }
+    }
+    sb.WriteString("Answer the original question again with these figures corrected.")
+    return sb.String()
+}
+
+// regenerateNumeric makes the one retry strict numeric verification allows:
+// the answer and its failed claims go back to the model as a further turn.
+// The retry is only used if it fails fewer checks than the original.
+func (bc *BedrockClient) regenerateNumeric(ctx context.Context, params GenerationParams, result *GenerationResult, checks []NumericCheck) (*GenerationResult, []NumericCheck, bool) {
+    retry := params
+    retry.History = append(params.History[:len(params.History):len(params.History)],
+        ChatMessage{Role: roleUser, Content: params.Prompt},
+        ChatMessage{Role: roleAssistant, Content: result.Text})
+    retry.Prompt = numericFeedback(checks)
+    params.Record.Policy("numeric check: %d of %d claims failed, regenerating once", numericFailures(checks), len(checks))
+
+    second, err := bc.Generate(ctx, retry)
+    if err != nil {
+        callerUsage.Record(ctx, "", 0, 0, true)
+        metrics.Inc("numeric_regenerations_total", "outcome", "error")
+        logWarnf(ctx, "Numeric regeneration failed: %v", err)
+        return result, checks, false
+    }
+    inputTokens, outputTokens := second.InputTokens, second.OutputTokens
+    if second.Cached {
+        inputTokens, outputTokens = 0, 0
+    }
+    callerUsage.Record(ctx, second.ModelID, inputTokens, outputTokens, false)
+
+    if second.Filtered {
+        metrics.Inc("numeric_regenerations_total", "outcome", "filtered")
+        return result, checks, false
+    }
+    classifyRefusal(second)
+    secondChecks := verifyNumeric(second.Text)
+    if numericFailures(secondChecks) >= numericFailures(checks) || second.Refused {
+        metrics.Inc("numeric_regenerations_total", "outcome", "not_improved")
+        return result, checks, false
+    }
+    metrics.Inc("numeric_regenerations_total", "outcome", "improved")
+    return second, secondChecks, true
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+    "net/http"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestVerifyNumeric(t *testing.T) {
+    for _, c := range []struct {
+        name string
+        text string
+        want []NumericCheck
+    }{
+        {"arithmetic", "So 12 + 30 = 42.", []NumericCheck{{"12 + 30 = 42", numericArithmetic, 42, 42, true}}},
+        {"arithmetic wrong", "12 + 30 = 43, as before", []NumericCheck{{"12 + 30 = 43", numericArithmetic, 43, 42, false}}},
+        {"precedence", "2 + 3 * 4 = 14", []NumericCheck{{"2 + 3 * 4 = 14", numericArithmetic, 14, 14, true}}},
+        {"times as x", "6 x 7 = 42", []NumericCheck{{"6 x 7 = 42", numericArithmetic, 42, 42, true}}},
+        {"negative", "−5 + 2 = −3", []NumericCheck{{"−5 + 2 = −3", numericArithmetic, -3, -3, true}}},
+        {"rounded to what was written", "100 / 3 = 33.3", []NumericCheck{{"100 / 3 = 33.3", numericArithmetic, 33.3, 33.333333, true}}},
+        {"rounded wrong", "100 / 3 = 33.4", []NumericCheck{{"100 / 3 = 33.4", numericArithmetic, 33.4, 33.333333, false}}},
+        {"currency", "$1,200 + $300 = $1,500", []NumericCheck{{"$1,200 + $300 = $1,500", numericArithmetic, 1500, 1500, true}}},
+        {"comma decimals", "1.234,5 + 0,5 = 1.235", []NumericCheck{{"1.234,5 + 0,5 = 1.235", numericArithmetic, 1235, 1235, true}}},
+        {"either convention", "1,5 + 1 = 2,5", []NumericCheck{{"1,5 + 1 = 2,5", numericArithmetic, 2.5, 2.5, true}}},
+        {"percentage", "15% of 80 is 12", []NumericCheck{{"15% of 80 is 12", numericPercentage, 12, 12, true}}},
+        {"percentage in words", "15 percent of 80 is about 13", []NumericCheck{{"15 percent of 80 is about 13", numericPercentage, 13, 12, false}}},
+        {"conversion", "5 km = 3.1 miles", []NumericCheck{{"5 km = 3.1 miles", numericConversion, 3.1, 3.106856, true}}},
+        {"conversion within 1%", "100 km is about 61.8 miles", []NumericCheck{{"100 km is about 61.8 miles", numericConversion, 61.8, 62.137119, true}}},
+        {"conversion wrong", "5 km = 4 miles", []NumericCheck{{"5 km = 4 miles", numericConversion, 4, 3.106856, false}}},
+        {"temperature", "100 °C = 212 °F", []NumericCheck{{"100 °C = 212 °F", numericConversion, 212, 212, true}}},
+        {"US gallons", "10 gallons = 37.85 liters", []NumericCheck{{"10 gallons = 37.85 liters", numericConversion, 37.85, 37.854118, true}}},
+        {"imperial gallons", "10 gallons = 45.46 liters", []NumericCheck{{"10 gallons = 45.46 liters", numericConversion, 45.46, 45.4609, true}}},
+        {"several", "First 2 + 2 = 5, then 10% of 50 = 5.", []NumericCheck{
+            {"2 + 2 = 5", numericArithmetic, 5, 4, false},
+            {"10% of 50 = 5", numericPercentage, 5, 5, true},
+        }},
+
+        // Left alone rather than misread
+        {"part of a longer expression", "x * 3 + 4 = 10", nil},
+        {"followed by a unit", "3 + 4 = 7% more", nil},
+        {"division by zero", "10 / 0 = 5", nil},
+        {"different dimensions", "5 km = 3 kg", nil},
+        {"same unit", "5 km = 5 km", nil},
+        {"currency with a unit", "$5 m = 5 mi", nil},
+        {"malformed grouping", "1,23,4 + 1 = 2", nil},
+        {"no claims", "Nothing to check here.", nil},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            if got := verifyNumeric(c.text); !reflect.DeepEqual(got, c.want) {
+                t.Errorf("verifyNumeric(%q) =\n%+v\nwant\n%+v", c.text, got, c.want)
+            }
+        })
+    }
+}
+
+// The scan stops at the limits however long the response is
+func TestVerifyNumericLimits(t *testing.T) {
+    many := strings.Repeat("1 + 1 = 2. ", maxNumericClaims+10)
+    if got := len(verifyNumeric(many)); got != maxNumericClaims {
+        t.Errorf("%d checks, want %d", got, maxNumericClaims)
+    }
+    late := strings.Repeat(" ", numericScanLimit) + "2 + 2 = 5"
+    if got := verifyNumeric(late); len(got) != 0 {
+        t.Errorf("claim past the scan limit checked: %+v", got)
+    }
+
+    before := metrics.Value("numeric_checks_total", "kind", numericArithmetic, "outcome", "fail")
+    verifyNumeric("2 + 2 = 5 and 3 + 3 = 6")
+    if n := metrics.Value("numeric_checks_total", "kind", numericArithmetic, "outcome", "fail") - before; n != 1 {
+        t.Errorf("%v failures counted, want 1", n)
+    }
+}
+
+func TestNumericFeedback(t *testing.T) {
+    checks := verifyNumeric("2 + 2 = 5, 3 + 3 = 6 and 10 / 4 = 3.5")
+    if n := numericFailures(checks); n != 2 {
+        t.Fatalf("%d failures in %+v, want 2", n, checks)
+    }
+    feedback := numericFeedback(checks)
+    for _, want := range []string{`"2 + 2 = 5": the correct value is 4`, `"10 / 4 = 3.5": the correct value is 2.5`} {
+        if !strings.Contains(feedback, want) {
+            t.Errorf("feedback %q lacks %q", feedback, want)
+        }
+    }
+    if strings.Contains(feedback, "3 + 3") {
+        t.Errorf("feedback %q lists a claim that passed", feedback)
+    }
+}
+
+// numeric_strict regenerates once with the failed claims as feedback, and
+// keeps the retry only if it gets more of them right
+func TestE2ENumericStrict(t *testing.T) {
+    const model = "mistral.mixtral-8x7b-instruct-v0:1"
+    answer := func(text string) fakeReply {
+        return fakeReply{Body: `{"outputs":[{"text":"` + text + `","stop_reason":"stop"}]}`}
+    }
+
+    for _, c := range []struct {
+        name        string
+        strict      bool
+        replies     []fakeReply
+        response    string
+        regenerated bool
+        failed      int
+        calls       int
+    }{
+        {"correct", true, []fakeReply{answer("12 + 30 = 42")}, "12 + 30 = 42", false, 0, 1},
+        {"not strict", false, []fakeReply{answer("12 + 31 = 42")}, "12 + 31 = 42", false, 1, 1},
+        {"improved", true, []fakeReply{answer("12 + 32 = 43"), answer("12 + 32 = 44")}, "12 + 32 = 44", true, 0, 2},
+        {"not improved", true, []fakeReply{answer("12 + 33 = 44"), answer("12 + 33 = 46")}, "12 + 33 = 44", false, 1, 2},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            fake.Script(model, c.replies...)
+            before := len(fake.Calls(model))
+            resp := post(t, "/generate", map[string]interface{}{
+                "prompt": "What is 12 plus a bit? (" + c.name + ")", "models": []string{model},
+                "verify_numeric": true, "numeric_strict": c.strict,
+            })
+            var out GenerateResponse
+            decode(t, resp, &out)
+            if resp.StatusCode != http.StatusOK {
+                t.Fatalf("status %d", resp.StatusCode)
+            }
+            calls := fake.Calls(model)[before:]
+            if len(calls) != c.calls {
+                t.Fatalf("%d model calls, want %d", len(calls), c.calls)
+            }
+            regenerated := out.Meta != nil && out.Meta.NumericRegenerated
+            if out.Response != c.response || regenerated != c.regenerated || numericFailures(out.NumericChecks) != c.failed || len(out.NumericChecks) != 1 {
+                t.Errorf("%q regenerated %v with checks %+v, want %q regenerated %v with %d failed", out.Response, regenerated, out.NumericChecks, c.response, c.regenerated, c.failed)
+            }
+            if c.calls == 2 && !strings.Contains(string(calls[1].Body), "the correct value is") {
+                t.Errorf("retry sent without feedback: %s", calls[1].Body)
+            }
+        })
+    }
+
+    resp := post(t, "/generate", map[string]interface{}{"prompt": "Hi", "models": []string{model}, "numeric_strict": true})
+    var rejected errorEnvelope
+    decode(t, resp, &rejected)
+    if resp.StatusCode != http.StatusBadRequest || rejected.Error.Code != ErrCodeValidation {
+        t.Errorf("numeric_strict alone: status %d, error %+v", resp.StatusCode, rejected.Error)
+    }
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// POST /v1/chat/completions takes OpenAI chat completion requests, so OpenAI
+// SDK clients can be pointed at the service. The request is mapped onto a
+// generate request and served by the streaming pipeline, streamGeneration,
+// whose events chatCompletionWriter turns into chat.completion.chunk server
+// events, or collects into one chat.completion when "stream" is false.
+// Fields the service has no use for are accepted and ignored, as clients
+// send many; ones it can't honor, like tools or n above 1, are rejected.
+// Either way the completion holds a stream slot while it runs.
+
+// chatHeartbeatInterval is how long a chat stream may go without writing
+// before a comment line is sent, so proxies don't take it for dead
+const chatHeartbeatInterval = 15 * time.Second
+
+// ChatCompletionRequest is the body of POST /v1/chat/completions
+type ChatCompletionRequest struct {
+    Model               string                  `json:"model"`
+    Messages            []ChatCompletionMessage `json:"messages"`
+    MaxTokens           *int                    `json:"max_tokens,omitempty"`
+    MaxCompletionTokens *int                    `json:"max_completion_tokens,omitempty"` // Replaces max_tokens when set
+    Temperature         *float64                `json:"temperature,omitempty"`
+    TopP                *float64                `json:"top_p,omitempty"`
+    Stop                json.RawMessage         `json:"stop,omitempty"`  // A string or an array of them
+    N                   *int                    `json:"n,omitempty"`     // Only 1
+    Tools               json.RawMessage         `json:"tools,omitempty"` // Not supported
+    Stream              bool                    `json:"stream,omitempty"`
+    StreamOptions       *ChatStreamOptions      `json:"stream_options,omitempty"`
+    User                string                  `json:"user,omitempty"` // End user, for experiment assignment
+}
+
+// ChatStreamOptions is a chat completion's stream_options
+type ChatStreamOptions struct {
+    IncludeUsage bool `json:"include_usage"` // Send a last chunk with the token usage
+}
+
+// ChatCompletionMessage is one message of a chat completion request
+type ChatCompletionMessage struct {
+    Role    string          `json:"role"`
+    Content json.RawMessage `json:"content"` // A string or an array of text and image_url parts
+}
+
+// chatContentPart is one part of a message's content array
+type chatContentPart struct {
+    Type     string `json:"type"`
+    Text     string `json:"text"`
+    ImageURL *struct {
+        URL string `json:"url"`
+    } `json:"image_url"`
+}
+
+// chatImageURL matches the data URLs images are given as; the service
+// fetches nothing
+var chatImageURL = regexp.MustCompile(`^data:(image/[a-z]+);base64,(.*)$`)
+
+// generateRequest maps the chat completion onto a generate request. The
+// leading system and developer messages become the system prompt; problems
+// name messages by their index in the chat completion.
+func (req ChatCompletionRequest) generateRequest() (GenerateRequest, *APIError) {
+    gen := GenerateRequest{
+        Model:       req.Model,
+        MaxTokens:   req.MaxTokens,
+        Temperature: req.Temperature,
+        TopP:        req.TopP,
+        UserID:      req.User,
+        Messages:    []ChatMessage{},
+    }
+    if req.MaxCompletionTokens != nil {
+        gen.MaxTokens = req.MaxCompletionTokens
+    }
+
+    var problems []FieldError
+    if strings.TrimSpace(req.Model) == "" {
+        problems = append(problems, FieldError{Field: "model", Message: "is required"})
+    }
+    if req.N != nil && *req.N != 1 {
+        problems = append(problems, FieldError{Field: "n", Message: "must be 1"})
+    }
+    if len(req.Tools) > 0 && string(req.Tools) != "null" {
+        problems = append(problems, FieldError{Field: "tools", Message: "are not supported"})
+    }
+    if req.StreamOptions != nil && !req.Stream {
+        problems = append(problems, FieldError{Field: "stream_options", Message: "requires stream"})
+    }
+    if stops, ok := chatStop(req.Stop); ok {
+        gen.StopSequences = stops
+    } else {
+        problems = append(problems, FieldError{Field: "stop", Message: "must be a string or an array of strings"})
+    }
+
+    var system []string
+    leading := 0
+    for i, m := range req.Messages {
+        field := fmt.Sprintf("messages[%d]", i)
+        switch m.Role {
+        case "system", "developer":
+            if i != leading {
+                problems = append(problems, FieldError{Field: field + ".role", Message: "system messages must come before the others"})
+                continue
+            }
+            leading++
+            blocks, text, partProblems := chatContent(field, m.Content)
+            problems = append(problems, partProblems...)
+            for _, b := range blocks {
+                if b.Type == blockImage {
+                    problems = append(problems, FieldError{Field: field + ".content", Message: "must be text in a system message"})
+                    break
+                }
+            }
+            system = append(system, text)
+        case roleUser, roleAssistant:
+            blocks, text, partProblems := chatContent(field, m.Content)
+            problems = append(problems, partProblems...)
+            gen.Messages = append(gen.Messages, ChatMessage{Role: m.Role, Content: text, Blocks: blocks})
+        default:
+            problems = append(problems, FieldError{Field: field + ".role", Message: "must be system, developer, user or assistant"})
+        }
+    }
+    if len(system) > 0 {
+        joined := strings.Join(system, "\n\n")
+        gen.System = &joined
+    }
+    if len(problems) > 0 {
+        return gen, &APIError{Code: ErrCodeValidation, Message: "Invalid chat completion request", Fields: problems}
+    }
+
+    // The turns are checked here, so their problems can be renumbered past
+    // the system messages
+    if _, _, apiErr := gen.turns(); apiErr != nil {
+        for i := range apiErr.Fields {
+            apiErr.Fields[i].Field = renumberMessages(apiErr.Fields[i].Field, leading)
+        }
+        return gen, apiErr
+    }
+    return gen, nil
+}
+
+// messageIndex finds the index in a field naming a message
+var messageIndex = regexp.MustCompile(`^messages\[(\d+)\]`)
+
+// renumberMessages shifts the message index in field by offset
+func renumberMessages(field string, offset int) string {
+    return messageIndex.ReplaceAllStringFunc(field, func(m string) string {
+        i, _ := strconv.Atoi(messageIndex.FindStringSubmatch(m)[1])
+        return fmt.Sprintf("messages[%d]", i+offset)
+    })
+}
+
+// chatStop reads stop, a string or an array of them
+func chatStop(raw json.RawMessage) ([]string, bool) {
+    raw = bytes.TrimSpace(raw)
+    if len(raw) == 0 || string(raw) == "null" {
+        return nil, true
+    }
+    var one string
+    if err := json.Unmarshal(raw, &one); err == nil {
+        return []string{one}, true
+    }
+    var many []string
+    if err := json.Unmarshal(raw, &many); err == nil {
+        return many, true
+    }
+    return nil, false
+}
+
+// chatContent reads a message's content: a string, or parts made content
+// blocks, with their text
+func chatContent(field string, raw json.RawMessage) ([]ContentBlock, string, []FieldError) {
+    raw = bytes.TrimSpace(raw)
+    if len(raw) == 0 || string(raw) == "null" {
+        return nil, "", nil
+    }
+    if raw[0] != '[' {
+        var text string
+        if err := json.Unmarshal(raw, &text); err != nil {
+            return nil, "", []FieldError{{Field: field + ".content", Message: "must be a string or an array of parts"}}
+        }
+        return nil, text, nil
+    }
+    var parts []chatContentPart
+    if err := json.Unmarshal(raw, &parts); err != nil {
+        return nil, "", []FieldError{{Field: field + ".content", Message: "must be a string or an array of parts"}}
+    }
+    var problems []FieldError
+    blocks := make([]ContentBlock, 0, len(parts))
+    for j, part := range parts {
+        at := fmt.Sprintf("%s.content[%d]", field, j)
+        switch part.Type {
+        case "text":
+            blocks = append(blocks, ContentBlock{Type: blockText, Text: part.Text})
+        case "image_url":
+            var image []string
+            if part.ImageURL != nil {
+                image = chatImageURL.FindStringSubmatch(part.ImageURL.URL)
+            }
+            if image == nil {
+                problems = append(problems, FieldError{Field: at + ".image_url.url", Message: "must be a base64 data: URL"})
+                continue
+            }
+            blocks = append(blocks, ContentBlock{Type: blockImage, MediaType: image[1], Data: image[2]})
+        default:
+            problems = append(problems, FieldError{Field: at + ".type", Message: "must be \"text\" or \"image_url\""})
+        }
+    }
+    return blocks, blocksText(blocks), problems
+}
+
+// chatFinishReason is OpenAI's name for a normalized finish reason
+func chatFinishReason(finish string) string {
+    switch finish {
+    case finishLengthCapped, finishBudget:
+        return "length"
+    case finishFiltered:
+        return "content_filter"
+    case finishToolUse:
+        return "tool_calls"
+    }
+    return "stop"
+}
+
+// Chat completion response bodies
+type chatUsage struct {
+    PromptTokens     int `json:"prompt_tokens"`
+    CompletionTokens int `json:"completion_tokens"`
+    TotalTokens      int `json:"total_tokens"`
+}
+
+type chatDelta struct {
+    Role    string  `json:"role,omitempty"`
+    Content *string `json:"content,omitempty"`
+}
+
+type chatChunkChoice struct {
+    Index        int       `json:"index"`
+    Delta        chatDelta `json:"delta"`
+    FinishReason *string   `json:"finish_reason"` // null until the last chunk
+}
+
+type chatChunk struct {
+    ID      string            `json:"id"`
+    Object  string            `json:"object"` // chat.completion.chunk
+    Created int64             `json:"created"`
+    Model   string            `json:"model"`
+    Choices []chatChunkChoice `json:"choices"`          // Empty in the usage chunk
+    Usage   *chatUsage        `json:"usage,omitempty"` // Only in the usage chunk
+}
+
+type chatOutputMessage struct {
+    Role    string `json:"role"`
+    Content string `json:"content"`
+}
+
+type chatChoice struct {
+    Index        int               `json:"index"`
+    Message      chatOutputMessage `json:"message"`
+    FinishReason string            `json:"finish_reason"`
+}
+
+type chatCompletion struct {
+    ID      string       `json:"id"`
+    Object  string       `json:"object"` // chat.completion
+    Created int64        `json:"created"`
+    Model   string       `json:"model"`
+    Choices []chatChoice `json:"choices"`
+    Usage   chatUsage    `json:"usage"`
+}
+
+// chatCompletionWriter is the response writer of a chat completion. The
+// streaming pipeline opens it as its event sink, see openEventWriter; a
+// response it writes before then, an error, passes straight through.
+type chatCompletionWriter struct {
+    http.ResponseWriter
+    flusher      http.Flusher
+    id           string
+    created      int64
+    model        string // As the request named it, echoed in every chunk
+    stream       bool
+    includeUsage bool
+
+    mu        sync.Mutex
+    status    int             // As opened
+    started   bool            // The chunk with the role was sent
+    text      strings.Builder // Collected when not streaming
+    lastWrite time.Time
+    finished  bool
+    stop      chan struct{}
+}
+
+// Flush passes through to the connection
+func (c *chatCompletionWriter) Flush() {
+    c.flusher.Flush()
+}
+
+// open starts the response, as the streaming pipeline starts its stream
+func (c *chatCompletionWriter) open(status int) eventWriter {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.status = status
+    if c.stream && status == http.StatusOK {
+        c.Header().Set("Content-Type", mimeSSE)
+        c.Header().Set("Cache-Control", "no-cache")
+        c.Header().Set("Connection", "keep-alive")
+        c.Header().Set("X-Accel-Buffering", "no")
+        c.ResponseWriter.WriteHeader(status)
+        c.lastWrite = time.Now()
+        go c.heartbeat()
+    }
+    return c
+}
+
+// heartbeat sends a comment line whenever the stream has been quiet for
+// chatHeartbeatInterval, until it finishes
+func (c *chatCompletionWriter) heartbeat() {
+    ticker := time.NewTicker(chatHeartbeatInterval / 3)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-c.stop:
+            return
+        case now := <-ticker.C:
+            c.mu.Lock()
+            if !c.finished && now.Sub(c.lastWrite) >= chatHeartbeatInterval {
+                c.writeLocked(": keep-alive\n\n")
+            }
+            c.mu.Unlock()
+        }
+    }
+}
+
+// close stops the heartbeat; the handler calls it once the stream is over
+func (c *chatCompletionWriter) close() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if !c.finished {
+        c.finished = true
+        close(c.stop)
+    }
+}
+
+// Send takes an event of the streaming pipeline
+func (c *chatCompletionWriter) Send(event string, data interface{}) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.finished {
+        return nil
+    }
+    switch e := data.(type) {
+    case textDeltaEvent:
+        if !c.stream {
+            c.text.WriteString(e.Text)
+            return nil
+        }
+        if err := c.startLocked(); err != nil {
+            return err
+        }
+        return c.chunkLocked(chatChunkChoice{Delta: chatDelta{Content: &e.Text}}, nil)
+    case streamDoneEvent:
+        return c.doneLocked(e)
+    case streamErrorEvent:
+        return c.errorLocked(e)
+    }
+    return nil // Events with no chat completion counterpart
+}
+
+// startLocked sends the chunk with the role ahead of the first delta
+func (c *chatCompletionWriter) startLocked() error {
+    if c.started {
+        return nil
+    }
+    c.started = true
+    empty := ""
+    return c.chunkLocked(chatChunkChoice{Delta: chatDelta{Role: roleAssistant, Content: &empty}}, nil)
+}
+
+// chunkLocked sends one chunk: a choice, or the usage
+func (c *chatCompletionWriter) chunkLocked(choice chatChunkChoice, usage *chatUsage) error {
+    chunk := chatChunk{ID: c.id, Object: "chat.completion.chunk", Created: c.created, Model: c.model, Choices: []chatChunkChoice{choice}}
+    if usage != nil {
+        chunk.Choices, chunk.Usage = []chatChunkChoice{}, usage
+    }
+    payload, err := json.Marshal(chunk)
+    if err != nil {
+        return err
+    }
+    return c.writeLocked("data: " + string(payload) + "\n\n")
+}
+
+// writeLocked writes to the stream and flushes it
+func (c *chatCompletionWriter) writeLocked(s string) error {
+    if _, err := c.ResponseWriter.Write([]byte(s)); err != nil {
+        return err
+    }
+    c.flusher.Flush()
+    c.lastWrite = time.Now()
+    return nil
+}
+
+// doneLocked finishes the completion: the last chunks and [DONE], or the
+// collected completion
+func (c *chatCompletionWriter) doneLocked(e streamDoneEvent) error {
+    defer func() {
+        c.finished = true
+        close(c.stop)
+    }()
+    finish := chatFinishReason(e.FinishReason)
+    usage := chatUsage{PromptTokens: e.InputTokens, CompletionTokens: e.OutputTokens, TotalTokens: e.InputTokens + e.OutputTokens}
+    if !c.stream {
+        c.Header().Set("Content-Type", "application/json")
+        c.ResponseWriter.WriteHeader(http.StatusOK)
+        return json.NewEncoder(c.ResponseWriter).Encode(chatCompletion{
+            ID:      c.id,
+            Object:  "chat.completion",
+            Created: c.created,
+            Model:   c.model,
+            Choices: []chatChoice{{Message: chatOutputMessage{Role: roleAssistant, Content: c.text.String()}, FinishReason: finish}},
+            Usage:   usage,
+        })
+    }
+    if err := c.startLocked(); err != nil {
+        return err
+    }
+    if err := c.chunkLocked(chatChunkChoice{Delta: chatDelta{}, FinishReason: &finish}, nil); err != nil {
+        return err
+    }
+    if c.includeUsage {
+        if err := c.chunkLocked(chatChunkChoice{}, &usage); err != nil {
+            return err
+        }
+    }
+    return c.writeLocked("data: [DONE]\n\n")
+}
+
+// errorLocked ends the completion with an error: an error event on a
+// stream that started, or else an error response with the status the
+// stream was opened with, 502 when it opened fine
+func (c *chatCompletionWriter) errorLocked(e streamErrorEvent) error {
+    defer func() {
+        c.finished = true
+        close(c.stop)
+    }()
+    apiErr := APIError{Code: e.Code, Message: e.Error}
+    if apiErr.Code == "" {
+        apiErr.Code = ErrCodeModelUnavailable
+    }
+    if c.stream && c.status == http.StatusOK {
+        payload, err := json.Marshal(errorEnvelope{Error: apiErr})
+        if err != nil {
+            return err
+        }
+        return c.writeLocked("data: " + string(payload) + "\n\n")
+    }
+    status := c.status
+    if status == http.StatusOK {
+        status = http.StatusBadGateway
+    }
+    c.Header().Set("Content-Type", "application/json")
+    c.ResponseWriter.WriteHeader(status)
+    return json.NewEncoder(c.ResponseWriter).Encode(errorEnvelope{Error: apiErr})
+}
+
+func chatCompletionsHandler(bc *BedrockClient, systemContext *SystemContext, contexts *ContextStore, streams *StreamLimiter) http.HandlerFunc {
+    serve := streamGeneration(bc, systemContext, contexts, streams)
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req ChatCompletionRequest
+        if err := json.Unmarshal(requestBody(r), &req); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+        gen, apiErr := req.generateRequest()
+        if apiErr != nil {
+            writeAPIError(w, r, http.StatusBadRequest, *apiErr)
+            return
+        }
+        flusher, ok := w.(http.Flusher)
+        if !ok {
+            writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "streaming not supported by this connection")
+            return
+        }
+
+        chat := &chatCompletionWriter{
+            ResponseWriter: w,
+            flusher:        flusher,
+            id:             "chatcmpl-" + requestIDFrom(r.Context()),
+            created:        time.Now().Unix(),
+            model:          req.Model,
+            stream:         req.Stream,
+            includeUsage:   req.StreamOptions != nil && req.StreamOptions.IncludeUsage,
+            stop:           make(chan struct{}),
+        }
+        defer chat.close()
+        serve(chat, r, gen, mimeSSE)
+    }
+}
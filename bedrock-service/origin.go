@@ -0,0 +1,56 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+
+    awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+    "github.com/aws/smithy-go/middleware"
+    smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// Origin says why a model was invoked. Every Bedrock invocation goes through
+// AccountPool, which requires one, so internal callers can't pass as users.
+type Origin string
+
+const (
+    originUser      Origin = "user"      // A client request; the only origin per-key limits and usage apply to
+    originProbe     Origin = "probe"     // Availability probes
+    originKeepalive Origin = "keepalive" // Keeps a model or connection warm
+    originWarmup    Origin = "warmup"    // Primes a prompt cache
+    originShadow    Origin = "shadow"    // Mirrored traffic whose results aren't served
+    originReplay    Origin = "replay"    // Re-runs of recorded requests
+    originSelftest  Origin = "selftest"  // The service checking itself
+)
+
+var knownOrigins = map[Origin]bool{
+    originUser: true, originProbe: true, originKeepalive: true, originWarmup: true,
+    originShadow: true, originReplay: true, originSelftest: true,
+}
+
+// check rejects the zero value and anything not listed above
+func (o Origin) check() error {
+    if !knownOrigins[o] {
+        return fmt.Errorf("bedrock invocation with unknown origin %q", o)
+    }
+    return nil
+}
+
+// recordInvocationTokens counts tokens by origin, so overhead spend can be
+// reported next to client spend
+func recordInvocationTokens(origin Origin, modelID string, inputTokens, outputTokens int) {
+    metrics.Add("bedrock_invocation_tokens_total", float64(inputTokens), "origin", string(origin), "model", modelID, "direction", "input")
+    metrics.Add("bedrock_invocation_tokens_total", float64(outputTokens), "origin", string(origin), "model", modelID, "direction", "output")
+}
+
+// headerTokens reads the token counts Bedrock reports in InvokeModel
+// response headers, which are there whatever the model's body format
+func headerTokens(metadata middleware.Metadata) (int, int) {
+    resp, ok := awsmiddleware.GetRawResponse(metadata).(*smithyhttp.Response)
+    if !ok {
+        return 0, 0
+    }
+    in, _ := strconv.Atoi(resp.Header.Get("X-Amzn-Bedrock-Input-Token-Count"))
+    out, _ := strconv.Atoi(resp.Header.Get("X-Amzn-Bedrock-Output-Token-Count"))
+    return in, out
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "fmt"
+    "net/http"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Every list endpoint pages the same way. Items come in a stable order,
+// (created_at, id) ascending or with order=desc descending, and a page that
+// isn't the last ends with an opaque next_cursor. The cursor carries the
+// last key returned and a hash of the filters in force, signed so it can't
+// be edited. A cursor used with other filters is rejected rather than
+// silently skipping or repeating items. Paging resumes after the cursor's
+// key, not at an offset, so items inserted during iteration never shift the
+// rest; ones created later than the walk's position appear on a later page.
+
+const defaultPageLimit = 20
+
+// PageConfig bounds page sizes and signs cursors
+type PageConfig struct {
+    MaxLimit int
+    secret   string
+}
+
+// LoadPageConfig reads PAGE_MAX_LIMIT (default 500) and PAGE_CURSOR_SECRET.
+// Without a secret one is generated, and cursors stop working on restart and
+// across replicas.
+func LoadPageConfig() (PageConfig, error) {
+    cfg := PageConfig{MaxLimit: 500, secret: os.Getenv("PAGE_CURSOR_SECRET")}
+    if v := os.Getenv("PAGE_MAX_LIMIT"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < defaultPageLimit {
+            return cfg, fmt.Errorf("invalid PAGE_MAX_LIMIT %q", v)
+        }
+        cfg.MaxLimit = n
+    }
+    if cfg.secret == "" {
+        b := make([]byte, 32)
+        if _, err := rand.Read(b); err != nil {
+            return cfg, fmt.Errorf("error generating a cursor secret: %v", err)
+        }
+        cfg.secret = hex.EncodeToString(b)
+    }
+    return cfg, nil
+}
+
+// Page is the envelope every list endpoint returns
+type Page struct {
+    Items         interface{} `json:"items"`
+    NextCursor    string      `json:"next_cursor,omitempty"`
+    TotalEstimate int         `json:"total_estimate"` // Items across all pages; inserts during iteration can change it
+}
+
+// pageKey places an item in list order
+type pageKey struct {
+    Created time.Time
+    ID      string
+}
+
+func (k pageKey) less(other pageKey) bool {
+    if !k.Created.Equal(other.Created) {
+        return k.Created.Before(other.Created)
+    }
+    return k.ID < other.ID
+}
+
+// ListQuery is a parsed list request
+type ListQuery struct {
+    Limit         int
+    CreatedAfter  time.Time // Exclusive; zero for no bound
+    CreatedBefore time.Time // Exclusive; zero for no bound
+    Descending    bool
+
+    filterHash string
+    after      *pageKey // From the cursor: the last item already returned
+}
+
+// parseListQuery reads limit, cursor, created_after, created_before and order
+// from the query string, along with the names of the endpoint's own filters,
+// which it only hashes into the cursor; the endpoint applies them itself
+func (cfg PageConfig) parseListQuery(r *http.Request, filters ...string) (ListQuery, *APIError) {
+    query := r.URL.Query()
+    q := ListQuery{Limit: defaultPageLimit}
+    invalid := func(field, message string) (ListQuery, *APIError) {
+        return q, &APIError{
+            Code:    ErrCodeValidation,
+            Message: fmt.Sprintf("Invalid %s", field),
+            Fields:  []FieldError{{Field: field, Message: message}},
+        }
+    }
+
+    if v := query.Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 || n > cfg.MaxLimit {
+            return invalid("limit", fmt.Sprintf("must be between 1 and %d", cfg.MaxLimit))
+        }
+        q.Limit = n
+    }
+    for _, bound := range []struct {
+        name string
+        t    *time.Time
+    }{{"created_after", &q.CreatedAfter}, {"created_before", &q.CreatedBefore}} {
+        if v := query.Get(bound.name); v != "" {
+            t, err := time.Parse(time.RFC3339, v)
+            if err != nil {
+                return invalid(bound.name, "must be an RFC 3339 timestamp")
+            }
+            *bound.t = t
+        }
+    }
+    switch query.Get("order") {
+    case "", "asc":
+    case "desc":
+        q.Descending = true
+    default:
+        return invalid("order", "must be \"asc\" or \"desc\"")
+    }
+
+    // The limit is left out: a caller may change page size mid-walk
+    h := sha256.New()
+    fmt.Fprintf(h, "%s\n%s\n%s\n%t", r.URL.Path, query.Get("created_after"), query.Get("created_before"), q.Descending)
+    for _, name := range filters {
+        fmt.Fprintf(h, "\n%s=%s", name, query.Get(name))
+    }
+    q.filterHash = hex.EncodeToString(h.Sum(nil)[:8])
+
+    if v := query.Get("cursor"); v != "" {
+        key, hash, ok := cfg.parseCursor(v)
+        if !ok {
+            return invalid("cursor", "is not a cursor this service issued")
+        }
+        if hash != q.filterHash {
+            return invalid("cursor", "was issued for different filters; start again without it")
+        }
+        q.after = &key
+    }
+    return q, nil
+}
+
+// cursor encodes the key a page ended on. The ID goes last since it may
+// contain dots.
+func (cfg PageConfig) cursor(key pageKey, filterHash string) string {
+    payload := strconv.FormatInt(key.Created.UnixNano(), 10) + "." + filterHash + "." + key.ID
+    return base64.RawURLEncoding.EncodeToString([]byte(payload + "." + signPayload(cfg.secret, "cursor\n"+payload)))
+}
+
+// parseCursor verifies a cursor. Tampered and malformed ones are both just
+// invalid.
+func (cfg PageConfig) parseCursor(cursor string) (pageKey, string, bool) {
+    data, err := base64.RawURLEncoding.DecodeString(cursor)
+    if err != nil {
+        return pageKey{}, "", false
+    }
+    token := string(data)
+    dot := strings.LastIndex(token, ".")
+    if dot < 0 {
+        return pageKey{}, "", false
+    }
+    payload, signature := token[:dot], token[dot+1:]
+    if !hmac.Equal([]byte(signature), []byte(signPayload(cfg.secret, "cursor\n"+payload))) {
+        return pageKey{}, "", false
+    }
+    parts := strings.SplitN(payload, ".", 3)
+    if len(parts) != 3 {
+        return pageKey{}, "", false
+    }
+    nanos, err := strconv.ParseInt(parts[0], 10, 64)
+    if err != nil {
+        return pageKey{}, "", false
+    }
+    return pageKey{Created: time.Unix(0, nanos), ID: parts[2]}, parts[1], true
+}
+
+// inWindow reports whether an item created at created passes the
+// created_after and created_before filters
+func (q ListQuery) inWindow(created time.Time) bool {
+    if !q.CreatedAfter.IsZero() && !created.After(q.CreatedAfter) {
+        return false
+    }
+    return q.CreatedBefore.IsZero() || created.Before(q.CreatedBefore)
+}
+
+// paginate picks the page q asks for out of n items, in no particular order,
+// that key describes. It returns the indexes of the page's items in list
+// order, and the envelope to put them in.
+func (cfg PageConfig) paginate(q ListQuery, n int, key func(i int) pageKey) ([]int, Page) {
+    matched := make([]int, 0, n)
+    for i := 0; i < n; i++ {
+        if q.inWindow(key(i).Created) {
+            matched = append(matched, i)
+        }
+    }
+    sort.Slice(matched, func(a, b int) bool {
+        if q.Descending {
+            return key(matched[b]).less(key(matched[a]))
+        }
+        return key(matched[a]).less(key(matched[b]))
+    })
+    page := Page{TotalEstimate: len(matched)}
+
+    start := 0
+    if q.after != nil {
+        start = sort.Search(len(matched), func(i int) bool {
+            if q.Descending {
+                return key(matched[i]).less(*q.after)
+            }
+            return q.after.less(key(matched[i]))
+        })
+    }
+    end := min(start+q.Limit, len(matched))
+    if end < len(matched) {
+        page.NextCursor = cfg.cursor(key(matched[end-1]), q.filterHash)
+    }
+    return matched[start:end], page
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "sort"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+var testPages = PageConfig{MaxLimit: 50, secret: "test-cursor-secret"}
+
+// listEndpoint is one list handler under the shared suite, with a store of
+// its own: insert adds an item created at the time given and returns its ID
+type listEndpoint struct {
+    path    string
+    filters []string // The endpoint's own, as it passes them to parseListQuery
+    serve   func(w http.ResponseWriter, r *http.Request)
+    insert  func(t *testing.T, created time.Time) string
+}
+
+// listEndpoints builds each list endpoint afresh, empty
+var listEndpoints = map[string]func(t *testing.T) listEndpoint{
+    "schedules": func(t *testing.T) listEndpoint {
+        ss := NewScheduleStore(ScheduleConfig{MaxPerTenant: 1 << 20, RunHistory: 1})
+        principal := &Principal{KeyID: "pager"}
+        handler := listSchedulesHandler(ss, testPages)
+        return listEndpoint{
+            path: "/schedules",
+            serve: func(w http.ResponseWriter, r *http.Request) {
+                handler(w, withPrincipal(r, principal))
+            },
+            insert: func(t *testing.T, created time.Time) string {
+                spec, err := parseCron("@daily")
+                if err != nil {
+                    t.Fatal(err)
+                }
+                s := &Schedule{Owner: contextOwner(principal), Cron: "@daily", spec: spec}
+                if err := ss.Create(s, created); err != nil {
+                    t.Fatal(err)
+                }
+                return s.ID
+            },
+        }
+    },
+    "schedule_runs": func(t *testing.T) listEndpoint {
+        ss := NewScheduleStore(ScheduleConfig{MaxPerTenant: 1, RunHistory: 1 << 20})
+        principal := &Principal{KeyID: "pager"}
+        spec, err := parseCron("@hourly")
+        if err != nil {
+            t.Fatal(err)
+        }
+        s := &Schedule{Owner: contextOwner(principal), Cron: "@hourly", spec: spec}
+        if err := ss.Create(s, time.Now()); err != nil {
+            t.Fatal(err)
+        }
+        handler := scheduleRunsHandler(ss, testPages)
+        var mu sync.Mutex
+        n := 0
+        return listEndpoint{
+            path:    "/schedules/" + s.ID + "/runs",
+            filters: []string{"status"},
+            serve: func(w http.ResponseWriter, r *http.Request) {
+                handler(w, mux.SetURLVars(withPrincipal(r, principal), map[string]string{"id": s.ID}))
+            },
+            insert: func(t *testing.T, created time.Time) string {
+                mu.Lock()
+                n++
+                id := fmt.Sprintf("run_%04d", n)
+                mu.Unlock()
+                ss.mu.Lock()
+                ss.recordRunLocked(s, &ScheduleRun{ID: id, ScheduledFor: created, Status: runSucceeded})
+                ss.mu.Unlock()
+                return id
+            },
+        }
+    },
+    "analytics_prompts": func(t *testing.T) listEndpoint {
+        pa, err := NewPromptAnalytics(PromptAnalyticsConfig{MaxFingerprints: 1 << 20})
+        if err != nil {
+            t.Fatal(err)
+        }
+        var mu sync.Mutex
+        n := 0
+        return listEndpoint{
+            path:    "/analytics/prompts",
+            filters: []string{"sort"},
+            serve:   promptAnalyticsListHandler(pa, testPages),
+            insert: func(t *testing.T, created time.Time) string {
+                mu.Lock()
+                n++
+                prompt := fmt.Sprintf("prompt number %d", n)
+                mu.Unlock()
+                pa.Record(PromptOutcome{Prompt: prompt, Model: "m"}, created)
+                return promptFingerprint(prompt)
+            },
+        }
+    },
+}
+
+func withPrincipal(r *http.Request, p *Principal) *http.Request {
+    return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+// listedPage is a Page as a caller reads it, with its items' IDs
+type listedPage struct {
+    IDs           []string
+    NextCursor    string
+    TotalEstimate int
+}
+
+// list requests one page, failing unless the endpoint answers 200
+func (e listEndpoint) list(t *testing.T, query string) listedPage {
+    t.Helper()
+    w := e.get(query)
+    if w.Code != http.StatusOK {
+        t.Fatalf("GET %s?%s: status %d: %s", e.path, query, w.Code, w.Body)
+    }
+    var page struct {
+        Items         json.RawMessage `json:"items"`
+        NextCursor    string          `json:"next_cursor"`
+        TotalEstimate int             `json:"total_estimate"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+        t.Fatal(err)
+    }
+    // Schedules and runs have IDs, prompts fingerprints
+    var items []struct {
+        ID          string `json:"id"`
+        Fingerprint string `json:"fingerprint"`
+    }
+    if err := json.Unmarshal(page.Items, &items); err != nil || items == nil {
+        t.Fatalf("GET %s?%s: items %s isn't a list", e.path, query, page.Items)
+    }
+    out := listedPage{NextCursor: page.NextCursor, TotalEstimate: page.TotalEstimate}
+    for _, item := range items {
+        out.IDs = append(out.IDs, item.ID+item.Fingerprint)
+    }
+    return out
+}
+
+func (e listEndpoint) get(query string) *httptest.ResponseRecorder {
+    w := httptest.NewRecorder()
+    e.serve(w, httptest.NewRequest(http.MethodGet, e.path+"?"+query, nil))
+    return w
+}
+
+// walk follows next_cursor from the first page to the last
+func (e listEndpoint) walk(t *testing.T, query string) []string {
+    t.Helper()
+    var ids []string
+    cursor := ""
+    for pages := 0; ; pages++ {
+        if pages > 100 {
+            t.Fatal("cursor never ran out")
+        }
+        q := query
+        if cursor != "" {
+            q += "&cursor=" + cursor
+        }
+        page := e.list(t, q)
+        ids = append(ids, page.IDs...)
+        if page.NextCursor == "" {
+            return ids
+        }
+        cursor = page.NextCursor
+    }
+}
+
+// wantCursorError checks the endpoint rejects the query's cursor
+func (e listEndpoint) wantCursorError(t *testing.T, query, message string) {
+    t.Helper()
+    w := e.get(query)
+    var envelope errorEnvelope
+    json.Unmarshal(w.Body.Bytes(), &envelope)
+    fields := envelope.Error.Fields
+    if w.Code != http.StatusBadRequest || envelope.Error.Code != ErrCodeValidation ||
+        len(fields) != 1 || fields[0].Field != "cursor" || !strings.Contains(fields[0].Message, message) {
+        t.Errorf("GET %s?%s: status %d: %s\nwant a validation error on the cursor saying %q", e.path, query, w.Code, w.Body, message)
+    }
+}
+
+// fill inserts n items a minute apart from base, two sharing each
+// creation time so the ID breaks the tie, and returns their IDs in list order
+func (e listEndpoint) fill(t *testing.T, base time.Time, n int) []string {
+    t.Helper()
+    var keys []pageKey
+    for i := 0; i < n; i++ {
+        created := base.Add(time.Duration(i/2) * time.Minute)
+        keys = append(keys, pageKey{Created: created, ID: e.insert(t, created)})
+    }
+    return sortedIDs(keys)
+}
+
+func sortedIDs(keys []pageKey) []string {
+    sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+    ids := make([]string, len(keys))
+    for i, key := range keys {
+        ids[i] = key.ID
+    }
+    return ids
+}
+
+func reversed(ids []string) []string {
+    out := make([]string, len(ids))
+    for i, id := range ids {
+        out[len(ids)-1-i] = id
+    }
+    return out
+}
+
+// runListSuite runs every check in the shared suite against each endpoint
+func runListSuite(t *testing.T, check func(t *testing.T, e listEndpoint)) {
+    for name, build := range listEndpoints {
+        build := build
+        t.Run(name, func(t *testing.T) {
+            check(t, build(t))
+        })
+    }
+}
+
+var pageBase = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// Walking with any page size returns every item once, in order both ways
+func TestListCursorRoundTrip(t *testing.T) {
+    runListSuite(t, func(t *testing.T, e listEndpoint) {
+        want := e.fill(t, pageBase, 25)
+        for _, limit := range []int{1, 7, 25, 50} {
+            if got := e.walk(t, fmt.Sprintf("limit=%d", limit)); strings.Join(got, ",") != strings.Join(want, ",") {
+                t.Errorf("limit %d: walked %v, want %v", limit, got, want)
+            }
+            if got := e.walk(t, fmt.Sprintf("limit=%d&order=desc", limit)); strings.Join(got, ",") != strings.Join(reversed(want), ",") {
+                t.Errorf("limit %d, descending: walked %v, want %v", limit, got, reversed(want))
+            }
+        }
+
+        first := e.list(t, "limit=10")
+        if first.TotalEstimate != 25 || len(first.IDs) != 10 || first.NextCursor == "" {
+            t.Fatalf("first page %+v, want 10 of 25 and a cursor", first)
+        }
+        // The page size may change mid-walk, the filters may not
+        if rest := e.list(t, "limit=50&cursor="+first.NextCursor); len(rest.IDs) != 15 || rest.NextCursor != "" {
+            t.Errorf("rest %+v, want the other 15 and no cursor", rest)
+        }
+        last := e.list(t, "limit=25")
+        if last.NextCursor != "" {
+            t.Errorf("a page holding everything has cursor %q", last.NextCursor)
+        }
+    })
+}
+
+// created_after and created_before are exclusive, and hold across pages
+func TestListCreatedWindow(t *testing.T) {
+    runListSuite(t, func(t *testing.T, e listEndpoint) {
+        all := e.fill(t, pageBase, 20) // Ten minutes, two items each
+        after := pageBase.Add(2 * time.Minute).Format(time.RFC3339)
+        before := pageBase.Add(7 * time.Minute).Format(time.RFC3339)
+        got := e.walk(t, "limit=3&created_after="+after+"&created_before="+before)
+        if want := all[6:14]; strings.Join(got, ",") != strings.Join(want, ",") {
+            t.Errorf("walked %v, want minutes 3 to 6: %v", got, want)
+        }
+    })
+}
+
+// Any change to a cursor, or a cursor made without the secret, is rejected
+func TestListCursorTampering(t *testing.T) {
+    runListSuite(t, func(t *testing.T, e listEndpoint) {
+        e.fill(t, pageBase, 10)
+        cursor := e.list(t, "limit=3").NextCursor
+        data, err := base64.RawURLEncoding.DecodeString(cursor)
+        if err != nil {
+            t.Fatal(err)
+        }
+        token := string(data)
+        dot := strings.LastIndex(token, ".")
+        payload, signature := token[:dot], token[dot+1:]
+        parts := strings.SplitN(payload, ".", 3)
+
+        encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+        forged := PageConfig{MaxLimit: testPages.MaxLimit, secret: "someone-else"}
+        key, _, _ := testPages.parseCursor(cursor)
+        for name, bad := range map[string]string{
+            "key moved back":    encode("0." + parts[1] + "." + parts[2] + "." + signature),
+            "id changed":        encode(parts[0] + "." + parts[1] + ".other." + signature),
+            "filters changed":   encode(parts[0] + ".0000000000000000." + parts[2] + "." + signature),
+            "signature flipped": encode(payload + "." + strings.Repeat("0", len(signature))),
+            "signature dropped": encode(payload),
+            "another secret":    forged.cursor(key, parts[1]),
+            "byte flipped":      cursor[:len(cursor)/2] + string("AB"[len(cursor)%2]) + cursor[len(cursor)/2+1:],
+            "appended":          cursor + "A",
+        } {
+            t.Run(name, func(t *testing.T) {
+                if bad == cursor {
+                    t.Skip("the edit left the cursor as it was")
+                }
+                e.wantCursorError(t, "limit=3&cursor="+bad, "not a cursor this service issued")
+            })
+        }
+    })
+}
+
+// Malformed cursors are rejected the same way, and so are good cursors
+// used with other filters or on another endpoint
+func TestListBadCursors(t *testing.T) {
+    runListSuite(t, func(t *testing.T, e listEndpoint) {
+        e.fill(t, pageBase, 10)
+        for _, bad := range []string{"garbage", "!!!", "bm9kb3Q", base64.RawURLEncoding.EncodeToString([]byte("1.2.3.4"))} {
+            e.wantCursorError(t, "cursor="+bad, "not a cursor this service issued")
+        }
+
+        cursor := e.list(t, "limit=3").NextCursor
+        after := pageBase.Format(time.RFC3339)
+        e.wantCursorError(t, "limit=3&order=desc&cursor="+cursor, "different filters")
+        e.wantCursorError(t, "limit=3&created_after="+after+"&cursor="+cursor, "different filters")
+        for _, filter := range e.filters {
+            e.wantCursorError(t, "limit=3&"+filter+"=other&cursor="+cursor, "different filters")
+        }
+
+        for name, build := range listEndpoints {
+            other := build(t)
+            if other.path == e.path {
+                continue
+            }
+            other.fill(t, pageBase, 1)
+            t.Run("on "+name, func(t *testing.T) {
+                other.wantCursorError(t, "limit=3&cursor="+cursor, "different filters")
+            })
+        }
+    })
+}
+
+// An empty list, or a window nothing falls in, is a page of no items and
+// no cursor
+func TestListEmptyPages(t *testing.T) {
+    runListSuite(t, func(t *testing.T, e listEndpoint) {
+        if page := e.list(t, ""); len(page.IDs) != 0 || page.NextCursor != "" || page.TotalEstimate != 0 {
+            t.Errorf("empty list %+v", page)
+        }
+        e.fill(t, pageBase, 4)
+        after := pageBase.Add(time.Hour).Format(time.RFC3339)
+        if page := e.list(t, "created_after="+after); len(page.IDs) != 0 || page.NextCursor != "" || page.TotalEstimate != 0 {
+            t.Errorf("window past every item %+v", page)
+        }
+
+        // A cursor whose items were all on earlier pages: everything after
+        // it is gone by the time it's used
+        cursor := testPages.cursor(pageKey{Created: pageBase.Add(time.Hour), ID: "z"}, e.filterHash(t, "limit=1"))
+        if page := e.list(t, "limit=1&cursor="+cursor); len(page.IDs) != 0 || page.NextCursor != "" || page.TotalEstimate != 4 {
+            t.Errorf("page past the end %+v", page)
+        }
+    })
+}
+
+// filterHash is the hash the endpoint puts in its cursors for query
+func (e listEndpoint) filterHash(t *testing.T, query string) string {
+    t.Helper()
+    q, apiErr := testPages.parseListQuery(httptest.NewRequest(http.MethodGet, e.path+"?"+query, nil), e.filters...)
+    if apiErr != nil {
+        t.Fatal(apiErr.Message)
+    }
+    return q.filterHash
+}
+
+// Items inserted during a walk never shift it: nothing already listed is
+// repeated and nothing not yet listed is skipped. Inserts behind the walk's
+// position are missed; ones ahead of it are listed.
+func TestListConcurrentInserts(t *testing.T) {
+    runListSuite(t, func(t *testing.T, e listEndpoint) {
+        original := e.fill(t, pageBase, 30)
+
+        var mu sync.Mutex
+        var behind []string
+        var ahead [][]string // By the page they raced
+        var seen []string
+        first := 0
+        cursor := ""
+        for page := 0; ; page++ {
+            if page > 100 {
+                t.Fatal("cursor never ran out")
+            }
+            q := "limit=4"
+            if cursor != "" {
+                q += "&cursor=" + cursor
+            }
+
+            // Writers race the request: half the items land before every
+            // original, half after everything inserted so far
+            ahead = append(ahead, nil)
+            var wg sync.WaitGroup
+            for w := 0; w < 4; w++ {
+                wg.Add(1)
+                go func(w int) {
+                    defer wg.Done()
+                    n := time.Duration(page*4 + w)
+                    if w%2 == 0 {
+                        id := e.insert(t, pageBase.Add(-(n+1)*time.Second))
+                        mu.Lock()
+                        behind = append(behind, id)
+                        mu.Unlock()
+                        return
+                    }
+                    id := e.insert(t, pageBase.Add(time.Hour+n*time.Second))
+                    mu.Lock()
+                    ahead[page] = append(ahead[page], id)
+                    mu.Unlock()
+                }(w)
+            }
+            listed := e.list(t, q)
+            wg.Wait()
+
+            seen = append(seen, listed.IDs...)
+            if page == 0 {
+                first = len(listed.IDs)
+            }
+            if listed.NextCursor == "" {
+                break
+            }
+            cursor = listed.NextCursor
+        }
+
+        counts := make(map[string]int)
+        for _, id := range seen {
+            if counts[id]++; counts[id] == 2 {
+                t.Errorf("%s listed twice", id)
+            }
+        }
+        for _, id := range original {
+            if counts[id] != 1 {
+                t.Errorf("original item %s listed %d times", id, counts[id])
+            }
+        }
+        // The last page's writers may finish after it was read
+        for page, ids := range ahead[:len(ahead)-1] {
+            for _, id := range ids {
+                if counts[id] != 1 {
+                    t.Errorf("item %s inserted ahead of the walk on page %d listed %d times", id, page, counts[id])
+                }
+            }
+        }
+        // Only the first request can see items behind the walk, if their
+        // writers beat it; after that the walk is past them
+        for _, id := range behind {
+            if counts[id] != 0 && !contains(seen[:first], id) {
+                t.Errorf("item %s inserted behind the walk was listed", id)
+            }
+        }
+    })
+}
+
+func contains(ids []string, id string) bool {
+    for _, other := range ids {
+        if other == id {
+            return true
+        }
+    }
+    return false
+}
+
+// limit must be between 1 and the configured maximum
+func TestListLimitBounds(t *testing.T) {
+    runListSuite(t, func(t *testing.T, e listEndpoint) {
+        for _, limit := range []string{"0", "-1", "51", "ten"} {
+            if w := e.get("limit=" + limit); w.Code != http.StatusBadRequest {
+                t.Errorf("limit=%s: status %d, want 400", limit, w.Code)
+            }
+        }
+        e.fill(t, pageBase, 60)
+        if page := e.list(t, ""); len(page.IDs) != defaultPageLimit {
+            t.Errorf("default page has %d items, want %d", len(page.IDs), defaultPageLimit)
+        }
+    })
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "strings"
+)
+
+// Parameter sources, highest precedence first. A value in the body beats a
+// header, a header beats the query string, and anything the caller sends
+// beats the key's policy default; the server default applies when nothing
+// sets the parameter. schema_version is the one exception: a body and header
+// that disagree are rejected, since the body can't be read without it.
+const (
+    paramBody      = "body"
+    paramHeader    = "header"
+    paramQuery     = "query"
+    paramKeyPolicy = "key_policy"
+    paramServer    = "server"
+)
+
+// requestParameter is a knob callers can set through more than one channel
+type requestParameter struct {
+    Name   string // Body field and query parameter
+    Header string
+    Policy func(KeyPolicy) string // Default from the caller's key policy
+}
+
+var (
+    paramModel    = requestParameter{Name: "model", Header: "X-Model", Policy: func(p KeyPolicy) string { return p.Model }}
+    paramTimezone = requestParameter{Name: "timezone", Header: "X-Timezone", Policy: func(p KeyPolicy) string { return p.Timezone }}
+    paramTimeout  = requestParameter{Name: "timeout_seconds", Header: "X-Request-Timeout", Policy: func(KeyPolicy) string { return "" }}
+)
+
+// ResolvedParam is a parameter's effective value and where it came from
+type ResolvedParam struct {
+    Value  string
+    Source string
+}
+
+// paramValues are the multi-channel parameters as decoded from a request body
+type paramValues struct {
+    Model    string
+    Timezone string
+    Timeout  string
+}
+
+// RequestParams are a request's multi-channel parameters after precedence
+// is applied. Warnings describe values that lost to a higher-precedence
+// source and are returned in the response meta.
+type RequestParams struct {
+    Model    ResolvedParam
+    Timezone ResolvedParam
+    Timeout  ResolvedParam // Seconds, see timeout.go
+    Warnings []string
+}
+
+type paramWarningsKey struct{}
+
+// withParamWarning notes a conflict found before the handler runs, such as
+// an API key sent in two headers
+func withParamWarning(ctx context.Context, warning string) context.Context {
+    warnings, _ := ctx.Value(paramWarningsKey{}).([]string)
+    return context.WithValue(ctx, paramWarningsKey{}, append(warnings[:len(warnings):len(warnings)], warning))
+}
+
+// resolveRequestParams is the one place handlers read parameters that can
+// arrive through more than one channel
+func resolveRequestParams(r *http.Request, body paramValues) RequestParams {
+    warnings, _ := r.Context().Value(paramWarningsKey{}).([]string)
+    params := RequestParams{Warnings: append([]string(nil), warnings...)}
+    params.Model = paramModel.resolve(r, body.Model, &params.Warnings)
+    params.Timezone = paramTimezone.resolve(r, body.Timezone, &params.Warnings)
+    params.Timeout = paramTimeout.resolve(r, body.Timeout, &params.Warnings)
+    return params
+}
+
+// resolve picks the highest-precedence value. Caller-supplied values that
+// disagree with it are reported; a key policy default being overridden is
+// what defaults are for, so it isn't.
+func (p requestParameter) resolve(r *http.Request, body string, warnings *[]string) ResolvedParam {
+    supplied := []ResolvedParam{
+        {Value: strings.TrimSpace(body), Source: paramBody},
+        {Value: strings.TrimSpace(r.Header.Get(p.Header)), Source: paramHeader},
+        {Value: strings.TrimSpace(r.URL.Query().Get(p.Name)), Source: paramQuery},
+    }
+
+    chosen := ResolvedParam{Source: paramServer}
+    var ignored []string
+    for _, candidate := range supplied {
+        switch {
+        case candidate.Value == "":
+        case chosen.Value == "":
+            chosen = candidate
+        case candidate.Value != chosen.Value:
+            ignored = append(ignored, fmt.Sprintf("%s (%q)", p.describe(candidate.Source), candidate.Value))
+        }
+    }
+    if chosen.Value == "" {
+        if v := p.Policy(principalFrom(r.Context()).Policy); v != "" {
+            chosen = ResolvedParam{Value: v, Source: paramKeyPolicy}
+        }
+    }
+
+    if len(ignored) > 0 {
+        warning := fmt.Sprintf("conflicting values for %s: using %s (%q), ignoring %s",
+            p.Name, p.describe(chosen.Source), chosen.Value, strings.Join(ignored, ", "))
+        *warnings = append(*warnings, warning)
+        metrics.Inc("parameter_conflicts_total", "parameter", p.Name)
+        requestRecordFrom(r.Context()).Policy("%s", warning)
+    }
+    return chosen
+}
+
+// describe names where a parameter was read from, as a caller would write it
+func (p requestParameter) describe(source string) string {
+    switch source {
+    case paramBody:
+        return fmt.Sprintf("body field %q", p.Name)
+    case paramHeader:
+        return p.Header + " header"
+    case paramQuery:
+        return fmt.Sprintf("query parameter %q", p.Name)
+    case paramKeyPolicy:
+        return "key policy default"
+    }
+    return "server default"
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+)
+
+// multiChannelParams are the parameters that can arrive through more than
+// one channel, with where each one's body value and policy default go
+var multiChannelParams = []struct {
+    param  requestParameter
+    body   func(v *paramValues, value string)
+    policy func(p *KeyPolicy, value string) // nil when keys have no default
+    pick   func(params RequestParams) ResolvedParam
+}{
+    {paramModel, func(v *paramValues, s string) { v.Model = s }, func(p *KeyPolicy, s string) { p.Model = s },
+        func(params RequestParams) ResolvedParam { return params.Model }},
+    {paramTimezone, func(v *paramValues, s string) { v.Timezone = s }, func(p *KeyPolicy, s string) { p.Timezone = s },
+        func(params RequestParams) ResolvedParam { return params.Timezone }},
+    {paramTimeout, func(v *paramValues, s string) { v.Timeout = s }, nil,
+        func(params RequestParams) ResolvedParam { return params.Timeout }},
+}
+
+// paramRequest builds a request setting the parameter in the header and
+// query string sources given
+func paramRequest(param requestParameter, sources map[string]string) *http.Request {
+    query := url.Values{}
+    if v, ok := sources[paramQuery]; ok {
+        query.Set(param.Name, v)
+    }
+    r := httptest.NewRequest(http.MethodPost, "/generate?"+query.Encode(), nil)
+    if v, ok := sources[paramHeader]; ok {
+        r.Header.Set(param.Header, v)
+    }
+    return r
+}
+
+// Every parameter, through every combination of channels: the highest
+// precedence source wins, and each caller-supplied value it beats that
+// differs is named in a warning
+func TestParamPrecedenceMatrix(t *testing.T) {
+    order := []string{paramBody, paramHeader, paramQuery, paramKeyPolicy}
+    for _, mp := range multiChannelParams {
+        for mask := 0; mask < 1<<len(order); mask++ {
+            sources := make(map[string]string)
+            var name []string
+            for i, source := range order {
+                if mask&(1<<i) != 0 {
+                    sources[source] = "7" + strings.Repeat("0", i) // Distinct values, all valid timeouts
+                    name = append(name, source)
+                }
+            }
+            if len(name) == 0 {
+                name = []string{"none"}
+            }
+            if _, ok := sources[paramKeyPolicy]; ok && mp.policy == nil {
+                continue
+            }
+
+            t.Run(mp.param.Name+"/"+strings.Join(name, "+"), func(t *testing.T) {
+                r := paramRequest(mp.param, sources)
+                principal := &Principal{KeyID: "k"}
+                if v, ok := sources[paramKeyPolicy]; ok {
+                    mp.policy(&principal.Policy, v)
+                }
+                r = r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+                var body paramValues
+                if v, ok := sources[paramBody]; ok {
+                    mp.body(&body, v)
+                }
+
+                params := resolveRequestParams(r, body)
+                got := mp.pick(params)
+
+                want := ResolvedParam{Source: paramServer}
+                for _, source := range order {
+                    if v, ok := sources[source]; ok {
+                        want = ResolvedParam{Value: v, Source: source}
+                        break
+                    }
+                }
+                if got != want {
+                    t.Errorf("resolved %+v, want %+v", got, want)
+                }
+
+                supplied := 0
+                for _, source := range order[:3] {
+                    if _, ok := sources[source]; ok {
+                        supplied++
+                    }
+                }
+                if wantWarning := supplied > 1; wantWarning != (len(params.Warnings) == 1) || len(params.Warnings) > 1 {
+                    t.Fatalf("warnings %q, want one only when more than one caller value was sent", params.Warnings)
+                }
+                if len(params.Warnings) == 1 {
+                    warning := params.Warnings[0]
+                    if !strings.HasPrefix(warning, "conflicting values for "+mp.param.Name+": using "+mp.param.describe(want.Source)) {
+                        t.Errorf("warning %q doesn't name the winning %s", warning, want.Source)
+                    }
+                    // The winner and every ignored value are each quoted once
+                    if strings.Count(warning, ` ("`) != supplied {
+                        t.Errorf("warning %q doesn't list the %d ignored values", warning, supplied-1)
+                    }
+                }
+            })
+        }
+    }
+}
+
+// The same value sent twice is no conflict, and blanks count as unset
+func TestParamAgreeingAndBlankValues(t *testing.T) {
+    r := paramRequest(paramModel, map[string]string{paramHeader: "haiku", paramQuery: "   "})
+    params := resolveRequestParams(r, paramValues{Model: " haiku "})
+    if params.Model != (ResolvedParam{Value: "haiku", Source: paramBody}) {
+        t.Errorf("model %+v", params.Model)
+    }
+    if len(params.Warnings) != 0 {
+        t.Errorf("warnings %q for agreeing values", params.Warnings)
+    }
+}
+
+// Warnings found before the handler, like an API key sent twice, come
+// first, and the context's list isn't shared between requests
+func TestParamWarningsFromContext(t *testing.T) {
+    base := withParamWarning(context.Background(), "first")
+    a := withParamWarning(base, "a")
+    b := withParamWarning(base, "b")
+
+    r := paramRequest(paramTimezone, map[string]string{paramHeader: "Europe/Paris"}).WithContext(a)
+    params := resolveRequestParams(r, paramValues{Timezone: "UTC"})
+    if len(params.Warnings) != 3 || params.Warnings[0] != "first" || params.Warnings[1] != "a" {
+        t.Errorf("warnings %q", params.Warnings)
+    }
+    if got := resolveRequestParams(r.WithContext(b), paramValues{}).Warnings; len(got) != 2 || got[1] != "b" {
+        t.Errorf("second request's warnings %q", got)
+    }
+}
+
+// The API key may come in X-API-Key or a bearer token; X-API-Key wins,
+// and a conflict is warned about without echoing either key
+func TestAPIKeyPrecedence(t *testing.T) {
+    ks := &KeyStore{keys: map[string]*Principal{
+        hashKey("key-a"): {KeyID: "a"},
+        hashKey("key-b"): {KeyID: "b"},
+    }}
+    for _, c := range []struct {
+        name          string
+        header, token string
+        want          string
+        conflict      bool
+    }{
+        {"header", "key-a", "", "a", false},
+        {"bearer", "", "key-b", "b", false},
+        {"both agree", "key-a", "key-a", "a", false},
+        {"both differ", "key-a", "key-b", "a", true},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            var principal *Principal
+            var warnings []string
+            handler := ks.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                principal = principalFrom(r.Context())
+                warnings = resolveRequestParams(r, paramValues{}).Warnings
+            }))
+            r := httptest.NewRequest(http.MethodPost, "/generate", nil)
+            if c.header != "" {
+                r.Header.Set("X-API-Key", c.header)
+            }
+            if c.token != "" {
+                r.Header.Set("Authorization", "Bearer "+c.token)
+            }
+            handler.ServeHTTP(httptest.NewRecorder(), r)
+
+            if principal == nil || principal.KeyID != c.want {
+                t.Fatalf("principal %+v, want key %s", principal, c.want)
+            }
+            if c.conflict != (len(warnings) == 1) {
+                t.Errorf("warnings %q", warnings)
+            }
+            for _, warning := range warnings {
+                if strings.Contains(warning, "key-a") || strings.Contains(warning, "key-b") {
+                    t.Errorf("warning %q echoes a key", warning)
+                }
+            }
+        })
+    }
+}
+
+// A conflict reaches the caller in the response meta
+func TestE2EParamConflictWarning(t *testing.T) {
+    const model = "cohere.command-r-plus-v1:0"
+    fake.Script(model, fakeReply{Body: `{"response_id":"r","text":"Bonjour","generation_id":"g","finish_reason":"COMPLETE"}`})
+
+    data := `{"prompt":"Say hello","models":["` + model + `"],"timeout_seconds":30}`
+    req, _ := http.NewRequest(http.MethodPost, serviceURL+"/generate?timeout_seconds=10", strings.NewReader(data))
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Request-Timeout", "20")
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("status %d", resp.StatusCode)
+    }
+    var out GenerateResponse
+    decode(t, resp, &out)
+
+    want := `conflicting values for timeout_seconds: using body field "timeout_seconds" ("30"), ignoring X-Request-Timeout header ("20"), query parameter "timeout_seconds" ("10")`
+    if out.Meta == nil || len(out.Meta.Warnings) != 1 || out.Meta.Warnings[0] != want {
+        t.Errorf("meta %+v, want the warning %s", out.Meta, want)
+    }
+}
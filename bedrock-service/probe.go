@@ -0,0 +1,476 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+    "github.com/aws/aws-sdk-go-v2/service/bedrock"
+    "github.com/aws/aws-sdk-go-v2/service/bedrock/types"
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+)
+
+// Probe statuses reported on /models
+const (
+    probeAvailable   = "available"
+    probeUnavailable = "unavailable"
+    probeTimeout     = "probe_timeout"
+    probeAssumed     = "assumed_available" // The model catalog couldn't be read before the model was first checked
+    probeSkipped     = "skipped"           // SKIP_MODEL_TEST: marked available without a check
+)
+
+var (
+    errNotListed          = errors.New("not offered in the model catalog for this region")
+    errLegacy             = errors.New("marked legacy in the model catalog")
+    errNotGranted         = errors.New("model access not granted")
+    errCatalogUnavailable = errors.New("model catalog unavailable")
+)
+
+// ProbeConfig bounds an availability sweep
+type ProbeConfig struct {
+    Timeout     time.Duration // Per-model probe deadline
+    Concurrency int           // Probes run at once
+    Interval    time.Duration // Between background sweeps, 0 to only sweep at startup
+    Deep        bool          // Invoke every model rather than reading the model catalog
+    AllowLegacy bool          // Keep models the catalog marks legacy in rotation
+    Skip        bool          // Mark every model available and never check
+}
+
+// LoadProbeConfig reads MODEL_PROBE_TIMEOUT_SECONDS, MODEL_PROBE_CONCURRENCY,
+// MODEL_PROBE_INTERVAL_SECONDS (default 600), MODEL_PROBE_DEEP and
+// MODEL_PROBE_ALLOW_LEGACY. A deep sweep invokes every model, so
+// cost-sensitive deployments running one can set the interval to 0.
+// SKIP_MODEL_TEST turns checking off altogether.
+func LoadProbeConfig() (ProbeConfig, error) {
+    cfg := ProbeConfig{Timeout: 10 * time.Second, Concurrency: 4, Interval: 10 * time.Minute}
+
+    if v := os.Getenv("MODEL_PROBE_TIMEOUT_SECONDS"); v != "" {
+        seconds, err := strconv.ParseFloat(v, 64)
+        if err != nil || seconds <= 0 {
+            return cfg, fmt.Errorf("invalid MODEL_PROBE_TIMEOUT_SECONDS %q", v)
+        }
+        cfg.Timeout = time.Duration(seconds * float64(time.Second))
+    }
+    if v := os.Getenv("MODEL_PROBE_CONCURRENCY"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return cfg, fmt.Errorf("invalid MODEL_PROBE_CONCURRENCY %q", v)
+        }
+        cfg.Concurrency = n
+    }
+    if v := os.Getenv("MODEL_PROBE_INTERVAL_SECONDS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            return cfg, fmt.Errorf("invalid MODEL_PROBE_INTERVAL_SECONDS %q", v)
+        }
+        cfg.Interval = time.Duration(n) * time.Second
+    }
+    if v := os.Getenv("MODEL_PROBE_DEEP"); v != "" {
+        deep, err := strconv.ParseBool(v)
+        if err != nil {
+            return cfg, fmt.Errorf("invalid MODEL_PROBE_DEEP %q", v)
+        }
+        cfg.Deep = deep
+    }
+    if v := os.Getenv("MODEL_PROBE_ALLOW_LEGACY"); v != "" {
+        allow, err := strconv.ParseBool(v)
+        if err != nil {
+            return cfg, fmt.Errorf("invalid MODEL_PROBE_ALLOW_LEGACY %q", v)
+        }
+        cfg.AllowLegacy = allow
+    }
+    if v := os.Getenv("SKIP_MODEL_TEST"); v != "" {
+        skip, err := strconv.ParseBool(v)
+        if err != nil {
+            return cfg, fmt.Errorf("invalid SKIP_MODEL_TEST %q", v)
+        }
+        cfg.Skip = skip
+    }
+    return cfg, nil
+}
+
+// probeRequestBody is the smallest useful request for the model's API format
+func probeRequestBody(model ModelInfo) map[string]interface{} {
+    if format, ok := imageFormats[model.API]; ok {
+        return format.probeBody()
+    }
+    return formatOf(model).probeBody("Hello")
+}
+
+// modelInvoker sends a probe request; *AccountPool in production
+type modelInvoker interface {
+    InvokeModel(ctx context.Context, origin Origin, input *bedrockruntime.InvokeModelInput) (*bedrockruntime.InvokeModelOutput, *Account, error)
+}
+
+// probeModel sends one probe request within the configured deadline
+func (bc *BedrockClient) probeModel(model ModelInfo, timeout time.Duration) error {
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    body, err := marshalRequestBody(ctx, model.ID, probeRequestBody(model))
+    if err != nil {
+        return err
+    }
+    _, _, err = bc.prober.InvokeModel(ctx, originProbe, &bedrockruntime.InvokeModelInput{
+        Body:        body,
+        ModelId:     aws.String(model.invokeID()),
+        ContentType: aws.String("application/json"),
+    })
+    if err != nil && ctx.Err() == context.DeadlineExceeded {
+        return context.DeadlineExceeded
+    }
+    return err
+}
+
+// probeProfile probes a model through its inference profile, then, when
+// the account can't invoke the profile, through its base model. Reaching
+// only the base model is errProfileFallback.
+func (bc *BedrockClient) probeProfile(model ModelInfo, timeout time.Duration) error {
+    model.ProfileFallback = false
+    err := bc.probeModel(model, timeout)
+    if !isInferenceProfile(model.ID) || !profileUnavailable(err) {
+        return err
+    }
+    model.ProfileFallback = true
+    if baseErr := bc.probeModel(model, timeout); baseErr != nil {
+        return err
+    }
+    return errProfileFallback
+}
+
+// invocationProbes sends each model a probe request, concurrently. Each
+// probe has its own deadline, so one hanging model can't stall the sweep.
+func (bc *BedrockClient) invocationProbes(models []ModelInfo, cfg ProbeConfig) []error {
+    errs := make([]error, len(models))
+    sem := make(chan struct{}, cfg.Concurrency)
+    var wg sync.WaitGroup
+    for i := range models {
+        wg.Add(1)
+        go func(i int, model ModelInfo) {
+            defer wg.Done()
+            sem <- struct{}{}
+            defer func() { <-sem }()
+            errs[i] = bc.probeProfile(model, cfg.Timeout)
+        }(i, models[i])
+    }
+    wg.Wait()
+    return errs
+}
+
+// foundationModels lists the models offered in the accounts' regions, by
+// normalized ID, with their lifecycle status. Accounts in the same region
+// see the same catalog, so each region is listed once.
+func (p *AccountPool) foundationModels(ctx context.Context) (map[string]types.FoundationModelLifecycleStatus, error) {
+    listed := make(map[string]types.FoundationModelLifecycleStatus)
+    regions := make(map[string]bool)
+    for _, account := range p.accounts {
+        if regions[account.Region] {
+            continue
+        }
+        regions[account.Region] = true
+        resp, err := account.control.ListFoundationModels(ctx, &bedrock.ListFoundationModelsInput{})
+        if err != nil {
+            return nil, fmt.Errorf("error listing foundation models for account %s: %v", account.Name, err)
+        }
+        for _, summary := range resp.ModelSummaries {
+            var status types.FoundationModelLifecycleStatus
+            if summary.ModelLifecycle != nil {
+                status = summary.ModelLifecycle.Status
+            }
+            listed[normalizeModelID(aws.ToString(summary.ModelId))] = status
+        }
+    }
+    return listed, nil
+}
+
+// modelAvailability is the part of a GetFoundationModelAvailability answer
+// that says whether an account may invoke a model
+type modelAvailability struct {
+    AuthorizationStatus     string `json:"authorizationStatus"`
+    EntitlementAvailability string `json:"entitlementAvailability"`
+    RegionAvailability      string `json:"regionAvailability"`
+    AgreementAvailability   struct {
+        Status string `json:"status"`
+    } `json:"agreementAvailability"`
+}
+
+// granted reports whether the account can invoke the model, or why not
+func (m modelAvailability) granted() error {
+    if m.AuthorizationStatus == "AUTHORIZED" && m.EntitlementAvailability == "AVAILABLE" &&
+        m.RegionAvailability == "AVAILABLE" && m.AgreementAvailability.Status == "AVAILABLE" {
+        return nil
+    }
+    return fmt.Errorf("%w (authorization %s, entitlement %s, region %s, agreement %s)", errNotGranted,
+        m.AuthorizationStatus, m.EntitlementAvailability, m.RegionAvailability, m.AgreementAvailability.Status)
+}
+
+// controlURL is the account's control plane endpoint
+func (a *Account) controlURL() string {
+    return "https://bedrock." + a.Region + ".amazonaws.com"
+}
+
+// modelAvailability asks the control plane whether the account was granted
+// access to a foundation model. This SDK version has no
+// GetFoundationModelAvailability operation, so the request is signed here,
+// as ApplyGuardrail's is.
+func (a *Account) modelAvailability(ctx context.Context, modelID string) (modelAvailability, error) {
+    var availability modelAvailability
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.controlURL()+"/foundation-model-availability/"+url.PathEscape(modelID), nil)
+    if err != nil {
+        return availability, err
+    }
+    creds, err := a.signing.Credentials.Retrieve(ctx)
+    if err != nil {
+        return availability, fmt.Errorf("error retrieving credentials for account %s: %v", a.Name, err)
+    }
+    sum := sha256.Sum256(nil)
+    if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(sum[:]), "bedrock", a.Region, time.Now()); err != nil {
+        return availability, fmt.Errorf("error signing GetFoundationModelAvailability request: %v", err)
+    }
+
+    var client aws.HTTPClient = http.DefaultClient
+    if a.signing.HTTPClient != nil {
+        client = a.signing.HTTPClient
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return availability, err
+    }
+    defer resp.Body.Close()
+    data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+    if err != nil {
+        return availability, err
+    }
+    if resp.StatusCode != http.StatusOK {
+        return availability, fmt.Errorf("GetFoundationModelAvailability returned %s: %s", resp.Status, data)
+    }
+    if err := json.Unmarshal(data, &availability); err != nil {
+        return availability, fmt.Errorf("error parsing GetFoundationModelAvailability response: %v", err)
+    }
+    return availability, nil
+}
+
+// modelAccess checks that some account was granted the model, since the
+// scheduler may send a request through any of them. An account whose
+// grants can't be read doesn't count against the model: only an explicit
+// answer that no account may invoke it makes it unavailable.
+func (p *AccountPool) modelAccess(ctx context.Context, modelID string) error {
+    var denied error
+    for _, account := range p.accounts {
+        availability, err := account.modelAvailability(ctx, modelID)
+        if err != nil {
+            logWarnf(ctx, "Model access for %s on account %s unknown: %v", modelID, account.Name, err)
+            return nil
+        }
+        if denied = availability.granted(); denied == nil {
+            return nil
+        }
+    }
+    return denied
+}
+
+// catalogProbes checks the models against the control plane instead of
+// invoking them, which costs nothing and uses no quota. A model must be
+// listed in its region's catalog as active, or as legacy with
+// MODEL_PROBE_ALLOW_LEGACY, and granted to an account. An inference profile
+// is checked by the model behind it; one the account can't invoke is found
+// by its first request.
+func (bc *BedrockClient) catalogProbes(models []ModelInfo, cfg ProbeConfig) []error {
+    ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+    defer cancel()
+
+    errs := make([]error, len(models))
+    listed, err := bc.accounts.foundationModels(ctx)
+    if err != nil {
+        logWarnf(ctx, "Model catalog unavailable: %v", err)
+        for i := range errs {
+            errs[i] = errCatalogUnavailable
+        }
+        return errs
+    }
+
+    sem := make(chan struct{}, cfg.Concurrency)
+    var wg sync.WaitGroup
+    for i, model := range models {
+        id := foundationModelID(model.ID)
+        status, ok := listed[id]
+        switch {
+        case !ok:
+            errs[i] = errNotListed
+            continue
+        case status == types.FoundationModelLifecycleStatusLegacy && !cfg.AllowLegacy:
+            errs[i] = errLegacy
+            continue
+        case status == types.FoundationModelLifecycleStatusLegacy:
+            logInfof(ctx, "Model %s (%s) is marked legacy in the model catalog and will be retired", model.Name, model.ID)
+        case status != "" && status != types.FoundationModelLifecycleStatusActive:
+            errs[i] = fmt.Errorf("lifecycle status %s in the model catalog", status)
+            continue
+        }
+
+        wg.Add(1)
+        go func(i int, id string) {
+            defer wg.Done()
+            sem <- struct{}{}
+            defer func() { <-sem }()
+            errs[i] = bc.accounts.modelAccess(ctx, id)
+        }(i, id)
+    }
+    wg.Wait()
+    return errs
+}
+
+// TestModelAvailability checks every configured model: against the model
+// catalog, or with MODEL_PROBE_DEEP by invoking each one. A model whose
+// probe times out keeps the availability it had before. When the catalog
+// can't be read, models already checked keep theirs and the rest are
+// assumed available, so a control plane outage at startup doesn't take the
+// service down with it.
+func (bc *BedrockClient) TestModelAvailability(cfg ProbeConfig) {
+    log.Println("Testing model availability...")
+    start := time.Now()
+
+    models := bc.models()
+    available, unavailable, unchecked := bc.applyProbes(models, bc.checkModels(models, cfg), cfg)
+
+    bc.modelsMu.Lock()
+    bc.lastProbe = time.Now()
+    bc.modelsMu.Unlock()
+    bc.registryReady.Store(true)
+
+    log.Printf("Model availability sweep finished in %v: %d available, %d unavailable, %d unchecked",
+        time.Since(start).Round(time.Millisecond), available, unavailable, unchecked)
+}
+
+// checkModels checks models the way cfg says to, returning each one's error
+func (bc *BedrockClient) checkModels(models []ModelInfo, cfg ProbeConfig) []error {
+    if cfg.Deep {
+        return bc.invocationProbes(models, cfg)
+    }
+    return bc.catalogProbes(models, cfg)
+}
+
+// applyProbes records the results of checking models. Requests keep reading
+// the registry while the checks run and a reload may replace it, so the
+// results are matched by ID and ones for models no longer configured are
+// dropped.
+func (bc *BedrockClient) applyProbes(models []ModelInfo, errs []error, cfg ProbeConfig) (available, unavailable, unchecked int) {
+    results := make(map[string]error, len(models))
+    for i, model := range models {
+        results[model.ID] = errs[i]
+    }
+
+    bc.modelsMu.Lock()
+    defer bc.invalidateModelsListing()
+    defer bc.modelsMu.Unlock()
+
+    for i := range bc.availableModels {
+        model := &bc.availableModels[i]
+        err, checked := results[model.ID]
+        if !checked {
+            continue
+        }
+        previous := model.ProbeStatus
+        var cause string
+        switch {
+        case (err == nil || errors.Is(err, errProfileFallback)) && cfg.Deep:
+            log.Printf("Model %s (%s): AVAILABLE ✓", model.Name, model.ID)
+            if fallback := err != nil; fallback != model.ProfileFallback {
+                log.Printf("Model %s (%s): now invoked as %s", model.Name, model.ID, ModelInfo{ID: model.ID, ProfileFallback: fallback}.invokeID())
+                model.ProfileFallback = fallback
+            }
+            model.Available, model.ProbeStatus = true, probeAvailable
+            delete(bc.breakers, model.ID) // A model that answers a probe starts over
+            cause = "probe succeeded"
+            available++
+        case err == nil:
+            // Being listed says nothing about why a breaker opened
+            log.Printf("Model %s (%s): AVAILABLE ✓", model.Name, model.ID)
+            model.Available, model.ProbeStatus = !bc.breakerOpenLocked(model.ID), probeAvailable
+            cause = "listed in the model catalog and granted"
+            available++
+        case errors.Is(err, context.DeadlineExceeded):
+            log.Printf("Model %s (%s): PROBE TIMED OUT after %v, keeping previous state", model.Name, model.ID, cfg.Timeout)
+            model.ProbeStatus = probeTimeout
+            cause = fmt.Sprintf("probe timed out after %v", cfg.Timeout)
+            unchecked++
+        case errors.Is(err, errCatalogUnavailable):
+            if previous == "" {
+                log.Printf("Model %s (%s): ASSUMED AVAILABLE, the model catalog couldn't be read", model.Name, model.ID)
+                model.Available, model.ProbeStatus = true, probeAssumed
+                cause = err.Error()
+            }
+            unchecked++
+        default:
+            log.Printf("Model %s (%s): UNAVAILABLE - %v", model.Name, model.ID, err)
+            model.Available, model.ProbeStatus = false, probeUnavailable
+            cause = err.Error()
+            unavailable++
+        }
+        metrics.Inc("model_probes_total", "model", model.ID, "status", model.ProbeStatus)
+        if model.ProbeStatus != previous {
+            bc.events.Record(RegistryEvent{
+                Time:    time.Now(),
+                ModelID: model.ID,
+                Type:    registryEventProbe,
+                From:    previous,
+                To:      model.ProbeStatus,
+                Cause:   cause,
+            })
+        }
+    }
+    return available, unavailable, unchecked
+}
+
+// skipModelTest marks every model available without checking any
+func (bc *BedrockClient) skipModelTest() {
+    bc.modelsMu.Lock()
+    defer bc.invalidateModelsListing()
+    defer bc.modelsMu.Unlock()
+
+    for i := range bc.availableModels {
+        bc.availableModels[i].Available, bc.availableModels[i].ProbeStatus = true, probeSkipped
+    }
+    bc.registryReady.Store(true)
+    log.Printf("SKIP_MODEL_TEST set: all %d configured models marked available without checking", len(bc.availableModels))
+}
+
+// RunProbes runs the first sweep, which the server doesn't wait for, then
+// sweeps again every cfg.Interval, so a model that was failing at startup,
+// or was enabled since, comes back without a restart. Sweeps run one at a
+// time and never hold up requests.
+func (bc *BedrockClient) RunProbes(cfg ProbeConfig) {
+    if cfg.Skip {
+        bc.skipModelTest()
+        return
+    }
+    bc.TestModelAvailability(cfg)
+    if cfg.Interval == 0 {
+        return
+    }
+    ticker := time.NewTicker(cfg.Interval)
+    defer ticker.Stop()
+    for range ticker.C {
+        bc.TestModelAvailability(cfg)
+    }
+}
+
+// LastProbe is when the last availability sweep finished, zero before the first
+func (bc *BedrockClient) LastProbe() time.Time {
+    bc.modelsMu.RLock()
+    defer bc.modelsMu.RUnlock()
+    return bc.lastProbe
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "log"
+    "net/http"
+    "net/http/httptest"
+    "regexp"
+    "strconv"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+)
+
+// Deep probes run at most MODEL_PROBE_CONCURRENCY at once, and the sweep logs
+// how long it took
+func TestInvocationProbesBounded(t *testing.T) {
+    const delay = 30 * time.Millisecond
+    var mu sync.Mutex
+    inFlight, peak, calls := 0, 0, 0
+    runtime := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mu.Lock()
+        inFlight++
+        calls++
+        if inFlight > peak {
+            peak = inFlight
+        }
+        mu.Unlock()
+        time.Sleep(delay)
+        mu.Lock()
+        inFlight--
+        mu.Unlock()
+        w.Header().Set("Content-Type", "application/json")
+        w.Write([]byte(`{}`))
+    }))
+    defer runtime.Close()
+    t.Setenv("BEDROCK_ENDPOINT_URL", runtime.URL)
+
+    bc, err := NewBedrockClient()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var buf bytes.Buffer
+    previous := log.Writer()
+    log.SetOutput(&buf)
+    defer log.SetOutput(previous)
+
+    bc.TestModelAvailability(ProbeConfig{Timeout: time.Second, Concurrency: 2, Deep: true})
+
+    models := bc.models()
+    if calls != len(models) || peak != 2 {
+        t.Errorf("%d probes, at most %d at once; want %d, 2", calls, peak, len(models))
+    }
+    for _, m := range models {
+        if !m.Available || m.ProbeStatus != probeAvailable {
+            t.Errorf("%s left %s", m.ID, m.ProbeStatus)
+        }
+    }
+
+    match := regexp.MustCompile(`sweep finished in (\S+):`).FindStringSubmatch(buf.String())
+    if match == nil {
+        t.Fatalf("sweep duration not logged:\n%s", buf.String())
+    }
+    took, err := time.ParseDuration(match[1])
+    if rounds := (len(models) + 1) / 2; err != nil || took < time.Duration(rounds)*delay {
+        t.Errorf("sweep logged as taking %s, want at least %d rounds of %v", match[1], rounds, delay)
+    }
+}
+
+// hangingInvoker answers probes at once, except for the models in hang,
+// which block until their context is done
+type hangingInvoker struct {
+    hang map[string]bool
+}
+
+func (h hangingInvoker) InvokeModel(ctx context.Context, origin Origin, input *bedrockruntime.InvokeModelInput) (*bedrockruntime.InvokeModelOutput, *Account, error) {
+    if h.hang[*input.ModelId] {
+        <-ctx.Done()
+        return nil, nil, ctx.Err()
+    }
+    return &bedrockruntime.InvokeModelOutput{Body: []byte(`{}`)}, nil, nil
+}
+
+// A model whose probe hangs times out on its own deadline: the sweep still
+// finishes in time, and that model keeps the availability it had
+func TestInvocationProbesHanging(t *testing.T) {
+    bc, err := NewBedrockClient()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var buf bytes.Buffer
+    previous := log.Writer()
+    log.SetOutput(&buf)
+    defer log.SetOutput(previous)
+
+    models := bc.models()
+    if len(models) < 4 {
+        t.Fatalf("%d models configured, want at least 4", len(models))
+    }
+    const timeout = 50 * time.Millisecond
+
+    for _, c := range []struct {
+        name        string
+        concurrency int
+        hang        []int // Indexes of the models whose probes hang
+    }{
+        {"one hangs", 2, []int{1}},
+        {"every model hangs", 2, nil},
+        {"every model hangs, one at a time", 1, nil},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            hang := make(map[string]bool)
+            for _, i := range c.hang {
+                hang[models[i].invokeID()] = true
+            }
+            if c.hang == nil {
+                for _, m := range models {
+                    hang[m.invokeID()] = true
+                }
+            }
+            bc.prober = hangingInvoker{hang: hang}
+
+            // The last sweep left every model available
+            bc.modelsMu.Lock()
+            for i := range bc.availableModels {
+                bc.availableModels[i].Available, bc.availableModels[i].ProbeStatus = true, probeAvailable
+            }
+            bc.modelsMu.Unlock()
+
+            // Each round of probes waits out one deadline at most
+            rounds := (len(hang) + c.concurrency - 1) / c.concurrency
+            bound := time.Duration(rounds)*timeout + time.Second
+
+            done := make(chan struct{})
+            start := time.Now()
+            go func() {
+                bc.TestModelAvailability(ProbeConfig{Timeout: timeout, Concurrency: c.concurrency, Deep: true})
+                close(done)
+            }()
+            select {
+            case <-done:
+            case <-time.After(bound):
+                t.Fatalf("sweep still running after %v", bound)
+            }
+            if took := time.Since(start); took < timeout {
+                t.Errorf("sweep took %v, less than the probe deadline it waited out", took)
+            }
+
+            for _, m := range bc.models() {
+                want := probeAvailable
+                if hang[m.invokeID()] {
+                    want = probeTimeout
+                }
+                if !m.Available || m.ProbeStatus != want {
+                    t.Errorf("%s left available %v, %s; want available, %s", m.ID, m.Available, m.ProbeStatus, want)
+                }
+            }
+            if want := `\d+ available, 0 unavailable, ` + strconv.Itoa(len(hang)) + ` unchecked`; !regexp.MustCompile(want).MatchString(buf.String()) {
+                t.Errorf("sweep summary doesn't match %q:\n%s", want, buf.String())
+            }
+            buf.Reset()
+        })
+    }
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "strings"
+    "time"
+)
+
+// A cross-region inference profile ID puts a region group ahead of a model
+// ID, as in "us.anthropic.claude-3-5-sonnet-20241022-v2:0", and Bedrock
+// routes its requests across the group's regions. Profiles are invoked like
+// the model behind them. An account can be offered a model without its
+// profile, so a profile that isn't available falls back to invoking the
+// regional base model, under the same registry entry.
+
+// inferenceProfileGroups are the region groups profile IDs start with
+var inferenceProfileGroups = []string{"us", "eu", "apac", "us-gov"}
+
+// isInferenceProfile reports whether id is a cross-region inference profile
+func isInferenceProfile(id string) bool {
+    return foundationModelID(id) != normalizeModelID(id)
+}
+
+// invokeID is the model ID requests for model are sent to: its own, or the
+// base model's once its profile proved unavailable
+func (m ModelInfo) invokeID() string {
+    if m.ProfileFallback {
+        return foundationModelID(m.ID)
+    }
+    return m.ID
+}
+
+// errProfileFallback reports a deep probe that only reached the base model
+var errProfileFallback = errors.New("inference profile unavailable, the base model answered")
+
+// profileUnavailable reports whether err means the account can't invoke the
+// profile, as opposed to the model failing
+func profileUnavailable(err error) bool {
+    switch classifyError(err) {
+    case "ResourceNotFoundException", "AccessDeniedException":
+        return true
+    }
+    return false
+}
+
+// LoadInferenceProfile reads INFERENCE_PROFILE, the region group whose
+// profiles the built-in Anthropic messages models are invoked through.
+// Unset, they are invoked by their regional base IDs.
+func LoadInferenceProfile() (string, error) {
+    group := strings.ToLower(strings.TrimSpace(os.Getenv("INFERENCE_PROFILE")))
+    if group == "" {
+        return "", nil
+    }
+    for _, known := range inferenceProfileGroups {
+        if group == known {
+            return group, nil
+        }
+    }
+    return "", fmt.Errorf("invalid INFERENCE_PROFILE %q: must be one of %s", group, strings.Join(inferenceProfileGroups, ", "))
+}
+
+// withInferenceProfile moves the config's Anthropic messages models, and the
+// aliases naming them, to the group's inference profiles
+func withInferenceProfile(config ModelConfig, group string) ModelConfig {
+    if group == "" {
+        return config
+    }
+    profiles := make(map[string]string)
+    models := make([]ModelInfo, len(config.Models))
+    for i, model := range config.Models {
+        if model.API == apiMessages && modelVendor(model) == "anthropic" && !isInferenceProfile(model.ID) {
+            profiles[model.ID] = group + "." + model.ID
+            model.ID = profiles[model.ID]
+        }
+        models[i] = model
+    }
+    aliases := make(map[string][]string, len(config.Aliases))
+    for alias, ids := range config.Aliases {
+        members := make([]string, len(ids))
+        for i, id := range ids {
+            if profile, ok := profiles[id]; ok {
+                id = profile
+            }
+            members[i] = id
+        }
+        aliases[alias] = members
+    }
+    config.Models, config.Aliases = models, aliases
+    return config
+}
+
+// noteProfileFailure falls model back to its base model when a request to
+// its profile failed because the account can't invoke the profile. The
+// request itself moves on down the chain; the next one goes to the base
+// model. A deep probe that reaches the profile again moves it back.
+func (bc *BedrockClient) noteProfileFailure(model ModelInfo, err error) {
+    if err == nil || model.ProfileFallback || !isInferenceProfile(model.ID) || !profileUnavailable(err) {
+        return
+    }
+    bc.modelsMu.Lock()
+    defer bc.invalidateModelsListing()
+    defer bc.modelsMu.Unlock()
+
+    for i := range bc.availableModels {
+        entry := &bc.availableModels[i]
+        if entry.ID != model.ID || entry.ProfileFallback {
+            continue
+        }
+        entry.ProfileFallback = true
+        log.Printf("Model %s (%s): inference profile unavailable, invoking %s instead: %v", entry.Name, entry.ID, entry.invokeID(), err)
+        bc.events.Record(RegistryEvent{
+            Time:    time.Now(),
+            ModelID: entry.ID,
+            Type:    registryEventProbe,
+            From:    entry.ID,
+            To:      entry.invokeID(),
+            Cause:   "inference profile unavailable: " + err.Error(),
+        })
+    }
+}
@@ -0,0 +1,135 @@
+package main
+
+import "sort"
+
+// Every model is invoked in the API format its APIType names. A format builds
+// the InvokeModel request bodies, probes included, and reads the responses.
+// Supporting another provider means implementing APIFormat in its own file
+// and registering it in apiFormats; nothing that invokes models changes.
+
+// RequestBuilder builds InvokeModel request bodies in one API format
+type RequestBuilder interface {
+    buildBody(p GenerationParams) map[string]interface{}
+    probeBody(prompt string) map[string]interface{} // The smallest useful request
+}
+
+// ResponseParser reads decoded InvokeModel responses in one API format
+type ResponseParser interface {
+    provider() string // Stop reason and response field vocabulary, see finishreason.go and drift.go
+    stopReason(response map[string]interface{}) string
+
+    // parseResponse fills in result's text, usage and matched stop sequence,
+    // reporting false when the text isn't where the format puts it. Usage
+    // left zero is taken from Bedrock's headers.
+    parseResponse(response map[string]interface{}, p GenerationParams, result *GenerationResult) bool
+}
+
+// APIFormat builds requests and reads responses in the same format
+type APIFormat interface {
+    RequestBuilder
+    ResponseParser
+}
+
+// apiFormats holds the format of each APIType; the catalog accepts exactly these
+var apiFormats = map[APIType]APIFormat{
+    apiMessages: messagesFormat{},
+    apiLegacy:   legacyFormat{},
+    apiJamba:    jambaFormat{},
+    apiTitan:    titanFormat{},
+    apiLlama:    llamaFormat{},
+
+    apiMistral:     mistralFormat{},
+    apiMistralChat: mistralChatFormat{},
+    apiCohere:      cohereFormat{},
+    apiNova:        novaFormat{},
+}
+
+// apiTypeNames lists every APIType, sorted
+func apiTypeNames() []string {
+    names := make([]string, 0, len(apiFormats))
+    for apiType := range apiFormats {
+        names = append(names, string(apiType))
+    }
+    sort.Strings(names)
+    return names
+}
+
+// formatOf returns the format model is invoked in
+func formatOf(model ModelInfo) APIFormat {
+    if format, ok := apiFormats[model.API]; ok {
+        return format
+    }
+    return legacyFormat{}
+}
+
+// messagesFormat is the Anthropic messages API
+type messagesFormat struct{}
+
+func (messagesFormat) buildBody(p GenerationParams) map[string]interface{} {
+    return buildMessagesBody(p)
+}
+
+func (messagesFormat) probeBody(prompt string) map[string]interface{} {
+    return map[string]interface{}{
+        "anthropic_version": "bedrock-2023-05-31",
+        "max_tokens":        10,
+        "messages": []map[string]string{
+            {"role": "user", "content": prompt},
+        },
+    }
+}
+
+func (messagesFormat) provider() string { return providerAnthropicMessages }
+
+func (messagesFormat) stopReason(response map[string]interface{}) string {
+    return rawFinishReason(response)
+}
+
+func (messagesFormat) parseResponse(response map[string]interface{}, p GenerationParams, result *GenerationResult) bool {
+    result.InputTokens, result.OutputTokens = messageUsage(response)
+    reported, _ := response["stop_sequence"].(string)
+    result.StopSequence = matchedStopSequence(p.StopSequences, reported)
+    if content, ok := response["content"].([]interface{}); ok && len(content) > 0 {
+        if firstContent, ok := content[0].(map[string]interface{}); ok {
+            if text, ok := firstContent["text"].(string); ok {
+                result.Text = text
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// legacyFormat is Anthropic text completions
+type legacyFormat struct{}
+
+func (legacyFormat) buildBody(p GenerationParams) map[string]interface{} {
+    return buildLegacyBody(p)
+}
+
+func (legacyFormat) probeBody(prompt string) map[string]interface{} {
+    return map[string]interface{}{
+        "prompt":               "\n\nHuman: " + prompt + "\n\nAssistant:",
+        "max_tokens_to_sample": 10,
+    }
+}
+
+func (legacyFormat) provider() string { return providerAnthropicLegacy }
+
+func (legacyFormat) stopReason(response map[string]interface{}) string {
+    return rawFinishReason(response)
+}
+
+func (legacyFormat) parseResponse(response map[string]interface{}, p GenerationParams, result *GenerationResult) bool {
+    reported, _ := response["stop"].(string)
+    result.StopSequence = matchedStopSequence(p.StopSequences, reported)
+    completion, ok := response["completion"].(string)
+    if !ok {
+        return false
+    }
+    result.Text = completion
+    // Text completions report no usage
+    result.InputTokens, result.OutputTokens = estimateInputTokens(ModelInfo{API: apiLegacy}, p), estimateTokens(completion)
+    result.TokensEstimated = true
+    return true
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "flag"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// The provider conformance fixtures live in testdata/fixtures/<api>/<name>,
+// one directory per recorded response: request.json is what the caller
+// asked for, body.json is the InvokeModel body the service sends for it,
+// response.json is the body as the provider sent it back, and expected.json
+// is what the service read from it. Names start with the month the shape
+// was seen, so a provider's changes sit side by side.
+//
+// When a builder or parser change is meant to change what's sent or read,
+// regenerate the golden files and review the diff:
+//
+//     go test -run TestProviderConformance -update
+
+var update = flag.Bool("update", false, "rewrite the golden files under testdata: provider fixture results and the status page")
+
+// fixtureRequest is a fixture's request.json
+type fixtureRequest struct {
+    Note           string   `json:"note"` // What the fixture covers
+    Model          string   `json:"model"`
+    Prompt         string        `json:"prompt"`
+    System         *string       `json:"system,omitempty"`
+    History        []ChatMessage `json:"history,omitempty"` // Earlier turns, oldest first
+    StopSequences  []string      `json:"stop_sequences,omitempty"`
+    GuardrailTrace bool          `json:"guardrail_trace,omitempty"`
+}
+
+// fixtureResult is a fixture's expected.json
+type fixtureResult struct {
+    Text            string   `json:"text"`
+    InputTokens     int      `json:"input_tokens"`
+    OutputTokens    int      `json:"output_tokens"`
+    TokensEstimated bool     `json:"tokens_estimated,omitempty"`
+    FinishReason    string   `json:"finish_reason"`
+    FinishReasonRaw string   `json:"finish_reason_raw"`
+    StopSequence    string   `json:"stop_sequence,omitempty"`
+    Filtered        bool     `json:"filtered,omitempty"`
+    FilterCategory  string   `json:"filter_category,omitempty"`
+    GuardrailTrace  bool     `json:"guardrail_trace,omitempty"` // A trace was read
+    UnknownFields   []string `json:"unknown_fields,omitempty"`  // Counted as schema drift
+    Error           string   `json:"error,omitempty"`
+}
+
+func TestProviderConformance(t *testing.T) {
+    for apiType, format := range apiFormats {
+        dirs, _ := filepath.Glob(filepath.Join("testdata", "fixtures", string(apiType), "*"))
+        if len(dirs) == 0 {
+            t.Errorf("no fixtures for API format %s", apiType)
+        }
+        for _, dir := range dirs {
+            apiType, format, dir := apiType, format, dir
+            t.Run(string(apiType)+"/"+filepath.Base(dir), func(t *testing.T) {
+                var req fixtureRequest
+                readFixture(t, filepath.Join(dir, "request.json"), &req)
+                body, err := os.ReadFile(filepath.Join(dir, "response.json"))
+                if err != nil {
+                    t.Fatal(err)
+                }
+                model := ModelInfo{ID: req.Model, Name: req.Model, API: apiType}
+                golden(t, filepath.Join(dir, "body.json"), req.Note, buildRequestBody(model, fixtureParams(req)))
+                golden(t, filepath.Join(dir, "expected.json"), req.Note, conformanceResult(t, apiType, format, req, body))
+            })
+        }
+    }
+}
+
+// golden compares v, as indented JSON, with a golden file, or rewrites the
+// file with -update
+func golden(t *testing.T, path, note string, v interface{}) {
+    t.Helper()
+    got, err := json.MarshalIndent(v, "", "    ")
+    if err != nil {
+        t.Fatal(err)
+    }
+    got = append(got, '\n')
+
+    if *update {
+        if err := os.WriteFile(path, got, 0644); err != nil {
+            t.Fatal(err)
+        }
+        return
+    }
+    want, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatalf("%v; run with -update to create it", err)
+    }
+    if !bytes.Equal(got, want) {
+        t.Errorf("%s: %s\ngot:\n%s\nwant:\n%s", path, note, got, want)
+    }
+}
+
+// fixtureParams are the generation parameters a fixture's request asks for
+func fixtureParams(req fixtureRequest) GenerationParams {
+    p := GenerationParams{Prompt: req.Prompt, SystemPrompt: req.System, History: req.History, StopSequences: req.StopSequences, Origin: originUser}.withDefaults()
+    if req.GuardrailTrace {
+        p.Guardrail = &Guardrail{ID: "gr-fixture", Version: "1", Trace: true}
+    }
+    return p
+}
+
+// conformanceResult reads a fixture's response the way invokeModel does
+func conformanceResult(t *testing.T, apiType APIType, format APIFormat, req fixtureRequest, body []byte) fixtureResult {
+    t.Helper()
+    model := ModelInfo{ID: req.Model, Name: req.Model, API: apiType}
+    p := fixtureParams(req)
+
+    result := &GenerationResult{ModelName: model.Name, ModelID: model.ID, Sampling: p.sampling()}
+    var out fixtureResult
+    if err := readInvokeResponse(model, p, body, result); err != nil {
+        out.Error = err.Error()
+    }
+    var response map[string]interface{}
+    if err := json.Unmarshal(body, &response); err == nil {
+        out.UnknownFields = unknownFields(format.provider(), response)
+    }
+
+    out.Text = result.Text
+    out.InputTokens, out.OutputTokens, out.TokensEstimated = result.InputTokens, result.OutputTokens, result.TokensEstimated
+    out.FinishReason, out.FinishReasonRaw, out.StopSequence = result.FinishReason, result.FinishReasonRaw, result.StopSequence
+    out.Filtered, out.FilterCategory = result.Filtered, result.FilterCategory
+    out.GuardrailTrace = result.GuardrailTrace != nil
+    return out
+}
+
+func readFixture(t *testing.T, path string, v interface{}) {
+    t.Helper()
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := json.Unmarshal(data, v); err != nil {
+        t.Fatalf("%s: %v", path, err)
+    }
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// RateDecision is the outcome of a rate limit check
+type RateDecision struct {
+    Allowed   bool
+    Limit     int
+    Remaining int
+    ResetAt   time.Time // End of the current window
+}
+
+// RateLimiter counts requests per key in fixed windows. Implementations are
+// selected with RATE_LIMIT_BACKEND and must be safe for concurrent use.
+type RateLimiter interface {
+    Allow(key string, now time.Time) RateDecision
+}
+
+// RateLimitConfig holds the settings shared by every limiter backend
+type RateLimitConfig struct {
+    Backend string
+    Limit   int           // Requests allowed per key per window
+    Window  time.Duration
+}
+
+// LoadRateLimitConfig reads RATE_LIMIT_BACKEND, RATE_LIMIT_REQUESTS and
+// RATE_LIMIT_WINDOW_SECONDS. A zero Limit means rate limiting is disabled.
+func LoadRateLimitConfig() (RateLimitConfig, error) {
+    cfg := RateLimitConfig{Backend: "memory", Window: time.Minute}
+
+    if v := os.Getenv("RATE_LIMIT_BACKEND"); v != "" {
+        cfg.Backend = v
+    }
+    if v := os.Getenv("RATE_LIMIT_REQUESTS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            return cfg, fmt.Errorf("invalid RATE_LIMIT_REQUESTS %q", v)
+        }
+        cfg.Limit = n
+    }
+    if v := os.Getenv("RATE_LIMIT_WINDOW_SECONDS"); v != "" {
+        seconds, err := strconv.Atoi(v)
+        if err != nil || seconds <= 0 {
+            return cfg, fmt.Errorf("invalid RATE_LIMIT_WINDOW_SECONDS %q", v)
+        }
+        cfg.Window = time.Duration(seconds) * time.Second
+    }
+    return cfg, nil
+}
+
+// NewRateLimiter builds the configured backend, or returns nil when rate
+// limiting is disabled
+func NewRateLimiter(cfg RateLimitConfig) (RateLimiter, error) {
+    if cfg.Limit == 0 {
+        return nil, nil
+    }
+    switch cfg.Backend {
+    case "memory":
+        log.Printf("Rate limiting: %d requests per %v per key (in-memory)", cfg.Limit, cfg.Window)
+        return NewMemoryLimiter(cfg.Limit, cfg.Window), nil
+    case "gossip":
+        gossipCfg, err := LoadGossipConfig()
+        if err != nil {
+            return nil, err
+        }
+        log.Printf("Rate limiting: %d requests per %v per key (peer-synchronized)", cfg.Limit, cfg.Window)
+        return NewGossipLimiter(cfg.Limit, cfg.Window, gossipCfg), nil
+    }
+    return nil, fmt.Errorf("invalid RATE_LIMIT_BACKEND %q (expected memory or gossip)", cfg.Backend)
+}
+
+// windowStart returns the start of the fixed window containing now
+func windowStart(now time.Time, window time.Duration) time.Time {
+    return now.Truncate(window)
+}
+
+// windowCounts holds the per-key counts of one window
+type windowCounts struct {
+    start  time.Time
+    counts map[string]int
+}
+
+// roll resets the counts when now has moved into a later window
+func (wc *windowCounts) roll(now time.Time, window time.Duration) {
+    if start := windowStart(now, window); !start.Equal(wc.start) {
+        wc.start = start
+        wc.counts = make(map[string]int)
+    }
+}
+
+// MemoryLimiter enforces limits within a single instance
+type MemoryLimiter struct {
+    limit  int
+    window time.Duration
+
+    mu      sync.Mutex
+    current windowCounts
+}
+
+func NewMemoryLimiter(limit int, window time.Duration) *MemoryLimiter {
+    return &MemoryLimiter{limit: limit, window: window}
+}
+
+func (ml *MemoryLimiter) Allow(key string, now time.Time) RateDecision {
+    ml.mu.Lock()
+    defer ml.mu.Unlock()
+
+    ml.current.roll(now, ml.window)
+    decision := RateDecision{Limit: ml.limit, ResetAt: ml.current.start.Add(ml.window)}
+    used := ml.current.counts[key]
+    if used >= ml.limit {
+        return decision
+    }
+    ml.current.counts[key] = used + 1
+    decision.Allowed = true
+    decision.Remaining = ml.limit - used - 1
+    return decision
+}
+
+// rateLimitKey identifies the caller: the API key ID, or the client address
+// when authentication is disabled
+func rateLimitKey(r *http.Request) string {
+    if p := principalFrom(r.Context()); p != anonymousPrincipal {
+        return "key:" + p.KeyID
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    return "ip:" + host
+}
+
+// Backoff hint tuning: how much each signal slows a client down, and the cap
+const (
+    backoffPerQueued   = 50 * time.Millisecond
+    backoffPerThrottle = 250 * time.Millisecond
+    maxBackoffHint     = 10 * time.Second
+)
+
+// backoffInputs are the signals behind X-Backoff-Hint-Ms
+type backoffInputs struct {
+    Limit      int           // Zero when rate limiting is disabled
+    Remaining  int
+    ResetIn    time.Duration
+    QueueDepth int
+    Throttle   float64 // Decaying count of recent Bedrock throttles
+}
+
+// backoffHint suggests how long a well-behaved client should wait before its
+// next request. Once half the window's quota is used it paces the remaining
+// requests evenly over what's left of the window; queueing and upstream
+// throttling add to that.
+func backoffHint(in backoffInputs) time.Duration {
+    var hint time.Duration
+    if in.Limit > 0 && in.Remaining*2 < in.Limit && in.ResetIn > 0 {
+        hint = in.ResetIn / time.Duration(in.Remaining+1)
+    }
+    hint += time.Duration(in.QueueDepth) * backoffPerQueued
+    hint += time.Duration(in.Throttle * float64(backoffPerThrottle))
+    if hint > maxBackoffHint {
+        hint = maxBackoffHint
+    }
+    return hint
+}
+
+// setRateLimitHeaders tells clients where they stand so they can slow down
+// before a 429. X-RateLimit-Reset is the window end in Unix seconds.
+func setRateLimitHeaders(w http.ResponseWriter, decision *RateDecision, now time.Time) {
+    in := backoffInputs{QueueDepth: load.QueueDepth(), Throttle: throttlePressure.Value(now)}
+    h := w.Header()
+    if decision != nil {
+        h.Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+        h.Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+        h.Set("X-RateLimit-Reset", strconv.FormatInt(decision.ResetAt.Unix(), 10))
+        in.Limit, in.Remaining, in.ResetIn = decision.Limit, decision.Remaining, decision.ResetAt.Sub(now)
+    }
+    h.Set("X-Backoff-Hint-Ms", strconv.FormatInt(backoffHint(in).Milliseconds(), 10))
+}
+
+// retryAfterSeconds rounds a wait up to whole seconds, at least one
+func retryAfterSeconds(wait time.Duration) int {
+    seconds := int(wait.Seconds() + 0.999)
+    if seconds < 1 {
+        seconds = 1
+    }
+    return seconds
+}
+
+// rateLimitMiddleware rejects callers over their limit with 429 and sets the
+// rate limit headers on everything else. It must run after the key store
+// middleware so the principal is known. A nil limiter lets everything through.
+// A key's own limits, see keylimits.go, are checked first. Requests sent with
+// X-Reservation-ID are limited by the reservation instead.
+func rateLimitMiddleware(limiter RateLimiter, reservations *ReservationStore) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if isPublicPath(r.URL.Path) {
+                next.ServeHTTP(w, r)
+                return
+            }
+
+            now := time.Now()
+            if id := r.Header.Get("X-Reservation-ID"); id != "" {
+                if r, ok := admitReserved(w, r, reservations, id, now); ok {
+                    next.ServeHTTP(w, r)
+                }
+                return
+            }
+            if !admitKeyLimits(w, r, keyLimits, now) {
+                return
+            }
+            if limiter == nil {
+                setRateLimitHeaders(w, nil, now)
+                next.ServeHTTP(w, r)
+                return
+            }
+
+            decision := limiter.Allow(rateLimitKey(r), now)
+            setRateLimitHeaders(w, &decision, now)
+            if !decision.Allowed {
+                metrics.Inc("rate_limited_requests_total", "path", r.URL.Path)
+                requestRecordFrom(r.Context()).Policy("rate limit: %d requests per window exhausted until %s", decision.Limit, decision.ResetAt.UTC().Format(time.RFC3339))
+                resetAt := decision.ResetAt.UTC()
+                writeAPIError(w, r, http.StatusTooManyRequests, APIError{
+                    Code:              ErrCodeRateLimited,
+                    Message:           "Rate limit exceeded",
+                    RetryAfterSeconds: retryAfterSeconds(decision.ResetAt.Sub(now)),
+                    Limit:             decision.Limit,
+                    LimitUnit:         "requests_per_window",
+                    ResetAt:           &resetAt,
+                })
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
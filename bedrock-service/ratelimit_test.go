@@ -0,0 +1,94 @@
+package main
+
+import (
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+// The hint paces the rest of the quota once half of it is used, and grows
+// with queueing and throttling up to its cap
+func TestBackoffHint(t *testing.T) {
+    for _, c := range []struct {
+        name string
+        in   backoffInputs
+        want time.Duration
+    }{
+        {"no signals", backoffInputs{}, 0},
+        {"limiting disabled", backoffInputs{Remaining: 0, ResetIn: time.Minute}, 0},
+        {"under half used", backoffInputs{Limit: 100, Remaining: 60, ResetIn: time.Minute}, 0},
+        {"exactly half used", backoffInputs{Limit: 100, Remaining: 50, ResetIn: time.Minute}, 0},
+        {"just past half", backoffInputs{Limit: 100, Remaining: 49, ResetIn: 50 * time.Second}, time.Second},
+        {"last request", backoffInputs{Limit: 100, Remaining: 0, ResetIn: 8 * time.Second}, 8 * time.Second},
+        {"odd limit", backoffInputs{Limit: 5, Remaining: 2, ResetIn: 9 * time.Second}, 3 * time.Second},
+        {"window already reset", backoffInputs{Limit: 100, Remaining: 0, ResetIn: -time.Second}, 0},
+        {"queued", backoffInputs{QueueDepth: 4}, 200 * time.Millisecond},
+        {"throttled", backoffInputs{Throttle: 2.5}, 625 * time.Millisecond},
+        {"all together", backoffInputs{Limit: 10, Remaining: 1, ResetIn: 2 * time.Second, QueueDepth: 2, Throttle: 1}, 1350 * time.Millisecond},
+        {"capped", backoffInputs{Limit: 10, Remaining: 0, ResetIn: time.Minute}, maxBackoffHint},
+        {"capped by queueing", backoffInputs{QueueDepth: 1000}, maxBackoffHint},
+    } {
+        if got := backoffHint(c.in); got != c.want {
+            t.Errorf("%s: %+v hints %v, want %v", c.name, c.in, got, c.want)
+        }
+    }
+}
+
+// The throttle score halves every throttleHalfLife, and a new throttle adds
+// to what's left of it
+func TestThrottleGauge(t *testing.T) {
+    var g throttleGauge
+    now := time.Now()
+    if v := g.Value(now); v != 0 {
+        t.Fatalf("empty gauge reads %v", v)
+    }
+    g.record(now)
+    g.record(now)
+    for _, c := range []struct {
+        after time.Duration
+        want  float64
+    }{
+        {0, 2},
+        {throttleHalfLife, 1},
+        {2 * throttleHalfLife, 0.5},
+    } {
+        if v := g.Value(now.Add(c.after)); v < c.want-1e-9 || v > c.want+1e-9 {
+            t.Errorf("after %v: %v, want %v", c.after, v, c.want)
+        }
+    }
+    g.record(now.Add(throttleHalfLife))
+    if v := g.Value(now.Add(throttleHalfLife)); v < 2-1e-9 || v > 2+1e-9 {
+        t.Errorf("after another throttle: %v, want 2", v)
+    }
+}
+
+func TestSetRateLimitHeaders(t *testing.T) {
+    withLoad(t)
+    score, updated := throttlePressure.score.Load(), throttlePressure.updated.Load()
+    throttlePressure.score.Store(0)
+    defer func() {
+        throttlePressure.score.Store(score)
+        throttlePressure.updated.Store(updated)
+    }()
+
+    now := time.Unix(1700000000, 0)
+    w := httptest.NewRecorder()
+    setRateLimitHeaders(w, &RateDecision{Allowed: true, Limit: 10, Remaining: 3, ResetAt: now.Add(8 * time.Second)}, now)
+    for header, want := range map[string]string{
+        "X-RateLimit-Limit":     "10",
+        "X-RateLimit-Remaining": "3",
+        "X-RateLimit-Reset":     "1700000008",
+        "X-Backoff-Hint-Ms":     "2000",
+    } {
+        if got := w.Header().Get(header); got != want {
+            t.Errorf("%s %q, want %q", header, got, want)
+        }
+    }
+
+    // Without a limiter only the hint is sent
+    w = httptest.NewRecorder()
+    setRateLimitHeaders(w, nil, now)
+    if got := w.Header().Get("X-Backoff-Hint-Ms"); got != "0" || w.Header().Get("X-RateLimit-Limit") != "" {
+        t.Errorf("headers %v, want only a zero hint", w.Header())
+    }
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Dependencies /readyz knows about, as named in READYZ_REQUIRED
+var readinessDependencyNames = []string{"bedrock", "kms", "results_bucket"}
+
+// Aggregate states reported by /readyz
+const (
+    readinessReady    = "ready"
+    readinessDegraded = "degraded"  // An optional dependency is failing
+    readinessNotReady = "not_ready" // A required dependency is failing
+)
+
+// DependencyCheck reports whether a backend is usable. It should return
+// promptly once ctx is done; one that doesn't is still cut off at the
+// check timeout.
+type DependencyCheck func(ctx context.Context) error
+
+// ReadinessConfig controls the dependency checks behind /readyz
+type ReadinessConfig struct {
+    Timeout  time.Duration   // Per check; checks run concurrently, so also about the endpoint's budget
+    CacheTTL time.Duration   // How long a result is reused before the check runs again
+    Required map[string]bool // Overrides each dependency's own default, nil to keep them
+}
+
+// LoadReadinessConfig reads READYZ_CHECK_TIMEOUT_MS (default 500),
+// READYZ_CACHE_MS (default 2000) and READYZ_REQUIRED, a comma-separated list
+// of the dependencies whose failure makes the service not ready. Unset, the
+// Bedrock model registry and KMS are required and the results bucket isn't.
+func LoadReadinessConfig() (ReadinessConfig, error) {
+    cfg := ReadinessConfig{Timeout: 500 * time.Millisecond, CacheTTL: 2 * time.Second}
+
+    ints := []struct {
+        env string
+        min int
+        dst *time.Duration
+    }{
+        {"READYZ_CHECK_TIMEOUT_MS", 1, &cfg.Timeout},
+        {"READYZ_CACHE_MS", 0, &cfg.CacheTTL},
+    }
+    for _, opt := range ints {
+        if v := os.Getenv(opt.env); v != "" {
+            n, err := strconv.Atoi(v)
+            if err != nil || n < opt.min {
+                return cfg, fmt.Errorf("invalid %s %q", opt.env, v)
+            }
+            *opt.dst = time.Duration(n) * time.Millisecond
+        }
+    }
+
+    if v, ok := os.LookupEnv("READYZ_REQUIRED"); ok {
+        cfg.Required = make(map[string]bool)
+        for _, name := range strings.Split(v, ",") {
+            name = strings.TrimSpace(name)
+            if name == "" {
+                continue
+            }
+            if !containsString(readinessDependencyNames, name) {
+                return cfg, fmt.Errorf("invalid READYZ_REQUIRED entry %q; dependencies are %s", name, strings.Join(readinessDependencyNames, ", "))
+            }
+            cfg.Required[name] = true
+        }
+    }
+    return cfg, nil
+}
+
+// DependencyStatus is one dependency's entry in the /readyz response
+type DependencyStatus struct {
+    Name        string     `json:"name"`
+    Required    bool       `json:"required"`
+    Status      string     `json:"status"` // ok, failed or timeout
+    LatencyMs   int64      `json:"latency_ms"`
+    CheckedAt   time.Time  `json:"checked_at"`
+    Cached      bool       `json:"cached"`
+    LastError   string     `json:"last_error,omitempty"` // Kept after the dependency recovers
+    LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// ReadinessResponse is the body of GET /readyz
+type ReadinessResponse struct {
+    Status       string             `json:"status"`
+    Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// dependency is one registered check with its last result. At most one run
+// of a check is in flight; callers that arrive while it runs wait on it
+// rather than starting another.
+type dependency struct {
+    name     string
+    required bool
+    check    DependencyCheck
+
+    mu      sync.Mutex
+    last    DependencyStatus
+    checked bool
+    running chan struct{} // Closed when the run in flight finishes, nil when none is
+    started time.Time
+}
+
+// Readiness runs the registered dependency checks for /readyz
+type Readiness struct {
+    cfg  ReadinessConfig
+    deps []*dependency
+}
+
+func NewReadiness(cfg ReadinessConfig) *Readiness {
+    return &Readiness{cfg: cfg}
+}
+
+// Register adds a dependency check. required is its default, which
+// READYZ_REQUIRED overrides. Registration happens at startup, before the
+// router serves requests.
+func (rd *Readiness) Register(name string, required bool, check DependencyCheck) {
+    if rd.cfg.Required != nil {
+        required = rd.cfg.Required[name]
+    }
+    rd.deps = append(rd.deps, &dependency{name: name, required: required, check: check})
+    log.Printf("Readiness check %s registered (required: %v)", name, required)
+}
+
+// Check runs every check concurrently, reusing results younger than the
+// cache TTL, and aggregates them. It returns within about one check timeout
+// however the checks behave.
+func (rd *Readiness) Check() ReadinessResponse {
+    statuses := make([]DependencyStatus, len(rd.deps))
+    var wg sync.WaitGroup
+    for i, dep := range rd.deps {
+        wg.Add(1)
+        go func(i int, dep *dependency) {
+            defer wg.Done()
+            statuses[i] = dep.status(rd.cfg.Timeout, rd.cfg.CacheTTL)
+        }(i, dep)
+    }
+    wg.Wait()
+
+    response := ReadinessResponse{Status: readinessReady, Dependencies: statuses}
+    for _, s := range statuses {
+        if s.Status == "ok" {
+            continue
+        }
+        if s.Required {
+            response.Status = readinessNotReady
+        } else if response.Status == readinessReady {
+            response.Status = readinessDegraded
+        }
+    }
+    return response
+}
+
+// status returns the dependency's cached result, or runs the check and
+// waits for it no longer than timeout after the run started
+func (d *dependency) status(timeout, ttl time.Duration) DependencyStatus {
+    d.mu.Lock()
+    if d.checked && d.running == nil && time.Since(d.last.CheckedAt) < ttl {
+        cached := d.last
+        d.mu.Unlock()
+        cached.Cached = true
+        return cached
+    }
+    if d.running == nil {
+        d.running, d.started = make(chan struct{}), time.Now()
+        go d.run(d.running, timeout)
+    }
+    running, started := d.running, d.started
+    d.mu.Unlock()
+
+    wait := time.NewTimer(timeout - time.Since(started))
+    defer wait.Stop()
+    select {
+    case <-running:
+        d.mu.Lock()
+        defer d.mu.Unlock()
+        return d.last
+    case <-wait.C:
+    }
+
+    // The check ignored its deadline. The run is left to finish on its own,
+    // keeping later requests from stacking up more of them.
+    status := DependencyStatus{
+        Name:      d.name,
+        Required:  d.required,
+        Status:    "timeout",
+        LatencyMs: time.Since(started).Milliseconds(),
+        CheckedAt: started,
+        LastError: fmt.Sprintf("no answer within %v", timeout),
+    }
+    now := time.Now()
+    status.LastErrorAt = &now
+    return status
+}
+
+// run performs one check and records its result
+func (d *dependency) run(done chan struct{}, timeout time.Duration) {
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    started := time.Now()
+    err := d.check(ctx)
+    elapsed := time.Since(started)
+
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    status := DependencyStatus{
+        Name:        d.name,
+        Required:    d.required,
+        Status:      "ok",
+        LatencyMs:   elapsed.Milliseconds(),
+        CheckedAt:   started,
+        LastError:   d.last.LastError,
+        LastErrorAt: d.last.LastErrorAt,
+    }
+    if err == nil && elapsed > timeout {
+        err = fmt.Errorf("answered after %v, past the %v timeout", elapsed.Round(time.Millisecond), timeout)
+    }
+    if err != nil {
+        status.Status = "failed"
+        if ctx.Err() == context.DeadlineExceeded {
+            status.Status = "timeout"
+        }
+        now := time.Now()
+        status.LastError, status.LastErrorAt = err.Error(), &now
+        if d.last.Status != status.Status {
+            logWarnf(ctx, "Readiness check %s %s: %v", d.name, status.Status, err)
+        }
+    } else if d.checked && d.last.Status != "ok" {
+        logInfof(ctx, "Readiness check %s recovered", d.name)
+    }
+    d.last, d.checked = status, true
+    d.running = nil
+    close(done)
+}
+
+// readyzHandler reports 200 when ready or degraded and 503 when a required
+// dependency is failing, so load balancers only drain on the latter
+func readyzHandler(rd *Readiness) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        response := rd.Check()
+        // Clients and proxies shouldn't cache it; the service does that itself
+        w.Header().Set("Cache-Control", "no-store")
+        if response.Status == readinessNotReady {
+            w.Header().Set("Content-Type", "application/json")
+            w.WriteHeader(http.StatusServiceUnavailable)
+            json.NewEncoder(w).Encode(response)
+            return
+        }
+        writeJSON(w, r, response)
+    }
+}
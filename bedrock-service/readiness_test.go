@@ -0,0 +1,202 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// readyz calls the handler and decodes its response
+func readyz(t *testing.T, rd *Readiness) (int, ReadinessResponse) {
+    t.Helper()
+    rec := httptest.NewRecorder()
+    readyzHandler(rd)(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+    var response ReadinessResponse
+    if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+        t.Fatal(err)
+    }
+    return rec.Code, response
+}
+
+// statusOf finds a dependency's entry
+func statusOf(response ReadinessResponse, name string) DependencyStatus {
+    for _, s := range response.Dependencies {
+        if s.Name == name {
+            return s
+        }
+    }
+    return DependencyStatus{}
+}
+
+// A check that hangs, whether or not it honours its context, is cut off at
+// the check timeout and /readyz still answers within its budget
+func TestReadinessHangingCheck(t *testing.T) {
+    const timeout = 50 * time.Millisecond
+    release := make(chan struct{})
+    defer close(release)
+
+    rd := NewReadiness(ReadinessConfig{Timeout: timeout})
+    rd.Register("kms", true, func(ctx context.Context) error {
+        <-ctx.Done()
+        return ctx.Err()
+    })
+    rd.Register("results_bucket", false, func(ctx context.Context) error {
+        <-release // Ignores its deadline
+        return nil
+    })
+    rd.Register("bedrock", true, func(ctx context.Context) error { return nil })
+
+    for round := 1; round <= 2; round++ {
+        start := time.Now()
+        code, response := readyz(t, rd)
+        if took := time.Since(start); took > timeout+250*time.Millisecond {
+            t.Errorf("round %d: /readyz took %v with a %v check timeout", round, took, timeout)
+        }
+        if code != http.StatusServiceUnavailable || response.Status != readinessNotReady {
+            t.Errorf("round %d: %d %s, want 503 %s", round, code, response.Status, readinessNotReady)
+        }
+        for _, name := range []string{"kms", "results_bucket"} {
+            if s := statusOf(response, name); s.Status != "timeout" || s.LastError == "" || s.LastErrorAt == nil {
+                t.Errorf("round %d: %s %+v, want a timeout with its error", round, name, s)
+            }
+        }
+        if s := statusOf(response, "bedrock"); s.Status != "ok" {
+            t.Errorf("round %d: bedrock %+v", round, s)
+        }
+    }
+}
+
+// Results are reused for the cache TTL, and callers arriving while a check
+// runs share that run
+func TestReadinessCache(t *testing.T) {
+    const ttl = 100 * time.Millisecond
+    var runs atomic.Int32
+    gate := make(chan struct{})
+    rd := NewReadiness(ReadinessConfig{Timeout: time.Second, CacheTTL: ttl})
+    rd.Register("kms", true, func(ctx context.Context) error {
+        runs.Add(1)
+        <-gate
+        return nil
+    })
+
+    var wg sync.WaitGroup
+    for i := 0; i < 5; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            rd.Check()
+        }()
+    }
+    time.Sleep(20 * time.Millisecond)
+    close(gate)
+    wg.Wait()
+    if n := runs.Load(); n != 1 {
+        t.Errorf("%d runs for concurrent callers, want them to share one", n)
+    }
+
+    if s := statusOf(rd.Check(), "kms"); !s.Cached || runs.Load() != 1 {
+        t.Errorf("within the TTL: %+v after %d runs, want the cached result", s, runs.Load())
+    }
+    time.Sleep(ttl)
+    if s := statusOf(rd.Check(), "kms"); s.Cached || runs.Load() != 2 {
+        t.Errorf("past the TTL: %+v after %d runs, want a fresh check", s, runs.Load())
+    }
+
+    uncached := NewReadiness(ReadinessConfig{Timeout: time.Second})
+    var uncachedRuns atomic.Int32
+    uncached.Register("kms", true, func(ctx context.Context) error {
+        uncachedRuns.Add(1)
+        return nil
+    })
+    uncached.Check()
+    uncached.Check()
+    if n := uncachedRuns.Load(); n != 2 {
+        t.Errorf("%d runs for two checks with no TTL, want 2", n)
+    }
+}
+
+// A failing required dependency makes the service not ready, an optional
+// one only degraded; READYZ_REQUIRED overrides the defaults
+func TestReadinessRequired(t *testing.T) {
+    failing := errors.New("access denied")
+    for _, c := range []struct {
+        name     string
+        required map[string]bool // Config override, nil for the defaults
+        kms      error
+        bucket   error
+        status   string
+        code     int
+    }{
+        {"all ok", nil, nil, nil, readinessReady, http.StatusOK},
+        {"optional failing", nil, nil, failing, readinessDegraded, http.StatusOK},
+        {"required failing", nil, failing, nil, readinessNotReady, http.StatusServiceUnavailable},
+        {"both failing", nil, failing, failing, readinessNotReady, http.StatusServiceUnavailable},
+        {"bucket made required", map[string]bool{"kms": true, "results_bucket": true}, nil, failing, readinessNotReady, http.StatusServiceUnavailable},
+        {"kms made optional", map[string]bool{}, failing, nil, readinessDegraded, http.StatusOK},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            rd := NewReadiness(ReadinessConfig{Timeout: time.Second, Required: c.required})
+            kms, bucket := c.kms, c.bucket
+            rd.Register("kms", true, func(ctx context.Context) error { return kms })
+            rd.Register("results_bucket", false, func(ctx context.Context) error { return bucket })
+
+            code, response := readyz(t, rd)
+            if code != c.code || response.Status != c.status {
+                t.Errorf("%d %s, want %d %s", code, response.Status, c.code, c.status)
+            }
+            for name, err := range map[string]error{"kms": kms, "results_bucket": bucket} {
+                s := statusOf(response, name)
+                if want := err != nil; (s.Status == "failed") != want || want && s.LastError != err.Error() {
+                    t.Errorf("%s %+v, want failed %v", name, s, want)
+                }
+            }
+        })
+    }
+}
+
+// The last error outlives a recovery, so a flapping dependency can be seen
+func TestReadinessKeepsLastError(t *testing.T) {
+    var fixed atomic.Bool
+    rd := NewReadiness(ReadinessConfig{Timeout: time.Second})
+    rd.Register("results_bucket", false, func(ctx context.Context) error {
+        if fixed.Load() {
+            return nil
+        }
+        return errors.New("bucket missing")
+    })
+
+    if s := statusOf(rd.Check(), "results_bucket"); s.Status != "failed" {
+        t.Fatalf("%+v, want failed", s)
+    }
+    fixed.Store(true)
+    s := statusOf(rd.Check(), "results_bucket")
+    if s.Status != "ok" || s.LastError != "bucket missing" || s.LastErrorAt == nil {
+        t.Errorf("%+v, want ok keeping the last error", s)
+    }
+}
+
+func TestLoadReadinessConfig(t *testing.T) {
+    t.Setenv("READYZ_REQUIRED", "kms, results_bucket")
+    cfg, err := LoadReadinessConfig()
+    if err != nil || !cfg.Required["kms"] || !cfg.Required["results_bucket"] || cfg.Required["bedrock"] {
+        t.Errorf("required %v, error %v", cfg.Required, err)
+    }
+    for env, v := range map[string]string{
+        "READYZ_REQUIRED":         "redis",
+        "READYZ_CHECK_TIMEOUT_MS": "0",
+        "READYZ_CACHE_MS":         "-1",
+    } {
+        t.Run(env, func(t *testing.T) {
+            t.Setenv(env, v)
+            if _, err := LoadReadinessConfig(); err == nil {
+                t.Errorf("%s=%s accepted", env, v)
+            }
+        })
+    }
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// Refusal categories for provider signals. Phrase matches use the category
+// of the pattern that matched.
+const (
+    refusalStopReason = "stop_reason"      // The provider reported a refusal stop reason
+    refusalGuardrail  = "guardrail"        // A Bedrock guardrail intervened
+    refusalFiltered   = "content_filtered" // The provider's built-in filter blocked the output
+)
+
+// RefusalPattern is one entry of REFUSAL_PATTERNS_FILE
+type RefusalPattern struct {
+    Category string `json:"category"`
+    Pattern  string `json:"pattern"`
+}
+
+// defaultRefusalPatterns only match refusal phrasing at the start of a reply
+// and require a verb of assistance after "I can't", so ordinary openings such
+// as "I can't believe how..." or "I won't bore you with..." don't trigger.
+// "help" and "do that" must end the refusal or name who or what it's for,
+// which leaves out idioms like "I can't help but..." and "I can't do that
+// justice". See testdata/refusals for the replies this is checked against.
+var defaultRefusalPatterns = []RefusalPattern{
+    {Category: "declined", Pattern: `^(?:(?:i'm sorry|i am sorry|sorry|i apologi[sz]e|unfortunately)[,.!]?\s+(?:but\s+)?)?i(?:\s+(?:can't|cannot|won't|will not|am unable to|am not able to)|'m (?:unable|not able) to)\s+(?:(?:assist|provide|comply|fulfill|create|generate|write|answer|share|engage|support)\b|(?:help|do (?:that|this))(?:\s+(?:you|with|for)\b|\s*[.,!;]|\s*$))`},
+    {Category: "policy", Pattern: `\b(?:against|violates?|violating)\s+my\s+(?:guidelines|principles|usage polic(?:y|ies)|content polic(?:y|ies))\b`},
+}
+
+type refusalRule struct {
+    category string
+    re       *regexp.Regexp
+}
+
+// RefusalClassifier decides whether a model declined to answer. Provider
+// signals are checked first; the phrase heuristics only look at the first
+// ScanChars characters of the text, where refusals are phrased.
+type RefusalClassifier struct {
+    ScanChars int
+    rules     []refusalRule
+}
+
+// refusals is the process-wide classifier
+var refusals = mustRefusalClassifier(defaultRefusalPatterns, 200)
+
+func newRefusalClassifier(patterns []RefusalPattern, scanChars int) (*RefusalClassifier, error) {
+    rc := &RefusalClassifier{ScanChars: scanChars}
+    for i, p := range patterns {
+        if p.Category == "" || p.Pattern == "" {
+            return nil, fmt.Errorf("patterns[%d]: category and pattern are required", i)
+        }
+        switch p.Category {
+        case refusalStopReason, refusalGuardrail, refusalFiltered:
+            return nil, fmt.Errorf("patterns[%d]: category %q is reserved for provider signals", i, p.Category)
+        }
+        re, err := regexp.Compile("(?i)" + p.Pattern)
+        if err != nil {
+            return nil, fmt.Errorf("patterns[%d]: %v", i, err)
+        }
+        rc.rules = append(rc.rules, refusalRule{category: p.Category, re: re})
+    }
+    return rc, nil
+}
+
+func mustRefusalClassifier(patterns []RefusalPattern, scanChars int) *RefusalClassifier {
+    rc, err := newRefusalClassifier(patterns, scanChars)
+    if err != nil {
+        panic(err)
+    }
+    return rc
+}
+
+// LoadRefusalClassifier reads REFUSAL_SCAN_CHARS and REFUSAL_PATTERNS_FILE, a
+// JSON array of {"category", "pattern"} objects that replaces the built-in
+// patterns. Patterns are case-insensitive Go regular expressions; an empty
+// array leaves only the provider signals.
+func LoadRefusalClassifier() (*RefusalClassifier, error) {
+    scanChars := 200
+    if v := os.Getenv("REFUSAL_SCAN_CHARS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return nil, fmt.Errorf("invalid REFUSAL_SCAN_CHARS %q", v)
+        }
+        scanChars = n
+    }
+
+    patterns := defaultRefusalPatterns
+    if path := os.Getenv("REFUSAL_PATTERNS_FILE"); path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil, fmt.Errorf("error reading REFUSAL_PATTERNS_FILE: %v", err)
+        }
+        patterns = nil
+        if err := json.Unmarshal(data, &patterns); err != nil {
+            return nil, fmt.Errorf("invalid REFUSAL_PATTERNS_FILE: %v", err)
+        }
+    }
+    return newRefusalClassifier(patterns, scanChars)
+}
+
+// head returns the normalized start of text the phrase rules run against
+func (rc *RefusalClassifier) head(text string) string {
+    text = strings.TrimLeft(text, " \t\r\n\"'*>#-")
+    runes := 0
+    for i := range text {
+        if runes == rc.ScanChars {
+            text = text[:i]
+            break
+        }
+        runes++
+    }
+    // Models use typographic apostrophes as often as plain ones
+    if strings.ContainsAny(text, "’ʼ") {
+        text = apostrophes.Replace(text)
+    }
+    return text
+}
+
+// apostrophes folds typographic apostrophes to plain ones
+var apostrophes = strings.NewReplacer("’", "'", "ʼ", "'")
+
+// Classify returns the refusal category, or "" when the output isn't a refusal
+func (rc *RefusalClassifier) Classify(filterCategory, text string) string {
+    switch filterCategory {
+    case filterRefusal:
+        return refusalStopReason
+    case filterGuardrail:
+        return refusalGuardrail
+    case filterContent:
+        return refusalFiltered
+    }
+    head := rc.head(text)
+    for _, rule := range rc.rules {
+        if rule.re.MatchString(head) {
+            return rule.category
+        }
+    }
+    return ""
+}
+
+// classifyRefusal flags a generation result and counts the refusal. Mocked
+// results are flagged too, so clients can test their refusal handling.
+func classifyRefusal(result *GenerationResult) {
+    result.RefusalCategory = refusals.Classify(result.FilterCategory, result.Text)
+    result.Refused = result.RefusalCategory != ""
+    if result.Refused && !result.Mocked {
+        metrics.Inc("refusals_total", "model", result.ModelID, "category", result.RefusalCategory)
+    }
+}
+
+// refusalText returns the text to serve for a refused result: the policy's
+// standardized message when one is set, otherwise the model's own text
+func refusalText(text string, refused bool, policy KeyPolicy) (string, bool) {
+    if !refused || policy.RefusalMessage == "" {
+        return text, false
+    }
+    return policy.RefusalMessage, true
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// readCorpus reads a corpus file under testdata/refusals: one reply per
+// line, skipping blank lines and // comments
+func readCorpus(t *testing.T, name string) []string {
+    t.Helper()
+    data, err := os.ReadFile(filepath.Join("testdata", "refusals", name))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var lines []string
+    for _, line := range strings.Split(string(data), "\n") {
+        if strings.TrimSpace(line) != "" && !strings.HasPrefix(line, "//") {
+            lines = append(lines, line)
+        }
+    }
+    return lines
+}
+
+// Replies that open like refusals, or quote one past the scanned start, are
+// not refusals
+func TestRefusalBenignCorpus(t *testing.T) {
+    for _, text := range readCorpus(t, "benign.txt") {
+        if category := refusals.Classify("", text); category != "" {
+            t.Errorf("%q classified as %s", text, category)
+        }
+    }
+}
+
+func TestRefusalCorpus(t *testing.T) {
+    for _, line := range readCorpus(t, "refused.txt") {
+        want, text, ok := strings.Cut(line, "\t")
+        if !ok {
+            t.Fatalf("no category in %q", line)
+        }
+        if category := refusals.Classify("", text); category != want {
+            t.Errorf("%q classified as %q, want %s", text, category, want)
+        }
+    }
+}
+
+// Provider signals decide before the text is looked at
+func TestRefusalProviderSignals(t *testing.T) {
+    for filter, want := range map[string]string{
+        filterRefusal:   refusalStopReason,
+        filterGuardrail: refusalGuardrail,
+        filterContent:   refusalFiltered,
+    } {
+        if got := refusals.Classify(filter, "Here is the answer."); got != want {
+            t.Errorf("%s classified as %q, want %s", filter, got, want)
+        }
+    }
+}
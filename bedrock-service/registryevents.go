@@ -0,0 +1,225 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Registry event types
+const (
+    registryEventProbe   = "probe"   // An availability probe changed a model's status
+    registryEventBreaker = "breaker" // Request failures opened or closed a model's breaker, see breaker.go
+    registryEventReload  = "reload"  // A models config reload added or removed a model, see modelconfig.go
+    registryEventAdmin   = "admin"   // An admin disabled or re-enabled a model, see modeltoggle.go
+)
+
+// registryEventTypes lists the types accepted by the ?type= filter
+var registryEventTypes = []string{registryEventProbe, registryEventBreaker, registryEventReload, registryEventAdmin}
+
+// RegistryEventsConfig controls the model registry event log
+type RegistryEventsConfig struct {
+    MaxEvents int    // Oldest events are dropped past this
+    StateFile string // Where events are persisted, empty to keep them in memory only
+}
+
+// LoadRegistryEventsConfig reads MODEL_EVENTS_MAX and MODEL_EVENTS_FILE
+func LoadRegistryEventsConfig() (RegistryEventsConfig, error) {
+    cfg := RegistryEventsConfig{MaxEvents: 1000, StateFile: os.Getenv("MODEL_EVENTS_FILE")}
+
+    if v := os.Getenv("MODEL_EVENTS_MAX"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return cfg, fmt.Errorf("invalid MODEL_EVENTS_MAX %q", v)
+        }
+        cfg.MaxEvents = n
+    }
+    return cfg, nil
+}
+
+// RegistryEvent records one state transition of a model
+type RegistryEvent struct {
+    Time    time.Time `json:"time"`
+    ModelID string    `json:"model_id"`
+    Type    string    `json:"type"`
+    From    string    `json:"from"`
+    To      string    `json:"to"`
+    Cause   string    `json:"cause"`
+}
+
+// RegistryEvents is a bounded, time-ordered log of registry transitions
+type RegistryEvents struct {
+    cfg RegistryEventsConfig
+
+    mu     sync.Mutex
+    events []RegistryEvent
+    dirty  bool
+}
+
+func NewRegistryEvents(cfg RegistryEventsConfig) (*RegistryEvents, error) {
+    re := &RegistryEvents{cfg: cfg}
+    if cfg.StateFile != "" {
+        if err := loadState(cfg.StateFile, &re.events); err != nil {
+            return nil, err
+        }
+        if len(re.events) > cfg.MaxEvents {
+            re.events = re.events[len(re.events)-cfg.MaxEvents:]
+        }
+        log.Printf("Loaded %d model registry events from %s", len(re.events), cfg.StateFile)
+    }
+    return re, nil
+}
+
+// Record appends a transition, logging it in key=value form and counting it
+// by type and new state so alerts can key off specific transitions. Nil
+// receivers are allowed so the registry works without a log.
+func (re *RegistryEvents) Record(e RegistryEvent) {
+    if re == nil {
+        return
+    }
+    log.Printf("Model registry event type=%s model=%s from=%s to=%s cause=%q", e.Type, e.ModelID, e.From, e.To, e.Cause)
+    metrics.Inc("model_registry_events_total", "type", e.Type, "to", e.To)
+
+    re.mu.Lock()
+    defer re.mu.Unlock()
+    re.events = append(re.events, e)
+    if len(re.events) > re.cfg.MaxEvents {
+        re.events = re.events[len(re.events)-re.cfg.MaxEvents:]
+    }
+    re.dirty = true
+}
+
+// RegistryEventFilter narrows a query; zero fields match everything
+type RegistryEventFilter struct {
+    ModelID string
+    Types   map[string]bool
+    Since   time.Time
+    Until   time.Time
+    Limit   int // Most recent events kept when more match
+}
+
+// Query returns matching events, oldest first
+func (re *RegistryEvents) Query(f RegistryEventFilter) []RegistryEvent {
+    re.mu.Lock()
+    defer re.mu.Unlock()
+
+    matched := make([]RegistryEvent, 0)
+    for _, e := range re.events {
+        if f.ModelID != "" && e.ModelID != f.ModelID {
+            continue
+        }
+        if len(f.Types) > 0 && !f.Types[e.Type] {
+            continue
+        }
+        if !f.Since.IsZero() && e.Time.Before(f.Since) {
+            continue
+        }
+        if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+            continue
+        }
+        matched = append(matched, e)
+    }
+    if f.Limit > 0 && len(matched) > f.Limit {
+        matched = matched[len(matched)-f.Limit:]
+    }
+    return matched
+}
+
+// Run persists the log every minute when a state file is configured
+func (re *RegistryEvents) Run() {
+    if re.cfg.StateFile == "" {
+        return
+    }
+    for range time.Tick(time.Minute) {
+        re.save()
+    }
+}
+
+func (re *RegistryEvents) save() {
+    re.mu.Lock()
+    if !re.dirty {
+        re.mu.Unlock()
+        return
+    }
+    events := append([]RegistryEvent(nil), re.events...)
+    re.dirty = false
+    re.mu.Unlock()
+
+    if err := saveState(re.cfg.StateFile, events); err != nil {
+        log.Printf("Error saving model registry events: %v", err)
+    }
+}
+
+// parseRegistryEventFilter reads since, until (RFC 3339), type (comma
+// separated) and limit from the query string
+func parseRegistryEventFilter(r *http.Request) (RegistryEventFilter, error) {
+    q := r.URL.Query()
+    f := RegistryEventFilter{Limit: 100}
+
+    for _, bound := range []struct {
+        name string
+        dst  *time.Time
+    }{{"since", &f.Since}, {"until", &f.Until}} {
+        if v := q.Get(bound.name); v != "" {
+            t, err := time.Parse(time.RFC3339, v)
+            if err != nil {
+                return f, fmt.Errorf("%s must be an RFC 3339 timestamp", bound.name)
+            }
+            *bound.dst = t
+        }
+    }
+    if v := q.Get("type"); v != "" {
+        f.Types = make(map[string]bool)
+        for _, t := range strings.Split(v, ",") {
+            known := false
+            for _, k := range registryEventTypes {
+                known = known || k == t
+            }
+            if !known {
+                return f, fmt.Errorf("type must be one of %s", strings.Join(registryEventTypes, ", "))
+            }
+            f.Types[t] = true
+        }
+    }
+    if v := q.Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 || n > 1000 {
+            return f, fmt.Errorf("limit must be between 1 and 1000")
+        }
+        f.Limit = n
+    }
+    return f, nil
+}
+
+func registryEventsHandler(bc *BedrockClient, re *RegistryEvents) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        f, err := parseRegistryEventFilter(r)
+        if err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, err.Error())
+            return
+        }
+
+        if id, ok := mux.Vars(r)["id"]; ok {
+            known := false
+            for _, model := range bc.models() {
+                known = known || model.ID == id
+            }
+            if !known {
+                writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Unknown model")
+                return
+            }
+            f.ModelID = id
+        }
+
+        writeJSON(w, r, map[string]interface{}{
+            "events": re.Query(f),
+        })
+    }
+}
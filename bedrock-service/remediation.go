@@ -0,0 +1,170 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net"
+    "strings"
+
+    "github.com/aws/smithy-go"
+)
+
+// Error classes for failures that aren't Bedrock API errors
+const (
+    errClassDeadline       = "deadline"
+    errClassCancelled      = "cancelled"
+    errClassRequestBuild   = "request_build"
+    errClassResponseFormat = "response_format"
+    errClassFiltered       = "content_filtered"
+    errClassNetwork        = "network"
+    errClassInvalidJSON    = "invalid_json"
+    errClassNotAvailable   = "not_available" // Unavailable or disabled, so not tried
+    errClassBreakerOpen    = "breaker_open"
+    errClassContextTooLong = "context_too_long" // A ValidationException saying the prompt didn't fit
+    errClassUnknown        = "unknown"
+)
+
+// remediations says what to do about each error class. Keys are Bedrock
+// error codes, the classes above, and the API error codes callers see. To
+// cover a new failure, add its class here; classifyError already passes
+// any Bedrock error code through.
+var remediations = map[string]string{
+    // Bedrock
+    "AccessDeniedException":         "The account is not allowed to invoke this model. Request model access in the Bedrock console for this account and region, and check the IAM policy allows bedrock:InvokeModel on the model ARN.",
+    "ThrottlingException":           "Bedrock throttled the account. Spread load across more accounts in BEDROCK_ACCOUNTS_FILE, or request a higher requests-per-minute quota for the model.",
+    "ServiceQuotaExceededException": "A Bedrock service quota was reached. Request a quota increase for the model in Service Quotas, or add another account.",
+    "ValidationException":           "Bedrock rejected the request body. Check max_tokens against the model's limit and that the model ID matches its API type (messages or legacy) in the catalog.",
+    "ResourceNotFoundException":     "The model ID doesn't exist in this region. Check the catalog entry and AWS_REGION; some models are only offered in certain regions or through inference profiles.",
+    "ModelNotReadyException":        "The model is still being provisioned. Retry shortly; persistent failures usually mean provisioned throughput isn't set up.",
+    "ModelTimeoutException":         "The model took too long to respond. Lower max_tokens or shorten the prompt; the fallback chain will try other models.",
+    "ModelErrorException":           "The model failed while processing the request. Usually transient: retry, or check the prompt isn't malformed for this model family.",
+    "InternalServerException":       "Bedrock had an internal error. Retry; if it persists, check the AWS Health Dashboard for the region.",
+    "ServiceUnavailableException":   "Bedrock is temporarily unavailable in this region. Retry with backoff; check the AWS Health Dashboard.",
+    "UnrecognizedClientException":   "The AWS credentials were not recognized. Check the access key for the account belongs to an active IAM user or role.",
+    "ExpiredTokenException":         "The AWS session credentials expired. Refresh the profile or role credentials the account uses.",
+    "InvalidSignatureException":     "The request signature was rejected. Check the secret key and that the host clock is in sync.",
+    "ModelStreamErrorException":     "The model failed partway through a stream. Retry the request.",
+
+    // Internal
+    errClassDeadline:       "The request ran out of time before the model answered. Retry, or lower max_tokens so the model finishes sooner.",
+    errClassRequestBuild:   "The service couldn't build a request body for the model. This is a bug in the service, not in the caller's request; report it with this request ID.",
+    errClassResponseFormat: "The model answered in a format the service doesn't understand. Check the catalog api_type for the model; the provider may have changed its response schema.",
+    errClassFiltered:       "The model's output was blocked by content filtering. Rephrase the prompt, or set CONTENT_FILTER_FALLBACK to try other models.",
+    errClassNetwork:        "The service couldn't reach Bedrock. Check network access to the regional endpoint, proxies and VPC endpoints.",
+    errClassInvalidJSON:    "The model's output stopped being valid JSON, so the stream was aborted. Ask for JSON explicitly in the prompt, lower the temperature, or give a schema.",
+    errClassNotAvailable:   "The requested model is unavailable, disabled by an admin, or has its breaker open, and strict_model or the request's models list allows no fallback. /models shows its state; retry later or allow other models.",
+    errClassBreakerOpen:    "The model failed repeatedly and its breaker is open, so it was skipped. It is tried again after the breaker's cooldown; /models shows when.",
+    errClassContextTooLong: "The prompt and max_tokens didn't fit the model's context window. Shorten the prompt or conversation history, lower max_tokens, or choose a model with a larger context window.",
+
+    // Returned to callers
+    ErrCodeValidation:       "The request was malformed. The error's fields list says which values to fix.",
+    ErrCodeUnauthorized:     "The API key was missing or unknown. Send a valid key in the Authorization header.",
+    ErrCodeInvalidSignature: "The key requires signed requests and the signature was missing, stale or wrong. Check the signing secret, the signed path and body, and that the client clock is in sync.",
+    ErrCodeReplayedRequest:  "A signed request reused a nonce. Generate a fresh X-Nonce for every request, including retries.",
+    ErrCodeForbidden:        "The API key isn't allowed to do this. Check the key's policy, or use an admin key for /admin routes.",
+    ErrCodeRateLimited:      "The caller exceeded a rate or concurrency limit. Retry after the Retry-After interval, or raise the key's limits.",
+    ErrCodeThrottled:        "Bedrock throttled every model tried. Retry after the Retry-After interval; persistent throttling needs more accounts or a higher quota.",
+    ErrCodeBudgetExceeded:   "The key's token budget is spent. Wait for reset_at, or raise the budget in the key's policy.",
+    ErrCodeModelUnavailable: "No model in the fallback chain could serve the request. The attempts show why each model failed; the registry shows which were available.",
+    ErrCodeContentBlocked:   "The prompt or output was blocked by policy. Rephrase the request.",
+    ErrCodeRequestBuild:     "The service couldn't build a request body for the model. This is a bug in the service; report it with this request ID.",
+    ErrCodeDeadlineExceeded: "The request's timeout ran out before a model answered. Raise timeout_seconds, or lower max_tokens so the model finishes sooner.",
+
+    ErrCodeReservationConflict: "Other reservations hold the capacity for that window. Pick one of suggested_windows, or spread the budget over a longer window.",
+}
+
+// classifyError names the class of a model invocation failure
+func classifyError(err error) string {
+    var apiErr smithy.APIError
+    var buildErr *RequestBuildError
+    var netErr net.Error
+    var violation *jsonViolation
+    switch {
+    case errors.As(err, &buildErr):
+        return errClassRequestBuild
+    case errors.As(err, &violation):
+        return errClassInvalidJSON
+    case errors.Is(err, ErrContentFiltered):
+        return errClassFiltered
+    case errors.Is(err, context.DeadlineExceeded):
+        return errClassDeadline
+    case errors.Is(err, context.Canceled):
+        return errClassCancelled
+    case errors.Is(err, errBreakerOpen):
+        return errClassBreakerOpen
+    case errors.As(err, &apiErr):
+        if apiErr.ErrorCode() == "ValidationException" && contextTooLong(apiErr.ErrorMessage()) {
+            return errClassContextTooLong
+        }
+        return apiErr.ErrorCode()
+    case errors.As(err, &netErr):
+        return errClassNetwork
+    case strings.Contains(err.Error(), "unexpected response format"), strings.Contains(err.Error(), "error parsing response"):
+        return errClassResponseFormat
+    }
+    return errClassUnknown
+}
+
+// remediationFor returns what to do about an error class, or nothing when the
+// class isn't listed
+func remediationFor(class string) string {
+    return remediations[class]
+}
+
+// contextTooLongPhrases are how the providers' ValidationExceptions say a
+// prompt is longer than the model takes
+var contextTooLongPhrases = []string{
+    "too long",               // Anthropic, and Bedrock's own "Input is too long for requested model"
+    "maximum context length", // Llama, Mistral
+    "context window",
+    "too many input tokens", // Titan
+}
+
+// contextTooLong reports whether a ValidationException's message says the
+// prompt didn't fit the model's context window
+func contextTooLong(message string) bool {
+    message = strings.ToLower(message)
+    for _, phrase := range contextTooLongPhrases {
+        if strings.Contains(message, phrase) {
+            return true
+        }
+    }
+    return false
+}
+
+// failureReasons are what callers are told of each failure class. Unlike
+// remediations they're meant for API clients, so they say nothing of how
+// the service is set up.
+var failureReasons = map[string]string{
+    "AccessDeniedException":         "the model isn't enabled for this service",
+    "ThrottlingException":           "throttled by Bedrock",
+    "ServiceQuotaExceededException": "throttled by Bedrock",
+    "ValidationException":           "the model rejected the request's parameters",
+    "ResourceNotFoundException":     "the model isn't offered in this region",
+    "ModelNotReadyException":        "the model isn't ready yet",
+    "ModelTimeoutException":         "the model took too long to respond",
+    "ModelErrorException":           "the model failed while processing the request",
+    "InternalServerException":       "Bedrock had an internal error",
+    "ServiceUnavailableException":   "Bedrock is temporarily unavailable",
+    "ModelStreamErrorException":     "the model failed partway through its stream",
+
+    errClassDeadline:       "the request ran out of time",
+    errClassCancelled:      "the request was cancelled",
+    errClassRequestBuild:   "the service couldn't build the model request",
+    errClassResponseFormat: "the model's response couldn't be read",
+    errClassFiltered:       "the output was blocked by content filtering",
+    errClassNetwork:        "Bedrock couldn't be reached",
+    errClassInvalidJSON:    "the output stopped being valid JSON",
+    errClassNotAvailable:   "the model isn't available",
+    errClassBreakerOpen:    "the model's breaker is open after repeated failures",
+    errClassContextTooLong: "the prompt is too long for the model",
+}
+
+// failureReason describes a failure class to callers; credential and
+// signing failures, and classes not listed, are only described generically
+func failureReason(class string) string {
+    if reason, ok := failureReasons[class]; ok {
+        return reason
+    }
+    return "the model failed"
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "net/http"
+)
+
+// maxRequestIDLength bounds caller-supplied request IDs
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// requestIDMiddleware takes the request ID from X-Request-ID (when it is
+// well-formed) or generates one, stores it on the context and echoes it in
+// the response headers
+func requestIDMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get("X-Request-ID")
+        if !validRequestID(id) {
+            id = newRequestID()
+        }
+        w.Header().Set("X-Request-ID", id)
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+    })
+}
+
+func newRequestID() string {
+    b := make([]byte, 16)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+// validRequestID accepts short IDs made of characters safe to log and echo
+func validRequestID(id string) bool {
+    if id == "" || len(id) > maxRequestIDLength {
+        return false
+    }
+    for _, c := range id {
+        if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+            return false
+        }
+    }
+    return true
+}
+
+// requestIDFrom returns the request ID stored on the context, if any
+func requestIDFrom(ctx context.Context) string {
+    id, _ := ctx.Value(requestIDKey{}).(string)
+    return id
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+    "unicode/utf8"
+
+    "github.com/gorilla/mux"
+)
+
+// recordedHeaders are the request headers worth keeping for triage. Nothing
+// that identifies or authenticates the caller is kept.
+var recordedHeaders = []string{
+    "User-Agent", "Content-Type", "Content-Length", "Accept", "Accept-Language",
+    "X-Schema-Version", "X-Caller-Service", "X-Caller-Operation", "X-Timezone", "X-Model",
+}
+
+// recordedBodyFields are body fields whose values are kept. Other fields are
+// listed by name only, and the prompt is reduced to its length and fingerprint.
+var recordedBodyFields = map[string]bool{
+    "model": true, "max_tokens": true, "temperature": true, "schema_version": true,
+    "link_filter": true, "deliver": true, "no_time_context": true, "dry_run": true,
+}
+
+// ModelAttempt is one model invocation made while serving a request
+type ModelAttempt struct {
+    Model       string    `json:"model"`
+    Account     string    `json:"account,omitempty"`
+    Started     time.Time `json:"started"`
+    DurationMs  int64     `json:"duration_ms"`
+    Outcome     string    `json:"outcome"` // success, error or filtered
+    ErrorClass  string    `json:"error_class,omitempty"`
+    Error       string    `json:"error,omitempty"`
+    Remediation string    `json:"remediation,omitempty"`
+}
+
+// ModelState is a registry entry as it was when a request failed
+type ModelState struct {
+    ID          string `json:"id"`
+    Available   bool   `json:"available"`
+    ProbeStatus string `json:"probe_status"`
+}
+
+// SanitizedRequest is what was asked, with secrets and prompt text removed
+type SanitizedRequest struct {
+    Method            string                     `json:"method"`
+    Path              string                     `json:"path"`
+    Headers           map[string]string          `json:"headers,omitempty"`
+    BodyBytes         int                        `json:"body_bytes"`
+    BodyFields        []string                   `json:"body_fields,omitempty"`
+    Values            map[string]json.RawMessage `json:"values,omitempty"`
+    PromptChars       int                        `json:"prompt_chars,omitempty"`
+    PromptFingerprint string                     `json:"prompt_fingerprint,omitempty"`
+}
+
+// RequestRecord is everything kept about one served request
+type RequestRecord struct {
+    mu sync.Mutex
+
+    ID         string           `json:"request_id"`
+    Time       time.Time        `json:"time"`
+    KeyID      string           `json:"key_id,omitempty"`
+    Tenant     string           `json:"tenant,omitempty"`
+    Request    SanitizedRequest `json:"request"`
+    Status     int              `json:"status"`
+    DurationMs int64            `json:"duration_ms"`
+    ErrorCode  string           `json:"error_code,omitempty"`
+    Error      string           `json:"error,omitempty"`
+    Attempts   []ModelAttempt   `json:"attempts"`
+    Policies   []string         `json:"policies_applied,omitempty"` // Limits and policies that changed the outcome
+    Registry   []ModelState     `json:"registry,omitempty"`         // Captured for failed requests only
+
+    size int64 // Estimated bytes, set when the record is added to the log
+}
+
+// memoryBytesLocked estimates the bytes held by a record
+func (rec *RequestRecord) memoryBytesLocked() int64 {
+    n := int64(len(rec.ID)+len(rec.KeyID)+len(rec.Tenant)+len(rec.ErrorCode)+len(rec.Error)) + recordOverhead
+    n += int64(len(rec.Request.Path) + len(rec.Request.PromptFingerprint))
+    for name, v := range rec.Request.Headers {
+        n += int64(len(name) + len(v))
+    }
+    for _, name := range rec.Request.BodyFields {
+        n += int64(len(name))
+    }
+    for _, raw := range rec.Request.Values {
+        n += int64(len(raw))
+    }
+    for _, a := range rec.Attempts {
+        n += int64(len(a.Model)+len(a.Account)+len(a.ErrorClass)+len(a.Error)+len(a.Remediation)) + 64
+    }
+    for _, p := range rec.Policies {
+        n += int64(len(p))
+    }
+    return n + int64(len(rec.Registry))*64
+}
+
+type requestRecordKey struct{}
+
+// requestRecordFrom returns the record of the request being served, or nil
+func requestRecordFrom(ctx context.Context) *RequestRecord {
+    rec, _ := ctx.Value(requestRecordKey{}).(*RequestRecord)
+    return rec
+}
+
+// Attempt records one model invocation. A nil record ignores it, so callers
+// outside a request don't need to check.
+func (rec *RequestRecord) Attempt(model, account string, started time.Time, outcome string, err error) {
+    if rec == nil {
+        return
+    }
+    attempt := ModelAttempt{
+        Model:      model,
+        Account:    account,
+        Started:    started,
+        DurationMs: time.Since(started).Milliseconds(),
+        Outcome:    outcome,
+    }
+    if err != nil {
+        attempt.ErrorClass = classifyError(err)
+        attempt.Error = err.Error()
+        attempt.Remediation = remediationFor(attempt.ErrorClass)
+    }
+    rec.mu.Lock()
+    rec.Attempts = append(rec.Attempts, attempt)
+    rec.mu.Unlock()
+}
+
+// Policy notes a limit or policy that changed how the request was served
+func (rec *RequestRecord) Policy(format string, args ...interface{}) {
+    if rec == nil {
+        return
+    }
+    rec.mu.Lock()
+    rec.Policies = append(rec.Policies, fmt.Sprintf(format, args...))
+    rec.mu.Unlock()
+}
+
+// failed stores the error the caller was sent, before localization
+func (rec *RequestRecord) failed(apiErr APIError) {
+    if rec == nil {
+        return
+    }
+    rec.mu.Lock()
+    rec.ErrorCode, rec.Error = apiErr.Code, apiErr.Message
+    rec.mu.Unlock()
+}
+
+// setBody summarizes the buffered request body
+func (rec *RequestRecord) setBody(body []byte) {
+    if rec == nil {
+        return
+    }
+    summary := SanitizedRequest{BodyBytes: len(body)}
+    var fields map[string]json.RawMessage
+    if json.Unmarshal(body, &fields) == nil {
+        for name, raw := range fields {
+            summary.BodyFields = append(summary.BodyFields, name)
+            if recordedBodyFields[name] {
+                if summary.Values == nil {
+                    summary.Values = make(map[string]json.RawMessage)
+                }
+                summary.Values[name] = raw
+            }
+        }
+        sort.Strings(summary.BodyFields)
+        var prompt string
+        if json.Unmarshal(fields["prompt"], &prompt) == nil && prompt != "" {
+            summary.PromptChars = utf8.RuneCountInString(prompt)
+            summary.PromptFingerprint = promptFingerprint(prompt)
+        }
+    }
+
+    rec.mu.Lock()
+    rec.Request.BodyBytes = summary.BodyBytes
+    rec.Request.BodyFields = summary.BodyFields
+    rec.Request.Values = summary.Values
+    rec.Request.PromptChars = summary.PromptChars
+    rec.Request.PromptFingerprint = summary.PromptFingerprint
+    rec.mu.Unlock()
+}
+
+// RequestLog keeps the most recent requests in a ring buffer for
+// GET /admin/requests/{request_id}
+type RequestLog struct {
+    size int
+
+    mu    sync.Mutex
+    ring  []*RequestRecord
+    next  int
+    byID  map[string]*RequestRecord
+    bytes int64
+}
+
+// LoadRequestLog reads REQUEST_LOG_SIZE (default 1000, 0 disables)
+func LoadRequestLog() (*RequestLog, error) {
+    size := 1000
+    if v := os.Getenv("REQUEST_LOG_SIZE"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            return nil, fmt.Errorf("invalid REQUEST_LOG_SIZE %q", v)
+        }
+        size = n
+    }
+    return &RequestLog{size: size, ring: make([]*RequestRecord, size), byID: make(map[string]*RequestRecord)}, nil
+}
+
+func (rl *RequestLog) add(rec *RequestRecord) {
+    rl.mu.Lock()
+    defer rl.mu.Unlock()
+    if old := rl.ring[rl.next]; old != nil {
+        rl.bytes -= old.size
+        if rl.byID[old.ID] == old {
+            delete(rl.byID, old.ID)
+        }
+    }
+    rl.ring[rl.next] = rec
+    rl.byID[rec.ID] = rec
+    rl.bytes += rec.size
+    rl.next = (rl.next + 1) % rl.size
+}
+
+// MemoryBytes estimates the bytes held by retained records
+func (rl *RequestLog) MemoryBytes() int64 {
+    rl.mu.Lock()
+    defer rl.mu.Unlock()
+    return rl.bytes
+}
+
+// EvictTo drops the oldest records; the ring refills as requests arrive
+func (rl *RequestLog) EvictTo(target int64) int {
+    rl.mu.Lock()
+    defer rl.mu.Unlock()
+    dropped := 0
+    for i := 0; i < rl.size && rl.bytes > target; i++ {
+        slot := (rl.next + i) % rl.size
+        old := rl.ring[slot]
+        if old == nil {
+            continue
+        }
+        rl.bytes -= old.size
+        if rl.byID[old.ID] == old {
+            delete(rl.byID, old.ID)
+        }
+        rl.ring[slot] = nil
+        dropped++
+    }
+    return dropped
+}
+
+// Get returns a completed request's record
+func (rl *RequestLog) Get(id string) (*RequestRecord, bool) {
+    rl.mu.Lock()
+    defer rl.mu.Unlock()
+    rec, ok := rl.byID[id]
+    return rec, ok
+}
+
+// Records returns the retained records, oldest first
+func (rl *RequestLog) Records() []*RequestRecord {
+    rl.mu.Lock()
+    defer rl.mu.Unlock()
+    records := make([]*RequestRecord, 0, len(rl.byID))
+    for i := 0; i < rl.size; i++ {
+        if rec := rl.ring[(rl.next+i)%rl.size]; rec != nil {
+            records = append(records, rec)
+        }
+    }
+    return records
+}
+
+// Oldest returns when the oldest retained request was served
+func (rl *RequestLog) Oldest() (time.Time, bool) {
+    rl.mu.Lock()
+    defer rl.mu.Unlock()
+    // The slot about to be overwritten is the oldest once the ring is full
+    for i := 0; i < rl.size; i++ {
+        if rec := rl.ring[(rl.next+i)%rl.size]; rec != nil {
+            return rec.Time, true
+        }
+    }
+    return time.Time{}, false
+}
+
+// statusRecorder captures the response status. It passes Flush through for
+// streams and unwraps for http.ResponseController.
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+    if s.status == 0 {
+        s.status = status
+    }
+    s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+    if s.status == 0 {
+        s.status = http.StatusOK
+    }
+    return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+    if f, ok := s.ResponseWriter.(http.Flusher); ok {
+        f.Flush()
+    }
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+    return s.ResponseWriter
+}
+
+// Middleware records every request. It runs right after the request ID is
+// assigned, so requests rejected by authentication or rate limiting are kept
+// too; the caller's identity is filled in once it's known.
+func (rl *RequestLog) Middleware(bc *BedrockClient, memory *MemoryGovernor) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            // Recording is optional, so it's the first thing shed under memory pressure
+            if rl.size == 0 || memory.UnderPressure() {
+                next.ServeHTTP(w, r)
+                return
+            }
+            rec := &RequestRecord{
+                ID:       requestIDFrom(r.Context()),
+                Time:     time.Now(),
+                Request:  SanitizedRequest{Method: r.Method, Path: r.URL.Path, Headers: make(map[string]string)},
+                Attempts: []ModelAttempt{},
+            }
+            for _, name := range recordedHeaders {
+                if v := r.Header.Get(name); v != "" {
+                    rec.Request.Headers[name] = v
+                }
+            }
+            recorder := &statusRecorder{ResponseWriter: w}
+            next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), requestRecordKey{}, rec)))
+
+            rec.mu.Lock()
+            rec.Status = recorder.status
+            if rec.Status == 0 {
+                rec.Status = http.StatusOK
+            }
+            rec.DurationMs = time.Since(rec.Time).Milliseconds()
+            if rec.Status >= 400 {
+                for _, model := range bc.models() {
+                    rec.Registry = append(rec.Registry, ModelState{ID: model.ID, Available: model.Available, ProbeStatus: model.ProbeStatus})
+                }
+            }
+            rec.size = rec.memoryBytesLocked()
+            rec.mu.Unlock()
+            rl.add(rec)
+        })
+    }
+}
+
+// identify stores who made the request, once authentication has run
+func (rec *RequestRecord) identify(p *Principal) {
+    if rec == nil || p == nil {
+        return
+    }
+    rec.mu.Lock()
+    rec.KeyID, rec.Tenant = p.KeyID, p.Tenant
+    rec.mu.Unlock()
+}
+
+// requestReportHandler serves GET /admin/requests/{request_id}
+func requestReportHandler(rl *RequestLog) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        id := mux.Vars(r)["request_id"]
+        rec, ok := rl.Get(id)
+        if !ok {
+            message := fmt.Sprintf("No record of request %s; the request log is disabled (REQUEST_LOG_SIZE=0)", id)
+            if rl.size > 0 {
+                message = fmt.Sprintf("No record of request %s; the request log keeps the last %d requests and is empty", id, rl.size)
+                if oldest, ok := rl.Oldest(); ok {
+                    message = fmt.Sprintf("No record of request %s; the request log keeps the last %d requests, currently back to %s",
+                        id, rl.size, oldest.UTC().Format(time.RFC3339))
+                }
+            }
+            writeError(w, r, http.StatusNotFound, ErrCodeNotFound, message)
+            return
+        }
+
+        rec.mu.Lock()
+        defer rec.mu.Unlock()
+        report := struct {
+            *RequestRecord
+            Remediation string `json:"remediation,omitempty"` // For the error the caller saw
+        }{RequestRecord: rec, Remediation: remediationFor(rec.ErrorCode)}
+        writeJSON(w, r, report)
+    }
+}
+
+// accountName is the account an invocation went through, or nothing when it
+// failed before one was picked
+func accountName(account *Account) string {
+    if account == nil {
+        return ""
+    }
+    return account.Name
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+    "os"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Reservations set capacity aside for planned bulk jobs. A reservation holds
+// a request budget, and a token budget when tokens are reserved, for a time
+// window under one caller. Requests sent with X-Reservation-ID inside the
+// window are admitted at the reserved rate and counted against the
+// reservation instead of the caller's rate limit. The reserved rates of
+// overlapping windows are held to a fraction of the instance's capacity, so
+// interactive traffic always keeps the rest.
+
+// Reservation states
+const (
+    reservationScheduled = "scheduled" // The window hasn't started
+    reservationActive    = "active"
+    reservationEnded     = "ended"
+    reservationReleased  = "released" // Unused past the claim period; its capacity went back
+)
+
+const (
+    reservationSuggestions = 3              // Alternative windows offered on a conflict
+    reservationRetention   = 24 * time.Hour // Ended reservations stay readable this long
+    reservationSweep       = 30 * time.Second
+)
+
+// ReservationConfig sizes the capacity reservations draw on
+type ReservationConfig struct {
+    CapacityRPM int           // Requests per minute the instance serves; 0 disables reservations
+    CapacityTPM int           // Tokens per minute; 0 reserves requests only
+    MaxFraction float64       // Share of capacity reservations may hold at any moment
+    MaxWindow   time.Duration // Longest window a reservation may cover
+    MaxLead     time.Duration // How far ahead a window may start, and how far suggestions look
+    ClaimWithin time.Duration // Reservations unused this long after their start are released
+}
+
+// LoadReservationConfig reads RESERVATION_CAPACITY_RPM, RESERVATION_CAPACITY_TPM,
+// RESERVATION_MAX_FRACTION (default 0.5), RESERVATION_MAX_WINDOW_HOURS
+// (default 24), RESERVATION_MAX_LEAD_DAYS (default 7) and
+// RESERVATION_CLAIM_MINUTES (default 15)
+func LoadReservationConfig() (ReservationConfig, error) {
+    cfg := ReservationConfig{MaxFraction: 0.5}
+    windowHours, leadDays, claimMinutes := 24, 7, 15
+
+    ints := []struct {
+        env string
+        min int
+        dst *int
+    }{
+        {"RESERVATION_CAPACITY_RPM", 0, &cfg.CapacityRPM},
+        {"RESERVATION_CAPACITY_TPM", 0, &cfg.CapacityTPM},
+        {"RESERVATION_MAX_WINDOW_HOURS", 1, &windowHours},
+        {"RESERVATION_MAX_LEAD_DAYS", 1, &leadDays},
+        {"RESERVATION_CLAIM_MINUTES", 1, &claimMinutes},
+    }
+    for _, opt := range ints {
+        if v := os.Getenv(opt.env); v != "" {
+            n, err := strconv.Atoi(v)
+            if err != nil || n < opt.min {
+                return cfg, fmt.Errorf("invalid %s %q", opt.env, v)
+            }
+            *opt.dst = n
+        }
+    }
+    if v := os.Getenv("RESERVATION_MAX_FRACTION"); v != "" {
+        f, err := strconv.ParseFloat(v, 64)
+        if err != nil || f <= 0 || f > 1 {
+            return cfg, fmt.Errorf("invalid RESERVATION_MAX_FRACTION %q", v)
+        }
+        cfg.MaxFraction = f
+    }
+    if cfg.CapacityTPM > 0 && cfg.CapacityRPM == 0 {
+        return cfg, fmt.Errorf("RESERVATION_CAPACITY_TPM requires RESERVATION_CAPACITY_RPM")
+    }
+    cfg.MaxWindow = time.Duration(windowHours) * time.Hour
+    cfg.MaxLead = time.Duration(leadDays) * 24 * time.Hour
+    cfg.ClaimWithin = time.Duration(claimMinutes) * time.Minute
+    return cfg, nil
+}
+
+// reservable is the rate reservations may hold in total, out of capacity
+func (cfg ReservationConfig) reservable(capacity int) int {
+    return int(float64(capacity) * cfg.MaxFraction)
+}
+
+// Reservation is capacity held for one caller over a window
+type Reservation struct {
+    ID                string
+    Owner             string // rateLimitKey of the caller that made it
+    StartsAt          time.Time
+    EndsAt            time.Time
+    RequestBudget     int
+    TokenBudget       int
+    RequestsPerMinute int // Budgets spread evenly over the window
+    TokensPerMinute   int
+    CreatedAt         time.Time
+
+    requests       int // Used so far
+    tokens         int
+    minute         time.Time // Start of the minute the counts below cover
+    minuteRequests int
+    minuteTokens   int
+    lastUsed       time.Time
+    released       time.Time
+}
+
+// statusLocked names the reservation's state at now
+func (res *Reservation) statusLocked(now time.Time) string {
+    switch {
+    case !res.released.IsZero():
+        return reservationReleased
+    case now.Before(res.StartsAt):
+        return reservationScheduled
+    case now.Before(res.EndsAt):
+        return reservationActive
+    }
+    return reservationEnded
+}
+
+// holdsLocked reports whether the reservation takes capacity at instant t
+func (res *Reservation) holdsLocked(t time.Time) bool {
+    return res.released.IsZero() && !t.Before(res.StartsAt) && t.Before(res.EndsAt)
+}
+
+// rollLocked resets the per-minute counts when now is in a later minute
+func (res *Reservation) rollLocked(now time.Time) {
+    if start := windowStart(now, time.Minute); !start.Equal(res.minute) {
+        res.minute, res.minuteRequests, res.minuteTokens = start, 0, 0
+    }
+}
+
+// ReservationWindow is a span of time, as suggested on a conflict
+type ReservationWindow struct {
+    StartsAt time.Time `json:"starts_at"`
+    EndsAt   time.Time `json:"ends_at"`
+}
+
+// ReservationUsage is consumption within the current minute
+type ReservationUsage struct {
+    Requests int `json:"requests"`
+    Tokens   int `json:"tokens"`
+}
+
+// ReservationInfo is the API view of a reservation
+type ReservationInfo struct {
+    ID                string           `json:"id"`
+    Status            string           `json:"status"`
+    StartsAt          time.Time        `json:"starts_at"`
+    EndsAt            time.Time        `json:"ends_at"`
+    RequestBudget     int              `json:"request_budget"`
+    TokenBudget       int              `json:"token_budget,omitempty"`
+    RequestsPerMinute int              `json:"requests_per_minute"`
+    TokensPerMinute   int              `json:"tokens_per_minute,omitempty"`
+    RequestsUsed      int              `json:"requests_used"`
+    TokensUsed        int              `json:"tokens_used"` // Counted even when tokens aren't reserved
+    RequestsRemaining int              `json:"requests_remaining"`
+    TokensRemaining   *int             `json:"tokens_remaining,omitempty"`
+    CurrentMinute     ReservationUsage `json:"current_minute"`
+    LastUsedAt        *time.Time       `json:"last_used_at,omitempty"`
+    ReleasedAt        *time.Time       `json:"released_at,omitempty"`
+    CreatedAt         time.Time        `json:"created_at"`
+}
+
+func (res *Reservation) infoLocked(now time.Time) ReservationInfo {
+    info := ReservationInfo{
+        ID:                res.ID,
+        Status:            res.statusLocked(now),
+        StartsAt:          res.StartsAt,
+        EndsAt:            res.EndsAt,
+        RequestBudget:     res.RequestBudget,
+        TokenBudget:       res.TokenBudget,
+        RequestsPerMinute: res.RequestsPerMinute,
+        TokensPerMinute:   res.TokensPerMinute,
+        RequestsUsed:      res.requests,
+        TokensUsed:        res.tokens,
+        RequestsRemaining: max(res.RequestBudget-res.requests, 0),
+        CreatedAt:         res.CreatedAt,
+    }
+    if res.TokenBudget > 0 {
+        remaining := max(res.TokenBudget-res.tokens, 0)
+        info.TokensRemaining = &remaining
+    }
+    if windowStart(now, time.Minute).Equal(res.minute) {
+        info.CurrentMinute = ReservationUsage{Requests: res.minuteRequests, Tokens: res.minuteTokens}
+    }
+    if !res.lastUsed.IsZero() {
+        lastUsed := res.lastUsed
+        info.LastUsedAt = &lastUsed
+    }
+    if !res.released.IsZero() {
+        released := res.released
+        info.ReleasedAt = &released
+    }
+    return info
+}
+
+// ReservationConflict means the requested window doesn't fit in the
+// reservable capacity
+type ReservationConflict struct {
+    Reason    string
+    Suggested []ReservationWindow // Windows of the same length that would fit
+}
+
+func (e *ReservationConflict) Error() string {
+    return e.Reason
+}
+
+// ReservationStore holds the reservations of this instance
+type ReservationStore struct {
+    cfg ReservationConfig
+
+    mu           sync.Mutex
+    reservations map[string]*Reservation
+}
+
+// NewReservationStore returns nil when no capacity is configured, which
+// disables reservations
+func NewReservationStore(cfg ReservationConfig) *ReservationStore {
+    if cfg.CapacityRPM == 0 {
+        return nil
+    }
+    log.Printf("Reservations: up to %d of %d requests per minute reservable", cfg.reservable(cfg.CapacityRPM), cfg.CapacityRPM)
+    return &ReservationStore{cfg: cfg, reservations: make(map[string]*Reservation)}
+}
+
+// perMinute spreads a budget evenly over a window, rounding up
+func perMinute(budget int, window time.Duration) int {
+    return int(math.Ceil(float64(budget) / window.Minutes()))
+}
+
+// peakLocked is the highest rate reserved at any moment of [start, end).
+// Reserved load only rises where a reservation starts, so those instants
+// and start itself are the only ones to check.
+func (rs *ReservationStore) peakLocked(start, end time.Time) (requests, tokens int) {
+    points := []time.Time{start}
+    for _, res := range rs.reservations {
+        if res.StartsAt.After(start) && res.StartsAt.Before(end) {
+            points = append(points, res.StartsAt)
+        }
+    }
+    for _, t := range points {
+        var rpm, tpm int
+        for _, res := range rs.reservations {
+            if res.holdsLocked(t) {
+                rpm += res.RequestsPerMinute
+                tpm += res.TokensPerMinute
+            }
+        }
+        requests, tokens = max(requests, rpm), max(tokens, tpm)
+    }
+    return requests, tokens
+}
+
+// fitsLocked reports whether rates can be reserved over [start, end)
+func (rs *ReservationStore) fitsLocked(start, end time.Time, rpm, tpm int) bool {
+    requests, tokens := rs.peakLocked(start, end)
+    return requests+rpm <= rs.cfg.reservable(rs.cfg.CapacityRPM) && tokens+tpm <= rs.cfg.reservable(rs.cfg.CapacityTPM)
+}
+
+// suggestLocked finds the earliest windows of the same length that fit,
+// no further ahead than the lead limit. Room only opens up where a
+// reservation ends, so those are the candidate starts.
+func (rs *ReservationStore) suggestLocked(res *Reservation, now time.Time) []ReservationWindow {
+    length := res.EndsAt.Sub(res.StartsAt)
+    var starts []time.Time
+    for _, other := range rs.reservations {
+        if other.released.IsZero() && other.EndsAt.After(res.StartsAt) {
+            starts = append(starts, other.EndsAt)
+        }
+    }
+    sort.Slice(starts, func(a, b int) bool { return starts[a].Before(starts[b]) })
+
+    var suggested []ReservationWindow
+    latest := now.Add(rs.cfg.MaxLead)
+    for i, start := range starts {
+        if start.After(latest) || len(suggested) == reservationSuggestions {
+            break
+        }
+        if i > 0 && start.Equal(starts[i-1]) {
+            continue
+        }
+        if rs.fitsLocked(start, start.Add(length), res.RequestsPerMinute, res.TokensPerMinute) {
+            suggested = append(suggested, ReservationWindow{StartsAt: start, EndsAt: start.Add(length)})
+        }
+    }
+    return suggested
+}
+
+// Create admits a reservation if its rates fit alongside the others over
+// its whole window
+func (rs *ReservationStore) Create(res *Reservation, now time.Time) error {
+    rs.mu.Lock()
+    defer rs.mu.Unlock()
+
+    maxRPM, maxTPM := rs.cfg.reservable(rs.cfg.CapacityRPM), rs.cfg.reservable(rs.cfg.CapacityTPM)
+    if res.RequestsPerMinute > maxRPM || res.TokensPerMinute > maxTPM {
+        metrics.Inc("reservation_conflicts_total")
+        reason := fmt.Sprintf("The reservation needs %d requests per minute; at most %d can be reserved", res.RequestsPerMinute, maxRPM)
+        if res.TokensPerMinute > maxTPM {
+            reason = fmt.Sprintf("The reservation needs %d tokens per minute; at most %d can be reserved", res.TokensPerMinute, maxTPM)
+        }
+        return &ReservationConflict{Reason: reason + ". Spread the budget over a longer window."}
+    }
+    if !rs.fitsLocked(res.StartsAt, res.EndsAt, res.RequestsPerMinute, res.TokensPerMinute) {
+        metrics.Inc("reservation_conflicts_total")
+        return &ReservationConflict{
+            Reason:    "Other reservations already hold too much of the capacity during that window",
+            Suggested: rs.suggestLocked(res, now),
+        }
+    }
+
+    res.ID = "resv_" + newRequestID()
+    res.CreatedAt = now
+    rs.reservations[res.ID] = res
+    metrics.Inc("reservations_created_total")
+    log.Printf("Reservation %s created for %s: %d requests per minute from %v to %v",
+        res.ID, res.Owner, res.RequestsPerMinute, res.StartsAt.Format(time.RFC3339), res.EndsAt.Format(time.RFC3339))
+    return nil
+}
+
+// Info returns one of owner's reservations
+func (rs *ReservationStore) Info(owner, id string, now time.Time) (ReservationInfo, bool) {
+    rs.mu.Lock()
+    defer rs.mu.Unlock()
+    res, ok := rs.reservations[id]
+    if !ok || res.Owner != owner {
+        return ReservationInfo{}, false
+    }
+    return res.infoLocked(now), true
+}
+
+// Admit counts one request against a reservation. The decision carries the
+// reservation's per-minute window for the rate limit headers.
+func (rs *ReservationStore) Admit(owner, id string, now time.Time) (RateDecision, int, *APIError) {
+    rs.mu.Lock()
+    defer rs.mu.Unlock()
+
+    res, ok := rs.reservations[id]
+    if !ok || res.Owner != owner {
+        return RateDecision{}, http.StatusNotFound, &APIError{Code: ErrCodeNotFound, Message: "Unknown reservation"}
+    }
+    switch status := res.statusLocked(now); status {
+    case reservationScheduled:
+        return RateDecision{}, http.StatusForbidden, &APIError{Code: ErrCodeForbidden, Message: fmt.Sprintf("Reservation %s starts at %s", id, res.StartsAt.UTC().Format(time.RFC3339))}
+    case reservationEnded, reservationReleased:
+        return RateDecision{}, http.StatusForbidden, &APIError{Code: ErrCodeForbidden, Message: fmt.Sprintf("Reservation %s is %s", id, status)}
+    }
+
+    if res.requests >= res.RequestBudget || (res.TokenBudget > 0 && res.tokens >= res.TokenBudget) {
+        metrics.Inc("reservation_requests_total", "outcome", "exhausted")
+        return RateDecision{}, http.StatusTooManyRequests, &APIError{Code: ErrCodeBudgetExceeded, Message: fmt.Sprintf("Reservation %s has used its whole budget", id)}
+    }
+
+    res.rollLocked(now)
+    decision := RateDecision{Limit: res.RequestsPerMinute, ResetAt: res.minute.Add(time.Minute)}
+    if res.minuteRequests >= res.RequestsPerMinute || (res.TokensPerMinute > 0 && res.minuteTokens >= res.TokensPerMinute) {
+        metrics.Inc("reservation_requests_total", "outcome", "rate_limited")
+        retryAfter := int(decision.ResetAt.Sub(now).Seconds() + 0.999)
+        return decision, http.StatusTooManyRequests, &APIError{
+            Code:              ErrCodeRateLimited,
+            Message:           "Reserved rate exceeded",
+            RetryAfterSeconds: max(retryAfter, 1),
+        }
+    }
+    res.requests++
+    res.minuteRequests++
+    res.lastUsed = now
+    decision.Allowed = true
+    decision.Remaining = res.RequestsPerMinute - res.minuteRequests
+    metrics.Inc("reservation_requests_total", "outcome", "admitted")
+    return decision, 0, nil
+}
+
+// charge counts tokens spent by a reserved request
+func (rs *ReservationStore) charge(id string, tokens int, now time.Time) {
+    rs.mu.Lock()
+    defer rs.mu.Unlock()
+    if res, ok := rs.reservations[id]; ok {
+        res.rollLocked(now)
+        res.tokens += tokens
+        res.minuteTokens += tokens
+    }
+}
+
+// Run releases reservations nobody claimed and drops old ones
+func (rs *ReservationStore) Run() {
+    for now := range time.Tick(reservationSweep) {
+        rs.sweep(now)
+    }
+}
+
+func (rs *ReservationStore) sweep(now time.Time) {
+    rs.mu.Lock()
+    defer rs.mu.Unlock()
+    for id, res := range rs.reservations {
+        switch {
+        case now.Sub(res.EndsAt) > reservationRetention || (!res.released.IsZero() && now.Sub(res.released) > reservationRetention):
+            delete(rs.reservations, id)
+        case res.released.IsZero() && res.requests == 0 && now.Before(res.EndsAt) && now.Sub(res.StartsAt) >= rs.cfg.ClaimWithin:
+            res.released = now
+            metrics.Inc("reservations_released_total")
+            log.Printf("Reservation %s released: no traffic within %v of its start", id, rs.cfg.ClaimWithin)
+        }
+    }
+}
+
+type reservationKey struct{}
+
+// reservedRequest is attached to the context of requests admitted under a
+// reservation, so the tokens they spend are charged to it
+type reservedRequest struct {
+    store *ReservationStore
+    id    string
+}
+
+// chargeReservation counts tokens against the request's reservation, if it
+// has one
+func chargeReservation(ctx context.Context, tokens int) {
+    if reserved, ok := ctx.Value(reservationKey{}).(reservedRequest); ok && tokens > 0 {
+        reserved.store.charge(reserved.id, tokens, time.Now())
+    }
+}
+
+// admitReserved admits a request tagged with X-Reservation-ID, or writes
+// the rejection. It replaces the caller's rate limit check.
+func admitReserved(w http.ResponseWriter, r *http.Request, rs *ReservationStore, id string, now time.Time) (*http.Request, bool) {
+    if rs == nil {
+        writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Reservations are not enabled on this service")
+        return r, false
+    }
+    decision, status, apiErr := rs.Admit(rateLimitKey(r), id, now)
+    if decision.Limit > 0 {
+        setRateLimitHeaders(w, &decision, now)
+    }
+    if apiErr != nil {
+        requestRecordFrom(r.Context()).Policy("reservation %s: %s", id, apiErr.Message)
+        writeAPIError(w, r, status, *apiErr)
+        return r, false
+    }
+    requestRecordFrom(r.Context()).Policy("admitted under reservation %s", id)
+    return r.WithContext(context.WithValue(r.Context(), reservationKey{}, reservedRequest{store: rs, id: id})), true
+}
+
+// CreateReservationRequest is the body of POST /reservations
+type CreateReservationRequest struct {
+    StartsAt      *time.Time `json:"starts_at,omitempty"` // Omitted to start now
+    EndsAt        time.Time  `json:"ends_at"`
+    RequestBudget int        `json:"request_budget"`
+    TokenBudget   int        `json:"token_budget,omitempty"` // Required when the service reserves tokens
+}
+
+// validate checks the request and returns the window's start
+func (req *CreateReservationRequest) validate(cfg ReservationConfig, now time.Time) ([]FieldError, time.Time) {
+    var fields []FieldError
+    start := now
+    if req.StartsAt != nil {
+        start = *req.StartsAt
+        switch {
+        case start.Before(now.Add(-time.Minute)):
+            fields = append(fields, FieldError{Field: "starts_at", Message: "must not be in the past"})
+        case start.After(now.Add(cfg.MaxLead)):
+            fields = append(fields, FieldError{Field: "starts_at", Message: fmt.Sprintf("must be within %v from now", cfg.MaxLead)})
+        }
+    }
+    switch window := req.EndsAt.Sub(start); {
+    case req.EndsAt.IsZero():
+        fields = append(fields, FieldError{Field: "ends_at", Message: "is required"})
+    case window < time.Minute:
+        fields = append(fields, FieldError{Field: "ends_at", Message: "must be at least a minute after starts_at"})
+    case window > cfg.MaxWindow:
+        fields = append(fields, FieldError{Field: "ends_at", Message: fmt.Sprintf("must be within %v of starts_at", cfg.MaxWindow)})
+    }
+    if req.RequestBudget < 1 {
+        fields = append(fields, FieldError{Field: "request_budget", Message: "must be at least 1"})
+    }
+    switch {
+    case cfg.CapacityTPM > 0 && req.TokenBudget < 1:
+        fields = append(fields, FieldError{Field: "token_budget", Message: "is required: this service reserves tokens"})
+    case cfg.CapacityTPM == 0 && req.TokenBudget != 0:
+        fields = append(fields, FieldError{Field: "token_budget", Message: "must be left out: this service reserves requests only"})
+    }
+    return fields, start
+}
+
+func createReservationHandler(rs *ReservationStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req CreateReservationRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+
+        now := time.Now()
+        fields, start := req.validate(rs.cfg, now)
+        if len(fields) > 0 {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: "Invalid reservation",
+                Fields:  fields,
+            })
+            return
+        }
+
+        window := req.EndsAt.Sub(start)
+        res := &Reservation{
+            Owner:             rateLimitKey(r),
+            StartsAt:          start,
+            EndsAt:            req.EndsAt,
+            RequestBudget:     req.RequestBudget,
+            TokenBudget:       req.TokenBudget,
+            RequestsPerMinute: perMinute(req.RequestBudget, window),
+        }
+        if req.TokenBudget > 0 {
+            res.TokensPerMinute = perMinute(req.TokenBudget, window)
+        }
+        if err := rs.Create(res, now); err != nil {
+            conflict := err.(*ReservationConflict)
+            writeAPIError(w, r, http.StatusConflict, APIError{
+                Code:             ErrCodeReservationConflict,
+                Message:          conflict.Reason,
+                SuggestedWindows: conflict.Suggested,
+            })
+            return
+        }
+
+        info, _ := rs.Info(res.Owner, res.ID, now)
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(info)
+    }
+}
+
+func getReservationHandler(rs *ReservationStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        info, ok := rs.Info(rateLimitKey(r), mux.Vars(r)["id"], time.Now())
+        if !ok {
+            writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Unknown reservation")
+            return
+        }
+        writeJSON(w, r, info)
+    }
+}
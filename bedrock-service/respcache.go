@@ -0,0 +1,194 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// ResponseCacheConfig sizes the /generate response cache
+type ResponseCacheConfig struct {
+    MaxEntries int // 0 disables the cache
+    TTL        time.Duration
+}
+
+// LoadResponseCacheConfig reads RESPONSE_CACHE_SIZE (default 0, disabled)
+// and RESPONSE_CACHE_TTL_SECONDS (default 300)
+func LoadResponseCacheConfig() (ResponseCacheConfig, error) {
+    cfg := ResponseCacheConfig{TTL: 5 * time.Minute}
+    if v := os.Getenv("RESPONSE_CACHE_SIZE"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            return cfg, fmt.Errorf("invalid RESPONSE_CACHE_SIZE %q", v)
+        }
+        cfg.MaxEntries = n
+    }
+    if v := os.Getenv("RESPONSE_CACHE_TTL_SECONDS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return cfg, fmt.Errorf("invalid RESPONSE_CACHE_TTL_SECONDS %q", v)
+        }
+        cfg.TTL = time.Duration(n) * time.Second
+    }
+    return cfg, nil
+}
+
+// responseCacheKey derives the cache key from the request body exactly as it
+// is sent to the model, not from the caller's request. Everything that
+// changes what the model sees, the resolved system prompt, injected time
+// context, stored prefixes, experiment overrides, history and tools, changes
+// the key without having to be listed here. The body is re-encoded first so
+// field order and whitespace don't matter.
+func responseCacheKey(scope, modelID string, body []byte) (string, error) {
+    var decoded interface{}
+    if err := json.Unmarshal(body, &decoded); err != nil {
+        return "", fmt.Errorf("request body for %s is not JSON: %v", modelID, err)
+    }
+    h := sha256.New()
+    io.WriteString(h, scope)
+    h.Write([]byte{0})
+    io.WriteString(h, modelID)
+    h.Write([]byte{0})
+    // Encoded straight into the hash; the encoder's trailing newline is
+    // hashed as well, which is as good as any other terminator
+    if err := json.NewEncoder(h).Encode(decoded); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type cachedResponse struct {
+    result   GenerationResult
+    expires  time.Time
+    lastUsed time.Time
+}
+
+// ResponseCache keeps recent /generate results in memory, isolated per
+// tenant. A nil cache misses every lookup and stores nothing.
+type ResponseCache struct {
+    cfg    ResponseCacheConfig
+    memory *MemoryGovernor // Lookups and stores stop under memory pressure
+
+    mu      sync.Mutex
+    entries map[string]*cachedResponse
+}
+
+// NewResponseCache returns nil when the cache is disabled
+func NewResponseCache(cfg ResponseCacheConfig, memory *MemoryGovernor) *ResponseCache {
+    if cfg.MaxEntries == 0 {
+        return nil
+    }
+    return &ResponseCache{cfg: cfg, memory: memory, entries: make(map[string]*cachedResponse)}
+}
+
+// Key returns the cache key for a model invocation, or "" to bypass the
+// cache. A key that can't be derived bypasses it rather than risk a wrong hit.
+func (rc *ResponseCache) Key(scope, modelID string, body []byte) string {
+    if rc == nil || scope == "" || rc.memory.UnderPressure() {
+        return ""
+    }
+    key, err := responseCacheKey(scope, modelID, body)
+    if err != nil {
+        metrics.Inc("response_cache_key_failures_total", "model", modelID)
+        return ""
+    }
+    return key
+}
+
+// Get returns a copy of a live cached result
+func (rc *ResponseCache) Get(key string, now time.Time) (*GenerationResult, bool) {
+    if rc == nil || key == "" {
+        return nil, false
+    }
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+    entry, ok := rc.entries[key]
+    if !ok || now.After(entry.expires) {
+        delete(rc.entries, key)
+        metrics.Inc("response_cache_lookups_total", "outcome", "miss")
+        return nil, false
+    }
+    entry.lastUsed = now
+    metrics.Inc("response_cache_lookups_total", "outcome", "hit")
+    result := entry.result
+    result.Cached, result.Latency = true, 0
+    return &result, true
+}
+
+// Put stores a successful, unfiltered result
+func (rc *ResponseCache) Put(key string, result *GenerationResult, now time.Time) {
+    if rc == nil || key == "" || result.Filtered {
+        return
+    }
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+    if _, ok := rc.entries[key]; !ok && len(rc.entries) >= rc.cfg.MaxEntries {
+        rc.evictLocked(len(rc.entries)-rc.cfg.MaxEntries+1, now)
+    }
+    rc.entries[key] = &cachedResponse{result: *result, expires: now.Add(rc.cfg.TTL), lastUsed: now}
+}
+
+// evictLocked drops expired entries, then the n least recently used if
+// that wasn't enough
+func (rc *ResponseCache) evictLocked(n int, now time.Time) int {
+    dropped := 0
+    for key, entry := range rc.entries {
+        if now.After(entry.expires) {
+            delete(rc.entries, key)
+            dropped++
+        }
+    }
+    if dropped >= n {
+        return dropped
+    }
+    sizes := make(map[string]int64, len(rc.entries))
+    lastUsed := make(map[string]time.Time, len(rc.entries))
+    var total int64
+    for key, entry := range rc.entries {
+        sizes[key], lastUsed[key] = 1, entry.lastUsed
+        total++
+    }
+    for _, key := range lruEvict(sizes, lastUsed, total-int64(n-dropped)) {
+        delete(rc.entries, key)
+        dropped++
+    }
+    return dropped
+}
+
+func (entry *cachedResponse) memoryBytes() int64 {
+    r := entry.result
+    return int64(len(r.Text)+len(r.ModelName)+len(r.ModelID)+len(r.Account)+len(r.FinishReason)+len(r.FinishReasonRaw)) + recordOverhead
+}
+
+// MemoryBytes estimates the bytes held by cached results
+func (rc *ResponseCache) MemoryBytes() int64 {
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+    var n int64
+    for _, entry := range rc.entries {
+        n += entry.memoryBytes()
+    }
+    return n
+}
+
+// EvictTo drops the least recently used results
+func (rc *ResponseCache) EvictTo(target int64) int {
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+    sizes := make(map[string]int64, len(rc.entries))
+    lastUsed := make(map[string]time.Time, len(rc.entries))
+    for key, entry := range rc.entries {
+        sizes[key], lastUsed[key] = entry.memoryBytes(), entry.lastUsed
+    }
+    drop := lruEvict(sizes, lastUsed, target)
+    for _, key := range drop {
+        delete(rc.entries, key)
+    }
+    return len(drop)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+)
+
+// cacheKeyBodies are Bedrock request bodies of the sizes /generate sends:
+// a one-line prompt, and a long conversation with stored context
+func cacheKeyBodies(b *testing.B) map[string][]byte {
+    b.Helper()
+    model := ModelInfo{ID: "anthropic.claude-3-haiku-20240307-v1:0", API: apiMessages}
+    short := GenerationParams{Prompt: "Say hello", Origin: originUser}.withDefaults()
+    long := GenerationParams{Prompt: strings.Repeat("Summarise the thread so far. ", 40), Origin: originUser,
+        ContextPrefix: strings.Repeat("Stored context line. ", 200)}.withDefaults()
+    for i := 0; i < 20; i++ {
+        long.History = append(long.History, ChatMessage{Role: "user", Content: strings.Repeat("question ", 30)},
+            ChatMessage{Role: "assistant", Content: strings.Repeat("answer ", 60)})
+    }
+    bodies := make(map[string][]byte)
+    for name, p := range map[string]GenerationParams{"short": short, "long": long} {
+        data, err := json.Marshal(buildRequestBody(model, p))
+        if err != nil {
+            b.Fatal(err)
+        }
+        bodies[name] = data
+    }
+    return bodies
+}
+
+func BenchmarkResponseCacheKey(b *testing.B) {
+    bodies := cacheKeyBodies(b)
+    for _, name := range []string{"short", "long"} {
+        body := bodies[name]
+        b.Run(name, func(b *testing.B) {
+            b.ReportAllocs()
+            b.SetBytes(int64(len(body)))
+            for i := 0; i < b.N; i++ {
+                if _, err := responseCacheKey("tenant-a", "anthropic.claude-3-haiku-20240307-v1:0", body); err != nil {
+                    b.Fatal(err)
+                }
+            }
+        })
+    }
+}
+
+// Every input that changes the body sent to the model changes the cache
+// key, whether or not it shows in the caller's request
+func TestResponseCacheKeyVaries(t *testing.T) {
+    model := ModelInfo{ID: "anthropic.claude-3-haiku-20240307-v1:0", Name: "Claude 3 Haiku", API: apiMessages}
+    const fallbackFrom = "mistral.mixtral-8x7b-instruct-v0:1" // Adaptations apply when falling back from another vendor
+    template := func(text string) *PromptAdaptations {
+        return &PromptAdaptations{rules: map[string][]*AdaptationRule{
+            "anthropic": {{Name: "house-style", Template: text}},
+        }}
+    }
+    plain := &BedrockClient{}
+    v1 := &BedrockClient{adaptations: template("{system}\nAnswer in British English.")}
+    v2 := &BedrockClient{adaptations: template("{system}\nAnswer in British English. Be brief.")}
+
+    at := time.Date(2026, 3, 2, 9, 30, 0, 0, time.UTC)
+    paris, _ := time.LoadLocation("Europe/Paris")
+    custom, empty := "You are a pirate.", ""
+    tool := func(property string) []ToolSpec {
+        return []ToolSpec{{Name: "lookup", Description: "Look up an order", InputSchema: map[string]interface{}{
+            "type": "object", "properties": map[string]interface{}{property: map[string]interface{}{"type": "string"}},
+        }}}
+    }
+
+    key := func(bc *BedrockClient, p GenerationParams) string {
+        t.Helper()
+        p.Origin, p.CacheScope = originUser, "tenant-a"
+        attempt, _ := bc.adapt(model, p.withDefaults())
+        body, err := json.Marshal(buildRequestBody(model, attempt))
+        if err != nil {
+            t.Fatal(err)
+        }
+        k, err := responseCacheKey(p.responseCacheScope(), model.ID, body)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return k
+    }
+    base := GenerationParams{Prompt: "Where is my order?", PreferredModel: fallbackFrom}
+
+    for _, c := range []struct {
+        name     string
+        bcA, bcB *BedrockClient // Prompt adaptations in effect
+        a, b     GenerationParams
+        equal    bool
+    }{
+        {"same inputs", plain, plain, base, base, true},
+        {"system prompt set", plain, plain, base, withParams(base, func(p *GenerationParams) { p.SystemPrompt = &custom }), false},
+        {"system prompt emptied", plain, plain, base, withParams(base, func(p *GenerationParams) { p.SystemPrompt = &empty }), false},
+        {"template added", plain, v1, base, base, false},
+        {"template version", v1, v2, base, base, false},
+        {"template skipped", v1, v1, base, withParams(base, func(p *GenerationParams) { p.NoAdaptation = true }), false},
+        {"time context injected", plain, plain, base, withParams(base, func(p *GenerationParams) { p.SystemContext = []string{formatTimeContext(at, time.UTC)} }), false},
+        {"time context a minute on", plain, plain,
+            withParams(base, func(p *GenerationParams) { p.SystemContext = []string{formatTimeContext(at, time.UTC)} }),
+            withParams(base, func(p *GenerationParams) { p.SystemContext = []string{formatTimeContext(at.Add(time.Minute), time.UTC)} }), false},
+        {"time context in another zone", plain, plain,
+            withParams(base, func(p *GenerationParams) { p.SystemContext = []string{formatTimeContext(at, time.UTC)} }),
+            withParams(base, func(p *GenerationParams) { p.SystemContext = []string{formatTimeContext(at, paris)} }), false},
+        {"tools offered", plain, plain, base, withParams(base, func(p *GenerationParams) { p.Tools = tool("order_id") }), false},
+        {"tool schema", plain, plain, withParams(base, func(p *GenerationParams) { p.Tools = tool("order_id") }), withParams(base, func(p *GenerationParams) { p.Tools = tool("email") }), false},
+        {"guardrail", plain, plain, base, withParams(base, func(p *GenerationParams) { p.Guardrail = &Guardrail{ID: "gr", Version: "1"} }), false},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            if got := key(c.bcA, c.a) == key(c.bcB, c.b); got != c.equal {
+                t.Errorf("keys equal %v, want %v", got, c.equal)
+            }
+        })
+    }
+
+    // The body is re-encoded, so field order and whitespace don't count
+    a, _ := responseCacheKey("tenant-a", model.ID, []byte(`{"max_tokens":10,"messages":[]}`))
+    b, _ := responseCacheKey("tenant-a", model.ID, []byte("{ \"messages\": [],\n  \"max_tokens\": 10 }"))
+    if a != b {
+        t.Error("the same body in another field order got another key")
+    }
+}
+
+// withParams returns a copy of p changed by set
+func withParams(p GenerationParams, set func(*GenerationParams)) GenerationParams {
+    set(&p)
+    return p
+}
+
+// A key that can't be derived bypasses the cache and is counted
+func TestResponseCacheKeyFailure(t *testing.T) {
+    rc := NewResponseCache(ResponseCacheConfig{MaxEntries: 10, TTL: time.Minute}, nil)
+    const model = "test.key-failure"
+    before := metrics.Value("response_cache_key_failures_total", "model", model)
+    if key := rc.Key("tenant-a", model, []byte("{not json")); key != "" {
+        t.Errorf("key %q for a body that isn't JSON, want the cache bypassed", key)
+    }
+    if n := metrics.Value("response_cache_key_failures_total", "model", model) - before; n != 1 {
+        t.Errorf("%v key failures counted, want 1", n)
+    }
+}
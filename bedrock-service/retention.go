@@ -0,0 +1,401 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/s3"
+    "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Data types the retention sweeper enforces, as named in RETENTION_DAYS
+var retentionTypes = []string{"conversations", "results", "usage"}
+
+// retentionLeaseTTL is how long a replica holds the sweep lease without
+// renewing it; it is renewed before every batch
+const retentionLeaseTTL = 15 * time.Minute
+
+// RetentionConfig sets how long each type of data is kept and how hard the
+// sweeper may work to delete it
+type RetentionConfig struct {
+    Days       map[string]int // Retention per data type, 0 to keep forever
+    Schedule   *cronSpec
+    BatchSize  int           // Items examined per batch
+    BatchPause time.Duration // Sleep between batches, so sweeps yield to user traffic
+    StateFile  string        // Where an interrupted sweep's position is kept, empty for none
+    NodeID     string        // Holder name for the lease shared with other replicas
+}
+
+// LoadRetentionConfig reads RETENTION_DAYS as comma-separated type=days
+// pairs (default conversations=90,results=7,usage=400), RETENTION_SCHEDULE
+// (default "0 3 * * *"), RETENTION_BATCH_SIZE (default 100),
+// RETENTION_BATCH_PAUSE_MS (default 500), RETENTION_STATE_FILE and
+// RETENTION_NODE_ID (default the hostname)
+func LoadRetentionConfig() (RetentionConfig, error) {
+    cfg := RetentionConfig{
+        Days:       map[string]int{"conversations": 90, "results": 7, "usage": 400},
+        BatchSize:  100,
+        BatchPause: 500 * time.Millisecond,
+        StateFile:  os.Getenv("RETENTION_STATE_FILE"),
+        NodeID:     os.Getenv("RETENTION_NODE_ID"),
+    }
+
+    if v := os.Getenv("RETENTION_DAYS"); v != "" {
+        for _, pair := range strings.Split(v, ",") {
+            name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+            n, err := strconv.Atoi(value)
+            if !ok || err != nil || n < 0 || !containsString(retentionTypes, name) {
+                return cfg, fmt.Errorf("invalid RETENTION_DAYS entry %q; types are %s", pair, strings.Join(retentionTypes, ", "))
+            }
+            cfg.Days[name] = n
+        }
+    }
+
+    schedule := "0 3 * * *"
+    if v := os.Getenv("RETENTION_SCHEDULE"); v != "" {
+        schedule = v
+    }
+    spec, err := parseCron(schedule)
+    if err != nil {
+        return cfg, fmt.Errorf("invalid RETENTION_SCHEDULE %q: %v", schedule, err)
+    }
+    cfg.Schedule = spec
+
+    if v := os.Getenv("RETENTION_BATCH_SIZE"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 || n > 1000 {
+            return cfg, fmt.Errorf("invalid RETENTION_BATCH_SIZE %q (1 to 1000)", v)
+        }
+        cfg.BatchSize = n
+    }
+    if v := os.Getenv("RETENTION_BATCH_PAUSE_MS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            return cfg, fmt.Errorf("invalid RETENTION_BATCH_PAUSE_MS %q", v)
+        }
+        cfg.BatchPause = time.Duration(n) * time.Millisecond
+    }
+
+    if cfg.NodeID == "" {
+        hostname, err := os.Hostname()
+        if err != nil {
+            return cfg, fmt.Errorf("unable to determine node ID, set RETENTION_NODE_ID: %v", err)
+        }
+        cfg.NodeID = hostname
+    }
+    return cfg, nil
+}
+
+// RetentionReport is what a sweep of one data type deleted, or in a dry run
+// would delete
+type RetentionReport struct {
+    Type    string     `json:"type"`
+    Days    int        `json:"retention_days"`
+    Cutoff  time.Time  `json:"cutoff"`
+    Count   int        `json:"count"`
+    Oldest  *time.Time `json:"oldest,omitempty"`
+    Newest  *time.Time `json:"newest,omitempty"`
+    Skipped string     `json:"skipped,omitempty"` // Why the type wasn't swept
+    Error   string     `json:"error,omitempty"`
+}
+
+// add counts one expired item last written at t
+func (rep *RetentionReport) add(t time.Time) {
+    rep.Count++
+    if rep.Oldest == nil || t.Before(*rep.Oldest) {
+        rep.Oldest = &t
+    }
+    if rep.Newest == nil || t.After(*rep.Newest) {
+        rep.Newest = &t
+    }
+}
+
+// RetentionTarget is a store the sweeper deletes expired data from. A sweep
+// goes in batches: each call examines up to limit items after cursor, counts
+// the ones written before cutoff into rep, deletes them unless dryRun, and
+// returns the cursor to continue from, "" once the store is done.
+type RetentionTarget interface {
+    SweepExpired(ctx context.Context, cutoff time.Time, cursor string, limit int, dryRun bool, rep *RetentionReport) (string, error)
+}
+
+// expiredPage picks the next batch for an in-memory store: up to limit IDs
+// after cursor, in ID order, that were written before cutoff
+func expiredPage(written map[string]time.Time, cutoff time.Time, cursor string, limit int) ([]string, string) {
+    var ids []string
+    for id, t := range written {
+        if id > cursor && t.Before(cutoff) {
+            ids = append(ids, id)
+        }
+    }
+    sort.Strings(ids)
+    if len(ids) <= limit {
+        return ids, ""
+    }
+    return ids[:limit], ids[limit-1]
+}
+
+// RetentionLease is an advisory lock shared by replicas, so data they share
+// is swept by one of them at a time
+type RetentionLease interface {
+    Acquire(ctx context.Context, holder string, ttl time.Duration, now time.Time) (bool, error)
+    Release(ctx context.Context, holder string) error
+}
+
+type retentionTargetEntry struct {
+    name   string
+    target RetentionTarget
+    shared bool // Held in a store every replica sees, swept under the lease
+}
+
+// retentionState is an interrupted sweep's position, per data type
+type retentionState struct {
+    Cursors map[string]string `json:"cursors"`
+}
+
+// RetentionSweeper deletes data past its retention period on a schedule
+type RetentionSweeper struct {
+    cfg     RetentionConfig
+    lease   RetentionLease // Nil when there is no shared store
+    targets []retentionTargetEntry
+
+    running sync.Mutex // Held for the length of a real sweep
+}
+
+func NewRetentionSweeper(cfg RetentionConfig, lease RetentionLease) *RetentionSweeper {
+    return &RetentionSweeper{cfg: cfg, lease: lease}
+}
+
+// Register puts a store under the sweeper. Shared stores are only swept by
+// the replica holding the lease.
+func (rs *RetentionSweeper) Register(name string, target RetentionTarget, shared bool) {
+    rs.targets = append(rs.targets, retentionTargetEntry{name: name, target: target, shared: shared})
+}
+
+// Run sweeps on the configured schedule
+func (rs *RetentionSweeper) Run() {
+    for {
+        next := rs.cfg.Schedule.Next(time.Now())
+        time.Sleep(time.Until(next))
+        rs.Sweep(context.Background(), false)
+    }
+}
+
+// Sweep deletes expired data from every registered store, or with dryRun
+// only reports what it would delete. Real sweeps pause between batches and
+// save their position after each one, so a sweep cut short by a restart
+// picks up where it stopped.
+func (rs *RetentionSweeper) Sweep(ctx context.Context, dryRun bool) []RetentionReport {
+    if !dryRun {
+        if !rs.running.TryLock() {
+            logInfof(ctx, "Retention sweep already running; skipping")
+            return nil
+        }
+        defer rs.running.Unlock()
+    }
+
+    state := retentionState{Cursors: make(map[string]string)}
+    if !dryRun && rs.cfg.StateFile != "" {
+        if err := loadState(rs.cfg.StateFile, &state); err != nil {
+            logErrorf(ctx, "Error loading retention state, starting over: %v", err)
+        }
+        if state.Cursors == nil {
+            state.Cursors = make(map[string]string)
+        }
+    }
+
+    started := time.Now()
+    var leased bool
+    reports := make([]RetentionReport, 0, len(rs.targets))
+    for _, t := range rs.targets {
+        rep := RetentionReport{Type: t.name, Days: rs.cfg.Days[t.name]}
+        if rep.Days == 0 {
+            rep.Skipped = "retention disabled"
+            reports = append(reports, rep)
+            continue
+        }
+        rep.Cutoff = started.AddDate(0, 0, -rep.Days)
+
+        cursor := ""
+        if !dryRun {
+            cursor = state.Cursors[t.name]
+            if cursor != "" {
+                logInfof(ctx, "Resuming retention sweep of %s after %q", t.name, cursor)
+            }
+        }
+        for {
+            if t.shared && !dryRun && rs.lease != nil {
+                // Renewed before every batch, so a replica that dies mid-sweep
+                // frees the lease within its TTL
+                ok, err := rs.lease.Acquire(ctx, rs.cfg.NodeID, retentionLeaseTTL, time.Now())
+                if err != nil {
+                    rep.Error = fmt.Sprintf("lease: %v", err)
+                    break
+                }
+                if !ok {
+                    rep.Skipped = "another replica holds the retention lease"
+                    break
+                }
+                leased = true
+            }
+
+            next, err := t.target.SweepExpired(ctx, rep.Cutoff, cursor, rs.cfg.BatchSize, dryRun, &rep)
+            if err != nil {
+                rep.Error = err.Error()
+                break
+            }
+            cursor = next
+            if !dryRun {
+                if cursor == "" {
+                    delete(state.Cursors, t.name)
+                } else {
+                    state.Cursors[t.name] = cursor
+                }
+                rs.saveState(state)
+            }
+            if cursor == "" {
+                break
+            }
+            if !dryRun {
+                time.Sleep(rs.cfg.BatchPause)
+            }
+        }
+        reports = append(reports, rep)
+    }
+    if leased {
+        if err := rs.lease.Release(ctx, rs.cfg.NodeID); err != nil {
+            logErrorf(ctx, "Error releasing retention lease: %v", err)
+        }
+    }
+
+    if !dryRun {
+        rs.record(reports, time.Since(started))
+    }
+    return reports
+}
+
+func (rs *RetentionSweeper) saveState(state retentionState) {
+    if rs.cfg.StateFile == "" {
+        return
+    }
+    if err := saveState(rs.cfg.StateFile, state); err != nil {
+        log.Printf("Error saving retention state: %v", err)
+    }
+}
+
+// record emits the metrics and audit entries for a real sweep
+func (rs *RetentionSweeper) record(reports []RetentionReport, took time.Duration) {
+    outcome := "completed"
+    for _, rep := range reports {
+        switch {
+        case rep.Error != "":
+            outcome = "failed"
+            log.Printf("Retention sweep of %s failed after %d deletions: %s", rep.Type, rep.Count, rep.Error)
+        case rep.Skipped != "":
+            log.Printf("Retention sweep of %s skipped: %s", rep.Type, rep.Skipped)
+        case rep.Count > 0:
+            log.Printf("Audit: retention sweep deleted %d %s older than %d days (oldest %s, newest %s)",
+                rep.Count, rep.Type, rep.Days, rep.Oldest.Format(time.RFC3339), rep.Newest.Format(time.RFC3339))
+        }
+        metrics.Add("retention_deleted_total", float64(rep.Count), "type", rep.Type)
+    }
+    metrics.Inc("retention_sweeps_total", "outcome", outcome)
+    metrics.Set("retention_last_sweep_seconds", took.Seconds())
+    log.Printf("Retention sweep %s in %s", outcome, took.Round(time.Millisecond))
+}
+
+func retentionDryRunHandler(rs *RetentionSweeper) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        reports := rs.Sweep(r.Context(), true)
+        logInfof(r.Context(), "Retention dry run requested from %s", r.RemoteAddr)
+        writeJSON(w, r, map[string]interface{}{"dry_run": true, "reports": reports})
+    }
+}
+
+// resultStoreLease keeps the retention lease as an object in the results
+// bucket. S3 has no compare-and-swap here, so a write is read back to see
+// whose landed; two replicas racing can still both win, which only costs
+// duplicate work because deletes are idempotent.
+type resultStoreLease struct {
+    rs  *ResultStore
+    key string
+}
+
+type leaseRecord struct {
+    Holder  string    `json:"holder"`
+    Expires time.Time `json:"expires"`
+}
+
+func newResultStoreLease(rs *ResultStore) *resultStoreLease {
+    return &resultStoreLease{rs: rs, key: rs.cfg.Prefix + retentionLeaseDir + "retention.json"}
+}
+
+// retentionLeaseDir holds lease objects, under the prefix but never swept
+const retentionLeaseDir = "_leases/"
+
+func (l *resultStoreLease) read(ctx context.Context) (*leaseRecord, error) {
+    out, err := l.rs.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(l.rs.cfg.Bucket), Key: aws.String(l.key)})
+    var missing *types.NoSuchKey
+    if errors.As(err, &missing) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer out.Body.Close()
+    data, err := io.ReadAll(out.Body)
+    if err != nil {
+        return nil, err
+    }
+    var record leaseRecord
+    if err := json.Unmarshal(data, &record); err != nil {
+        return nil, fmt.Errorf("invalid lease object %s: %v", l.key, err)
+    }
+    return &record, nil
+}
+
+func (l *resultStoreLease) Acquire(ctx context.Context, holder string, ttl time.Duration, now time.Time) (bool, error) {
+    current, err := l.read(ctx)
+    if err != nil {
+        return false, err
+    }
+    if current != nil && current.Holder != holder && now.Before(current.Expires) {
+        return false, nil
+    }
+    data, _ := json.Marshal(leaseRecord{Holder: holder, Expires: now.Add(ttl)})
+    _, err = l.rs.client.PutObject(ctx, &s3.PutObjectInput{
+        Bucket:      aws.String(l.rs.cfg.Bucket),
+        Key:         aws.String(l.key),
+        Body:        bytes.NewReader(data),
+        ContentType: aws.String("application/json"),
+    })
+    if err != nil {
+        return false, err
+    }
+    current, err = l.read(ctx)
+    if err != nil {
+        return false, err
+    }
+    return current != nil && current.Holder == holder, nil
+}
+
+func (l *resultStoreLease) Release(ctx context.Context, holder string) error {
+    current, err := l.read(ctx)
+    if err != nil || current == nil || current.Holder != holder {
+        return err
+    }
+    _, err = l.rs.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(l.rs.cfg.Bucket), Key: aws.String(l.key)})
+    return err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math/rand"
+    "os"
+    "strconv"
+    "sync/atomic"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/aws/retry"
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// maxRetryBackoff caps a single wait however many retries came before it
+const maxRetryBackoff = 10 * time.Second
+
+// RetryConfig controls how the account pool retries an invocation once
+// every account has been throttled, or the model failed on its side
+type RetryConfig struct {
+    MaxRetries int           // Waits per invocation before the error is returned
+    BaseDelay  time.Duration // The first wait; each later one doubles
+}
+
+// LoadRetryConfig reads BEDROCK_MAX_RETRIES and BEDROCK_BACKOFF_BASE_MS
+func LoadRetryConfig() (RetryConfig, error) {
+    cfg := RetryConfig{MaxRetries: 2, BaseDelay: 200 * time.Millisecond}
+    if v := os.Getenv("BEDROCK_MAX_RETRIES"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            return cfg, fmt.Errorf("invalid BEDROCK_MAX_RETRIES %q", v)
+        }
+        cfg.MaxRetries = n
+    }
+    if v := os.Getenv("BEDROCK_BACKOFF_BASE_MS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return cfg, fmt.Errorf("invalid BEDROCK_BACKOFF_BASE_MS %q", v)
+        }
+        cfg.BaseDelay = time.Duration(n) * time.Millisecond
+    }
+    return cfg, nil
+}
+
+// String describes the config for the status page
+func (cfg RetryConfig) String() string {
+    return fmt.Sprintf("%d (backoff from %v)", cfg.MaxRetries, cfg.BaseDelay)
+}
+
+// backoff is the wait before retry n, counting from 0: the doubled delay
+// with its upper half jittered, so callers throttled together don't all
+// come back at the same moment
+func (cfg RetryConfig) backoff(n int) time.Duration {
+    delay := maxRetryBackoff
+    if n < 30 && cfg.BaseDelay<<n < maxRetryBackoff {
+        delay = cfg.BaseDelay << n
+    }
+    return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// wait sleeps before retry n. It returns false without waiting when ctx
+// would end first, since the retry would start with no time left.
+func (cfg RetryConfig) wait(ctx context.Context, n int) bool {
+    delay := cfg.backoff(n)
+    if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+        return false
+    }
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return true
+    case <-ctx.Done():
+        return false
+    }
+}
+
+// allows reports whether another retry may follow the given number of them
+// for origin. Probes measure whether a model answers now, so they never wait.
+func (cfg RetryConfig) allows(origin Origin, retries int) bool {
+    return origin != originProbe && retries < cfg.MaxRetries
+}
+
+// isModelFailure reports whether err is the model failing on the provider's
+// side, which a later attempt may not hit
+func isModelFailure(err error) bool {
+    var modelErr *types.ModelErrorException
+    if !errors.As(err, &modelErr) {
+        return false
+    }
+    return modelErr.OriginalStatusCode == nil || *modelErr.OriginalStatusCode >= 500
+}
+
+// sdkRetryer is the SDK's standard retryer without its throttle retries.
+// Those would keep a throttled request on the same account; the pool
+// shifts it to another one first and only then backs off.
+func sdkRetryer() aws.Retryer {
+    return retry.NewStandard(func(o *retry.StandardOptions) {
+        o.Retryables = []retry.IsErrorRetryable{
+            retry.NoRetryCanceledError{},
+            retry.RetryableError{},
+            retry.RetryableConnectionError{},
+            retry.RetryableHTTPStatusCode{Codes: retry.DefaultRetryableHTTPStatusCodes},
+            retry.RetryableErrorCode{Codes: retry.DefaultRetryableErrorCodes},
+        }
+    })
+}
+
+type retryCountKey struct{}
+
+// countRetries starts counting the pool's retries for calls made with the
+// returned context
+func countRetries(ctx context.Context) (context.Context, *atomic.Int64) {
+    count := new(atomic.Int64)
+    return context.WithValue(ctx, retryCountKey{}, count), count
+}
+
+// addRetry counts one retry against the request ctx belongs to, if it is
+// being counted
+func addRetry(ctx context.Context) {
+    if count, ok := ctx.Value(retryCountKey{}).(*atomic.Int64); ok {
+        count.Add(1)
+    }
+}
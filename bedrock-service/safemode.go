@@ -0,0 +1,328 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Safe mode settings
+const (
+    safeModeSampleInterval = 10 * time.Second
+    safeModeMaxEvents      = 100
+)
+
+// SafeModeConfig controls when the service automatically enters and leaves
+// safe mode. Exit uses a lower threshold than entry so the state doesn't flap.
+type SafeModeConfig struct {
+    Window      time.Duration // Error rate is computed over this trailing window
+    EnterRate   float64       // Enter safe mode at or above this error rate
+    ExitRate    float64       // Leave safe mode once the error rate drops below this
+    MinRequests float64       // Ignore windows with fewer requests than this
+    MinDuration time.Duration // Stay in automatic safe mode at least this long
+}
+
+// SafeModeEvent records one safe-mode transition
+type SafeModeEvent struct {
+    Time      time.Time `json:"time"`
+    Action    string    `json:"action"`  // "enter" or "exit"
+    Trigger   string    `json:"trigger"` // "auto" or "admin"
+    ErrorRate float64   `json:"error_rate"`
+    Requests  float64   `json:"requests"`
+    Reason    string    `json:"reason"`
+}
+
+// SafeModeStatus is returned by GET /admin/safe-mode
+type SafeModeStatus struct {
+    Active    bool            `json:"active"`
+    Forced    bool            `json:"forced"`
+    Since     *time.Time      `json:"since,omitempty"`
+    Reason    string          `json:"reason,omitempty"`
+    ErrorRate float64         `json:"error_rate"`
+    Requests  float64         `json:"requests"`
+    EnterRate float64         `json:"enter_rate"`
+    ExitRate  float64         `json:"exit_rate"`
+    Window    string          `json:"window"`
+    Events    []SafeModeEvent `json:"events"`
+}
+
+// budgetSample is a snapshot of the request counters at one point in time
+type budgetSample struct {
+    at     time.Time
+    total  float64
+    errors float64
+}
+
+// SafeMode tracks the error budget from the generate request counters and
+// runs the safe-mode state machine. While active, experimental features are
+// disabled and all traffic is routed to the most reliable model first.
+type SafeMode struct {
+    cfg SafeModeConfig
+    now func() time.Time // The clock for admin transitions; Observe is given its time
+
+    mu      sync.Mutex
+    samples []budgetSample
+    active  bool
+    forced  bool
+    since   time.Time
+    reason  string
+    events  []SafeModeEvent
+}
+
+// LoadSafeModeConfig reads SAFE_MODE_WINDOW_MINUTES (default 5),
+// SAFE_MODE_ERROR_THRESHOLD (default 0.5), SAFE_MODE_RECOVERY_THRESHOLD
+// (default half the error threshold) and SAFE_MODE_MIN_REQUESTS (default 20)
+func LoadSafeModeConfig() (SafeModeConfig, error) {
+    cfg := SafeModeConfig{
+        Window:      5 * time.Minute,
+        EnterRate:   0.5,
+        MinRequests: 20,
+        MinDuration: time.Minute,
+    }
+
+    if v := os.Getenv("SAFE_MODE_WINDOW_MINUTES"); v != "" {
+        minutes, err := strconv.Atoi(v)
+        if err != nil || minutes <= 0 {
+            return cfg, fmt.Errorf("invalid SAFE_MODE_WINDOW_MINUTES %q", v)
+        }
+        cfg.Window = time.Duration(minutes) * time.Minute
+    }
+    if v := os.Getenv("SAFE_MODE_ERROR_THRESHOLD"); v != "" {
+        rate, err := strconv.ParseFloat(v, 64)
+        if err != nil || rate <= 0 || rate > 1 {
+            return cfg, fmt.Errorf("invalid SAFE_MODE_ERROR_THRESHOLD %q", v)
+        }
+        cfg.EnterRate = rate
+    }
+    cfg.ExitRate = cfg.EnterRate / 2
+    if v := os.Getenv("SAFE_MODE_RECOVERY_THRESHOLD"); v != "" {
+        rate, err := strconv.ParseFloat(v, 64)
+        if err != nil || rate < 0 || rate >= cfg.EnterRate {
+            return cfg, fmt.Errorf("invalid SAFE_MODE_RECOVERY_THRESHOLD %q (must be below the error threshold)", v)
+        }
+        cfg.ExitRate = rate
+    }
+    if v := os.Getenv("SAFE_MODE_MIN_REQUESTS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return cfg, fmt.Errorf("invalid SAFE_MODE_MIN_REQUESTS %q", v)
+        }
+        cfg.MinRequests = float64(n)
+    }
+    return cfg, nil
+}
+
+// NewSafeMode creates the tracker in the normal (inactive) state
+func NewSafeMode(cfg SafeModeConfig) *SafeMode {
+    return &SafeMode{cfg: cfg, now: time.Now}
+}
+
+// Active reports whether safe mode is on. A nil tracker is never active.
+func (sm *SafeMode) Active() bool {
+    if sm == nil {
+        return false
+    }
+    sm.mu.Lock()
+    defer sm.mu.Unlock()
+    return sm.active
+}
+
+// Run samples the request counters and evaluates transitions until the process exits
+func (sm *SafeMode) Run() {
+    ticker := time.NewTicker(safeModeSampleInterval)
+    defer ticker.Stop()
+
+    sm.Observe(time.Now(), metrics.Value("generate_requests_total", "outcome", "success"),
+        metrics.Value("generate_requests_total", "outcome", "error"))
+    for now := range ticker.C {
+        sm.Observe(now, metrics.Value("generate_requests_total", "outcome", "success"),
+            metrics.Value("generate_requests_total", "outcome", "error"))
+    }
+}
+
+// Observe records a counter snapshot and applies any resulting transition
+func (sm *SafeMode) Observe(now time.Time, successes, errors float64) {
+    sm.mu.Lock()
+    defer sm.mu.Unlock()
+
+    sm.samples = append(sm.samples, budgetSample{at: now, total: successes + errors, errors: errors})
+
+    // Keep one sample at or before the window start as the baseline
+    cutoff := now.Add(-sm.cfg.Window)
+    for len(sm.samples) > 2 && !sm.samples[1].at.After(cutoff) {
+        sm.samples = sm.samples[1:]
+    }
+
+    rate, requests := sm.errorRateLocked()
+    if sm.forced {
+        return
+    }
+
+    switch {
+    case !sm.active && requests >= sm.cfg.MinRequests && rate >= sm.cfg.EnterRate:
+        sm.transitionLocked(now, true, "auto", rate, requests,
+            fmt.Sprintf("error rate %.1f%% over %s exceeded %.1f%%", rate*100, sm.cfg.Window, sm.cfg.EnterRate*100))
+    case sm.active && now.Sub(sm.since) >= sm.cfg.MinDuration && rate < sm.cfg.ExitRate:
+        sm.transitionLocked(now, false, "auto", rate, requests,
+            fmt.Sprintf("error rate recovered to %.1f%% (below %.1f%%)", rate*100, sm.cfg.ExitRate*100))
+    }
+}
+
+// errorRateLocked computes the error rate between the oldest and newest samples
+func (sm *SafeMode) errorRateLocked() (float64, float64) {
+    if len(sm.samples) < 2 {
+        return 0, 0
+    }
+    first, last := sm.samples[0], sm.samples[len(sm.samples)-1]
+    requests := last.total - first.total
+    if requests <= 0 {
+        return 0, 0
+    }
+    return (last.errors - first.errors) / requests, requests
+}
+
+func (sm *SafeMode) transitionLocked(now time.Time, active bool, trigger string, rate, requests float64, reason string) {
+    sm.active = active
+    sm.since = now
+    sm.reason = reason
+
+    action := "exit"
+    if active {
+        action = "enter"
+    }
+
+    sm.events = append(sm.events, SafeModeEvent{
+        Time:      now,
+        Action:    action,
+        Trigger:   trigger,
+        ErrorRate: rate,
+        Requests:  requests,
+        Reason:    reason,
+    })
+    if len(sm.events) > safeModeMaxEvents {
+        sm.events = sm.events[len(sm.events)-safeModeMaxEvents:]
+    }
+
+    metrics.Inc("safe_mode_transitions_total", "action", action, "trigger", trigger)
+    if active {
+        log.Printf("⚠ SAFE MODE ENTERED (%s): %s", trigger, reason)
+    } else {
+        log.Printf("Safe mode exited (%s): %s", trigger, reason)
+    }
+}
+
+// Force enters or exits safe mode by admin request. A forced entry holds
+// until an explicit exit; exiting returns to automatic evaluation with a
+// fresh window so the old error burst doesn't immediately re-trigger it.
+func (sm *SafeMode) Force(active bool, reason string) {
+    sm.mu.Lock()
+    defer sm.mu.Unlock()
+
+    now := sm.now()
+    rate, requests := sm.errorRateLocked()
+    if reason == "" {
+        reason = "admin request"
+    }
+
+    sm.forced = active
+    if !active && len(sm.samples) > 0 {
+        sm.samples = sm.samples[len(sm.samples)-1:]
+    }
+    if sm.active != active {
+        sm.transitionLocked(now, active, "admin", rate, requests, reason)
+    }
+}
+
+// Status returns a snapshot of the tracker
+func (sm *SafeMode) Status() SafeModeStatus {
+    sm.mu.Lock()
+    defer sm.mu.Unlock()
+
+    rate, requests := sm.errorRateLocked()
+    status := SafeModeStatus{
+        Active:    sm.active,
+        Forced:    sm.forced,
+        ErrorRate: rate,
+        Requests:  requests,
+        EnterRate: sm.cfg.EnterRate,
+        ExitRate:  sm.cfg.ExitRate,
+        Window:    sm.cfg.Window.String(),
+        Events:    append([]SafeModeEvent{}, sm.events...),
+    }
+    if sm.active {
+        since := sm.since
+        status.Since = &since
+        status.Reason = sm.reason
+    }
+    return status
+}
+
+// mostReliableModel picks the available model with the best recent success
+// rate, preferring catalog order on ties and for models without traffic yet
+func (bc *BedrockClient) mostReliableModel() string {
+    best := ""
+    bestRate := -1.0
+    for _, model := range bc.textModels() {
+        if !model.selectable() {
+            continue
+        }
+        // Every origin's invocations say something about the model
+        var successes, failures float64
+        for origin := range knownOrigins {
+            successes += metrics.Value("bedrock_model_invocations_total", "model", model.ID, "origin", string(origin), "outcome", "success")
+            failures += metrics.Value("bedrock_model_invocations_total", "model", model.ID, "origin", string(origin), "outcome", "error")
+        }
+
+        rate := 0.5 // Unknown reliability ranks below proven models but above failing ones
+        if successes+failures > 0 {
+            rate = successes / (successes + failures)
+        }
+        if rate > bestRate {
+            best, bestRate = model.ID, rate
+        }
+    }
+    return best
+}
+
+func safeModeStatusHandler(sm *SafeMode) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(sm.Status())
+    }
+}
+
+// safeModeForceHandler handles POST /admin/safe-mode with {"action": "enter"|"exit", "reason": "..."}
+func safeModeForceHandler(sm *SafeMode) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req struct {
+            Action string `json:"action"`
+            Reason string `json:"reason"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+
+        switch req.Action {
+        case "enter":
+            sm.Force(true, req.Reason)
+        case "exit":
+            sm.Force(false, req.Reason)
+        default:
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: "action must be \"enter\" or \"exit\"",
+                Fields:  []FieldError{{Field: "action", Message: "must be \"enter\" or \"exit\""}},
+            })
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(sm.Status())
+    }
+}
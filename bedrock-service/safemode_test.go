@@ -0,0 +1,169 @@
+package main
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+// fakeClock is a time that tests move forward by hand
+type fakeClock struct {
+    now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) time.Time {
+    c.now = c.now.Add(d)
+    return c.now
+}
+
+// safeModeTest is a tracker on a fake clock, fed cumulative counters the
+// way Run samples them
+type safeModeTest struct {
+    *SafeMode
+    clock             *fakeClock
+    successes, errors float64
+}
+
+func newSafeModeTest() *safeModeTest {
+    clock := &fakeClock{now: time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)}
+    sm := NewSafeMode(SafeModeConfig{
+        Window:      time.Minute,
+        EnterRate:   0.5,
+        ExitRate:    0.2,
+        MinRequests: 20,
+        MinDuration: 2 * time.Minute,
+    })
+    sm.now = clock.Now
+    st := &safeModeTest{SafeMode: sm, clock: clock}
+    sm.Observe(clock.now, 0, 0)
+    return st
+}
+
+// tick advances one sample interval during which the service served
+// successes and errors more requests
+func (st *safeModeTest) tick(successes, errors float64) {
+    st.successes += successes
+    st.errors += errors
+    st.Observe(st.clock.Advance(safeModeSampleInterval), st.successes, st.errors)
+}
+
+func TestSafeModeEnterAndRecover(t *testing.T) {
+    st := newSafeModeTest()
+
+    // Healthy traffic
+    for i := 0; i < 6; i++ {
+        st.tick(10, 1)
+    }
+    if st.Active() {
+        t.Fatalf("active at a %.0f%% error rate", st.Status().ErrorRate*100)
+    }
+
+    // An error burst over the window trips it
+    for i := 0; i < 6 && !st.Active(); i++ {
+        st.tick(2, 8)
+    }
+    status := st.Status()
+    if !status.Active || status.Forced || status.Since == nil || !strings.Contains(status.Reason, "exceeded 50.0%") {
+        t.Fatalf("after the burst: %+v", status)
+    }
+    entered := *status.Since
+
+    // Errors stop at once, but it holds for MinDuration
+    for st.clock.now.Sub(entered) < 2*time.Minute-safeModeSampleInterval {
+        st.tick(10, 0)
+        if !st.Active() {
+            t.Fatalf("exited %s after entering, before the minimum duration", st.clock.now.Sub(entered))
+        }
+    }
+    st.tick(10, 0)
+    status = st.Status()
+    if status.Active || status.ErrorRate >= 0.2 {
+        t.Fatalf("after recovery: %+v", status)
+    }
+
+    events := status.Events
+    if len(events) != 2 || events[0].Action != "enter" || events[1].Action != "exit" || events[0].Trigger != "auto" || events[1].Trigger != "auto" {
+        t.Fatalf("events %+v, want an automatic enter and exit", events)
+    }
+    if !events[0].Time.Equal(entered) || events[1].Time.Sub(entered) != 2*time.Minute {
+        t.Errorf("entered at %s and exited at %s, want two minutes apart from %s", events[0].Time, events[1].Time, entered)
+    }
+}
+
+// Between the exit and the entry rate it stays in whichever state it's in
+func TestSafeModeHysteresis(t *testing.T) {
+    st := newSafeModeTest()
+    for i := 0; i < 6; i++ {
+        st.tick(7, 3) // 30%
+    }
+    if st.Active() {
+        t.Fatal("entered below the entry rate")
+    }
+    for i := 0; i < 6; i++ {
+        st.tick(0, 10)
+    }
+    if !st.Active() {
+        t.Fatal("didn't enter on errors only")
+    }
+    for i := 0; i < 30; i++ {
+        st.tick(7, 3)
+    }
+    if !st.Active() {
+        t.Errorf("exited at a %.0f%% error rate, above the exit rate", st.Status().ErrorRate*100)
+    }
+}
+
+func TestSafeModeMinRequests(t *testing.T) {
+    st := newSafeModeTest()
+    for i := 0; i < 12; i++ {
+        st.tick(0, 1) // Six a window, all failing
+    }
+    if status := st.Status(); status.Active || status.Requests >= 20 {
+        t.Errorf("%+v, want inactive on a thin window", status)
+    }
+}
+
+func TestSafeModeForce(t *testing.T) {
+    st := newSafeModeTest()
+    st.tick(10, 0)
+
+    st.Force(true, "")
+    status := st.Status()
+    if !status.Active || !status.Forced || status.Reason != "admin request" || !status.Since.Equal(st.clock.now) {
+        t.Fatalf("after a forced entry: %+v", status)
+    }
+    // Healthy traffic doesn't lift a forced entry, however long
+    for i := 0; i < 30; i++ {
+        st.tick(10, 0)
+    }
+    if !st.Active() {
+        t.Fatal("a forced entry lifted itself")
+    }
+
+    for i := 0; i < 6; i++ {
+        st.tick(0, 10)
+    }
+    st.Force(false, "incident over")
+    if st.Active() {
+        t.Fatal("still active after a forced exit")
+    }
+    // The burst it saw while forced doesn't re-trigger it on the next sample
+    st.tick(10, 0)
+    if status := st.Status(); status.Active || status.ErrorRate != 0 {
+        t.Errorf("after a forced exit: %+v", status)
+    }
+
+    events := st.Status().Events
+    if len(events) != 2 || events[0].Trigger != "admin" || events[1].Trigger != "admin" || events[1].Reason != "incident over" {
+        t.Errorf("events %+v, want an admin enter and exit", events)
+    }
+}
+
+func TestSafeModeNilIsInactive(t *testing.T) {
+    var sm *SafeMode
+    if sm.Active() {
+        t.Error("a nil tracker is active")
+    }
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "net/http"
+    "os"
+    "sort"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// scalingWindow is how far back queue waits and shed decisions are considered
+const scalingWindow = time.Minute
+
+// maxWaitSamples bounds the queue wait samples kept for the p95
+const maxWaitSamples = 1024
+
+// LoadTracker follows Bedrock-bound load: invocations in flight, requests
+// waiting for an invocation slot, how long they waited and how many were shed
+type LoadTracker struct {
+    depth atomic.Int64 // Mirrors queued for lock-free readers
+
+    mu       sync.Mutex
+    inFlight int
+    queued   int
+    waits    []waitSample
+    admitted []time.Time // Admission times within the window
+    shed     []time.Time // Shed times within the window
+}
+
+type waitSample struct {
+    at   time.Time
+    wait time.Duration
+}
+
+// load is the process-wide tracker used by the invocation paths
+var load = &LoadTracker{}
+
+// Begin marks an invocation as in flight; call the returned func when it ends
+func (lt *LoadTracker) Begin() func() {
+    lt.mu.Lock()
+    lt.inFlight++
+    inFlight := lt.inFlight
+    lt.mu.Unlock()
+    metrics.Set("bedrock_invocations_in_flight", float64(inFlight))
+
+    var once sync.Once
+    return func() {
+        once.Do(func() {
+            lt.mu.Lock()
+            lt.inFlight--
+            inFlight := lt.inFlight
+            lt.mu.Unlock()
+            metrics.Set("bedrock_invocations_in_flight", float64(inFlight))
+        })
+    }
+}
+
+// InFlight returns the number of invocations currently running
+func (lt *LoadTracker) InFlight() int {
+    lt.mu.Lock()
+    defer lt.mu.Unlock()
+    return lt.inFlight
+}
+
+// Enqueue marks a request as waiting for an invocation slot
+func (lt *LoadTracker) Enqueue() {
+    lt.mu.Lock()
+    lt.queued++
+    depth := lt.queued
+    lt.depth.Store(int64(depth))
+    lt.mu.Unlock()
+    metrics.Set("bedrock_queue_depth", float64(depth))
+}
+
+// Dequeue records the end of a wait: admitted, or shed when it gave up
+func (lt *LoadTracker) Dequeue(wait time.Duration, admitted bool) {
+    now := time.Now()
+
+    lt.mu.Lock()
+    lt.queued--
+    depth := lt.queued
+    lt.depth.Store(int64(depth))
+    lt.waits = append(lt.waits, waitSample{at: now, wait: wait})
+    if len(lt.waits) > maxWaitSamples {
+        lt.waits = lt.waits[len(lt.waits)-maxWaitSamples:]
+    }
+    if admitted {
+        lt.admitted = append(lt.admitted, now)
+    } else {
+        lt.shed = append(lt.shed, now)
+    }
+    lt.mu.Unlock()
+
+    metrics.Set("bedrock_queue_depth", float64(depth))
+    if !admitted {
+        metrics.Inc("bedrock_requests_shed_total")
+    }
+}
+
+// QueueDepth returns the number of waiting requests without taking the lock
+func (lt *LoadTracker) QueueDepth() int {
+    return int(lt.depth.Load())
+}
+
+// Admit records a request that got a slot without waiting
+func (lt *LoadTracker) Admit() {
+    lt.mu.Lock()
+    defer lt.mu.Unlock()
+    lt.admitted = append(lt.admitted, time.Now())
+}
+
+// Shed records a request rejected immediately for lack of capacity
+func (lt *LoadTracker) Shed() {
+    lt.mu.Lock()
+    lt.shed = append(lt.shed, time.Now())
+    lt.mu.Unlock()
+    metrics.Inc("bedrock_requests_shed_total")
+}
+
+// LoadSnapshot is the tracker's view of the last scalingWindow
+type LoadSnapshot struct {
+    InFlight     int
+    QueueDepth   int
+    QueueWaitP95 time.Duration
+    ShedRate     float64 // Fraction of requests shed
+}
+
+// trimTimes drops entries older than cutoff from a time-ordered slice
+func trimTimes(times []time.Time, cutoff time.Time) []time.Time {
+    i := sort.Search(len(times), func(i int) bool { return !times[i].Before(cutoff) })
+    return times[i:]
+}
+
+// Snapshot summarizes current load
+func (lt *LoadTracker) Snapshot(now time.Time) LoadSnapshot {
+    lt.mu.Lock()
+    defer lt.mu.Unlock()
+
+    cutoff := now.Add(-scalingWindow)
+    lt.admitted = trimTimes(lt.admitted, cutoff)
+    lt.shed = trimTimes(lt.shed, cutoff)
+    i := sort.Search(len(lt.waits), func(i int) bool { return !lt.waits[i].at.Before(cutoff) })
+    lt.waits = lt.waits[i:]
+
+    snap := LoadSnapshot{InFlight: lt.inFlight, QueueDepth: lt.queued}
+    if total := len(lt.admitted) + len(lt.shed); total > 0 {
+        snap.ShedRate = float64(len(lt.shed)) / float64(total)
+    }
+    if len(lt.waits) > 0 {
+        waits := make([]time.Duration, len(lt.waits))
+        for i, s := range lt.waits {
+            waits[i] = s.wait
+        }
+        sort.Slice(waits, func(a, b int) bool { return waits[a] < waits[b] })
+        snap.QueueWaitP95 = waits[int(math.Ceil(0.95*float64(len(waits))))-1]
+    }
+    return snap
+}
+
+// ScalingTargets are the per-replica levels the autoscaler should hold
+type ScalingTargets struct {
+    InFlight      float64       // Invocations in flight per replica
+    QueueDepth    float64       // Requests waiting per replica
+    QueueWait     time.Duration // p95 queue wait
+    MaxShedRate   float64       // Shed fraction tolerated before scaling out
+    MinMultiplier float64       // Never suggest shrinking faster than this
+    MaxMultiplier float64       // Never suggest growing faster than this
+}
+
+// LoadScalingTargets reads SCALING_TARGET_IN_FLIGHT, SCALING_TARGET_QUEUE_DEPTH,
+// SCALING_TARGET_QUEUE_WAIT_MS, SCALING_MAX_SHED_RATE, SCALING_MIN_MULTIPLIER
+// and SCALING_MAX_MULTIPLIER
+func LoadScalingTargets() (ScalingTargets, error) {
+    targets := ScalingTargets{
+        InFlight:      16,
+        QueueDepth:    8,
+        QueueWait:     500 * time.Millisecond,
+        MaxShedRate:   0.01,
+        MinMultiplier: 0.5,
+        MaxMultiplier: 4,
+    }
+
+    floats := []struct {
+        env    string
+        target *float64
+    }{
+        {"SCALING_TARGET_IN_FLIGHT", &targets.InFlight},
+        {"SCALING_TARGET_QUEUE_DEPTH", &targets.QueueDepth},
+        {"SCALING_MAX_SHED_RATE", &targets.MaxShedRate},
+        {"SCALING_MIN_MULTIPLIER", &targets.MinMultiplier},
+        {"SCALING_MAX_MULTIPLIER", &targets.MaxMultiplier},
+    }
+    for _, setting := range floats {
+        if v := os.Getenv(setting.env); v != "" {
+            f, err := strconv.ParseFloat(v, 64)
+            if err != nil || f <= 0 {
+                return targets, fmt.Errorf("invalid %s %q", setting.env, v)
+            }
+            *setting.target = f
+        }
+    }
+    if v := os.Getenv("SCALING_TARGET_QUEUE_WAIT_MS"); v != "" {
+        ms, err := strconv.Atoi(v)
+        if err != nil || ms <= 0 {
+            return targets, fmt.Errorf("invalid SCALING_TARGET_QUEUE_WAIT_MS %q", v)
+        }
+        targets.QueueWait = time.Duration(ms) * time.Millisecond
+    }
+    if targets.MinMultiplier > 1 || targets.MaxMultiplier < 1 {
+        return targets, fmt.Errorf("SCALING_MIN_MULTIPLIER must be <= 1 and SCALING_MAX_MULTIPLIER >= 1")
+    }
+    return targets, nil
+}
+
+// desiredMultiplier turns load into the factor the replica count should be
+// multiplied by. Each signal is compared to its target and the most
+// saturated one wins, since any of them alone means callers are waiting.
+// Shedding always asks for growth because it means requests are failing.
+func desiredMultiplier(snap LoadSnapshot, targets ScalingTargets) float64 {
+    ratio := float64(snap.InFlight) / targets.InFlight
+    ratio = math.Max(ratio, float64(snap.QueueDepth)/targets.QueueDepth)
+    ratio = math.Max(ratio, float64(snap.QueueWaitP95)/float64(targets.QueueWait))
+    if snap.ShedRate > targets.MaxShedRate {
+        ratio = math.Max(ratio, 1+snap.ShedRate/targets.MaxShedRate*0.1)
+    }
+    return math.Round(math.Min(math.Max(ratio, targets.MinMultiplier), targets.MaxMultiplier)*100) / 100
+}
+
+// ScalingResponse is returned by GET /scaling
+type ScalingResponse struct {
+    InFlight          int     `json:"in_flight"`
+    QueueDepth        int     `json:"queue_depth"`
+    QueueWaitP95Ms    int64   `json:"queue_wait_p95_ms"`
+    ShedRate          float64 `json:"shed_rate"`
+    DesiredMultiplier float64 `json:"desired_replicas_multiplier"`
+}
+
+// scalingHandler reports the autoscaling signal; it only reads in-memory
+// counters so it is cheap to poll every few seconds
+func scalingHandler(targets ScalingTargets) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        snap := load.Snapshot(time.Now())
+        multiplier := desiredMultiplier(snap, targets)
+
+        metrics.Set("bedrock_queue_wait_p95_seconds", snap.QueueWaitP95.Seconds())
+        metrics.Set("bedrock_shed_rate", snap.ShedRate)
+        metrics.Set("scaling_desired_replicas_multiplier", multiplier)
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(ScalingResponse{
+            InFlight:          snap.InFlight,
+            QueueDepth:        snap.QueueDepth,
+            QueueWaitP95Ms:    snap.QueueWaitP95.Milliseconds(),
+            ShedRate:          math.Round(snap.ShedRate*10000) / 10000,
+            DesiredMultiplier: multiplier,
+        })
+    }
+}
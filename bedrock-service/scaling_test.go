@@ -0,0 +1,142 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func TestDesiredMultiplier(t *testing.T) {
+    targets := ScalingTargets{InFlight: 16, QueueDepth: 8, QueueWait: 500 * time.Millisecond, MaxShedRate: 0.01, MinMultiplier: 0.5, MaxMultiplier: 4}
+    for _, c := range []struct {
+        name string
+        snap LoadSnapshot
+        want float64
+    }{
+        {"idle", LoadSnapshot{}, 0.5},
+        {"under target", LoadSnapshot{InFlight: 12}, 0.75},
+        {"at target", LoadSnapshot{InFlight: 16}, 1},
+        {"in flight", LoadSnapshot{InFlight: 24}, 1.5},
+        {"queue depth", LoadSnapshot{InFlight: 16, QueueDepth: 16}, 2},
+        {"queue wait", LoadSnapshot{InFlight: 8, QueueWaitP95: 1250 * time.Millisecond}, 2.5},
+        {"shedding", LoadSnapshot{InFlight: 4, ShedRate: 0.05}, 1.5},
+        {"shedding within tolerance", LoadSnapshot{InFlight: 4, ShedRate: 0.01}, 0.5},
+        {"shedding outweighed", LoadSnapshot{InFlight: 48, ShedRate: 0.05}, 3},
+        {"capped", LoadSnapshot{InFlight: 160, ShedRate: 1}, 4},
+    } {
+        if got := desiredMultiplier(c.snap, targets); got != c.want {
+            t.Errorf("%s: %+v wants %v replicas, want %v", c.name, c.snap, got, c.want)
+        }
+    }
+}
+
+// withLoad swaps in a fresh load tracker for the length of a test
+func withLoad(t *testing.T) *LoadTracker {
+    previous := load
+    load = &LoadTracker{}
+    t.Cleanup(func() { load = previous })
+    return load
+}
+
+// scaling calls the handler and decodes its response
+func scaling(t *testing.T, targets ScalingTargets) ScalingResponse {
+    t.Helper()
+    rec := httptest.NewRecorder()
+    scalingHandler(targets)(rec, httptest.NewRequest(http.MethodGet, "/scaling", nil))
+    var response ScalingResponse
+    if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+        t.Fatal(err)
+    }
+    return response
+}
+
+// The gate's admissions, waits and rejections reach /scaling through the
+// load tracker, with invocations in flight counted separately
+func TestScalingHandler(t *testing.T) {
+    const wait = 30 * time.Millisecond
+    tracker := withLoad(t)
+    targets := ScalingTargets{InFlight: 1, QueueDepth: 8, QueueWait: time.Hour, MaxShedRate: 0.5, MinMultiplier: 0.5, MaxMultiplier: 4}
+    gate := NewGenerationGate(ConcurrencyConfig{MaxInFlight: 1, QueueWait: wait})
+    ctx := context.Background()
+
+    _, release, err := gate.Enter(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // The slot is taken, so the next request waits out the queue and is shed
+    if _, _, err := gate.Enter(ctx); err != errSaturated {
+        t.Fatalf("second request: %v, want %v", err, errSaturated)
+    }
+
+    // A request waiting while the slot is held shows as queued
+    admitted := make(chan error)
+    go func() {
+        _, done, err := gate.Enter(ctx)
+        if err == nil {
+            done()
+        }
+        admitted <- err
+    }()
+    for tracker.QueueDepth() == 0 {
+        time.Sleep(time.Millisecond)
+    }
+    if got := scaling(t, targets); got.QueueDepth != 1 {
+        t.Errorf("queue depth %d while a request waits, want 1", got.QueueDepth)
+    }
+    release()
+    if err := <-admitted; err != nil {
+        t.Fatalf("waiting request: %v", err)
+    }
+
+    end1, end2 := tracker.Begin(), tracker.Begin()
+    got := scaling(t, targets)
+    if got.InFlight != 2 || got.QueueDepth != 0 || got.ShedRate != 0.3333 || got.QueueWaitP95Ms < wait.Milliseconds() {
+        t.Errorf("%+v, want 2 in flight, none queued, a third shed and the timed-out wait as p95", got)
+    }
+    if got.DesiredMultiplier != 2 {
+        t.Errorf("multiplier %v for twice the in-flight target, want 2", got.DesiredMultiplier)
+    }
+    end1()
+    end1() // Ending twice counts once
+    end2()
+
+    // Past the shed tolerance, shedding drives the answer, up to the cap
+    targets.MaxShedRate = 0.01
+    if got := scaling(t, targets); got.InFlight != 0 || got.DesiredMultiplier != 4 {
+        t.Errorf("%+v, want none in flight and the maximum multiplier", got)
+    }
+    if v := metrics.Value("scaling_desired_replicas_multiplier"); v != 4 {
+        t.Errorf("multiplier gauge %v, want 4", v)
+    }
+
+    // Outside the window only the current state is left
+    if snap := tracker.Snapshot(time.Now().Add(scalingWindow + time.Second)); snap != (LoadSnapshot{}) {
+        t.Errorf("snapshot after the window %+v, want it empty", snap)
+    }
+}
+
+func TestLoadScalingTargets(t *testing.T) {
+    t.Setenv("SCALING_TARGET_IN_FLIGHT", "4")
+    t.Setenv("SCALING_TARGET_QUEUE_WAIT_MS", "250")
+    targets, err := LoadScalingTargets()
+    if err != nil || targets.InFlight != 4 || targets.QueueWait != 250*time.Millisecond || targets.QueueDepth != 8 {
+        t.Errorf("%+v, %v", targets, err)
+    }
+    for env, v := range map[string]string{
+        "SCALING_TARGET_QUEUE_DEPTH":   "0",
+        "SCALING_MAX_SHED_RATE":        "often",
+        "SCALING_TARGET_QUEUE_WAIT_MS": "-5",
+        "SCALING_MIN_MULTIPLIER":       "1.5",
+        "SCALING_MAX_MULTIPLIER":       "0.9",
+    } {
+        t.Run(env, func(t *testing.T) {
+            t.Setenv(env, v)
+            if _, err := LoadScalingTargets(); err == nil {
+                t.Errorf("%s=%s accepted", env, v)
+            }
+        })
+    }
+}
@@ -0,0 +1,758 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Misfire policies: what happens to a run that can't start on time because
+// the previous run is still going or the scheduler fell behind
+const (
+    misfireSkip    = "skip"     // Record the run as skipped
+    misfireRunOnce = "run_once" // Run once, late, however many fires were missed
+)
+
+// Schedule run statuses
+const (
+    runRunning   = "running"
+    runSucceeded = "succeeded"
+    runFailed    = "failed"
+    runSkipped   = "skipped"
+)
+
+// ScheduleConfig bounds scheduled generation jobs
+type ScheduleConfig struct {
+    MaxPerTenant int           // Schedules one tenant may define
+    RunHistory   int           // Runs kept per schedule
+    MisfireGrace time.Duration // How late a run may start and still count as on time
+}
+
+// LoadScheduleConfig reads SCHEDULES_MAX_PER_TENANT, SCHEDULE_RUN_HISTORY
+// and SCHEDULE_MISFIRE_GRACE_SECONDS
+func LoadScheduleConfig() (ScheduleConfig, error) {
+    cfg := ScheduleConfig{MaxPerTenant: 20, RunHistory: 50, MisfireGrace: time.Minute}
+
+    if v := os.Getenv("SCHEDULES_MAX_PER_TENANT"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return cfg, fmt.Errorf("invalid SCHEDULES_MAX_PER_TENANT %q", v)
+        }
+        cfg.MaxPerTenant = n
+    }
+    if v := os.Getenv("SCHEDULE_RUN_HISTORY"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return cfg, fmt.Errorf("invalid SCHEDULE_RUN_HISTORY %q", v)
+        }
+        cfg.RunHistory = n
+    }
+    if v := os.Getenv("SCHEDULE_MISFIRE_GRACE_SECONDS"); v != "" {
+        seconds, err := strconv.Atoi(v)
+        if err != nil || seconds < 1 {
+            return cfg, fmt.Errorf("invalid SCHEDULE_MISFIRE_GRACE_SECONDS %q", v)
+        }
+        cfg.MisfireGrace = time.Duration(seconds) * time.Second
+    }
+    return cfg, nil
+}
+
+// ScheduleTarget is where each run's result goes; exactly one field is set
+type ScheduleTarget struct {
+    WebhookURL string `json:"webhook_url,omitempty"`
+    S3Key      string `json:"s3_key,omitempty"` // Pattern with {schedule_id} and optionally {run_id}, {date}, {time}
+}
+
+// CreateScheduleRequest is the body of POST /schedules
+type CreateScheduleRequest struct {
+    Cron    string          `json:"cron"` // Five fields or a macro, optionally prefixed with CRON_TZ=<zone>
+    Request GenerateRequest `json:"request"`
+    Deliver ScheduleTarget  `json:"deliver"`
+    Misfire string          `json:"misfire,omitempty"` // skip (default) or run_once
+}
+
+// ScheduleRun is one entry in a schedule's run history
+type ScheduleRun struct {
+    ID           string     `json:"id"`
+    ScheduledFor time.Time  `json:"scheduled_for"`
+    StartedAt    *time.Time `json:"started_at,omitempty"`
+    FinishedAt   *time.Time `json:"finished_at,omitempty"`
+    Status       string     `json:"status"`
+    Late         bool       `json:"late,omitempty"`   // Started after the misfire grace period
+    Reason       string     `json:"reason,omitempty"` // Why the run was skipped or failed
+    ModelUsed    string     `json:"model_used,omitempty"`
+    DeliveredTo  string     `json:"delivered_to,omitempty"` // Webhook host or S3 key
+}
+
+// Schedule is a recurring generation owned by one tenant
+type Schedule struct {
+    ID        string
+    Owner     string
+    Cron      string
+    Request   GenerateRequest
+    Target    ScheduleTarget
+    Misfire   string
+    CreatedAt time.Time
+
+    spec   *cronSpec
+    policy KeyPolicy // Of the key that created it, for the attribution footer
+
+    // Guarded by ScheduleStore.mu
+    paused  bool
+    nextRun time.Time
+    running bool
+    owed    *time.Time // run_once: the fire that arrived mid-run, started when it finishes
+    runs    []*ScheduleRun
+}
+
+// ScheduleInfo is the JSON view of a schedule
+type ScheduleInfo struct {
+    ID        string          `json:"id"`
+    Cron      string          `json:"cron"`
+    Timezone  string          `json:"timezone"`
+    Request   GenerateRequest `json:"request"`
+    Deliver   ScheduleTarget  `json:"deliver"`
+    Misfire   string          `json:"misfire"`
+    Paused    bool            `json:"paused"`
+    Running   bool            `json:"running"`
+    NextRun   *time.Time      `json:"next_run,omitempty"`
+    LastRun   *ScheduleRun    `json:"last_run,omitempty"`
+    CreatedAt time.Time       `json:"created_at"`
+}
+
+// ScheduledResult is the payload delivered for each successful run
+type ScheduledResult struct {
+    ScheduleID   string           `json:"schedule_id"`
+    RunID        string           `json:"run_id"`
+    ScheduledFor time.Time        `json:"scheduled_for"`
+    Result       GenerateResponse `json:"result"`
+}
+
+// ScheduleStore holds schedules in memory and fires them from Run
+type ScheduleStore struct {
+    cfg ScheduleConfig
+
+    mu        sync.Mutex
+    schedules map[string]*Schedule
+}
+
+func NewScheduleStore(cfg ScheduleConfig) *ScheduleStore {
+    return &ScheduleStore{cfg: cfg, schedules: make(map[string]*Schedule)}
+}
+
+// Create validates the tenant's quota, assigns an ID and arms the schedule
+func (ss *ScheduleStore) Create(s *Schedule, now time.Time) error {
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+
+    count := 0
+    for _, existing := range ss.schedules {
+        if existing.Owner == s.Owner {
+            count++
+        }
+    }
+    if count >= ss.cfg.MaxPerTenant {
+        return fmt.Errorf("schedule limit of %d reached", ss.cfg.MaxPerTenant)
+    }
+    s.ID = "sched_" + newRequestID()
+    s.CreatedAt = now
+    s.nextRun = s.spec.Next(now)
+    ss.schedules[s.ID] = s
+    log.Printf("Schedule %s created for %s: %q, next run %v", s.ID, s.Owner, s.Cron, s.nextRun)
+    return nil
+}
+
+// Get returns a schedule if it exists and belongs to owner
+func (ss *ScheduleStore) Get(owner, id string) (*Schedule, bool) {
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+    s, ok := ss.schedules[id]
+    if !ok || s.Owner != owner {
+        return nil, false
+    }
+    return s, true
+}
+
+// List returns the owner's schedules, oldest first
+func (ss *ScheduleStore) List(owner string) []ScheduleInfo {
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+    infos := make([]ScheduleInfo, 0)
+    for _, s := range ss.schedules {
+        if s.Owner == owner {
+            infos = append(infos, s.infoLocked())
+        }
+    }
+    sort.Slice(infos, func(i, j int) bool { return infos[i].CreatedAt.Before(infos[j].CreatedAt) })
+    return infos
+}
+
+// Delete removes a schedule; a run in progress finishes but isn't followed by another
+func (ss *ScheduleStore) Delete(s *Schedule) {
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+    delete(ss.schedules, s.ID)
+    log.Printf("Schedule %s deleted", s.ID)
+}
+
+// SetPaused pauses or resumes a schedule. Resuming doesn't replay the fires
+// missed while paused; the next run is the next match from now.
+func (ss *ScheduleStore) SetPaused(s *Schedule, paused bool, now time.Time) {
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+    if s.paused == paused {
+        return
+    }
+    s.paused = paused
+    s.owed = nil
+    if !paused {
+        s.nextRun = s.spec.Next(now)
+    }
+    log.Printf("Schedule %s paused=%v", s.ID, paused)
+}
+
+// Info returns the JSON view of a schedule
+func (ss *ScheduleStore) Info(s *Schedule) ScheduleInfo {
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+    return s.infoLocked()
+}
+
+// Runs returns a schedule's history, most recent first
+func (ss *ScheduleStore) Runs(s *Schedule) []ScheduleRun {
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+    runs := make([]ScheduleRun, 0, len(s.runs))
+    for i := len(s.runs) - 1; i >= 0; i-- {
+        runs = append(runs, *s.runs[i])
+    }
+    return runs
+}
+
+func (s *Schedule) infoLocked() ScheduleInfo {
+    info := ScheduleInfo{
+        ID:        s.ID,
+        Cron:      s.Cron,
+        Timezone:  s.spec.loc.String(),
+        Request:   s.Request,
+        Deliver:   s.Target,
+        Misfire:   s.Misfire,
+        Paused:    s.paused,
+        Running:   s.running,
+        CreatedAt: s.CreatedAt,
+    }
+    if !s.paused && !s.nextRun.IsZero() {
+        next := s.nextRun
+        info.NextRun = &next
+    }
+    if len(s.runs) > 0 {
+        last := *s.runs[len(s.runs)-1]
+        info.LastRun = &last
+    }
+    return info
+}
+
+// recordRunLocked appends to the run history, dropping the oldest runs
+func (ss *ScheduleStore) recordRunLocked(s *Schedule, run *ScheduleRun) {
+    s.runs = append(s.runs, run)
+    if len(s.runs) > ss.cfg.RunHistory {
+        s.runs = s.runs[len(s.runs)-ss.cfg.RunHistory:]
+    }
+    if run.Status != runRunning {
+        metrics.Inc("schedule_runs_total", "status", run.Status)
+    }
+}
+
+// startRunLocked marks the schedule running and records the new run
+func (ss *ScheduleStore) startRunLocked(s *Schedule, scheduledFor, now time.Time) *ScheduleRun {
+    started := now
+    run := &ScheduleRun{
+        ID:           "run_" + newRequestID(),
+        ScheduledFor: scheduledFor,
+        StartedAt:    &started,
+        Status:       runRunning,
+        Late:         now.Sub(scheduledFor) > ss.cfg.MisfireGrace,
+    }
+    s.running = true
+    ss.recordRunLocked(s, run)
+    return run
+}
+
+// scheduledRun is a run the scheduler decided to start
+type scheduledRun struct {
+    schedule *Schedule
+    run      *ScheduleRun
+}
+
+// due advances every schedule whose next run has arrived and returns the
+// runs to start. Several fires missed in a row collapse into one.
+func (ss *ScheduleStore) due(now time.Time) []scheduledRun {
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+
+    var start []scheduledRun
+    for _, s := range ss.schedules {
+        if s.paused || s.nextRun.IsZero() || now.Before(s.nextRun) {
+            continue
+        }
+        scheduledFor := s.nextRun
+        s.nextRun = s.spec.Next(now)
+        late := now.Sub(scheduledFor) > ss.cfg.MisfireGrace
+
+        switch {
+        case s.running && s.Misfire == misfireRunOnce:
+            if s.owed == nil {
+                s.owed = &scheduledFor
+            }
+        case s.running:
+            ss.recordRunLocked(s, &ScheduleRun{ID: "run_" + newRequestID(), ScheduledFor: scheduledFor,
+                Status: runSkipped, Reason: "previous run still in progress"})
+            log.Printf("Schedule %s: skipped run for %v, previous run still in progress", s.ID, scheduledFor)
+        case late && s.Misfire == misfireSkip:
+            ss.recordRunLocked(s, &ScheduleRun{ID: "run_" + newRequestID(), ScheduledFor: scheduledFor,
+                Status: runSkipped, Reason: fmt.Sprintf("missed by %v", now.Sub(scheduledFor).Round(time.Second))})
+            log.Printf("Schedule %s: skipped run for %v, missed by %v", s.ID, scheduledFor, now.Sub(scheduledFor))
+        default:
+            start = append(start, scheduledRun{s, ss.startRunLocked(s, scheduledFor, now)})
+        }
+    }
+    return start
+}
+
+// finish records a run's outcome and returns the owed late run to start, if any
+func (ss *ScheduleStore) finish(s *Schedule, run *ScheduleRun, model, deliveredTo string, err error, now time.Time) *ScheduleRun {
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+
+    finished := now
+    run.FinishedAt = &finished
+    run.ModelUsed, run.DeliveredTo = model, deliveredTo
+    run.Status = runSucceeded
+    if err != nil {
+        run.Status, run.Reason = runFailed, err.Error()
+    }
+    metrics.Inc("schedule_runs_total", "status", run.Status)
+    s.running = false
+
+    owed := s.owed
+    s.owed = nil
+    if owed == nil || s.paused || ss.schedules[s.ID] != s {
+        return nil
+    }
+    return ss.startRunLocked(s, *owed, now)
+}
+
+// Run fires due schedules every second until the process exits
+func (ss *ScheduleStore) Run(runner *scheduleRunner) {
+    for now := range time.Tick(time.Second) {
+        for _, due := range ss.due(now) {
+            go ss.execute(runner, due.schedule, due.run)
+        }
+    }
+}
+
+// execute performs a run and any owed late run that queued up behind it
+func (ss *ScheduleStore) execute(runner *scheduleRunner, s *Schedule, run *ScheduleRun) {
+    for run != nil {
+        log.Printf("Schedule %s: starting run %s (scheduled for %v)", s.ID, run.ID, run.ScheduledFor)
+        model, deliveredTo, err := runner.execute(s, run)
+        if err != nil {
+            log.Printf("Schedule %s: run %s failed: %v", s.ID, run.ID, err)
+        }
+        run = ss.finish(s, run, model, deliveredTo, err, time.Now())
+    }
+}
+
+// scheduleRunner generates and delivers the result of one run
+type scheduleRunner struct {
+    bc            *BedrockClient
+    linkPolicy    *LinkPolicy
+    systemContext *SystemContext
+    results       *ResultStore
+}
+
+func (sr *scheduleRunner) execute(s *Schedule, run *ScheduleRun) (string, string, error) {
+    req := s.Request
+    now := time.Now()
+
+    params, err := sr.params(&req, s.spec.loc, now)
+    if err != nil {
+        return "", "", err
+    }
+    result, err := sr.bc.Generate(context.Background(), params)
+    if err != nil {
+        return "", "", err
+    }
+    classifyRefusal(result)
+
+    mode, _ := sr.linkPolicy.EffectiveMode(req.LinkFilter)
+    text, links, err := sr.linkPolicy.Apply(mode, result.Text)
+    if err != nil {
+        return result.ModelName, "", fmt.Errorf("response blocked: it contained links to disallowed domains")
+    }
+    text, refusalReplaced := refusalText(text, result.Refused, s.policy)
+    footerApplied := false
+    if result.FinishReason != finishFiltered && !refusalReplaced {
+        text, footerApplied = applyFooter(text, s.policy)
+    }
+
+    scheduled := ScheduledResult{
+        ScheduleID:   s.ID,
+        RunID:        run.ID,
+        ScheduledFor: run.ScheduledFor,
+        Result: GenerateResponse{
+            Response:  text,
+            ModelUsed: result.ModelName,
+            Links:     links,
+            Meta: &ResponseMeta{
+                ModelID:         result.ModelID,
+                Account:         result.Account,
+                FooterApplied:   footerApplied,
+                RefusalReplaced: refusalReplaced,
+            },
+            FinishReason:    result.FinishReason,
+            FinishReasonRaw: result.FinishReasonRaw,
+            Filtered:        result.Filtered,
+            FilterCategory:  result.FilterCategory,
+            Refused:         result.Refused,
+            RefusalCategory: result.RefusalCategory,
+        },
+    }
+    scheduled.Result.setUsage(result)
+    payload, err := json.Marshal(scheduled)
+    if err != nil {
+        return result.ModelName, "", err
+    }
+
+    if s.Target.WebhookURL != "" {
+        return result.ModelName, s.Target.WebhookURL, deliverWebhook(s, run, payload)
+    }
+    key := expandScheduleKey(s.Target.S3Key, s, run)
+    if _, err := sr.results.PutKey(context.Background(), key, payload, now); err != nil {
+        return result.ModelName, "", err
+    }
+    return result.ModelName, key, nil
+}
+
+// params builds a run's generation the way /generate does. Models and the
+// guardrail are resolved again on each run, since the registry may have been
+// reloaded since the schedule was created.
+func (sr *scheduleRunner) params(req *GenerateRequest, loc *time.Location, now time.Time) (GenerationParams, error) {
+    invalid := func(apiErr *APIError) (GenerationParams, error) {
+        return GenerationParams{}, fmt.Errorf("invalid request: %s", apiErr.Message)
+    }
+    prompt, history, apiErr := req.turns()
+    if apiErr != nil {
+        return invalid(apiErr)
+    }
+    documents, apiErr := req.documents(prompt)
+    if apiErr != nil {
+        return invalid(apiErr)
+    }
+    match, apiErr := sr.bc.checkModelPreference(req.Model, req.StrictModel)
+    if apiErr != nil {
+        return invalid(apiErr)
+    }
+    chain, apiErr := sr.bc.resolveChain(req.Models, req.Model)
+    if apiErr != nil {
+        return invalid(apiErr)
+    }
+    guardrail, apiErr := sr.bc.guardrail.forRequest(req)
+    if apiErr != nil {
+        return invalid(apiErr)
+    }
+
+    params := GenerationParams{
+        Prompt:         prompt,
+        History:        history,
+        PromptBlocks:   req.promptBlocks(),
+        Documents:      documents,
+        PreferredModel: req.Model,
+        MaxTokens:      req.maxTokens(),
+        Temperature:    req.Temperature,
+        TopP:           req.TopP,
+        TopK:           req.TopK,
+        SystemPrompt:   req.System,
+        StopSequences:  req.StopSequences,
+        SystemContext:  sr.systemContext.Lines(now, loc, !req.NoTimeContext),
+        Origin:         originUser, // Scheduled on the tenant's behalf, and billed to it
+        NoAdaptation:   req.NoAdaptation,
+        Guardrail:      guardrail,
+    }
+    if req.StrictModel {
+        params.Candidates = sr.bc.strictCandidates(match)
+    }
+    chain.apply(&params)
+    return params, nil
+}
+
+// deliverWebhook POSTs a run's result through the egress client
+func deliverWebhook(s *Schedule, run *ScheduleRun, payload []byte) error {
+    req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, s.Target.WebhookURL, bytes.NewReader(payload))
+    if err != nil {
+        return fmt.Errorf("invalid webhook URL: %v", err)
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Schedule-ID", s.ID)
+    req.Header.Set("X-Run-ID", run.ID)
+
+    resp, err := egress.Do(req)
+    if err != nil {
+        return fmt.Errorf("webhook delivery failed: %v", err)
+    }
+    defer resp.Body.Close()
+    io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+    }
+    return nil
+}
+
+// expandScheduleKey fills in an S3 key pattern. Dates are in the
+// schedule's time zone.
+func expandScheduleKey(pattern string, s *Schedule, run *ScheduleRun) string {
+    local := run.ScheduledFor.In(s.spec.loc)
+    return strings.NewReplacer(
+        "{schedule_id}", s.ID,
+        "{run_id}", run.ID,
+        "{date}", local.Format("2006-01-02"),
+        "{time}", local.Format("1504"),
+    ).Replace(pattern)
+}
+
+// validate checks everything about a new schedule that doesn't depend on the store
+func (req *CreateScheduleRequest) validate(bc *BedrockClient, linkPolicy *LinkPolicy, results *ResultStore) ([]FieldError, *cronSpec) {
+    var fields []FieldError
+
+    spec, err := parseCron(req.Cron)
+    if err != nil {
+        fields = append(fields, FieldError{Field: "cron", Message: err.Error()})
+    } else if spec.Next(time.Now()).IsZero() {
+        fields = append(fields, FieldError{Field: "cron", Message: "never matches a date"})
+    }
+
+    // Problems with the request are reported under request.
+    nested := func(apiErr *APIError) {
+        if apiErr == nil {
+            return
+        }
+        if len(apiErr.Fields) == 0 {
+            fields = append(fields, FieldError{Field: "request", Message: apiErr.Message})
+        }
+        for _, f := range apiErr.Fields {
+            fields = append(fields, FieldError{Field: "request." + f.Field, Message: f.Message})
+        }
+    }
+
+    g := req.Request
+    if g.Messages == nil && strings.TrimSpace(g.Prompt) == "" {
+        fields = append(fields, FieldError{Field: "request.prompt", Message: "is required"})
+    } else if prompt, _, apiErr := g.turns(); apiErr != nil {
+        nested(apiErr)
+    } else {
+        _, apiErr = g.documents(prompt)
+        nested(apiErr)
+    }
+    nested(g.checkStopSequences())
+    nested(g.checkSampling())
+    _, apiErr := bc.checkModelPreference(g.Model, g.StrictModel)
+    nested(apiErr)
+    _, apiErr = bc.resolveChain(g.Models, g.Model)
+    nested(apiErr)
+    _, apiErr = bc.guardrail.forRequest(&g)
+    nested(apiErr)
+
+    if len(g.Tools) > 0 {
+        fields = append(fields, FieldError{Field: "request.tools", Message: "are not supported on scheduled runs"})
+    }
+    if g.ContextID != "" {
+        fields = append(fields, FieldError{Field: "request.context_id", Message: "is not supported on scheduled runs; contexts expire"})
+    }
+    if g.DryRun || g.Deliver != "" {
+        fields = append(fields, FieldError{Field: "request", Message: "dry_run and deliver are not supported on scheduled runs; use the schedule's deliver target"})
+    }
+    // A run has no caller to answer in these shapes, nor a request for
+    // hooks and experiments to look at
+    for _, unsupported := range []struct {
+        field string
+        set   bool
+    }{
+        {"response_format", g.ResponseFormat != nil},
+        {"verify_numeric", g.VerifyNumeric || g.NumericStrict},
+        {"format", g.Format != ""},
+        {"timeout_seconds", g.TimeoutSeconds != nil},
+        {"guardrail_trace", g.GuardrailTrace},
+        {"user_id", g.UserID != ""},
+        {"extensions", len(g.Extensions) > 0},
+    } {
+        if unsupported.set {
+            fields = append(fields, FieldError{Field: "request." + unsupported.field, Message: "is not supported on scheduled runs"})
+        }
+    }
+    if g.Timezone != "" {
+        fields = append(fields, FieldError{Field: "request.timezone", Message: "is not supported on scheduled runs; prefix cron with CRON_TZ=<zone>"})
+    }
+    if _, err := linkPolicy.EffectiveMode(g.LinkFilter); err != nil {
+        fields = append(fields, FieldError{Field: "request.link_filter", Message: err.Error()})
+    }
+
+    switch {
+    case (req.Deliver.WebhookURL == "") == (req.Deliver.S3Key == ""):
+        fields = append(fields, FieldError{Field: "deliver", Message: "set exactly one of webhook_url and s3_key"})
+    case req.Deliver.WebhookURL != "":
+        u, err := url.Parse(req.Deliver.WebhookURL)
+        if err == nil {
+            err = egress.policy.CheckURL(u)
+        }
+        if err != nil {
+            fields = append(fields, FieldError{Field: "deliver.webhook_url", Message: err.Error()})
+        }
+    case results == nil:
+        fields = append(fields, FieldError{Field: "deliver.s3_key", Message: "no results bucket is configured"})
+    case !strings.Contains(req.Deliver.S3Key, "{schedule_id}") || strings.HasPrefix(req.Deliver.S3Key, "/"):
+        fields = append(fields, FieldError{Field: "deliver.s3_key", Message: "must be a relative key containing {schedule_id}"})
+    }
+
+    switch req.Misfire {
+    case "":
+        req.Misfire = misfireSkip
+    case misfireSkip, misfireRunOnce:
+    default:
+        fields = append(fields, FieldError{Field: "misfire", Message: fmt.Sprintf("must be %q or %q", misfireSkip, misfireRunOnce)})
+    }
+    return fields, spec
+}
+
+func createScheduleHandler(ss *ScheduleStore, bc *BedrockClient, linkPolicy *LinkPolicy, results *ResultStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req CreateScheduleRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+
+        fields, spec := req.validate(bc, linkPolicy, results)
+        if len(fields) > 0 {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: "Invalid schedule",
+                Fields:  fields,
+            })
+            return
+        }
+
+        principal := principalFrom(r.Context())
+        s := &Schedule{
+            Owner:   contextOwner(principal),
+            Cron:    req.Cron,
+            Request: req.Request,
+            Target:  req.Deliver,
+            Misfire: req.Misfire,
+            spec:    spec,
+            policy:  principal.Policy,
+        }
+        if err := ss.Create(s, time.Now()); err != nil {
+            writeError(w, r, http.StatusConflict, ErrCodeUnprocessable, err.Error())
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(ss.Info(s))
+    }
+}
+
+func listSchedulesHandler(ss *ScheduleStore, pages PageConfig) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        q, apiErr := pages.parseListQuery(r)
+        if apiErr != nil {
+            writeAPIError(w, r, http.StatusBadRequest, *apiErr)
+            return
+        }
+        schedules := ss.List(contextOwner(principalFrom(r.Context())))
+        indexes, page := pages.paginate(q, len(schedules), func(i int) pageKey {
+            return pageKey{Created: schedules[i].CreatedAt, ID: schedules[i].ID}
+        })
+        items := make([]ScheduleInfo, len(indexes))
+        for i, idx := range indexes {
+            items[i] = schedules[idx]
+        }
+        page.Items = items
+        writeJSON(w, r, page)
+    }
+}
+
+// scheduleHandler resolves {id} to one of the caller's schedules for fn
+func scheduleHandler(ss *ScheduleStore, fn func(w http.ResponseWriter, r *http.Request, s *Schedule)) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        s, ok := ss.Get(contextOwner(principalFrom(r.Context())), mux.Vars(r)["id"])
+        if !ok {
+            writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Unknown schedule")
+            return
+        }
+        fn(w, r, s)
+    }
+}
+
+func getScheduleHandler(ss *ScheduleStore) http.HandlerFunc {
+    return scheduleHandler(ss, func(w http.ResponseWriter, r *http.Request, s *Schedule) {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(ss.Info(s))
+    })
+}
+
+func deleteScheduleHandler(ss *ScheduleStore) http.HandlerFunc {
+    return scheduleHandler(ss, func(w http.ResponseWriter, r *http.Request, s *Schedule) {
+        ss.Delete(s)
+        w.WriteHeader(http.StatusNoContent)
+    })
+}
+
+// pauseScheduleHandler serves both /pause and /resume
+func pauseScheduleHandler(ss *ScheduleStore, paused bool) http.HandlerFunc {
+    return scheduleHandler(ss, func(w http.ResponseWriter, r *http.Request, s *Schedule) {
+        ss.SetPaused(s, paused, time.Now())
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(ss.Info(s))
+    })
+}
+
+func scheduleRunsHandler(ss *ScheduleStore, pages PageConfig) http.HandlerFunc {
+    return scheduleHandler(ss, func(w http.ResponseWriter, r *http.Request, s *Schedule) {
+        q, apiErr := pages.parseListQuery(r, "status")
+        if apiErr != nil {
+            writeAPIError(w, r, http.StatusBadRequest, *apiErr)
+            return
+        }
+        status := r.URL.Query().Get("status")
+        var runs []ScheduleRun
+        for _, run := range ss.Runs(s) {
+            if status == "" || run.Status == status {
+                runs = append(runs, run)
+            }
+        }
+        // Runs are created when they're due, so that is their creation time
+        indexes, page := pages.paginate(q, len(runs), func(i int) pageKey {
+            return pageKey{Created: runs[i].ScheduledFor, ID: runs[i].ID}
+        })
+        items := make([]ScheduleRun, len(indexes))
+        for i, idx := range indexes {
+            items[i] = runs[idx]
+        }
+        page.Items = items
+        writeJSON(w, r, page)
+    })
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+// A run is generated from everything in the schedule's request that
+// /generate would honour, not just the prompt
+func TestScheduleRunnerParams(t *testing.T) {
+    bc, err := NewBedrockClient()
+    if err != nil {
+        t.Fatal(err)
+    }
+    sr := &scheduleRunner{bc: bc, systemContext: &SystemContext{StaticLines: []string{"Team: growth"}}}
+
+    system, topP, topK := "Reply in French.", 0.8, 40
+    const first, second = "anthropic.claude-3-haiku-20240307-v1:0", "anthropic.claude-3-sonnet-20240229-v1:0"
+    req := GenerateRequest{
+        Messages: []ChatMessage{
+            {Role: roleUser, Content: "Summarise yesterday's tickets."},
+            {Role: roleAssistant, Content: "Which queue?"},
+            {Role: roleUser, Content: "Billing."},
+        },
+        System:           &system,
+        StopSequences:    []string{"END"},
+        TopP:             &topP,
+        TopK:             &topK,
+        Models:           []string{first, second},
+        NoAdaptation:     true,
+        GuardrailID:      "gr-reports",
+        GuardrailVersion: "2",
+        NoTimeContext:    true,
+    }
+    p, err := sr.params(&req, time.UTC, time.Now())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if p.Prompt != "Billing." || len(p.History) != 2 || p.History[1].Content != "Which queue?" {
+        t.Errorf("turns %q after %+v", p.Prompt, p.History)
+    }
+    if p.SystemPrompt == nil || *p.SystemPrompt != system || !reflect.DeepEqual(p.StopSequences, []string{"END"}) {
+        t.Errorf("system %v, stop sequences %v", p.SystemPrompt, p.StopSequences)
+    }
+    if p.TopP == nil || *p.TopP != topP || p.TopK == nil || *p.TopK != topK {
+        t.Errorf("top_p %v, top_k %v", p.TopP, p.TopK)
+    }
+    if len(p.Candidates) != 2 || p.Candidates[0].ID != first || p.Candidates[1].ID != second || p.PreferredModel != first {
+        t.Errorf("candidates %+v preferring %q, want the listed models", p.Candidates, p.PreferredModel)
+    }
+    if p.Guardrail == nil || p.Guardrail.ID != "gr-reports" || p.Guardrail.Version != "2" {
+        t.Errorf("guardrail %+v", p.Guardrail)
+    }
+    if !p.NoAdaptation || p.Origin != originUser || !reflect.DeepEqual(p.SystemContext, []string{"Team: growth"}) {
+        t.Errorf("no adaptation %v, origin %s, system context %v", p.NoAdaptation, p.Origin, p.SystemContext)
+    }
+
+    strict, err := sr.params(&GenerateRequest{Prompt: "Hi", Model: first, StrictModel: true}, time.UTC, time.Now())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(strict.Candidates) != 1 || strict.Candidates[0].ID != first {
+        t.Errorf("strict candidates %+v, want %s alone", strict.Candidates, first)
+    }
+
+    // The registry may have changed since the schedule was created
+    if _, err := sr.params(&GenerateRequest{Prompt: "Hi", Models: []string{"no-such-model"}}, time.UTC, time.Now()); err == nil {
+        t.Error("a run naming an unknown model went ahead")
+    }
+}
+
+func TestScheduleValidateRequest(t *testing.T) {
+    bc, err := NewBedrockClient()
+    if err != nil {
+        t.Fatal(err)
+    }
+    results := &ResultStore{}
+    validate := func(g GenerateRequest) []string {
+        req := &CreateScheduleRequest{Cron: "0 9 * * *", Request: g, Deliver: ScheduleTarget{S3Key: "reports/{schedule_id}.json"}}
+        fields, _ := req.validate(bc, &LinkPolicy{}, results)
+        var names []string
+        for _, f := range fields {
+            names = append(names, f.Field)
+        }
+        return names
+    }
+
+    if fields := validate(GenerateRequest{
+        Messages:      []ChatMessage{{Role: roleUser, Content: "Hi"}},
+        Models:        []string{"anthropic.claude-3-haiku-20240307-v1:0"},
+        StopSequences: []string{"END"},
+    }); len(fields) != 0 {
+        t.Errorf("valid request rejected on %v", fields)
+    }
+
+    ten := 10.0
+    for _, c := range []struct {
+        name  string
+        req   GenerateRequest
+        field string
+    }{
+        {"no prompt", GenerateRequest{Prompt: "  "}, "request.prompt"},
+        {"bad messages", GenerateRequest{Messages: []ChatMessage{{Role: roleAssistant, Content: "Hi"}}}, "request.messages[0].role"},
+        {"model and models", GenerateRequest{Prompt: "Hi", Model: "haiku", Models: []string{"sonnet"}}, "request.models"},
+        {"strict without model", GenerateRequest{Prompt: "Hi", StrictModel: true}, "request.strict_model"},
+        {"unknown model", GenerateRequest{Prompt: "Hi", Models: []string{"no-such-model"}}, "request.models[0]"},
+        {"guardrail version alone", GenerateRequest{Prompt: "Hi", GuardrailVersion: "1"}, "request.guardrail_version"},
+        {"response format", GenerateRequest{Prompt: "Hi", ResponseFormat: &ResponseFormat{Type: "json_object"}}, "request.response_format"},
+        {"verify numeric", GenerateRequest{Prompt: "Hi", VerifyNumeric: true}, "request.verify_numeric"},
+        {"blocks", GenerateRequest{Prompt: "Hi", Format: "blocks"}, "request.format"},
+        {"timeout", GenerateRequest{Prompt: "Hi", TimeoutSeconds: &ten}, "request.timeout_seconds"},
+        {"guardrail trace", GenerateRequest{Prompt: "Hi", GuardrailID: "gr", GuardrailVersion: "1", GuardrailTrace: true}, "request.guardrail_trace"},
+        {"user id", GenerateRequest{Prompt: "Hi", UserID: "u-1"}, "request.user_id"},
+        {"extensions", GenerateRequest{Prompt: "Hi", Extensions: map[string]interface{}{"tier": "gold"}}, "request.extensions"},
+        {"timezone", GenerateRequest{Prompt: "Hi", Timezone: "Europe/Paris"}, "request.timezone"},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            fields := validate(c.req)
+            if !contains(fields, c.field) {
+                t.Errorf("rejected on %v, want %s", fields, c.field)
+            }
+            for _, f := range fields {
+                if !strings.HasPrefix(f, "request") {
+                    t.Errorf("field %s outside the request", f)
+                }
+            }
+        })
+    }
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+)
+
+// schemaVersions lists the supported versions of GenerateRequest, oldest
+// first and ending with the latest. Handlers only ever see the latest shape;
+// older requests are upgraded by the adapters below. Requests that don't name
+// a version are treated as the oldest, so changing a default in a new version
+// never changes behavior for clients that haven't opted in.
+var schemaVersions = []string{"1"}
+
+// schemaAdapter upgrades a raw request body from one version to the next,
+// renaming fields or filling in the defaults that version used to imply
+type schemaAdapter func(body map[string]json.RawMessage) error
+
+// schemaAdapters maps a version to the adapter that upgrades it to the
+// following one in schemaVersions. Adding version N+1 means appending it to
+// schemaVersions and registering the adapter for version N here.
+var schemaAdapters = map[string]schemaAdapter{}
+
+// schemaVersionError is returned when the declared version is malformed,
+// ambiguous or not supported
+type schemaVersionError struct {
+    Message string
+}
+
+func (e *schemaVersionError) Error() string {
+    return e.Message
+}
+
+// decodeGenerateRequest reads a GenerateRequest in whatever schema version
+// the caller declared, via schema_version or X-Schema-Version, and upgrades
+// it to the latest. It returns the version the request was interpreted as.
+func decodeGenerateRequest(r *http.Request, req *GenerateRequest) (string, error) {
+    var body map[string]json.RawMessage
+    if err := json.Unmarshal(requestBody(r), &body); err != nil {
+        return "", err
+    }
+
+    version := strings.TrimSpace(r.Header.Get("X-Schema-Version"))
+    if raw, ok := body["schema_version"]; ok {
+        var declared string
+        if err := json.Unmarshal(raw, &declared); err != nil {
+            return "", &schemaVersionError{Message: "schema_version must be a string"}
+        }
+        if version != "" && version != declared {
+            return "", &schemaVersionError{Message: fmt.Sprintf("schema_version %q does not match X-Schema-Version %q", declared, version)}
+        }
+        version = declared
+        delete(body, "schema_version")
+    }
+    if version == "" {
+        version = schemaVersions[0]
+    }
+
+    index := -1
+    for i, v := range schemaVersions {
+        if v == version {
+            index = i
+            break
+        }
+    }
+    if index < 0 {
+        return "", &schemaVersionError{Message: fmt.Sprintf("Unsupported schema_version %q; supported versions: %s",
+            version, strings.Join(schemaVersions, ", "))}
+    }
+
+    for _, v := range schemaVersions[index : len(schemaVersions)-1] {
+        if err := schemaAdapters[v](body); err != nil {
+            return "", &schemaVersionError{Message: fmt.Sprintf("schema_version %s: %v", v, err)}
+        }
+    }
+
+    canonical, err := json.Marshal(body)
+    if err != nil {
+        return "", err
+    }
+    if err := json.Unmarshal(canonical, req); err != nil {
+        return "", err
+    }
+    metrics.Inc("generate_schema_versions_total", "version", version)
+    return version, nil
+}
+
+// schemaErrorResponse maps a decode failure to its error envelope
+func schemaErrorResponse(err error) (int, APIError) {
+    if _, ok := err.(*schemaVersionError); ok {
+        return http.StatusBadRequest, APIError{
+            Code:    ErrCodeValidation,
+            Message: err.Error(),
+            Fields:  []FieldError{{Field: "schema_version", Message: "must be one of " + strings.Join(schemaVersions, ", ")}},
+        }
+    }
+    return http.StatusBadRequest, APIError{Code: ErrCodeValidation, Message: "Invalid request body"}
+}
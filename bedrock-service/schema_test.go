@@ -0,0 +1,133 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// decodeVersioned decodes a body the way the handlers do, after the body
+// buffer middleware
+func decodeVersioned(t *testing.T, header, body string) (GenerateRequest, string, error) {
+    t.Helper()
+    r := httptest.NewRequest(http.MethodPost, "/generate", strings.NewReader(body))
+    r = r.WithContext(context.WithValue(r.Context(), bodyKey{}, []byte(body)))
+    if header != "" {
+        r.Header.Set("X-Schema-Version", header)
+    }
+    var req GenerateRequest
+    version, err := decodeGenerateRequest(r, &req)
+    return req, version, err
+}
+
+// withSchemaVersions swaps in a version list and its adapters for a test
+func withSchemaVersions(t *testing.T, versions []string, adapters map[string]schemaAdapter) {
+    previousVersions, previousAdapters := schemaVersions, schemaAdapters
+    schemaVersions, schemaAdapters = versions, adapters
+    t.Cleanup(func() { schemaVersions, schemaAdapters = previousVersions, previousAdapters })
+}
+
+// latestRequest is the request every versioned body below must upgrade to
+const latestRequest = `{"prompt":"Summarize this","max_tokens":256,"temperature":0,"models":["anthropic.claude-3-haiku-20240307-v1:0"]}`
+
+// versionBodies is latestRequest as a client of each version writes it. A
+// new version needs an entry here, so its adapter is exercised.
+var versionBodies = map[string]string{
+    "1": latestRequest,
+}
+
+// Each supported version's request upgrades, through every adapter after
+// it, to the same request as the latest version's
+func TestSchemaAdaptersRoundTrip(t *testing.T) {
+    latest := schemaVersions[len(schemaVersions)-1]
+    want, _, err := decodeVersioned(t, latest, latestRequest)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i, version := range schemaVersions {
+        if _, ok := schemaAdapters[version]; ok != (i < len(schemaVersions)-1) {
+            t.Errorf("version %s: adapter registered %v", version, ok)
+        }
+        body, ok := versionBodies[version]
+        if !ok {
+            t.Errorf("no request body for version %s", version)
+            continue
+        }
+        got, interpreted, err := decodeVersioned(t, version, body)
+        if err != nil || interpreted != version || !reflect.DeepEqual(got, want) {
+            t.Errorf("version %s: %+v as %s, %v; want %+v", version, got, interpreted, err, want)
+        }
+    }
+}
+
+// An adapter chain, exercised with made-up versions: 1 spelled max_tokens
+// as max_token_count, and 2 implied temperature 0 where 3 has a default
+func TestSchemaAdapterChain(t *testing.T) {
+    withSchemaVersions(t, []string{"1", "2", "3"}, map[string]schemaAdapter{
+        "1": func(body map[string]json.RawMessage) error {
+            if raw, ok := body["max_token_count"]; ok {
+                body["max_tokens"] = raw
+                delete(body, "max_token_count")
+            }
+            return nil
+        },
+        "2": func(body map[string]json.RawMessage) error {
+            if _, ok := body["temperature"]; !ok {
+                body["temperature"] = json.RawMessage("0")
+            }
+            if raw, ok := body["max_tokens"]; ok && string(raw) == "0" {
+                return errors.New("max_tokens 0 means the default, leave it out")
+            }
+            return nil
+        },
+    })
+    zero := 0.0
+    limit := 256
+
+    for _, c := range []struct {
+        name    string
+        header  string
+        body    string
+        version string
+        want    GenerateRequest
+        err     string
+    }{
+        {"oldest by default", "", `{"prompt":"Hi","max_token_count":256}`, "1", GenerateRequest{Prompt: "Hi", MaxTokens: &limit, Temperature: &zero}, ""},
+        {"middle version", "", `{"schema_version":"2","prompt":"Hi","max_tokens":256}`, "2", GenerateRequest{Prompt: "Hi", MaxTokens: &limit, Temperature: &zero}, ""},
+        {"latest untouched", "3", `{"prompt":"Hi","max_tokens":256}`, "3", GenerateRequest{Prompt: "Hi", MaxTokens: &limit}, ""},
+        {"header and body agree", "2", `{"schema_version":"2","prompt":"Hi"}`, "2", GenerateRequest{Prompt: "Hi", Temperature: &zero}, ""},
+        {"adapter error", "2", `{"prompt":"Hi","max_tokens":0}`, "", GenerateRequest{}, "schema_version 2: max_tokens 0 means the default"},
+        {"header and body disagree", "3", `{"schema_version":"2","prompt":"Hi"}`, "", GenerateRequest{}, `schema_version "2" does not match X-Schema-Version "3"`},
+        {"unsupported", "", `{"schema_version":"4","prompt":"Hi"}`, "", GenerateRequest{}, `Unsupported schema_version "4"; supported versions: 1, 2, 3`},
+        {"not a string", "", `{"schema_version":2,"prompt":"Hi"}`, "", GenerateRequest{}, "schema_version must be a string"},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            got, version, err := decodeVersioned(t, c.header, c.body)
+            if c.err != "" {
+                var versionErr *schemaVersionError
+                if !errors.As(err, &versionErr) || !strings.Contains(err.Error(), c.err) {
+                    t.Errorf("error %v, want %q", err, c.err)
+                }
+                return
+            }
+            if err != nil || version != c.version || !reflect.DeepEqual(got, c.want) {
+                t.Errorf("%+v as %s, %v; want %+v as %s", got, version, err, c.want, c.version)
+            }
+        })
+    }
+}
+
+func TestSchemaErrorResponse(t *testing.T) {
+    status, apiErr := schemaErrorResponse(&schemaVersionError{Message: "Unsupported schema_version \"9\""})
+    if status != http.StatusBadRequest || apiErr.Code != ErrCodeValidation || len(apiErr.Fields) != 1 || apiErr.Fields[0].Field != "schema_version" {
+        t.Errorf("version error: %d %+v", status, apiErr)
+    }
+    if _, apiErr := schemaErrorResponse(errors.New("unexpected EOF")); apiErr.Message != "Invalid request body" || len(apiErr.Fields) != 0 {
+        t.Errorf("malformed body: %+v", apiErr)
+    }
+}
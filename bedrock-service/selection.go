@@ -0,0 +1,262 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// A request's model preference is matched against every configured text
+// model, available or not; image models only answer /images. An alias
+// matches its group; anything else matches the models whose name or ID
+// contains it, ignoring case. A preference that matches nothing is rejected
+// rather than quietly ignored. With strict_model only what it matched is
+// tried, never the rest of the fallback chain, and a failure is returned as
+// such instead of an answer from a model the caller didn't ask for.
+//
+// A request may instead list the models to try itself. Then only those are
+// tried, in the order given, and when all of them fail the error says why
+// each one did.
+
+// Matching rules reported in model_match
+const (
+    matchAlias     = "alias"
+    matchSubstring = "substring"
+    matchNone      = "none"
+)
+
+// ModelMatch says how a request's model preference was resolved
+type ModelMatch struct {
+    Requested string   `json:"requested"`
+    Rule      string   `json:"rule"`             // alias, substring or none
+    Models    []string `json:"models,omitempty"` // Configured model IDs matched: the alias's group, or every substring match in fallback order
+}
+
+// matches reports whether a model preference names the model: it is part of
+// the model's name or ID, or an inference profile of the model's base ID
+func (m ModelInfo) matches(preferred string) bool {
+    needle := strings.ToLower(preferred)
+    if strings.Contains(strings.ToLower(m.Name), needle) || strings.Contains(strings.ToLower(m.ID), needle) {
+        return true
+    }
+    return isInferenceProfile(preferred) && !isInferenceProfile(m.ID) && strings.Contains(normalizeModelID(m.ID), foundationModelID(preferred))
+}
+
+// matchModel resolves a model preference against the configured models
+func (bc *BedrockClient) matchModel(preferred string) ModelMatch {
+    match := ModelMatch{Requested: preferred, Rule: matchNone}
+    bc.modelsMu.RLock()
+    defer bc.modelsMu.RUnlock()
+
+    if group, ok := bc.aliases[normalizeAlias(preferred)]; ok {
+        match.Rule, match.Models = matchAlias, group
+        return match
+    }
+    for _, model := range bc.availableModels {
+        if model.modality() == modalityText && model.matches(preferred) {
+            match.Models = append(match.Models, model.ID)
+        }
+    }
+    if len(match.Models) > 0 {
+        match.Rule = matchSubstring
+    }
+    return match
+}
+
+// checkModelPreference rejects a preference that matches no configured
+// model, and strict_model without a preference
+func (bc *BedrockClient) checkModelPreference(preferred string, strict bool) (ModelMatch, *APIError) {
+    if preferred == "" {
+        if strict {
+            return ModelMatch{}, &APIError{
+                Code:    ErrCodeValidation,
+                Message: "strict_model requires model",
+                Fields:  []FieldError{{Field: "strict_model", Message: "requires model to name a model or alias"}},
+            }
+        }
+        return ModelMatch{}, nil
+    }
+    match := bc.matchModel(preferred)
+    if match.Rule == matchNone {
+        return match, &APIError{
+            Code:       ErrCodeValidation,
+            Message:    fmt.Sprintf("Model %q matches no configured model or alias", preferred),
+            Fields:     []FieldError{{Field: "model", Message: "matches no configured model name, model ID or alias"}},
+            ModelMatch: &match,
+        }
+    }
+    return match, nil
+}
+
+// strictCandidates is the chain for strict_model: an alias's usable models
+// in group order, or the first usable model a substring matched. It is
+// empty, not nil, when none is usable, so no fallback chain replaces it.
+func (bc *BedrockClient) strictCandidates(match ModelMatch) []ModelInfo {
+    usable := bc.usableModels()
+    candidates := []ModelInfo{}
+    for _, id := range match.Models {
+        for _, model := range usable {
+            if model.ID == id {
+                candidates = append(candidates, model)
+            }
+        }
+        if match.Rule == matchSubstring && len(candidates) > 0 {
+            break
+        }
+    }
+    return candidates
+}
+
+// strictErrorResponse is the response when a strict_model request failed.
+// Throttling, a prompt too long and rejected parameters answer with their
+// own codes, as without strict_model, and any other upstream failure is a
+// 502, all with the failure's class; when nothing matched was usable to try
+// it is a 503. Cancellations, deadlines and our own errors answer as usual.
+func strictErrorResponse(err error, match ModelMatch) (int, APIError) {
+    status, apiErr := generationErrorResponse(err)
+    var genErr *GenerationError
+    switch apiErr.Code {
+    case ErrCodeModelUnavailable, ErrCodeThrottled, ErrCodeContextTooLong, ErrCodeValidation:
+    default:
+        return status, apiErr
+    }
+    if !errors.As(err, &genErr) {
+        return status, apiErr
+    }
+    apiErr.ModelMatch = &match
+
+    if len(genErr.Attempted) == 0 {
+        apiErr.Message = fmt.Sprintf("No model matching %q is available, and strict_model allows no fallback", match.Requested)
+        apiErr.ErrorClass = errClassNotAvailable
+        return http.StatusServiceUnavailable, apiErr
+    }
+    apiErr.ErrorClass = classifyError(genErr.Err)
+    if apiErr.Code != ErrCodeModelUnavailable {
+        return status, apiErr
+    }
+    apiErr.Message = fmt.Sprintf("%s failed, and strict_model allows no fallback", strings.Join(genErr.Attempted, ", "))
+    return http.StatusBadGateway, apiErr
+}
+
+// maxRequestModels bounds a request's models list
+const maxRequestModels = 10
+
+// requestChain is the chain a request's models list resolved to
+type requestChain struct {
+    models  []ModelInfo    // Listed models usable now, in order; empty, not nil, when none is
+    skipped []ModelFailure // Listed models that are disabled or unavailable
+    head    string         // The first listed model's ID, whose provider the prompt is taken to be written for
+}
+
+// apply makes the listed models the only ones p tries. A nil chain, for a
+// request without a list, leaves the fallback chain in place.
+func (c *requestChain) apply(p *GenerationParams) {
+    if c == nil {
+        return
+    }
+    p.Candidates, p.Skipped, p.PreferredModel = c.models, c.skipped, c.head
+}
+
+// resolveChain resolves a request's models list. Each entry is a model ID;
+// an alias, standing for its group; or else a substring of a model's name
+// or ID, standing for the first usable model in fallback order it matches,
+// or the first it matches at all when none is usable. Entries
+// that match nothing are rejected, and a model listed twice is tried once.
+func (bc *BedrockClient) resolveChain(names []string, preferred string) (*requestChain, *APIError) {
+    if len(names) == 0 {
+        return nil, nil
+    }
+    if preferred != "" {
+        return nil, &APIError{
+            Code:    ErrCodeValidation,
+            Message: "Set model or models, not both",
+            Fields:  []FieldError{{Field: "models", Message: "can't be combined with model"}},
+        }
+    }
+    if len(names) > maxRequestModels {
+        return nil, &APIError{
+            Code:    ErrCodeValidation,
+            Message: fmt.Sprintf("models lists at most %d models", maxRequestModels),
+            Fields:  []FieldError{{Field: "models", Message: fmt.Sprintf("has more than %d entries", maxRequestModels)}},
+        }
+    }
+    now := time.Now()
+    warming := !bc.registryReady.Load()
+    bc.modelsMu.RLock()
+    defer bc.modelsMu.RUnlock()
+
+    var fields []FieldError
+    var listed []ModelInfo
+    seen := make(map[string]bool)
+    for i, name := range names {
+        models := bc.resolveLocked(name, now, warming)
+        if len(models) == 0 {
+            fields = append(fields, FieldError{Field: fmt.Sprintf("models[%d]", i), Message: fmt.Sprintf("%q matches no configured model ID, name or alias", name)})
+        }
+        for _, model := range models {
+            if !seen[model.ID] {
+                seen[model.ID] = true
+                listed = append(listed, model)
+            }
+        }
+    }
+    if len(fields) > 0 {
+        return nil, &APIError{Code: ErrCodeValidation, Message: "models lists models that aren't configured", Fields: fields}
+    }
+
+    chain := &requestChain{models: []ModelInfo{}, head: listed[0].ID}
+    for _, model := range listed {
+        switch {
+        case bc.usableLocked(model, now, warming):
+            chain.models = append(chain.models, model)
+        case model.Disabled:
+            chain.skipped = append(chain.skipped, ModelFailure{Model: model.ID, ErrorClass: errClassNotAvailable, Reason: "disabled by an admin"})
+        default:
+            reason := "unavailable"
+            if model.ProbeStatus != "" {
+                reason += ": " + model.ProbeStatus
+            }
+            chain.skipped = append(chain.skipped, ModelFailure{Model: model.ID, ErrorClass: errClassNotAvailable, Reason: reason})
+        }
+    }
+    return chain, nil
+}
+
+// resolveLocked is the models one entry of a models list stands for, see
+// resolveChain; callers hold modelsMu
+func (bc *BedrockClient) resolveLocked(name string, now time.Time, warming bool) []ModelInfo {
+    if strings.TrimSpace(name) == "" {
+        return nil
+    }
+    for _, model := range bc.availableModels {
+        if normalizeModelID(model.ID) == normalizeModelID(name) && model.modality() == modalityText {
+            return []ModelInfo{model}
+        }
+    }
+    if group, ok := bc.aliases[normalizeAlias(name)]; ok {
+        var models []ModelInfo
+        for _, id := range group {
+            for _, model := range bc.availableModels {
+                if model.ID == id && model.modality() == modalityText {
+                    models = append(models, model)
+                }
+            }
+        }
+        return models
+    }
+    var matched []ModelInfo
+    for _, model := range bc.availableModels {
+        if model.modality() != modalityText || !model.matches(name) {
+            continue
+        }
+        if bc.usableLocked(model, now, warming) {
+            return []ModelInfo{model}
+        }
+        if matched == nil {
+            matched = []ModelInfo{model}
+        }
+    }
+    return matched
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+    "crypto/hmac"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// ShareConfig signs the links that give read-only access to a conversation
+// transcript without an API key
+type ShareConfig struct {
+    Secret     string // Empty disables share links
+    DefaultTTL time.Duration
+    MaxTTL     time.Duration
+    BaseURL    string // Put in front of returned links, empty to return a path
+}
+
+// LoadShareConfig reads SHARE_LINK_SECRET, SHARE_LINK_TTL_SECONDS (default
+// 86400), SHARE_LINK_MAX_TTL_SECONDS (default 604800) and SHARE_LINK_BASE_URL
+func LoadShareConfig() (ShareConfig, error) {
+    cfg := ShareConfig{
+        Secret:     os.Getenv("SHARE_LINK_SECRET"),
+        DefaultTTL: 24 * time.Hour,
+        MaxTTL:     7 * 24 * time.Hour,
+        BaseURL:    strings.TrimSuffix(os.Getenv("SHARE_LINK_BASE_URL"), "/"),
+    }
+    if v := os.Getenv("SHARE_LINK_TTL_SECONDS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return cfg, fmt.Errorf("invalid SHARE_LINK_TTL_SECONDS %q", v)
+        }
+        cfg.DefaultTTL = time.Duration(n) * time.Second
+    }
+    if v := os.Getenv("SHARE_LINK_MAX_TTL_SECONDS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return cfg, fmt.Errorf("invalid SHARE_LINK_MAX_TTL_SECONDS %q", v)
+        }
+        cfg.MaxTTL = time.Duration(n) * time.Second
+    }
+    if cfg.DefaultTTL > cfg.MaxTTL {
+        return cfg, fmt.Errorf("SHARE_LINK_TTL_SECONDS exceeds SHARE_LINK_MAX_TTL_SECONDS")
+    }
+    return cfg, nil
+}
+
+// shareToken signs a conversation ID, an expiry and the conversation's share
+// generation. Nothing is stored per link: revoking bumps the generation, so
+// every link signed for an earlier one stops verifying.
+func shareToken(secret, id string, expires time.Time, generation int) string {
+    payload := id + "." + strconv.FormatInt(expires.Unix(), 10) + "." + strconv.Itoa(generation)
+    return payload + "." + signPayload(secret, "share\n"+payload)
+}
+
+// parseShareToken verifies a token and reports what it grants. Tampered,
+// malformed and expired tokens are all just invalid.
+func parseShareToken(secret, token string, now time.Time) (string, int, time.Time, bool) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 4 {
+        return "", 0, time.Time{}, false
+    }
+    payload := strings.Join(parts[:3], ".")
+    if !hmac.Equal([]byte(parts[3]), []byte(signPayload(secret, "share\n"+payload))) {
+        return "", 0, time.Time{}, false
+    }
+    seconds, err := strconv.ParseInt(parts[1], 10, 64)
+    if err != nil {
+        return "", 0, time.Time{}, false
+    }
+    generation, err := strconv.Atoi(parts[2])
+    if err != nil {
+        return "", 0, time.Time{}, false
+    }
+    expires := time.Unix(seconds, 0)
+    if now.After(expires) {
+        return "", 0, time.Time{}, false
+    }
+    return parts[0], generation, expires, true
+}
+
+// CreateShareRequest is the optional body of POST /conversations/{id}/share
+type CreateShareRequest struct {
+    TTLSeconds int `json:"ttl_seconds,omitempty"` // Defaults to SHARE_LINK_TTL_SECONDS
+}
+
+// ShareLink is the response to POST /conversations/{id}/share
+type ShareLink struct {
+    URL       string    `json:"url"`
+    ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SharedTranscript is what a share link shows: the messages, redacted, and
+// nothing about budgets, token usage or cost
+type SharedTranscript struct {
+    ConversationID string        `json:"conversation_id"`
+    CreatedAt      time.Time     `json:"created_at"`
+    ExpiresAt      time.Time     `json:"expires_at"` // When the link stops working
+    Messages       []ChatMessage `json:"messages"`
+}
+
+var sharedTranscriptFormats = []string{mimeJSON, mimeMarkdown}
+
+// markdown renders the transcript for reading in a browser or ticket
+func (t SharedTranscript) markdown() string {
+    var sb strings.Builder
+    fmt.Fprintf(&sb, "# Conversation %s\n\nStarted %s\n", t.ConversationID, t.CreatedAt.UTC().Format(time.RFC1123))
+    for _, m := range t.Messages {
+        speaker := "User"
+        if m.Role == roleAssistant {
+            speaker = "Assistant"
+        }
+        fmt.Fprintf(&sb, "\n**%s:**\n\n%s\n", speaker, m.Content)
+    }
+    return sb.String()
+}
+
+func createShareHandler(cs *ConversationStore, cfg ShareConfig) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req CreateShareRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+        ttl := cfg.DefaultTTL
+        if req.TTLSeconds != 0 {
+            ttl = time.Duration(req.TTLSeconds) * time.Second
+        }
+        if ttl < time.Second || ttl > cfg.MaxTTL {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: fmt.Sprintf("ttl_seconds must be between 1 and %d", int(cfg.MaxTTL.Seconds())),
+                Fields:  []FieldError{{Field: "ttl_seconds", Message: "out of range"}},
+            })
+            return
+        }
+
+        principal := principalFrom(r.Context())
+        now := time.Now()
+        c, ok := cs.Get(contextOwner(principal), mux.Vars(r)["id"], now)
+        if !ok {
+            writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Conversation not found")
+            return
+        }
+
+        expires := now.Add(ttl).Truncate(time.Second)
+        generation := cs.ShareGeneration(c)
+        metrics.Inc("share_links_created_total")
+        requestRecordFrom(r.Context()).Policy("share link created for conversation %s, expires %s", c.ID, expires.Format(time.RFC3339))
+        logInfof(r.Context(), "Audit: key %s shared conversation %s until %s (share generation %d)",
+            principal.KeyID, c.ID, expires.Format(time.RFC3339), generation)
+
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(ShareLink{
+            URL:       cfg.BaseURL + "/shared/" + shareToken(cfg.Secret, c.ID, expires, generation),
+            ExpiresAt: expires,
+        })
+    }
+}
+
+// revokeSharesHandler invalidates every link created so far for a conversation
+func revokeSharesHandler(cs *ConversationStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        principal := principalFrom(r.Context())
+        c, ok := cs.Get(contextOwner(principal), mux.Vars(r)["id"], time.Now())
+        if !ok {
+            writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Conversation not found")
+            return
+        }
+        generation := cs.RevokeShares(c)
+        metrics.Inc("share_links_revoked_total")
+        requestRecordFrom(r.Context()).Policy("share links revoked for conversation %s", c.ID)
+        logInfof(r.Context(), "Audit: key %s revoked share links for conversation %s (share generation now %d)", principal.KeyID, c.ID, generation)
+        w.WriteHeader(http.StatusNoContent)
+    }
+}
+
+// sharedTranscriptHandler serves GET /shared/{token} without an API key.
+// Every failure is the same 404, so tokens and conversation IDs can't be
+// probed.
+func sharedTranscriptHandler(cs *ConversationStore, cfg ShareConfig) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        format, ok := negotiate(r.Header.Get("Accept"), sharedTranscriptFormats)
+        if !ok {
+            notAcceptable(w, r, sharedTranscriptFormats)
+            return
+        }
+
+        now := time.Now()
+        transcript, ok := SharedTranscript{}, false
+        if id, generation, expires, valid := parseShareToken(cfg.Secret, mux.Vars(r)["token"], now); valid {
+            transcript, ok = cs.Shared(id, generation, now)
+            transcript.ExpiresAt = expires
+        }
+        if !ok {
+            metrics.Inc("shared_transcript_views_total", "outcome", "not_found")
+            writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Shared transcript not found")
+            return
+        }
+        metrics.Inc("shared_transcript_views_total", "outcome", "ok")
+
+        // Links get pasted into tickets and chats; keep them out of caches and indexes
+        w.Header().Set("Cache-Control", "no-store")
+        w.Header().Set("X-Robots-Tag", "noindex")
+        if format == mimeMarkdown {
+            w.Header().Set("Content-Type", mimeMarkdown+"; charset=utf-8")
+            io.WriteString(w, transcript.markdown())
+            return
+        }
+        writeJSON(w, r, transcript)
+    }
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+const testShareSecret = "share-secret"
+
+// shareTest serves the share routes over one conversation owned by tenant
+// "acme"
+type shareTest struct {
+    cs     *ConversationStore
+    conv   *Conversation
+    router *mux.Router
+    owner  *Principal
+}
+
+func newShareTest(t *testing.T) *shareTest {
+    t.Helper()
+    cfg := ShareConfig{Secret: testShareSecret, DefaultTTL: time.Hour, MaxTTL: 24 * time.Hour}
+    cs := NewConversationStore(ConversationConfig{MaxPerOwner: 10, IdleTTL: time.Hour})
+    owner := &Principal{KeyID: "key-1", Tenant: "acme"}
+    conv := &Conversation{Owner: contextOwner(owner)}
+    if err := cs.Create(conv, time.Now()); err != nil {
+        t.Fatal(err)
+    }
+    conv.messages = []ChatMessage{
+        {Role: roleUser, Content: "My email is jane@example.com, card 4111111111111111"},
+        {Role: roleAssistant, Content: "Thanks, noted."},
+    }
+
+    router := mux.NewRouter()
+    router.HandleFunc("/conversations/{id}/share", createShareHandler(cs, cfg)).Methods("POST")
+    router.HandleFunc("/conversations/{id}/share", revokeSharesHandler(cs)).Methods("DELETE")
+    router.HandleFunc("/shared/{token}", sharedTranscriptHandler(cs, cfg)).Methods("GET")
+    return &shareTest{cs: cs, conv: conv, router: router, owner: owner}
+}
+
+func (st *shareTest) serve(r *http.Request) *httptest.ResponseRecorder {
+    rec := httptest.NewRecorder()
+    st.router.ServeHTTP(rec, r)
+    return rec
+}
+
+// share creates a link as p and returns its token
+func (st *shareTest) share(t *testing.T, p *Principal, body string) (*httptest.ResponseRecorder, string) {
+    t.Helper()
+    rec := st.serve(withPrincipal(httptest.NewRequest(http.MethodPost, "/conversations/"+st.conv.ID+"/share", strings.NewReader(body)), p))
+    if rec.Code != http.StatusCreated {
+        return rec, ""
+    }
+    var link ShareLink
+    if err := json.Unmarshal(rec.Body.Bytes(), &link); err != nil {
+        t.Fatal(err)
+    }
+    return rec, strings.TrimPrefix(link.URL, "/shared/")
+}
+
+// view fetches a shared transcript without any principal
+func (st *shareTest) view(token, accept string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(http.MethodGet, "/shared/"+token, nil)
+    if accept != "" {
+        r.Header.Set("Accept", accept)
+    }
+    return st.serve(r)
+}
+
+func TestShareLink(t *testing.T) {
+    st := newShareTest(t)
+
+    rec, token := st.share(t, st.owner, `{"ttl_seconds":600}`)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("create: status %d: %s", rec.Code, rec.Body)
+    }
+    var link ShareLink
+    json.Unmarshal(rec.Body.Bytes(), &link)
+    if until := time.Until(link.ExpiresAt); until < 590*time.Second || until > 600*time.Second {
+        t.Errorf("expires in %s, want ten minutes", until)
+    }
+
+    view := st.view(token, "")
+    if view.Code != http.StatusOK {
+        t.Fatalf("view: status %d: %s", view.Code, view.Body)
+    }
+    if view.Header().Get("Cache-Control") != "no-store" || view.Header().Get("X-Robots-Tag") != "noindex" {
+        t.Errorf("headers %v, want it kept out of caches and indexes", view.Header())
+    }
+    var transcript SharedTranscript
+    if err := json.Unmarshal(view.Body.Bytes(), &transcript); err != nil {
+        t.Fatal(err)
+    }
+    if transcript.ConversationID != st.conv.ID || len(transcript.Messages) != 2 || !transcript.ExpiresAt.Equal(link.ExpiresAt) {
+        t.Fatalf("transcript %+v", transcript)
+    }
+    if first := transcript.Messages[0].Content; strings.Contains(first, "jane@example.com") || strings.Contains(first, "4111") {
+        t.Errorf("transcript not redacted: %q", first)
+    }
+    if strings.Contains(view.Body.String(), "token") || strings.Contains(view.Body.String(), "acme") {
+        t.Errorf("transcript shows more than the messages: %s", view.Body)
+    }
+
+    markdown := st.view(token, mimeMarkdown)
+    if markdown.Code != http.StatusOK || !strings.HasPrefix(markdown.Header().Get("Content-Type"), mimeMarkdown) ||
+        !strings.Contains(markdown.Body.String(), "**Assistant:**\n\nThanks, noted.") {
+        t.Errorf("markdown: status %d, %s", markdown.Code, markdown.Body)
+    }
+    if rec := st.view(token, "image/png"); rec.Code != http.StatusNotAcceptable {
+        t.Errorf("status %d for an unservable Accept, want 406", rec.Code)
+    }
+}
+
+func TestShareLinkRejected(t *testing.T) {
+    st := newShareTest(t)
+    _, token := st.share(t, st.owner, "")
+    parts := strings.Split(token, ".")
+    expires, _ := strconv.ParseInt(parts[1], 10, 64)
+
+    for _, c := range []struct {
+        name  string
+        token string
+    }{
+        {"expired", shareToken(testShareSecret, st.conv.ID, time.Now().Add(-time.Second), 0)},
+        {"other secret", shareToken("other-secret", st.conv.ID, time.Unix(expires, 0), 0)},
+        {"extended expiry", strings.Join([]string{parts[0], strconv.FormatInt(expires+3600, 10), parts[2], parts[3]}, ".")},
+        {"other conversation", strings.Join([]string{"conv_other", parts[1], parts[2], parts[3]}, ".")},
+        {"later generation", strings.Join([]string{parts[0], parts[1], "1", parts[3]}, ".")},
+        {"flipped signature", token[:len(token)-1] + string(token[len(token)-1]^1)},
+        {"no signature", strings.Join(parts[:3], ".")},
+        {"extra part", token + ".x"},
+        {"garbage", "not-a-token"},
+        // Signed properly, but for a conversation that doesn't exist
+        {"unknown conversation", shareToken(testShareSecret, "conv_missing", time.Unix(expires, 0), 0)},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            rec := st.view(c.token, "")
+            if rec.Code != http.StatusNotFound {
+                t.Fatalf("status %d: %s", rec.Code, rec.Body)
+            }
+            if strings.Contains(rec.Body.String(), "Thanks") {
+                t.Errorf("the 404 shows the transcript: %s", rec.Body)
+            }
+        })
+    }
+
+    // Every failure reads the same, so tokens can't be probed
+    expired, tampered := st.view(shareToken(testShareSecret, st.conv.ID, time.Now().Add(-time.Second), 0), ""), st.view(token+"x", "")
+    if expired.Body.String() != tampered.Body.String() {
+        t.Errorf("expired %s and tampered %s read differently", expired.Body, tampered.Body)
+    }
+}
+
+func TestShareLinkRevoked(t *testing.T) {
+    st := newShareTest(t)
+    _, first := st.share(t, st.owner, "")
+    _, second := st.share(t, st.owner, "")
+
+    // Another tenant can neither revoke nor share the conversation
+    other := &Principal{KeyID: "key-2", Tenant: "globex"}
+    if rec := st.serve(withPrincipal(httptest.NewRequest(http.MethodDelete, "/conversations/"+st.conv.ID+"/share", nil), other)); rec.Code != http.StatusNotFound {
+        t.Errorf("other tenant's revoke: status %d", rec.Code)
+    }
+    if rec, _ := st.share(t, other, ""); rec.Code != http.StatusNotFound {
+        t.Errorf("other tenant's share: status %d", rec.Code)
+    }
+    if rec := st.view(first, ""); rec.Code != http.StatusOK {
+        t.Fatalf("status %d before the revoke", rec.Code)
+    }
+
+    rec := st.serve(withPrincipal(httptest.NewRequest(http.MethodDelete, "/conversations/"+st.conv.ID+"/share", nil), st.owner))
+    if rec.Code != http.StatusNoContent {
+        t.Fatalf("revoke: status %d", rec.Code)
+    }
+    for _, token := range []string{first, second} {
+        if rec := st.view(token, ""); rec.Code != http.StatusNotFound {
+            t.Errorf("revoked link: status %d", rec.Code)
+        }
+    }
+
+    // Links created after the revoke work
+    _, third := st.share(t, st.owner, "")
+    if rec := st.view(third, ""); rec.Code != http.StatusOK {
+        t.Errorf("new link after the revoke: status %d", rec.Code)
+    }
+}
+
+func TestShareLinkTTL(t *testing.T) {
+    st := newShareTest(t)
+    for _, body := range []string{`{"ttl_seconds":-5}`, `{"ttl_seconds":86401}`, `{"ttl_seconds":"soon"}`} {
+        rec, _ := st.share(t, st.owner, body)
+        if rec.Code != http.StatusBadRequest {
+            t.Errorf("%s: status %d", body, rec.Code)
+        }
+    }
+    rec, _ := st.share(t, st.owner, "")
+    var link ShareLink
+    json.Unmarshal(rec.Body.Bytes(), &link)
+    if until := time.Until(link.ExpiresAt); until < 59*time.Minute || until > time.Hour {
+        t.Errorf("default link expires in %s, want an hour", until)
+    }
+
+    // An idle conversation takes its links with it
+    st.cs.mu.Lock()
+    st.conv.lastActive = time.Now().Add(-2 * time.Hour)
+    st.cs.mu.Unlock()
+    if rec := st.view(strings.TrimPrefix(link.URL, "/shared/"), ""); rec.Code != http.StatusNotFound {
+        t.Errorf("link to an expired conversation: status %d", rec.Code)
+    }
+}
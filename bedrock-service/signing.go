@@ -0,0 +1,198 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Request signing headers. Keys with a signing_secret must send all three;
+// X-Signature is the hex HMAC-SHA256 of signaturePayload under the secret.
+const (
+    headerTimestamp = "X-Timestamp" // Unix seconds
+    headerNonce     = "X-Nonce"     // Unique per request and key, at most maxNonceLength bytes
+    headerSignature = "X-Signature"
+)
+
+const maxNonceLength = 128
+
+// SigningConfig bounds how long a signed request stays valid
+type SigningConfig struct {
+    Window    time.Duration // Accepted clock skew either way; nonces are remembered this long past their timestamp
+    MaxNonces int           // Nonces remembered at once, across all keys
+}
+
+// LoadSigningConfig reads SIGNATURE_WINDOW_SECONDS (default 300) and
+// NONCE_STORE_MAX (default 100000)
+func LoadSigningConfig() (SigningConfig, error) {
+    cfg := SigningConfig{Window: 5 * time.Minute, MaxNonces: 100000}
+    if v := os.Getenv("SIGNATURE_WINDOW_SECONDS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return cfg, fmt.Errorf("invalid SIGNATURE_WINDOW_SECONDS %q", v)
+        }
+        cfg.Window = time.Duration(n) * time.Second
+    }
+    if v := os.Getenv("NONCE_STORE_MAX"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return cfg, fmt.Errorf("invalid NONCE_STORE_MAX %q", v)
+        }
+        cfg.MaxNonces = n
+    }
+    return cfg, nil
+}
+
+// signatureTime parses X-Timestamp and checks it is within the window of
+// now. Both the signature check and nonce expiry go through it, so they
+// always agree on what "within the window" means.
+func (cfg SigningConfig) signatureTime(v string, now time.Time) (time.Time, error) {
+    seconds, err := strconv.ParseInt(v, 10, 64)
+    if err != nil {
+        return time.Time{}, fmt.Errorf("%s must be Unix seconds", headerTimestamp)
+    }
+    ts := time.Unix(seconds, 0)
+    if skew := now.Sub(ts); skew > cfg.Window || skew < -cfg.Window {
+        return time.Time{}, fmt.Errorf("%s is more than %s from the server clock", headerTimestamp, cfg.Window)
+    }
+    return ts, nil
+}
+
+// signaturePayload is what gets signed: the method, the request URI as the
+// service receives it, the timestamp, the nonce and the body's SHA-256
+func signaturePayload(method, uri, timestamp, nonce string, body []byte) string {
+    sum := sha256.Sum256(body)
+    return method + "\n" + uri + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(sum[:])
+}
+
+func signPayload(secret, payload string) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(payload))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NonceStore remembers which nonces each key has used. Claim returns false
+// for a nonce already seen; it errors when the store can't take more.
+type NonceStore interface {
+    Claim(keyID, nonce string, expires, now time.Time) (bool, error)
+}
+
+// errNonceStoreFull is returned when every remembered nonce is still live
+var errNonceStoreFull = errors.New("nonce store is full")
+
+// memoryNonceStore keeps nonces in process. A nonce is only needed until its
+// timestamp leaves the window, since the signature check rejects it after
+// that, so entries expire then and memory is bounded by the request rate
+// over one window, capped at MaxNonces.
+type memoryNonceStore struct {
+    max int
+
+    mu        sync.Mutex
+    seen      map[string]time.Time // Key ID and nonce to expiry
+    lastSweep time.Time
+}
+
+func newMemoryNonceStore(max int) *memoryNonceStore {
+    return &memoryNonceStore{max: max, seen: make(map[string]time.Time)}
+}
+
+// expireLocked drops nonces whose timestamps have left the window
+func (ns *memoryNonceStore) expireLocked(now time.Time) {
+    for key, expires := range ns.seen {
+        if now.After(expires) {
+            delete(ns.seen, key)
+        }
+    }
+    ns.lastSweep = now
+}
+
+func (ns *memoryNonceStore) Claim(keyID, nonce string, expires, now time.Time) (bool, error) {
+    ns.mu.Lock()
+    defer ns.mu.Unlock()
+
+    // Sweep at most once a second, or when full
+    if now.Sub(ns.lastSweep) > time.Second || len(ns.seen) >= ns.max {
+        ns.expireLocked(now)
+    }
+    key := keyID + "\x00" + nonce
+    if until, ok := ns.seen[key]; ok && !now.After(until) {
+        return false, nil
+    }
+    if len(ns.seen) >= ns.max {
+        return false, errNonceStoreFull
+    }
+    ns.seen[key] = expires
+    metrics.Set("nonce_store_entries", float64(len(ns.seen)))
+    return true, nil
+}
+
+// rejectSignature answers a signed request that failed verification
+func rejectSignature(w http.ResponseWriter, r *http.Request, reason, message string) {
+    metrics.Inc("signature_rejections_total", "reason", reason)
+    requestRecordFrom(r.Context()).Policy("request signature rejected: %s", reason)
+    logWarnf(r.Context(), "Rejected signed request to %s from key %s: %s", r.URL.Path, principalFrom(r.Context()).KeyID, message)
+    writeError(w, r, http.StatusUnauthorized, ErrCodeInvalidSignature, message)
+}
+
+// signatureMiddleware verifies requests from keys that have a signing
+// secret. It runs after the body is buffered, since the body is signed. A
+// nonce is only claimed once the signature checks out, so forged requests
+// can't use up a client's nonces; replays of a valid request are counted
+// apart from bad signatures, to tell attacks from client bugs.
+func signatureMiddleware(cfg SigningConfig, nonces NonceStore) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            principal := principalFrom(r.Context())
+            if principal.signingSecret == "" {
+                next.ServeHTTP(w, r)
+                return
+            }
+
+            timestamp, nonce, signature := r.Header.Get(headerTimestamp), r.Header.Get(headerNonce), r.Header.Get(headerSignature)
+            if timestamp == "" || nonce == "" || signature == "" {
+                rejectSignature(w, r, "missing", fmt.Sprintf("This key requires signed requests: send %s, %s and %s", headerTimestamp, headerNonce, headerSignature))
+                return
+            }
+            if len(nonce) > maxNonceLength {
+                rejectSignature(w, r, "malformed", fmt.Sprintf("%s must be at most %d bytes", headerNonce, maxNonceLength))
+                return
+            }
+            now := time.Now()
+            ts, err := cfg.signatureTime(timestamp, now)
+            if err != nil {
+                rejectSignature(w, r, "timestamp", err.Error())
+                return
+            }
+
+            expected := signPayload(principal.signingSecret, signaturePayload(r.Method, r.URL.RequestURI(), timestamp, nonce, requestBody(r)))
+            if !hmac.Equal([]byte(signature), []byte(expected)) {
+                rejectSignature(w, r, "invalid", "Request signature does not match")
+                return
+            }
+
+            fresh, err := nonces.Claim(principal.KeyID, nonce, ts.Add(cfg.Window), now)
+            if err != nil {
+                metrics.Inc("signature_rejections_total", "reason", "nonce_store_full")
+                logWarnf(r.Context(), "Rejected signed request from key %s: %v", principal.KeyID, err)
+                w.Header().Set("Retry-After", "1")
+                writeError(w, r, http.StatusServiceUnavailable, ErrCodeRateLimited, "Too many signed requests in the replay window; retry shortly")
+                return
+            }
+            if !fresh {
+                metrics.Inc("replay_rejections_total")
+                requestRecordFrom(r.Context()).Policy("replayed nonce rejected")
+                logWarnf(r.Context(), "Rejected replayed request to %s from key %s", r.URL.Path, principal.KeyID)
+                writeError(w, r, http.StatusUnauthorized, ErrCodeReplayedRequest, fmt.Sprintf("%s was already used; send a new nonce with every request", headerNonce))
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
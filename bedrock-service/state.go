@@ -0,0 +1,78 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+)
+
+// Small helpers for stores that persist JSON snapshots across restarts
+
+// loadState reads a snapshot written by saveState. A missing file is not an
+// error; v is left untouched. With encryption enabled, plaintext and
+// undecryptable files are refused rather than treated as empty, and files
+// sealed under an old master key are rewritten under the current one.
+func loadState(path string, v interface{}) error {
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    switch {
+    case stateEncryption == nil && isEnvelope(data):
+        return fmt.Errorf("state file %s is encrypted; set STATE_ENCRYPTION_KEY or KMS_KEY_ID", path)
+    case stateEncryption != nil && !isEnvelope(data):
+        return fmt.Errorf("state file %s is not encrypted; remove it or disable state encryption", path)
+    case stateEncryption != nil:
+        plaintext, stale, err := stateEncryption.Open(context.TODO(), filepath.Base(path), data)
+        if err != nil {
+            return fmt.Errorf("state file %s: %w", path, err)
+        }
+        data = plaintext
+        if stale {
+            if err := saveState(path, json.RawMessage(data)); err != nil {
+                return fmt.Errorf("error re-encrypting state file %s: %v", path, err)
+            }
+            log.Printf("Re-encrypted state file %s under the current master key", path)
+        }
+    }
+
+    if err := json.Unmarshal(data, v); err != nil {
+        return fmt.Errorf("invalid state file %s: %v", path, err)
+    }
+    return nil
+}
+
+// saveState writes v atomically so a crash mid-write never leaves a
+// truncated snapshot behind
+func saveState(path string, v interface{}) error {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    if stateEncryption != nil {
+        if data, err = stateEncryption.Seal(context.TODO(), filepath.Base(path), data); err != nil {
+            return err
+        }
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "html/template"
+    "net/http"
+    "runtime"
+    "runtime/debug"
+    "sort"
+    "time"
+)
+
+// statusRefreshSeconds is how often the status page reloads itself
+const statusRefreshSeconds = 15
+
+// processStarted is when the service started, for the status page's uptime
+var processStarted = time.Now()
+
+// StatusFlag is one configuration switch shown on the status page
+type StatusFlag struct {
+    Name  string
+    Value string
+}
+
+// ModelStatus is one row of the status page's model table. Attempt counts
+// and latencies cover the requests still in the request log.
+type ModelStatus struct {
+    ID          string
+    Name        string
+    Available   bool
+    ProbeStatus string
+    Attempts    int
+    Errors      int
+    P50Ms       int64
+    P95Ms       int64
+}
+
+// ErrorClassCount is how often an error class was seen in recent requests
+type ErrorClassCount struct {
+    Class       string
+    Count       int
+    Remediation string
+}
+
+// StatusPage is everything GET /status renders
+type StatusPage struct {
+    Generated   time.Time
+    Refresh     int
+    Grade       string // healthy, degraded or down, as on /health
+    Reasons     []string
+    Version     string
+    Revision    string
+    GoVersion   string
+    Started     time.Time
+    Uptime      time.Duration
+    Models      []ModelStatus
+    Load        LoadSnapshot
+    Streams     StreamStats
+    SafeMode    SafeModeStatus
+    Requests    int       // Requests in the request log
+    Since       time.Time // Oldest of them
+    Failed      int
+    Errors      []ErrorClassCount
+    Flags       []StatusFlag
+    Experiments []ExperimentState
+}
+
+// buildRevision is the VCS revision the binary was built from, when known
+func buildRevision() string {
+    info, ok := debug.ReadBuildInfo()
+    if !ok {
+        return ""
+    }
+    for _, setting := range info.Settings {
+        if setting.Key == "vcs.revision" {
+            return setting.Value
+        }
+    }
+    return ""
+}
+
+// percentileMs returns the p-th percentile of sorted durations in milliseconds
+func percentileMs(sorted []int64, p float64) int64 {
+    if len(sorted) == 0 {
+        return 0
+    }
+    i := int(p*float64(len(sorted))+0.5) - 1
+    if i < 0 {
+        i = 0
+    } else if i >= len(sorted) {
+        i = len(sorted) - 1
+    }
+    return sorted[i]
+}
+
+// buildStatusPage gathers the page from the same sources as the JSON
+// endpoints. It only copies counters and scans the request log once.
+func buildStatusPage(bc *BedrockClient, requestLog *RequestLog, streams *StreamLimiter, experiments *Experiments, flags []StatusFlag, now time.Time) StatusPage {
+    page := StatusPage{
+        Generated:   now,
+        Refresh:     statusRefreshSeconds,
+        Grade:       "healthy",
+        Version:     serviceVersion,
+        Revision:    buildRevision(),
+        GoVersion:   runtime.Version(),
+        Started:     processStarted,
+        Uptime:      now.Sub(processStarted).Round(time.Second),
+        Load:        load.Snapshot(now),
+        Streams:     streams.Stats(),
+        SafeMode:    bc.safeMode.Status(),
+        Flags:       flags,
+        Experiments: experiments.States(),
+    }
+
+    latencies := make(map[string][]int64)
+    attempts := make(map[string]int)
+    failures := make(map[string]int)
+    classes := make(map[string]int)
+    records := requestLog.Records()
+    page.Requests = len(records)
+    if len(records) > 0 {
+        page.Since = records[0].Time
+    }
+    for _, rec := range records {
+        rec.mu.Lock()
+        if rec.Status >= 400 {
+            page.Failed++
+        }
+        if rec.ErrorCode != "" {
+            classes[rec.ErrorCode]++
+        }
+        for _, attempt := range rec.Attempts {
+            attempts[attempt.Model]++
+            latencies[attempt.Model] = append(latencies[attempt.Model], attempt.DurationMs)
+            if attempt.ErrorClass != "" {
+                failures[attempt.Model]++
+                classes[attempt.ErrorClass]++
+            }
+        }
+        rec.mu.Unlock()
+    }
+
+    available := 0
+    for _, model := range bc.models() {
+        sorted := latencies[model.ID]
+        sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+        page.Models = append(page.Models, ModelStatus{
+            ID:          model.ID,
+            Name:        model.Name,
+            Available:   model.selectable(),
+            ProbeStatus: model.ProbeStatus,
+            Attempts:    attempts[model.ID],
+            Errors:      failures[model.ID],
+            P50Ms:       percentileMs(sorted, 0.50),
+            P95Ms:       percentileMs(sorted, 0.95),
+        })
+        if model.selectable() {
+            available++
+        }
+    }
+
+    for class, count := range classes {
+        page.Errors = append(page.Errors, ErrorClassCount{Class: class, Count: count, Remediation: remediationFor(class)})
+    }
+    sort.Slice(page.Errors, func(a, b int) bool {
+        if page.Errors[a].Count != page.Errors[b].Count {
+            return page.Errors[a].Count > page.Errors[b].Count
+        }
+        return page.Errors[a].Class < page.Errors[b].Class
+    })
+
+    if available == 0 {
+        page.Grade = "down"
+        page.Reasons = append(page.Reasons, "no models are available")
+    }
+    if page.SafeMode.Active {
+        page.Reasons = append(page.Reasons, "safe mode is active: "+page.SafeMode.Reason)
+    }
+    if page.Load.ShedRate > 0 {
+        page.Reasons = append(page.Reasons, fmt.Sprintf("shedding %.1f%% of requests", page.Load.ShedRate*100))
+    }
+    if page.Grade == "healthy" && len(page.Reasons) > 0 {
+        page.Grade = "degraded"
+    }
+    return page
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+    "pct":  func(f float64) string { return fmt.Sprintf("%.1f%%", f*100) },
+    "when": func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+    "ms":   func(d time.Duration) int64 { return d.Milliseconds() },
+}).Parse(statusHTML))
+
+// statusHandler serves GET /status, a read-only HTML dashboard for operators
+func statusHandler(bc *BedrockClient, requestLog *RequestLog, streams *StreamLimiter, experiments *Experiments, flags []StatusFlag) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        page := buildStatusPage(bc, requestLog, streams, experiments, flags, time.Now())
+
+        var buf bytes.Buffer
+        if err := statusTemplate.Execute(&buf, page); err != nil {
+            logErrorf(r.Context(), "Internal error: rendering status page: %v", err)
+            writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, "Error rendering status page")
+            return
+        }
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        w.Header().Set("Cache-Control", "no-store")
+        w.Write(buf.Bytes())
+    }
+}
+
+const statusHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>bedrock-service: {{.Grade}}</title>
+<style>
+body { font-family: sans-serif; margin: 1.5em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.6em; text-align: left; }
+th { background: #f2f2f2; }
+.healthy { color: #17692c; } .degraded { color: #9a6700; } .down { color: #b00020; }
+.muted { color: #777; }
+</style>
+</head>
+<body>
+<h1>bedrock-service <span class="{{.Grade}}">{{.Grade}}</span></h1>
+{{if .Reasons}}<ul>{{range .Reasons}}<li>{{.}}</li>{{end}}</ul>{{end}}
+<p class="muted">Generated {{when .Generated}}; refreshes every {{.Refresh}}s.</p>
+
+<h2>Models</h2>
+<table>
+<tr><th>Model</th><th>ID</th><th>Available</th><th>Probe</th><th>Attempts</th><th>Errors</th><th>p50 ms</th><th>p95 ms</th></tr>
+{{range .Models}}<tr><td>{{.Name}}</td><td>{{.ID}}</td><td>{{if .Available}}yes{{else}}no{{end}}</td><td>{{.ProbeStatus}}</td><td>{{.Attempts}}</td><td>{{.Errors}}</td><td>{{.P50Ms}}</td><td>{{.P95Ms}}</td></tr>
+{{end}}</table>
+
+<h2>Load</h2>
+<table>
+<tr><th>Invocations in flight</th><td>{{.Load.InFlight}}</td></tr>
+<tr><th>Queue depth</th><td>{{.Load.QueueDepth}}</td></tr>
+<tr><th>Queue wait p95</th><td>{{ms .Load.QueueWaitP95}} ms</td></tr>
+<tr><th>Shed rate</th><td>{{pct .Load.ShedRate}}</td></tr>
+<tr><th>Open streams</th><td>{{.Streams.Open}} (limits: {{.Streams.MaxPerKey}} per key, {{.Streams.MaxGlobal}} total)</td></tr>
+<tr><th>Safe mode</th><td>{{if .SafeMode.Active}}active{{if .SafeMode.Forced}} (forced){{end}}{{else}}inactive{{end}}; error rate {{pct .SafeMode.ErrorRate}} over {{.SafeMode.Window}}</td></tr>
+</table>
+
+<h2>Recent errors</h2>
+{{if .Requests}}<p>{{.Failed}} of {{.Requests}} requests failed since {{when .Since}}.</p>{{else}}<p class="muted">No requests recorded.</p>{{end}}
+{{if .Errors}}<table>
+<tr><th>Class</th><th>Count</th><th>Remediation</th></tr>
+{{range .Errors}}<tr><td>{{.Class}}</td><td>{{.Count}}</td><td>{{.Remediation}}</td></tr>
+{{end}}</table>{{end}}
+
+<h2>Configuration</h2>
+<table>
+{{range .Flags}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>
+{{end}}</table>
+
+<h2>Experiments</h2>
+{{if .Experiments}}<table>
+<tr><th>Name</th><th>Enabled</th><th>Traffic</th><th>Variants</th></tr>
+{{range .Experiments}}<tr><td>{{.Name}}</td><td>{{if .Enabled}}yes{{else}}no{{end}}</td><td>{{pct .Traffic}}</td><td>{{range $i, $v := .Variants}}{{if $i}}, {{end}}{{$v}}{{end}}</td></tr>
+{{end}}</table>{{else}}<p class="muted">No experiments configured.</p>{{end}}
+
+<h2>Version</h2>
+<table>
+<tr><th>Version</th><td>{{.Version}}</td></tr>
+{{if .Revision}}<tr><th>Revision</th><td>{{.Revision}}</td></tr>{{end}}
+<tr><th>Go</th><td>{{.GoVersion}}</td></tr>
+<tr><th>Started</th><td>{{when .Started}} (up {{.Uptime}})</td></tr>
+</table>
+</body>
+</html>
+`
@@ -0,0 +1,137 @@
+package main
+
+import (
+    "bytes"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// goldenStatusPage fills every section of the page, with values that have
+// to be escaped where a model, flag or error could put them
+func goldenStatusPage() StatusPage {
+    started := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+    generated := started.Add(26*time.Hour + 3*time.Minute + 4*time.Second)
+    safeSince := generated.Add(-5 * time.Minute)
+    return StatusPage{
+        Generated: generated,
+        Refresh:   statusRefreshSeconds,
+        Grade:     "degraded",
+        Reasons:   []string{"safe mode is active: error rate 41.0% over 5m0s", "shedding 2.5% of requests"},
+        Version:   "1.4.0",
+        Revision:  "0123456789abcdef",
+        GoVersion: "go1.22.4",
+        Started:   started,
+        Uptime:    generated.Sub(started),
+        Models: []ModelStatus{
+            {ID: "anthropic.claude-3-haiku-20240307-v1:0", Name: "Claude 3 Haiku", Available: true, ProbeStatus: "ok", Attempts: 120, Errors: 3, P50Ms: 640, P95Ms: 2100},
+            {ID: "meta.llama3-70b-instruct-v1:0", Name: "Llama <3> & friends", ProbeStatus: "AccessDeniedException"},
+        },
+        Load:     LoadSnapshot{InFlight: 4, QueueDepth: 2, QueueWaitP95: 1500 * time.Millisecond, ShedRate: 0.025},
+        Streams:  StreamStats{Open: 3, MaxPerKey: 5, MaxGlobal: 100},
+        SafeMode: SafeModeStatus{Active: true, Since: &safeSince, Reason: "error rate 41.0% over 5m0s", ErrorRate: 0.41, Window: "5m0s"},
+        Requests: 200,
+        Since:    started.Add(25 * time.Hour),
+        Failed:   9,
+        Errors: []ErrorClassCount{
+            {Class: "ThrottlingException", Count: 6, Remediation: remediationFor("ThrottlingException")},
+            {Class: ErrCodeValidation, Count: 3, Remediation: remediationFor(ErrCodeValidation)},
+        },
+        Flags: []StatusFlag{{Name: "RESPONSE_CACHE_SIZE", Value: "1000"}, {Name: "LINK_FILTER", Value: `"strict"`}},
+        Experiments: []ExperimentState{
+            {Name: "haiku-first", Enabled: true, Traffic: 0.1, Variants: []string{"control", "haiku"}},
+        },
+    }
+}
+
+func TestStatusPageGolden(t *testing.T) {
+    var buf bytes.Buffer
+    if err := statusTemplate.Execute(&buf, goldenStatusPage()); err != nil {
+        t.Fatal(err)
+    }
+    path := filepath.Join("testdata", "status.golden.html")
+    if *update {
+        if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+            t.Fatal(err)
+        }
+        return
+    }
+    want, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatalf("%v; run with -update to create it", err)
+    }
+    if !bytes.Equal(buf.Bytes(), want) {
+        t.Errorf("status page differs from %s; run with -update and review the diff\n%s", path, buf.String())
+    }
+}
+
+// An empty page says so instead of rendering empty tables
+func TestStatusPageEmpty(t *testing.T) {
+    var buf bytes.Buffer
+    page := StatusPage{Generated: time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC), Refresh: statusRefreshSeconds, Grade: "down"}
+    if err := statusTemplate.Execute(&buf, page); err != nil {
+        t.Fatal(err)
+    }
+    html := buf.String()
+    for _, want := range []string{"No requests recorded.", "No experiments configured.", `<span class="down">down</span>`} {
+        if !strings.Contains(html, want) {
+            t.Errorf("empty page lacks %q", want)
+        }
+    }
+    if strings.Contains(html, "<th>Class</th>") || strings.Contains(html, "<th>Revision</th>") {
+        t.Errorf("empty page renders the error table or revision:\n%s", html)
+    }
+}
+
+func TestPercentileMs(t *testing.T) {
+    sorted := []int64{10, 20, 30, 40, 50, 60, 70, 80, 90, 100}
+    for _, c := range []struct {
+        p    float64
+        want int64
+    }{{0.50, 50}, {0.95, 100}, {0, 10}, {1, 100}} {
+        if got := percentileMs(sorted, c.p); got != c.want {
+            t.Errorf("percentileMs(p=%g) = %d, want %d", c.p, got, c.want)
+        }
+    }
+    if got := percentileMs(nil, 0.5); got != 0 {
+        t.Errorf("percentileMs of nothing = %d", got)
+    }
+}
+
+func TestE2EStatus(t *testing.T) {
+    t.Setenv("ADMIN_TOKEN", "status-admin")
+
+    resp, err := http.Get(serviceURL + "/status")
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusUnauthorized {
+        t.Errorf("without the token: status %d, want 401", resp.StatusCode)
+    }
+
+    req, _ := http.NewRequest(http.MethodGet, serviceURL+"/status", nil)
+    req.Header.Set("Authorization", "Bearer status-admin")
+    resp, err = http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var body bytes.Buffer
+    body.ReadFrom(resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("status %d: %s", resp.StatusCode, body.String())
+    }
+    if got := resp.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+        t.Errorf("content type %q", got)
+    }
+    if got := resp.Header.Get("Cache-Control"); got != "no-store" {
+        t.Errorf("cache control %q", got)
+    }
+    if !strings.Contains(body.String(), "<td>anthropic.claude-3-haiku-20240307-v1:0</td>") {
+        t.Errorf("page has no row for a registered model:\n%s", body.String())
+    }
+}
@@ -0,0 +1,920 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+    "unicode/utf8"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// streamEvent is one Server-Sent Event sent to the client
+type streamEvent struct {
+    Name string
+    Data interface{}
+}
+
+// Event payloads
+type textDeltaEvent struct {
+    Text string `json:"text"`
+}
+
+type toolCallStartEvent struct {
+    Index int    `json:"index"`
+    ID    string `json:"id"`
+    Name  string `json:"name"`
+}
+
+type toolCallDeltaEvent struct {
+    Index       int    `json:"index"`
+    PartialJSON string `json:"partial_json"`
+}
+
+type toolCallEndEvent struct {
+    Index int             `json:"index"`
+    ID    string          `json:"id"`
+    Name  string          `json:"name"`
+    Input json.RawMessage `json:"input"`
+}
+
+type streamDoneEvent struct {
+    ModelUsed       string          `json:"model_used"`
+    ModelID         string          `json:"model_id,omitempty"`
+    ModelAlias      string          `json:"model_alias,omitempty"` // The alias the request named, which resolved to model_id
+    StopReason      string          `json:"stop_reason,omitempty"` // Deprecated: same as finish_reason_raw
+    FinishReason    string          `json:"finish_reason,omitempty"`
+    FinishReasonRaw string          `json:"finish_reason_raw,omitempty"`
+    StopSequence    string          `json:"stop_sequence,omitempty"` // Which of stop_sequences ended generation
+    InputTokens     int             `json:"input_tokens,omitempty"`
+    OutputTokens    int             `json:"output_tokens,omitempty"`
+    FooterApplied   bool            `json:"footer_applied,omitempty"`
+    Filtered        bool            `json:"filtered,omitempty"`
+    FilterCategory  string          `json:"filter_category,omitempty"`
+    Refused         bool            `json:"refused,omitempty"` // Text already sent is never replaced
+    RefusalCategory string          `json:"refusal_category,omitempty"`
+    Mocked          bool            `json:"mocked,omitempty"`
+    Sampling        *SamplingParams `json:"sampling,omitempty"` // As sent to Bedrock
+    Buffered        bool            `json:"buffered,omitempty"` // Legacy model: the completion was sent once it was complete
+    Adaptations     []string        `json:"adaptations,omitempty"` // Prompt rewrites for a fallback from another provider
+    Retries         int             `json:"retries,omitempty"`     // Backoff retries after throttles and model failures
+    Documents       string          `json:"documents,omitempty"`   // How the model got the request's documents: native or text_extraction
+    Warnings        []string        `json:"warnings,omitempty"` // Parameters that were overridden, see params.go
+
+    GuardrailIntervened bool `json:"guardrail_intervened,omitempty"` // The text already sent is what the guardrail let through
+}
+
+type streamErrorEvent struct {
+    Error        string `json:"error"`
+    Code         string `json:"code,omitempty"`          // An error code, as in the error envelope
+    FinishReason string `json:"finish_reason,omitempty"` // error or deadline
+}
+
+// streamChunk is the subset of the Anthropic messages stream event format we use
+type streamChunk struct {
+    Type         string `json:"type"`
+    Index        int    `json:"index"`
+
+    // Set on the last chunk when a guardrail intervened
+    GuardrailAction string `json:"amazon-bedrock-guardrailAction"`
+
+    ContentBlock *struct {
+        Type string `json:"type"`
+        ID   string `json:"id"`
+        Name string `json:"name"`
+    } `json:"content_block"`
+    Delta *struct {
+        Type         string `json:"type"`
+        Text         string `json:"text"`
+        PartialJSON  string `json:"partial_json"`
+        StopReason   string `json:"stop_reason"`
+        StopSequence string `json:"stop_sequence"`
+    } `json:"delta"`
+    Message *struct {
+        Usage struct {
+            InputTokens int `json:"input_tokens"`
+        } `json:"usage"`
+    } `json:"message"`
+    Usage *struct {
+        OutputTokens int `json:"output_tokens"`
+    } `json:"usage"`
+}
+
+// toolBlock buffers the partial JSON input of an open tool_use content block
+type toolBlock struct {
+    ID    string
+    Name  string
+    input strings.Builder
+}
+
+// streamParser turns Anthropic stream chunks into client events. Text deltas
+// pass straight through; tool_use blocks are surfaced as tool_call_start,
+// tool_call_delta (the raw partial JSON) and tool_call_end (the parsed input).
+type streamParser struct {
+    tools        map[int]*toolBlock
+    TextSeen     bool   // At least one text delta was forwarded
+    Head         string // Start of the text, enough for refusal detection
+    StopReason   string
+    StopSequence string // As reported, including ones the caller didn't ask for
+    InputTokens  int
+    OutputTokens int
+
+    GuardrailIntervened bool // The guardrail replaced or cut off the output
+}
+
+func newStreamParser() *streamParser {
+    return &streamParser{tools: make(map[int]*toolBlock)}
+}
+
+// Parse handles one chunk and returns the events to forward
+func (sp *streamParser) Parse(data []byte) ([]streamEvent, error) {
+    var chunk streamChunk
+    if err := json.Unmarshal(data, &chunk); err != nil {
+        return nil, fmt.Errorf("error parsing stream chunk: %v", err)
+    }
+
+    detectStreamDrift(providerAnthropicMessages, chunk.Type)
+    if chunk.GuardrailAction == "INTERVENED" {
+        sp.GuardrailIntervened = true
+    }
+    switch chunk.Type {
+    case "message_start":
+        if chunk.Message != nil {
+            sp.InputTokens = chunk.Message.Usage.InputTokens
+        }
+
+    case "content_block_start":
+        if chunk.ContentBlock != nil && chunk.ContentBlock.Type == "tool_use" {
+            sp.tools[chunk.Index] = &toolBlock{ID: chunk.ContentBlock.ID, Name: chunk.ContentBlock.Name}
+            return []streamEvent{{Name: "tool_call_start", Data: toolCallStartEvent{
+                Index: chunk.Index,
+                ID:    chunk.ContentBlock.ID,
+                Name:  chunk.ContentBlock.Name,
+            }}}, nil
+        }
+
+    case "content_block_delta":
+        if chunk.Delta == nil {
+            return nil, nil
+        }
+        switch chunk.Delta.Type {
+        case "text_delta":
+            sp.TextSeen = true
+            if len(sp.Head) < refusals.ScanChars*utf8.UTFMax {
+                sp.Head += chunk.Delta.Text
+            }
+            return []streamEvent{{Name: "delta", Data: textDeltaEvent{Text: chunk.Delta.Text}}}, nil
+        case "input_json_delta":
+            block, ok := sp.tools[chunk.Index]
+            if !ok {
+                return nil, fmt.Errorf("input_json_delta for unknown content block %d", chunk.Index)
+            }
+            block.input.WriteString(chunk.Delta.PartialJSON)
+            return []streamEvent{{Name: "tool_call_delta", Data: toolCallDeltaEvent{
+                Index:       chunk.Index,
+                PartialJSON: chunk.Delta.PartialJSON,
+            }}}, nil
+        }
+
+    case "content_block_stop":
+        block, ok := sp.tools[chunk.Index]
+        if !ok {
+            return nil, nil
+        }
+        delete(sp.tools, chunk.Index)
+
+        input := json.RawMessage(strings.TrimSpace(block.input.String()))
+        if len(input) == 0 {
+            input = json.RawMessage("{}") // Tools without parameters stream no input
+        }
+        if !json.Valid(input) {
+            return nil, fmt.Errorf("tool %s produced invalid JSON input", block.Name)
+        }
+        return []streamEvent{{Name: "tool_call_end", Data: toolCallEndEvent{
+            Index: chunk.Index,
+            ID:    block.ID,
+            Name:  block.Name,
+            Input: input,
+        }}}, nil
+
+    case "message_delta":
+        if chunk.Delta != nil && chunk.Delta.StopReason != "" {
+            sp.StopReason, sp.StopSequence = chunk.Delta.StopReason, chunk.Delta.StopSequence
+        }
+        if chunk.Usage != nil {
+            sp.OutputTokens = chunk.Usage.OutputTokens
+        }
+    }
+    return nil, nil
+}
+
+// eventWriter sends stream events in the negotiated wire format
+type eventWriter interface {
+    Send(event string, data interface{}) error
+}
+
+// newEventWriter starts a streaming response as SSE or NDJSON
+func newEventWriter(w http.ResponseWriter, format string) (eventWriter, error) {
+    return openEventWriter(w, format, http.StatusOK)
+}
+
+// openEventWriter starts an event stream with the given status
+func openEventWriter(w http.ResponseWriter, format string, status int) (eventWriter, error) {
+    if chat, ok := w.(*chatCompletionWriter); ok {
+        return chat.open(status), nil // A chat completion has its own wire format, see openai.go
+    }
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        return nil, fmt.Errorf("streaming not supported by this connection")
+    }
+    w.Header().Set("Content-Type", format)
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+    w.Header().Set("X-Accel-Buffering", "no")
+    w.Header().Set("Vary", "Accept")
+    w.WriteHeader(status)
+    if format == mimeNDJSON {
+        return &ndjsonWriter{w: w, flusher: flusher}, nil
+    }
+    return &sseWriter{w: w, flusher: flusher}, nil
+}
+
+// sseWriter writes Server-Sent Events, flushing after each one
+type sseWriter struct {
+    w       http.ResponseWriter
+    flusher http.Flusher
+}
+
+func (s *sseWriter) Send(event string, data interface{}) error {
+    payload, err := json.Marshal(data)
+    if err != nil {
+        return err
+    }
+    if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+        return err
+    }
+    s.flusher.Flush()
+    return nil
+}
+
+// ndjsonWriter writes one {"event": ..., "data": ...} object per line
+type ndjsonWriter struct {
+    w       http.ResponseWriter
+    flusher http.Flusher
+}
+
+func (n *ndjsonWriter) Send(event string, data interface{}) error {
+    line, err := json.Marshal(struct {
+        Event string      `json:"event"`
+        Data  interface{} `json:"data"`
+    }{event, data})
+    if err != nil {
+        return err
+    }
+    if _, err := n.w.Write(append(line, '\n')); err != nil {
+        return err
+    }
+    n.flusher.Flush()
+    return nil
+}
+
+// InvokeModelWithResponseStream starts a stream through a scheduled account,
+// moving on to other accounts and retrying when one is throttled before the
+// stream starts.
+// Token usage only arrives at the end of a stream, so the caller records it.
+func (p *AccountPool) InvokeModelWithResponseStream(ctx context.Context, origin Origin, input *bedrockruntime.InvokeModelWithResponseStreamInput) (*bedrockruntime.InvokeModelWithResponseStreamOutput, *Account, error) {
+    if err := origin.check(); err != nil {
+        return nil, nil, err
+    }
+    tried := make(map[*Account]bool)
+    retries := 0
+
+    for {
+        account := p.pick(tried)
+        if account == nil {
+            return nil, nil, fmt.Errorf("no Bedrock accounts configured")
+        }
+        tried[account] = true
+
+        started := time.Now()
+        resp, err := account.client.InvokeModelWithResponseStream(ctx, input)
+        observeInvocation(ctx, aws.ToString(input.ModelId), started, err)
+        if err == nil {
+            metrics.Inc("bedrock_account_invocations_total", "account", account.Name, "origin", string(origin), "outcome", "success")
+            metrics.Inc("bedrock_model_invocations_total", "model", aws.ToString(input.ModelId), "origin", string(origin), "outcome", "success")
+            return resp, account, nil
+        }
+
+        if p.retryAfter(ctx, origin, aws.ToString(input.ModelId), account, err, tried, &retries) {
+            continue
+        }
+        metrics.Inc("bedrock_model_invocations_total", "model", aws.ToString(input.ModelId), "origin", string(origin), "outcome", failureOutcome(err))
+        return nil, account, err
+    }
+}
+
+// validateTools checks caller-supplied tool definitions
+func validateTools(tools []ToolSpec) error {
+    seen := make(map[string]bool)
+    for i, tool := range tools {
+        if tool.Name == "" {
+            return fmt.Errorf("tools[%d]: name is required", i)
+        }
+        if seen[tool.Name] {
+            return fmt.Errorf("tools[%d]: duplicate tool name %s", i, tool.Name)
+        }
+        seen[tool.Name] = true
+        if tool.InputSchema == nil {
+            return fmt.Errorf("tools[%d] (%s): input_schema is required", i, tool.Name)
+        }
+    }
+    return nil
+}
+
+func generateStreamHandler(bc *BedrockClient, systemContext *SystemContext, contexts *ContextStore, streams *StreamLimiter) http.HandlerFunc {
+    serve := streamGeneration(bc, systemContext, contexts, streams)
+    return func(w http.ResponseWriter, r *http.Request) {
+        format, ok := negotiate(r.Header.Get("Accept"), streamFormats)
+        if !ok {
+            notAcceptable(w, r, streamFormats)
+            return
+        }
+
+        var req GenerateRequest
+
+        schemaVersion, err := decodeGenerateRequest(r, &req)
+        if err != nil {
+            status, apiErr := schemaErrorResponse(err)
+            writeAPIError(w, r, status, apiErr)
+            return
+        }
+        w.Header().Set("X-Schema-Version", schemaVersion)
+        serve(w, r, req, format)
+    }
+}
+
+// streamGeneration serves a decoded generate request as a stream of events
+// in format. POST /v1/chat/completions shares it too, see openai.go.
+func streamGeneration(bc *BedrockClient, systemContext *SystemContext, contexts *ContextStore, streams *StreamLimiter) func(w http.ResponseWriter, r *http.Request, req GenerateRequest, format string) {
+    return func(w http.ResponseWriter, r *http.Request, req GenerateRequest, format string) {
+        prompt, history, apiErr := req.turns()
+        if apiErr != nil {
+            writeAPIError(w, r, http.StatusBadRequest, *apiErr)
+            return
+        }
+        documents, apiErr := req.documents(prompt)
+        if apiErr != nil {
+            writeAPIError(w, r, http.StatusBadRequest, *apiErr)
+            return
+        }
+        if apiErr := req.checkStopSequences(); apiErr != nil {
+            writeAPIError(w, r, http.StatusBadRequest, *apiErr)
+            return
+        }
+        if apiErr := req.checkSampling(); apiErr != nil {
+            writeAPIError(w, r, http.StatusBadRequest, *apiErr)
+            return
+        }
+        if apiErr := req.checkFormat(); apiErr != nil {
+            writeAPIError(w, r, http.StatusBadRequest, *apiErr)
+            return
+        }
+        if req.VerifyNumeric {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "verify_numeric is only supported on /generate")
+            return
+        }
+        if req.TimeoutSeconds != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "timeout_seconds is only supported on /generate")
+            return
+        }
+        if req.GuardrailTrace {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "guardrail_trace is only supported on /generate")
+            return
+        }
+
+        // Tool calls arrive as their own event types, so clients must opt in
+        // rather than discover unfamiliar events halfway through a stream
+        if len(req.Tools) > 0 && !req.StreamToolEvents {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Requests with tools must set \"stream_tool_events\": true to receive tool_call events")
+            return
+        }
+        if err := validateTools(req.Tools); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, err.Error())
+            return
+        }
+        if req.ResponseFormat != nil {
+            if err := req.ResponseFormat.validate(); err != nil {
+                writeAPIError(w, r, http.StatusBadRequest, APIError{
+                    Code:    ErrCodeValidation,
+                    Message: err.Error(),
+                    Fields:  []FieldError{{Field: "response_format", Message: err.Error()}},
+                })
+                return
+            }
+        }
+
+        reqParams := resolveRequestParams(r, paramValues{Model: req.Model, Timezone: req.Timezone})
+        loc, err := systemContext.ResolveLocation(reqParams.Timezone)
+        if err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, err.Error())
+            return
+        }
+        match, apiErr := bc.checkModelPreference(reqParams.Model.Value, req.StrictModel)
+        if apiErr != nil {
+            writeAPIError(w, r, http.StatusBadRequest, *apiErr)
+            return
+        }
+        chain, apiErr := bc.resolveChain(req.Models, reqParams.Model.Value)
+        if apiErr != nil {
+            writeAPIError(w, r, http.StatusBadRequest, *apiErr)
+            return
+        }
+        guardrail, apiErr := bc.guardrail.forRequest(&req)
+        if apiErr != nil {
+            writeAPIError(w, r, http.StatusBadRequest, *apiErr)
+            return
+        }
+
+        var prefix string
+        if req.ContextID != "" {
+            var found bool
+            prefix, found = contexts.Use(contextOwner(principalFrom(r.Context())), req.ContextID, time.Now())
+            if !found {
+                writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Unknown or expired context_id")
+                return
+            }
+        }
+
+        params := GenerationParams{
+            Prompt:         prompt,
+            History:        history,
+            PromptBlocks:   req.promptBlocks(),
+            Documents:      documents,
+            PreferredModel: reqParams.Model.Value,
+            MaxTokens:      req.maxTokens(),
+            Temperature:    req.Temperature,
+            TopP:           req.TopP,
+            TopK:           req.TopK,
+            SystemPrompt:   req.System,
+            StopSequences:  req.StopSequences,
+            SystemContext:  systemContext.Lines(time.Now(), loc, !req.NoTimeContext),
+            Tools:          req.Tools,
+            ContextPrefix:  prefix,
+            PromptCache:    contexts.cfg.PromptCache,
+            Origin:         originUser,
+            NoAdaptation:   req.NoAdaptation,
+            Guardrail:      guardrail,
+        }.withDefaults()
+        if req.ResponseFormat != nil {
+            params.SystemContext = append(params.SystemContext, req.ResponseFormat.instruction())
+        }
+        if req.StrictModel {
+            params.Candidates = bc.strictCandidates(match)
+        }
+        chain.apply(&params)
+
+        mockText, mocked, err := mockResponse(r)
+        if err != nil {
+            writeError(w, r, http.StatusForbidden, ErrCodeForbidden, err.Error())
+            return
+        }
+
+        // Admission is the last check, so a stream slot is only ever held by
+        // a request that is going to stream
+        ctx, cancel := context.WithCancel(r.Context())
+        defer cancel()
+        ctx, retries := countRetries(ctx)
+        record := requestRecordFrom(r.Context())
+        open, limit := streams.Acquire(rateLimitKey(r), closeStream(w, cancel))
+        if open == nil {
+            logWarnf(r.Context(), "Rejected stream for %s: %s concurrent stream limit reached", rateLimitKey(r), limit)
+            record.Policy("%s concurrent stream limit reached", limit)
+            record.failed(APIError{Code: ErrCodeRateLimited, Message: "concurrent stream limit reached"})
+            rejectStream(w, format, limit)
+            return
+        }
+        defer streams.Release(open)
+
+        // The server's WriteTimeout would cut long streams off partway; the
+        // idle reaper bounds streams that stop making progress instead
+        if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+            logWarnf(r.Context(), "Stream for %s keeps the server write timeout: %v", rateLimitKey(r), err)
+        }
+
+        if mocked {
+            streamMock(w, r, format, mockText, params, req.ResponseFormat, req.Format == formatBlocks, reqParams.Warnings)
+            return
+        }
+
+        // The generation slot is held until the stream has been forwarded
+        ctx, leave, err := bc.gate.Enter(ctx)
+        if err != nil {
+            if isCancelled(err) {
+                return
+            }
+            metrics.Inc("generate_requests_total", "outcome", failureOutcome(err))
+            callerUsage.Record(r.Context(), "", 0, 0, true)
+            record.Policy("concurrency limit: no generation slot came free")
+            record.failed(APIError{Code: ErrCodeRateLimited, Message: "too many generations in flight"})
+            rejectSaturated(w, format)
+            return
+        }
+        defer leave()
+
+        logPrompt(r.Context(), "received streaming prompt", prompt, "model_preference", params.PreferredModel, "tools", len(req.Tools))
+
+        // Fall back between models until one starts streaming; after the
+        // first event has been sent there is no way to switch models. Legacy
+        // models can't stream, so they are invoked in their place in the
+        // chain and their completion is sent once it is complete.
+        var stream *bedrockruntime.InvokeModelWithResponseStreamOutput
+        var buffered *GenerationResult
+        var model ModelInfo
+        var streamAccount string
+        var adaptations []string
+        var documentMode string
+        var streamSpan *attemptSpan // Open until the stream ends
+        var spanAccount *Account
+        var lastError error
+        var attempted []string
+        failures := append([]ModelFailure(nil), params.Skipped...)
+        var started time.Time
+        if bc.safeMode.Active() {
+            record.Policy("safe mode: the most reliable model was tried first")
+        }
+        for _, candidate := range bc.chain(params) {
+            if params.hasImages() && !candidate.Vision {
+                if lastError == nil {
+                    lastError = errImagesUnsupported
+                }
+                failures = append(failures, ModelFailure{Model: candidate.ID, ErrorClass: errClassNotAvailable, Reason: errImagesUnsupported.Error()})
+                continue
+            }
+            if candidate.API != apiMessages {
+                if len(params.Tools) > 0 {
+                    // Legacy models can't call tools
+                    failures = append(failures, ModelFailure{Model: candidate.ID, ErrorClass: errClassNotAvailable, Reason: "can't call tools"})
+                    continue
+                }
+                attempted = append(attempted, candidate.ID)
+                single := params
+                single.Candidates, single.Skipped, single.Record = []ModelInfo{candidate}, nil, record
+                result, err := bc.Generate(ctx, single)
+                if err != nil && isCancelled(r.Context().Err()) {
+                    metrics.Inc("generate_requests_total", "outcome", "cancelled")
+                    logInfof(r.Context(), "Stream request cancelled by the client while model %s was generating", candidate.Name)
+                    return
+                }
+                var genErr *GenerationError
+                if errors.As(err, &genErr) {
+                    lastError = genErr.Err
+                    failures = append(failures, genErr.Failures...)
+                    continue
+                }
+                if err != nil {
+                    metrics.Inc("generate_requests_total", "outcome", "error")
+                    callerUsage.Record(r.Context(), "", 0, 0, true)
+                    status, apiErr := generationErrorResponse(err)
+                    writeAPIError(w, r, status, apiErr)
+                    return
+                }
+                buffered, model = result, candidate
+                break
+            }
+            started = time.Now()
+
+            // The stream goes through InvokeModel, so documents go as their text
+            attempt, applied := bc.adapt(candidate, params)
+            attempt, documentsGiven, err := attempt.withDocuments(false)
+            if err != nil {
+                if lastError == nil {
+                    lastError = err
+                }
+                failures = append(failures, ModelFailure{Model: candidate.ID, ErrorClass: errClassNotAvailable, Reason: err.Error()})
+                continue
+            }
+            bodyBytes, err := marshalRequestBody(r.Context(), candidate.ID, buildRequestBody(candidate, attempt))
+            if err != nil {
+                metrics.Inc("generate_requests_total", "outcome", "error")
+                callerUsage.Record(r.Context(), "", 0, 0, true)
+                status, apiErr := generationErrorResponse(err)
+                writeAPIError(w, r, status, apiErr)
+                return
+            }
+            if !bc.breakerAdmit(candidate.ID, started) {
+                logAttempt(r.Context(), candidate.ID, "", "breaker_open", started, nil)
+                record.Attempt(candidate.ID, "", started, "breaker_open", nil)
+                if lastError == nil {
+                    lastError = errBreakerOpen
+                }
+                failures = append(failures, modelFailure(candidate.ID, errBreakerOpen))
+                continue
+            }
+            attempted = append(attempted, candidate.ID)
+
+            // Only the start of a stream is recorded for the breaker: once
+            // it starts, the model is answering
+            input := &bedrockruntime.InvokeModelWithResponseStreamInput{
+                Body:        bodyBytes,
+                ModelId:     aws.String(candidate.invokeID()),
+                ContentType: aws.String("application/json"),
+            }
+            input.GuardrailIdentifier, input.GuardrailVersion, input.Trace = params.Guardrail.invocation()
+            attemptCtx, span := startAttempt(ctx, candidate, retries)
+            resp, account, err := bc.accounts.InvokeModelWithResponseStream(attemptCtx, params.Origin, input)
+            bc.breakerRecord(candidate.ID, err, time.Now())
+            bc.noteProfileFailure(candidate, err)
+            if err != nil && isCancelled(r.Context().Err()) {
+                metrics.Inc("generate_requests_total", "outcome", "cancelled")
+                logAttempt(r.Context(), candidate.ID, accountName(account), "cancelled", started, err)
+                record.Attempt(candidate.ID, accountName(account), started, "cancelled", err)
+                span.end(account, "cancelled", 0, 0, err)
+                return
+            }
+            if err != nil {
+                lastError = err
+                logAttempt(r.Context(), candidate.ID, accountName(account), "error", started, err)
+                record.Attempt(candidate.ID, accountName(account), started, "error", err)
+                span.end(account, "error", 0, 0, err)
+                failures = append(failures, modelFailure(candidate.ID, err))
+                continue
+            }
+            stream, model, streamAccount, adaptations, documentMode = resp, candidate, account.Name, applied, documentsGiven
+            streamSpan, spanAccount = span, account
+            if len(applied) > 0 {
+                record.Policy("prompt adapted for %s: %s", candidate.ID, strings.Join(applied, ", "))
+            }
+            break
+        }
+
+        if buffered != nil {
+            logInfof(r.Context(), "✓ Completed without streaming from legacy model: %s", model.Name)
+            record.Policy("legacy model %s does not stream: the completion was sent in one piece", model.ID)
+            metrics.Inc("generate_requests_total", "outcome", "success")
+            metrics.Inc("generate_finish_reasons_total", "model", model.ID, "finish_reason", buffered.FinishReason)
+            metrics.Inc("stream_buffered_total", "model", model.ID)
+            callerUsage.Record(r.Context(), model.ID, buffered.InputTokens, buffered.OutputTokens, false)
+            classifyRefusal(buffered)
+
+            sink, err := newEventWriter(w, format)
+            if err != nil {
+                writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+                return
+            }
+            sink = open.Watch(sink)
+            if req.ResponseFormat != nil {
+                sink = newJSONModeWriter(sink, req.ResponseFormat, cancel)
+            }
+            if req.Format == formatBlocks {
+                sink = newBlocksWriter(sink)
+            }
+            streamComplete(sink, r, buffered, bc.aliasOf(reqParams.Model.Value), req.ResponseFormat != nil, reqParams.Warnings)
+            return
+        }
+
+        if stream == nil {
+            metrics.Inc("generate_requests_total", "outcome", "error")
+            callerUsage.Record(r.Context(), "", 0, 0, true)
+            if lastError == nil {
+                lastError = fmt.Errorf("no available streaming models found")
+            }
+            logErrorf(r.Context(), "Error starting stream: %v", lastError)
+            genErr := &GenerationError{Attempted: attempted, Failures: failures, Err: lastError}
+            if req.StrictModel {
+                status, apiErr := strictErrorResponse(genErr, match)
+                writeAPIError(w, r, status, apiErr)
+                return
+            }
+            status, apiErr := modelUnavailableError(genErr)
+            writeAPIError(w, r, status, apiErr)
+            return
+        }
+
+        // The invocation stays in flight until the stream is fully forwarded
+        defer load.Begin()()
+
+        events := stream.GetStream()
+        defer events.Close()
+
+        sink, err := newEventWriter(w, format)
+        if err != nil {
+            writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+            return
+        }
+        sink = open.Watch(sink)
+        var jsonMode *jsonModeWriter
+        if req.ResponseFormat != nil {
+            jsonMode = newJSONModeWriter(sink, req.ResponseFormat, cancel)
+            sink = jsonMode
+        }
+        if req.Format == formatBlocks {
+            sink = newBlocksWriter(sink)
+        }
+
+        parser := newStreamParser()
+        attemptDone := func(outcome string, err error) {
+            logAttempt(r.Context(), model.ID, streamAccount, outcome, started, err)
+            record.Attempt(model.ID, streamAccount, started, outcome, err)
+            streamSpan.end(spanAccount, outcome, parser.InputTokens, parser.OutputTokens, err)
+        }
+        // A client that went away ends the stream without an outcome
+        defer func() { streamSpan.end(spanAccount, "cancelled", parser.InputTokens, parser.OutputTokens, nil) }()
+
+        for event := range events.Events() {
+            chunk, ok := event.(*types.ResponseStreamMemberChunk)
+            if !ok {
+                continue
+            }
+
+            out, err := parser.Parse(chunk.Value.Bytes)
+            if err != nil {
+                metrics.Inc("generate_requests_total", "outcome", "error")
+                callerUsage.Record(r.Context(), model.ID, parser.InputTokens, parser.OutputTokens, true)
+                recordInvocationTokens(params.Origin, model.ID, parser.InputTokens, parser.OutputTokens)
+                metrics.Inc("generate_finish_reasons_total", "model", model.ID, "finish_reason", finishError)
+                attemptDone("error", err)
+                sink.Send("error", streamErrorEvent{Error: "The model's stream couldn't be read", Code: ErrCodeInternal, FinishReason: finishError})
+                return
+            }
+            for _, e := range out {
+                if err := sink.Send(e.Name, e.Data); err != nil {
+                    if errors.Is(err, errJSONAborted) {
+                        // Invalid JSON is a failed generation, billed for what was produced
+                        metrics.Inc("generate_requests_total", "outcome", "error")
+                        callerUsage.Record(r.Context(), model.ID, parser.InputTokens, parser.OutputTokens, true)
+                        recordInvocationTokens(params.Origin, model.ID, parser.InputTokens, parser.OutputTokens)
+                        metrics.Inc("generate_finish_reasons_total", "model", model.ID, "finish_reason", finishError)
+                        attemptDone("error", jsonMode.Aborted())
+                        return
+                    }
+                    logInfof(r.Context(), "Client went away during stream from %s: %v", model.Name, err)
+                    return
+                }
+            }
+        }
+
+        // The client closing the connection cancels the stream; that's
+        // billed for what was produced, but it isn't a failure
+        if err := events.Err(); err != nil && isCancelled(r.Context().Err()) {
+            logInfof(r.Context(), "Client went away during stream from %s: %v", model.Name, err)
+            metrics.Inc("generate_requests_total", "outcome", "cancelled")
+            callerUsage.Record(r.Context(), model.ID, parser.InputTokens, parser.OutputTokens, false)
+            recordInvocationTokens(params.Origin, model.ID, parser.InputTokens, parser.OutputTokens)
+            attemptDone("cancelled", err)
+            return
+        }
+        if err := events.Err(); err != nil {
+            reason := streamFailureReason(r.Context(), err)
+            metrics.Inc("generate_requests_total", "outcome", "error")
+            callerUsage.Record(r.Context(), model.ID, parser.InputTokens, parser.OutputTokens, true)
+            recordInvocationTokens(params.Origin, model.ID, parser.InputTokens, parser.OutputTokens)
+            metrics.Inc("generate_finish_reasons_total", "model", model.ID, "finish_reason", reason)
+            message := "stream interrupted"
+            if open.Reaped() {
+                message = fmt.Sprintf("stream closed after %s without activity", streams.cfg.IdleTimeout)
+                record.Policy("idle stream reaped after %s", streams.cfg.IdleTimeout)
+            }
+            code := ErrCodeModelUnavailable
+            if reason == finishDeadline {
+                code = ErrCodeDeadlineExceeded
+            }
+            attemptDone("error", err)
+            sink.Send("error", streamErrorEvent{Error: message, Code: code, FinishReason: reason})
+            return
+        }
+
+        finish := normalizeFinishReason(providerAnthropicMessages, parser.StopReason)
+        category, filtered := streamStopFiltered(parser.StopReason)
+        if parser.GuardrailIntervened {
+            category, filtered = filterGuardrail, true
+        }
+        if filtered {
+            finish = finishFiltered
+            metrics.Inc("content_filtered_total", "model", model.ID, "category", category)
+            attemptDone("filtered", ErrContentFiltered)
+        } else {
+            attemptDone("success", nil)
+        }
+        refusal := refusals.Classify(category, parser.Head)
+        if refusal != "" {
+            metrics.Inc("refusals_total", "model", model.ID, "category", refusal)
+        }
+
+        // The attribution footer is the final text delta, after everything the
+        // model produced; in JSON mode it would make the output invalid
+        footerApplied := false
+        if parser.TextSeen && finish != finishFiltered && req.ResponseFormat == nil {
+            if delta, ok := footerDelta(principalFrom(r.Context()).Policy); ok {
+                sink.Send("delta", textDeltaEvent{Text: delta})
+                footerApplied = true
+            }
+        }
+
+        metrics.Inc("generate_requests_total", "outcome", "success")
+        callerUsage.Record(r.Context(), model.ID, parser.InputTokens, parser.OutputTokens, false)
+        recordInvocationTokens(params.Origin, model.ID, parser.InputTokens, parser.OutputTokens)
+        metrics.Inc("generate_finish_reasons_total", "model", model.ID, "finish_reason", finish)
+        sampling := params.withModelDefaults(model).sampling()
+        sink.Send("done", streamDoneEvent{
+            ModelUsed:       model.Name,
+            ModelID:         model.ID,
+            ModelAlias:      bc.aliasOf(reqParams.Model.Value),
+            StopReason:      parser.StopReason,
+            FinishReason:    finish,
+            FinishReasonRaw: parser.StopReason,
+            StopSequence:    matchedStopSequence(params.StopSequences, parser.StopSequence),
+            Sampling:        &sampling,
+            InputTokens:     parser.InputTokens,
+            OutputTokens:    parser.OutputTokens,
+            FooterApplied:   footerApplied,
+            Filtered:        filtered,
+            FilterCategory:  category,
+
+            GuardrailIntervened: parser.GuardrailIntervened,
+            Refused:         refusal != "",
+            RefusalCategory: refusal,
+            Adaptations:     adaptations,
+            Retries:         int(retries.Load()),
+            Documents:       documentMode,
+            Warnings:        reqParams.Warnings,
+        })
+    }
+}
+
+// streamMock sends canned X-Mock-Response text as a stream of deltas, the
+// same way a model's output would arrive, footer included
+func streamMock(w http.ResponseWriter, r *http.Request, format, text string, params GenerationParams, responseFormat *ResponseFormat, blocks bool, warnings []string) {
+    sink, err := newEventWriter(w, format)
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+        return
+    }
+    if responseFormat != nil {
+        sink = newJSONModeWriter(sink, responseFormat, func() {})
+    }
+    if blocks {
+        sink = newBlocksWriter(sink)
+    }
+    logInfof(r.Context(), "Serving mocked stream for key %s (%d bytes)", principalFrom(r.Context()).KeyID, len(text))
+    metrics.Inc("mock_requests_total", "endpoint", "generate_stream")
+
+    result := mockGeneration(text, params)
+    result.FinishReasonRaw = "end_turn"
+    classifyRefusal(result)
+    streamComplete(sink, r, result, "", responseFormat != nil, warnings)
+}
+
+// streamComplete sends a generation that is already complete as a stream of
+// deltas, footer included. Mocked responses and legacy models, which can't
+// stream, are served through it. alias is the model alias the request named,
+// if any.
+func streamComplete(sink eventWriter, r *http.Request, result *GenerationResult, alias string, jsonMode bool, warnings []string) {
+    // What a guardrail returns in place of the output is sent like it
+    guardrailIntervened := result.FilterCategory == filterGuardrail
+    if !result.Filtered || guardrailIntervened {
+        for _, delta := range mockDeltas(result.Text) {
+            if err := sink.Send("delta", textDeltaEvent{Text: delta}); err != nil {
+                return
+            }
+        }
+    }
+    footerApplied := false
+    if result.Text != "" && !result.Filtered && !jsonMode {
+        if delta, ok := footerDelta(principalFrom(r.Context()).Policy); ok {
+            sink.Send("delta", textDeltaEvent{Text: delta})
+            footerApplied = true
+        }
+    }
+
+    sink.Send("done", streamDoneEvent{
+        ModelUsed:       result.ModelName,
+        ModelID:         result.ModelID,
+        ModelAlias:      alias,
+        StopReason:      result.FinishReasonRaw,
+        FinishReason:    result.FinishReason,
+        FinishReasonRaw: result.FinishReasonRaw,
+        StopSequence:    result.StopSequence,
+        Sampling:        &result.Sampling,
+        InputTokens:     result.InputTokens,
+        OutputTokens:    result.OutputTokens,
+        FooterApplied:   footerApplied,
+        Filtered:        result.Filtered,
+        FilterCategory:  result.FilterCategory,
+        Refused:         result.Refused,
+        RefusalCategory: result.RefusalCategory,
+        Mocked:          result.Mocked,
+        Buffered:        !result.Mocked,
+        Adaptations:     result.Adaptations,
+        Retries:         result.Retries,
+        Documents:       result.Documents,
+        Warnings:        warnings,
+
+        GuardrailIntervened: guardrailIntervened,
+    })
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// idleWriteGrace is how long a reaped stream has to send its closing event
+// before pending writes to a client that stopped reading are abandoned
+const idleWriteGrace = 5 * time.Second
+
+// StreamLimitConfig bounds concurrent streaming responses
+type StreamLimitConfig struct {
+    MaxPerKey   int           // Per API key, or per client address without auth; 0 disables
+    MaxGlobal   int           // Across all callers; 0 disables
+    IdleTimeout time.Duration // Streams that send nothing for this long are closed; 0 disables
+}
+
+// LoadStreamLimitConfig reads STREAM_MAX_PER_KEY, STREAM_MAX_CONNECTIONS and
+// STREAM_IDLE_TIMEOUT_SECONDS
+func LoadStreamLimitConfig() (StreamLimitConfig, error) {
+    cfg := StreamLimitConfig{MaxPerKey: 20, MaxGlobal: 1000, IdleTimeout: 2 * time.Minute}
+    for _, setting := range []struct {
+        env string
+        dst *int
+    }{
+        {"STREAM_MAX_PER_KEY", &cfg.MaxPerKey},
+        {"STREAM_MAX_CONNECTIONS", &cfg.MaxGlobal},
+    } {
+        if v := os.Getenv(setting.env); v != "" {
+            n, err := strconv.Atoi(v)
+            if err != nil || n < 0 {
+                return cfg, fmt.Errorf("invalid %s %q", setting.env, v)
+            }
+            *setting.dst = n
+        }
+    }
+    if v := os.Getenv("STREAM_IDLE_TIMEOUT_SECONDS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            return cfg, fmt.Errorf("invalid STREAM_IDLE_TIMEOUT_SECONDS %q", v)
+        }
+        cfg.IdleTimeout = time.Duration(n) * time.Second
+    }
+    return cfg, nil
+}
+
+// openStream is one admitted streaming response
+type openStream struct {
+    key      string
+    opened   time.Time
+    lastSent atomic.Int64 // Unix nanoseconds of the last event written
+    reaped   atomic.Bool
+    close    func()
+}
+
+// Reaped reports whether the idle reaper closed the stream
+func (s *openStream) Reaped() bool {
+    return s.reaped.Load()
+}
+
+// Watch returns sink with every successful send counted as activity
+func (s *openStream) Watch(sink eventWriter) eventWriter {
+    return &activityWriter{sink: sink, stream: s}
+}
+
+type activityWriter struct {
+    sink   eventWriter
+    stream *openStream
+}
+
+func (a *activityWriter) Send(event string, data interface{}) error {
+    err := a.sink.Send(event, data)
+    if err == nil {
+        a.stream.lastSent.Store(time.Now().UnixNano())
+    }
+    return err
+}
+
+// StreamLimiter admits streaming responses up to the per-key and global
+// limits and closes the ones that go idle
+type StreamLimiter struct {
+    cfg StreamLimitConfig
+
+    mu     sync.Mutex
+    perKey map[string]int
+    open   map[*openStream]bool
+}
+
+func NewStreamLimiter(cfg StreamLimitConfig) *StreamLimiter {
+    return &StreamLimiter{cfg: cfg, perKey: make(map[string]int), open: make(map[*openStream]bool)}
+}
+
+// Acquire admits a stream for key, or returns nil and the limit that was hit.
+// close is called from the reaper to end the stream if it goes idle.
+func (sl *StreamLimiter) Acquire(key string, close func()) (*openStream, string) {
+    sl.mu.Lock()
+    defer sl.mu.Unlock()
+
+    if sl.cfg.MaxGlobal > 0 && len(sl.open) >= sl.cfg.MaxGlobal {
+        metrics.Inc("stream_connections_rejected_total", "limit", "global")
+        return nil, "global"
+    }
+    if sl.cfg.MaxPerKey > 0 && sl.perKey[key] >= sl.cfg.MaxPerKey {
+        metrics.Inc("stream_connections_rejected_total", "limit", "key")
+        return nil, "key"
+    }
+
+    now := time.Now()
+    s := &openStream{key: key, opened: now, close: close}
+    s.lastSent.Store(now.UnixNano())
+    sl.open[s] = true
+    sl.perKey[key]++
+    sl.updateGaugesLocked(key)
+    return s, ""
+}
+
+// Release ends a stream's accounting; releasing twice is harmless
+func (sl *StreamLimiter) Release(s *openStream) {
+    sl.mu.Lock()
+    defer sl.mu.Unlock()
+    if !sl.open[s] {
+        return
+    }
+    delete(sl.open, s)
+    if sl.perKey[s.key]--; sl.perKey[s.key] == 0 {
+        delete(sl.perKey, s.key)
+    }
+    sl.updateGaugesLocked(s.key)
+}
+
+// updateGaugesLocked publishes the counts. Authenticated keys get their own
+// series; client addresses are unbounded, so they share one.
+func (sl *StreamLimiter) updateGaugesLocked(key string) {
+    metrics.Set("stream_connections", float64(len(sl.open)), "key", "all")
+    if strings.HasPrefix(key, "key:") {
+        metrics.Set("stream_connections", float64(sl.perKey[key]), "key", strings.TrimPrefix(key, "key:"))
+        return
+    }
+    anonymous := 0
+    for k, n := range sl.perKey {
+        if !strings.HasPrefix(k, "key:") {
+            anonymous += n
+        }
+    }
+    metrics.Set("stream_connections", float64(anonymous), "key", "anonymous")
+}
+
+// Run closes streams idle for longer than the configured timeout
+func (sl *StreamLimiter) Run() {
+    if sl.cfg.IdleTimeout <= 0 {
+        return
+    }
+    // Check often enough that a stream is closed within a quarter of the timeout
+    interval := sl.cfg.IdleTimeout / 4
+    if interval > 10*time.Second {
+        interval = 10 * time.Second
+    } else if interval < time.Second {
+        interval = time.Second
+    }
+    for now := range time.Tick(interval) {
+        cutoff := now.Add(-sl.cfg.IdleTimeout).UnixNano()
+        var idle []*openStream
+        sl.mu.Lock()
+        for s := range sl.open {
+            if s.lastSent.Load() < cutoff && !s.reaped.Load() {
+                idle = append(idle, s)
+            }
+        }
+        sl.mu.Unlock()
+
+        for _, s := range idle {
+            s.reaped.Store(true)
+            metrics.Inc("stream_connections_reaped_total")
+            s.close()
+        }
+    }
+}
+
+// StreamStats is the streams section of /admin/debug/stats
+type StreamStats struct {
+    Open        int            `json:"open"`
+    MaxPerKey   int            `json:"max_per_key"`
+    MaxGlobal   int            `json:"max_global"`
+    IdleTimeout int            `json:"idle_timeout_seconds"`
+    PerKey      map[string]int `json:"per_key"`
+    OldestOpen  *time.Time     `json:"oldest_open,omitempty"`
+}
+
+func (sl *StreamLimiter) Stats() StreamStats {
+    sl.mu.Lock()
+    defer sl.mu.Unlock()
+
+    stats := StreamStats{
+        Open:        len(sl.open),
+        MaxPerKey:   sl.cfg.MaxPerKey,
+        MaxGlobal:   sl.cfg.MaxGlobal,
+        IdleTimeout: int(sl.cfg.IdleTimeout.Seconds()),
+        PerKey:      make(map[string]int, len(sl.perKey)),
+    }
+    for k, n := range sl.perKey {
+        stats.PerKey[k] = n
+    }
+    for s := range sl.open {
+        if stats.OldestOpen == nil || s.opened.Before(*stats.OldestOpen) {
+            opened := s.opened
+            stats.OldestOpen = &opened
+        }
+    }
+    return stats
+}
+
+// closeStream returns the reaper's close function for a streaming response:
+// cancel the invocation, then stop waiting on a client that isn't reading
+func closeStream(w http.ResponseWriter, cancel func()) func() {
+    return func() {
+        cancel()
+        http.NewResponseController(w).SetWriteDeadline(time.Now().Add(idleWriteGrace))
+    }
+}
+
+// rejectStream answers a stream request over the limit with a 429 carrying a
+// single error event, so stream clients see the reason in their own format
+func rejectStream(w http.ResponseWriter, format, limit string) {
+    message := "Too many concurrent streams for this API key"
+    if limit == "global" {
+        message = "Too many concurrent streams on this server"
+    }
+    w.Header().Set("Retry-After", "1")
+    sink, err := openEventWriter(w, format, http.StatusTooManyRequests)
+    if err != nil {
+        return
+    }
+    sink.Send("error", streamErrorEvent{Error: message, Code: ErrCodeRateLimited})
+}
+
+// rejectSaturated turns a stream away for want of a generation slot
+func rejectSaturated(w http.ResponseWriter, format string) {
+    w.Header().Set("Retry-After", strconv.Itoa(saturatedRetryAfter))
+    sink, err := openEventWriter(w, format, http.StatusServiceUnavailable)
+    if err != nil {
+        return
+    }
+    sink.Send("error", streamErrorEvent{Error: "Too many generations in flight on this server", Code: ErrCodeRateLimited})
+}
+
+func debugStatsHandler(streams *StreamLimiter, memory *MemoryGovernor) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        writeJSON(w, r, map[string]interface{}{
+            "streams": streams.Stats(),
+            "memory":  memory.Stats(),
+        })
+    }
+}
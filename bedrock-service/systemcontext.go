@@ -0,0 +1,119 @@
+package main
+
+import (
+    "bufio"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "os"
+    "strings"
+    "time"
+    _ "time/tzdata" // The runtime image has no zoneinfo database
+)
+
+// SystemContext holds the context lines injected into every system prompt:
+// the current date/time and optional deployment-defined static facts
+type SystemContext struct {
+    Location    *time.Location
+    StaticLines []string
+}
+
+// LoadSystemContext reads TIME_CONTEXT_TIMEZONE (IANA name, default UTC) and
+// SYSTEM_CONTEXT_FILE (one static context line per non-empty line)
+func LoadSystemContext() (*SystemContext, error) {
+    sc := &SystemContext{Location: time.UTC}
+
+    if tz := os.Getenv("TIME_CONTEXT_TIMEZONE"); tz != "" {
+        loc, err := time.LoadLocation(tz)
+        if err != nil {
+            return nil, fmt.Errorf("invalid TIME_CONTEXT_TIMEZONE %q: %v", tz, err)
+        }
+        sc.Location = loc
+    }
+
+    if path := os.Getenv("SYSTEM_CONTEXT_FILE"); path != "" {
+        f, err := os.Open(path)
+        if err != nil {
+            return nil, fmt.Errorf("unable to read SYSTEM_CONTEXT_FILE: %v", err)
+        }
+        defer f.Close()
+
+        scanner := bufio.NewScanner(f)
+        for scanner.Scan() {
+            if line := strings.TrimSpace(scanner.Text()); line != "" {
+                sc.StaticLines = append(sc.StaticLines, line)
+            }
+        }
+        if err := scanner.Err(); err != nil {
+            return nil, fmt.Errorf("unable to read SYSTEM_CONTEXT_FILE: %v", err)
+        }
+    }
+    return sc, nil
+}
+
+// ResolveLocation picks the timezone for a request: the one resolved from
+// the request or key policy, otherwise the configured default
+func (sc *SystemContext) ResolveLocation(tz ResolvedParam) (*time.Location, error) {
+    if tz.Value == "" {
+        return sc.Location, nil
+    }
+    loc, err := time.LoadLocation(tz.Value)
+    if err != nil {
+        return nil, fmt.Errorf("invalid timezone %q from %s", tz.Value, paramTimezone.describe(tz.Source))
+    }
+    return loc, nil
+}
+
+// Lines returns the context lines for a request. The time line is omitted
+// when the caller opted out with no_time_context.
+func (sc *SystemContext) Lines(now time.Time, loc *time.Location, includeTime bool) []string {
+    var lines []string
+    if includeTime {
+        lines = append(lines, formatTimeContext(now, loc))
+    }
+    return append(lines, sc.StaticLines...)
+}
+
+// formatTimeContext renders the standard time line, e.g.
+// "Current date and time: Wednesday, 2026-10-14 09:30 (Europe/Berlin, UTC+02:00)"
+func formatTimeContext(now time.Time, loc *time.Location) string {
+    local := now.In(loc)
+    line := make([]byte, 0, 96)
+    line = append(line, "Current date and time: "...)
+    line = append(line, local.Weekday().String()...)
+    line = append(line, ", "...)
+    line = local.AppendFormat(line, "2006-01-02 15:04")
+    line = append(line, " ("...)
+    line = append(line, loc.String()...)
+    line = append(line, ", UTC"...)
+    line = local.AppendFormat(line, "-07:00")
+    return string(append(line, ')'))
+}
+
+// PromptHash is the stable fingerprint of a generation request as the caller
+// sees it; the response cache keys on the built request body instead, see
+// responseCacheKey. It covers the caller's inputs and whether time context
+// is injected, but deliberately not the injected timestamp itself, so the
+// hash does not change from one minute to the next.
+func PromptHash(p GenerationParams, timeContext bool, staticLines []string) string {
+    canonical, _ := json.Marshal(struct {
+        Prompt      string         `json:"prompt"`
+        Model       string         `json:"model"`
+        MaxTokens   int            `json:"max_tokens"`
+        Temperature float64        `json:"temperature"`
+        TimeContext bool           `json:"time_context"`
+        StaticLines []string       `json:"static_lines"`
+        Prefix      string         `json:"context_prefix,omitempty"` // Omitted when empty so older hashes stay valid
+        History     []ChatMessage  `json:"history,omitempty"`        // Likewise
+        Blocks      []ContentBlock `json:"prompt_blocks,omitempty"`  // Likewise
+        Documents   []Document     `json:"documents,omitempty"`      // Likewise
+        System      *string        `json:"system,omitempty"`         // Likewise; "" when the caller asked for none
+        Stop        []string       `json:"stop_sequences,omitempty"` // Likewise
+        TopP        *float64       `json:"top_p,omitempty"`          // Likewise
+        TopK        *int           `json:"top_k,omitempty"`          // Likewise
+    }{p.Prompt, p.PreferredModel, p.MaxTokens, *p.Temperature, timeContext, staticLines, p.ContextPrefix, p.History, p.PromptBlocks, p.Documents, p.SystemPrompt, p.StopSequences, p.TopP, p.TopK})
+
+    sum := sha256.Sum256(canonical)
+    return hex.EncodeToString(sum[:])
+}
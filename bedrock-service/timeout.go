@@ -0,0 +1,76 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "strconv"
+    "time"
+)
+
+// defaultMaxRequestTimeout keeps a capped deadline inside the server's
+// 120s WriteTimeout, so the 504 can still be written when it fires
+const defaultMaxRequestTimeout = 110 * time.Second
+
+// RequestTimeoutConfig bounds the timeout callers may ask for
+type RequestTimeoutConfig struct {
+    Max time.Duration // Longer requested timeouts are cut down to this
+}
+
+// LoadRequestTimeoutConfig reads REQUEST_TIMEOUT_MAX_SECONDS
+func LoadRequestTimeoutConfig() (RequestTimeoutConfig, error) {
+    cfg := RequestTimeoutConfig{Max: defaultMaxRequestTimeout}
+    if v := os.Getenv("REQUEST_TIMEOUT_MAX_SECONDS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return cfg, fmt.Errorf("invalid REQUEST_TIMEOUT_MAX_SECONDS %q", v)
+        }
+        cfg.Max = time.Duration(n) * time.Second
+    }
+    return cfg, nil
+}
+
+// requestTimeout reads the caller's timeout_seconds, 0 when none was given.
+// One above the server maximum is capped with a warning rather than
+// rejected; a caller asking for too long still wants an answer.
+func (cfg RequestTimeoutConfig) requestTimeout(param ResolvedParam, warnings *[]string) (time.Duration, *APIError) {
+    if param.Value == "" {
+        return 0, nil
+    }
+    seconds, err := strconv.ParseFloat(param.Value, 64)
+    if err != nil || seconds <= 0 {
+        return 0, &APIError{
+            Code:    ErrCodeValidation,
+            Message: fmt.Sprintf("Invalid timeout %q", param.Value),
+            Fields:  []FieldError{{Field: paramTimeout.Name, Message: "must be a positive number of seconds"}},
+        }
+    }
+    timeout := time.Duration(seconds * float64(time.Second))
+    if timeout > cfg.Max {
+        *warnings = append(*warnings, fmt.Sprintf("timeout_seconds %s exceeds the server maximum; using %v", param.Value, cfg.Max))
+        timeout = cfg.Max
+    }
+    return timeout, nil
+}
+
+// timeoutValue is the body's timeout_seconds as a parameter value
+func (req *GenerateRequest) timeoutValue() string {
+    if req.TimeoutSeconds == nil {
+        return ""
+    }
+    return strconv.FormatFloat(*req.TimeoutSeconds, 'g', -1, 64)
+}
+
+// withRequestTimeout bounds ctx by the caller's timeout, if one was given
+func withRequestTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+    if timeout <= 0 {
+        return context.WithCancel(ctx)
+    }
+    return context.WithTimeout(ctx, timeout)
+}
+
+// isDeadline reports whether err comes from a request running out of time
+func isDeadline(err error) bool {
+    return errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,114 @@
+package main
+
+import "strings"
+
+// Amazon Titan Text models take a single inputText with no separate system
+// prompt, and the sampling parameters in textGenerationConfig. Turns are laid
+// out in the User:/Bot: form Titan is tuned for. They answer with
+// results[0].outputText and a completionReason.
+
+// buildTitanBody is buildRequestBody for the Titan Text format
+func buildTitanBody(p GenerationParams) map[string]interface{} {
+    preamble := p.withContextPrefix(p.systemPrompt(defaultSystemPrompt))
+
+    config := map[string]interface{}{
+        "maxTokenCount": p.MaxTokens,
+        "temperature":   *p.Temperature,
+    }
+    if p.TopP != nil {
+        config["topP"] = *p.TopP
+    }
+    // Titan has no top_k, and rejects the request if one is sent
+    if len(p.StopSequences) > 0 {
+        config["stopSequences"] = p.StopSequences
+    }
+    return map[string]interface{}{
+        "inputText":            renderTitanPrompt(preamble, p.History, p.Prompt),
+        "textGenerationConfig": config,
+    }
+}
+
+// renderTitanPrompt lays out the preamble, if any, then the turns, ending
+// on the Bot: cue for the answer
+func renderTitanPrompt(preamble string, history []ChatMessage, prompt string) string {
+    var sb strings.Builder
+    if preamble != "" {
+        sb.WriteString(preamble + "\n\n")
+    }
+    for _, m := range append(history[:len(history):len(history)], ChatMessage{Role: roleUser, Content: prompt}) {
+        if m.Role == roleAssistant {
+            sb.WriteString("Bot: " + m.Content + "\n")
+        } else {
+            sb.WriteString("User: " + m.Content + "\n")
+        }
+    }
+    sb.WriteString("Bot:")
+    return sb.String()
+}
+
+// titanResult returns the first result of a Titan response
+func titanResult(response map[string]interface{}) (map[string]interface{}, bool) {
+    results, ok := response["results"].([]interface{})
+    if !ok || len(results) == 0 {
+        return nil, false
+    }
+    result, ok := results[0].(map[string]interface{})
+    return result, ok
+}
+
+// titanText reads the generated text of a Titan response. Titan often starts
+// its answer with the space after "Bot:", which isn't part of it.
+func titanText(response map[string]interface{}) (string, bool) {
+    result, ok := titanResult(response)
+    if !ok {
+        return "", false
+    }
+    text, ok := result["outputText"].(string)
+    return strings.TrimLeft(text, " "), ok
+}
+
+// titanUsage reads the token usage a Titan response reports, zero when it
+// reports none
+func titanUsage(response map[string]interface{}) (input, output int) {
+    if n, ok := response["inputTextTokenCount"].(float64); ok {
+        input = int(n)
+    }
+    if result, ok := titanResult(response); ok {
+        if n, ok := result["tokenCount"].(float64); ok {
+            output = int(n)
+        }
+    }
+    return input, output
+}
+
+// titanFormat is Amazon Titan Text
+type titanFormat struct{}
+
+func (titanFormat) buildBody(p GenerationParams) map[string]interface{} {
+    return buildTitanBody(p)
+}
+
+func (titanFormat) probeBody(prompt string) map[string]interface{} {
+    return map[string]interface{}{
+        "inputText":            prompt,
+        "textGenerationConfig": map[string]interface{}{"maxTokenCount": 10},
+    }
+}
+
+func (titanFormat) provider() string { return providerAmazonTitan }
+
+func (titanFormat) stopReason(response map[string]interface{}) string {
+    // Titan reports it per result
+    result, _ := titanResult(response)
+    raw, _ := result["completionReason"].(string)
+    return raw
+}
+
+func (titanFormat) parseResponse(response map[string]interface{}, p GenerationParams, result *GenerationResult) bool {
+    result.InputTokens, result.OutputTokens = titanUsage(response)
+    // Titan doesn't say which stop sequence matched, and sends no top_k
+    result.Sampling.TopK = nil
+    text, ok := titanText(response)
+    result.Text = text
+    return ok
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+    "encoding/json"
+    "io"
+    "net/http"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+const titanModel = "amazon.titan-text-premier-v1:0"
+
+func TestTitanRequestBody(t *testing.T) {
+    topP, topK := 0.9, 50
+    system := "Answer in one sentence."
+    p := GenerationParams{
+        Prompt:        "And Spain?",
+        SystemPrompt:  &system,
+        History:       []ChatMessage{{Role: roleUser, Content: "Capital of France?"}, {Role: roleAssistant, Content: "Paris."}},
+        StopSequences: []string{"User:"},
+        TopP:          &topP,
+        TopK:          &topK,
+        MaxTokens:     300,
+    }.withDefaults()
+
+    body := buildRequestBody(ModelInfo{ID: titanModel, API: apiTitan}, p)
+    data, err := json.Marshal(body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var sent struct {
+        InputText            string                 `json:"inputText"`
+        TextGenerationConfig map[string]interface{} `json:"textGenerationConfig"`
+    }
+    if err := json.Unmarshal(data, &sent); err != nil {
+        t.Fatal(err)
+    }
+
+    want := "Answer in one sentence.\n\nUser: Capital of France?\nBot: Paris.\nUser: And Spain?\nBot:"
+    if sent.InputText != want {
+        t.Errorf("inputText %q, want %q", sent.InputText, want)
+    }
+    config := sent.TextGenerationConfig
+    if config["maxTokenCount"] != 300.0 || config["topP"] != 0.9 || config["temperature"] != *p.Temperature {
+        t.Errorf("textGenerationConfig %v", config)
+    }
+    if stops, _ := config["stopSequences"].([]interface{}); len(stops) != 1 || stops[0] != "User:" {
+        t.Errorf("stopSequences %v", config["stopSequences"])
+    }
+    // Titan rejects a request with a parameter it doesn't know
+    for key := range config {
+        switch key {
+        case "maxTokenCount", "temperature", "topP", "stopSequences":
+        default:
+            t.Errorf("textGenerationConfig sends %s", key)
+        }
+    }
+    if len(body) != 2 {
+        t.Errorf("body has fields %v, want inputText and textGenerationConfig only", body)
+    }
+}
+
+// Without a system prompt or optional parameters, only the turn and the
+// required settings go out
+func TestTitanRequestBodyMinimal(t *testing.T) {
+    none := ""
+    p := GenerationParams{Prompt: "Hi", SystemPrompt: &none, MaxTokens: 10}.withDefaults()
+    body := buildTitanBody(p)
+    config := body["textGenerationConfig"].(map[string]interface{})
+    if _, ok := config["topP"]; ok {
+        t.Errorf("topP sent unset: %v", config)
+    }
+    if _, ok := config["stopSequences"]; ok {
+        t.Errorf("stopSequences sent unset: %v", config)
+    }
+    input := body["inputText"].(string)
+    if input != "User: Hi\nBot:" {
+        t.Errorf("inputText %q, want the turn and the Bot: cue alone", input)
+    }
+
+    probe := probeRequestBody(ModelInfo{ID: titanModel, API: apiTitan})
+    if probe["inputText"] != "Hello" || !reflect.DeepEqual(probe["textGenerationConfig"], map[string]interface{}{"maxTokenCount": 10}) {
+        t.Errorf("probe body %v", probe)
+    }
+}
+
+// Canned Titan responses, beyond those the conformance fixtures record
+func TestTitanResponses(t *testing.T) {
+    for _, c := range []struct {
+        name          string
+        response      string
+        text          string
+        ok            bool
+        input, output int
+        reason        string
+    }{
+        {"finished", `{"inputTextTokenCount":5,"results":[{"tokenCount":3,"outputText":" Madrid.","completionReason":"FINISH"}]}`,
+            "Madrid.", true, 5, 3, "FINISH"},
+        {"only the first result", `{"inputTextTokenCount":5,"results":[{"tokenCount":2,"outputText":"One","completionReason":"LENGTH"},{"tokenCount":9,"outputText":"Two","completionReason":"FINISH"}]}`,
+            "One", true, 5, 2, "LENGTH"},
+        {"leading newline kept", `{"results":[{"outputText":"\n- a\n- b","completionReason":"FINISH"}]}`,
+            "\n- a\n- b", true, 0, 0, "FINISH"},
+        {"empty output", `{"inputTextTokenCount":4,"results":[{"tokenCount":0,"outputText":"","completionReason":"CONTENT_FILTERED"}]}`,
+            "", true, 4, 0, "CONTENT_FILTERED"},
+        {"no outputText", `{"inputTextTokenCount":4,"results":[{"tokenCount":0,"completionReason":"FINISH"}]}`,
+            "", false, 4, 0, "FINISH"},
+        {"no results", `{"inputTextTokenCount":4,"results":[]}`, "", false, 4, 0, ""},
+        {"results not a list", `{"results":{"outputText":"x"}}`, "", false, 0, 0, ""},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            var response map[string]interface{}
+            if err := json.Unmarshal([]byte(c.response), &response); err != nil {
+                t.Fatal(err)
+            }
+            text, ok := titanText(response)
+            if text != c.text || ok != c.ok {
+                t.Errorf("text %q, %v; want %q, %v", text, ok, c.text, c.ok)
+            }
+            if input, output := titanUsage(response); input != c.input || output != c.output {
+                t.Errorf("usage %d/%d, want %d/%d", input, output, c.input, c.output)
+            }
+            if reason := (titanFormat{}).stopReason(response); reason != c.reason {
+                t.Errorf("stop reason %q, want %q", reason, c.reason)
+            }
+
+            result := &GenerationResult{}
+            p := GenerationParams{Prompt: "x"}.withDefaults()
+            result.Sampling = p.sampling()
+            if parsed := (titanFormat{}).parseResponse(response, p, result); parsed != c.ok || result.Text != c.text {
+                t.Errorf("parseResponse %v with text %q", parsed, result.Text)
+            }
+            if result.Sampling.TopK != nil {
+                t.Error("sampling reports a top_k Titan never got")
+            }
+        })
+    }
+}
+
+// Titan answers in the fallback chain like any other model, and is listed
+func TestE2ETitanFallback(t *testing.T) {
+    const throttledModel = "mistral.mistral-large-2407-v1:0"
+    fake.Script(throttledModel, throttled(), throttled())
+    fake.Script(titanModel, fakeReply{Body: `{"inputTextTokenCount":9,"results":[{"tokenCount":4,"outputText":" Bonjour tout le monde","completionReason":"FINISH"}]}`})
+
+    resp := post(t, "/generate", map[string]interface{}{"prompt": "Say hello in French", "models": []string{throttledModel, titanModel}})
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("status %d", resp.StatusCode)
+    }
+    requestID := resp.Header.Get("X-Request-ID")
+    var out GenerateResponse
+    decode(t, resp, &out)
+
+    if out.Response != "Bonjour tout le monde" || out.Meta == nil || out.Meta.ModelID != titanModel {
+        t.Errorf("response %q from %+v, want Titan's", out.Response, out.Meta)
+    }
+    if out.InputTokens != 9 || out.OutputTokens != 4 || out.FinishReason != finishCompleted {
+        t.Errorf("usage %d/%d, finish reason %q", out.InputTokens, out.OutputTokens, out.FinishReason)
+    }
+    if !attemptLogged(t, requestID, titanModel, "success") {
+        t.Errorf("no successful Titan attempt logged for request %s:\n%v", requestID, logLines(t, requestID))
+    }
+
+    calls := fake.Calls(titanModel)
+    if len(calls) != 1 || calls[0].Operation != "invoke" {
+        t.Fatalf("calls %+v, want one InvokeModel", calls)
+    }
+    var sent map[string]interface{}
+    if err := json.Unmarshal(calls[0].Body, &sent); err != nil {
+        t.Fatal(err)
+    }
+    if input, _ := sent["inputText"].(string); !strings.HasSuffix(input, "User: Say hello in French\nBot:") {
+        t.Errorf("inputText %q", sent["inputText"])
+    }
+
+    listing, err := http.Get(serviceURL + "/models")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listing.Body.Close()
+    data, _ := io.ReadAll(listing.Body)
+    var models struct {
+        Models []modelListing `json:"models"`
+    }
+    if err := json.Unmarshal(data, &models); err != nil {
+        t.Fatal(err)
+    }
+    for _, m := range models.Models {
+        if m.ID == titanModel {
+            if m.APIType != string(apiTitan) || !m.Enabled {
+                t.Errorf("Titan listed as %+v", m)
+            }
+            return
+        }
+    }
+    t.Errorf("Titan missing from /models: %s", data)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+    "unicode/utf8"
+)
+
+// charsPerToken is the rough ratio used for pre-flight token estimates;
+// Anthropic models average a little under four characters per token for English
+const charsPerToken = 4
+
+// estimateTokens gives an approximate token count for text
+func estimateTokens(text string) int {
+    return tokensForRunes(utf8.RuneCountInString(text))
+}
+
+// tokensForRunes is the estimate for a text of n runes. Truncation counts
+// runes as it goes and asks this, so it agrees with every other estimate.
+func tokensForRunes(n int) int {
+    if n == 0 {
+        return 0
+    }
+    return (n + charsPerToken - 1) / charsPerToken
+}
+
+// estimateInputTokens estimates the input tokens of a generation request,
+// including the system prompt and any injected context lines
+func estimateInputTokens(model ModelInfo, p GenerationParams) int {
+    prefix := estimateTokens(p.ContextPrefix) + estimateHistoryTokens(p.History) + p.turn().images()*imageTokenEstimate + estimateDocumentTokens(p.Documents)
+    if model.API != apiLegacy {
+        return prefix + estimateTokens(p.systemPrompt(defaultSystemPrompt)) + estimateTokens(p.Prompt)
+    }
+    return prefix + estimateTokens(p.systemPrompt(legacyPreamble)) + estimateTokens(p.Prompt)
+}
+
+// estimateHistoryTokens estimates the tokens of earlier conversation turns
+func estimateHistoryTokens(history []ChatMessage) int {
+    total := 0
+    for _, m := range history {
+        total += estimateTokens(m.Content) + m.images()*imageTokenEstimate
+    }
+    return total
+}
+
+// messageUsage reads the token usage a messages API response reports, zero
+// when it reports none
+func messageUsage(response map[string]interface{}) (input, output int) {
+    usage, ok := response["usage"].(map[string]interface{})
+    if !ok {
+        return 0, 0
+    }
+    if n, ok := usage["input_tokens"].(float64); ok {
+        input = int(n)
+    }
+    if n, ok := usage["output_tokens"].(float64); ok {
+        output = int(n)
+    }
+    return input, output
+}
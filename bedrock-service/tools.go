@@ -0,0 +1,146 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+)
+
+// ToolSpec describes a tool the model is forced to call, which is how we get
+// structured output that matches a JSON schema out of the messages API
+type ToolSpec struct {
+    Name        string                 `json:"name"`
+    Description string                 `json:"description"`
+    InputSchema map[string]interface{} `json:"input_schema"`
+}
+
+// ToolCall holds the parameters for a forced tool invocation
+type ToolCall struct {
+    System         string
+    Prompt         string
+    PreferredModel string
+    MaxTokens      int
+    Temperature    float64
+    Tool           ToolSpec
+    Origin         Origin
+}
+
+// ToolUsage is the token usage of a forced tool invocation
+type ToolUsage struct {
+    InputTokens  int `json:"input_tokens"`
+    OutputTokens int `json:"output_tokens"`
+}
+
+// InvokeTool forces a messages-API model to answer by calling call.Tool and
+// returns the raw tool input along with the name of the model that produced it.
+// Legacy models are skipped since they have no tool support.
+func (bc *BedrockClient) InvokeTool(ctx context.Context, call ToolCall) (json.RawMessage, string, error) {
+    input, modelUsed, _, err := bc.InvokeToolUsage(ctx, call)
+    return input, modelUsed, err
+}
+
+// InvokeToolUsage is InvokeTool that also reports the token usage of the
+// successful invocation
+func (bc *BedrockClient) InvokeToolUsage(ctx context.Context, call ToolCall) (json.RawMessage, string, ToolUsage, error) {
+    if err := call.Origin.check(); err != nil {
+        return nil, "", ToolUsage{}, err
+    }
+    if call.MaxTokens == 0 {
+        call.MaxTokens = 1000
+    }
+
+    var lastError error
+    tried := 0
+    for _, model := range bc.modelsToTry(call.PreferredModel) {
+        if model.API != apiMessages {
+            continue
+        }
+        tried++
+        logInfof(ctx, "Trying model for tool %s: %s (%s)", call.Tool.Name, model.Name, model.ID)
+
+        requestBody := map[string]interface{}{
+            "anthropic_version": "bedrock-2023-05-31",
+            "max_tokens":        call.MaxTokens,
+            "temperature":       call.Temperature,
+            "tools":             []ToolSpec{call.Tool},
+            "tool_choice":       map[string]string{"type": "tool", "name": call.Tool.Name},
+            "messages": []map[string]interface{}{
+                {
+                    "role":    "user",
+                    "content": call.Prompt,
+                },
+            },
+        }
+        if call.System != "" {
+            requestBody["system"] = call.System
+        }
+
+        bodyBytes, err := marshalRequestBody(ctx, model.ID, requestBody)
+        if err != nil {
+            return nil, "", ToolUsage{}, err
+        }
+
+        resp, _, err := bc.accounts.InvokeModel(ctx, call.Origin, &bedrockruntime.InvokeModelInput{
+            Body:        bodyBytes,
+            ModelId:     aws.String(model.invokeID()),
+            ContentType: aws.String("application/json"),
+        })
+        if err != nil {
+            lastError = err
+            logWarnf(ctx, "Error with model %s: %v", model.Name, err)
+            continue
+        }
+
+        var usage ToolUsage
+        var decoded map[string]interface{}
+        if json.Unmarshal(resp.Body, &decoded) == nil {
+            detectSchemaDrift(providerAnthropicMessages, decoded)
+            usage.InputTokens, usage.OutputTokens = messageUsage(decoded)
+            if category, filtered := detectContentFilter(decoded); filtered {
+                metrics.Inc("content_filtered_total", "model", model.ID, "category", category)
+                logInfof(ctx, "Output from model %s was filtered (%s)", model.Name, category)
+                if !bc.filterFallback {
+                    return nil, model.Name, ToolUsage{}, ErrContentFiltered
+                }
+                lastError = ErrContentFiltered
+                continue
+            }
+        }
+
+        input, err := extractToolInput(resp.Body, call.Tool.Name)
+        if err != nil {
+            lastError = fmt.Errorf("model %s: %v", model.Name, err)
+            continue
+        }
+        return input, model.Name, usage, nil
+    }
+
+    if tried == 0 {
+        return nil, "", ToolUsage{}, fmt.Errorf("no available models with tool support found")
+    }
+    return nil, "", ToolUsage{}, fmt.Errorf("all available models failed. Last error: %v", lastError)
+}
+
+// extractToolInput pulls the input of the named tool_use block out of a messages API response
+func extractToolInput(body []byte, toolName string) (json.RawMessage, error) {
+    var response struct {
+        Content []struct {
+            Type  string          `json:"type"`
+            Name  string          `json:"name"`
+            Input json.RawMessage `json:"input"`
+        } `json:"content"`
+    }
+    if err := json.Unmarshal(body, &response); err != nil {
+        return nil, fmt.Errorf("error parsing response: %v", err)
+    }
+
+    for _, block := range response.Content {
+        if block.Type == "tool_use" && block.Name == toolName {
+            return block.Input, nil
+        }
+    }
+    return nil, fmt.Errorf("response did not contain a %s tool call", toolName)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "sync/atomic"
+
+    "github.com/gorilla/mux"
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/codes"
+    "go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+    "go.opentelemetry.io/otel/propagation"
+    "go.opentelemetry.io/otel/sdk/resource"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    "go.opentelemetry.io/otel/trace"
+)
+
+// Requests are traced with OpenTelemetry: a server span per request, a span
+// per model attempt under it and one for any wait for a generation slot.
+// Spans are exported over OTLP/HTTP as the standard OTEL_* variables say;
+// with no OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+// nothing is recorded. Incoming traceparent headers are honoured either
+// way, so error responses quote the caller's trace ID.
+
+// tracerName names the spans' instrumentation scope
+const tracerName = "bedrock-service"
+
+// tracer starts every span; it follows the global provider once set
+var tracer = otel.Tracer(tracerName)
+
+// tracesExported is set once LoadTracing installs the exporting provider
+var tracesExported bool
+
+// tracePropagator reads traceparent and baggage headers
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// tracingEnabled reports whether spans have somewhere to go
+func tracingEnabled() bool {
+    if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+        return false
+    }
+    return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// LoadTracing installs the propagator and, when an exporter endpoint is
+// configured, the OTLP tracer provider. Spans are exported in batches, as
+// OTEL_BSP_* says.
+func LoadTracing(ctx context.Context) error {
+    otel.SetTextMapPropagator(tracePropagator)
+    if !tracingEnabled() {
+        return nil
+    }
+    if os.Getenv("OTEL_SERVICE_NAME") == "" {
+        os.Setenv("OTEL_SERVICE_NAME", tracerName)
+    }
+
+    exporter, err := otlptracehttp.New(ctx)
+    if err != nil {
+        return fmt.Errorf("OTLP trace exporter: %v", err)
+    }
+    res, err := resource.New(ctx, resource.WithFromEnv(), resource.WithTelemetrySDK(), resource.WithHost())
+    if err != nil {
+        return fmt.Errorf("trace resource: %v", err)
+    }
+    provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+    otel.SetTracerProvider(provider)
+    tracesExported = true
+    log.Printf("Tracing enabled, exporting spans over OTLP")
+    return nil
+}
+
+// traceIDFrom is the trace ctx belongs to, or "" when it has none
+func traceIDFrom(ctx context.Context) string {
+    if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+        return sc.TraceID().String()
+    }
+    return ""
+}
+
+// exemplarLabels renders ctx's trace and request IDs as an exemplar's labels.
+// It's "" unless ctx's span is sampled and exported: an exemplar for a trace
+// the backend never got would be a dead link.
+func exemplarLabels(ctx context.Context) string {
+    sc := trace.SpanContextFromContext(ctx)
+    if !tracesExported || !sc.IsSampled() {
+        return ""
+    }
+    // trace_id leads, as the exemplar's link target; request IDs are
+    // validated on the way in, so they need no escaping
+    labels := renderLabels([]string{"trace_id", sc.TraceID().String()})
+    if id := requestIDFrom(ctx); id != "" {
+        labels = withLabel(labels, `request_id="`+id+`"`)
+    }
+    return labels
+}
+
+// tracingMiddleware opens the server span of each request, continuing the
+// trace of an incoming traceparent. It runs right after the request ID is
+// assigned, so even rejected requests are traced.
+func tracingMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        route := r.URL.Path
+        if current := mux.CurrentRoute(r); current != nil {
+            if template, err := current.GetPathTemplate(); err == nil {
+                route = template
+            }
+        }
+        ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+        ctx, span := tracer.Start(ctx, r.Method+" "+route,
+            trace.WithSpanKind(trace.SpanKindServer),
+            trace.WithAttributes(
+                attribute.String("http.request.method", r.Method),
+                attribute.String("http.route", route),
+                attribute.String("url.path", r.URL.Path),
+                attribute.String("request_id", requestIDFrom(r.Context())),
+            ))
+        defer span.End()
+
+        recorder := &statusRecorder{ResponseWriter: w}
+        next.ServeHTTP(recorder, r.WithContext(ctx))
+
+        status := recorder.status
+        if status == 0 {
+            status = http.StatusOK
+        }
+        span.SetAttributes(attribute.Int("http.response.status_code", status))
+        if p := principalFrom(ctx); p != nil && p.KeyID != "" {
+            span.SetAttributes(attribute.String("api_key_id", p.KeyID))
+        }
+        if status >= 500 {
+            span.SetStatus(codes.Error, http.StatusText(status))
+        }
+    })
+}
+
+// attemptSpan is the span of one model attempt
+type attemptSpan struct {
+    span    trace.Span
+    retries *atomic.Int64 // The generation's retry count, nil when not counted
+    before  int64         // Its value when the attempt started
+    once    sync.Once
+}
+
+// startAttempt opens the span of an attempt on model
+func startAttempt(ctx context.Context, model ModelInfo, retries *atomic.Int64) (context.Context, *attemptSpan) {
+    ctx, span := tracer.Start(ctx, "invoke "+model.ID,
+        trace.WithSpanKind(trace.SpanKindClient),
+        trace.WithAttributes(
+            attribute.String("gen_ai.system", "aws.bedrock"),
+            attribute.String("gen_ai.request.model", model.ID),
+        ))
+    a := &attemptSpan{span: span, retries: retries}
+    if retries != nil {
+        a.before = retries.Load()
+    }
+    return ctx, a
+}
+
+// end closes the span with how the attempt went. Only the first call counts,
+// so a deferred end can back up the others.
+func (a *attemptSpan) end(account *Account, outcome string, inputTokens, outputTokens int, err error) {
+    a.once.Do(func() {
+        a.span.SetAttributes(
+            attribute.String("bedrock.account", accountName(account)),
+            attribute.String("bedrock.outcome", outcome),
+            attribute.Int("gen_ai.usage.input_tokens", inputTokens),
+            attribute.Int("gen_ai.usage.output_tokens", outputTokens),
+        )
+        if a.retries != nil {
+            a.span.SetAttributes(attribute.Int64("bedrock.retries", a.retries.Load()-a.before))
+        }
+        if err != nil && outcome != "cancelled" {
+            a.span.SetAttributes(attribute.String("error.type", classifyError(err)))
+            a.span.RecordError(err)
+            a.span.SetStatus(codes.Error, err.Error())
+        }
+        a.span.End()
+    })
+}
+
+// startQueueWait opens the span of a wait for a generation slot
+func startQueueWait(ctx context.Context) trace.Span {
+    _, span := tracer.Start(ctx, "generation queue wait")
+    return span
+}
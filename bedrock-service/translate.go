@@ -0,0 +1,273 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// Translation settings
+const (
+    translateTemperature = 0.2 // Low temperature keeps translations consistent
+    translateConcurrency = 4   // Max items translated in parallel per request
+    maxTranslateTexts    = 50  // Each text is a model call, two with a glossary correction
+)
+
+// TranslateRequest is the body accepted by POST /translate.
+// Text may be a single string or an array of strings.
+type TranslateRequest struct {
+    SourceLang string            `json:"source_lang"`
+    TargetLang string            `json:"target_lang"`
+    Text       json.RawMessage   `json:"text"`
+    Glossary   map[string]string `json:"glossary,omitempty"`
+    Model      string            `json:"model,omitempty"`
+    MaxTokens  int               `json:"max_tokens,omitempty"`
+}
+
+type GlossaryViolation struct {
+    Term     string `json:"term"`
+    Expected string `json:"expected"`
+}
+
+type TranslationItem struct {
+    Index              int                 `json:"index"`
+    Translation        string              `json:"translation"`
+    ModelUsed          string              `json:"model_used,omitempty"`
+    Retried            bool                `json:"retried,omitempty"`
+    GlossaryViolations []GlossaryViolation `json:"glossary_violations,omitempty"`
+    Error              string              `json:"error,omitempty"`
+}
+
+type TranslateResponse struct {
+    SourceLang   string            `json:"source_lang"`
+    TargetLang   string            `json:"target_lang"`
+    Translations []TranslationItem `json:"translations"`
+}
+
+// texts decodes the text field, accepting either a string or an array of strings.
+func (req *TranslateRequest) texts() ([]string, error) {
+    return decodeTextList(req.Text)
+}
+
+// checkTranslateTexts rejects a batch over maxTranslateTexts texts, or with
+// blank entries, which would each still cost a model call
+func checkTranslateTexts(texts []string) *APIError {
+    if len(texts) > maxTranslateTexts {
+        return &APIError{
+            Code:    ErrCodeValidation,
+            Message: fmt.Sprintf("At most %d texts can be translated per request", maxTranslateTexts),
+            Fields:  []FieldError{{Field: "text", Message: fmt.Sprintf("has %d entries, the limit is %d", len(texts), maxTranslateTexts)}},
+        }
+    }
+    var fields []FieldError
+    for i, text := range texts {
+        if strings.TrimSpace(text) == "" {
+            fields = append(fields, FieldError{Field: fmt.Sprintf("text[%d]", i), Message: "must not be empty"})
+        }
+    }
+    if len(fields) > 0 {
+        return &APIError{Code: ErrCodeValidation, Message: "Texts to translate must not be empty", Fields: fields}
+    }
+    return nil
+}
+
+// decodeTextList accepts a JSON string or an array of strings, as used by the
+// batch-capable endpoints.
+func decodeTextList(raw json.RawMessage) ([]string, error) {
+    if len(raw) == 0 {
+        return nil, fmt.Errorf("text is required")
+    }
+
+    var single string
+    if err := json.Unmarshal(raw, &single); err == nil {
+        if strings.TrimSpace(single) == "" {
+            return nil, fmt.Errorf("text is required")
+        }
+        return []string{single}, nil
+    }
+
+    var batch []string
+    if err := json.Unmarshal(raw, &batch); err != nil {
+        return nil, fmt.Errorf("text must be a string or an array of strings")
+    }
+    if len(batch) == 0 {
+        return nil, fmt.Errorf("text array must not be empty")
+    }
+    return batch, nil
+}
+
+// buildTranslationPrompt renders the instruction prompt for a single text,
+// listing only the glossary terms that actually occur in it.
+func buildTranslationPrompt(sourceLang, targetLang, text string, glossary map[string]string) string {
+    var sb strings.Builder
+
+    source := sourceLang
+    if source == "" {
+        source = "the source language (detect it)"
+    }
+    sb.WriteString(fmt.Sprintf("Translate the following text from %s to %s.\n", source, targetLang))
+    sb.WriteString("Return only the translated text, with no explanations, quotes or notes.\n")
+
+    terms := applicableGlossaryTerms(text, glossary)
+    if len(terms) > 0 {
+        sb.WriteString("\nThe following glossary is mandatory. Each source term must be translated exactly as given:\n")
+        for _, term := range terms {
+            sb.WriteString(fmt.Sprintf("- \"%s\" => \"%s\"\n", term, glossary[term]))
+        }
+    }
+
+    sb.WriteString("\nText:\n")
+    sb.WriteString(text)
+    return sb.String()
+}
+
+// buildCorrectionPrompt asks the model to fix a translation that ignored glossary terms.
+func buildCorrectionPrompt(sourceLang, targetLang, text, previous string, violations []GlossaryViolation) string {
+    var sb strings.Builder
+    sb.WriteString(buildTranslationPrompt(sourceLang, targetLang, text, nil))
+    sb.WriteString("\n\nA previous translation was:\n")
+    sb.WriteString(previous)
+    sb.WriteString("\n\nIt did not respect the mandatory glossary. Produce a corrected translation that uses these exact translations:\n")
+    for _, v := range violations {
+        sb.WriteString(fmt.Sprintf("- \"%s\" must be translated as \"%s\"\n", v.Term, v.Expected))
+    }
+    sb.WriteString("Return only the corrected translated text.")
+    return sb.String()
+}
+
+// applicableGlossaryTerms returns the glossary terms present in text, sorted for a stable prompt.
+func applicableGlossaryTerms(text string, glossary map[string]string) []string {
+    lowerText := strings.ToLower(text)
+    var terms []string
+    for term := range glossary {
+        if term != "" && strings.Contains(lowerText, strings.ToLower(term)) {
+            terms = append(terms, term)
+        }
+    }
+    sort.Strings(terms)
+    return terms
+}
+
+// checkGlossary reports glossary terms that occur in the source but whose
+// required translation is missing from the output (case-insensitive substring check).
+func checkGlossary(source, translated string, glossary map[string]string) []GlossaryViolation {
+    lowerTranslated := strings.ToLower(translated)
+    var violations []GlossaryViolation
+    for _, term := range applicableGlossaryTerms(source, glossary) {
+        expected := glossary[term]
+        if !strings.Contains(lowerTranslated, strings.ToLower(expected)) {
+            violations = append(violations, GlossaryViolation{Term: term, Expected: expected})
+        }
+    }
+    return violations
+}
+
+// translateOne translates a single text, retrying once with corrections when glossary terms were missed.
+func (bc *BedrockClient) translateOne(ctx context.Context, req *TranslateRequest, model string, index int, text string) TranslationItem {
+    item := TranslationItem{Index: index}
+
+    prompt := buildTranslationPrompt(req.SourceLang, req.TargetLang, text, req.Glossary)
+    translated, modelUsed, err := bc.GenerateText(ctx, prompt, model, req.MaxTokens, translateTemperature)
+    if err != nil {
+        logWarnf(ctx, "Translation of item %d failed: %v", index, err)
+        item.Error = "translation failed"
+        return item
+    }
+    translated = strings.TrimSpace(translated)
+
+    violations := checkGlossary(text, translated, req.Glossary)
+    if len(violations) > 0 {
+        logInfof(ctx, "Item %d missed %d glossary terms, retrying with corrections", index, len(violations))
+        item.Retried = true
+
+        correction := buildCorrectionPrompt(req.SourceLang, req.TargetLang, text, translated, violations)
+        corrected, correctedModel, err := bc.GenerateText(ctx, correction, model, req.MaxTokens, translateTemperature)
+        if err != nil {
+            logWarnf(ctx, "Glossary correction of item %d failed: %v", index, err)
+        } else {
+            translated = strings.TrimSpace(corrected)
+            modelUsed = correctedModel
+            violations = checkGlossary(text, translated, req.Glossary)
+        }
+    }
+
+    item.Translation = translated
+    item.ModelUsed = modelUsed
+    item.GlossaryViolations = violations
+    return item
+}
+
+// Translate translates every text concurrently, preserving input order in the
+// result. It translates nothing if any text fails checkTranslateTexts.
+func (bc *BedrockClient) Translate(ctx context.Context, req *TranslateRequest, texts []string) ([]TranslationItem, *APIError) {
+    if apiErr := checkTranslateTexts(texts); apiErr != nil {
+        return nil, apiErr
+    }
+    model := req.Model
+    if model == "" {
+        model = os.Getenv("TRANSLATE_MODEL")
+    }
+
+    results := make([]TranslationItem, len(texts))
+    sem := make(chan struct{}, translateConcurrency)
+    var wg sync.WaitGroup
+
+    for i, text := range texts {
+        wg.Add(1)
+        go func(i int, text string) {
+            defer wg.Done()
+            sem <- struct{}{}
+            defer func() { <-sem }()
+            results[i] = bc.translateOne(ctx, req, model, i, text)
+        }(i, text)
+    }
+
+    wg.Wait()
+    return results, nil
+}
+
+func translateHandler(bc *BedrockClient) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req TranslateRequest
+
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid request body")
+            return
+        }
+
+        if req.TargetLang == "" {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: "target_lang is required",
+                Fields:  []FieldError{{Field: "target_lang", Message: "is required"}},
+            })
+            return
+        }
+
+        texts, err := req.texts()
+        if err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, err.Error())
+            return
+        }
+
+        logInfof(r.Context(), "Received translation request: %d item(s) %s -> %s, %d glossary terms",
+            len(texts), req.SourceLang, req.TargetLang, len(req.Glossary))
+
+        translations, apiErr := bc.Translate(r.Context(), &req, texts)
+        if apiErr != nil {
+            writeAPIError(w, r, http.StatusBadRequest, *apiErr)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(TranslateResponse{
+            SourceLang:   req.SourceLang,
+            TargetLang:   req.TargetLang,
+            Translations: translations,
+        })
+    }
+}
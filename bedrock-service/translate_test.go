@@ -0,0 +1,139 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestCheckTranslateTexts(t *testing.T) {
+    full := make([]string, maxTranslateTexts)
+    for i := range full {
+        full[i] = "Hello"
+    }
+    for _, c := range []struct {
+        name   string
+        texts  []string
+        fields []string // Fields named by the error; nil when accepted
+    }{
+        {"one", []string{"Hello"}, nil},
+        {"at the limit", full, nil},
+        {"over the limit", append(full, "One more"), []string{"text"}},
+        {"blank entries", []string{"Hello", "", "World", " \n\t"}, []string{"text[1]", "text[3]"}},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            apiErr := checkTranslateTexts(c.texts)
+            var fields []string
+            if apiErr != nil {
+                if apiErr.Code != ErrCodeValidation {
+                    t.Errorf("code %s", apiErr.Code)
+                }
+                for _, f := range apiErr.Fields {
+                    fields = append(fields, f.Field)
+                }
+            }
+            if !reflect.DeepEqual(fields, c.fields) {
+                t.Errorf("fields %v, want %v", fields, c.fields)
+            }
+        })
+    }
+}
+
+// Translate checks the batch itself, so no caller can run an oversized one
+func TestTranslateRejectsBatch(t *testing.T) {
+    const model = "mistral.mixtral-8x7b-instruct-v0:1"
+    bc, err := NewBedrockClient()
+    if err != nil {
+        t.Fatal(err)
+    }
+    before := len(fake.Calls(model))
+    for name, texts := range map[string][]string{
+        "over the limit": make([]string, maxTranslateTexts+1),
+        "blank entry":    {"Hello", ""},
+    } {
+        items, apiErr := bc.Translate(context.Background(), &TranslateRequest{TargetLang: "fr", Model: model}, texts)
+        if apiErr == nil || items != nil {
+            t.Errorf("%s: translated %+v", name, items)
+        }
+    }
+    if calls := len(fake.Calls(model)) - before; calls != 0 {
+        t.Errorf("%d model calls for rejected batches", calls)
+    }
+}
+
+func TestE2ETranslate(t *testing.T) {
+    const model = "mistral.mixtral-8x7b-instruct-v0:1"
+    answer := func(text string) fakeReply {
+        return fakeReply{Body: `{"outputs":[{"text":"` + text + `","stop_reason":"stop"}]}`}
+    }
+    translate := func(t *testing.T, body map[string]interface{}) (*http.Response, int) {
+        body["target_lang"], body["model"] = "French", model
+        before := len(fake.Calls(model))
+        resp := post(t, "/translate", body)
+        return resp, len(fake.Calls(model)) - before
+    }
+
+    t.Run("rejected batches", func(t *testing.T) {
+        for name, c := range map[string]struct {
+            text  interface{}
+            field string
+        }{
+            "over the limit": {make([]string, maxTranslateTexts+1), "text"},
+            "blank entry":    {[]string{"Good morning", "  "}, "text[1]"},
+        } {
+            resp, calls := translate(t, map[string]interface{}{"text": c.text})
+            var rejected errorEnvelope
+            decode(t, resp, &rejected)
+            if resp.StatusCode != http.StatusBadRequest || len(rejected.Error.Fields) != 1 || rejected.Error.Fields[0].Field != c.field {
+                t.Errorf("%s: status %d, error %+v; want 400 naming %s", name, resp.StatusCode, rejected.Error, c.field)
+            }
+            if calls != 0 {
+                t.Errorf("%s: %d model calls", name, calls)
+            }
+        }
+    })
+
+    // A translation missing a glossary term is retried once with the terms
+    // it missed; what's still missing after that is reported
+    for _, c := range []struct {
+        name       string
+        replies    []fakeReply
+        want       string
+        retried    bool
+        violations []GlossaryViolation
+    }{
+        {"glossary respected", []fakeReply{answer("Bonjour, cher utilisateur")}, "Bonjour, cher utilisateur", false, nil},
+        {"corrected on retry", []fakeReply{answer("Bonjour, cher client"), answer("Bonjour, cher utilisateur")}, "Bonjour, cher utilisateur", true, nil},
+        {"still missing", []fakeReply{answer("Bonjour, cher client"), answer("Salut, cher client")}, "Salut, cher client", true,
+            []GlossaryViolation{{Term: "user", Expected: "utilisateur"}}},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            fake.Script(model, c.replies...)
+            resp, calls := translate(t, map[string]interface{}{
+                "text":     "Hello, dear user (" + c.name + ")",
+                "glossary": map[string]string{"user": "utilisateur", "admin": "administrateur"},
+            })
+            var out TranslateResponse
+            decode(t, resp, &out)
+            if resp.StatusCode != http.StatusOK || len(out.Translations) != 1 {
+                t.Fatalf("status %d, %+v", resp.StatusCode, out)
+            }
+            item := out.Translations[0]
+            if item.Translation != c.want || item.Retried != c.retried || !reflect.DeepEqual(item.GlossaryViolations, c.violations) {
+                t.Errorf("%+v, want %q retried %v with violations %+v", item, c.want, c.retried, c.violations)
+            }
+            if calls != len(c.replies) {
+                t.Errorf("%d model calls, want %d", calls, len(c.replies))
+            }
+            if c.retried {
+                retry := fake.Calls(model)
+                body := string(retry[len(retry)-1].Body)
+                if !strings.Contains(body, `must be translated as \"utilisateur\"`) || strings.Contains(body, "administrateur") {
+                    t.Errorf("correction prompt should name only the missed term: %s", body)
+                }
+            }
+        })
+    }
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+    "unicode"
+)
+
+// Truncation settings
+const (
+    maxTruncateSegments = 1000
+    segmentSeparator    = "\n\n" // Between kept segments in the returned text
+)
+
+// Segment outcomes
+const (
+    segmentKept    = "kept"
+    segmentTrimmed = "trimmed"
+    segmentDropped = "dropped"
+)
+
+// TruncateSegment is one labeled piece of caller context. Higher priorities
+// are kept longer; among equal priorities, earlier segments are kept longer.
+type TruncateSegment struct {
+    Label    string `json:"label,omitempty"`
+    Text     string `json:"text"`
+    Priority int    `json:"priority,omitempty"`
+}
+
+// TruncateRequest is the body accepted by POST /truncate. Exactly one of
+// Text and Segments is set.
+type TruncateRequest struct {
+    Text        string            `json:"text,omitempty"`
+    Segments    []TruncateSegment `json:"segments,omitempty"`
+    TokenBudget int               `json:"token_budget"`
+    Model       string            `json:"model,omitempty"`    // Budget is checked against this model's context window
+    Boundary    string            `json:"boundary,omitempty"` // "sentence" trims to a sentence end; default trims anywhere
+}
+
+// SegmentResult reports what happened to one segment
+type SegmentResult struct {
+    Label         string `json:"label,omitempty"`
+    Priority      int    `json:"priority"`
+    Status        string `json:"status"` // kept, trimmed or dropped
+    Tokens        int    `json:"tokens"`
+    KeptTokens    int    `json:"kept_tokens"`
+    DroppedTokens int    `json:"dropped_tokens"`
+}
+
+// TruncateResponse carries the fitted text. Tokens is the estimate of the
+// whole returned text, which is what the context-window pre-check counts;
+// per-segment counts are estimated separately and can differ from it by
+// rounding and separators.
+type TruncateResponse struct {
+    Text          string          `json:"text"`
+    Tokens        int             `json:"tokens"`
+    TokenBudget   int             `json:"token_budget"`
+    Truncated     bool            `json:"truncated"`
+    Model         string          `json:"model,omitempty"`
+    ContextWindow int             `json:"context_window,omitempty"`
+    Segments      []SegmentResult `json:"segments"`
+}
+
+func (req *TruncateRequest) validate() []FieldError {
+    var problems []FieldError
+    switch {
+    case req.Text != "" && len(req.Segments) > 0:
+        problems = append(problems, FieldError{Field: "segments", Message: "must not be combined with text"})
+    case req.Text == "" && len(req.Segments) == 0:
+        problems = append(problems, FieldError{Field: "text", Message: "text or segments is required"})
+    case len(req.Segments) > maxTruncateSegments:
+        problems = append(problems, FieldError{Field: "segments", Message: fmt.Sprintf("must have at most %d entries", maxTruncateSegments)})
+    }
+    if req.TokenBudget < 1 {
+        problems = append(problems, FieldError{Field: "token_budget", Message: "must be a positive number of tokens"})
+    }
+    if req.Boundary != "" && req.Boundary != "sentence" {
+        problems = append(problems, FieldError{Field: "boundary", Message: "must be \"sentence\" or omitted"})
+    }
+    return problems
+}
+
+// sentencePrefix shortens runes to the last complete sentence: up to
+// sentence-ending punctuation followed by whitespace, or a line break
+func sentencePrefix(runes []rune, n int) int {
+    for i := n; i > 0; i-- {
+        c := runes[i-1]
+        if c == '\n' {
+            return i
+        }
+        if (c == '.' || c == '!' || c == '?') && (i == len(runes) || unicode.IsSpace(runes[i])) {
+            return i
+        }
+    }
+    return 0
+}
+
+// truncateSegments fits segments into budget tokens as estimated by
+// tokensForRunes, the estimator behind every pre-check. Lowest priority
+// segments are dropped first; the segment whose removal would be enough is
+// tail-trimmed instead, so the budget is used rather than left empty.
+func truncateSegments(segments []TruncateSegment, budget int, sentences bool) (string, []SegmentResult) {
+    keptRunes := make([]int, len(segments)) // Length of each segment's kept prefix
+    runes := make([][]rune, len(segments))
+    results := make([]SegmentResult, len(segments))
+    for i, s := range segments {
+        runes[i] = []rune(s.Text)
+        keptRunes[i] = len(runes[i])
+        tokens := tokensForRunes(len(runes[i]))
+        results[i] = SegmentResult{Label: s.Label, Priority: s.Priority, Status: segmentKept, Tokens: tokens, KeptTokens: tokens}
+    }
+    separator := len([]rune(segmentSeparator))
+    total := func() int {
+        n, parts := 0, 0
+        for _, k := range keptRunes {
+            if k > 0 {
+                n += k
+                parts++
+            }
+        }
+        if parts > 1 {
+            n += (parts - 1) * separator
+        }
+        return tokensForRunes(n)
+    }
+
+    // Lowest priority first; later segments go before earlier ones
+    order := make([]int, len(segments))
+    for i := range order {
+        order[i] = len(segments) - 1 - i
+    }
+    sort.SliceStable(order, func(a, b int) bool { return segments[order[a]].Priority < segments[order[b]].Priority })
+
+    for _, i := range order {
+        if total() <= budget {
+            break
+        }
+        keptRunes[i] = 0
+        if total() > budget {
+            continue // Dropping it entirely isn't enough
+        }
+
+        // Keep the longest prefix that fits; estimates only grow with length
+        lo, hi := 0, len(runes[i])
+        for lo < hi {
+            mid := (lo + hi + 1) / 2
+            keptRunes[i] = mid
+            if total() <= budget {
+                lo = mid
+            } else {
+                hi = mid - 1
+            }
+        }
+        if sentences {
+            lo = sentencePrefix(runes[i], lo)
+        }
+        for lo > 0 && unicode.IsSpace(runes[i][lo-1]) {
+            lo--
+        }
+        keptRunes[i] = lo
+    }
+
+    var parts []string
+    for i := range results {
+        results[i].KeptTokens = tokensForRunes(keptRunes[i])
+        results[i].DroppedTokens = results[i].Tokens - results[i].KeptTokens
+        switch {
+        case keptRunes[i] == 0 && len(runes[i]) > 0:
+            results[i].Status = segmentDropped
+        case keptRunes[i] < len(runes[i]):
+            results[i].Status = segmentTrimmed
+        }
+        if keptRunes[i] > 0 {
+            parts = append(parts, string(runes[i][:keptRunes[i]]))
+        }
+    }
+    return strings.Join(parts, segmentSeparator), results
+}
+
+// truncateHandler serves POST /truncate
+func truncateHandler(bc *BedrockClient) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req TruncateRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, r, http.StatusBadRequest, ErrCodeValidation, "Invalid JSON")
+            return
+        }
+        if problems := req.validate(); len(problems) > 0 {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: "Invalid truncation request",
+                Fields:  problems,
+            })
+            return
+        }
+
+        // The budget has to fit the model the text is meant for
+        window, name, ok := bc.modelWindow(req.Model)
+        if !ok && req.Model == "" {
+            writeError(w, r, http.StatusServiceUnavailable, ErrCodeModelUnavailable, "No models configured")
+            return
+        }
+        if !ok {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: fmt.Sprintf("Unknown model %q", req.Model),
+                Fields:  []FieldError{{Field: "model", Message: "is not a configured model"}},
+            })
+            return
+        }
+        if req.TokenBudget > window {
+            writeAPIError(w, r, http.StatusBadRequest, APIError{
+                Code:    ErrCodeValidation,
+                Message: fmt.Sprintf("token_budget exceeds the %d token context window of %s", window, name),
+                Fields:  []FieldError{{Field: "token_budget", Message: fmt.Sprintf("must be at most %d", window)}},
+            })
+            return
+        }
+
+        segments := req.Segments
+        if req.Text != "" {
+            segments = []TruncateSegment{{Text: req.Text}}
+        }
+        text, results := truncateSegments(segments, req.TokenBudget, req.Boundary == "sentence")
+
+        resp := TruncateResponse{
+            Text:          text,
+            Tokens:        estimateTokens(text),
+            TokenBudget:   req.TokenBudget,
+            Model:         name,
+            ContextWindow: window,
+            Segments:      results,
+        }
+        for _, result := range results {
+            if result.Status != segmentKept {
+                resp.Truncated = true
+            }
+        }
+        metrics.Inc("truncate_requests_total", "truncated", fmt.Sprint(resp.Truncated))
+        writeJSON(w, r, resp)
+    }
+}
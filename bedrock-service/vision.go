@@ -0,0 +1,252 @@
+package main
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+
+    "github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// A message's content is a string, or an array of content blocks mixing
+// text with images for the models that see them, the registry's vision
+// models:
+//
+//    {"role": "user", "content": [
+//        {"type": "image", "media_type": "image/png", "data": "<base64>"},
+//        {"type": "text", "text": "What is in this picture?"}]}
+//
+// A message's text blocks, joined, stand in for its content wherever only
+// text counts, and the blocks themselves are sent to messages and Converse
+// models in order. A request carrying images skips the models of its chain
+// that can't see them rather than failing on the first.
+
+// Content block types
+const (
+    blockText  = "text"
+    blockImage = "image"
+)
+
+// Limits on images in a request. Bedrock rejects bodies over 20 MB, and
+// base64 grows images by a third, so the images of one request are held
+// under 15 MB. REQUEST_MAX_BODY_BYTES bounds the whole request first.
+const (
+    maxInputImages          = 20
+    maxInputImageBytes      = 3750000 // Per image, decoded, as the Anthropic models take them
+    maxInputImageTotalBytes = 15000000
+)
+
+// imageTokenEstimate is charged for an image when estimating input tokens.
+// Anthropic scales images down to about 1600 tokens at most.
+const imageTokenEstimate = 1600
+
+// imageInputFormats are the media types images may have, with the Converse
+// format of each
+var imageInputFormats = map[string]types.ImageFormat{
+    "image/gif":  types.ImageFormatGif,
+    "image/jpeg": types.ImageFormatJpeg,
+    "image/png":  types.ImageFormatPng,
+    "image/webp": types.ImageFormatWebp,
+}
+
+// errImagesUnsupported is why a request with images skipped a model
+var errImagesUnsupported = errors.New("doesn't accept images")
+
+// ContentBlock is one block of a message's content array
+type ContentBlock struct {
+    Type      string `json:"type"` // text or image
+    Text      string `json:"text,omitempty"`
+    MediaType string `json:"media_type,omitempty"` // An image's: image/png, image/jpeg, image/gif or image/webp
+    Data      string `json:"data,omitempty"`       // An image's bytes, base64
+}
+
+// UnmarshalJSON reads content given as a string or as content blocks
+func (m *ChatMessage) UnmarshalJSON(data []byte) error {
+    var raw struct {
+        Role    string          `json:"role"`
+        Content json.RawMessage `json:"content"`
+    }
+    if err := json.Unmarshal(data, &raw); err != nil {
+        return err
+    }
+    *m = ChatMessage{Role: raw.Role}
+    content := bytes.TrimSpace(raw.Content)
+    if len(content) == 0 || content[0] != '[' {
+        if len(content) == 0 || string(content) == "null" {
+            return nil
+        }
+        return json.Unmarshal(content, &m.Content)
+    }
+    if err := json.Unmarshal(content, &m.Blocks); err != nil {
+        return err
+    }
+    if m.Blocks == nil {
+        m.Blocks = []ContentBlock{}
+    }
+    m.Content = blocksText(m.Blocks)
+    return nil
+}
+
+// MarshalJSON writes the content blocks a message was given as, or its
+// content string
+func (m ChatMessage) MarshalJSON() ([]byte, error) {
+    if m.Blocks == nil {
+        return json.Marshal(struct {
+            Role    string `json:"role"`
+            Content string `json:"content"`
+        }{m.Role, m.Content})
+    }
+    return json.Marshal(struct {
+        Role    string         `json:"role"`
+        Content []ContentBlock `json:"content"`
+    }{m.Role, m.Blocks})
+}
+
+// blocksText is the text of content blocks, one block to a line
+func blocksText(blocks []ContentBlock) string {
+    var text []string
+    for _, b := range blocks {
+        if b.Type == blockText {
+            text = append(text, b.Text)
+        }
+    }
+    return strings.Join(text, "\n")
+}
+
+// images counts the message's images
+func (m ChatMessage) images() int {
+    n := 0
+    for _, b := range m.Blocks {
+        if b.Type == blockImage {
+            n++
+        }
+    }
+    return n
+}
+
+// imageTotals adds up the images of a request as its messages are checked
+type imageTotals struct {
+    count int
+    bytes int
+}
+
+// checkContentBlocks checks the content blocks of the message at field,
+// naming the block at fault by its index
+func checkContentBlocks(field string, m ChatMessage, totals *imageTotals) []FieldError {
+    var problems []FieldError
+    for j, b := range m.Blocks {
+        at := fmt.Sprintf("%s.content[%d]", field, j)
+        switch b.Type {
+        case blockText:
+            if strings.TrimSpace(b.Text) == "" {
+                problems = append(problems, FieldError{Field: at + ".text", Message: "is required"})
+            }
+        case blockImage:
+            if m.Role != roleUser {
+                problems = append(problems, FieldError{Field: at, Message: "images are only accepted in user messages"})
+                continue
+            }
+            if _, ok := imageInputFormats[b.MediaType]; !ok {
+                problems = append(problems, FieldError{Field: at + ".media_type", Message: "must be image/gif, image/jpeg, image/png or image/webp"})
+                continue
+            }
+            data, err := base64.StdEncoding.DecodeString(b.Data)
+            switch {
+            case b.Data == "":
+                problems = append(problems, FieldError{Field: at + ".data", Message: "is required"})
+            case err != nil:
+                problems = append(problems, FieldError{Field: at + ".data", Message: "is not valid base64"})
+            case len(data) > maxInputImageBytes:
+                problems = append(problems, FieldError{Field: at + ".data", Message: fmt.Sprintf("is %d bytes, more than the %d an image may be", len(data), maxInputImageBytes)})
+            case http.DetectContentType(data) != b.MediaType:
+                problems = append(problems, FieldError{Field: at + ".data", Message: "does not match media_type " + b.MediaType})
+            }
+            totals.count++
+            totals.bytes += len(data)
+        default:
+            problems = append(problems, FieldError{Field: at + ".type", Message: "must be \"text\" or \"image\""})
+        }
+    }
+    return problems
+}
+
+// problems checks the totals against the request-wide limits
+func (totals imageTotals) problems() []FieldError {
+    var problems []FieldError
+    if totals.count > maxInputImages {
+        problems = append(problems, FieldError{Field: "messages", Message: fmt.Sprintf("carry %d images, more than %d", totals.count, maxInputImages)})
+    }
+    if totals.bytes > maxInputImageTotalBytes {
+        problems = append(problems, FieldError{Field: "messages", Message: fmt.Sprintf("carry %d bytes of images, more than %d", totals.bytes, maxInputImageTotalBytes)})
+    }
+    return problems
+}
+
+// promptBlocks is the content blocks of the request's final user turn, nil
+// when it was given as a string
+func (req *GenerateRequest) promptBlocks() []ContentBlock {
+    if len(req.Messages) == 0 {
+        return nil
+    }
+    return req.Messages[len(req.Messages)-1].Blocks
+}
+
+// turn is the final user turn of the generation
+func (p GenerationParams) turn() ChatMessage {
+    return ChatMessage{Role: roleUser, Content: p.Prompt, Blocks: p.PromptBlocks}
+}
+
+// hasImages reports whether any turn of the generation carries an image
+func (p GenerationParams) hasImages() bool {
+    for _, m := range append(p.History[:len(p.History):len(p.History)], p.turn()) {
+        if m.images() > 0 {
+            return true
+        }
+    }
+    return false
+}
+
+// anthropicContent is the messages API content of m: its string, or its
+// blocks
+func anthropicContent(m ChatMessage) interface{} {
+    if m.Blocks == nil {
+        return m.Content
+    }
+    content := make([]map[string]interface{}, 0, len(m.Blocks))
+    for _, b := range m.Blocks {
+        if b.Type == blockImage {
+            content = append(content, map[string]interface{}{
+                "type":   "image",
+                "source": map[string]interface{}{"type": "base64", "media_type": b.MediaType, "data": b.Data},
+            })
+            continue
+        }
+        content = append(content, map[string]interface{}{"type": "text", "text": b.Text})
+    }
+    return content
+}
+
+// converseContent is the Converse content of m. The images were checked
+// when the request was, so they decode.
+func converseContent(m ChatMessage) []types.ContentBlock {
+    if m.Blocks == nil {
+        return []types.ContentBlock{&types.ContentBlockMemberText{Value: m.Content}}
+    }
+    content := make([]types.ContentBlock, 0, len(m.Blocks))
+    for _, b := range m.Blocks {
+        if b.Type == blockImage {
+            data, _ := base64.StdEncoding.DecodeString(b.Data)
+            content = append(content, &types.ContentBlockMemberImage{Value: types.ImageBlock{
+                Format: imageInputFormats[b.MediaType],
+                Source: &types.ImageSourceMemberBytes{Value: data},
+            }})
+            continue
+        }
+        content = append(content, &types.ContentBlockMemberText{Value: b.Text})
+    }
+    return content
+}